@@ -1,20 +1,36 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"flag"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"lmbroker/internal/broker"
 	"lmbroker/internal/config"
-
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"lmbroker/internal/tracing"
 )
 
 func main() {
+	// Resolve the config file from --config/-c, then LMBROKER_CONFIG.
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "path to the configuration file (env LMBROKER_CONFIG, default config.toml)")
+	flag.StringVar(&configPath, "c", "", "shorthand for --config")
+	flag.Parse()
+	if configPath == "" {
+		configPath = os.Getenv("LMBROKER_CONFIG")
+	}
+	if configPath == "" {
+		configPath = "config.toml"
+	}
+
 	// Load configuration first (with basic logging).
-	cfg, err := config.Load("config.toml")
+	cfg, err := config.Load(configPath)
 	if err != nil {
 		slog.Error("failed to load configuration", "error", err)
 		os.Exit(1)
@@ -40,33 +56,145 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
-	slog.Info("configuration loaded successfully", "log_level", cfg.LogLevel)
+	slog.Info("configuration loaded successfully", "path", configPath, "log_level", cfg.LogLevel)
+
+	// Export traces to the OTLP collector if enabled.
+	var tracer *tracing.Tracer
+	if cfg.Tracing.Enabled {
+		tracer = tracing.New(tracing.Options{
+			Endpoint:    cfg.Tracing.Endpoint,
+			ServiceName: cfg.Tracing.ServiceName,
+			Headers:     cfg.Tracing.Headers,
+		})
+		tracing.SetDefault(tracer)
+		slog.Info("trace export enabled", "endpoint", cfg.Tracing.Endpoint)
+	}
 
 	// Create a new broker instance.
 	brk := broker.New(cfg)
 
-	// Create a new ServeMux to register our routes.
-	mux := http.NewServeMux()
+	// SIGTERM and SIGINT start a graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
 
-	// Register the health check endpoint.
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "OK")
-	})
+	// Reload models on SIGHUP, and on file changes if enabled.
+	go reloadOnSignal(configPath, brk)
+	if cfg.Server.WatchConfig {
+		go watchConfig(configPath, brk)
+	}
+	if interval := cfg.Server.SecretRefreshDuration; interval > 0 {
+		go refreshSecrets(configPath, brk, interval)
+	}
 
-	// Register Prometheus metrics handler.
-	mux.Handle("/metrics", promhttp.Handler())
+	// Create a new ServeMux to register our routes.
+	mux := http.NewServeMux()
 
-	// Register the main broker handlers from the plan.
-	mux.HandleFunc("/v1/chat/completions", brk.HandleChatCompletions)
-	mux.HandleFunc("/v1/messages", brk.HandleChatCompletions) // Anthropic format
-	mux.HandleFunc("/v1/embeddings", brk.HandleEmbeddings)
+	// Register the broker's routes and start probing backends. New routes
+	// go in config.BrokerRoutes, so embedding_paths cannot take them.
+	for _, route := range brk.Routes() {
+		mux.Handle(route.Path, route.Handler)
+	}
+	brk.StartHealthChecks(ctx)
 
-	// Start the server.
+	// Start the server, on a Unix domain socket if one is configured.
 	address := cfg.Server.Address()
-	slog.Info("starting server", "address", address, "host", cfg.Server.Host, "port", cfg.Server.Port)
-	if err := http.ListenAndServe(address, mux); err != nil {
+	network := "tcp"
+	if cfg.Server.Socket != "" {
+		address, network = cfg.Server.Socket, "unix"
+		// A socket file left behind by an earlier run would block the bind.
+		os.Remove(address)
+	}
+	server := &http.Server{
+		Addr:    address,
+		Handler: brk.ResolveClientIP(brk.AccessLog(brk.Trace(brk.Observe(brk.LimitRequestBodies(brk.RecordUsage(brk.LogRequests(brk.LogContent(brk.Authenticate(brk.RunAsync(brk.EnforceQuotas(brk.ReportCost(mux)))))))))))),
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("starting server", "address", address, "network", network)
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			serveErr <- err
+			return
+		}
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
 		slog.Error("server failed to start", "error", err, "address", address)
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// Stop accepting connections and let in-flight requests, including
+	// streams, finish within the drain timeout.
+	stop()
+	slog.Info("shutting down, draining in-flight requests", "timeout", cfg.Server.ShutdownTimeoutDuration.String())
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeoutDuration)
+	defer cancel()
+	if err := server.Shutdown(drainCtx); err != nil {
+		slog.Warn("drain timeout reached, closing remaining connections", "error", err)
+		server.Close()
+	}
+	if err := brk.Close(); err != nil {
+		slog.Warn("failed to close broker files", "error", err)
+	}
+	if tracer != nil {
+		flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelFlush()
+		if err := tracer.Shutdown(flushCtx); err != nil {
+			slog.Warn("failed to flush traces", "error", err)
+		}
+	}
+	slog.Info("server stopped")
+}
+
+// reloadConfig re-reads the configuration file and hands it to the broker.
+// An invalid file is logged and the running configuration is kept.
+func reloadConfig(path string, brk *broker.Broker) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		slog.Error("failed to reload configuration, keeping the current one", "error", err, "path", path)
+		return
+	}
+	brk.Reload(cfg)
+}
+
+// reloadOnSignal reloads the configuration every time the process receives
+// SIGHUP.
+func reloadOnSignal(path string, brk *broker.Broker) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		slog.Info("received SIGHUP, reloading configuration", "path", path)
+		reloadConfig(path, brk)
+	}
+}
+
+// refreshSecrets reloads the configuration at a fixed interval, resolving
+// secret references again.
+func refreshSecrets(path string, brk *broker.Broker, interval time.Duration) {
+	for range time.Tick(interval) {
+		slog.Debug("refreshing secrets", "path", path)
+		reloadConfig(path, brk)
+	}
+}
+
+// watchConfig polls the configuration file and reloads it when its
+// modification time or size changes.
+func watchConfig(path string, brk *broker.Broker) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(path); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+	for range time.Tick(2 * time.Second) {
+		info, err := os.Stat(path)
+		if err != nil || (info.ModTime().Equal(lastMod) && info.Size() == lastSize) {
+			continue
+		}
+		lastMod, lastSize = info.ModTime(), info.Size()
+		slog.Info("configuration file changed, reloading", "path", path)
+		reloadConfig(path, brk)
 	}
 }
@@ -6,10 +6,32 @@ import "net/http"
 // It's designed to be a superset of the common fields across different APIs.
 type UnifiedChatRequest struct {
 	Model       string
+	// System is the system prompt carried outside the conversation, as
+	// Anthropic's top-level system field. Backends whose dialect has no such
+	// field send it as a leading system message.
+	System      string
 	Messages    []UnifiedMessage
 	Stream      bool
+	// MaxTokens limits the tokens generated for the response; zero means
+	// the client set no limit.
+	MaxTokens   int
+	// N is the number of choices to generate (OpenAI n); zero or one asks
+	// for a single choice.
+	N           int
+	// Stop lists sequences that end generation when the model produces them.
+	Stop        []string
 	Tools       []UnifiedTool
 	ToolChoice  interface{}
+	// ReplayStream is set by client adapters that render a stream from the
+	// complete response, which chat translation always does. The backend is called without streaming and the
+	// response is marked with Stream.
+	ReplayStream bool
+	// IncludeUsage asks for the token usage at the end of a replayed
+	// stream (OpenAI stream_options.include_usage).
+	IncludeUsage bool
+	// LegacyFunctions is set when the client used the legacy functions API,
+	// so the response is rendered in that shape.
+	LegacyFunctions bool
 	// Parameters holds provider-specific parameters that don't have a common mapping.
 	Parameters map[string]interface{}
 }
@@ -21,6 +43,17 @@ type UnifiedMessage struct {
 	ToolCalls    []UnifiedToolCall
 	ToolCallID   string
 	Name         string
+	// Images holds images attached to the message, such as user-supplied
+	// pictures or screenshots returned in a tool result.
+	Images []UnifiedImage
+}
+
+// UnifiedImage is an image carried either inline (base64 Data with its
+// MediaType) or by reference (URL).
+type UnifiedImage struct {
+	MediaType string
+	Data      string
+	URL       string
 }
 
 // UnifiedToolCall represents a call to a tool function.
@@ -40,6 +73,36 @@ type UnifiedFunctionCall struct {
 type UnifiedTool struct {
 	Type     string          `json:"type"`
 	Function UnifiedFunction `json:"function"`
+	// WebSearch configures the provider-hosted search tool (Type "web_search").
+	WebSearch *UnifiedWebSearch `json:"-"`
+	// Computer configures a computer-use tool (Type "computer").
+	Computer *UnifiedComputer `json:"-"`
+}
+
+// UnifiedComputer describes the virtual display a computer-use tool controls.
+type UnifiedComputer struct {
+	DisplayWidth  int
+	DisplayHeight int
+	DisplayNumber int
+	Environment   string // OpenAI only: browser, mac, windows, ubuntu
+}
+
+// UnifiedWebSearch holds the options of a provider-hosted web search tool.
+// Fields without an equivalent in the target dialect are dropped.
+type UnifiedWebSearch struct {
+	MaxUses        int
+	AllowedDomains []string
+	BlockedDomains []string
+	UserLocation   *UnifiedUserLocation
+	ContextSize    string // OpenAI search_context_size: low, medium, high
+}
+
+// UnifiedUserLocation is an approximate location used to localize search results.
+type UnifiedUserLocation struct {
+	City     string
+	Region   string
+	Country  string
+	Timezone string
 }
 
 // UnifiedFunction represents the definition of a function tool.
@@ -57,9 +120,41 @@ type UnifiedChatResponse struct {
 	Model      string
 	Role       string
 	Content    string
+	// Reasoning is the thinking a reasoning model showed before its answer.
+	// ReasoningSignature is Anthropic's integrity token for it, which
+	// Anthropic needs back when the turn is continued.
+	Reasoning          string
+	ReasoningSignature string
 	ToolCalls  []UnifiedToolCall
 	StopReason string
+	// StopSequence is the stop sequence that ended generation, if the
+	// backend reports it (Anthropic stop_reason "stop_sequence").
+	StopSequence string
 	Usage      UnifiedUsage
+	// Citations reference web sources backing spans of Content.
+	Citations []UnifiedCitation
+	// Stream asks the client adapter to deliver the response as an event
+	// stream (see UnifiedChatRequest.ReplayStream).
+	Stream bool
+	// IncludeUsage adds a usage chunk to the end of an OpenAI-format stream.
+	IncludeUsage bool
+	// LegacyFunctions renders tool calls as legacy function_call messages
+	// (see UnifiedChatRequest.LegacyFunctions).
+	LegacyFunctions bool
+	// AdditionalChoices holds the choices after the first when the request
+	// asked for several. Only their Role, Content, Reasoning, ToolCalls,
+	// StopReason and Citations are set; Usage above covers all choices.
+	AdditionalChoices []UnifiedChatResponse
+}
+
+// UnifiedCitation attributes the span [StartIndex, EndIndex) of the response
+// content (in characters) to a web source.
+type UnifiedCitation struct {
+	URL        string
+	Title      string
+	CitedText  string
+	StartIndex int
+	EndIndex   int
 }
 
 // UnifiedUsage represents token usage information.
@@ -71,13 +166,101 @@ type UnifiedUsage struct {
 // UnifiedEmbeddingRequest is a provider-agnostic representation of an embedding request.
 type UnifiedEmbeddingRequest struct {
 	Input []string
-	Model string
+	// Tokens holds pre-tokenized inputs; it is set instead of Input when the
+	// client sent token-ID arrays.
+	Tokens [][]int
+	// Contents holds multimodal inputs (text and images, possibly mixed
+	// within one input); it is set instead of Input when any image is present.
+	Contents [][]UnifiedEmbeddingPart
+	Model    string
+	// InputType is a retrieval hint ("query" or "document") for providers
+	// that distinguish between the two.
+	InputType string
+	// EncodingFormat is the client's requested vector encoding ("float" or "base64").
+	EncodingFormat string
+	// Dimensions requests truncated output vectors; zero means the model default.
+	Dimensions int
+	// Truncate says whether inputs longer than the model's context are cut
+	// to fit (true) or rejected (false); nil leaves it to the backend.
+	Truncate *bool
+}
+
+// UnifiedEmbeddingPart is one piece of a multimodal embedding input.
+type UnifiedEmbeddingPart struct {
+	Type string // "text" or "image"
+	Text string
+	// ImageURL is either an http(s) URL or a data: URI carrying base64 image bytes.
+	ImageURL string
 }
 
 // UnifiedEmbeddingResponse is a provider-agnostic representation of an embedding response.
 type UnifiedEmbeddingResponse struct {
+	// ID is the backend's response ID, if it gives one.
+	ID         string
 	Embeddings [][]float32
 	Model      string
+	// EncodingFormat controls how embeddings are rendered for the client.
+	EncodingFormat string
+	// Usage holds the tokens the backend billed in InputTokens; zero if it
+	// reported none.
+	Usage UnifiedUsage
+}
+
+// UnifiedCompletionRequest is a provider-agnostic representation of a legacy
+// text completion request (/v1/completions).
+type UnifiedCompletionRequest struct {
+	Model     string
+	Prompt    string
+	MaxTokens int
+	Stop      []string
+	Stream    bool
+	// Parameters holds the remaining sampling fields (temperature, top_p, ...).
+	Parameters map[string]interface{}
+}
+
+// UnifiedCompletionResponse is a provider-agnostic representation of a text
+// completion response.
+type UnifiedCompletionResponse struct {
+	ID           string
+	Model        string
+	Text         string
+	FinishReason string
+	Usage        UnifiedUsage
+	// Stream renders the response as server-sent events for clients that
+	// asked for a streamed completion.
+	Stream bool
+}
+
+// UnifiedImageRequest is a provider-agnostic representation of an image
+// generation request.
+type UnifiedImageRequest struct {
+	Model  string
+	Prompt string
+	N      int
+	Size   string
+	// Quality and Style are model-specific hints (e.g. "hd", "vivid").
+	Quality string
+	Style   string
+	// ResponseFormat is "url" or "b64_json".
+	ResponseFormat string
+	// Parameters holds provider-specific fields without a common mapping.
+	Parameters map[string]interface{}
+}
+
+// UnifiedImageResponse is a provider-agnostic representation of an image
+// generation response.
+type UnifiedImageResponse struct {
+	Created int64
+	Images  []UnifiedGeneratedImage
+	Usage   UnifiedUsage
+}
+
+// UnifiedGeneratedImage is one generated image, returned either by URL or
+// inline as base64.
+type UnifiedGeneratedImage struct {
+	URL           string
+	B64JSON       string
+	RevisedPrompt string
 }
 
 // Adapter defines the full suite of translation capabilities.
@@ -100,3 +283,24 @@ type Adapter interface {
 	TranslateError(backendResp *http.Response) []byte
 }
 
+// ChoicesAdapter is implemented by backend adapters whose API can generate
+// several choices for one request. For the others, the translation workflow
+// can emulate n with parallel requests.
+type ChoicesAdapter interface {
+	SupportsChoices() bool
+}
+
+// CompletionAdapter is implemented by client adapters that can serve the
+// legacy text completion endpoint.
+type CompletionAdapter interface {
+	ClientCompletionToUnified(*http.Request) (*UnifiedCompletionRequest, error)
+	UnifiedCompletionToClient(*UnifiedCompletionResponse, http.ResponseWriter) error
+}
+
+// ImageAdapter is implemented by adapters that support image generation.
+type ImageAdapter interface {
+	ClientImageToUnified(*http.Request) (*UnifiedImageRequest, error)
+	UnifiedImageToBackend(*UnifiedImageRequest, string) (*http.Request, error)
+	BackendImageToUnified(*http.Response) (*UnifiedImageResponse, error)
+	UnifiedImageToClient(*UnifiedImageResponse, http.ResponseWriter) error
+}
@@ -5,27 +5,38 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 )
 
 // AnthropicAdapter implements the Adapter interface for the Anthropic API.
 type AnthropicAdapter struct{}
 
+// defaultAnthropicMaxTokens is sent as the required max_tokens when neither
+// the client nor the model configuration sets a limit.
+const defaultAnthropicMaxTokens = 4096
+
 // --- Chat Completion Operations ---
 
 func (a *AnthropicAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatRequest, error) {
 	var anthropicReq struct {
 		Model      string `json:"model"`
 		MaxTokens  int    `json:"max_tokens"`
+		Stream     bool   `json:"stream"`
+		System     interface{} `json:"system"` // String or []map[string]interface{} of text blocks
 		Messages   []struct {
 			Role    string      `json:"role"`
 			Content interface{} `json:"content"` // Can be string or []map[string]interface{}
 		} `json:"messages"`
-		Tools      []struct {
-			Name        string                 `json:"name"`
-			Description string                 `json:"description"`
-			InputSchema map[string]interface{} `json:"input_schema"`
-		} `json:"tools"`
+		Tools      []map[string]interface{} `json:"tools"` // Function and server tools
 		ToolChoice interface{} `json:"tool_choice"`
+		// Sampling parameters
+		Temperature   *float64 `json:"temperature"`
+		TopP          *float64 `json:"top_p"`
+		TopK          *int     `json:"top_k"`
+		StopSequences []string `json:"stop_sequences"`
+		Metadata      struct {
+			UserID string `json:"user_id"`
+		} `json:"metadata"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&anthropicReq); err != nil {
@@ -40,7 +51,7 @@ func (a *AnthropicAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReq
 		if contentStr, ok := msg.Content.(string); ok {
 			unifiedMessages[i].Content = contentStr
 		} else if contentBlocks, ok := msg.Content.([]interface{}); ok {
-			// Handle text blocks first
+			// Handle text and image blocks first
 			var textContent string
 			for _, block := range contentBlocks {
 				if blockMap, isMap := block.(map[string]interface{}); isMap {
@@ -48,6 +59,10 @@ func (a *AnthropicAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReq
 						if text, hasText := blockMap["text"]; hasText {
 							textContent += fmt.Sprintf("%v", text)
 						}
+					} else if hasType && blockType == "image" {
+						if image, ok := anthropicImageToUnified(blockMap); ok {
+							unifiedMessages[i].Images = append(unifiedMessages[i].Images, image)
+						}
 					}
 				}
 			}
@@ -83,10 +98,29 @@ func (a *AnthropicAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReq
 					} else if blockType, hasType := blockMap["type"]; hasType && blockType == "tool_result" {
 						if toolUseID, hasID := blockMap["tool_use_id"]; hasID {
 							if content, hasContent := blockMap["content"]; hasContent {
-								// Convert content to JSON string for UnifiedMessage.Content
-								contentBytes, _ := json.Marshal(content)
 								unifiedMessages[i].ToolCallID = fmt.Sprintf("%v", toolUseID)
-								unifiedMessages[i].Content = string(contentBytes)
+								if resultBlocks, isBlocks := content.([]interface{}); isBlocks {
+									// Split text from screenshots so either dialect can render them
+									var resultText string
+									for _, resultBlock := range resultBlocks {
+										resultMap, _ := resultBlock.(map[string]interface{})
+										switch resultMap["type"] {
+										case "text":
+											resultText += fmt.Sprintf("%v", resultMap["text"])
+										case "image":
+											if image, ok := anthropicImageToUnified(resultMap); ok {
+												unifiedMessages[i].Images = append(unifiedMessages[i].Images, image)
+											}
+										}
+									}
+									unifiedMessages[i].Content = resultText
+								} else if contentStr, isStr := content.(string); isStr {
+									unifiedMessages[i].Content = contentStr
+								} else {
+									// Convert content to JSON string for UnifiedMessage.Content
+									contentBytes, _ := json.Marshal(content)
+									unifiedMessages[i].Content = string(contentBytes)
+								}
 							}
 						}
 					}
@@ -98,31 +132,57 @@ func (a *AnthropicAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReq
 	// Convert Anthropic tools to unified format
 	unifiedTools := make([]UnifiedTool, len(anthropicReq.Tools))
 	for i, tool := range anthropicReq.Tools {
-		unifiedTools[i] = UnifiedTool{
-			Type: "function",
-			Function: UnifiedFunction{
-				Name:        tool.Name,
-				Description: tool.Description,
-				Parameters:  tool.InputSchema,
-			},
-		}
+		unifiedTools[i] = anthropicToolToUnified(tool)
 	}
 
 	unifiedReq := &UnifiedChatRequest{
 		Model:      anthropicReq.Model,
+		System:     anthropicSystemToUnified(anthropicReq.System),
+		MaxTokens:  anthropicReq.MaxTokens,
+		Stop:       anthropicReq.StopSequences,
 		Messages:   unifiedMessages,
 		Tools:      unifiedTools,
-		ToolChoice: anthropicReq.ToolChoice,
-		// Anthropic does not have a direct 'stream' field in the request body,
-		// but it's handled by the HTTP client.
+		// Streams are replayed from the complete response.
+		ReplayStream: anthropicReq.Stream,
+		Parameters: make(map[string]interface{}),
+	}
+	if anthropicReq.Temperature != nil {
+		unifiedReq.Parameters["temperature"] = *anthropicReq.Temperature
+	}
+	if anthropicReq.TopP != nil {
+		unifiedReq.Parameters["top_p"] = *anthropicReq.TopP
+	}
+	if anthropicReq.TopK != nil {
+		unifiedReq.Parameters["top_k"] = *anthropicReq.TopK
+	}
+	if anthropicReq.Metadata.UserID != "" {
+		unifiedReq.Parameters["user"] = anthropicReq.Metadata.UserID
+	}
+
+	toolChoice, disableParallel := anthropicToolChoiceToUnified(anthropicReq.ToolChoice)
+	unifiedReq.ToolChoice = toolChoice
+	if disableParallel {
+		unifiedReq.Parameters["parallel_tool_calls"] = false
 	}
 
 	return unifiedReq, nil
 }
 
 func (a *AnthropicAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
-	anthropicMessages := make([]map[string]interface{}, len(unifiedReq.Messages))
-	for i, msg := range unifiedReq.Messages {
+	// Anthropic has no system role; system and developer messages join the
+	// top-level system prompt, in order.
+	var systemPrompts []string
+	if unifiedReq.System != "" {
+		systemPrompts = append(systemPrompts, unifiedReq.System)
+	}
+	anthropicMessages := make([]map[string]interface{}, 0, len(unifiedReq.Messages))
+	for _, msg := range unifiedReq.Messages {
+		if msg.Role == "system" || msg.Role == "developer" {
+			if msg.Content != "" {
+				systemPrompts = append(systemPrompts, msg.Content)
+			}
+			continue
+		}
 		anthropicMsg := map[string]interface{}{
 			"role": msg.Role,
 		}
@@ -131,49 +191,86 @@ func (a *AnthropicAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest,
 			anthropicMsg["content"] = msg.Content
 		}
 
+		if len(msg.Images) > 0 && msg.ToolCallID == "" {
+			var contentBlocks []map[string]interface{}
+			for _, image := range msg.Images {
+				contentBlocks = append(contentBlocks, unifiedImageToAnthropic(image))
+			}
+			if msg.Content != "" {
+				contentBlocks = append(contentBlocks, map[string]interface{}{"type": "text", "text": msg.Content})
+			}
+			anthropicMsg["content"] = contentBlocks
+		}
+
 		if len(msg.ToolCalls) > 0 {
-			// Convert UnifiedToolCalls to Anthropic tool_use blocks
-			contentBlocks := []map[string]interface{}{
-				{
+			// Convert UnifiedToolCalls to Anthropic tool_use blocks, keeping
+			// any text the assistant produced alongside them
+			var contentBlocks []map[string]interface{}
+			if msg.Content != "" {
+				contentBlocks = append(contentBlocks, map[string]interface{}{"type": "text", "text": msg.Content})
+			}
+			for _, toolCall := range msg.ToolCalls {
+				arguments := toolCall.Function.Arguments
+				if !json.Valid([]byte(arguments)) {
+					arguments = "{}"
+				}
+				contentBlocks = append(contentBlocks, map[string]interface{}{
 					"type": "tool_use",
-					"id":   msg.ToolCalls[0].ID, // Assuming one tool call per message for simplicity
-					"name": msg.ToolCalls[0].Function.Name,
-					"input": json.RawMessage(msg.ToolCalls[0].Function.Arguments), // Arguments are JSON string
-				},
+					"id":   toolCall.ID,
+					"name": toolCall.Function.Name,
+					"input": json.RawMessage(arguments), // Arguments are JSON string
+				})
 			}
 			anthropicMsg["content"] = contentBlocks
-		} else if msg.ToolCallID != "" && msg.Content != "" {
+		} else if msg.ToolCallID != "" && (msg.Content != "" || len(msg.Images) > 0) {
+			// Anthropic carries tool results in user turns
+			anthropicMsg["role"] = "user"
 			// Convert Unified tool_result to Anthropic tool_result block
 			contentBlocks := []map[string]interface{}{
 				{
 					"type": "tool_result",
 					"tool_use_id": msg.ToolCallID,
-					"content": json.RawMessage(msg.Content), // Content is JSON string
+					"content": anthropicToolResultContent(msg),
 				},
 			}
 			anthropicMsg["content"] = contentBlocks
 		}
 
-		anthropicMessages[i] = anthropicMsg
+		anthropicMessages = append(anthropicMessages, anthropicMsg)
 	}
 
+	// Anthropic requires max_tokens
+	maxTokens := unifiedReq.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = defaultAnthropicMaxTokens
+	}
 	anthropicReq := map[string]interface{}{
 		"model":    unifiedReq.Model,
 		"messages": anthropicMessages,
-		"max_tokens": 4096, // Anthropic requires max_tokens
+		"max_tokens": maxTokens,
+	}
+	if len(systemPrompts) > 0 {
+		anthropicReq["system"] = strings.Join(systemPrompts, "\n\n")
+	}
+	if len(unifiedReq.Stop) > 0 {
+		anthropicReq["stop_sequences"] = unifiedReq.Stop
+	}
+	for name, value := range unifiedParametersToAnthropic(unifiedReq.Parameters) {
+		anthropicReq[name] = value
 	}
 
 	// Handle tools (function definitions) - Anthropic expects these at the top level
 	if len(unifiedReq.Tools) > 0 {
 		anthropicTools := make([]map[string]interface{}, len(unifiedReq.Tools))
 		for i, tool := range unifiedReq.Tools {
-			anthropicTools[i] = map[string]interface{}{
-				"name":        tool.Function.Name,
-				"description": tool.Function.Description,
-				"input_schema": tool.Function.Parameters, // Anthropic uses input_schema
-			}
+			anthropicTools[i] = unifiedToolToAnthropic(tool)
 		}
 		anthropicReq["tools"] = anthropicTools
+
+		disableParallel := unifiedReq.Parameters["parallel_tool_calls"] == false
+		if toolChoice := unifiedToolChoiceToAnthropic(unifiedReq.ToolChoice, disableParallel); toolChoice != nil {
+			anthropicReq["tool_choice"] = toolChoice
+		}
 	}
 
 	body, err := json.Marshal(anthropicReq)
@@ -186,6 +283,10 @@ func (a *AnthropicAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest,
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	// The hosted code execution sandbox is still gated behind a beta flag.
+	if hasToolType(unifiedReq.Tools, "code_execution") {
+		req.Header.Add("anthropic-beta", "code-execution-2025-05-22")
+	}
 	return req, nil
 }
 
@@ -195,12 +296,23 @@ func (a *AnthropicAdapter) BackendChatToUnified(backendResp *http.Response) (*Un
 		Type         string        `json:"type"`
 		Role         string        `json:"role"`
 		Content      []struct {
-			Type string `json:"type"`
-			Text string `json:"text"`
+			Type      string          `json:"type"`
+			Text      string          `json:"text"`
+			Thinking  string          `json:"thinking"`
+			Signature string          `json:"signature"`
+			ID        string          `json:"id"`
+			Name      string          `json:"name"`
+			Input     json.RawMessage `json:"input"`
+			Citations []struct {
+				Type      string `json:"type"`
+				URL       string `json:"url"`
+				Title     string `json:"title"`
+				CitedText string `json:"cited_text"`
+			} `json:"citations"`
 		} `json:"content"`
 		Model        string        `json:"model"`
 		StopReason   string        `json:"stop_reason"`
-		StopSequence interface{}   `json:"stop_sequence"`
+		StopSequence string        `json:"stop_sequence"`
 		Usage        struct {
 			InputTokens  int `json:"input_tokens"`
 			OutputTokens int `json:"output_tokens"`
@@ -216,6 +328,7 @@ func (a *AnthropicAdapter) BackendChatToUnified(backendResp *http.Response) (*Un
 		Model:      anthropicResp.Model,
 		Role:       anthropicResp.Role,
 		StopReason: anthropicResp.StopReason,
+		StopSequence: anthropicResp.StopSequence,
 		Usage: UnifiedUsage{
 			InputTokens:  anthropicResp.Usage.InputTokens,
 			OutputTokens: anthropicResp.Usage.OutputTokens,
@@ -223,9 +336,43 @@ func (a *AnthropicAdapter) BackendChatToUnified(backendResp *http.Response) (*Un
 	}
 
 	// Extract content
+	// Server tool blocks (server_tool_use, web_search_tool_result,
+	// code_execution_tool_result) are consumed by the provider; only text and
+	// its citations reach the client.
 	for _, block := range anthropicResp.Content {
+		if block.Type == "thinking" {
+			unifiedResp.Reasoning += block.Thinking
+			unifiedResp.ReasoningSignature = block.Signature
+		}
+		if block.Type == "tool_use" {
+			arguments := string(block.Input)
+			if arguments == "" {
+				arguments = "{}"
+			}
+			unifiedResp.ToolCalls = append(unifiedResp.ToolCalls, UnifiedToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: UnifiedFunctionCall{
+					Name:      block.Name,
+					Arguments: arguments,
+				},
+			})
+		}
 		if block.Type == "text" {
+			start := len([]rune(unifiedResp.Content))
 			unifiedResp.Content += block.Text
+			for _, citation := range block.Citations {
+				if citation.Type != "web_search_result_location" {
+					continue
+				}
+				unifiedResp.Citations = append(unifiedResp.Citations, UnifiedCitation{
+					URL:        citation.URL,
+					Title:      citation.Title,
+					CitedText:  citation.CitedText,
+					StartIndex: start,
+					EndIndex:   len([]rune(unifiedResp.Content)),
+				})
+			}
 		}
 	}
 
@@ -233,11 +380,20 @@ func (a *AnthropicAdapter) BackendChatToUnified(backendResp *http.Response) (*Un
 }
 
 func (a *AnthropicAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
-	// Build content array with text and tool_use blocks
+	// Build content array with thinking, text and tool_use blocks
 	var contentBlocks []map[string]interface{}
+	if unifiedResp.Reasoning != "" {
+		contentBlocks = append(contentBlocks, map[string]interface{}{
+			"type":      "thinking",
+			"thinking":  unifiedResp.Reasoning,
+			"signature": unifiedResp.ReasoningSignature,
+		})
+	}
 	
-	// Add text content if present
-	if unifiedResp.Content != "" {
+	// Add text content if present, split into cited spans when sources exist
+	if len(unifiedResp.Citations) > 0 {
+		contentBlocks = append(contentBlocks, anthropicCitedBlocks(unifiedResp.Content, unifiedResp.Citations)...)
+	} else if unifiedResp.Content != "" {
 		contentBlocks = append(contentBlocks, map[string]interface{}{
 			"type": "text",
 			"text": unifiedResp.Content,
@@ -261,19 +417,32 @@ func (a *AnthropicAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse,
 		})
 	}
 	
+	var stopSequence interface{}
+	if unifiedResp.StopSequence != "" {
+		stopSequence = unifiedResp.StopSequence
+	}
 	anthropicResp := map[string]interface{}{
 		"id":          unifiedResp.ID,
 		"type":        "message",
 		"role":        unifiedResp.Role,
 		"content":     contentBlocks,
 		"model":       unifiedResp.Model,
-		"stop_reason": unifiedResp.StopReason,
+		"stop_reason": anthropicStopReason(unifiedResp.StopReason),
+		"stop_sequence": stopSequence,
 		"usage": map[string]int{
 			"input_tokens":  unifiedResp.Usage.InputTokens,
 			"output_tokens": unifiedResp.Usage.OutputTokens,
 		},
 	}
 
+	if unifiedResp.Stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		writeAnthropicEvents(w, anthropicResp, contentBlocks)
+		return nil
+	}
+
 	respBody, err := json.Marshal(anthropicResp)
 	if err != nil {
 		return err
@@ -288,11 +457,57 @@ func (a *AnthropicAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse,
 
 // --- Error Translation ---
 
+// openaiErrorTypes maps Anthropic error types to the OpenAI type and code
+// an OpenAI SDK raises the equivalent exception for.
+var openaiErrorTypes = map[string][2]string{
+	"invalid_request_error": {"invalid_request_error", ""},
+	"authentication_error":  {"invalid_request_error", "invalid_api_key"},
+	"permission_error":      {"invalid_request_error", "permission_denied"},
+	"not_found_error":       {"invalid_request_error", "not_found"},
+	"request_too_large":     {"invalid_request_error", "request_too_large"},
+	"rate_limit_error":      {"rate_limit_error", "rate_limit_exceeded"},
+	"api_error":             {"server_error", ""},
+	"overloaded_error":      {"server_error", "overloaded"},
+}
+
 func (a *AnthropicAdapter) TranslateError(backendResp *http.Response) []byte {
-	// In a real implementation, we would parse the backend error
-	// and create a new error JSON in the client's expected format.
-	// For now, we return a generic error.
-	return []byte(`{"error": {"message": "An error occurred at the backend.", "type": "broker_error"}}`)
+	var anthropicError struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(backendResp.Body).Decode(&anthropicError); err != nil || anthropicError.Error.Message == "" {
+		return []byte(`{"error": {"message": "An error occurred at the backend.", "type": "broker_error"}}`)
+	}
+
+	openaiType, ok := openaiErrorTypes[anthropicError.Error.Type]
+	if !ok {
+		openaiType = [2]string{"server_error", ""}
+	}
+	var code interface{}
+	if openaiType[1] != "" {
+		code = openaiType[1]
+	}
+	errorBody, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]interface{}{
+			"message": anthropicError.Error.Message,
+			"type":    openaiType[0],
+			"param":   nil,
+			"code":    code,
+		},
+	})
+	return errorBody
+}
+
+// OpenAIErrorStatus returns the status to answer an OpenAI client with for
+// a backend error status. Anthropic signals overload with the nonstandard
+// 529, which OpenAI SDKs only retry as 503.
+func OpenAIErrorStatus(status int) int {
+	if status == 529 {
+		return http.StatusServiceUnavailable
+	}
+	return status
 }
 
 // --- Embedding Operations ---
@@ -311,4 +526,94 @@ func (a *AnthropicAdapter) BackendEmbeddingToUnified(backendResp *http.Response)
 
 func (a *AnthropicAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingResponse, w http.ResponseWriter) error {
 	return fmt.Errorf("Anthropic does not support embedding responses")
+}
+
+// writeAnthropicEvents replays a complete message as a Messages API event
+// stream, delivering each content block in a single delta.
+func writeAnthropicEvents(w http.ResponseWriter, message map[string]interface{}, contentBlocks []map[string]interface{}) {
+	emit := func(event map[string]interface{}) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event["type"], data)
+	}
+
+	started := make(map[string]interface{}, len(message))
+	for key, value := range message {
+		started[key] = value
+	}
+	started["content"] = []interface{}{}
+	started["stop_reason"] = nil
+	started["stop_sequence"] = nil
+	emit(map[string]interface{}{"type": "message_start", "message": started})
+
+	for index, block := range contentBlocks {
+		var start, delta map[string]interface{}
+		switch block["type"] {
+		case "thinking":
+			start = map[string]interface{}{"type": "thinking", "thinking": ""}
+			delta = map[string]interface{}{"type": "thinking_delta", "thinking": block["thinking"]}
+		case "tool_use":
+			start = map[string]interface{}{"type": "tool_use", "id": block["id"], "name": block["name"], "input": map[string]interface{}{}}
+			input, _ := json.Marshal(block["input"])
+			delta = map[string]interface{}{"type": "input_json_delta", "partial_json": string(input)}
+		default:
+			start = map[string]interface{}{"type": "text", "text": ""}
+			delta = map[string]interface{}{"type": "text_delta", "text": block["text"]}
+		}
+		emit(map[string]interface{}{"type": "content_block_start", "index": index, "content_block": start})
+		emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": delta})
+		if block["type"] == "thinking" && block["signature"] != "" {
+			emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "signature_delta", "signature": block["signature"]}})
+		}
+		citations, _ := block["citations"].([]map[string]interface{})
+		for _, citation := range citations {
+			emit(map[string]interface{}{"type": "content_block_delta", "index": index, "delta": map[string]interface{}{"type": "citations_delta", "citation": citation}})
+		}
+		emit(map[string]interface{}{"type": "content_block_stop", "index": index})
+	}
+
+	emit(map[string]interface{}{
+		"type":  "message_delta",
+		"delta": map[string]interface{}{"stop_reason": message["stop_reason"], "stop_sequence": message["stop_sequence"]},
+		"usage": message["usage"],
+	})
+	emit(map[string]interface{}{"type": "message_stop"})
+}
+
+// anthropicSystemToUnified flattens Anthropic's system field, a string or a
+// list of text blocks, into one prompt.
+func anthropicSystemToUnified(system interface{}) string {
+	switch v := system.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, block := range v {
+			if blockMap, ok := block.(map[string]interface{}); ok && blockMap["type"] == "text" {
+				texts = append(texts, fmt.Sprintf("%v", blockMap["text"]))
+			}
+		}
+		return strings.Join(texts, "\n\n")
+	}
+	return ""
+}
+
+// anthropicToolResultContent renders tool output for a tool_result block.
+// Screenshots become image blocks and plain text output stays a string.
+func anthropicToolResultContent(msg UnifiedMessage) interface{} {
+	if len(msg.Images) == 0 {
+		// Pre-built content block arrays pass through; anything else
+		// (including JSON objects) must be sent as a string.
+		if strings.HasPrefix(msg.Content, "[") && json.Valid([]byte(msg.Content)) {
+			return json.RawMessage(msg.Content)
+		}
+		return msg.Content
+	}
+	var blocks []map[string]interface{}
+	if msg.Content != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": msg.Content})
+	}
+	for _, image := range msg.Images {
+		blocks = append(blocks, unifiedImageToAnthropic(image))
+	}
+	return blocks
 }
\ No newline at end of file
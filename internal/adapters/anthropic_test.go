@@ -1,8 +1,10 @@
 package adapters
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -126,4 +128,654 @@ func TestAnthropicAdapter_EmbeddingMethodsReturnErrors(t *testing.T) {
 	if err == nil {
 		t.Error("Expected error for embedding client response, got nil")
 	}
-}
\ No newline at end of file
+}
+
+func TestAnthropicAdapter_WebSearchToolTranslation(t *testing.T) {
+	openaiAdapter := &OpenAIAdapter{}
+	anthropicAdapter := &AnthropicAdapter{}
+
+	// OpenAI client enabling hosted search
+	reqBody := `{
+		"model": "gpt-4o-search-preview",
+		"messages": [{"role": "user", "content": "Latest Go release?"}],
+		"web_search_options": {"user_location": {"type": "approximate", "approximate": {"country": "US"}}}
+	}`
+	req, err := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unified, err := openaiAdapter.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Tools) != 1 || unified.Tools[0].Type != "web_search" {
+		t.Fatalf("Expected one web_search tool, got: %+v", unified.Tools)
+	}
+
+	backendReq, err := anthropicAdapter.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var body struct {
+		Tools []map[string]interface{} `json:"tools"`
+	}
+	if err := json.NewDecoder(backendReq.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode backend request: %v", err)
+	}
+
+	if len(body.Tools) != 1 || body.Tools[0]["type"] != "web_search_20250305" {
+		t.Fatalf("Expected web_search_20250305 server tool, got: %v", body.Tools)
+	}
+
+	location, _ := body.Tools[0]["user_location"].(map[string]interface{})
+	if location["country"] != "US" || location["type"] != "approximate" {
+		t.Errorf("Expected approximate US location, got: %v", location)
+	}
+}
+
+func TestAnthropicAdapter_WebSearchCitationsToOpenAI(t *testing.T) {
+	respBody := `{
+		"id": "msg_search",
+		"type": "message",
+		"role": "assistant",
+		"content": [
+			{"type": "server_tool_use", "id": "srvtoolu_1", "name": "web_search", "input": {"query": "go release"}},
+			{"type": "web_search_tool_result", "tool_use_id": "srvtoolu_1", "content": []},
+			{"type": "text", "text": "The latest release is "},
+			{"type": "text", "text": "Go 1.25", "citations": [
+				{"type": "web_search_result_location", "url": "https://go.dev/doc/devel/release", "title": "Release History", "cited_text": "go1.25"}
+			]}
+		],
+		"model": "claude-sonnet-4",
+		"stop_reason": "end_turn",
+		"usage": {"input_tokens": 10, "output_tokens": 5}
+	}`
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(respBody)),
+	}
+
+	unified, err := (&AnthropicAdapter{}).BackendChatToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if unified.Content != "The latest release is Go 1.25" {
+		t.Errorf("Expected concatenated text, got: %s", unified.Content)
+	}
+
+	if len(unified.Citations) != 1 || unified.Citations[0].StartIndex != 22 || unified.Citations[0].EndIndex != 29 {
+		t.Fatalf("Expected citation spanning [22, 29), got: %+v", unified.Citations)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := (&OpenAIAdapter{}).UnifiedChatToClient(unified, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"url_citation"`) || !strings.Contains(rr.Body.String(), `"start_index":22`) {
+		t.Errorf("Expected url_citation annotation, got: %s", rr.Body.String())
+	}
+
+	// And back into Anthropic blocks for Claude-format clients
+	rr = httptest.NewRecorder()
+	if err := (&AnthropicAdapter{}).UnifiedChatToClient(unified, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"web_search_result_location"`) {
+		t.Errorf("Expected cited text block, got: %s", rr.Body.String())
+	}
+}
+
+func TestAnthropicAdapter_ComputerUseToOpenAI(t *testing.T) {
+	// Anthropic computer-use client returning a screenshot
+	reqBody := `{
+		"model": "claude-sonnet-4",
+		"max_tokens": 1024,
+		"tools": [{"type": "computer_20250124", "name": "computer", "display_width_px": 1280, "display_height_px": 800}],
+		"messages": [
+			{"role": "user", "content": "Open the settings"},
+			{"role": "assistant", "content": [{"type": "tool_use", "id": "toolu_1", "name": "computer", "input": {"action": "screenshot"}}]},
+			{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "toolu_1", "content": [
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}}
+			]}]}
+		]
+	}`
+	req, err := http.NewRequest("POST", "/v1/messages", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unified, err := (&AnthropicAdapter{}).ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Tools) != 1 || unified.Tools[0].Type != "computer" || unified.Tools[0].Computer.DisplayWidth != 1280 {
+		t.Fatalf("Expected computer tool with 1280px display, got: %+v", unified.Tools)
+	}
+
+	if len(unified.Messages[2].Images) != 1 || unified.Messages[2].Images[0].MediaType != "image/png" {
+		t.Fatalf("Expected screenshot on tool result, got: %+v", unified.Messages[2])
+	}
+
+	backendReq, err := (&OpenAIAdapter{}).UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var body struct {
+		Messages []map[string]interface{} `json:"messages"`
+		Tools    []struct {
+			Type     string `json:"type"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		} `json:"tools"`
+	}
+	if err := json.NewDecoder(backendReq.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode backend request: %v", err)
+	}
+
+	if len(body.Tools) != 1 || body.Tools[0].Type != "function" || body.Tools[0].Function.Name != "computer" {
+		t.Errorf("Expected computer emulated as a function tool, got: %+v", body.Tools)
+	}
+
+	// The screenshot follows the tool message as a user image
+	if len(body.Messages) != 4 {
+		t.Fatalf("Expected 4 messages, got: %d", len(body.Messages))
+	}
+
+	last, _ := json.Marshal(body.Messages[3])
+	if !strings.Contains(string(last), "data:image/png;base64,iVBORw0KGgo=") {
+		t.Errorf("Expected screenshot data URI in follow-up message, got: %s", last)
+	}
+}
+
+func TestComputerActionMapping(t *testing.T) {
+	openaiAction := map[string]interface{}{"type": "click", "button": "right", "x": float64(10), "y": float64(20)}
+
+	anthropicInput := openaiComputerActionToAnthropic(openaiAction)
+	if anthropicInput["action"] != "right_click" {
+		t.Errorf("Expected right_click action, got: %v", anthropicInput["action"])
+	}
+
+	// Round-trip through JSON as real tool inputs would
+	encoded, _ := json.Marshal(anthropicInput)
+	var decoded map[string]interface{}
+	json.Unmarshal(encoded, &decoded)
+
+	back := anthropicComputerActionToOpenAI(decoded)
+	if back["type"] != "click" || back["button"] != "right" || back["x"] != 10 || back["y"] != 20 {
+		t.Errorf("Expected right click at (10, 20), got: %v", back)
+	}
+
+	scroll := openaiComputerActionToAnthropic(map[string]interface{}{"type": "scroll", "x": float64(0), "y": float64(0), "scroll_y": float64(-300)})
+	if scroll["scroll_direction"] != "up" || scroll["scroll_amount"] != 3 {
+		t.Errorf("Expected scroll up by 3, got: %v", scroll)
+	}
+}
+
+func TestAnthropicAdapter_CodeExecutionToolTranslation(t *testing.T) {
+	openaiAdapter := &OpenAIAdapter{}
+	anthropicAdapter := &AnthropicAdapter{}
+
+	// OpenAI client asking for the hosted code interpreter
+	reqBody := `{
+		"model": "gpt-4o",
+		"messages": [{"role": "user", "content": "What is 2**64?"}],
+		"tools": [{"type": "code_interpreter", "container": {"type": "auto"}}]
+	}`
+	req, err := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unified, err := openaiAdapter.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(unified.Tools) != 1 || unified.Tools[0].Type != "code_execution" {
+		t.Fatalf("Expected one code_execution tool, got: %+v", unified.Tools)
+	}
+
+	backendReq, err := anthropicAdapter.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if beta := backendReq.Header.Get("anthropic-beta"); beta != "code-execution-2025-05-22" {
+		t.Errorf("Expected code execution beta header, got: %q", beta)
+	}
+
+	var body struct {
+		Tools []map[string]interface{} `json:"tools"`
+	}
+	if err := json.NewDecoder(backendReq.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode backend request: %v", err)
+	}
+	if len(body.Tools) != 1 || body.Tools[0]["type"] != "code_execution_20250522" {
+		t.Fatalf("Expected code_execution_20250522 server tool, got: %v", body.Tools)
+	}
+
+	// Chat Completions has no hosted sandbox, so the tool becomes a function
+	openaiReq, err := openaiAdapter.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var openaiBody struct {
+		Tools []struct {
+			Type     string `json:"type"`
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		} `json:"tools"`
+	}
+	if err := json.NewDecoder(openaiReq.Body).Decode(&openaiBody); err != nil {
+		t.Fatalf("Failed to decode backend request: %v", err)
+	}
+	if len(openaiBody.Tools) != 1 || openaiBody.Tools[0].Function.Name != "code_execution" {
+		t.Errorf("Expected code_execution function tool, got: %+v", openaiBody.Tools)
+	}
+}
+
+func TestAnthropicAdapter_ToolUseRoundTrip(t *testing.T) {
+	adapter := &AnthropicAdapter{}
+
+	respBody := `{
+		"id": "msg_tool",
+		"type": "message",
+		"role": "assistant",
+		"content": [
+			{"type": "text", "text": "Checking."},
+			{"type": "tool_use", "id": "toolu_1", "name": "get_time", "input": {"zone": "UTC"}}
+		],
+		"model": "claude-sonnet-4",
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 5, "output_tokens": 3}
+	}`
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(respBody))}
+
+	unified, err := adapter.BackendChatToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(unified.ToolCalls) != 1 || unified.ToolCalls[0].Function.Name != "get_time" || unified.ToolCalls[0].Function.Arguments != `{"zone": "UTC"}` {
+		t.Fatalf("Expected get_time tool call, got: %+v", unified.ToolCalls)
+	}
+
+	// Feeding the call and its result back must produce valid Anthropic turns
+	req := &UnifiedChatRequest{
+		Model: "claude-sonnet-4",
+		Messages: []UnifiedMessage{
+			{Role: "user", Content: "What time is it?"},
+			{Role: "assistant", Content: unified.Content, ToolCalls: unified.ToolCalls},
+			{Role: "tool", ToolCallID: "toolu_1", Content: "12:00"},
+		},
+	}
+	backendReq, err := adapter.UnifiedChatToBackend(req, "https://api.anthropic.com/v1/messages")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	// The first turn has plain string content, so only the later two are decoded
+	var body struct {
+		Messages []json.RawMessage `json:"messages"`
+	}
+	if err := json.NewDecoder(backendReq.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode backend request: %v", err)
+	}
+	type turn struct {
+		Role    string                   `json:"role"`
+		Content []map[string]interface{} `json:"content"`
+	}
+	var assistant, result turn
+	if err := json.Unmarshal(body.Messages[1], &assistant); err != nil {
+		t.Fatalf("Failed to decode assistant turn: %v", err)
+	}
+	if err := json.Unmarshal(body.Messages[2], &result); err != nil {
+		t.Fatalf("Failed to decode tool result turn: %v", err)
+	}
+
+	if len(assistant.Content) != 2 || assistant.Content[0]["type"] != "text" || assistant.Content[1]["type"] != "tool_use" {
+		t.Errorf("Expected text and tool_use blocks, got: %v", assistant.Content)
+	}
+	if result.Role != "user" || result.Content[0]["type"] != "tool_result" {
+		t.Errorf("Expected user turn with tool_result, got: %+v", result)
+	}
+}
+
+func TestAnthropicAdapter_SystemPrompt(t *testing.T) {
+	anthropic := &AnthropicAdapter{}
+	openai := &OpenAIAdapter{}
+
+	// The top-level system field, string or text blocks, reaches the unified request
+	for _, system := range []string{`"Be brief."`, `[{"type": "text", "text": "Be brief.", "cache_control": {"type": "ephemeral"}}]`} {
+		req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-sonnet-4", "max_tokens": 100, "system": `+system+`, "messages": [{"role": "user", "content": "Hello"}]}`))
+		unified, err := anthropic.ClientChatToUnified(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if unified.System != "Be brief." {
+			t.Errorf("Expected system prompt 'Be brief.', got: %q", unified.System)
+		}
+
+		// An OpenAI backend receives it as a leading system message
+		backendReq, err := openai.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		var openaiBody struct {
+			Messages []map[string]interface{} `json:"messages"`
+		}
+		json.NewDecoder(backendReq.Body).Decode(&openaiBody)
+		if len(openaiBody.Messages) != 2 || openaiBody.Messages[0]["role"] != "system" || openaiBody.Messages[0]["content"] != "Be brief." {
+			t.Errorf("Expected a leading system message, got: %v", openaiBody.Messages)
+		}
+	}
+
+	// OpenAI system and developer messages move to the top-level field
+	unified := &UnifiedChatRequest{
+		Model: "claude-sonnet-4",
+		Messages: []UnifiedMessage{
+			{Role: "system", Content: "Be brief."},
+			{Role: "developer", Content: "Answer in French."},
+			{Role: "user", Content: "Hello"},
+		},
+	}
+	backendReq, err := anthropic.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var body struct {
+		System   string                   `json:"system"`
+		Messages []map[string]interface{} `json:"messages"`
+	}
+	json.NewDecoder(backendReq.Body).Decode(&body)
+	if body.System != "Be brief.\n\nAnswer in French." {
+		t.Errorf("Expected the system messages joined into system, got: %q", body.System)
+	}
+	if len(body.Messages) != 1 || body.Messages[0]["role"] != "user" {
+		t.Errorf("Expected only the user turn in messages, got: %v", body.Messages)
+	}
+}
+
+func TestAnthropicAdapter_MaxTokens(t *testing.T) {
+	anthropic := &AnthropicAdapter{}
+	openai := &OpenAIAdapter{}
+
+	// The client's limit survives translation in both directions
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "max_completion_tokens": 300, "messages": [{"role": "user", "content": "Hello"}]}`))
+	unified, err := openai.ClientChatToUnified(req)
+	if err != nil || unified.MaxTokens != 300 {
+		t.Fatalf("Expected max_completion_tokens as MaxTokens, got: %+v %v", unified, err)
+	}
+	backendReq, _ := anthropic.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	var body map[string]interface{}
+	json.NewDecoder(backendReq.Body).Decode(&body)
+	if body["max_tokens"] != float64(300) {
+		t.Errorf("Expected max_tokens 300, got: %v", body["max_tokens"])
+	}
+
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-sonnet-4", "max_tokens": 200, "messages": [{"role": "user", "content": "Hello"}]}`))
+	unified, _ = anthropic.ClientChatToUnified(req)
+	backendReq, _ = openai.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	body = nil
+	json.NewDecoder(backendReq.Body).Decode(&body)
+	if body["max_tokens"] != float64(200) {
+		t.Errorf("Expected max_tokens 200, got: %v", body["max_tokens"])
+	}
+
+	// Without a limit, Anthropic still gets the one it requires
+	backendReq, _ = anthropic.UnifiedChatToBackend(&UnifiedChatRequest{Model: "claude-sonnet-4"}, "https://api.anthropic.com/v1/messages")
+	body = nil
+	json.NewDecoder(backendReq.Body).Decode(&body)
+	if body["max_tokens"] != float64(defaultAnthropicMaxTokens) {
+		t.Errorf("Expected the default max_tokens, got: %v", body["max_tokens"])
+	}
+}
+
+func TestAnthropicAdapter_SamplingParameters(t *testing.T) {
+	anthropic := &AnthropicAdapter{}
+	openai := &OpenAIAdapter{}
+	decode := func(req *http.Request) map[string]interface{} {
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		return body
+	}
+
+	// OpenAI parameters are renamed for Anthropic, and those it lacks are dropped
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}], "temperature": 0.3, "top_p": 0.9, "stop": "END", "user": "u-1", "presence_penalty": 0.5, "seed": 7, "n": 2}`))
+	unified, err := openai.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unified.Parameters["temperature"] != 0.3 || unified.Parameters["seed"] != float64(7) {
+		t.Errorf("Expected sampling parameters to be captured, got: %v", unified.Parameters)
+	}
+	if _, ok := unified.Parameters["n"]; ok {
+		t.Errorf("Expected n not to be forwarded, got: %v", unified.Parameters)
+	}
+	backendReq, _ := anthropic.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	body := decode(backendReq)
+	if body["temperature"] != 0.3 || body["top_p"] != 0.9 {
+		t.Errorf("Expected temperature and top_p, got: %v", body)
+	}
+	if stop, _ := body["stop_sequences"].([]interface{}); len(stop) != 1 || stop[0] != "END" {
+		t.Errorf("Expected stop as stop_sequences, got: %v", body["stop_sequences"])
+	}
+	if metadata, _ := body["metadata"].(map[string]interface{}); metadata["user_id"] != "u-1" {
+		t.Errorf("Expected user as metadata.user_id, got: %v", body["metadata"])
+	}
+	for _, dropped := range []string{"presence_penalty", "seed", "stop", "user"} {
+		if _, ok := body[dropped]; ok {
+			t.Errorf("Expected %s to be dropped, got: %v", dropped, body)
+		}
+	}
+
+	// Anthropic parameters reach OpenAI under its names, without top_k
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-sonnet-4", "max_tokens": 100, "messages": [{"role": "user", "content": "Hello"}], "temperature": 0.7, "top_k": 40, "stop_sequences": ["END"], "metadata": {"user_id": "u-2"}}`))
+	unified, err = anthropic.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	backendReq, _ = openai.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	body = decode(backendReq)
+	if body["temperature"] != 0.7 || body["user"] != "u-2" {
+		t.Errorf("Expected temperature and user, got: %v", body)
+	}
+	if stop, _ := body["stop"].([]interface{}); len(stop) != 1 || stop[0] != "END" {
+		t.Errorf("Expected stop_sequences as stop, got: %v", body["stop"])
+	}
+	if _, ok := body["top_k"]; ok {
+		t.Errorf("Expected top_k to be dropped, got: %v", body)
+	}
+}
+
+func TestToolChoiceMapping(t *testing.T) {
+	cases := []struct {
+		name      string
+		openai    string
+		anthropic string
+	}{
+		{"auto", `"auto"`, `{"type":"auto"}`},
+		{"required", `"required"`, `{"type":"any"}`},
+		{"none", `"none"`, `{"type":"none"}`},
+		{"function", `{"function":{"name":"get_weather"},"type":"function"}`, `{"name":"get_weather","type":"tool"}`},
+	}
+	for _, c := range cases {
+		var openaiChoice, anthropicChoice interface{}
+		json.Unmarshal([]byte(c.openai), &openaiChoice)
+		json.Unmarshal([]byte(c.anthropic), &anthropicChoice)
+
+		if encoded, _ := json.Marshal(unifiedToolChoiceToAnthropic(openaiChoice, false)); string(encoded) != c.anthropic {
+			t.Errorf("%s: Expected Anthropic tool_choice %s, got: %s", c.name, c.anthropic, encoded)
+		}
+		unified, _ := anthropicToolChoiceToUnified(anthropicChoice)
+		if encoded, _ := json.Marshal(unified); string(encoded) != c.openai {
+			t.Errorf("%s: Expected unified tool_choice %s, got: %s", c.name, c.openai, encoded)
+		}
+	}
+
+	// Parallel tool use maps to parallel_tool_calls both ways
+	anthropic := &AnthropicAdapter{}
+	openai := &OpenAIAdapter{}
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-sonnet-4", "max_tokens": 100, "messages": [{"role": "user", "content": "Weather?"}], "tools": [{"name": "get_weather", "input_schema": {"type": "object"}}], "tool_choice": {"type": "any", "disable_parallel_tool_use": true}}`))
+	unified, err := anthropic.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	backendReq, _ := openai.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	var openaiBody map[string]interface{}
+	json.NewDecoder(backendReq.Body).Decode(&openaiBody)
+	if openaiBody["tool_choice"] != "required" || openaiBody["parallel_tool_calls"] != false {
+		t.Errorf("Expected required tool_choice without parallel calls, got: %v", openaiBody)
+	}
+
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Weather?"}], "tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object"}}}], "parallel_tool_calls": false}`))
+	unified, _ = openai.ClientChatToUnified(req)
+	backendReq, _ = anthropic.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	var anthropicBody map[string]interface{}
+	json.NewDecoder(backendReq.Body).Decode(&anthropicBody)
+	choice, _ := anthropicBody["tool_choice"].(map[string]interface{})
+	if choice["type"] != "auto" || choice["disable_parallel_tool_use"] != true {
+		t.Errorf("Expected auto tool_choice without parallel tool use, got: %v", anthropicBody["tool_choice"])
+	}
+	if _, ok := anthropicBody["parallel_tool_calls"]; ok {
+		t.Errorf("Expected parallel_tool_calls to be dropped, got: %v", anthropicBody)
+	}
+}
+
+func TestAnthropicAdapter_ReasoningToThinking(t *testing.T) {
+	openai := &OpenAIAdapter{}
+	anthropic := &AnthropicAdapter{}
+
+	// DeepSeek-style reasoning_content becomes a thinking block
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"id": "chatcmpl-r1", "model": "deepseek-reasoner", "choices": [{"index": 0, "message": {"role": "assistant", "content": "4", "reasoning_content": "2 plus 2 is 4."}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 8, "completion_tokens": 12}}`))}
+	unified, err := openai.BackendChatToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unified.Reasoning != "2 plus 2 is 4." {
+		t.Fatalf("Expected reasoning_content to be kept, got: %q", unified.Reasoning)
+	}
+
+	rr := httptest.NewRecorder()
+	anthropic.UnifiedChatToClient(unified, rr)
+	var message struct {
+		Content []map[string]interface{} `json:"content"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &message)
+	if len(message.Content) != 2 || message.Content[0]["type"] != "thinking" || message.Content[0]["thinking"] != "2 plus 2 is 4." || message.Content[1]["text"] != "4" {
+		t.Errorf("Expected a thinking block before the text, got: %s", rr.Body.String())
+	}
+
+	// Streamed, the thinking arrives as thinking deltas ahead of the text
+	unified.Stream = true
+	rr = httptest.NewRecorder()
+	anthropic.UnifiedChatToClient(unified, rr)
+	body := rr.Body.String()
+	if rr.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected an event stream, got: %s", rr.Header().Get("Content-Type"))
+	}
+	thinking := strings.Index(body, `"thinking_delta"`)
+	text := strings.Index(body, `"text_delta"`)
+	if thinking < 0 || text < thinking || !strings.HasPrefix(body, "event: message_start") || !strings.Contains(body, "event: message_stop") {
+		t.Errorf("Expected message_start, a thinking delta, a text delta and message_stop, got: %s", body)
+	}
+
+	// Anthropic thinking blocks reach OpenAI clients as reasoning_content
+	resp = &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4", "content": [{"type": "thinking", "thinking": "Simple sum.", "signature": "sig-1"}, {"type": "text", "text": "4"}], "stop_reason": "end_turn", "usage": {"input_tokens": 8, "output_tokens": 12}}`))}
+	unified, _ = anthropic.BackendChatToUnified(resp)
+	if unified.Reasoning != "Simple sum." || unified.ReasoningSignature != "sig-1" || unified.Content != "4" {
+		t.Errorf("Expected thinking and signature to be kept, got: %+v", unified)
+	}
+	unified.Stream = true
+	rr = httptest.NewRecorder()
+	openai.UnifiedChatToClient(unified, rr)
+	if body := rr.Body.String(); !strings.Contains(body, `"reasoning_content":"Simple sum."`) || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected a reasoning_content delta and [DONE], got: %s", body)
+	}
+}
+
+func TestAnthropicAdapter_StopSequence(t *testing.T) {
+	openai := &OpenAIAdapter{}
+	anthropic := &AnthropicAdapter{}
+
+	// A single OpenAI stop string reaches Anthropic as stop_sequences
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude", "messages": [{"role": "user", "content": "Count"}], "stop": "5"}`))
+	unified, err := openai.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(unified.Stop) != 1 || unified.Stop[0] != "5" {
+		t.Fatalf("Expected the stop string to be captured, got: %v", unified.Stop)
+	}
+	backendReq, _ := anthropic.UnifiedChatToBackend(unified, "https://api.anthropic.com/v1/messages")
+	var body map[string]interface{}
+	json.NewDecoder(backendReq.Body).Decode(&body)
+	if stop, _ := body["stop_sequences"].([]interface{}); len(stop) != 1 || stop[0] != "5" {
+		t.Errorf("Expected stop_sequences, got: %v", body)
+	}
+
+	// Stopping on a sequence is a plain "stop" for OpenAI clients
+	resp := &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude", "content": [{"type": "text", "text": "1 2 3 4 "}], "stop_reason": "stop_sequence", "stop_sequence": "5", "usage": {"input_tokens": 5, "output_tokens": 8}}`))}
+	unifiedResp, err := anthropic.BackendChatToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unifiedResp.StopSequence != "5" {
+		t.Errorf("Expected the matched stop sequence, got: %q", unifiedResp.StopSequence)
+	}
+	rr := httptest.NewRecorder()
+	openai.UnifiedChatToClient(unifiedResp, rr)
+	if !strings.Contains(rr.Body.String(), `"finish_reason":"stop"`) {
+		t.Errorf("Expected finish_reason stop, got: %s", rr.Body.String())
+	}
+
+	// Anthropic clients see which sequence matched
+	rr = httptest.NewRecorder()
+	anthropic.UnifiedChatToClient(unifiedResp, rr)
+	if !strings.Contains(rr.Body.String(), `"stop_sequence":"5"`) {
+		t.Errorf("Expected stop_sequence in the message, got: %s", rr.Body.String())
+	}
+}
+
+func TestStopReasonMapping(t *testing.T) {
+	cases := []struct {
+		openai    string
+		anthropic string
+	}{
+		{"stop", "end_turn"},
+		{"length", "max_tokens"},
+		{"tool_calls", "tool_use"},
+	}
+	for _, c := range cases {
+		if got := openaiStopReason(c.anthropic); got != c.openai {
+			t.Errorf("Expected %s for %s, got: %s", c.openai, c.anthropic, got)
+		}
+		if got := anthropicStopReason(c.openai); got != c.anthropic {
+			t.Errorf("Expected %s for %s, got: %s", c.anthropic, c.openai, got)
+		}
+		// Reasons already in the target dialect are kept
+		if got := openaiStopReason(c.openai); got != c.openai {
+			t.Errorf("Expected %s to pass through, got: %s", c.openai, got)
+		}
+	}
+
+	// Clients get the reason in their own dialect
+	resp := &UnifiedChatResponse{ID: "chatcmpl-1", Role: "assistant", Content: "Hi", StopReason: "end_turn"}
+	rr := httptest.NewRecorder()
+	(&OpenAIAdapter{}).UnifiedChatToClient(resp, rr)
+	if !strings.Contains(rr.Body.String(), `"finish_reason":"stop"`) {
+		t.Errorf("Expected finish_reason stop, got: %s", rr.Body.String())
+	}
+	resp.StopReason = "tool_calls"
+	rr = httptest.NewRecorder()
+	(&AnthropicAdapter{}).UnifiedChatToClient(resp, rr)
+	if !strings.Contains(rr.Body.String(), `"stop_reason":"tool_use"`) {
+		t.Errorf("Expected stop_reason tool_use, got: %s", rr.Body.String())
+	}
+}
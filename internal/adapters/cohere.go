@@ -0,0 +1,281 @@
+package adapters
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CohereAdapter implements the embedding half of the Adapter interface for
+// Cohere's v2 embed API, including mixed text and image inputs for embed-v4.
+// It serves clients of that API too, so Cohere SDKs can embed against any
+// backend.
+type CohereAdapter struct{}
+
+// --- Chat Completion Operations ---
+
+func (a *CohereAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatRequest, error) {
+	return nil, fmt.Errorf("Cohere chat requests are not supported")
+}
+
+func (a *CohereAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
+	return nil, fmt.Errorf("Cohere chat requests are not supported")
+}
+
+func (a *CohereAdapter) BackendChatToUnified(backendResp *http.Response) (*UnifiedChatResponse, error) {
+	return nil, fmt.Errorf("Cohere chat responses are not supported")
+}
+
+func (a *CohereAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("Cohere chat responses are not supported")
+}
+
+// --- Error Translation ---
+
+func (a *CohereAdapter) TranslateError(backendResp *http.Response) []byte {
+	var cohereError struct {
+		Message string `json:"message"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&cohereError); err != nil || cohereError.Message == "" {
+		return []byte(`{"error": {"message": "An error occurred at the backend.", "type": "broker_error"}}`)
+	}
+
+	errorBody, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"message": cohereError.Message,
+			"type":    "backend_error",
+		},
+	})
+	return errorBody
+}
+
+// --- Embedding Operations ---
+
+func (a *CohereAdapter) ClientEmbeddingToUnified(r *http.Request) (*UnifiedEmbeddingRequest, error) {
+	var cohereReq struct {
+		Model  string   `json:"model"`
+		Texts  []string `json:"texts"`
+		Images []string `json:"images"`
+		Inputs []struct {
+			Content []struct {
+				Type     string `json:"type"`
+				Text     string `json:"text"`
+				ImageURL struct {
+					URL string `json:"url"`
+				} `json:"image_url"`
+			} `json:"content"`
+		} `json:"inputs"`
+		InputType       string   `json:"input_type"`
+		EmbeddingTypes  []string `json:"embedding_types"`
+		OutputDimension int      `json:"output_dimension"`
+		Truncate        string   `json:"truncate"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&cohereReq); err != nil {
+		return nil, err
+	}
+
+	for _, embeddingType := range cohereReq.EmbeddingTypes {
+		if embeddingType != "float" {
+			return nil, &ParameterError{Parameter: "embedding_types", Message: "only float embeddings are supported"}
+		}
+	}
+
+	unifiedReq := &UnifiedEmbeddingRequest{
+		Model:      cohereReq.Model,
+		Dimensions: cohereReq.OutputDimension,
+		InputType:  cohereReq.InputType,
+	}
+	switch cohereReq.InputType {
+	case "search_query":
+		unifiedReq.InputType = "query"
+	case "search_document":
+		unifiedReq.InputType = "document"
+	}
+
+	// Other backends only cut long inputs or refuse them; where they are
+	// cut is up to the backend.
+	switch strings.ToUpper(cohereReq.Truncate) {
+	case "":
+	case "NONE":
+		truncate := false
+		unifiedReq.Truncate = &truncate
+	case "START", "END":
+		truncate := true
+		unifiedReq.Truncate = &truncate
+	default:
+		return nil, &ParameterError{Parameter: "truncate", Message: "must be NONE, START or END"}
+	}
+
+	set := 0
+	for _, n := range []int{len(cohereReq.Texts), len(cohereReq.Images), len(cohereReq.Inputs)} {
+		if n > 0 {
+			set++
+		}
+	}
+	switch {
+	case set == 0:
+		return nil, &ParameterError{Parameter: "texts", Message: "one of texts, images or inputs is required"}
+	case set > 1:
+		return nil, &ParameterError{Parameter: "texts", Message: "only one of texts, images or inputs may be set"}
+	case len(cohereReq.Texts) > 0:
+		unifiedReq.Input = cohereReq.Texts
+	case len(cohereReq.Images) > 0:
+		for _, image := range cohereReq.Images {
+			unifiedReq.Contents = append(unifiedReq.Contents, []UnifiedEmbeddingPart{{Type: "image", ImageURL: image}})
+		}
+	default:
+		for _, input := range cohereReq.Inputs {
+			if len(input.Content) == 0 {
+				return nil, &ParameterError{Parameter: "inputs", Message: "every input needs content"}
+			}
+			var parts []UnifiedEmbeddingPart
+			for _, part := range input.Content {
+				switch part.Type {
+				case "text":
+					parts = append(parts, UnifiedEmbeddingPart{Type: "text", Text: part.Text})
+				case "image_url":
+					parts = append(parts, UnifiedEmbeddingPart{Type: "image", ImageURL: part.ImageURL.URL})
+				default:
+					return nil, &ParameterError{Parameter: "inputs", Message: "content type " + part.Type + " is not supported"}
+				}
+			}
+			unifiedReq.Contents = append(unifiedReq.Contents, parts)
+		}
+	}
+
+	return unifiedReq, nil
+}
+
+func (a *CohereAdapter) UnifiedEmbeddingToBackend(unifiedReq *UnifiedEmbeddingRequest, backendURL string) (*http.Request, error) {
+	if len(unifiedReq.Tokens) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "token arrays are not supported by Cohere; send text"}
+	}
+
+	// Cohere requires an input_type for v3+ models; map the generic
+	// query/document hint onto its search-specific names.
+	inputType := "search_document"
+	switch unifiedReq.InputType {
+	case "":
+	case "query":
+		inputType = "search_query"
+	case "document":
+		inputType = "search_document"
+	default:
+		inputType = unifiedReq.InputType
+	}
+
+	cohereReq := map[string]interface{}{
+		"model":           unifiedReq.Model,
+		"input_type":      inputType,
+		"embedding_types": []string{"float"},
+	}
+	if unifiedReq.Dimensions > 0 {
+		cohereReq["output_dimension"] = unifiedReq.Dimensions
+	}
+	if unifiedReq.Truncate != nil {
+		cohereReq["truncate"] = "NONE"
+		if *unifiedReq.Truncate {
+			cohereReq["truncate"] = "END"
+		}
+	}
+
+	if len(unifiedReq.Contents) > 0 {
+		inputs := make([]map[string]interface{}, len(unifiedReq.Contents))
+		for i, parts := range unifiedReq.Contents {
+			cohereParts := make([]map[string]interface{}, len(parts))
+			for j, part := range parts {
+				if part.Type == "text" {
+					cohereParts[j] = map[string]interface{}{"type": "text", "text": part.Text}
+					continue
+				}
+				// Cohere only accepts inline images.
+				if !isDataURI(part.ImageURL) {
+					return nil, fmt.Errorf("Cohere image inputs must be base64 data URIs")
+				}
+				cohereParts[j] = map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]string{"url": part.ImageURL},
+				}
+			}
+			inputs[i] = map[string]interface{}{"content": cohereParts}
+		}
+		cohereReq["inputs"] = inputs
+	} else {
+		cohereReq["texts"] = unifiedReq.Input
+	}
+
+	body, err := json.Marshal(cohereReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", backendURL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (a *CohereAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*UnifiedEmbeddingResponse, error) {
+	var cohereResp struct {
+		ID         string `json:"id"`
+		Embeddings struct {
+			Float [][]float32 `json:"float"`
+		} `json:"embeddings"`
+		Meta struct {
+			BilledUnits struct {
+				InputTokens int `json:"input_tokens"`
+			} `json:"billed_units"`
+		} `json:"meta"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&cohereResp); err != nil {
+		return nil, err
+	}
+
+	return &UnifiedEmbeddingResponse{
+		ID:         cohereResp.ID,
+		Embeddings: cohereResp.Embeddings.Float,
+		Usage:      UnifiedUsage{InputTokens: cohereResp.Meta.BilledUnits.InputTokens},
+	}, nil
+}
+
+func (a *CohereAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingResponse, w http.ResponseWriter) error {
+	// Cohere SDKs require a response ID, which other backends do not give.
+	id := unifiedResp.ID
+	if id == "" {
+		random := make([]byte, 16)
+		rand.Read(random)
+		id = hex.EncodeToString(random)
+	}
+	cohereResp := map[string]interface{}{
+		"id":            id,
+		"response_type": "embeddings_by_type",
+		"embeddings": map[string]interface{}{
+			"float": unifiedResp.Embeddings,
+		},
+		"meta": map[string]interface{}{
+			"api_version": map[string]string{"version": "2"},
+			"billed_units": map[string]int{
+				"input_tokens": unifiedResp.Usage.InputTokens,
+			},
+		},
+	}
+
+	respBody, err := json.Marshal(cohereResp)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+	return nil
+}
@@ -0,0 +1,103 @@
+package adapters
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCohereAdapter_UnifiedEmbeddingToBackend(t *testing.T) {
+	adapter := &CohereAdapter{}
+
+	unified := &UnifiedEmbeddingRequest{
+		Model: "embed-v4.0",
+		Contents: [][]UnifiedEmbeddingPart{
+			{
+				{Type: "text", Text: "A cat"},
+				{Type: "image", ImageURL: "data:image/png;base64,iVBORw0KGgo="},
+			},
+		},
+		InputType: "query",
+	}
+
+	req, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.cohere.com/v2/embed")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode request body: %v", err)
+	}
+
+	if body["input_type"] != "search_query" {
+		t.Errorf("Expected input_type search_query, got: %v", body["input_type"])
+	}
+
+	inputs, ok := body["inputs"].([]interface{})
+	if !ok || len(inputs) != 1 {
+		t.Fatalf("Expected 1 multimodal input, got: %v", body["inputs"])
+	}
+
+	// Remote image URLs must be rejected
+	unified.Contents[0][1].ImageURL = "https://example.com/cat.png"
+	if _, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.cohere.com/v2/embed"); err == nil {
+		t.Error("Expected error for non-data-URI image")
+	}
+}
+
+func TestCohereAdapter_BackendEmbeddingToUnified(t *testing.T) {
+	adapter := &CohereAdapter{}
+
+	respBody := `{"id": "abc", "embeddings": {"float": [[0.1, 0.2], [0.3, 0.4]]}, "meta": {"billed_units": {"input_tokens": 7}}}`
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(respBody)),
+	}
+
+	unified, err := adapter.BackendEmbeddingToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Embeddings) != 2 || unified.Embeddings[1][1] != 0.4 {
+		t.Errorf("Expected float embeddings, got: %v", unified.Embeddings)
+	}
+
+	if unified.Usage.InputTokens != 7 {
+		t.Errorf("Expected the billed input tokens, got: %d", unified.Usage.InputTokens)
+	}
+}
+
+func TestCohereAdapter_ClientEmbeddingToUnified(t *testing.T) {
+	adapter := &CohereAdapter{}
+
+	body := `{"model": "embed-v4.0", "inputs": [{"content": [{"type": "text", "text": "a cat"}, {"type": "image_url", "image_url": {"url": "data:image/png;base64,AAAA"}}]}], "input_type": "search_document", "output_dimension": 256, "truncate": "NONE"}`
+	req, _ := http.NewRequest("POST", "/v2/embed", strings.NewReader(body))
+	unified, err := adapter.ClientEmbeddingToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unified.Model != "embed-v4.0" || unified.InputType != "document" || unified.Dimensions != 256 {
+		t.Errorf("Expected model, document input type and 256 dimensions, got: %+v", unified)
+	}
+	if unified.Truncate == nil || *unified.Truncate {
+		t.Errorf("Expected truncate false, got: %v", unified.Truncate)
+	}
+	if len(unified.Contents) != 1 || len(unified.Contents[0]) != 2 || unified.Contents[0][1].ImageURL != "data:image/png;base64,AAAA" {
+		t.Errorf("Expected one text and image input, got: %+v", unified.Contents)
+	}
+
+	for _, body := range []string{
+		`{"model": "embed-v4.0"}`,
+		`{"model": "embed-v4.0", "texts": ["a"], "images": ["data:image/png;base64,AAAA"]}`,
+		`{"model": "embed-v4.0", "texts": ["a"], "truncate": "MIDDLE"}`,
+	} {
+		req, _ := http.NewRequest("POST", "/v2/embed", strings.NewReader(body))
+		if _, err := adapter.ClientEmbeddingToUnified(req); err == nil {
+			t.Errorf("Expected error for %s", body)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// CompletionToChat turns a text completion request into a chat request that
+// carries the prompt as a single user message, for backends that only
+// implement the chat API.
+func CompletionToChat(req *UnifiedCompletionRequest) *UnifiedChatRequest {
+	parameters := make(map[string]interface{}, len(req.Parameters))
+	for key, value := range req.Parameters {
+		parameters[key] = value
+	}
+
+	return &UnifiedChatRequest{
+		Model:      req.Model,
+		Messages:   []UnifiedMessage{{Role: "user", Content: req.Prompt}},
+		MaxTokens:  req.MaxTokens,
+		Stop:       req.Stop,
+		Parameters: parameters,
+	}
+}
+
+// ChatToCompletion turns the chat response to a CompletionToChat request
+// back into a text completion.
+func ChatToCompletion(resp *UnifiedChatResponse) *UnifiedCompletionResponse {
+	return &UnifiedCompletionResponse{
+		ID:           resp.ID,
+		Model:        resp.Model,
+		Text:         resp.Content,
+		FinishReason: openaiStopReason(resp.StopReason),
+		Usage:        resp.Usage,
+	}
+}
+
+// parseCompletionPrompt accepts a prompt given as a string or as an array
+// holding a single string. Batched and pre-tokenized prompts have no chat
+// equivalent and are rejected.
+func parseCompletionPrompt(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", nil
+	}
+	var prompt string
+	if err := json.Unmarshal(raw, &prompt); err == nil {
+		return prompt, nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(raw, &prompts); err != nil {
+		return "", fmt.Errorf("prompt must be a string or an array of strings")
+	}
+	if len(prompts) != 1 {
+		return "", fmt.Errorf("only a single prompt is supported, got %d", len(prompts))
+	}
+	return prompts[0], nil
+}
+
+// parseStopSequences accepts OpenAI's stop field as a string or an array.
+func parseStopSequences(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var stop string
+	if err := json.Unmarshal(raw, &stop); err == nil {
+		return []string{stop}, nil
+	}
+	var stops []string
+	if err := json.Unmarshal(raw, &stops); err != nil {
+		return nil, fmt.Errorf("stop must be a string or an array of strings")
+	}
+	return stops, nil
+}
@@ -0,0 +1,179 @@
+package adapters
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// encodeEmbeddingBase64 packs a vector as little-endian float32 values and
+// base64-encodes the result, matching OpenAI's encoding_format "base64".
+func encodeEmbeddingBase64(embedding []float32) string {
+	buf := make([]byte, 4*len(embedding))
+	for i, v := range embedding {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(v))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// decodeEmbeddingBase64 is the inverse of encodeEmbeddingBase64.
+func decodeEmbeddingBase64(encoded string) ([]float32, error) {
+	buf, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf)%4 != 0 {
+		return nil, fmt.Errorf("base64 embedding length %d is not a multiple of 4", len(buf))
+	}
+	embedding := make([]float32, len(buf)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return embedding, nil
+}
+
+// decodeEmbedding accepts either a JSON float array or a base64 string.
+func decodeEmbedding(raw json.RawMessage) ([]float32, error) {
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		return decodeEmbeddingBase64(encoded)
+	}
+	var embedding []float32
+	if err := json.Unmarshal(raw, &embedding); err != nil {
+		return nil, err
+	}
+	return embedding, nil
+}
+
+// parseEmbeddingInput normalizes the accepted `input` shapes onto the
+// unified request: a single string, an array of strings, a single token
+// array, an array of token arrays, or multimodal content parts (a single
+// part, an array of parts, or an array of part arrays for mixed inputs).
+// Inputs it cannot use are reported as a *ParameterError.
+func parseEmbeddingInput(raw json.RawMessage, unifiedReq *UnifiedEmbeddingRequest) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return &ParameterError{Parameter: "input", Message: "is required"}
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err == nil && len(items) == 0 {
+		return &ParameterError{Parameter: "input", Message: "must not be empty"}
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		unifiedReq.Input = []string{single}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(raw, &texts); err == nil {
+		unifiedReq.Input = texts
+		return nil
+	}
+	var tokens []int
+	if err := json.Unmarshal(raw, &tokens); err == nil {
+		unifiedReq.Tokens = [][]int{tokens}
+		return nil
+	}
+	var tokenBatches [][]int
+	if err := json.Unmarshal(raw, &tokenBatches); err == nil {
+		for _, batch := range tokenBatches {
+			if len(batch) == 0 {
+				return &ParameterError{Parameter: "input", Message: "token arrays must not be empty"}
+			}
+		}
+		unifiedReq.Tokens = tokenBatches
+		return nil
+	}
+
+	contents, err := parseEmbeddingContents(raw)
+	if err != nil {
+		return &ParameterError{Parameter: "input", Message: "must be a string, an array of strings, token arrays, or content parts"}
+	}
+	unifiedReq.Contents = contents
+	return nil
+}
+
+// embeddingPart mirrors the chat content-part shape used for multimodal
+// inputs: {"type": "text", "text": ...} or {"type": "image_url", "image_url": {"url": ...}}.
+type embeddingPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text"`
+	ImageURL json.RawMessage `json:"image_url"`
+}
+
+func (p embeddingPart) toUnified() (UnifiedEmbeddingPart, error) {
+	switch p.Type {
+	case "text":
+		return UnifiedEmbeddingPart{Type: "text", Text: p.Text}, nil
+	case "image_url":
+		// Accept both {"url": "..."} and a bare string.
+		var wrapped struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(p.ImageURL, &wrapped); err == nil && wrapped.URL != "" {
+			return UnifiedEmbeddingPart{Type: "image", ImageURL: wrapped.URL}, nil
+		}
+		var url string
+		if err := json.Unmarshal(p.ImageURL, &url); err == nil && url != "" {
+			return UnifiedEmbeddingPart{Type: "image", ImageURL: url}, nil
+		}
+		return UnifiedEmbeddingPart{}, fmt.Errorf("image_url part is missing a url")
+	default:
+		return UnifiedEmbeddingPart{}, fmt.Errorf("unsupported content part type %q", p.Type)
+	}
+}
+
+// parseEmbeddingContents decodes multimodal inputs. A flat array of parts is
+// treated as one input per part; nested arrays group parts into one input.
+func parseEmbeddingContents(raw json.RawMessage) ([][]UnifiedEmbeddingPart, error) {
+	var single embeddingPart
+	if err := json.Unmarshal(raw, &single); err == nil {
+		part, err := single.toUnified()
+		if err != nil {
+			return nil, err
+		}
+		return [][]UnifiedEmbeddingPart{{part}}, nil
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	contents := make([][]UnifiedEmbeddingPart, len(items))
+	for i, item := range items {
+		var text string
+		if err := json.Unmarshal(item, &text); err == nil {
+			contents[i] = []UnifiedEmbeddingPart{{Type: "text", Text: text}}
+			continue
+		}
+		var part embeddingPart
+		if err := json.Unmarshal(item, &part); err == nil {
+			unifiedPart, err := part.toUnified()
+			if err != nil {
+				return nil, err
+			}
+			contents[i] = []UnifiedEmbeddingPart{unifiedPart}
+			continue
+		}
+		var group []embeddingPart
+		if err := json.Unmarshal(item, &group); err != nil {
+			return nil, err
+		}
+		for _, part := range group {
+			unifiedPart, err := part.toUnified()
+			if err != nil {
+				return nil, err
+			}
+			contents[i] = append(contents[i], unifiedPart)
+		}
+	}
+	return contents, nil
+}
+
+// isDataURI reports whether an image reference carries inline base64 bytes.
+func isDataURI(url string) bool {
+	return strings.HasPrefix(url, "data:")
+}
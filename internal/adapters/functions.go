@@ -0,0 +1,40 @@
+package adapters
+
+// The legacy Chat Completions functions API predates tools: requests carry
+// `functions` and `function_call` instead of `tools` and `tool_choice`,
+// assistant messages a single `function_call`, and function results the
+// "function" role with the function's name instead of a call ID.
+
+// legacyFunctionCall is the function_call of a legacy assistant message.
+type legacyFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// legacyFunctionCallToUnified converts a legacy function_call request
+// field ("auto", "none" or {"name": ...}) to a unified tool_choice.
+func legacyFunctionCallToUnified(functionCall interface{}) interface{} {
+	switch v := functionCall.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok {
+			return map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": name},
+			}
+		}
+	}
+	return nil
+}
+
+// legacyFunctionCallFromUnified returns the first tool call of a choice as
+// a legacy function_call, or nil. The legacy API has one call per message,
+// so any others are dropped.
+func legacyFunctionCallFromUnified(choice *UnifiedChatResponse) map[string]interface{} {
+	if len(choice.ToolCalls) == 0 {
+		return nil
+	}
+	call := choice.ToolCalls[0].Function
+	return map[string]interface{}{"name": call.Name, "arguments": call.Arguments}
+}
@@ -0,0 +1,126 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GeminiAdapter implements the embedding half of the Adapter interface for
+// the Google Gemini API (batchEmbedContents).
+type GeminiAdapter struct{}
+
+// --- Chat Completion Operations ---
+
+func (a *GeminiAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatRequest, error) {
+	return nil, fmt.Errorf("Gemini chat requests are not supported")
+}
+
+func (a *GeminiAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
+	return nil, fmt.Errorf("Gemini chat requests are not supported")
+}
+
+func (a *GeminiAdapter) BackendChatToUnified(backendResp *http.Response) (*UnifiedChatResponse, error) {
+	return nil, fmt.Errorf("Gemini chat responses are not supported")
+}
+
+func (a *GeminiAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("Gemini chat responses are not supported")
+}
+
+// --- Error Translation ---
+
+func (a *GeminiAdapter) TranslateError(backendResp *http.Response) []byte {
+	var geminiError struct {
+		Error struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&geminiError); err != nil || geminiError.Error.Message == "" {
+		return []byte(`{"error": {"message": "An error occurred at the backend.", "type": "broker_error"}}`)
+	}
+
+	errorBody, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"message": geminiError.Error.Message,
+			"type":    strings.ToLower(geminiError.Error.Status),
+		},
+	})
+	return errorBody
+}
+
+// --- Embedding Operations ---
+
+func (a *GeminiAdapter) ClientEmbeddingToUnified(r *http.Request) (*UnifiedEmbeddingRequest, error) {
+	return nil, fmt.Errorf("Gemini-format embedding clients are not supported")
+}
+
+func (a *GeminiAdapter) UnifiedEmbeddingToBackend(unifiedReq *UnifiedEmbeddingRequest, backendURL string) (*http.Request, error) {
+	if len(unifiedReq.Tokens) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "token arrays are not supported by Gemini; send text"}
+	}
+	if len(unifiedReq.Contents) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "images are not supported by Gemini text embedding models"}
+	}
+
+	// Gemini addresses models as "models/<name>" inside each request.
+	model := unifiedReq.Model
+	if !strings.HasPrefix(model, "models/") {
+		model = "models/" + model
+	}
+
+	requests := make([]map[string]interface{}, len(unifiedReq.Input))
+	for i, text := range unifiedReq.Input {
+		requests[i] = map[string]interface{}{
+			"model": model,
+			"content": map[string]interface{}{
+				"parts": []map[string]string{{"text": text}},
+			},
+		}
+		if unifiedReq.Dimensions > 0 {
+			requests[i]["outputDimensionality"] = unifiedReq.Dimensions
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"requests": requests})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", backendURL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (a *GeminiAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*UnifiedEmbeddingResponse, error) {
+	var geminiResp struct {
+		Embeddings []struct {
+			Values []float32 `json:"values"`
+		} `json:"embeddings"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&geminiResp); err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float32, len(geminiResp.Embeddings))
+	for i, embedding := range geminiResp.Embeddings {
+		embeddings[i] = embedding.Values
+	}
+
+	return &UnifiedEmbeddingResponse{
+		Embeddings: embeddings,
+	}, nil
+}
+
+func (a *GeminiAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("Gemini-format embedding clients are not supported")
+}
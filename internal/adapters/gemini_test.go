@@ -0,0 +1,93 @@
+package adapters
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGeminiAdapter_UnifiedEmbeddingToBackend(t *testing.T) {
+	adapter := &GeminiAdapter{}
+
+	unified := &UnifiedEmbeddingRequest{
+		Input:      []string{"Hello", "World"},
+		Model:      "text-embedding-004",
+		Dimensions: 256,
+	}
+
+	req, err := adapter.UnifiedEmbeddingToBackend(unified, "https://generativelanguage.googleapis.com/v1beta/models/text-embedding-004:batchEmbedContents")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var body struct {
+		Requests []struct {
+			Model   string `json:"model"`
+			Content struct {
+				Parts []struct {
+					Text string `json:"text"`
+				} `json:"parts"`
+			} `json:"content"`
+			OutputDimensionality int `json:"outputDimensionality"`
+		} `json:"requests"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode request body: %v", err)
+	}
+
+	if len(body.Requests) != 2 {
+		t.Fatalf("Expected 2 requests, got: %d", len(body.Requests))
+	}
+
+	if body.Requests[0].Model != "models/text-embedding-004" {
+		t.Errorf("Expected model models/text-embedding-004, got: %s", body.Requests[0].Model)
+	}
+
+	if body.Requests[1].Content.Parts[0].Text != "World" {
+		t.Errorf("Expected second text 'World', got: %s", body.Requests[1].Content.Parts[0].Text)
+	}
+
+	if body.Requests[0].OutputDimensionality != 256 {
+		t.Errorf("Expected outputDimensionality 256, got: %d", body.Requests[0].OutputDimensionality)
+	}
+}
+
+func TestGeminiAdapter_BackendEmbeddingToUnified(t *testing.T) {
+	adapter := &GeminiAdapter{}
+
+	respBody := `{"embeddings": [{"values": [0.1, 0.2]}, {"values": [0.3, 0.4]}]}`
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(respBody)),
+	}
+
+	unified, err := adapter.BackendEmbeddingToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Embeddings) != 2 {
+		t.Fatalf("Expected 2 embeddings, got: %d", len(unified.Embeddings))
+	}
+
+	if unified.Embeddings[1][0] != 0.3 {
+		t.Errorf("Expected first component of second embedding 0.3, got: %v", unified.Embeddings[1][0])
+	}
+}
+
+func TestTextEmbeddingAdapters_RejectImages(t *testing.T) {
+	unified := &UnifiedEmbeddingRequest{
+		Contents: [][]UnifiedEmbeddingPart{{{Type: "image", ImageURL: "data:image/png;base64,AAAA"}}},
+		Model:    "text-embedding",
+	}
+	for name, adapter := range map[string]Adapter{"gemini": &GeminiAdapter{}, "ollama": &OllamaAdapter{}} {
+		_, err := adapter.UnifiedEmbeddingToBackend(unified, "http://backend/")
+		var paramErr *ParameterError
+		if !errors.As(err, &paramErr) || paramErr.Parameter != "input" {
+			t.Errorf("%s: expected an input parameter error, got: %v", name, err)
+		}
+	}
+}
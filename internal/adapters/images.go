@@ -0,0 +1,69 @@
+package adapters
+
+import "strings"
+
+// imageFromURL builds a UnifiedImage from an image reference, splitting
+// data: URIs into media type and base64 payload.
+func imageFromURL(url string) UnifiedImage {
+	if rest, ok := strings.CutPrefix(url, "data:"); ok {
+		if meta, data, found := strings.Cut(rest, ","); found && strings.HasSuffix(meta, ";base64") {
+			return UnifiedImage{
+				MediaType: strings.TrimSuffix(meta, ";base64"),
+				Data:      data,
+			}
+		}
+	}
+	return UnifiedImage{URL: url}
+}
+
+// dataURI renders the image as a URL, inlining base64 payloads as data: URIs.
+func (img UnifiedImage) dataURI() string {
+	if img.URL != "" {
+		return img.URL
+	}
+	return "data:" + img.MediaType + ";base64," + img.Data
+}
+
+// anthropicImageToUnified converts an Anthropic image block.
+func anthropicImageToUnified(block map[string]interface{}) (UnifiedImage, bool) {
+	source, ok := block["source"].(map[string]interface{})
+	if !ok {
+		return UnifiedImage{}, false
+	}
+	switch source["type"] {
+	case "base64":
+		mediaType, _ := source["media_type"].(string)
+		data, _ := source["data"].(string)
+		return UnifiedImage{MediaType: mediaType, Data: data}, true
+	case "url":
+		url, _ := source["url"].(string)
+		return UnifiedImage{URL: url}, true
+	}
+	return UnifiedImage{}, false
+}
+
+// unifiedImageToAnthropic renders an image as an Anthropic image block.
+func unifiedImageToAnthropic(img UnifiedImage) map[string]interface{} {
+	if img.URL != "" {
+		return map[string]interface{}{
+			"type":   "image",
+			"source": map[string]interface{}{"type": "url", "url": img.URL},
+		}
+	}
+	return map[string]interface{}{
+		"type": "image",
+		"source": map[string]interface{}{
+			"type":       "base64",
+			"media_type": img.MediaType,
+			"data":       img.Data,
+		},
+	}
+}
+
+// unifiedImageToOpenAI renders an image as an OpenAI image_url content part.
+func unifiedImageToOpenAI(img UnifiedImage) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "image_url",
+		"image_url": map[string]string{"url": img.dataURI()},
+	}
+}
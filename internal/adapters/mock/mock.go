@@ -0,0 +1,265 @@
+// Package mock serves the OpenAI API in process for "mock" targets, so
+// clients and CI can use the broker without calling any backend.
+package mock
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// embeddingDimensions is the size of mock embeddings unless the request
+// asks for another.
+const embeddingDimensions = 16
+
+// Transport answers requests to a mock target in process.
+type Transport struct {
+	// Response is the content of every answer, with {{input}} and
+	// {{model}} filled in.
+	Response string
+	// Latency is how long the target waits before answering.
+	Latency time.Duration
+	// ChunkDelay is the pause between the chunks of a streamed answer.
+	ChunkDelay time.Duration
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body map[string]interface{}
+	if req.Body != nil {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				return jsonResponse(req, http.StatusBadRequest, map[string]interface{}{"error": map[string]interface{}{"message": "invalid JSON body", "type": "invalid_request_error"}}), nil
+			}
+		}
+	}
+	if err := sleepContext(req.Context(), t.Latency); err != nil {
+		return nil, err
+	}
+
+	model, _ := body["model"].(string)
+	switch path := req.URL.Path; {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return t.chat(req, body, model), nil
+	case strings.HasSuffix(path, "/completions"):
+		prompt, _ := body["prompt"].(string)
+		content := t.render(prompt, model)
+		usage := tokenUsage(estimateTokens(prompt), estimateTokens(content))
+		return jsonResponse(req, http.StatusOK, map[string]interface{}{
+			"id":      "cmpl-mock",
+			"object":  "text_completion",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []interface{}{map[string]interface{}{"index": 0, "text": content, "finish_reason": "stop"}},
+			"usage":   usage,
+		}), nil
+	case strings.HasSuffix(path, "/embeddings"):
+		return embeddings(req, body, model), nil
+	case strings.HasSuffix(path, "/models"):
+		return jsonResponse(req, http.StatusOK, map[string]interface{}{"object": "list", "data": []interface{}{}}), nil
+	}
+	return jsonResponse(req, http.StatusNotFound, map[string]interface{}{"error": map[string]interface{}{"message": "mock targets do not serve " + req.URL.Path, "type": "invalid_request_error"}}), nil
+}
+
+// chat answers a chat completion, as a stream if the request asks for one.
+func (t *Transport) chat(req *http.Request, body map[string]interface{}, model string) *http.Response {
+	var input strings.Builder
+	last := ""
+	messages, _ := body["messages"].([]interface{})
+	for _, item := range messages {
+		msg, _ := item.(map[string]interface{})
+		text := contentText(msg["content"])
+		input.WriteString(text)
+		if msg["role"] == "user" {
+			last = text
+		}
+	}
+	content := t.render(last, model)
+	usage := tokenUsage(estimateTokens(input.String()), estimateTokens(content))
+
+	if stream, _ := body["stream"].(bool); !stream {
+		return jsonResponse(req, http.StatusOK, map[string]interface{}{
+			"id":      "chatcmpl-mock",
+			"object":  "chat.completion",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []interface{}{map[string]interface{}{
+				"index":         0,
+				"message":       map[string]interface{}{"role": "assistant", "content": content},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+	}
+
+	includeUsage := false
+	if options, ok := body["stream_options"].(map[string]interface{}); ok {
+		includeUsage, _ = options["include_usage"].(bool)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		chunk := func(delta map[string]interface{}, finishReason interface{}) map[string]interface{} {
+			return map[string]interface{}{
+				"id":      "chatcmpl-mock",
+				"object":  "chat.completion.chunk",
+				"created": time.Now().Unix(),
+				"model":   model,
+				"choices": []interface{}{map[string]interface{}{"index": 0, "delta": delta, "finish_reason": finishReason}},
+			}
+		}
+		events := []map[string]interface{}{chunk(map[string]interface{}{"role": "assistant", "content": ""}, nil)}
+		for _, word := range strings.SplitAfter(content, " ") {
+			if word != "" {
+				events = append(events, chunk(map[string]interface{}{"content": word}, nil))
+			}
+		}
+		events = append(events, chunk(map[string]interface{}{}, "stop"))
+		if includeUsage {
+			final := chunk(nil, nil)
+			final["choices"] = []interface{}{}
+			final["usage"] = usage
+			events = append(events, final)
+		}
+		for i, event := range events {
+			if i > 1 {
+				if err := sleepContext(req.Context(), t.ChunkDelay); err != nil {
+					writer.CloseWithError(err)
+					return
+				}
+			}
+			data, _ := json.Marshal(event)
+			if _, err := fmt.Fprintf(writer, "data: %s\n\n", data); err != nil {
+				return
+			}
+		}
+		io.WriteString(writer, "data: [DONE]\n\n")
+		writer.Close()
+	}()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       reader,
+		Request:    req,
+	}
+}
+
+// render fills in the response template.
+func (t *Transport) render(input, model string) string {
+	return strings.NewReplacer("{{input}}", input, "{{model}}", model).Replace(t.Response)
+}
+
+// embeddings answers an embedding request with vectors derived from a
+// hash of each input, so equal inputs get equal embeddings.
+func embeddings(req *http.Request, body map[string]interface{}, model string) *http.Response {
+	var inputs []string
+	switch input := body["input"].(type) {
+	case string:
+		inputs = []string{input}
+	case []interface{}:
+		for _, item := range input {
+			text, _ := item.(string)
+			inputs = append(inputs, text)
+		}
+	}
+	dimensions := embeddingDimensions
+	if n, ok := body["dimensions"].(float64); ok && n > 0 {
+		dimensions = int(n)
+	}
+	data := make([]interface{}, 0, len(inputs))
+	tokens := 0
+	for i, input := range inputs {
+		vector := make([]float64, dimensions)
+		var norm float64
+		for j := range vector {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s", j, input)))
+			vector[j] = float64(binary.BigEndian.Uint32(sum[:4]))/math.MaxUint32*2 - 1
+			norm += vector[j] * vector[j]
+		}
+		for j := range vector {
+			vector[j] /= math.Sqrt(norm)
+		}
+		data = append(data, map[string]interface{}{"object": "embedding", "index": i, "embedding": vector})
+		tokens += estimateTokens(input)
+	}
+	return jsonResponse(req, http.StatusOK, map[string]interface{}{
+		"object": "list",
+		"model":  model,
+		"data":   data,
+		"usage":  map[string]int{"prompt_tokens": tokens, "total_tokens": tokens},
+	})
+}
+
+// contentText returns the text of a message's content, a string or a
+// list of content parts.
+func contentText(content interface{}) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []interface{}:
+		var parts []string
+		for _, item := range v {
+			if part, ok := item.(map[string]interface{}); ok {
+				if text, ok := part["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	}
+	return ""
+}
+
+// estimateTokens estimates the tokens of a text at four characters each.
+func estimateTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+func tokenUsage(input, output int) map[string]int {
+	return map[string]int{"prompt_tokens": input, "completion_tokens": output, "total_tokens": input + output}
+}
+
+func jsonResponse(req *http.Request, status int, body interface{}) *http.Response {
+	data, _ := json.Marshal(body)
+	return &http.Response{
+		StatusCode:    status,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          io.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+		Request:       req,
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
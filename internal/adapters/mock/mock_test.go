@@ -0,0 +1,73 @@
+package mock
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTransport_Chat(t *testing.T) {
+	transport := &Transport{Response: "{{model}} says {{input}}"}
+	req, _ := http.NewRequest("POST", "http://mock/chat/completions", strings.NewReader(`{"model": "mock-1", "messages": [{"role": "user", "content": "hello"}]}`))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	json.NewDecoder(resp.Body).Decode(&completion)
+	if resp.StatusCode != http.StatusOK || len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "mock-1 says hello" {
+		t.Errorf("Expected the rendered response, got: %d %+v", resp.StatusCode, completion)
+	}
+}
+
+func TestTransport_Stream(t *testing.T) {
+	transport := &Transport{Response: "one two"}
+	req, _ := http.NewRequest("POST", "http://mock/chat/completions", strings.NewReader(`{"model": "mock-1", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`))
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != "text/event-stream" || strings.Count(string(body), "data: ") != 5 || !strings.HasSuffix(string(body), "data: [DONE]\n\n") {
+		t.Errorf("Expected a chunk per word and [DONE], got: %s", body)
+	}
+}
+
+func TestTransport_Embeddings(t *testing.T) {
+	transport := &Transport{}
+	send := func(body string) []struct {
+		Embedding []float64 `json:"embedding"`
+	} {
+		req, _ := http.NewRequest("POST", "http://mock/embeddings", strings.NewReader(body))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		var result struct {
+			Data []struct {
+				Embedding []float64 `json:"embedding"`
+			} `json:"data"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return result.Data
+	}
+
+	data := send(`{"model": "mock-embed", "input": ["a", "b", "a"]}`)
+	if len(data) != 3 || len(data[0].Embedding) != embeddingDimensions {
+		t.Fatalf("Expected 3 embeddings of %d dimensions, got: %+v", embeddingDimensions, data)
+	}
+	if data[0].Embedding[0] != data[2].Embedding[0] || data[0].Embedding[0] == data[1].Embedding[0] {
+		t.Errorf("Expected equal inputs to get equal embeddings, got: %+v", data)
+	}
+	if data := send(`{"model": "mock-embed", "input": "a", "dimensions": 4}`); len(data) != 1 || len(data[0].Embedding) != 4 {
+		t.Errorf("Expected the requested dimensions, got: %+v", data)
+	}
+}
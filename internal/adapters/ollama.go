@@ -0,0 +1,147 @@
+package adapters
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// OllamaAdapter implements the embedding half of the Adapter interface for
+// Ollama's native /api/embed endpoint. Chat traffic to Ollama should use the
+// "openai" type against its OpenAI-compatible /v1 endpoint. It serves
+// /api/embed clients too, so tools built for Ollama can embed against any
+// backend.
+type OllamaAdapter struct{}
+
+// --- Chat Completion Operations ---
+
+func (a *OllamaAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatRequest, error) {
+	return nil, fmt.Errorf("Ollama native chat requests are not supported")
+}
+
+func (a *OllamaAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
+	return nil, fmt.Errorf("Ollama native chat requests are not supported")
+}
+
+func (a *OllamaAdapter) BackendChatToUnified(backendResp *http.Response) (*UnifiedChatResponse, error) {
+	return nil, fmt.Errorf("Ollama native chat responses are not supported")
+}
+
+func (a *OllamaAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("Ollama native chat responses are not supported")
+}
+
+// --- Error Translation ---
+
+func (a *OllamaAdapter) TranslateError(backendResp *http.Response) []byte {
+	var ollamaError struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&ollamaError); err != nil || ollamaError.Error == "" {
+		return []byte(`{"error": {"message": "An error occurred at the backend.", "type": "broker_error"}}`)
+	}
+
+	errorBody, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"message": ollamaError.Error,
+			"type":    "backend_error",
+		},
+	})
+	return errorBody
+}
+
+// --- Embedding Operations ---
+
+func (a *OllamaAdapter) ClientEmbeddingToUnified(r *http.Request) (*UnifiedEmbeddingRequest, error) {
+	var ollamaReq struct {
+		Model      string          `json:"model"`
+		Input      json.RawMessage `json:"input"`
+		Truncate   *bool           `json:"truncate"`
+		Dimensions int             `json:"dimensions"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&ollamaReq); err != nil {
+		return nil, err
+	}
+
+	unifiedReq := &UnifiedEmbeddingRequest{
+		Model:      ollamaReq.Model,
+		Dimensions: ollamaReq.Dimensions,
+		Truncate:   ollamaReq.Truncate,
+	}
+	if err := parseEmbeddingInput(ollamaReq.Input, unifiedReq); err != nil {
+		return nil, err
+	}
+	if len(unifiedReq.Tokens) > 0 || len(unifiedReq.Contents) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "must be a string or a list of strings"}
+	}
+
+	return unifiedReq, nil
+}
+
+func (a *OllamaAdapter) UnifiedEmbeddingToBackend(unifiedReq *UnifiedEmbeddingRequest, backendURL string) (*http.Request, error) {
+	if len(unifiedReq.Tokens) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "token arrays are not supported by Ollama; send text"}
+	}
+	if len(unifiedReq.Contents) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "images are not supported by Ollama text embedding models"}
+	}
+
+	ollamaReq := map[string]interface{}{
+		"model": unifiedReq.Model,
+		"input": unifiedReq.Input,
+	}
+	if unifiedReq.Dimensions > 0 {
+		ollamaReq["dimensions"] = unifiedReq.Dimensions
+	}
+
+	body, err := json.Marshal(ollamaReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", backendURL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (a *OllamaAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*UnifiedEmbeddingResponse, error) {
+	var ollamaResp struct {
+		Model           string      `json:"model"`
+		Embeddings      [][]float32 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&ollamaResp); err != nil {
+		return nil, err
+	}
+
+	return &UnifiedEmbeddingResponse{
+		Embeddings: ollamaResp.Embeddings,
+		Model:      ollamaResp.Model,
+		Usage:      UnifiedUsage{InputTokens: ollamaResp.PromptEvalCount},
+	}, nil
+}
+
+func (a *OllamaAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingResponse, w http.ResponseWriter) error {
+	ollamaResp := map[string]interface{}{
+		"model":             unifiedResp.Model,
+		"embeddings":        unifiedResp.Embeddings,
+		"prompt_eval_count": unifiedResp.Usage.InputTokens,
+	}
+
+	respBody, err := json.Marshal(ollamaResp)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+	return nil
+}
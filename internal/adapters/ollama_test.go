@@ -0,0 +1,92 @@
+package adapters
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOllamaAdapter_UnifiedEmbeddingToBackend(t *testing.T) {
+	adapter := &OllamaAdapter{}
+
+	unified := &UnifiedEmbeddingRequest{
+		Input: []string{"Hello"},
+		Model: "nomic-embed-text",
+	}
+
+	req, err := adapter.UnifiedEmbeddingToBackend(unified, "http://localhost:11434/api/embed")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode request body: %v", err)
+	}
+
+	if body["model"] != "nomic-embed-text" {
+		t.Errorf("Expected model nomic-embed-text, got: %v", body["model"])
+	}
+
+	input, ok := body["input"].([]interface{})
+	if !ok || len(input) != 1 || input[0] != "Hello" {
+		t.Errorf("Expected input [Hello], got: %v", body["input"])
+	}
+
+	// Token inputs cannot be expressed in the native API
+	unified.Tokens = [][]int{{1, 2, 3}}
+	if _, err := adapter.UnifiedEmbeddingToBackend(unified, "http://localhost:11434/api/embed"); err == nil {
+		t.Error("Expected error for token inputs")
+	}
+}
+
+func TestOllamaAdapter_BackendEmbeddingToUnified(t *testing.T) {
+	adapter := &OllamaAdapter{}
+
+	respBody := `{"model": "nomic-embed-text", "embeddings": [[0.1, 0.2, 0.3]], "prompt_eval_count": 2}`
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(respBody)),
+	}
+
+	unified, err := adapter.BackendEmbeddingToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if unified.Model != "nomic-embed-text" {
+		t.Errorf("Expected model nomic-embed-text, got: %s", unified.Model)
+	}
+
+	if len(unified.Embeddings) != 1 || len(unified.Embeddings[0]) != 3 {
+		t.Errorf("Expected one 3-dimensional embedding, got: %v", unified.Embeddings)
+	}
+
+	if unified.Usage.InputTokens != 2 {
+		t.Errorf("Expected prompt_eval_count as usage, got: %d", unified.Usage.InputTokens)
+	}
+}
+
+func TestOllamaAdapter_ClientEmbeddingToUnified(t *testing.T) {
+	adapter := &OllamaAdapter{}
+
+	req, _ := http.NewRequest("POST", "/api/embed", strings.NewReader(`{"model": "nomic", "input": "Hello", "truncate": false}`))
+	unified, err := adapter.ClientEmbeddingToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unified.Model != "nomic" || len(unified.Input) != 1 || unified.Input[0] != "Hello" {
+		t.Errorf("Expected one input for nomic, got: %+v", unified)
+	}
+	if unified.Truncate == nil || *unified.Truncate {
+		t.Errorf("Expected truncate false, got: %v", unified.Truncate)
+	}
+
+	// The native API only embeds text
+	req, _ = http.NewRequest("POST", "/api/embed", strings.NewReader(`{"model": "nomic", "input": [1, 2, 3]}`))
+	if _, err := adapter.ClientEmbeddingToUnified(req); err == nil {
+		t.Error("Expected error for token inputs")
+	}
+}
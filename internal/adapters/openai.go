@@ -3,6 +3,7 @@ package adapters
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
@@ -19,7 +20,7 @@ func (a *OpenAIAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReques
 		Model    string `json:"model"`
 		Messages []struct {
 			Role         string `json:"role"`
-			Content      string `json:"content"`
+			Content      json.RawMessage `json:"content"` // String, content parts, or null
 			ToolCalls    []struct {
 				ID       string `json:"id"`
 				Type     string `json:"type"`
@@ -30,22 +31,48 @@ func (a *OpenAIAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReques
 			} `json:"tool_calls"`
 			ToolCallID   string `json:"tool_call_id"`
 			Name         string `json:"name"`
+			FunctionCall *legacyFunctionCall `json:"function_call"` // Legacy functions API
 		} `json:"messages"`
-		Tools    []UnifiedTool `json:"tools"`
+		Tools    []json.RawMessage `json:"tools"`
 		ToolChoice interface{} `json:"tool_choice"`
+		// Legacy functions API, superseded by tools and tool_choice
+		Functions    []UnifiedFunction `json:"functions"`
+		FunctionCall interface{}       `json:"function_call"`
+		WebSearchOptions map[string]interface{} `json:"web_search_options"`
 		Stream   bool   `json:"stream"`
-		// Add other OpenAI-specific fields here if needed
-		// Parameters map[string]interface{} `json:"-"` // Handled separately
+		N                   int `json:"n"`
+		Stop                json.RawMessage `json:"stop"` // String or array of strings
+		StreamOptions       struct {
+			IncludeUsage bool `json:"include_usage"`
+		} `json:"stream_options"`
+		MaxTokens           int `json:"max_tokens"`
+		MaxCompletionTokens int `json:"max_completion_tokens"` // Supersedes max_tokens
+		// Remaining fields are collected into Parameters
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&openaiReq); err != nil {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &openaiReq); err != nil {
+		return nil, err
+	}
+	// Fields without a dedicated unified field are carried as parameters.
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
 		return nil, err
 	}
 
 	unifiedMessages := make([]UnifiedMessage, len(openaiReq.Messages))
+	legacyCallIDs := make(map[string]string)
 	for i, msg := range openaiReq.Messages {
 		unifiedMessages[i].Role = msg.Role
-		unifiedMessages[i].Content = msg.Content
+		content, images, err := openaiContentToUnified(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+		unifiedMessages[i].Content = content
+		unifiedMessages[i].Images = images
 		unifiedMessages[i].ToolCallID = msg.ToolCallID
 		unifiedMessages[i].Name = msg.Name
 
@@ -63,14 +90,60 @@ func (a *OpenAIAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReques
 			}
 			unifiedMessages[i].ToolCalls = unifiedToolCalls
 		}
+
+		// Legacy calls carry no ID, so one is made up and matched to the
+		// function result that answers it by name.
+		if msg.FunctionCall != nil {
+			id := fmt.Sprintf("call_legacy_%d", i)
+			legacyCallIDs[msg.FunctionCall.Name] = id
+			unifiedMessages[i].ToolCalls = append(unifiedMessages[i].ToolCalls, UnifiedToolCall{
+				ID:       id,
+				Type:     "function",
+				Function: UnifiedFunctionCall{Name: msg.FunctionCall.Name, Arguments: msg.FunctionCall.Arguments},
+			})
+		}
+		if msg.Role == "function" {
+			unifiedMessages[i].Role = "tool"
+			unifiedMessages[i].ToolCallID = legacyCallIDs[msg.Name]
+			if unifiedMessages[i].ToolCallID == "" {
+				unifiedMessages[i].ToolCallID = fmt.Sprintf("call_legacy_%d", i)
+			}
+		}
 	}
 
 	unifiedReq := &UnifiedChatRequest{
 		Model:    openaiReq.Model,
 		Messages: unifiedMessages,
-		Stream:   openaiReq.Stream,
-		Tools:    openaiReq.Tools,
+		// Streams are replayed from the complete response.
+		ReplayStream: openaiReq.Stream,
+		IncludeUsage: openaiReq.Stream && openaiReq.StreamOptions.IncludeUsage,
+		MaxTokens: openaiReq.MaxTokens,
+		N:         openaiReq.N,
 		// ToolChoice: openaiReq.ToolChoice, // ToolChoice needs special handling
+		Parameters: make(map[string]interface{}),
+	}
+	for name, value := range fields {
+		if !openaiChatFields[name] && value != nil {
+			unifiedReq.Parameters[name] = value
+		}
+	}
+
+	if openaiReq.MaxCompletionTokens > 0 {
+		unifiedReq.MaxTokens = openaiReq.MaxCompletionTokens
+	}
+	if unifiedReq.Stop, err = parseStopSequences(openaiReq.Stop); err != nil {
+		return nil, err
+	}
+
+	for _, rawTool := range openaiReq.Tools {
+		tool, err := openaiToolToUnified(rawTool)
+		if err != nil {
+			return nil, err
+		}
+		unifiedReq.Tools = append(unifiedReq.Tools, tool)
+	}
+	if openaiReq.WebSearchOptions != nil {
+		unifiedReq.Tools = append(unifiedReq.Tools, openaiWebSearchOptionsToUnified(openaiReq.WebSearchOptions))
 	}
 
 
@@ -81,12 +154,39 @@ func (a *OpenAIAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatReques
 		unifiedReq.ToolChoice = tcMap
 	}
 
+	// Legacy functions become function tools, and the response is rendered
+	// in the legacy shape for the client that used them.
+	if len(openaiReq.Functions) > 0 || openaiReq.FunctionCall != nil {
+		unifiedReq.LegacyFunctions = true
+		for _, function := range openaiReq.Functions {
+			unifiedReq.Tools = append(unifiedReq.Tools, UnifiedTool{Type: "function", Function: function})
+		}
+		// A legacy message holds one call, so the model must not make more.
+		if len(openaiReq.Functions) > 0 {
+			unifiedReq.Parameters["parallel_tool_calls"] = false
+		}
+		if unifiedReq.ToolChoice == nil {
+			unifiedReq.ToolChoice = legacyFunctionCallToUnified(openaiReq.FunctionCall)
+		}
+	}
+
 	return unifiedReq, nil
 }
 
 func (a *OpenAIAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
-	openaiMessages := make([]map[string]interface{}, len(unifiedReq.Messages))
-	for i, msg := range unifiedReq.Messages {
+	return newJSONRequest(openaiChatBody(unifiedReq), backendURL)
+}
+
+// openaiChatBody renders a unified request as a Chat Completions body.
+func openaiChatBody(unifiedReq *UnifiedChatRequest) map[string]interface{} {
+	openaiMessages := make([]map[string]interface{}, 0, len(unifiedReq.Messages)+1)
+	if unifiedReq.System != "" {
+		openaiMessages = append(openaiMessages, map[string]interface{}{
+			"role":    "system",
+			"content": unifiedReq.System,
+		})
+	}
+	for _, msg := range unifiedReq.Messages {
 		// Convert tool response messages to proper OpenAI format
 		role := msg.Role
 		if msg.ToolCallID != "" {
@@ -97,6 +197,9 @@ func (a *OpenAIAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, bac
 			"role":    role,
 			"content": msg.Content,
 		}
+		if len(msg.Images) > 0 && msg.ToolCallID == "" {
+			openaiMsg["content"] = openaiContentParts(msg.Content, msg.Images)
+		}
 		if msg.ToolCallID != "" {
 			openaiMsg["tool_call_id"] = msg.ToolCallID
 		}
@@ -132,7 +235,16 @@ func (a *OpenAIAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, bac
 			}
 			openaiMsg["tool_calls"] = openaiToolCalls
 		}
-		openaiMessages[i] = openaiMsg
+		openaiMessages = append(openaiMessages, openaiMsg)
+
+		// Tool messages can't carry images, so screenshots returned by a
+		// tool (e.g. computer use) follow as a user message.
+		if len(msg.Images) > 0 && msg.ToolCallID != "" {
+			openaiMessages = append(openaiMessages, map[string]interface{}{
+				"role":    "user",
+				"content": openaiContentParts("Output of tool call "+msg.ToolCallID+":", msg.Images),
+			})
+		}
 	}
 
 	openaiReq := map[string]interface{}{
@@ -140,9 +252,33 @@ func (a *OpenAIAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, bac
 		"messages": openaiMessages,
 		"stream":   unifiedReq.Stream,
 	}
+	if unifiedReq.MaxTokens > 0 {
+		openaiReq["max_tokens"] = unifiedReq.MaxTokens
+	}
+	if unifiedReq.N > 1 {
+		openaiReq["n"] = unifiedReq.N
+	}
+	if len(unifiedReq.Stop) > 0 {
+		openaiReq["stop"] = unifiedReq.Stop
+	}
 
-	if len(unifiedReq.Tools) > 0 {
-		openaiReq["tools"] = unifiedReq.Tools
+	// Hosted web search is a request option in Chat Completions, not a tool,
+	// and computer use and code execution have no native form there at all.
+	var functionTools []UnifiedTool
+	for _, tool := range unifiedReq.Tools {
+		switch tool.Type {
+		case "web_search":
+			openaiReq["web_search_options"] = unifiedWebSearchToOpenAI(tool.WebSearch)
+		case "computer":
+			functionTools = append(functionTools, computerFunctionTool(tool.Computer))
+		case "code_execution":
+			functionTools = append(functionTools, CodeExecutionFunctionTool())
+		default:
+			functionTools = append(functionTools, tool)
+		}
+	}
+	if len(functionTools) > 0 {
+		openaiReq["tools"] = functionTools
 	}
 
 	if unifiedReq.ToolChoice != nil {
@@ -150,16 +286,19 @@ func (a *OpenAIAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, bac
 	}
 
 	// Add any extra parameters
-	for k, v := range unifiedReq.Parameters {
+	for k, v := range openaiParameters(unifiedReq.Parameters) {
 		openaiReq[k] = v
 	}
+	return openaiReq
+}
 
-	body, err := json.Marshal(openaiReq)
+// newJSONRequest builds a POST of a JSON body to a backend.
+func newJSONRequest(body interface{}, backendURL string) (*http.Request, error) {
+	data, err := json.Marshal(body)
 	if err != nil {
 		return nil, err
 	}
-
-	req, err := http.NewRequest("POST", backendURL, bytes.NewBuffer(body))
+	req, err := http.NewRequest("POST", backendURL, bytes.NewBuffer(data))
 	if err != nil {
 		return nil, err
 	}
@@ -188,6 +327,19 @@ func (a *OpenAIAdapter) BackendChatToUnified(backendResp *http.Response) (*Unifi
 			Message struct {
 				Role         string `json:"role"`
 				Content      string `json:"content"`
+				// DeepSeek and most compatible servers name it
+				// reasoning_content; some use reasoning.
+				ReasoningContent string `json:"reasoning_content"`
+				Reasoning        string `json:"reasoning"`
+				Annotations  []struct {
+					Type        string `json:"type"`
+					URLCitation struct {
+						StartIndex int    `json:"start_index"`
+						EndIndex   int    `json:"end_index"`
+						URL        string `json:"url"`
+						Title      string `json:"title"`
+					} `json:"url_citation"`
+				} `json:"annotations"`
 				ToolCalls    []struct {
 					ID       string `json:"id"`
 					Type     string `json:"type"`
@@ -219,17 +371,44 @@ func (a *OpenAIAdapter) BackendChatToUnified(backendResp *http.Response) (*Unifi
 		},
 	}
 
-	if len(openaiResp.Choices) > 0 {
-		choice := openaiResp.Choices[0]
-		unifiedResp.Role = choice.Message.Role
-		unifiedResp.Content = choice.Message.Content
-		unifiedResp.StopReason = choice.FinishReason
+	// The first choice fills the response itself; any others, requested
+	// with n, are kept as additional choices.
+	for index, choice := range openaiResp.Choices {
+		target := unifiedResp
+		if index > 0 {
+			unifiedResp.AdditionalChoices = append(unifiedResp.AdditionalChoices, UnifiedChatResponse{})
+			target = &unifiedResp.AdditionalChoices[len(unifiedResp.AdditionalChoices)-1]
+		}
+		target.Role = choice.Message.Role
+		target.Content = choice.Message.Content
+		target.Reasoning = choice.Message.ReasoningContent
+		if target.Reasoning == "" {
+			target.Reasoning = choice.Message.Reasoning
+		}
+		target.StopReason = choice.FinishReason
+
+		contentRunes := []rune(choice.Message.Content)
+		for _, annotation := range choice.Message.Annotations {
+			if annotation.Type != "url_citation" {
+				continue
+			}
+			citation := UnifiedCitation{
+				URL:        annotation.URLCitation.URL,
+				Title:      annotation.URLCitation.Title,
+				StartIndex: annotation.URLCitation.StartIndex,
+				EndIndex:   annotation.URLCitation.EndIndex,
+			}
+			if citation.StartIndex >= 0 && citation.StartIndex <= citation.EndIndex && citation.EndIndex <= len(contentRunes) {
+				citation.CitedText = string(contentRunes[citation.StartIndex:citation.EndIndex])
+			}
+			target.Citations = append(target.Citations, citation)
+		}
 		
 		// Handle tool calls from OpenAI response
 		if len(choice.Message.ToolCalls) > 0 {
-			unifiedResp.ToolCalls = make([]UnifiedToolCall, len(choice.Message.ToolCalls))
+			target.ToolCalls = make([]UnifiedToolCall, len(choice.Message.ToolCalls))
 			for i, toolCall := range choice.Message.ToolCalls {
-				unifiedResp.ToolCalls[i] = UnifiedToolCall{
+				target.ToolCalls[i] = UnifiedToolCall{
 					ID:   toolCall.ID,
 					Type: toolCall.Type,
 					Function: UnifiedFunctionCall{
@@ -244,40 +423,250 @@ func (a *OpenAIAdapter) BackendChatToUnified(backendResp *http.Response) (*Unifi
 	return unifiedResp, nil
 }
 
+// SupportsChoices reports that Chat Completions backends honor n.
+func (a *OpenAIAdapter) SupportsChoices() bool {
+	return true
+}
+
 func (a *OpenAIAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
+	if unifiedResp.Stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		writeChatCompletionChunks(w, unifiedResp)
+		return nil
+	}
+
+	choices := make([]map[string]interface{}, 0, 1+len(unifiedResp.AdditionalChoices))
+	for index, choice := range allChoices(unifiedResp) {
+		finishReason := openaiFinishReason(choice, unifiedResp.LegacyFunctions)
+		choices = append(choices, map[string]interface{}{
+			"index":         index,
+			"message":       openaiMessage(choice, unifiedResp.LegacyFunctions),
+			"finish_reason": finishReason,
+		})
+	}
+
 	openaiResp := map[string]interface{}{
 		"id":      unifiedResp.ID,
 		"object":  "chat.completion",
 		"created": 0, // Current timestamp could be added here
 		"model":   unifiedResp.Model,
+		"choices": choices,
+		"usage": map[string]int{
+			"prompt_tokens":     unifiedResp.Usage.InputTokens,
+			"completion_tokens": unifiedResp.Usage.OutputTokens,
+			"total_tokens":      unifiedResp.Usage.InputTokens + unifiedResp.Usage.OutputTokens,
+		},
+	}
+
+	respBody, err := json.Marshal(openaiResp)
+	if err != nil {
+		slog.Error("failed to marshal OpenAI response", "error", err)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+	return nil
+}
+
+// allChoices returns the first choice of a response, the response itself,
+// followed by its additional choices.
+func allChoices(unifiedResp *UnifiedChatResponse) []*UnifiedChatResponse {
+	choices := []*UnifiedChatResponse{unifiedResp}
+	for i := range unifiedResp.AdditionalChoices {
+		choices = append(choices, &unifiedResp.AdditionalChoices[i])
+	}
+	return choices
+}
+
+// openaiMessage renders one choice of a response as a Chat Completions
+// message, with a legacy function_call instead of tool_calls if asked.
+func openaiMessage(choice *UnifiedChatResponse, legacyFunctions bool) map[string]interface{} {
+	msg := map[string]interface{}{
+		"role":    choice.Role,
+		"content": choice.Content,
+	}
+	if choice.Reasoning != "" {
+		msg["reasoning_content"] = choice.Reasoning
+	}
+	
+	// Add tool calls if present
+	if legacyFunctions {
+		if functionCall := legacyFunctionCallFromUnified(choice); functionCall != nil {
+			msg["function_call"] = functionCall
+		}
+	} else if len(choice.ToolCalls) > 0 {
+		toolCalls := make([]map[string]interface{}, len(choice.ToolCalls))
+		for i, tc := range choice.ToolCalls {
+			toolCalls[i] = map[string]interface{}{
+				"id":   tc.ID,
+				"type": tc.Type,
+				"function": map[string]interface{}{
+					"name":      tc.Function.Name,
+					"arguments": tc.Function.Arguments,
+				},
+			}
+		}
+		msg["tool_calls"] = toolCalls
+	}
+
+	// Add web search citations as url_citation annotations
+	if len(choice.Citations) > 0 {
+		annotations := make([]map[string]interface{}, len(choice.Citations))
+		for i, citation := range choice.Citations {
+			annotations[i] = map[string]interface{}{
+				"type": "url_citation",
+				"url_citation": map[string]interface{}{
+					"start_index": citation.StartIndex,
+					"end_index":   citation.EndIndex,
+					"url":         citation.URL,
+					"title":       citation.Title,
+				},
+			}
+		}
+		msg["annotations"] = annotations
+	}
+	
+	return msg
+}
+
+// writeChatCompletionChunks replays a complete response as a Chat
+// Completions stream. Each choice sends its role, then its reasoning,
+// content and tool calls as one delta each, then its finish reason. With
+// IncludeUsage, a last chunk without choices carries the usage, and the
+// others a null usage, as OpenAI sends them.
+func writeChatCompletionChunks(w http.ResponseWriter, unifiedResp *UnifiedChatResponse) {
+	send := func(choices []map[string]interface{}, usage interface{}) {
+		chunk := map[string]interface{}{
+			"id":      unifiedResp.ID,
+			"object":  "chat.completion.chunk",
+			"created": 0,
+			"model":   unifiedResp.Model,
+			"choices": choices,
+		}
+		if unifiedResp.IncludeUsage {
+			chunk["usage"] = usage
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	emit := func(index int, delta map[string]interface{}, finishReason interface{}) {
+		send([]map[string]interface{}{
+			{"index": index, "delta": delta, "finish_reason": finishReason},
+		}, nil)
+	}
+
+	for index, choice := range allChoices(unifiedResp) {
+		role := choice.Role
+		if role == "" {
+			role = "assistant"
+		}
+		emit(index, map[string]interface{}{"role": role, "content": ""}, nil)
+		if choice.Reasoning != "" {
+			emit(index, map[string]interface{}{"reasoning_content": choice.Reasoning}, nil)
+		}
+		if choice.Content != "" {
+			emit(index, map[string]interface{}{"content": choice.Content}, nil)
+		}
+		finishReason := openaiFinishReason(choice, unifiedResp.LegacyFunctions)
+		if unifiedResp.LegacyFunctions {
+			if functionCall := legacyFunctionCallFromUnified(choice); functionCall != nil {
+				emit(index, map[string]interface{}{"function_call": functionCall}, nil)
+			}
+		} else if len(choice.ToolCalls) > 0 {
+			toolCalls := make([]map[string]interface{}, len(choice.ToolCalls))
+			for i, tc := range choice.ToolCalls {
+				toolCalls[i] = map[string]interface{}{
+					"index": i,
+					"id":    tc.ID,
+					"type":  tc.Type,
+					"function": map[string]interface{}{
+						"name":      tc.Function.Name,
+						"arguments": tc.Function.Arguments,
+					},
+				}
+			}
+			emit(index, map[string]interface{}{"tool_calls": toolCalls}, nil)
+		}
+		emit(index, map[string]interface{}{}, finishReason)
+	}
+	if unifiedResp.IncludeUsage {
+		send([]map[string]interface{}{}, map[string]int{
+			"prompt_tokens":     unifiedResp.Usage.InputTokens,
+			"completion_tokens": unifiedResp.Usage.OutputTokens,
+			"total_tokens":      unifiedResp.Usage.InputTokens + unifiedResp.Usage.OutputTokens,
+		})
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+// --- Text Completion Operations ---
+
+// completionSamplingFields are the /v1/completions fields forwarded
+// unchanged as chat parameters.
+var completionSamplingFields = []string{"temperature", "top_p", "presence_penalty", "frequency_penalty", "seed", "user"}
+
+func (a *OpenAIAdapter) ClientCompletionToUnified(r *http.Request) (*UnifiedCompletionRequest, error) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	unifiedReq := &UnifiedCompletionRequest{Parameters: make(map[string]interface{})}
+	if raw, ok := fields["model"]; ok {
+		if err := json.Unmarshal(raw, &unifiedReq.Model); err != nil {
+			return nil, fmt.Errorf("model must be a string")
+		}
+	}
+	if raw, ok := fields["max_tokens"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &unifiedReq.MaxTokens); err != nil {
+			return nil, fmt.Errorf("max_tokens must be an integer")
+		}
+	}
+	if raw, ok := fields["stream"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &unifiedReq.Stream); err != nil {
+			return nil, fmt.Errorf("stream must be a boolean")
+		}
+	}
+
+	var err error
+	if unifiedReq.Prompt, err = parseCompletionPrompt(fields["prompt"]); err != nil {
+		return nil, err
+	}
+	if unifiedReq.Stop, err = parseStopSequences(fields["stop"]); err != nil {
+		return nil, err
+	}
+
+	for _, name := range completionSamplingFields {
+		raw, ok := fields[name]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, err
+		}
+		unifiedReq.Parameters[name] = value
+	}
+
+	return unifiedReq, nil
+}
+
+func (a *OpenAIAdapter) UnifiedCompletionToClient(unifiedResp *UnifiedCompletionResponse, w http.ResponseWriter) error {
+	completion := map[string]interface{}{
+		"id":      unifiedResp.ID,
+		"object":  "text_completion",
+		"created": 0,
+		"model":   unifiedResp.Model,
 		"choices": []map[string]interface{}{
 			{
-				"index": 0,
-				"message": func() map[string]interface{} {
-					msg := map[string]interface{}{
-						"role":    unifiedResp.Role,
-						"content": unifiedResp.Content,
-					}
-					
-					// Add tool calls if present
-					if len(unifiedResp.ToolCalls) > 0 {
-						toolCalls := make([]map[string]interface{}, len(unifiedResp.ToolCalls))
-						for i, tc := range unifiedResp.ToolCalls {
-							toolCalls[i] = map[string]interface{}{
-								"id":   tc.ID,
-								"type": tc.Type,
-								"function": map[string]interface{}{
-									"name":      tc.Function.Name,
-									"arguments": tc.Function.Arguments,
-								},
-							}
-						}
-						msg["tool_calls"] = toolCalls
-					}
-					
-					return msg
-				}(),
-				"finish_reason": unifiedResp.StopReason,
+				"index":         0,
+				"text":          unifiedResp.Text,
+				"logprobs":      nil,
+				"finish_reason": unifiedResp.FinishReason,
 			},
 		},
 		"usage": map[string]int{
@@ -287,9 +676,169 @@ func (a *OpenAIAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w
 		},
 	}
 
+	respBody, err := json.Marshal(completion)
+	if err != nil {
+		slog.Error("failed to marshal OpenAI completion response", "error", err)
+		return err
+	}
+
+	// A streamed completion is delivered as one event holding the whole text.
+	if unifiedResp.Stream {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "data: %s\n\n", respBody)
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(respBody)
+	return nil
+}
+
+// --- Image Generation Operations ---
+
+func (a *OpenAIAdapter) ClientImageToUnified(r *http.Request) (*UnifiedImageRequest, error) {
+	var fields map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	unifiedReq := &UnifiedImageRequest{Parameters: make(map[string]interface{})}
+	for key, value := range fields {
+		switch key {
+		case "model":
+			unifiedReq.Model, _ = value.(string)
+		case "prompt":
+			unifiedReq.Prompt, _ = value.(string)
+		case "n":
+			n, _ := value.(float64)
+			unifiedReq.N = int(n)
+		case "size":
+			unifiedReq.Size, _ = value.(string)
+		case "quality":
+			unifiedReq.Quality, _ = value.(string)
+		case "style":
+			unifiedReq.Style, _ = value.(string)
+		case "response_format":
+			unifiedReq.ResponseFormat, _ = value.(string)
+		default:
+			unifiedReq.Parameters[key] = value
+		}
+	}
+	if unifiedReq.Prompt == "" {
+		return nil, fmt.Errorf("prompt is required")
+	}
+
+	return unifiedReq, nil
+}
+
+func (a *OpenAIAdapter) UnifiedImageToBackend(unifiedReq *UnifiedImageRequest, backendURL string) (*http.Request, error) {
+	openaiReq := map[string]interface{}{}
+	for key, value := range unifiedReq.Parameters {
+		openaiReq[key] = value
+	}
+	openaiReq["model"] = unifiedReq.Model
+	openaiReq["prompt"] = unifiedReq.Prompt
+	if unifiedReq.N > 0 {
+		openaiReq["n"] = unifiedReq.N
+	}
+	if unifiedReq.Size != "" {
+		openaiReq["size"] = unifiedReq.Size
+	}
+	if unifiedReq.Quality != "" {
+		openaiReq["quality"] = unifiedReq.Quality
+	}
+	if unifiedReq.Style != "" {
+		openaiReq["style"] = unifiedReq.Style
+	}
+	if unifiedReq.ResponseFormat != "" {
+		openaiReq["response_format"] = unifiedReq.ResponseFormat
+	}
+
+	body, err := json.Marshal(openaiReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", backendURL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (a *OpenAIAdapter) BackendImageToUnified(backendResp *http.Response) (*UnifiedImageResponse, error) {
+	var openaiResp struct {
+		Created int64 `json:"created"`
+		Data    []struct {
+			URL           string `json:"url"`
+			B64JSON       string `json:"b64_json"`
+			RevisedPrompt string `json:"revised_prompt"`
+		} `json:"data"`
+		Usage struct {
+			InputTokens  int `json:"input_tokens"`
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&openaiResp); err != nil {
+		return nil, err
+	}
+
+	unifiedResp := &UnifiedImageResponse{
+		Created: openaiResp.Created,
+		Images:  make([]UnifiedGeneratedImage, len(openaiResp.Data)),
+		Usage: UnifiedUsage{
+			InputTokens:  openaiResp.Usage.InputTokens,
+			OutputTokens: openaiResp.Usage.OutputTokens,
+		},
+	}
+	for i, image := range openaiResp.Data {
+		unifiedResp.Images[i] = UnifiedGeneratedImage{
+			URL:           image.URL,
+			B64JSON:       image.B64JSON,
+			RevisedPrompt: image.RevisedPrompt,
+		}
+	}
+
+	return unifiedResp, nil
+}
+
+func (a *OpenAIAdapter) UnifiedImageToClient(unifiedResp *UnifiedImageResponse, w http.ResponseWriter) error {
+	data := make([]map[string]interface{}, len(unifiedResp.Images))
+	for i, image := range unifiedResp.Images {
+		entry := map[string]interface{}{}
+		if image.URL != "" {
+			entry["url"] = image.URL
+		}
+		if image.B64JSON != "" {
+			entry["b64_json"] = image.B64JSON
+		}
+		if image.RevisedPrompt != "" {
+			entry["revised_prompt"] = image.RevisedPrompt
+		}
+		data[i] = entry
+	}
+
+	openaiResp := map[string]interface{}{
+		"created": unifiedResp.Created,
+		"data":    data,
+	}
+	if unifiedResp.Usage.InputTokens > 0 || unifiedResp.Usage.OutputTokens > 0 {
+		openaiResp["usage"] = map[string]int{
+			"input_tokens":  unifiedResp.Usage.InputTokens,
+			"output_tokens": unifiedResp.Usage.OutputTokens,
+			"total_tokens":  unifiedResp.Usage.InputTokens + unifiedResp.Usage.OutputTokens,
+		}
+	}
+
 	respBody, err := json.Marshal(openaiResp)
 	if err != nil {
-		slog.Error("failed to marshal OpenAI response", "error", err)
+		slog.Error("failed to marshal OpenAI image response", "error", err)
 		return err
 	}
 
@@ -343,25 +892,53 @@ func (a *OpenAIAdapter) TranslateError(backendResp *http.Response) []byte {
 
 func (a *OpenAIAdapter) ClientEmbeddingToUnified(r *http.Request) (*UnifiedEmbeddingRequest, error) {
 	var openaiReq struct {
-		Input []string `json:"input"`
-		Model string   `json:"model"`
+		Input          json.RawMessage `json:"input"`
+		Model          string          `json:"model"`
+		EncodingFormat string          `json:"encoding_format"`
+		Dimensions     int             `json:"dimensions"`
+		InputType      string          `json:"input_type"` // Extension for retrieval-tuned backends
+		Truncation     *bool           `json:"truncation"` // Extension for backends that can refuse long inputs
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&openaiReq); err != nil {
 		return nil, err
 	}
 
-	return &UnifiedEmbeddingRequest{
-		Input: openaiReq.Input,
-		Model: openaiReq.Model,
-	}, nil
+	unifiedReq := &UnifiedEmbeddingRequest{
+		Model:          openaiReq.Model,
+		EncodingFormat: openaiReq.EncodingFormat,
+		Dimensions:     openaiReq.Dimensions,
+		InputType:      openaiReq.InputType,
+		Truncate:       openaiReq.Truncation,
+	}
+	if err := parseEmbeddingInput(openaiReq.Input, unifiedReq); err != nil {
+		return nil, err
+	}
+
+	return unifiedReq, nil
 }
 
 func (a *OpenAIAdapter) UnifiedEmbeddingToBackend(unifiedReq *UnifiedEmbeddingRequest, backendURL string) (*http.Request, error) {
+	if len(unifiedReq.Contents) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "images are not supported by OpenAI embeddings"}
+	}
+
 	openaiReq := map[string]interface{}{
 		"input": unifiedReq.Input,
 		"model": unifiedReq.Model,
 	}
+	if len(unifiedReq.Tokens) > 0 {
+		openaiReq["input"] = unifiedReq.Tokens
+	}
+
+	// OpenAI-compatible backends understand base64 natively, which keeps
+	// large batches compact on the wire; we decode it on the way back.
+	if unifiedReq.EncodingFormat != "" {
+		openaiReq["encoding_format"] = unifiedReq.EncodingFormat
+	}
+	if unifiedReq.Dimensions > 0 {
+		openaiReq["dimensions"] = unifiedReq.Dimensions
+	}
 
 	body, err := json.Marshal(openaiReq)
 	if err != nil {
@@ -380,9 +957,9 @@ func (a *OpenAIAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*
 	var openaiResp struct {
 		Object string `json:"object"`
 		Data   []struct {
-			Object    string    `json:"object"`
-			Index     int       `json:"index"`
-			Embedding []float32 `json:"embedding"`
+			Object    string          `json:"object"`
+			Index     int             `json:"index"`
+			Embedding json.RawMessage `json:"embedding"` // float array or base64 string
 		} `json:"data"`
 		Model string `json:"model"`
 		Usage struct {
@@ -397,12 +974,22 @@ func (a *OpenAIAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*
 
 	embeddings := make([][]float32, len(openaiResp.Data))
 	for i, data := range openaiResp.Data {
-		embeddings[i] = data.Embedding
+		embedding, err := decodeEmbedding(data.Embedding)
+		if err != nil {
+			return nil, fmt.Errorf("embedding %d: %w", i, err)
+		}
+		embeddings[i] = embedding
 	}
 
+	// Some compatible servers only fill in total_tokens.
+	inputTokens := openaiResp.Usage.PromptTokens
+	if inputTokens == 0 {
+		inputTokens = openaiResp.Usage.TotalTokens
+	}
 	return &UnifiedEmbeddingResponse{
 		Embeddings: embeddings,
 		Model:      openaiResp.Model,
+		Usage:      UnifiedUsage{InputTokens: inputTokens},
 	}, nil
 }
 
@@ -414,6 +1001,9 @@ func (a *OpenAIAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingRe
 			"index":     i,
 			"embedding": embedding,
 		}
+		if unifiedResp.EncodingFormat == "base64" {
+			data[i]["embedding"] = encodeEmbeddingBase64(embedding)
+		}
 	}
 
 	openaiResp := map[string]interface{}{
@@ -421,8 +1011,8 @@ func (a *OpenAIAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingRe
 		"data":   data,
 		"model":  unifiedResp.Model,
 		"usage": map[string]int{
-			"prompt_tokens": len(unifiedResp.Embeddings), // Approximation
-			"total_tokens":  len(unifiedResp.Embeddings),
+			"prompt_tokens": unifiedResp.Usage.InputTokens,
+			"total_tokens":  unifiedResp.Usage.InputTokens,
 		},
 	}
 
@@ -436,3 +1026,49 @@ func (a *OpenAIAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingRe
 	w.Write(respBody)
 	return nil
 }
+
+
+// openaiContentToUnified decodes a message `content` field, which may be a
+// string, an array of content parts, or null.
+func openaiContentToUnified(raw json.RawMessage) (string, []UnifiedImage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, fmt.Errorf("message content must be a string or an array of content parts")
+	}
+	var images []UnifiedImage
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			text += part.Text
+		case "image_url":
+			images = append(images, imageFromURL(part.ImageURL.URL))
+		}
+	}
+	return text, images, nil
+}
+
+// openaiContentParts builds a content-part array from text and images.
+func openaiContentParts(text string, images []UnifiedImage) []map[string]interface{} {
+	var parts []map[string]interface{}
+	if text != "" {
+		parts = append(parts, map[string]interface{}{"type": "text", "text": text})
+	}
+	for _, image := range images {
+		parts = append(parts, unifiedImageToOpenAI(image))
+	}
+	return parts
+}
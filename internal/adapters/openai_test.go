@@ -1,8 +1,10 @@
 package adapters
 
 import (
+	"errors"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 )
@@ -175,4 +177,325 @@ func TestOpenAIAdapter_BackendChatToUnified(t *testing.T) {
 	if unified.Usage.OutputTokens != 12 {
 		t.Errorf("Expected 12 output tokens, got: %d", unified.Usage.OutputTokens)
 	}
-}
\ No newline at end of file
+}
+
+func TestOpenAIAdapter_MultipleChoices(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	// n reaches the backend, and every returned choice reaches the client
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "n": 2, "messages": [{"role": "user", "content": "Hello"}]}`))
+	unified, err := adapter.ClientChatToUnified(req)
+	if err != nil || unified.N != 2 {
+		t.Fatalf("Expected n 2, got: %+v %v", unified, err)
+	}
+	backendReq, _ := adapter.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	if body, _ := io.ReadAll(backendReq.Body); !strings.Contains(string(body), `"n":2`) {
+		t.Errorf("Expected n in the backend request, got: %s", body)
+	}
+
+	resp := &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(`{"id": "chatcmpl-2", "model": "gpt-4o", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}, {"index": 1, "message": {"role": "assistant", "content": "Hey"}, "finish_reason": "length"}]}`))}
+	unifiedResp, err := adapter.BackendChatToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unifiedResp.Content != "Hi" || len(unifiedResp.AdditionalChoices) != 1 || unifiedResp.AdditionalChoices[0].Content != "Hey" || unifiedResp.AdditionalChoices[0].StopReason != "length" {
+		t.Fatalf("Expected two choices, got: %+v", unifiedResp)
+	}
+
+	rr := httptest.NewRecorder()
+	adapter.UnifiedChatToClient(unifiedResp, rr)
+	if body := rr.Body.String(); !strings.Contains(body, `"index":1`) || !strings.Contains(body, `"content":"Hey"`) {
+		t.Errorf("Expected the second choice in the response, got: %s", body)
+	}
+}
+
+func TestOpenAIAdapter_EmbeddingBase64RoundTrip(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	// Backend returns base64-encoded vectors
+	encoded := encodeEmbeddingBase64([]float32{0.5, -1.25, 3})
+	respBody := `{
+		"object": "list",
+		"data": [{"object": "embedding", "index": 0, "embedding": "` + encoded + `"}],
+		"model": "text-embedding-3-small",
+		"usage": {"prompt_tokens": 9, "total_tokens": 9}
+	}`
+
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(respBody)),
+	}
+
+	unified, err := adapter.BackendEmbeddingToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Embeddings) != 1 || len(unified.Embeddings[0]) != 3 {
+		t.Fatalf("Expected one 3-dimensional embedding, got: %v", unified.Embeddings)
+	}
+
+	if unified.Embeddings[0][1] != -1.25 {
+		t.Errorf("Expected second component -1.25, got: %v", unified.Embeddings[0][1])
+	}
+
+	// Client asked for base64, so the vector must be re-encoded
+	unified.EncodingFormat = "base64"
+	rr := httptest.NewRecorder()
+	if err := adapter.UnifiedEmbeddingToClient(unified, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"embedding":"`+encoded+`"`) {
+		t.Errorf("Expected base64 embedding in response, got: %s", rr.Body.String())
+	}
+
+	// The backend's usage is carried through
+	if !strings.Contains(rr.Body.String(), `"usage":{"prompt_tokens":9,"total_tokens":9}`) {
+		t.Errorf("Expected the backend's usage in response, got: %s", rr.Body.String())
+	}
+}
+
+func TestOpenAIAdapter_ClientEmbeddingToUnified_InputForms(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	tests := []struct {
+		name           string
+		input          string
+		expectedInput  int
+		expectedTokens int
+	}{
+		{"single string", `"Hello"`, 1, 0},
+		{"string array", `["Hello", "World"]`, 2, 0},
+		{"token array", `[1, 2, 3]`, 0, 1},
+		{"token arrays", `[[1, 2], [3]]`, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqBody := `{"model": "text-embedding-3-small", "input": ` + tt.input + `}`
+			req, err := http.NewRequest("POST", "/v1/embeddings", strings.NewReader(reqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unified, err := adapter.ClientEmbeddingToUnified(req)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+
+			if len(unified.Input) != tt.expectedInput {
+				t.Errorf("Expected %d string inputs, got: %d", tt.expectedInput, len(unified.Input))
+			}
+
+			if len(unified.Tokens) != tt.expectedTokens {
+				t.Errorf("Expected %d token inputs, got: %d", tt.expectedTokens, len(unified.Tokens))
+			}
+		})
+	}
+
+	// Objects are not a valid input shape
+	req, _ := http.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "m", "input": {"text": "x"}}`))
+	if _, err := adapter.ClientEmbeddingToUnified(req); err == nil {
+		t.Error("Expected error for object input")
+	}
+
+	// Missing and empty inputs are the client's mistake
+	for _, input := range []string{`null`, `[]`, `[[1, 2], []]`} {
+		req, _ := http.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "m", "input": `+input+`}`))
+		_, err := adapter.ClientEmbeddingToUnified(req)
+		var paramErr *ParameterError
+		if !errors.As(err, &paramErr) || paramErr.Parameter != "input" {
+			t.Errorf("Expected an input parameter error for %s, got: %v", input, err)
+		}
+	}
+}
+
+func TestOpenAIAdapter_ClientEmbeddingToUnified_Multimodal(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	// One image-only input and one mixed text+image input
+	reqBody := `{
+		"model": "voyage-multimodal-3",
+		"input": [
+			{"type": "image_url", "image_url": {"url": "https://example.com/cat.png"}},
+			[
+				{"type": "text", "text": "A photo of a dog"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,iVBORw0KGgo="}}
+			]
+		]
+	}`
+
+	req, err := http.NewRequest("POST", "/v1/embeddings", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unified, err := adapter.ClientEmbeddingToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Contents) != 2 {
+		t.Fatalf("Expected 2 multimodal inputs, got: %d", len(unified.Contents))
+	}
+
+	if unified.Contents[0][0].Type != "image" || unified.Contents[0][0].ImageURL != "https://example.com/cat.png" {
+		t.Errorf("Expected image part with URL, got: %+v", unified.Contents[0][0])
+	}
+
+	if len(unified.Contents[1]) != 2 || unified.Contents[1][0].Text != "A photo of a dog" {
+		t.Errorf("Expected mixed text+image input, got: %+v", unified.Contents[1])
+	}
+
+	// OpenAI embedding backends can't take images
+	if _, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.openai.com/v1/embeddings"); err == nil {
+		t.Error("Expected error when sending images to an OpenAI backend")
+	}
+}
+
+func TestOpenAIAdapter_CompletionRoundTrip(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	reqBody := `{"model": "gpt-3.5-turbo-instruct", "prompt": ["Say hi"], "max_tokens": 16, "stop": "\n", "temperature": 0.2, "stream": true}`
+	req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(reqBody))
+
+	unified, err := adapter.ClientCompletionToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unified.Prompt != "Say hi" || unified.MaxTokens != 16 || !unified.Stream {
+		t.Errorf("Expected prompt, max_tokens and stream to be parsed, got: %+v", unified)
+	}
+	if len(unified.Stop) != 1 || unified.Stop[0] != "\n" {
+		t.Errorf("Expected a single stop sequence, got: %v", unified.Stop)
+	}
+
+	chatReq := CompletionToChat(unified)
+	if len(chatReq.Messages) != 1 || chatReq.Messages[0].Role != "user" || chatReq.Messages[0].Content != "Say hi" {
+		t.Errorf("Expected the prompt as a single user message, got: %+v", chatReq.Messages)
+	}
+	if chatReq.MaxTokens != 16 || chatReq.Parameters["temperature"] != 0.2 {
+		t.Errorf("Expected sampling parameters to carry over, got: %v", chatReq.Parameters)
+	}
+
+	completion := ChatToCompletion(&UnifiedChatResponse{ID: "cmpl-1", Content: "Hi!", StopReason: "stop"})
+	completion.Stream = true
+	rr := httptest.NewRecorder()
+	if err := adapter.UnifiedCompletionToClient(completion, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, `"text":"Hi!"`) || !strings.Contains(body, `"object":"text_completion"`) {
+		t.Errorf("Expected a text_completion event, got: %s", body)
+	}
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected the stream to end with [DONE], got: %s", body)
+	}
+}
+
+func TestOpenAIAdapter_ClientCompletionToUnified_RejectsBatchedPrompts(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "m", "prompt": ["a", "b"]}`))
+	if _, err := adapter.ClientCompletionToUnified(req); err == nil {
+		t.Error("Expected an error for multiple prompts")
+	}
+}
+
+func TestOpenAIAdapter_ImageRoundTrip(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	req := httptest.NewRequest("POST", "/v1/images/generations", strings.NewReader(`{"model": "dall-e-3", "prompt": "a lighthouse", "n": 1, "size": "1024x1024", "response_format": "b64_json", "seed": 7}`))
+	unified, err := adapter.ClientImageToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if unified.Prompt != "a lighthouse" || unified.N != 1 || unified.Size != "1024x1024" || unified.ResponseFormat != "b64_json" {
+		t.Errorf("Expected image fields to be parsed, got: %+v", unified)
+	}
+	if unified.Parameters["seed"] != float64(7) {
+		t.Errorf("Expected unknown fields in Parameters, got: %v", unified.Parameters)
+	}
+
+	backendReq, err := adapter.UnifiedImageToBackend(unified, "http://backend/images/generations")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	body, _ := io.ReadAll(backendReq.Body)
+	if !strings.Contains(string(body), `"seed":7`) || !strings.Contains(string(body), `"size":"1024x1024"`) {
+		t.Errorf("Expected size and passthrough parameters in backend body, got: %s", body)
+	}
+
+	backendResp := &http.Response{Body: io.NopCloser(strings.NewReader(`{"created": 1700000000, "data": [{"b64_json": "aGk=", "revised_prompt": "a tall lighthouse"}]}`))}
+	unifiedResp, err := adapter.BackendImageToUnified(backendResp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(unifiedResp.Images) != 1 || unifiedResp.Images[0].B64JSON != "aGk=" || unifiedResp.Images[0].RevisedPrompt != "a tall lighthouse" {
+		t.Errorf("Expected one decoded image, got: %+v", unifiedResp.Images)
+	}
+
+	rr := httptest.NewRecorder()
+	if err := adapter.UnifiedImageToClient(unifiedResp, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.Contains(rr.Body.String(), `"created":1700000000`) || strings.Contains(rr.Body.String(), `"url"`) {
+		t.Errorf("Expected created timestamp and no empty url, got: %s", rr.Body.String())
+	}
+}
+
+func TestOpenAIAdapter_LegacyFunctions(t *testing.T) {
+	adapter := &OpenAIAdapter{}
+
+	reqBody := `{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": null, "function_call": {"name": "get_weather", "arguments": "{\"city\": \"Paris\"}"}},
+			{"role": "function", "name": "get_weather", "content": "Sunny"}
+		],
+		"functions": [{"name": "get_weather", "parameters": {"type": "object"}}],
+		"function_call": {"name": "get_weather"}
+	}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(reqBody))
+	unified, err := adapter.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !unified.LegacyFunctions || len(unified.Tools) != 1 || unified.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("Expected functions as tools, got: %+v", unified.Tools)
+	}
+	choice, _ := unified.ToolChoice.(map[string]interface{})
+	if function, _ := choice["function"].(map[string]interface{}); choice["type"] != "function" || function["name"] != "get_weather" {
+		t.Errorf("Expected function_call as a forced tool choice, got: %v", unified.ToolChoice)
+	}
+	call, result := unified.Messages[1], unified.Messages[2]
+	if len(call.ToolCalls) != 1 || call.ToolCalls[0].Function.Arguments != `{"city": "Paris"}` {
+		t.Errorf("Expected the function call as a tool call, got: %+v", call)
+	}
+	if result.Role != "tool" || result.ToolCallID == "" || result.ToolCallID != call.ToolCalls[0].ID {
+		t.Errorf("Expected the function result to answer the call, got: %+v", result)
+	}
+
+	// Backends get the tools shape only
+	backendReq, _ := adapter.UnifiedChatToBackend(unified, "https://api.openai.com/v1/chat/completions")
+	if body, _ := io.ReadAll(backendReq.Body); strings.Contains(string(body), `"functions"`) || strings.Contains(string(body), `"function_call"`) || !strings.Contains(string(body), `"tools"`) {
+		t.Errorf("Expected tools instead of functions, got: %s", body)
+	}
+
+	// The client gets a legacy function_call back
+	resp := &UnifiedChatResponse{
+		ID:              "chatcmpl-1",
+		Role:            "assistant",
+		StopReason:      "tool_use",
+		LegacyFunctions: true,
+		ToolCalls:       []UnifiedToolCall{{ID: "toolu_1", Type: "function", Function: UnifiedFunctionCall{Name: "get_weather", Arguments: `{"city":"Rome"}`}}},
+	}
+	rr := httptest.NewRecorder()
+	adapter.UnifiedChatToClient(resp, rr)
+	body := rr.Body.String()
+	if !strings.Contains(body, `"function_call":{"arguments":"{\"city\":\"Rome\"}","name":"get_weather"}`) || !strings.Contains(body, `"finish_reason":"function_call"`) || strings.Contains(body, "tool_calls") {
+		t.Errorf("Expected a legacy function_call response, got: %s", body)
+	}
+}
@@ -0,0 +1,78 @@
+package adapters
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// UnifiedChatRequest.Parameters holds tuning fields under their OpenAI Chat
+// Completions names (temperature, top_p, seed, ...). Client adapters
+// rename their dialect's fields to these, and backend adapters rename them
+// back, dropping the ones their API does not accept.
+
+// openaiChatFields are the Chat Completions request fields decoded into
+// dedicated UnifiedChatRequest fields, or deliberately not forwarded. Every
+// other field is carried in Parameters.
+var openaiChatFields = map[string]bool{
+	"model":                 true,
+	"messages":              true,
+	"tools":                 true,
+	"tool_choice":           true,
+	"web_search_options":    true,
+	"stream":                true,
+	"max_tokens":            true,
+	"max_completion_tokens": true,
+	"n":                     true,
+	"stop":                  true,
+	"functions":             true,
+	"function_call":         true,
+	// The broker decides how the backend streams.
+	"stream_options": true,
+}
+
+// openaiDroppedParameters are unified parameters the Chat Completions API
+// rejects.
+var openaiDroppedParameters = map[string]bool{
+	"top_k": true,
+}
+
+// anthropicParameters maps unified parameters to their Messages API names.
+// Parameters missing here have no Anthropic equivalent and are dropped.
+var anthropicParameters = map[string]string{
+	"temperature": "temperature",
+	"top_p":       "top_p",
+	"top_k":       "top_k",
+	"user":        "metadata",
+}
+
+// openaiParameters returns the unified parameters a Chat Completions backend
+// accepts.
+func openaiParameters(parameters map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(parameters))
+	for name, value := range parameters {
+		if openaiDroppedParameters[name] {
+			slog.Debug("dropping parameter unsupported by backend", "parameter", name, "backend", "openai")
+			continue
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// unifiedParametersToAnthropic renames unified parameters for the Messages
+// API and drops those it does not support.
+func unifiedParametersToAnthropic(parameters map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(parameters))
+	for name, value := range parameters {
+		anthropicName, ok := anthropicParameters[name]
+		if !ok {
+			slog.Debug("dropping parameter unsupported by backend", "parameter", name, "backend", "anthropic")
+			continue
+		}
+		if name == "user" {
+			value = map[string]interface{}{"user_id": fmt.Sprintf("%v", value)}
+		}
+		result[anthropicName] = value
+	}
+	return result
+}
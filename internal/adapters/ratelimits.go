@@ -0,0 +1,81 @@
+package adapters
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RateLimits is what a backend reported about its remaining rate limit in
+// the headers of a response. Counts it did not report are -1.
+type RateLimits struct {
+	RemainingRequests int
+	RemainingTokens   int
+	// ResetRequests and ResetTokens are how long until the request and
+	// token windows refill.
+	ResetRequests time.Duration
+	ResetTokens   time.Duration
+}
+
+// RateLimitReporter is implemented by the adapters of backends that report
+// their rate limits on every response, so the broker can stop routing to a
+// target before it starts answering 429.
+type RateLimitReporter interface {
+	ParseRateLimits(header http.Header) (RateLimits, bool)
+}
+
+// GroqAdapter serves Groq targets, which speak the OpenAI dialect and
+// report limits in OpenAI's x-ratelimit-* headers.
+type GroqAdapter struct {
+	OpenAIAdapter
+}
+
+func (a *GroqAdapter) ParseRateLimits(header http.Header) (RateLimits, bool) {
+	limits := RateLimits{
+		RemainingRequests: headerCount(header, "x-ratelimit-remaining-requests"),
+		RemainingTokens:   headerCount(header, "x-ratelimit-remaining-tokens"),
+		ResetRequests:     headerDuration(header, "x-ratelimit-reset-requests"),
+		ResetTokens:       headerDuration(header, "x-ratelimit-reset-tokens"),
+	}
+	return limits, limits.RemainingRequests >= 0 || limits.RemainingTokens >= 0
+}
+
+// TogetherAdapter serves Together AI targets, which speak the OpenAI
+// dialect and report request limits in x-ratelimit-* headers and token
+// limits in x-tokenlimit-* headers, with one reset for both.
+type TogetherAdapter struct {
+	OpenAIAdapter
+}
+
+func (a *TogetherAdapter) ParseRateLimits(header http.Header) (RateLimits, bool) {
+	reset := headerDuration(header, "x-ratelimit-reset")
+	limits := RateLimits{
+		RemainingRequests: headerCount(header, "x-ratelimit-remaining"),
+		RemainingTokens:   headerCount(header, "x-tokenlimit-remaining"),
+		ResetRequests:     reset,
+		ResetTokens:       reset,
+	}
+	return limits, limits.RemainingRequests >= 0 || limits.RemainingTokens >= 0
+}
+
+// headerCount reads a non-negative count from a header, or -1.
+func headerCount(header http.Header, name string) int {
+	value := header.Get(name)
+	if n, err := strconv.ParseFloat(value, 64); err == nil && n >= 0 {
+		return int(n)
+	}
+	return -1
+}
+
+// headerDuration reads a reset time given as a Go-style duration ("7.66s",
+// "2m59.56s", "20ms") or in seconds, or zero.
+func headerDuration(header http.Header, name string) time.Duration {
+	value := header.Get(name)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return d
+	}
+	return 0
+}
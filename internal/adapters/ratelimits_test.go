@@ -0,0 +1,34 @@
+package adapters
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	groq := http.Header{}
+	groq.Set("x-ratelimit-remaining-requests", "14370")
+	groq.Set("x-ratelimit-remaining-tokens", "0")
+	groq.Set("x-ratelimit-reset-requests", "2m59.56s")
+	groq.Set("x-ratelimit-reset-tokens", "7.66s")
+	limits, ok := (&GroqAdapter{}).ParseRateLimits(groq)
+	expected := RateLimits{RemainingRequests: 14370, RemainingTokens: 0, ResetRequests: 179560 * time.Millisecond, ResetTokens: 7660 * time.Millisecond}
+	if !ok || limits != expected {
+		t.Errorf("Expected %+v, got: %+v", expected, limits)
+	}
+
+	together := http.Header{}
+	together.Set("x-ratelimit-remaining", "0")
+	together.Set("x-ratelimit-reset", "2")
+	together.Set("x-tokenlimit-remaining", "5000")
+	limits, ok = (&TogetherAdapter{}).ParseRateLimits(together)
+	expected = RateLimits{RemainingRequests: 0, RemainingTokens: 5000, ResetRequests: 2 * time.Second, ResetTokens: 2 * time.Second}
+	if !ok || limits != expected {
+		t.Errorf("Expected %+v, got: %+v", expected, limits)
+	}
+
+	if _, ok := (&GroqAdapter{}).ParseRateLimits(http.Header{}); ok {
+		t.Errorf("Expected no limits without headers")
+	}
+}
@@ -0,0 +1,403 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ResponsesAdapter implements the client side of the OpenAI Responses API
+// (/v1/responses), so Responses clients can be served by any chat backend.
+// OpenAI targets receive Responses requests by passthrough, so the backend
+// operations are not implemented.
+type ResponsesAdapter struct{}
+
+// --- Chat Completion Operations ---
+
+func (a *ResponsesAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatRequest, error) {
+	var responsesReq struct {
+		Model              string            `json:"model"`
+		Input              json.RawMessage   `json:"input"`
+		Instructions       string            `json:"instructions"`
+		Tools              []json.RawMessage `json:"tools"`
+		ToolChoice         interface{}       `json:"tool_choice"`
+		Stream             bool              `json:"stream"`
+		MaxOutputTokens    int               `json:"max_output_tokens"`
+		Temperature        *float64          `json:"temperature"`
+		TopP               *float64          `json:"top_p"`
+		PreviousResponseID string            `json:"previous_response_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&responsesReq); err != nil {
+		return nil, err
+	}
+	// Stored conversations live on OpenAI's side; a translated request has
+	// no history to continue from.
+	if responsesReq.PreviousResponseID != "" {
+		return nil, fmt.Errorf("previous_response_id is only supported by OpenAI targets")
+	}
+
+	var messages []UnifiedMessage
+	if responsesReq.Instructions != "" {
+		messages = append(messages, UnifiedMessage{Role: "system", Content: responsesReq.Instructions})
+	}
+	inputMessages, err := responsesInputToUnified(responsesReq.Input)
+	if err != nil {
+		return nil, err
+	}
+	messages = append(messages, inputMessages...)
+
+	unifiedReq := &UnifiedChatRequest{
+		Model:    responsesReq.Model,
+		Messages: messages,
+		// Streams are replayed from the complete response, so the backend
+		// is always called without streaming.
+		ReplayStream: responsesReq.Stream,
+		MaxTokens:    responsesReq.MaxOutputTokens,
+		Parameters:   make(map[string]interface{}),
+	}
+	if responsesReq.Temperature != nil {
+		unifiedReq.Parameters["temperature"] = *responsesReq.Temperature
+	}
+	if responsesReq.TopP != nil {
+		unifiedReq.Parameters["top_p"] = *responsesReq.TopP
+	}
+
+	for _, rawTool := range responsesReq.Tools {
+		tool, err := responsesToolToUnified(rawTool)
+		if err != nil {
+			return nil, err
+		}
+		unifiedReq.Tools = append(unifiedReq.Tools, tool)
+	}
+
+	// Responses names the forced function at the top level; the unified
+	// request uses the Chat Completions shape.
+	switch choice := responsesReq.ToolChoice.(type) {
+	case string:
+		unifiedReq.ToolChoice = choice
+	case map[string]interface{}:
+		if choice["type"] == "function" {
+			unifiedReq.ToolChoice = map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": choice["name"]},
+			}
+		} else {
+			unifiedReq.ToolChoice = choice
+		}
+	}
+
+	return unifiedReq, nil
+}
+
+func (a *ResponsesAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
+	return nil, fmt.Errorf("Responses-format backends are not supported")
+}
+
+func (a *ResponsesAdapter) BackendChatToUnified(backendResp *http.Response) (*UnifiedChatResponse, error) {
+	return nil, fmt.Errorf("Responses-format backends are not supported")
+}
+
+func (a *ResponsesAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
+	response := unifiedToResponsesObject(unifiedResp)
+
+	if !unifiedResp.Stream {
+		respBody, err := json.Marshal(response)
+		if err != nil {
+			slog.Error("failed to marshal Responses response", "error", err)
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(respBody)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	writeResponsesEvents(w, response)
+	return nil
+}
+
+// --- Error Translation ---
+
+func (a *ResponsesAdapter) TranslateError(backendResp *http.Response) []byte {
+	// Responses errors use the same envelope as Chat Completions.
+	return (&OpenAIAdapter{}).TranslateError(backendResp)
+}
+
+// --- Embedding Operations ---
+
+func (a *ResponsesAdapter) ClientEmbeddingToUnified(r *http.Request) (*UnifiedEmbeddingRequest, error) {
+	return nil, fmt.Errorf("the Responses API has no embedding operations")
+}
+
+func (a *ResponsesAdapter) UnifiedEmbeddingToBackend(unifiedReq *UnifiedEmbeddingRequest, backendURL string) (*http.Request, error) {
+	return nil, fmt.Errorf("the Responses API has no embedding operations")
+}
+
+func (a *ResponsesAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*UnifiedEmbeddingResponse, error) {
+	return nil, fmt.Errorf("the Responses API has no embedding operations")
+}
+
+func (a *ResponsesAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("the Responses API has no embedding operations")
+}
+
+// responsesInputToUnified converts the Responses `input` field, either a
+// plain string or an array of input items, into chat messages.
+func responsesInputToUnified(raw json.RawMessage) ([]UnifiedMessage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return []UnifiedMessage{{Role: "user", Content: text}}, nil
+	}
+
+	var items []struct {
+		Type      string                 `json:"type"`
+		Role      string                 `json:"role"`
+		Content   json.RawMessage        `json:"content"`
+		CallID    string                 `json:"call_id"`
+		Name      string                 `json:"name"`
+		Arguments string                 `json:"arguments"`
+		Output    json.RawMessage        `json:"output"`
+		Action    map[string]interface{} `json:"action"`
+	}
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, fmt.Errorf("input must be a string or an array of input items")
+	}
+
+	var messages []UnifiedMessage
+	// addToolCall attaches a call to the preceding assistant turn, since
+	// chat backends expect all of a turn's calls in one message.
+	addToolCall := func(call UnifiedToolCall) {
+		if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+			messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			return
+		}
+		messages = append(messages, UnifiedMessage{Role: "assistant", ToolCalls: []UnifiedToolCall{call}})
+	}
+
+	for _, item := range items {
+		switch item.Type {
+		case "", "message":
+			role := item.Role
+			if role == "developer" {
+				role = "system"
+			}
+			content, images, err := responsesContentToUnified(item.Content)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, UnifiedMessage{Role: role, Content: content, Images: images})
+		case "function_call":
+			addToolCall(UnifiedToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: UnifiedFunctionCall{Name: item.Name, Arguments: item.Arguments},
+			})
+		case "function_call_output":
+			var output string
+			if err := json.Unmarshal(item.Output, &output); err != nil {
+				output = string(item.Output)
+			}
+			messages = append(messages, UnifiedMessage{Role: "tool", ToolCallID: item.CallID, Content: output})
+		case "computer_call":
+			// Computer actions travel in Anthropic's schema, matching the
+			// computer tool offered to chat backends.
+			arguments, _ := json.Marshal(openaiComputerActionToAnthropic(item.Action))
+			addToolCall(UnifiedToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: UnifiedFunctionCall{Name: "computer", Arguments: string(arguments)},
+			})
+		case "computer_call_output":
+			var screenshot struct {
+				ImageURL string `json:"image_url"`
+			}
+			json.Unmarshal(item.Output, &screenshot)
+			msg := UnifiedMessage{Role: "tool", ToolCallID: item.CallID}
+			if screenshot.ImageURL != "" {
+				msg.Images = []UnifiedImage{imageFromURL(screenshot.ImageURL)}
+			}
+			messages = append(messages, msg)
+		case "reasoning":
+			// Reasoning items are specific to the model that produced them.
+		default:
+			return nil, fmt.Errorf("unsupported input item type %q", item.Type)
+		}
+	}
+	return messages, nil
+}
+
+// responsesContentToUnified flattens a message's content, a string or an
+// array of input_text/output_text/input_image parts.
+func responsesContentToUnified(raw json.RawMessage) (string, []UnifiedImage, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+
+	var parts []struct {
+		Type     string `json:"type"`
+		Text     string `json:"text"`
+		ImageURL string `json:"image_url"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, fmt.Errorf("message content must be a string or an array of content parts")
+	}
+	var images []UnifiedImage
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			text += part.Text
+		case "input_image":
+			if part.ImageURL != "" {
+				images = append(images, imageFromURL(part.ImageURL))
+			}
+		}
+	}
+	return text, images, nil
+}
+
+// responsesToolToUnified converts a Responses tool definition. Function
+// tools are flat ({"type": "function", "name": ...}) rather than nested as
+// in Chat Completions; hosted tools share the Chat Completions parsing.
+func responsesToolToUnified(raw json.RawMessage) (UnifiedTool, error) {
+	var tool struct {
+		Type string `json:"type"`
+		UnifiedFunction
+	}
+	if err := json.Unmarshal(raw, &tool); err != nil {
+		return UnifiedTool{}, err
+	}
+	if tool.Type == "function" {
+		return UnifiedTool{Type: "function", Function: tool.UnifiedFunction}, nil
+	}
+	return openaiToolToUnified(raw)
+}
+
+// unifiedToResponsesObject renders a chat response as a Responses `response`
+// object. Calls to the "computer" tool become computer_call items.
+func unifiedToResponsesObject(unifiedResp *UnifiedChatResponse) map[string]interface{} {
+	id := unifiedResp.ID
+	if !strings.HasPrefix(id, "resp_") {
+		id = "resp_" + id
+	}
+
+	var output []map[string]interface{}
+	if unifiedResp.Content != "" {
+		annotations := make([]map[string]interface{}, len(unifiedResp.Citations))
+		for i, citation := range unifiedResp.Citations {
+			annotations[i] = map[string]interface{}{
+				"type":        "url_citation",
+				"start_index": citation.StartIndex,
+				"end_index":   citation.EndIndex,
+				"url":         citation.URL,
+				"title":       citation.Title,
+			}
+		}
+		output = append(output, map[string]interface{}{
+			"type":   "message",
+			"id":     "msg_" + strings.TrimPrefix(id, "resp_"),
+			"status": "completed",
+			"role":   "assistant",
+			"content": []map[string]interface{}{
+				{"type": "output_text", "text": unifiedResp.Content, "annotations": annotations},
+			},
+		})
+	}
+	for _, tc := range unifiedResp.ToolCalls {
+		if tc.Function.Name == "computer" {
+			var input map[string]interface{}
+			json.Unmarshal([]byte(tc.Function.Arguments), &input)
+			output = append(output, map[string]interface{}{
+				"type":                  "computer_call",
+				"id":                    "cu_" + tc.ID,
+				"call_id":               tc.ID,
+				"action":                anthropicComputerActionToOpenAI(input),
+				"pending_safety_checks": []interface{}{},
+				"status":                "completed",
+			})
+			continue
+		}
+		output = append(output, map[string]interface{}{
+			"type":      "function_call",
+			"id":        "fc_" + tc.ID,
+			"call_id":   tc.ID,
+			"name":      tc.Function.Name,
+			"arguments": tc.Function.Arguments,
+			"status":    "completed",
+		})
+	}
+	if output == nil {
+		output = []map[string]interface{}{}
+	}
+
+	response := map[string]interface{}{
+		"id":         id,
+		"object":     "response",
+		"created_at": 0,
+		"status":     "completed",
+		"model":      unifiedResp.Model,
+		"output":     output,
+		"usage": map[string]int{
+			"input_tokens":  unifiedResp.Usage.InputTokens,
+			"output_tokens": unifiedResp.Usage.OutputTokens,
+			"total_tokens":  unifiedResp.Usage.InputTokens + unifiedResp.Usage.OutputTokens,
+		},
+	}
+	if openaiStopReason(unifiedResp.StopReason) == "length" {
+		response["status"] = "incomplete"
+		response["incomplete_details"] = map[string]string{"reason": "max_output_tokens"}
+	}
+	return response
+}
+
+// writeResponsesEvents replays a complete response as the Responses event
+// stream: response.created, the added/delta/done events of every output
+// item, then response.completed.
+func writeResponsesEvents(w http.ResponseWriter, response map[string]interface{}) {
+	sequence := 0
+	emit := func(event map[string]interface{}) {
+		event["sequence_number"] = sequence
+		sequence++
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event["type"], data)
+	}
+
+	created := make(map[string]interface{}, len(response))
+	for key, value := range response {
+		created[key] = value
+	}
+	created["status"] = "in_progress"
+	created["output"] = []interface{}{}
+	emit(map[string]interface{}{"type": "response.created", "response": created})
+
+	for index, item := range response["output"].([]map[string]interface{}) {
+		emit(map[string]interface{}{"type": "response.output_item.added", "output_index": index, "item": item})
+		if item["type"] == "message" {
+			for partIndex, part := range item["content"].([]map[string]interface{}) {
+				emit(map[string]interface{}{"type": "response.content_part.added", "item_id": item["id"], "output_index": index, "content_index": partIndex, "part": map[string]interface{}{"type": "output_text", "text": "", "annotations": []interface{}{}}})
+				emit(map[string]interface{}{"type": "response.output_text.delta", "item_id": item["id"], "output_index": index, "content_index": partIndex, "delta": part["text"]})
+				emit(map[string]interface{}{"type": "response.output_text.done", "item_id": item["id"], "output_index": index, "content_index": partIndex, "text": part["text"]})
+				emit(map[string]interface{}{"type": "response.content_part.done", "item_id": item["id"], "output_index": index, "content_index": partIndex, "part": part})
+			}
+		}
+		emit(map[string]interface{}{"type": "response.output_item.done", "output_index": index, "item": item})
+	}
+
+	doneType := "response.completed"
+	if response["status"] == "incomplete" {
+		doneType = "response.incomplete"
+	}
+	emit(map[string]interface{}{"type": doneType, "response": response})
+}
@@ -0,0 +1,158 @@
+package adapters
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponsesAdapter_ClientChatToUnified(t *testing.T) {
+	adapter := &ResponsesAdapter{}
+
+	reqBody := `{
+		"model": "gpt-4.1",
+		"instructions": "Be brief.",
+		"input": [
+			{"role": "user", "content": [{"type": "input_text", "text": "Weather in Paris?"}, {"type": "input_image", "image_url": "data:image/png;base64,iVBOR"}]},
+			{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{\"city\":\"Paris\"}"},
+			{"type": "function_call", "call_id": "call_2", "name": "get_time", "arguments": "{}"},
+			{"type": "function_call_output", "call_id": "call_1", "output": "18C"},
+			{"type": "computer_call_output", "call_id": "call_3", "output": {"type": "computer_screenshot", "image_url": "https://example.com/s.png"}}
+		],
+		"tools": [{"type": "function", "name": "get_weather", "description": "Look up weather", "parameters": {"type": "object"}}],
+		"tool_choice": {"type": "function", "name": "get_weather"},
+		"max_output_tokens": 256,
+		"stream": true
+	}`
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(reqBody))
+
+	unified, err := adapter.ClientChatToUnified(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Messages) != 5 {
+		t.Fatalf("Expected 5 messages, got: %d (%+v)", len(unified.Messages), unified.Messages)
+	}
+	if unified.Messages[0].Role != "system" || unified.Messages[0].Content != "Be brief." {
+		t.Errorf("Expected instructions as a system message, got: %+v", unified.Messages[0])
+	}
+	if unified.Messages[1].Content != "Weather in Paris?" || len(unified.Messages[1].Images) != 1 || unified.Messages[1].Images[0].MediaType != "image/png" {
+		t.Errorf("Expected user text and image, got: %+v", unified.Messages[1])
+	}
+	if unified.Messages[2].Role != "assistant" || len(unified.Messages[2].ToolCalls) != 2 {
+		t.Errorf("Expected both function calls in one assistant message, got: %+v", unified.Messages[2])
+	}
+	if unified.Messages[3].Role != "tool" || unified.Messages[3].ToolCallID != "call_1" || unified.Messages[3].Content != "18C" {
+		t.Errorf("Expected function output as a tool message, got: %+v", unified.Messages[3])
+	}
+	if len(unified.Messages[4].Images) != 1 || unified.Messages[4].Images[0].URL != "https://example.com/s.png" {
+		t.Errorf("Expected the screenshot on the tool message, got: %+v", unified.Messages[4])
+	}
+
+	if len(unified.Tools) != 1 || unified.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("Expected the flat function tool, got: %+v", unified.Tools)
+	}
+	choice, _ := unified.ToolChoice.(map[string]interface{})
+	if function, _ := choice["function"].(map[string]interface{}); function["name"] != "get_weather" {
+		t.Errorf("Expected tool_choice in Chat Completions shape, got: %v", unified.ToolChoice)
+	}
+	if unified.Stream || !unified.ReplayStream {
+		t.Errorf("Expected a replayed stream with a non-streaming backend call")
+	}
+	if unified.MaxTokens != 256 {
+		t.Errorf("Expected max_output_tokens as max_tokens, got: %d", unified.MaxTokens)
+	}
+}
+
+func TestResponsesAdapter_RejectsPreviousResponseID(t *testing.T) {
+	adapter := &ResponsesAdapter{}
+
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model": "m", "input": "hi", "previous_response_id": "resp_1"}`))
+	if _, err := adapter.ClientChatToUnified(req); err == nil {
+		t.Error("Expected an error for previous_response_id")
+	}
+}
+
+func TestResponsesAdapter_UnifiedChatToClient(t *testing.T) {
+	adapter := &ResponsesAdapter{}
+
+	unifiedResp := &UnifiedChatResponse{
+		ID:      "abc",
+		Model:   "claude-3-haiku",
+		Content: "Checking.",
+		ToolCalls: []UnifiedToolCall{
+			{ID: "toolu_1", Type: "function", Function: UnifiedFunctionCall{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+			{ID: "toolu_2", Type: "function", Function: UnifiedFunctionCall{Name: "computer", Arguments: `{"action":"left_click","coordinate":[10,20]}`}},
+		},
+		Usage: UnifiedUsage{InputTokens: 12, OutputTokens: 8},
+	}
+
+	rr := httptest.NewRecorder()
+	if err := adapter.UnifiedChatToClient(unifiedResp, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var resp struct {
+		ID     string `json:"id"`
+		Object string `json:"object"`
+		Output []struct {
+			Type    string                 `json:"type"`
+			CallID  string                 `json:"call_id"`
+			Name    string                 `json:"name"`
+			Action  map[string]interface{} `json:"action"`
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"output"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.ID != "resp_abc" || resp.Object != "response" || resp.Usage.TotalTokens != 20 {
+		t.Errorf("Expected a response object, got: %s", rr.Body.String())
+	}
+	if len(resp.Output) != 3 {
+		t.Fatalf("Expected message, function_call and computer_call items, got: %s", rr.Body.String())
+	}
+	if resp.Output[0].Type != "message" || resp.Output[0].Content[0].Text != "Checking." {
+		t.Errorf("Expected the text as a message item, got: %+v", resp.Output[0])
+	}
+	if resp.Output[1].Type != "function_call" || resp.Output[1].CallID != "toolu_1" || resp.Output[1].Name != "get_weather" {
+		t.Errorf("Expected a function_call item, got: %+v", resp.Output[1])
+	}
+	if resp.Output[2].Type != "computer_call" || resp.Output[2].Action["type"] != "click" || resp.Output[2].Action["x"] != float64(10) {
+		t.Errorf("Expected a computer_call click item, got: %+v", resp.Output[2])
+	}
+}
+
+func TestResponsesAdapter_ReplaysStreamEvents(t *testing.T) {
+	adapter := &ResponsesAdapter{}
+
+	rr := httptest.NewRecorder()
+	if err := adapter.UnifiedChatToClient(&UnifiedChatResponse{ID: "1", Content: "Hi", Stream: true}, rr); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if rr.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected an event stream, got: %s", rr.Header().Get("Content-Type"))
+	}
+	var events []string
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+		}
+	}
+	expected := []string{
+		"response.created", "response.output_item.added", "response.content_part.added",
+		"response.output_text.delta", "response.output_text.done", "response.content_part.done",
+		"response.output_item.done", "response.completed",
+	}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected events %v, got: %v", expected, events)
+	}
+}
@@ -0,0 +1,453 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Server tools are executed by the provider rather than the client. Each
+// dialect spells them differently, so tool definitions are converted through
+// UnifiedTool.Type instead of being forwarded verbatim.
+
+// anthropicToolToUnified converts one entry of an Anthropic `tools` array.
+func anthropicToolToUnified(tool map[string]interface{}) UnifiedTool {
+	toolType, _ := tool["type"].(string)
+	switch {
+	case strings.HasPrefix(toolType, "web_search_"):
+		webSearch := &UnifiedWebSearch{
+			AllowedDomains: stringSlice(tool["allowed_domains"]),
+			BlockedDomains: stringSlice(tool["blocked_domains"]),
+		}
+		if maxUses, ok := tool["max_uses"].(float64); ok {
+			webSearch.MaxUses = int(maxUses)
+		}
+		if location, ok := tool["user_location"].(map[string]interface{}); ok {
+			webSearch.UserLocation = userLocationFromMap(location)
+		}
+		return UnifiedTool{Type: "web_search", WebSearch: webSearch}
+	case strings.HasPrefix(toolType, "computer_"):
+		computer := &UnifiedComputer{}
+		if width, ok := tool["display_width_px"].(float64); ok {
+			computer.DisplayWidth = int(width)
+		}
+		if height, ok := tool["display_height_px"].(float64); ok {
+			computer.DisplayHeight = int(height)
+		}
+		if number, ok := tool["display_number"].(float64); ok {
+			computer.DisplayNumber = int(number)
+		}
+		return UnifiedTool{Type: "computer", Computer: computer}
+	case strings.HasPrefix(toolType, "code_execution_"):
+		return UnifiedTool{Type: "code_execution"}
+	}
+
+	schema, _ := tool["input_schema"].(map[string]interface{})
+	name, _ := tool["name"].(string)
+	description, _ := tool["description"].(string)
+	return UnifiedTool{
+		Type: "function",
+		Function: UnifiedFunction{
+			Name:        name,
+			Description: description,
+			Parameters:  schema,
+		},
+	}
+}
+
+// unifiedToolToAnthropic renders a unified tool as an Anthropic tool definition.
+func unifiedToolToAnthropic(tool UnifiedTool) map[string]interface{} {
+	switch tool.Type {
+	case "web_search":
+		anthropicTool := map[string]interface{}{
+			"type": "web_search_20250305",
+			"name": "web_search",
+		}
+		if ws := tool.WebSearch; ws != nil {
+			if ws.MaxUses > 0 {
+				anthropicTool["max_uses"] = ws.MaxUses
+			}
+			// Anthropic rejects requests that set both lists.
+			if len(ws.AllowedDomains) > 0 {
+				anthropicTool["allowed_domains"] = ws.AllowedDomains
+			} else if len(ws.BlockedDomains) > 0 {
+				anthropicTool["blocked_domains"] = ws.BlockedDomains
+			}
+			if ws.UserLocation != nil {
+				location := userLocationToMap(ws.UserLocation)
+				location["type"] = "approximate"
+				anthropicTool["user_location"] = location
+			}
+		}
+		return anthropicTool
+	case "computer":
+		anthropicTool := map[string]interface{}{
+			"type": "computer_20250124",
+			"name": "computer",
+		}
+		if c := tool.Computer; c != nil {
+			anthropicTool["display_width_px"] = c.DisplayWidth
+			anthropicTool["display_height_px"] = c.DisplayHeight
+			if c.DisplayNumber > 0 {
+				anthropicTool["display_number"] = c.DisplayNumber
+			}
+		}
+		return anthropicTool
+	case "code_execution":
+		return map[string]interface{}{
+			"type": "code_execution_20250522",
+			"name": "code_execution",
+		}
+	}
+
+	return map[string]interface{}{
+		"name":         tool.Function.Name,
+		"description":  tool.Function.Description,
+		"input_schema": tool.Function.Parameters, // Anthropic uses input_schema
+	}
+}
+
+// openaiToolToUnified converts one entry of an OpenAI `tools` array. Both
+// the Chat Completions function shape and the hosted web_search tool
+// (web_search / web_search_preview) are recognized.
+func openaiToolToUnified(raw json.RawMessage) (UnifiedTool, error) {
+	var tool struct {
+		Type              string                 `json:"type"`
+		Function          UnifiedFunction        `json:"function"`
+		SearchContextSize string                 `json:"search_context_size"`
+		UserLocation      map[string]interface{} `json:"user_location"`
+		Filters           struct {
+			AllowedDomains []string `json:"allowed_domains"`
+		} `json:"filters"`
+		DisplayWidth  int    `json:"display_width"`
+		DisplayHeight int    `json:"display_height"`
+		Environment   string `json:"environment"`
+	}
+	if err := json.Unmarshal(raw, &tool); err != nil {
+		return UnifiedTool{}, err
+	}
+
+	switch tool.Type {
+	case "web_search", "web_search_preview":
+		return UnifiedTool{
+			Type: "web_search",
+			WebSearch: &UnifiedWebSearch{
+				ContextSize:    tool.SearchContextSize,
+				AllowedDomains: tool.Filters.AllowedDomains,
+				UserLocation:   openaiUserLocation(tool.UserLocation),
+			},
+		}, nil
+	case "code_interpreter":
+		return UnifiedTool{Type: "code_execution"}, nil
+	case "computer_use_preview":
+		return UnifiedTool{
+			Type: "computer",
+			Computer: &UnifiedComputer{
+				DisplayWidth:  tool.DisplayWidth,
+				DisplayHeight: tool.DisplayHeight,
+				Environment:   tool.Environment,
+			},
+		}, nil
+	}
+	return UnifiedTool{Type: tool.Type, Function: tool.Function}, nil
+}
+
+// computerFunctionTool emulates a computer-use tool for Chat Completions
+// backends, which have no native equivalent, as a regular function whose
+// arguments follow Anthropic's computer action schema. Tool calls therefore
+// come back in the shape Anthropic computer-use clients already execute.
+func computerFunctionTool(c *UnifiedComputer) UnifiedTool {
+	description := "Control the computer's screen, mouse, and keyboard. Take a screenshot to see the current state."
+	if c != nil && c.DisplayWidth > 0 {
+		description += fmt.Sprintf(" The display is %dx%d pixels.", c.DisplayWidth, c.DisplayHeight)
+	}
+	return UnifiedTool{
+		Type: "function",
+		Function: UnifiedFunction{
+			Name:        "computer",
+			Description: description,
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"action": map[string]interface{}{
+						"type": "string",
+						"enum": []string{"screenshot", "left_click", "right_click", "middle_click", "double_click", "triple_click",
+							"mouse_move", "left_click_drag", "type", "key", "scroll", "wait", "cursor_position"},
+					},
+					"coordinate":       map[string]interface{}{"type": "array", "items": map[string]string{"type": "integer"}, "description": "[x, y] in pixels"},
+					"start_coordinate": map[string]interface{}{"type": "array", "items": map[string]string{"type": "integer"}, "description": "[x, y] drag start"},
+					"text":             map[string]interface{}{"type": "string", "description": "Text to type or key combination to press"},
+					"scroll_direction": map[string]interface{}{"type": "string", "enum": []string{"up", "down", "left", "right"}},
+					"scroll_amount":    map[string]interface{}{"type": "integer"},
+					"duration":         map[string]interface{}{"type": "number", "description": "Seconds to wait"},
+				},
+				"required": []string{"action"},
+			},
+		},
+	}
+}
+
+// CodeExecutionFunctionTool exposes code execution as a regular function
+// tool, so the client runs the code itself. It is used for backends with no
+// hosted sandbox and when a model is configured to emulate the tool.
+func CodeExecutionFunctionTool() UnifiedTool {
+	return UnifiedTool{
+		Type: "function",
+		Function: UnifiedFunction{
+			Name:        "code_execution",
+			Description: "Execute Python code in a sandbox and return its stdout, stderr, and exit code.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"code": map[string]interface{}{"type": "string", "description": "Python source to execute"},
+				},
+				"required": []string{"code"},
+			},
+		},
+	}
+}
+
+// hasToolType reports whether any tool in the request is of the given type.
+func hasToolType(tools []UnifiedTool, toolType string) bool {
+	for _, tool := range tools {
+		if tool.Type == toolType {
+			return true
+		}
+	}
+	return false
+}
+
+// openaiComputerActionToAnthropic converts an OpenAI computer_call action
+// into the input of an Anthropic computer tool_use block.
+func openaiComputerActionToAnthropic(action map[string]interface{}) map[string]interface{} {
+	coordinate := func() []int {
+		x, _ := action["x"].(float64)
+		y, _ := action["y"].(float64)
+		return []int{int(x), int(y)}
+	}
+
+	switch action["type"] {
+	case "click":
+		name := "left_click"
+		switch action["button"] {
+		case "right":
+			name = "right_click"
+		case "wheel":
+			name = "middle_click"
+		}
+		return map[string]interface{}{"action": name, "coordinate": coordinate()}
+	case "double_click":
+		return map[string]interface{}{"action": "double_click", "coordinate": coordinate()}
+	case "move":
+		return map[string]interface{}{"action": "mouse_move", "coordinate": coordinate()}
+	case "drag":
+		path, _ := action["path"].([]interface{})
+		if len(path) >= 2 {
+			point := func(p interface{}) []int {
+				m, _ := p.(map[string]interface{})
+				x, _ := m["x"].(float64)
+				y, _ := m["y"].(float64)
+				return []int{int(x), int(y)}
+			}
+			return map[string]interface{}{
+				"action":           "left_click_drag",
+				"start_coordinate": point(path[0]),
+				"coordinate":       point(path[len(path)-1]),
+			}
+		}
+	case "type":
+		return map[string]interface{}{"action": "type", "text": action["text"]}
+	case "keypress":
+		keys := stringSlice(action["keys"])
+		return map[string]interface{}{"action": "key", "text": strings.Join(keys, "+")}
+	case "scroll":
+		scrollX, _ := action["scroll_x"].(float64)
+		scrollY, _ := action["scroll_y"].(float64)
+		direction, amount := "down", scrollY
+		switch {
+		case scrollY < 0:
+			direction, amount = "up", -scrollY
+		case scrollX > 0:
+			direction, amount = "right", scrollX
+		case scrollX < 0:
+			direction, amount = "left", -scrollX
+		}
+		return map[string]interface{}{
+			"action":           "scroll",
+			"coordinate":       coordinate(),
+			"scroll_direction": direction,
+			"scroll_amount":    max(1, int(amount)/100), // OpenAI scrolls in pixels, Anthropic in clicks
+		}
+	case "wait":
+		return map[string]interface{}{"action": "wait", "duration": 1}
+	}
+	return map[string]interface{}{"action": "screenshot"}
+}
+
+// anthropicComputerActionToOpenAI is the inverse of
+// openaiComputerActionToAnthropic.
+func anthropicComputerActionToOpenAI(input map[string]interface{}) map[string]interface{} {
+	point := func(key string) (int, int) {
+		coords, _ := input[key].([]interface{})
+		if len(coords) != 2 {
+			return 0, 0
+		}
+		x, _ := coords[0].(float64)
+		y, _ := coords[1].(float64)
+		return int(x), int(y)
+	}
+	x, y := point("coordinate")
+
+	switch input["action"] {
+	case "left_click", "right_click", "middle_click":
+		button := map[interface{}]string{"left_click": "left", "right_click": "right", "middle_click": "wheel"}[input["action"]]
+		return map[string]interface{}{"type": "click", "button": button, "x": x, "y": y}
+	case "double_click", "triple_click":
+		return map[string]interface{}{"type": "double_click", "x": x, "y": y}
+	case "mouse_move":
+		return map[string]interface{}{"type": "move", "x": x, "y": y}
+	case "left_click_drag":
+		startX, startY := point("start_coordinate")
+		return map[string]interface{}{
+			"type": "drag",
+			"path": []map[string]int{{"x": startX, "y": startY}, {"x": x, "y": y}},
+		}
+	case "type":
+		return map[string]interface{}{"type": "type", "text": input["text"]}
+	case "key":
+		text, _ := input["text"].(string)
+		return map[string]interface{}{"type": "keypress", "keys": strings.Split(text, "+")}
+	case "scroll":
+		amount, _ := input["scroll_amount"].(float64)
+		pixels := int(amount) * 100
+		scroll := map[string]interface{}{"type": "scroll", "x": x, "y": y, "scroll_x": 0, "scroll_y": 0}
+		switch input["scroll_direction"] {
+		case "up":
+			scroll["scroll_y"] = -pixels
+		case "down":
+			scroll["scroll_y"] = pixels
+		case "left":
+			scroll["scroll_x"] = -pixels
+		case "right":
+			scroll["scroll_x"] = pixels
+		}
+		return scroll
+	case "wait":
+		return map[string]interface{}{"type": "wait"}
+	}
+	return map[string]interface{}{"type": "screenshot"}
+}
+
+// openaiWebSearchOptionsToUnified converts the Chat Completions
+// `web_search_options` field into a web_search tool.
+func openaiWebSearchOptionsToUnified(options map[string]interface{}) UnifiedTool {
+	webSearch := &UnifiedWebSearch{}
+	webSearch.ContextSize, _ = options["search_context_size"].(string)
+	if location, ok := options["user_location"].(map[string]interface{}); ok {
+		webSearch.UserLocation = openaiUserLocation(location)
+	}
+	return UnifiedTool{Type: "web_search", WebSearch: webSearch}
+}
+
+// unifiedWebSearchToOpenAI renders a web_search tool as Chat Completions
+// `web_search_options`. Domain filters and use limits have no equivalent.
+func unifiedWebSearchToOpenAI(ws *UnifiedWebSearch) map[string]interface{} {
+	options := map[string]interface{}{}
+	if ws == nil {
+		return options
+	}
+	if ws.ContextSize != "" {
+		options["search_context_size"] = ws.ContextSize
+	}
+	if ws.UserLocation != nil {
+		options["user_location"] = map[string]interface{}{
+			"type":        "approximate",
+			"approximate": userLocationToMap(ws.UserLocation),
+		}
+	}
+	return options
+}
+
+// openaiUserLocation accepts both the nested Chat Completions shape
+// ({"type": "approximate", "approximate": {...}}) and the flat Responses shape.
+func openaiUserLocation(location map[string]interface{}) *UnifiedUserLocation {
+	if location == nil {
+		return nil
+	}
+	if nested, ok := location["approximate"].(map[string]interface{}); ok {
+		location = nested
+	}
+	return userLocationFromMap(location)
+}
+
+func userLocationFromMap(location map[string]interface{}) *UnifiedUserLocation {
+	result := &UnifiedUserLocation{}
+	result.City, _ = location["city"].(string)
+	result.Region, _ = location["region"].(string)
+	result.Country, _ = location["country"].(string)
+	result.Timezone, _ = location["timezone"].(string)
+	return result
+}
+
+func userLocationToMap(location *UnifiedUserLocation) map[string]interface{} {
+	result := map[string]interface{}{}
+	for key, value := range map[string]string{
+		"city":     location.City,
+		"region":   location.Region,
+		"country":  location.Country,
+		"timezone": location.Timezone,
+	} {
+		if value != "" {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// anthropicCitedBlocks splits response text into Anthropic text blocks so
+// that each cited span carries its web_search_result_location citation.
+func anthropicCitedBlocks(content string, citations []UnifiedCitation) []map[string]interface{} {
+	runes := []rune(content)
+	var blocks []map[string]interface{}
+	cursor := 0
+	for _, citation := range citations {
+		start, end := citation.StartIndex, citation.EndIndex
+		if start < cursor || end > len(runes) || start >= end {
+			continue
+		}
+		if start > cursor {
+			blocks = append(blocks, map[string]interface{}{"type": "text", "text": string(runes[cursor:start])})
+		}
+		blocks = append(blocks, map[string]interface{}{
+			"type": "text",
+			"text": string(runes[start:end]),
+			"citations": []map[string]interface{}{
+				{
+					"type":       "web_search_result_location",
+					"url":        citation.URL,
+					"title":      citation.Title,
+					"cited_text": citation.CitedText,
+				},
+			},
+		})
+		cursor = end
+	}
+	if cursor < len(runes) || len(blocks) == 0 {
+		blocks = append(blocks, map[string]interface{}{"type": "text", "text": string(runes[cursor:])})
+	}
+	return blocks
+}
+
+func stringSlice(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			result = append(result, s)
+		}
+	}
+	return result
+}
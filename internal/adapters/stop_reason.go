@@ -0,0 +1,55 @@
+package adapters
+
+// UnifiedChatResponse.StopReason holds the backend's own value, like
+// "stop" or "end_turn". Client adapters translate it to their dialect when
+// rendering, so SDKs only ever see reasons they know.
+
+// openaiFinishReasons maps Anthropic stop reasons to Chat Completions
+// finish reasons. Chat Completions has no separate reason for stop
+// sequences: hitting one is a plain "stop".
+var openaiFinishReasons = map[string]string{
+	"end_turn":      "stop",
+	"stop_sequence": "stop",
+	"pause_turn":    "stop",
+	"max_tokens":    "length",
+	"tool_use":      "tool_calls",
+	"refusal":       "content_filter",
+}
+
+// anthropicStopReasons maps Chat Completions finish reasons to Anthropic
+// stop reasons.
+var anthropicStopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"function_call":  "tool_use",
+	"content_filter": "refusal",
+}
+
+// openaiStopReason returns a stop reason as a Chat Completions
+// finish_reason. Reasons already in that form, or unknown, pass through.
+func openaiStopReason(reason string) string {
+	if mapped, ok := openaiFinishReasons[reason]; ok {
+		return mapped
+	}
+	return reason
+}
+
+// anthropicStopReason returns a stop reason as an Anthropic stop_reason.
+// Reasons already in that form, or unknown, pass through.
+func anthropicStopReason(reason string) string {
+	if mapped, ok := anthropicStopReasons[reason]; ok {
+		return mapped
+	}
+	return reason
+}
+
+// openaiFinishReason returns the finish_reason for a choice. Legacy
+// functions clients get "function_call" for a tool call stop.
+func openaiFinishReason(choice *UnifiedChatResponse, legacyFunctions bool) string {
+	reason := openaiStopReason(choice.StopReason)
+	if legacyFunctions && reason == "tool_calls" && len(choice.ToolCalls) > 0 {
+		return "function_call"
+	}
+	return reason
+}
@@ -0,0 +1,71 @@
+package adapters
+
+import "log/slog"
+
+// UnifiedChatRequest.ToolChoice uses the Chat Completions shape: "auto",
+// "none", "required", or {"type": "function", "function": {"name": ...}}.
+// Whether the model may call several tools at once travels separately, as
+// the parallel_tool_calls parameter.
+
+// anthropicToolChoiceToUnified converts an Anthropic tool_choice
+// ({"type": "auto"|"any"|"none"|"tool", "name": ...}) to the unified shape.
+// It also reports whether disable_parallel_tool_use was set.
+func anthropicToolChoiceToUnified(choice interface{}) (interface{}, bool) {
+	choiceMap, ok := choice.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	disableParallel, _ := choiceMap["disable_parallel_tool_use"].(bool)
+
+	switch choiceMap["type"] {
+	case "auto":
+		return "auto", disableParallel
+	case "any":
+		return "required", disableParallel
+	case "none":
+		return "none", disableParallel
+	case "tool":
+		return map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choiceMap["name"]},
+		}, disableParallel
+	}
+	slog.Debug("dropping unknown tool_choice", "tool_choice", choice)
+	return nil, disableParallel
+}
+
+// unifiedToolChoiceToAnthropic converts a unified tool_choice to Anthropic's
+// shape, or returns nil if it has no equivalent there.
+func unifiedToolChoiceToAnthropic(choice interface{}, disableParallel bool) map[string]interface{} {
+	var anthropicChoice map[string]interface{}
+	switch v := choice.(type) {
+	case string:
+		switch v {
+		case "auto":
+			anthropicChoice = map[string]interface{}{"type": "auto"}
+		case "required":
+			anthropicChoice = map[string]interface{}{"type": "any"}
+		case "none":
+			anthropicChoice = map[string]interface{}{"type": "none"}
+		}
+	case map[string]interface{}:
+		if function, ok := v["function"].(map[string]interface{}); ok && v["type"] == "function" {
+			anthropicChoice = map[string]interface{}{"type": "tool", "name": function["name"]}
+		}
+	case nil:
+		if disableParallel {
+			anthropicChoice = map[string]interface{}{"type": "auto"}
+		}
+	}
+	if anthropicChoice == nil {
+		if choice != nil {
+			slog.Debug("dropping tool_choice unsupported by backend", "tool_choice", choice, "backend", "anthropic")
+		}
+		return nil
+	}
+	// "none" forbids tool use, so there is nothing to run in parallel.
+	if disableParallel && anthropicChoice["type"] != "none" {
+		anthropicChoice["disable_parallel_tool_use"] = true
+	}
+	return anthropicChoice
+}
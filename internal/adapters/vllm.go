@@ -0,0 +1,218 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// VLLMAdapter speaks the OpenAI dialect of self-hosted vLLM and Hugging Face
+// Text Generation Inference (TGI) servers. On top of the OpenAI adapter it
+// forwards their extra sampling and guided decoding parameters (top_k,
+// best_of, ignore_eos, guided_json, ...), checking them before the request
+// is sent so mistakes are reported as 400s rather than backend errors.
+type VLLMAdapter struct {
+	OpenAIAdapter
+	// TGI renames guided decoding to TGI's response_format grammars and
+	// rejects the vLLM parameters TGI lacks.
+	TGI bool
+}
+
+// ParameterError reports a request parameter that the backend would reject.
+type ParameterError struct {
+	Parameter string
+	Message   string
+}
+
+func (e *ParameterError) Error() string {
+	return "invalid parameter " + e.Parameter + ": " + e.Message
+}
+
+// vllmParameter checks the value of one extra parameter.
+type vllmParameter func(value interface{}) string
+
+func vllmBool(value interface{}) string {
+	if _, ok := value.(bool); !ok {
+		return "must be a boolean"
+	}
+	return ""
+}
+
+// vllmFloat returns a numeric parameter, decoded from JSON or set by another
+// adapter, as a float64.
+func vllmFloat(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func vllmInteger(min float64) vllmParameter {
+	return func(value interface{}) string {
+		n, ok := vllmFloat(value)
+		if !ok || n != math.Trunc(n) {
+			return "must be an integer"
+		}
+		if n < min {
+			return fmt.Sprintf("must be at least %g", min)
+		}
+		return ""
+	}
+}
+
+func vllmNumber(min, max float64) vllmParameter {
+	return func(value interface{}) string {
+		n, ok := vllmFloat(value)
+		if !ok {
+			return "must be a number"
+		}
+		if n < min || n > max {
+			return fmt.Sprintf("must be between %g and %g", min, max)
+		}
+		return ""
+	}
+}
+
+func vllmString(value interface{}) string {
+	if s, ok := value.(string); !ok || s == "" {
+		return "must be a non-empty string"
+	}
+	return ""
+}
+
+// vllmParameters are the extra parameters vLLM accepts and their checks.
+var vllmParameters = map[string]vllmParameter{
+	"top_k":                      vllmInteger(-1),
+	"min_p":                      vllmNumber(0, 1),
+	"repetition_penalty":         vllmNumber(math.SmallestNonzeroFloat64, math.MaxFloat64),
+	"length_penalty":             vllmNumber(-math.MaxFloat64, math.MaxFloat64),
+	"best_of":                    vllmInteger(1),
+	"min_tokens":                 vllmInteger(0),
+	"ignore_eos":                 vllmBool,
+	"use_beam_search":            vllmBool,
+	"skip_special_tokens":        vllmBool,
+	"include_stop_str_in_output": vllmBool,
+	"guided_json": func(value interface{}) string {
+		switch schema := value.(type) {
+		case map[string]interface{}:
+			return ""
+		case string:
+			if json.Valid([]byte(schema)) {
+				return ""
+			}
+		}
+		return "must be a JSON schema"
+	},
+	"guided_regex": func(value interface{}) string {
+		s, ok := value.(string)
+		if !ok {
+			return "must be a regular expression"
+		}
+		if _, err := regexp.Compile(s); err != nil {
+			return "must be a regular expression: " + err.Error()
+		}
+		return ""
+	},
+	"guided_choice": func(value interface{}) string {
+		choices, ok := value.([]interface{})
+		if !ok || len(choices) == 0 {
+			return "must be a non-empty list of strings"
+		}
+		for _, choice := range choices {
+			if _, ok := choice.(string); !ok {
+				return "must be a non-empty list of strings"
+			}
+		}
+		return ""
+	},
+	"guided_grammar":          vllmString,
+	"guided_decoding_backend": vllmString,
+}
+
+// guidedParameters are the mutually exclusive guided decoding modes.
+var guidedParameters = []string{"guided_json", "guided_regex", "guided_choice", "guided_grammar"}
+
+func (a *VLLMAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
+	body := openaiChatBody(unifiedReq)
+	// The OpenAI API rejects top_k, but these servers accept it.
+	if topK, ok := unifiedReq.Parameters["top_k"]; ok {
+		body["top_k"] = topK
+	}
+	if err := a.PrepareBody(body); err != nil {
+		return nil, err
+	}
+	return newJSONRequest(body, backendURL)
+}
+
+// PrepareBody checks the extra parameters of a decoded Chat Completions
+// request body, and for TGI rewrites guided decoding in TGI's form. It is
+// also used on requests passed through unchanged, and returns a
+// *ParameterError for a parameter the server would reject.
+func (a *VLLMAdapter) PrepareBody(body map[string]interface{}) error {
+	for name, check := range vllmParameters {
+		if value, ok := body[name]; ok {
+			if message := check(value); message != "" {
+				return &ParameterError{Parameter: name, Message: message}
+			}
+		}
+	}
+	var guided []string
+	for _, name := range guidedParameters {
+		if _, ok := body[name]; ok {
+			guided = append(guided, name)
+		}
+	}
+	if len(guided) > 1 {
+		return &ParameterError{Parameter: guided[1], Message: "cannot be combined with " + guided[0]}
+	}
+	if bestOf, ok := vllmFloat(body["best_of"]); ok {
+		if n, ok := vllmFloat(body["n"]); ok && bestOf < n {
+			return &ParameterError{Parameter: "best_of", Message: "must be at least n"}
+		}
+	}
+	if !a.TGI {
+		return nil
+	}
+
+	// TGI's chat API takes grammars in response_format and has no
+	// equivalent for the other parameters.
+	if len(guided) == 1 {
+		if _, ok := body["response_format"]; ok {
+			return &ParameterError{Parameter: guided[0], Message: "cannot be combined with response_format"}
+		}
+	}
+	for name := range vllmParameters {
+		value, ok := body[name]
+		if !ok {
+			continue
+		}
+		delete(body, name)
+		switch name {
+		case "guided_json":
+			if schema, ok := value.(string); ok {
+				var decoded interface{}
+				json.Unmarshal([]byte(schema), &decoded)
+				value = decoded
+			}
+			body["response_format"] = map[string]interface{}{"type": "json", "value": value}
+		case "guided_regex":
+			body["response_format"] = map[string]interface{}{"type": "regex", "value": value}
+		case "guided_choice":
+			choices := value.([]interface{})
+			quoted := make([]string, len(choices))
+			for i, choice := range choices {
+				quoted[i] = regexp.QuoteMeta(choice.(string))
+			}
+			body["response_format"] = map[string]interface{}{"type": "regex", "value": "(" + strings.Join(quoted, "|") + ")"}
+		default:
+			return &ParameterError{Parameter: name, Message: "is not supported by TGI"}
+		}
+	}
+	return nil
+}
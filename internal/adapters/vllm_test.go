@@ -0,0 +1,81 @@
+package adapters
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVLLMAdapter_UnifiedChatToBackend(t *testing.T) {
+	adapter := &VLLMAdapter{}
+	unified := &UnifiedChatRequest{
+		Model:    "meta-llama/Llama-3.1-8B-Instruct",
+		Messages: []UnifiedMessage{{Role: "user", Content: "Pick one"}},
+		Parameters: map[string]interface{}{
+			"top_k":         20,
+			"ignore_eos":    true,
+			"guided_choice": []interface{}{"yes", "no"},
+		},
+	}
+	req, err := adapter.UnifiedChatToBackend(unified, "http://vllm:8000/v1/chat/completions")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	data, _ := io.ReadAll(req.Body)
+	var body map[string]interface{}
+	json.Unmarshal(data, &body)
+	if body["top_k"] != float64(20) || body["ignore_eos"] != true || body["guided_choice"] == nil {
+		t.Errorf("Expected the vLLM parameters to be forwarded, got: %s", data)
+	}
+
+	// Bad values are reported as parameter errors
+	unified.Parameters = map[string]interface{}{"best_of": 0.5}
+	_, err = adapter.UnifiedChatToBackend(unified, "http://vllm:8000/v1/chat/completions")
+	var paramErr *ParameterError
+	if !errors.As(err, &paramErr) || paramErr.Parameter != "best_of" {
+		t.Errorf("Expected a best_of parameter error, got: %v", err)
+	}
+}
+
+func TestVLLMAdapter_PrepareBody(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		tgi      bool
+		body     string
+		expected string // error substring, or a field of the rewritten body
+	}{
+		{"valid", false, `{"min_p": 0.1, "guided_regex": "[0-9]+"}`, ""},
+		{"range", false, `{"min_p": 2}`, "min_p: must be between 0 and 1"},
+		{"regex", false, `{"guided_regex": "("}`, "guided_regex: must be a regular expression"},
+		{"exclusive", false, `{"guided_json": {}, "guided_choice": ["a"]}`, "cannot be combined with guided_json"},
+		{"best_of", false, `{"n": 3, "best_of": 2}`, "best_of: must be at least n"},
+		{"tgi unsupported", true, `{"ignore_eos": true}`, "ignore_eos: is not supported by TGI"},
+	} {
+		var body map[string]interface{}
+		json.Unmarshal([]byte(tc.body), &body)
+		err := (&VLLMAdapter{TGI: tc.tgi}).PrepareBody(body)
+		if tc.expected == "" && err != nil {
+			t.Errorf("%s: Expected no error, got: %v", tc.name, err)
+		}
+		if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+			t.Errorf("%s: Expected %q, got: %v", tc.name, tc.expected, err)
+		}
+	}
+
+	// TGI takes guided decoding as a response_format grammar
+	body := map[string]interface{}{"guided_choice": []interface{}{"yes", "n.a."}}
+	if err := (&VLLMAdapter{TGI: true}).PrepareBody(body); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	format, _ := body["response_format"].(map[string]interface{})
+	if format["type"] != "regex" || format["value"] != `(yes|n\.a\.)` || body["guided_choice"] != nil {
+		t.Errorf("Expected a regex grammar, got: %v", body)
+	}
+	body = map[string]interface{}{"guided_json": `{"type": "object"}`}
+	(&VLLMAdapter{TGI: true}).PrepareBody(body)
+	if format, _ := body["response_format"].(map[string]interface{}); format["type"] != "json" || format["value"].(map[string]interface{})["type"] != "object" {
+		t.Errorf("Expected a JSON grammar, got: %v", body)
+	}
+}
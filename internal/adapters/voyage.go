@@ -0,0 +1,159 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// VoyageAdapter implements the embedding half of the Adapter interface for
+// Voyage AI's text and multimodal embeddings APIs. Requests for a backend
+// URL ending in "multimodalembeddings" use the multimodal API, which takes
+// images but no output_dimension; others use the text API.
+type VoyageAdapter struct{}
+
+// --- Chat Completion Operations ---
+
+func (a *VoyageAdapter) ClientChatToUnified(r *http.Request) (*UnifiedChatRequest, error) {
+	return nil, fmt.Errorf("Voyage does not support chat requests")
+}
+
+func (a *VoyageAdapter) UnifiedChatToBackend(unifiedReq *UnifiedChatRequest, backendURL string) (*http.Request, error) {
+	return nil, fmt.Errorf("Voyage does not support chat requests")
+}
+
+func (a *VoyageAdapter) BackendChatToUnified(backendResp *http.Response) (*UnifiedChatResponse, error) {
+	return nil, fmt.Errorf("Voyage does not support chat responses")
+}
+
+func (a *VoyageAdapter) UnifiedChatToClient(unifiedResp *UnifiedChatResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("Voyage does not support chat responses")
+}
+
+// --- Error Translation ---
+
+func (a *VoyageAdapter) TranslateError(backendResp *http.Response) []byte {
+	var voyageError struct {
+		Detail string `json:"detail"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&voyageError); err != nil || voyageError.Detail == "" {
+		return []byte(`{"error": {"message": "An error occurred at the backend.", "type": "broker_error"}}`)
+	}
+
+	errorBody, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"message": voyageError.Detail,
+			"type":    "backend_error",
+		},
+	})
+	return errorBody
+}
+
+// --- Embedding Operations ---
+
+func (a *VoyageAdapter) ClientEmbeddingToUnified(r *http.Request) (*UnifiedEmbeddingRequest, error) {
+	return nil, fmt.Errorf("Voyage-format embedding clients are not supported")
+}
+
+func (a *VoyageAdapter) UnifiedEmbeddingToBackend(unifiedReq *UnifiedEmbeddingRequest, backendURL string) (*http.Request, error) {
+	if len(unifiedReq.Tokens) > 0 {
+		return nil, &ParameterError{Parameter: "input", Message: "token arrays are not supported by Voyage; send text"}
+	}
+
+	voyageReq := map[string]interface{}{
+		"model": unifiedReq.Model,
+	}
+	if unifiedReq.InputType != "" {
+		voyageReq["input_type"] = unifiedReq.InputType
+	}
+	if unifiedReq.Truncate != nil {
+		voyageReq["truncation"] = *unifiedReq.Truncate
+	}
+
+	if !strings.HasSuffix(backendURL, "multimodalembeddings") {
+		if len(unifiedReq.Contents) > 0 {
+			return nil, &ParameterError{Parameter: "input", Message: "images are only supported by Voyage multimodal models"}
+		}
+		voyageReq["input"] = unifiedReq.Input
+		if unifiedReq.Dimensions > 0 {
+			voyageReq["output_dimension"] = unifiedReq.Dimensions
+		}
+		// Like OpenAI, the text API can send vectors as base64 float32.
+		if unifiedReq.EncodingFormat == "base64" {
+			voyageReq["encoding_format"] = "base64"
+		}
+		return newJSONRequest(voyageReq, backendURL)
+	}
+	if unifiedReq.Dimensions > 0 {
+		return nil, &ParameterError{Parameter: "dimensions", Message: "is not supported by Voyage multimodal models; set truncate_dimensions on the model"}
+	}
+
+	// The multimodal endpoint takes every input as a list of content parts,
+	// so plain text inputs are wrapped as single text parts.
+	contents := unifiedReq.Contents
+	if len(contents) == 0 {
+		contents = make([][]UnifiedEmbeddingPart, len(unifiedReq.Input))
+		for i, text := range unifiedReq.Input {
+			contents[i] = []UnifiedEmbeddingPart{{Type: "text", Text: text}}
+		}
+	}
+
+	inputs := make([]map[string]interface{}, len(contents))
+	for i, parts := range contents {
+		voyageParts := make([]map[string]string, len(parts))
+		for j, part := range parts {
+			switch {
+			case part.Type == "text":
+				voyageParts[j] = map[string]string{"type": "text", "text": part.Text}
+			case isDataURI(part.ImageURL):
+				voyageParts[j] = map[string]string{"type": "image_base64", "image_base64": part.ImageURL}
+			default:
+				voyageParts[j] = map[string]string{"type": "image_url", "image_url": part.ImageURL}
+			}
+		}
+		inputs[i] = map[string]interface{}{"content": voyageParts}
+	}
+	voyageReq["inputs"] = inputs
+	return newJSONRequest(voyageReq, backendURL)
+}
+
+func (a *VoyageAdapter) BackendEmbeddingToUnified(backendResp *http.Response) (*UnifiedEmbeddingResponse, error) {
+	var voyageResp struct {
+		Data []struct {
+			Index     int             `json:"index"`
+			Embedding json.RawMessage `json:"embedding"` // float array or base64 string
+		} `json:"data"`
+		Model string `json:"model"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+
+	if err := json.NewDecoder(backendResp.Body).Decode(&voyageResp); err != nil {
+		return nil, err
+	}
+
+	embeddings := make([][]float32, len(voyageResp.Data))
+	for _, data := range voyageResp.Data {
+		if data.Index < 0 || data.Index >= len(embeddings) {
+			return nil, fmt.Errorf("embedding index %d out of range", data.Index)
+		}
+		embedding, err := decodeEmbedding(data.Embedding)
+		if err != nil {
+			return nil, err
+		}
+		embeddings[data.Index] = embedding
+	}
+
+	return &UnifiedEmbeddingResponse{
+		Embeddings: embeddings,
+		Model:      voyageResp.Model,
+		Usage:      UnifiedUsage{InputTokens: voyageResp.Usage.TotalTokens},
+	}, nil
+}
+
+func (a *VoyageAdapter) UnifiedEmbeddingToClient(unifiedResp *UnifiedEmbeddingResponse, w http.ResponseWriter) error {
+	return fmt.Errorf("Voyage-format embedding clients are not supported")
+}
@@ -0,0 +1,124 @@
+package adapters
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVoyageAdapter_UnifiedEmbeddingToBackend_Multimodal(t *testing.T) {
+	adapter := &VoyageAdapter{}
+
+	unified := &UnifiedEmbeddingRequest{
+		Model: "voyage-multimodal-3",
+		Contents: [][]UnifiedEmbeddingPart{
+			{
+				{Type: "text", Text: "A cat"},
+				{Type: "image", ImageURL: "data:image/png;base64,iVBORw0KGgo="},
+			},
+			{
+				{Type: "image", ImageURL: "https://example.com/dog.png"},
+			},
+		},
+		InputType: "document",
+	}
+
+	req, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.voyageai.com/v1/multimodalembeddings")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var body struct {
+		Inputs []struct {
+			Content []map[string]string `json:"content"`
+		} `json:"inputs"`
+		InputType string `json:"input_type"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode request body: %v", err)
+	}
+
+	if len(body.Inputs) != 2 {
+		t.Fatalf("Expected 2 inputs, got: %d", len(body.Inputs))
+	}
+
+	if body.Inputs[0].Content[1]["type"] != "image_base64" {
+		t.Errorf("Expected data URI to be sent as image_base64, got: %v", body.Inputs[0].Content[1])
+	}
+
+	if body.Inputs[1].Content[0]["type"] != "image_url" {
+		t.Errorf("Expected remote image to be sent as image_url, got: %v", body.Inputs[1].Content[0])
+	}
+
+	if body.InputType != "document" {
+		t.Errorf("Expected input_type document, got: %s", body.InputType)
+	}
+}
+
+func TestVoyageAdapter_BackendEmbeddingToUnified(t *testing.T) {
+	adapter := &VoyageAdapter{}
+
+	// Results may come back out of order; index decides placement
+	respBody := `{"object": "list", "data": [{"index": 1, "embedding": [0.3]}, {"index": 0, "embedding": [0.1]}], "model": "voyage-multimodal-3"}`
+	resp := &http.Response{
+		StatusCode: 200,
+		Body:       io.NopCloser(strings.NewReader(respBody)),
+	}
+
+	unified, err := adapter.BackendEmbeddingToUnified(resp)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if len(unified.Embeddings) != 2 || unified.Embeddings[0][0] != 0.1 {
+		t.Errorf("Expected embeddings ordered by index, got: %v", unified.Embeddings)
+	}
+
+	// Base64 vectors are decoded
+	respBody = `{"object": "list", "data": [{"index": 0, "embedding": "` + encodeEmbeddingBase64([]float32{0.5, -0.25}) + `"}], "model": "voyage-3-large"}`
+	resp = &http.Response{StatusCode: 200, Body: io.NopCloser(strings.NewReader(respBody))}
+	unified, err = adapter.BackendEmbeddingToUnified(resp)
+	if err != nil || len(unified.Embeddings[0]) != 2 || unified.Embeddings[0][1] != -0.25 {
+		t.Errorf("Expected the base64 vector to be decoded, got: %v %v", unified, err)
+	}
+}
+
+func TestVoyageAdapter_UnifiedEmbeddingToBackend_Text(t *testing.T) {
+	adapter := &VoyageAdapter{}
+	truncate := false
+	unified := &UnifiedEmbeddingRequest{
+		Model:          "voyage-3-large",
+		Input:          []string{"first", "second"},
+		InputType:      "query",
+		Dimensions:     512,
+		Truncate:       &truncate,
+		EncodingFormat: "base64",
+	}
+
+	req, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.voyageai.com/v1/embeddings")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode request body: %v", err)
+	}
+	if input, _ := body["input"].([]interface{}); len(input) != 2 || body["inputs"] != nil {
+		t.Errorf("Expected text inputs in input, got: %v", body)
+	}
+	if body["input_type"] != "query" || body["output_dimension"] != float64(512) || body["truncation"] != false || body["encoding_format"] != "base64" {
+		t.Errorf("Expected input_type, output_dimension, truncation and encoding_format, got: %v", body)
+	}
+
+	// The multimodal API has no output_dimension
+	if _, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.voyageai.com/v1/multimodalembeddings"); err == nil {
+		t.Errorf("Expected dimensions to be refused by the multimodal API")
+	}
+	// And the text API takes no images
+	unified = &UnifiedEmbeddingRequest{Model: "voyage-3-large", Contents: [][]UnifiedEmbeddingPart{{{Type: "image", ImageURL: "https://example.com/dog.png"}}}}
+	if _, err := adapter.UnifiedEmbeddingToBackend(unified, "https://api.voyageai.com/v1/embeddings"); err == nil {
+		t.Errorf("Expected images to be refused by the text API")
+	}
+}
@@ -0,0 +1,108 @@
+package broker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestIDHeader carries the request ID to and from clients. A client's
+// own ID is kept so its logs and the broker's can be joined.
+const requestIDHeader = "X-Request-ID"
+
+// AccessLog is a middleware that assigns every API request an ID, returns
+// it in X-Request-ID, and writes one structured log record per request once
+// the response is done. It should wrap the other broker middlewares.
+func (b *Broker) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey, id))
+
+		info, w, r := withRequestInfo(w, r)
+		next.ServeHTTP(w, r)
+		b.logAccess(r, id, info)
+	})
+}
+
+func (b *Broker) logAccess(r *http.Request, id string, info *requestInfo) {
+	status := info.capture.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("client_ip", b.clientIP(r)),
+		slog.String("dialect", clientDialect(r.URL.Path)),
+		slog.Int("status", status),
+		slog.Int64("latency_ms", time.Since(info.start).Milliseconds()),
+	}
+	if key := info.clientKey(); key != nil {
+		attrs = append(attrs, slog.String("key", key.Name))
+	}
+	if model, workflow := info.target(); model != nil {
+		inputTokens, outputTokens := info.usage()
+		attrs = append(attrs,
+			slog.String("alias", model.Alias),
+			slog.String("provider", model.Type),
+			slog.String("target", model.Target.Model),
+			slog.String("target_url", model.Target.URL),
+			slog.String("workflow", workflow),
+			slog.Int("input_tokens", inputTokens),
+			slog.Int("output_tokens", outputTokens),
+		)
+	}
+	if experiment, arm := info.experimentArm(); arm != "" {
+		attrs = append(attrs, slog.String("experiment", experiment), slog.String("arm", arm))
+	}
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "request completed", attrs...)
+
+	if b.webhooks.wants("request.completed") {
+		data := make(map[string]interface{}, len(attrs))
+		for _, attr := range attrs {
+			data[attr.Key] = attr.Value.Any()
+		}
+		b.Notify("request.completed", data)
+	}
+}
+
+// requestID returns the ID AccessLog assigned to the request, or "".
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// clientDialect returns the wire format a client speaks on an API path.
+func clientDialect(path string) string {
+	switch {
+	case strings.HasPrefix(path, "/v1/messages"):
+		return "anthropic"
+	case path == "/v1/responses":
+		return "openai_responses"
+	case path == "/v2/embed":
+		return "cohere"
+	case path == "/api/embed":
+		return "ollama"
+	default:
+		return "openai"
+	}
+}
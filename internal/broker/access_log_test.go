@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_AccessLog(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 12, "completion_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	var logs bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	broker := New(&config.Config{
+		Keys: []config.KeyConfig{{Name: "team-a", Key: "sk-team-a"}},
+		Models: map[string]config.Model{
+			"logged-gpt": {Alias: "logged-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+		},
+	})
+	handler := broker.AccessLog(broker.Authenticate(http.HandlerFunc(broker.HandleChatCompletions)))
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "logged-gpt", "max_tokens": 10, "messages": [{"role": "user", "content": "Hello"}]}`))
+	req.Header.Set("x-api-key", "sk-team-a")
+	req.Header.Set("X-Request-ID", "client-request-1")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("X-Request-ID"); got != "client-request-1" {
+		t.Errorf("Expected the client's request ID to be echoed, got: %q", got)
+	}
+
+	var record map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["msg"] == "request completed" {
+			record = entry
+		}
+	}
+	if record == nil {
+		t.Fatalf("Expected an access log record, got: %s", logs.String())
+	}
+	for field, want := range map[string]interface{}{
+		"request_id":    "client-request-1",
+		"dialect":       "anthropic",
+		"key":           "team-a",
+		"alias":         "logged-gpt",
+		"target":        "gpt-4",
+		"workflow":      "translation",
+		"status":        float64(200),
+		"input_tokens":  float64(12),
+		"output_tokens": float64(7),
+	} {
+		if record[field] != want {
+			t.Errorf("Expected %s to be %v, got: %v", field, want, record[field])
+		}
+	}
+	if _, ok := record["latency_ms"]; !ok {
+		t.Errorf("Expected latency_ms in the access log record")
+	}
+
+	// Requests without an ID get a generated one.
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "logged-gpt", "messages": []}`))
+	req.Header.Set("Authorization", "Bearer sk-team-a")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if got := rr.Header().Get("X-Request-ID"); len(got) != 32 {
+		t.Errorf("Expected a generated request ID, got: %q", got)
+	}
+}
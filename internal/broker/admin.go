@@ -0,0 +1,26 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin checks a request to an /admin endpoint for the admin key.
+// It returns false after answering 404 when no admin key is configured, or
+// 401 when the request does not carry it.
+func (b *Broker) requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if b.cfg.Server.AdminKey == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	tokenHash := sha256.Sum256([]byte(strings.TrimSpace(token)))
+	adminHash := sha256.Sum256([]byte(b.cfg.Server.AdminKey))
+	if subtle.ConstantTimeCompare(tokenHash[:], adminHash[:]) != 1 {
+		http.Error(w, "invalid admin key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,356 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lmbroker/internal/config"
+)
+
+// redacted replaces secrets in models returned by the admin API.
+const redacted = "[redacted]"
+
+// HandleAdminModels serves /admin/models and /admin/models/{alias}. GET
+// lists every model or shows one, PUT adds or replaces a model, and DELETE
+// removes one. Models are JSON objects with the fields of a [[models]] entry
+// in config.toml; secrets are redacted in responses, and a redacted secret
+// in a PUT keeps the current one. Changes apply immediately, like a reload,
+// and are saved to server.models_file. Without a models file, PUT and
+// DELETE are refused, as the next reload would undo them.
+func (b *Broker) HandleAdminModels(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAdmin(w, r) {
+		return
+	}
+	alias := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/models"), "/")
+
+	b.mu.RLock()
+	modelsFile := b.cfg.Server.ModelsFile
+	b.mu.RUnlock()
+	if (r.Method == http.MethodPut || r.Method == http.MethodDelete) && modelsFile == "" {
+		http.Error(w, "model changes need server.models_file, or the next reload would undo them", http.StatusConflict)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if alias == "" {
+			b.mu.RLock()
+			models := make([]config.Model, 0, len(b.cfg.Models))
+			for _, model := range b.cfg.Models {
+				models = append(models, model)
+			}
+			b.mu.RUnlock()
+			sort.Slice(models, func(i, j int) bool { return models[i].Alias < models[j].Alias })
+
+			tables := make([]map[string]interface{}, 0, len(models))
+			for _, model := range models {
+				table, err := config.ModelTable(redactModel(model))
+				if err != nil {
+					http.Error(w, "failed to encode model", http.StatusInternalServerError)
+					return
+				}
+				tables = append(tables, table)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"models": tables})
+			return
+		}
+		model, ok := b.findModelConfig(alias)
+		if !ok {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		writeModel(w, http.StatusOK, *model)
+
+	case http.MethodPut:
+		if alias == "" {
+			http.Error(w, "PUT needs a model alias in the path", http.StatusBadRequest)
+			return
+		}
+		b.putModel(w, r, alias)
+
+	case http.MethodDelete:
+		if alias == "" {
+			http.Error(w, "DELETE needs a model alias in the path", http.StatusBadRequest)
+			return
+		}
+		if _, ok := b.findModelConfig(alias); !ok {
+			http.Error(w, "model not found", http.StatusNotFound)
+			return
+		}
+		ok := b.updateModels(w, http.StatusConflict, func(models, definitions map[string]config.Model) {
+			delete(models, alias)
+			delete(definitions, alias)
+		}, func(overlay *config.ModelOverlay) {
+			overlay.Remove(alias)
+		})
+		if !ok {
+			return
+		}
+		slog.Info("model removed through admin API", "alias", alias)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// putModel adds or replaces a model from the JSON definition in the request.
+func (b *Broker) putModel(w http.ResponseWriter, r *http.Request, alias string) {
+	// 1. Decode the definition. Numbers stay integers where they can, as
+	// TOML tells them apart from floats.
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	var table map[string]interface{}
+	if err := decoder.Decode(&table); err != nil {
+		http.Error(w, "failed to parse model JSON", http.StatusBadRequest)
+		return
+	}
+	if body, ok := table["alias"]; ok && body != alias {
+		http.Error(w, "alias in the body does not match the path", http.StatusBadRequest)
+		return
+	}
+	table["alias"] = alias
+	normalizeNumbers(table)
+
+	// 2. Validate it as config.toml would. The definition is kept as
+	// submitted for the models file, and prepared separately for serving.
+	submitted, err := config.ModelFromTable(table)
+	if err != nil {
+		http.Error(w, "invalid model: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	model, _ := config.ModelFromTable(table)
+
+	// Redacted secrets keep the current values: the reference as written
+	// for the models file, and the resolved secret for serving.
+	b.mu.RLock()
+	current, existed := b.cfg.Models[alias]
+	definition, defined := b.cfg.Definitions[alias]
+	b.mu.RUnlock()
+	if !defined {
+		definition = current
+	}
+	if err := keepSecrets(&submitted, definition); err != nil {
+		http.Error(w, "invalid model: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	keepSecrets(&model, current)
+	if err := config.PrepareModel(&model); err != nil {
+		http.Error(w, "invalid model: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 3. Switch to it.
+	ok := b.updateModels(w, http.StatusBadRequest, func(models, definitions map[string]config.Model) {
+		models[alias] = model
+		definitions[alias] = submitted
+	}, func(overlay *config.ModelOverlay) {
+		overlay.Set(submitted)
+	})
+	if !ok {
+		return
+	}
+	status := http.StatusCreated
+	if existed {
+		status = http.StatusOK
+	}
+	slog.Info("model saved through admin API", "alias", alias, "created", !existed)
+	writeModel(w, status, model)
+}
+
+// updateModels applies a change to the model set if every reference in the
+// configuration still resolves afterwards, answering invalidStatus if not.
+// The change is saved to the models file first. It reports whether the
+// change was applied.
+func (b *Broker) updateModels(w http.ResponseWriter, invalidStatus int, change func(models, definitions map[string]config.Model), save func(*config.ModelOverlay)) bool {
+	b.adminMu.Lock()
+	defer b.adminMu.Unlock()
+
+	b.mu.RLock()
+	candidate := *b.cfg
+	candidate.Models = maps.Clone(b.cfg.Models)
+	candidate.Definitions = maps.Clone(b.cfg.Definitions)
+	b.mu.RUnlock()
+	if candidate.Definitions == nil {
+		candidate.Definitions = make(map[string]config.Model)
+	}
+	change(candidate.Models, candidate.Definitions)
+	if err := config.CheckReferences(&candidate); err != nil {
+		http.Error(w, err.Error(), invalidStatus)
+		return false
+	}
+
+	path := candidate.Server.ModelsFile
+	overlay, err := config.LoadOverlay(path)
+	if err == nil {
+		save(overlay)
+		err = overlay.Save(path)
+	}
+	if err != nil {
+		slog.Error("failed to save models file", "path", path, "error", err)
+		http.Error(w, "failed to save models file", http.StatusInternalServerError)
+		return false
+	}
+	b.Reload(&candidate)
+	return true
+}
+
+// writeModel answers with a model, its secrets redacted.
+func writeModel(w http.ResponseWriter, status int, model config.Model) {
+	table, err := config.ModelTable(redactModel(model))
+	if err != nil {
+		http.Error(w, "failed to encode model", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(table)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// redactModel returns a copy of a model without API keys and signing
+// secrets.
+func redactModel(model config.Model) config.Model {
+	redactTarget(&model.Target)
+	model.Targets = append([]config.WeightedTarget(nil), model.Targets...)
+	for i := range model.Targets {
+		redactTarget(&model.Targets[i].Target)
+	}
+	if model.Green != nil {
+		green := *model.Green
+		redactTarget(&green.Target)
+		model.Green = &green
+	}
+	if model.Shadow != nil {
+		shadow := *model.Shadow
+		redactTarget(&shadow.Target)
+		model.Shadow = &shadow
+	}
+	if model.Experiment != nil {
+		experiment := *model.Experiment
+		experiment.Arms = append([]config.ExperimentArm(nil), experiment.Arms...)
+		for i, arm := range experiment.Arms {
+			if arm.Target != nil {
+				target := *arm.Target
+				redactTarget(&target)
+				experiment.Arms[i].Target = &target
+			}
+		}
+		model.Experiment = &experiment
+	}
+	return model
+}
+
+// keepSecrets replaces redacted secrets in a submitted model with those of
+// the previous version, matching targets by position and experiment arms by
+// name. It fails if a redacted secret has nothing to keep.
+func keepSecrets(model *config.Model, previous config.Model) error {
+	if err := keepTargetSecrets(&model.Target, &previous.Target); err != nil {
+		return err
+	}
+	for i := range model.Targets {
+		var old *config.TargetConfig
+		if i < len(previous.Targets) {
+			old = &previous.Targets[i].Target
+		}
+		if err := keepTargetSecrets(&model.Targets[i].Target, old); err != nil {
+			return err
+		}
+	}
+	if model.Green != nil {
+		var old *config.TargetConfig
+		if previous.Green != nil {
+			old = &previous.Green.Target
+		}
+		if err := keepTargetSecrets(&model.Green.Target, old); err != nil {
+			return err
+		}
+	}
+	if model.Shadow != nil {
+		var old *config.TargetConfig
+		if previous.Shadow != nil {
+			old = &previous.Shadow.Target
+		}
+		if err := keepTargetSecrets(&model.Shadow.Target, old); err != nil {
+			return err
+		}
+	}
+	if model.Experiment != nil {
+		for _, arm := range model.Experiment.Arms {
+			if arm.Target == nil {
+				continue
+			}
+			var old *config.TargetConfig
+			if previous.Experiment != nil {
+				for _, previousArm := range previous.Experiment.Arms {
+					if previousArm.Name == arm.Name {
+						old = previousArm.Target
+					}
+				}
+			}
+			if err := keepTargetSecrets(arm.Target, old); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func keepTargetSecrets(target, previous *config.TargetConfig) error {
+	if target.APIKey == redacted {
+		if previous == nil || previous.APIKey == "" {
+			return fmt.Errorf("api_key is redacted and there is no current key to keep")
+		}
+		target.APIKey = previous.APIKey
+	}
+	if target.Signing != nil && target.Signing.Secret == redacted {
+		if previous == nil || previous.Signing == nil {
+			return fmt.Errorf("signing secret is redacted and there is no current secret to keep")
+		}
+		target.Signing.Secret = previous.Signing.Secret
+	}
+	return nil
+}
+
+func redactTarget(target *config.TargetConfig) {
+	if target.APIKey != "" {
+		target.APIKey = redacted
+	}
+	if target.Signing != nil {
+		signing := *target.Signing
+		signing.Secret = redacted
+		target.Signing = &signing
+	}
+}
+
+// normalizeNumbers turns the JSON numbers of a decoded object into int64
+// or float64, recursively.
+func normalizeNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeNumbers(item)
+		}
+	}
+	return value
+}
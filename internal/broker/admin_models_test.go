@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_AdminModels(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "sk-anthropic")
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(configPath, []byte(`
+[server]
+  admin_key = "admin-secret"
+  models_file = "models.toml"
+
+[[models]]
+  alias = "gpt-4o"
+  type = "openai"
+  target = { url = "https://api.openai.com/v1/", model = "gpt-4o", api_key = "sk-openai" }
+  shadow = { target = { url = "https://api.openai.com/v1/", model = "gpt-4.1", api_key = "sk-shadow" } }
+
+  [[models.experiment.arms]]
+    name = "control"
+    percent = 50
+
+  [[models.experiment.arms]]
+    name = "mini"
+    percent = 50
+    target = { url = "https://api.openai.com/v1/", model = "gpt-4o-mini", api_key = "sk-arm" }
+`), 0o644)
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	broker := New(cfg)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		rr := httptest.NewRecorder()
+		broker.HandleAdminModels(rr, req)
+		return rr
+	}
+
+	// Models are listed with their secrets redacted
+	rr := send("GET", "/admin/models", "")
+	var list struct {
+		Models []map[string]interface{} `json:"models"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if rr.Code != http.StatusOK || len(list.Models) != 1 || list.Models[0]["alias"] != "gpt-4o" {
+		t.Fatalf("Expected the configured model, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if strings.Contains(rr.Body.String(), "sk-openai") || strings.Contains(rr.Body.String(), "sk-shadow") || strings.Contains(rr.Body.String(), "sk-arm") {
+		t.Errorf("Expected the API key to be redacted, got: %s", rr.Body.String())
+	}
+
+	// A new model is served right away and saved as submitted
+	rr = send("PUT", "/admin/models/claude", `{"type": "anthropic", "fallbacks": ["gpt-4o"], "target": {"url": "https://api.anthropic.com/v1/", "model": "claude-3-haiku-20240307", "api_key": "env:ANTHROPIC_API_KEY", "max_in_flight": 4}}`)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if model, ok := broker.findModelConfig("claude"); !ok || model.Target.MaxInFlight != 4 || model.Target.Client == nil {
+		t.Errorf("Expected the new model to be prepared and served, got: %+v", model)
+	}
+	saved, _ := os.ReadFile(filepath.Join(dir, "models.toml"))
+	if !strings.Contains(string(saved), `api_key = "env:ANTHROPIC_API_KEY"`) {
+		t.Errorf("Expected the models file to keep the key reference, got: %s", saved)
+	}
+
+	// A model read back and sent again keeps its secrets
+	for _, alias := range []string{"gpt-4o", "claude"} {
+		rr = send("GET", "/admin/models/"+alias, "")
+		if rr := send("PUT", "/admin/models/"+alias, rr.Body.String()); rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 when saving %s unchanged, got: %d %s", alias, rr.Code, rr.Body.String())
+		}
+	}
+	if model, _ := broker.findModelConfig("gpt-4o"); model.Target.APIKey != "sk-openai" || model.Shadow.Target.APIKey != "sk-shadow" || model.Experiment.Arms[1].Target.APIKey != "sk-arm" {
+		t.Errorf("Expected the redacted keys to be kept, got: %+v", model)
+	}
+	if model, _ := broker.findModelConfig("claude"); model.Target.APIKey != "sk-anthropic" {
+		t.Errorf("Expected the redacted key to be kept, got: %q", model.Target.APIKey)
+	}
+	saved, _ = os.ReadFile(filepath.Join(dir, "models.toml"))
+	if !strings.Contains(string(saved), `api_key = "env:ANTHROPIC_API_KEY"`) || strings.Contains(string(saved), "sk-anthropic") || strings.Contains(string(saved), "[redacted]") {
+		t.Errorf("Expected the models file to keep the key reference, got: %s", saved)
+	}
+	if rr := send("PUT", "/admin/models/new", `{"type": "openai", "target": {"url": "http://x/", "api_key": "[redacted]"}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a redacted key with nothing to keep, got: %d", rr.Code)
+	}
+
+	// Invalid definitions and dangling references are refused
+	if rr := send("PUT", "/admin/models/bad", `{"type": "openai", "target": {"url": "http://x/"}, "strategy": "fastest"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown strategy, got: %d", rr.Code)
+	}
+	if rr := send("PUT", "/admin/models/bad", `{"type": "openai", "target": {"url": "http://x/", "modle": "typo"}}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown field, got: %d", rr.Code)
+	}
+	if rr := send("DELETE", "/admin/models/gpt-4o", ""); rr.Code != http.StatusConflict {
+		t.Errorf("Expected 409 when removing a fallback target in use, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Removing both models leaves the broker empty, and the change survives
+	// a reload of the configuration
+	if rr := send("DELETE", "/admin/models/claude", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got: %d", rr.Code)
+	}
+	if rr := send("DELETE", "/admin/models/gpt-4o", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got: %d", rr.Code)
+	}
+	if rr := send("GET", "/admin/models/gpt-4o", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a removed model, got: %d", rr.Code)
+	}
+	reloaded, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to reload config: %v", err)
+	}
+	if len(reloaded.Models) != 0 {
+		t.Errorf("Expected the removals to persist, got: %v", reloaded.Models)
+	}
+
+	// The admin key is required
+	req := httptest.NewRequest("GET", "/admin/models", nil)
+	rr = httptest.NewRecorder()
+	broker.HandleAdminModels(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without the admin key, got: %d", rr.Code)
+	}
+}
+
+func TestBroker_AdminModelsNeedModelsFile(t *testing.T) {
+	broker := New(&config.Config{
+		Server: config.ServerConfig{AdminKey: "admin-secret"},
+		Models: map[string]config.Model{"gpt-4o": {Alias: "gpt-4o", Type: "openai"}},
+	})
+	for _, method := range []string{"PUT", "DELETE"} {
+		req := httptest.NewRequest(method, "/admin/models/gpt-4o", strings.NewReader(`{"type": "openai", "target": {"url": "http://x/"}}`))
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		rr := httptest.NewRecorder()
+		broker.HandleAdminModels(rr, req)
+		if rr.Code != http.StatusConflict || !strings.Contains(rr.Body.String(), "models_file") {
+			t.Errorf("%s: expected 409 without a models file, got: %d %s", method, rr.Code, rr.Body.String())
+		}
+	}
+	if _, ok := broker.findModelConfig("gpt-4o"); !ok {
+		t.Error("Expected the model to be left in place")
+	}
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// HandleAudio is the handler for the OpenAI audio endpoints:
+// /v1/audio/transcriptions (multipart upload) and /v1/audio/speech (JSON in,
+// binary audio out). Requests are passed through with the model rewritten.
+func (b *Broker) HandleAudio(w http.ResponseWriter, r *http.Request) {
+	r = b.watchRateLimits(r)
+	// 1. Identify the operation from the request path.
+	var operation string
+	switch r.URL.Path {
+	case "/v1/audio/transcriptions":
+		operation = "audio/transcriptions"
+	case "/v1/audio/speech":
+		operation = "audio/speech"
+	default:
+		workflows.WriteError(w, r, http.StatusNotFound, "unsupported endpoint")
+		return
+	}
+
+	// 2. Extract model name from the JSON or multipart body
+	modelName, err := b.extractModelFromRequest(r)
+	if err != nil {
+		slog.Error("failed to extract model from request", "error", err)
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+
+	// 3. Find model configuration for this alias, or the default model
+	modelConfig, ok := b.resolveModel(r, modelName)
+	if !ok {
+		slog.Error("no model configuration found", "alias", modelName)
+		workflows.WriteError(w, r, http.StatusNotFound, "audio model not supported")
+		return
+	}
+
+	// 3.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 4. Serve from the target picked by weight or blue/green rollout.
+	b.serveModel(w, r, modelConfig, func(w http.ResponseWriter, modelConfig *config.Model) {
+		noteServedTarget(r, modelConfig)
+		b.dispatchAudio(w, r, operation, modelConfig)
+	})
+}
+
+// dispatchAudio passes an audio request through to OpenAI-compatible targets.
+// Other providers have no common audio API to translate to.
+func (b *Broker) dispatchAudio(w http.ResponseWriter, r *http.Request, operation string, modelConfig *config.Model) {
+	if dialectOf(modelConfig.Type) != "openai" {
+		workflows.WriteError(w, r, http.StatusBadRequest, "audio is not supported for provider type "+modelConfig.Type)
+		return
+	}
+
+	providerURL := providerEndpoint(modelConfig, operation)
+	noteWorkflow(r, "passthrough")
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		workflows.HandleMultipartPassthrough(w, r, providerURL, modelConfig)
+		return
+	}
+	workflows.HandlePassthrough(w, r, providerURL, modelConfig)
+}
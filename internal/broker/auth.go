@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// Authenticate is a middleware that requires a valid client key on every
+// API request once keys are configured. Keys are accepted as a bearer token
+// or in x-api-key, as the Anthropic SDKs send them, and are removed before
+// the request is forwarded so they never reach a backend. Health and
+// metrics endpoints stay open.
+func (b *Broker) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.RLock()
+		keys := b.cfg.Keys
+		b.mu.RUnlock()
+		if len(keys) == 0 || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get("x-api-key")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			token = strings.TrimSpace(bearer)
+		}
+		if token == "" {
+			writeAuthError(w, r, "missing API key: send it as a bearer token or in x-api-key")
+			return
+		}
+		key, ok := matchKey(keys, token)
+		if !ok {
+			slog.Warn("rejected request with invalid API key", "client_ip", b.clientIP(r), "path", r.URL.Path)
+			writeAuthError(w, r, "invalid API key")
+			return
+		}
+
+		r.Header.Del("Authorization")
+		r.Header.Del("x-api-key")
+		noteClientKey(r, key)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKeyKey, key)))
+	})
+}
+
+// matchKey finds the configured key with the given secret. Secrets are
+// compared by hash in constant time so response timing reveals nothing
+// about them.
+func matchKey(keys []config.KeyConfig, token string) (*config.KeyConfig, bool) {
+	tokenHash := sha256.Sum256([]byte(token))
+	var found *config.KeyConfig
+	for i := range keys {
+		keyHash := sha256.Sum256([]byte(keys[i].Key))
+		if subtle.ConstantTimeCompare(tokenHash[:], keyHash[:]) == 1 {
+			found = &keys[i]
+		}
+	}
+	return found, found != nil
+}
+
+// clientKey returns the key that authenticated the request, if any.
+func clientKey(r *http.Request) (*config.KeyConfig, bool) {
+	key, ok := r.Context().Value(clientKeyKey).(*config.KeyConfig)
+	return key, ok
+}
+
+// authorizeModel checks the model against the client key's allowlist. It
+// returns false after answering 403 when the key may not use the model.
+// Keys without an allowlist, and unauthenticated requests, may use any model.
+func (b *Broker) authorizeModel(w http.ResponseWriter, r *http.Request, modelConfig *config.Model) bool {
+	key, ok := clientKey(r)
+	if !ok || key.Allows(modelConfig.Alias) {
+		return true
+	}
+	slog.Warn("rejected request for model outside the key's allowlist", "key", key.Name, "alias", modelConfig.Alias)
+	writeKeyError(w, r, http.StatusForbidden, "model_not_allowed", "this API key may not use model "+modelConfig.Alias)
+	return false
+}
+
+// writeAuthError answers 401 with the error envelope of the client's SDK.
+func writeAuthError(w http.ResponseWriter, r *http.Request, message string) {
+	writeKeyError(w, r, http.StatusUnauthorized, "invalid_api_key", message)
+}
+
+// writeKeyError reports a rejected key (401), a model the key may not use
+// (403), an exhausted limit (429) or a broker at capacity (503) with the
+// error envelope of the client's SDK. code is the OpenAI error code.
+func writeKeyError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	workflows.WriteErrorCode(w, r, status, code, "", message)
+}
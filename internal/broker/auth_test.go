@@ -0,0 +1,119 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Authenticate(t *testing.T) {
+	var forwarded http.Header
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	})
+	broker := New(&config.Config{Keys: []config.KeyConfig{{Name: "team-a", Key: "lmb-secret"}}})
+	handler := broker.Authenticate(next)
+
+	// A valid bearer token is accepted and not forwarded
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer lmb-secret")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got: %d", rr.Code)
+	}
+	if forwarded.Get("Authorization") != "" {
+		t.Errorf("Expected the client key to be stripped, got: %s", forwarded.Get("Authorization"))
+	}
+
+	// So is x-api-key, as sent by Anthropic SDKs
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{}`))
+	req.Header.Set("x-api-key", "lmb-secret")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || forwarded.Get("x-api-key") != "" {
+		t.Errorf("Expected x-api-key to be accepted and stripped, got: %d %v", rr.Code, forwarded)
+	}
+
+	// Invalid keys get a 401 in the client's dialect
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer wrong")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `"code":"invalid_api_key"`) {
+		t.Errorf("Expected an OpenAI-style 401, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{}`))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || !strings.Contains(rr.Body.String(), `"type":"authentication_error"`) {
+		t.Errorf("Expected an Anthropic-style 401, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Health checks stay open
+	req = httptest.NewRequest("GET", "/health", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected /health to need no key, got: %d", rr.Code)
+	}
+}
+
+func TestBroker_KeyModelScopes(t *testing.T) {
+	var gotModel string
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		gotModel, _ = body["model"].(string)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4":      {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+			"cheap-mini": {Alias: "cheap-mini", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o-mini"}},
+		},
+		Keys: []config.KeyConfig{{
+			Name:   "interns",
+			Key:    "lmb-interns",
+			Models: []string{"cheap-*"},
+			Routes: map[string]string{"gpt-4": "cheap-mini"},
+		}},
+	})
+	handler := broker.Authenticate(http.HandlerFunc(broker.HandleChatCompletions))
+	send := func(path, model string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"model": "`+model+`", "max_tokens": 10, "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Authorization", "Bearer lmb-interns")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The key's route sends gpt-4 to the cheap model
+	rr := send("/v1/chat/completions", "gpt-4")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if gotModel != "gpt-4o-mini" {
+		t.Errorf("Expected the routed target model gpt-4o-mini, got: %s", gotModel)
+	}
+
+	// Models outside the allowlist are forbidden
+	broker.cfg.Keys[0].Routes = nil
+	rr = send("/v1/chat/completions", "gpt-4")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "model_not_allowed") {
+		t.Errorf("Expected an OpenAI-style 403, got: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = send("/v1/messages", "gpt-4")
+	if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), "permission_error") {
+		t.Errorf("Expected an Anthropic-style 403, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
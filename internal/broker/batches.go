@@ -0,0 +1,825 @@
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+var batchRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_batch_requests_total",
+	Help: "Requests of emulated batches, by result.",
+}, []string{"result"})
+
+// maxBatchLines is the most requests one batch may hold, as on OpenAI.
+const maxBatchLines = 50000
+
+// batchLineAttempts is how many times a batch request turned away with 429
+// or 503 is sent before it counts as failed.
+const batchLineAttempts = 10
+
+// batchCounts tallies the requests of a batch.
+type batchCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+}
+
+// batchError is a problem found in a batch's input file.
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Line    *int   `json:"line"`
+}
+
+type batchErrors struct {
+	Object string       `json:"object"`
+	Data   []batchError `json:"data"`
+}
+
+// batchObject is a batch as the OpenAI Batch API describes it.
+type batchObject struct {
+	ID               string            `json:"id"`
+	Object           string            `json:"object"`
+	Endpoint         string            `json:"endpoint"`
+	Errors           *batchErrors      `json:"errors"`
+	InputFileID      string            `json:"input_file_id"`
+	CompletionWindow string            `json:"completion_window"`
+	Status           string            `json:"status"`
+	OutputFileID     *string           `json:"output_file_id"`
+	ErrorFileID      *string           `json:"error_file_id"`
+	CreatedAt        int64             `json:"created_at"`
+	InProgressAt     *int64            `json:"in_progress_at"`
+	ExpiresAt        *int64            `json:"expires_at"`
+	FinalizingAt     *int64            `json:"finalizing_at"`
+	CompletedAt      *int64            `json:"completed_at"`
+	FailedAt         *int64            `json:"failed_at"`
+	ExpiredAt        *int64            `json:"expired_at"`
+	CancellingAt     *int64            `json:"cancelling_at"`
+	CancelledAt      *int64            `json:"cancelled_at"`
+	RequestCounts    batchCounts       `json:"request_counts"`
+	Metadata         map[string]string `json:"metadata"`
+}
+
+// finished reports whether the batch has reached a final status.
+func (o *batchObject) finished() bool {
+	switch o.Status {
+	case "completed", "failed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+// fail marks the batch failed with one error.
+func (o *batchObject) fail(code, message string, now time.Time) {
+	o.Status = "failed"
+	o.FailedAt = unixTime(now)
+	o.Errors = &batchErrors{Object: "list", Data: []batchError{{Code: code, Message: message}}}
+}
+
+// copyRemote takes the progress of a batch run natively from the target's
+// copy, keeping the broker's own IDs.
+func (o *batchObject) copyRemote(remote batchObject) {
+	local := *o
+	*o = remote
+	o.ID, o.Object, o.InputFileID, o.Metadata = local.ID, local.Object, local.InputFileID, local.Metadata
+	o.OutputFileID, o.ErrorFileID = local.OutputFileID, local.ErrorFileID
+}
+
+func unixTime(t time.Time) *int64 {
+	seconds := t.Unix()
+	return &seconds
+}
+
+// storedBatch is a batch and the client key it belongs to. Batches run
+// natively name the model whose target runs them and the target's batch.
+type storedBatch struct {
+	Key      string      `json:"key,omitempty"`
+	Batch    batchObject `json:"batch"`
+	Alias    string      `json:"alias,omitempty"`
+	RemoteID string      `json:"remote_id,omitempty"`
+}
+
+// putBatch stores a new batch.
+func (s *batchStore) putBatch(stored storedBatch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches[stored.Batch.ID] = &stored
+	s.appendLocked(batchIndexEntry{Batch: &stored})
+}
+
+// batch returns a client key's batch.
+func (s *batchStore) batch(key, id string) (storedBatch, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.batches[id]
+	if !ok || stored.Key != key {
+		return storedBatch{}, false
+	}
+	return *stored, true
+}
+
+// updateBatch changes a batch and stores its new state.
+func (s *batchStore) updateBatch(id string, update func(*storedBatch)) storedBatch {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := s.batches[id]
+	update(stored)
+	s.appendLocked(batchIndexEntry{Batch: stored})
+	return *stored
+}
+
+// listBatches returns a client key's batches, newest first.
+func (s *batchStore) listBatches(key string) []batchObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batches := []batchObject{}
+	for _, stored := range s.batches {
+		if stored.Key == key {
+			batches = append(batches, stored.Batch)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		if batches[i].CreatedAt != batches[j].CreatedAt {
+			return batches[i].CreatedAt > batches[j].CreatedAt
+		}
+		return batches[i].ID > batches[j].ID
+	})
+	return batches
+}
+
+// batchLine is one request of a batch's input file.
+type batchLine struct {
+	CustomID string          `json:"custom_id"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+	model    string
+}
+
+// parseBatchLines reads a batch input file, one request per line, and
+// reports every line that cannot be run.
+func parseBatchLines(content []byte, endpoint string) ([]batchLine, []batchError) {
+	var lines []batchLine
+	var errors []batchError
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		lineError := func(code, message string) {
+			line := number
+			errors = append(errors, batchError{Code: code, Message: message, Line: &line})
+		}
+		var line batchLine
+		if err := json.Unmarshal(text, &line); err != nil {
+			lineError("invalid_json_line", "the line is not a JSON object")
+			continue
+		}
+		var body struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		switch {
+		case line.CustomID == "":
+			lineError("missing_required_parameter", "custom_id is required")
+		case seen[line.CustomID]:
+			lineError("duplicate_custom_id", "custom_id "+line.CustomID+" is used more than once")
+		case line.Method != http.MethodPost:
+			lineError("invalid_method", "method must be POST")
+		case line.URL != endpoint:
+			lineError("mismatched_endpoint", "url must be the batch's endpoint "+endpoint)
+		case json.Unmarshal(line.Body, &body) != nil || body.Model == "":
+			lineError("missing_required_parameter", "body must be a request with a model")
+		case body.Stream:
+			lineError("invalid_request", "stream is not supported in batches")
+		default:
+			seen[line.CustomID] = true
+			line.model = body.Model
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		errors = append(errors, batchError{Code: "invalid_file", Message: err.Error()})
+	}
+	if len(lines)+len(errors) == 0 {
+		errors = append(errors, batchError{Code: "empty_file", Message: "the input file has no requests"})
+	}
+	if len(lines) > maxBatchLines {
+		errors = append(errors, batchError{Code: "too_many_requests", Message: fmt.Sprintf("a batch holds at most %d requests", maxBatchLines)})
+	}
+	return lines, errors
+}
+
+// batchHandler returns the handler that serves an endpoint's requests.
+func (b *Broker) batchHandler(endpoint string) (http.HandlerFunc, bool) {
+	switch endpoint {
+	case "/v1/chat/completions", "/v1/responses":
+		return b.HandleChatCompletions, true
+	case "/v1/embeddings":
+		return b.HandleEmbeddings, true
+	case "/v1/completions":
+		return b.HandleCompletions, true
+	}
+	return nil, false
+}
+
+// isBatchRequest reports whether a request is one of an emulated batch.
+func isBatchRequest(r *http.Request) bool {
+	batch, _ := r.Context().Value(batchRequestKey).(bool)
+	return batch
+}
+
+// HandleBatches serves the OpenAI Batch API on /v1/batches: creating a
+// batch from an uploaded input file, listing, retrieval and cancellation.
+// A batch whose requests are all for one model with an openai target runs
+// on that target's own Batch API, which the broker polls when the batch is
+// retrieved. Any other batch is emulated: its requests are served in the
+// background like regular ones, at low priority under concurrency limits,
+// and their answers collected into an output file and an error file.
+func (b *Broker) HandleBatches(w http.ResponseWriter, r *http.Request) {
+	owner := batchOwner(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/batches"), "/")
+	id, suffix, _ := strings.Cut(rest, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		b.createBatch(w, r, owner)
+
+	case id == "" && r.Method == http.MethodGet:
+		batches := b.batches.listBatches(owner)
+		if after := r.URL.Query().Get("after"); after != "" {
+			for i, batch := range batches {
+				if batch.ID == after {
+					batches = batches[i+1:]
+					break
+				}
+			}
+		}
+		limit := 20
+		if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 100 {
+			limit = n
+		}
+		hasMore := len(batches) > limit
+		batches = batches[:min(limit, len(batches))]
+		resp := map[string]interface{}{"object": "list", "data": batches, "has_more": hasMore}
+		if len(batches) > 0 {
+			resp["first_id"], resp["last_id"] = batches[0].ID, batches[len(batches)-1].ID
+		}
+		writeJSON(w, http.StatusOK, resp)
+
+	case id != "" && suffix == "" && r.Method == http.MethodGet:
+		stored, ok := b.batches.batch(owner, id)
+		if !ok {
+			workflows.WriteError(w, r, http.StatusNotFound, "no such batch: "+id)
+			return
+		}
+		if stored.RemoteID != "" && !stored.Batch.finished() {
+			if refreshed, err := b.refreshNativeBatch(r.Context(), stored); err != nil {
+				slog.Warn("failed to refresh batch", "batch", id, "alias", stored.Alias, "error", err)
+			} else {
+				stored = refreshed
+			}
+		}
+		writeJSON(w, http.StatusOK, stored.Batch)
+
+	case id != "" && suffix == "cancel" && r.Method == http.MethodPost:
+		stored, ok := b.batches.batch(owner, id)
+		if !ok {
+			workflows.WriteError(w, r, http.StatusNotFound, "no such batch: "+id)
+			return
+		}
+		if stored.Batch.finished() {
+			workflows.WriteError(w, r, http.StatusConflict, "batch "+id+" is already "+stored.Batch.Status)
+			return
+		}
+		if stored.RemoteID != "" {
+			cancelled, err := b.cancelNativeBatch(r.Context(), stored)
+			if err != nil {
+				slog.Error("failed to cancel batch", "batch", id, "alias", stored.Alias, "error", err)
+				workflows.WriteError(w, r, http.StatusBadGateway, "failed to cancel batch: "+err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, cancelled.Batch)
+			return
+		}
+		stored = b.batches.updateBatch(id, func(stored *storedBatch) {
+			if !stored.Batch.finished() {
+				stored.Batch.Status = "cancelling"
+				stored.Batch.CancellingAt = unixTime(time.Now())
+			}
+		})
+		b.batches.cancelRun(id)
+		writeJSON(w, http.StatusOK, stored.Batch)
+
+	default:
+		workflows.WriteError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// createBatch checks a new batch's input file and starts it, natively or
+// emulated.
+func (b *Broker) createBatch(w http.ResponseWriter, r *http.Request, owner string) {
+	var req struct {
+		InputFileID      string            `json:"input_file_id"`
+		Endpoint         string            `json:"endpoint"`
+		CompletionWindow string            `json:"completion_window"`
+		Metadata         map[string]string `json:"metadata"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+	if _, ok := b.batchHandler(req.Endpoint); !ok {
+		workflows.WriteError(w, r, http.StatusBadRequest, "unsupported endpoint "+req.Endpoint+"; use /v1/chat/completions, /v1/responses, /v1/embeddings or /v1/completions")
+		return
+	}
+	if req.CompletionWindow == "" {
+		req.CompletionWindow = "24h"
+	}
+	window, err := time.ParseDuration(req.CompletionWindow)
+	if err != nil || window <= 0 {
+		workflows.WriteError(w, r, http.StatusBadRequest, "invalid completion_window "+req.CompletionWindow)
+		return
+	}
+	content, ok := b.batches.content(owner, req.InputFileID)
+	if !ok {
+		workflows.WriteError(w, r, http.StatusNotFound, "no such file: "+req.InputFileID)
+		return
+	}
+
+	now := time.Now()
+	stored := storedBatch{Key: owner, Batch: batchObject{
+		ID:               "batch_" + newRequestID()[:24],
+		Object:           "batch",
+		Endpoint:         req.Endpoint,
+		InputFileID:      req.InputFileID,
+		CompletionWindow: req.CompletionWindow,
+		Status:           "validating",
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        unixTime(now.Add(window)),
+		Metadata:         req.Metadata,
+	}}
+	lines, errors := parseBatchLines(content, req.Endpoint)
+	if len(errors) > 0 {
+		stored.Batch.Status = "failed"
+		stored.Batch.FailedAt = unixTime(now)
+		stored.Batch.Errors = &batchErrors{Object: "list", Data: errors}
+		b.batches.putBatch(stored)
+		writeJSON(w, http.StatusOK, stored.Batch)
+		return
+	}
+	stored.Batch.RequestCounts.Total = len(lines)
+
+	// Batches for one model whose target has a Batch API of its own run
+	// there. OpenAI-compatible servers without one get emulated batches,
+	// unless the target asks for native ones.
+	key, _ := clientKey(r)
+	if modelConfig, ok := b.nativeBatchModel(key, lines); ok {
+		err := b.startNativeBatch(r.Context(), &stored, modelConfig, lines)
+		if err == nil {
+			b.batches.putBatch(stored)
+			slog.Info("batch started on target", "batch", stored.Batch.ID, "alias", modelConfig.Alias, "remote_id", stored.RemoteID, "requests", len(lines))
+			writeJSON(w, http.StatusOK, stored.Batch)
+			return
+		}
+		if modelConfig.Target.Batch == "native" || !batchAPIMissing(err) {
+			slog.Error("failed to start batch on target", "alias", modelConfig.Alias, "error", err)
+			workflows.WriteError(w, r, http.StatusBadGateway, "failed to start batch on backend: "+err.Error())
+			return
+		}
+		slog.Warn("target has no Batch API, emulating batch", "alias", modelConfig.Alias, "error", err)
+	}
+
+	stored.Batch.Status = "in_progress"
+	stored.Batch.InProgressAt = unixTime(now)
+	b.batches.putBatch(stored)
+	slog.Info("batch started", "batch", stored.Batch.ID, "endpoint", req.Endpoint, "requests", len(lines))
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(window))
+	b.batches.startRun(stored.Batch.ID, cancel)
+	go b.runBatch(ctx, stored, key, lines)
+	writeJSON(w, http.StatusOK, stored.Batch)
+}
+
+// nativeBatchModel returns the model that serves every request of a batch,
+// if there is one and its target runs batches natively. Batches of keys
+// with token limits or budgets are always emulated, so their requests are
+// accounted for like the key's own.
+func (b *Broker) nativeBatchModel(key *config.KeyConfig, lines []batchLine) (*config.Model, bool) {
+	if key != nil && (key.TPM > 0 || key.DailyBudget > 0 || key.MonthlyBudget > 0) {
+		return nil, false
+	}
+	var modelConfig *config.Model
+	for _, line := range lines {
+		lineModel, ok := b.lookupModel(key, line.model)
+		if !ok || (modelConfig != nil && lineModel.Alias != modelConfig.Alias) {
+			return nil, false
+		}
+		modelConfig = lineModel
+	}
+	if modelConfig.Type != "openai" || modelConfig.Target.Batch == "emulate" {
+		return nil, false
+	}
+	if key != nil && !key.Allows(modelConfig.Alias) {
+		return nil, false
+	}
+	return modelConfig, true
+}
+
+// --- Native batches ---
+
+// startNativeBatch uploads a batch's requests, with the target's model
+// name, to the target and creates the batch there.
+func (b *Broker) startNativeBatch(ctx context.Context, stored *storedBatch, modelConfig *config.Model, lines []batchLine) error {
+	var input bytes.Buffer
+	for _, line := range lines {
+		var body map[string]interface{}
+		json.Unmarshal(line.Body, &body)
+		body["model"] = modelConfig.Target.Model
+		encoded, err := json.Marshal(map[string]interface{}{"custom_id": line.CustomID, "method": line.Method, "url": line.URL, "body": body})
+		if err != nil {
+			return err
+		}
+		input.Write(append(encoded, '\n'))
+	}
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("purpose", "batch")
+	part, _ := writer.CreateFormFile("file", stored.Batch.ID+".jsonl")
+	part.Write(input.Bytes())
+	writer.Close()
+	upload, err := http.NewRequestWithContext(ctx, http.MethodPost, providerEndpoint(modelConfig, "files"), &form)
+	if err != nil {
+		return err
+	}
+	upload.Header.Set("Content-Type", writer.FormDataContentType())
+	var file fileObject
+	if err := sendBatchRequest(upload, modelConfig, &file); err != nil {
+		return fmt.Errorf("uploading input file: %w", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"input_file_id":     file.ID,
+		"endpoint":          stored.Batch.Endpoint,
+		"completion_window": stored.Batch.CompletionWindow,
+		"metadata":          stored.Batch.Metadata,
+	})
+	create, err := http.NewRequestWithContext(ctx, http.MethodPost, providerEndpoint(modelConfig, "batches"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	create.Header.Set("Content-Type", "application/json")
+	var remote batchObject
+	if err := sendBatchRequest(create, modelConfig, &remote); err != nil {
+		return fmt.Errorf("creating batch: %w", err)
+	}
+	stored.Alias = modelConfig.Alias
+	stored.RemoteID = remote.ID
+	stored.Batch.copyRemote(remote)
+	return nil
+}
+
+// refreshNativeBatch fetches a batch's progress from its target. Once the
+// target has written result files, they are copied to the broker.
+func (b *Broker) refreshNativeBatch(ctx context.Context, stored storedBatch) (storedBatch, error) {
+	modelConfig, ok := b.findModelConfig(stored.Alias)
+	if !ok {
+		return stored, fmt.Errorf("model %s is no longer configured", stored.Alias)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, providerEndpoint(modelConfig, "batches/"+stored.RemoteID), nil)
+	if err != nil {
+		return stored, err
+	}
+	var remote batchObject
+	if err := sendBatchRequest(req, modelConfig, &remote); err != nil {
+		return stored, err
+	}
+	return b.applyRemoteBatch(ctx, stored, modelConfig, remote)
+}
+
+// cancelNativeBatch cancels a batch on its target.
+func (b *Broker) cancelNativeBatch(ctx context.Context, stored storedBatch) (storedBatch, error) {
+	modelConfig, ok := b.findModelConfig(stored.Alias)
+	if !ok {
+		return stored, fmt.Errorf("model %s is no longer configured", stored.Alias)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, providerEndpoint(modelConfig, "batches/"+stored.RemoteID+"/cancel"), nil)
+	if err != nil {
+		return stored, err
+	}
+	var remote batchObject
+	if err := sendBatchRequest(req, modelConfig, &remote); err != nil {
+		return stored, err
+	}
+	return b.applyRemoteBatch(ctx, stored, modelConfig, remote)
+}
+
+// applyRemoteBatch stores the target's state of a batch, copying result
+// files the broker does not have yet.
+func (b *Broker) applyRemoteBatch(ctx context.Context, stored storedBatch, modelConfig *config.Model, remote batchObject) (storedBatch, error) {
+	outputID, errorID := stored.Batch.OutputFileID, stored.Batch.ErrorFileID
+	for _, result := range []struct {
+		remote *string
+		local  **string
+		name   string
+	}{{remote.OutputFileID, &outputID, "output"}, {remote.ErrorFileID, &errorID, "errors"}} {
+		if result.remote == nil || *result.remote == "" || *result.local != nil {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, providerEndpoint(modelConfig, "files/"+*result.remote+"/content"), nil)
+		if err != nil {
+			return stored, err
+		}
+		content, err := readBatchResponse(req, modelConfig)
+		if err != nil {
+			return stored, fmt.Errorf("downloading %s file: %w", result.name, err)
+		}
+		file, err := b.batches.putFile(stored.Key, stored.Batch.ID+"_"+result.name+".jsonl", "batch_output", content)
+		if err != nil {
+			return stored, err
+		}
+		*result.local = &file.ID
+	}
+	return b.batches.updateBatch(stored.Batch.ID, func(stored *storedBatch) {
+		stored.Batch.copyRemote(remote)
+		stored.Batch.OutputFileID, stored.Batch.ErrorFileID = outputID, errorID
+	}), nil
+}
+
+// sendBatchRequest sends a Batch API request to a target and decodes its
+// JSON answer.
+func sendBatchRequest(req *http.Request, modelConfig *config.Model, v interface{}) error {
+	body, err := readBatchResponse(req, modelConfig)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// readBatchResponse sends a Batch API request to a target and returns the
+// body of a successful answer.
+func readBatchResponse(req *http.Request, modelConfig *config.Model) ([]byte, error) {
+	resp, err := workflows.Send(req, modelConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &batchStatusError{status: resp.StatusCode, body: bytes.TrimSpace(body)}
+	}
+	return body, nil
+}
+
+// batchStatusError is a target's error answer to a Batch API request.
+type batchStatusError struct {
+	status int
+	body   []byte
+}
+
+func (e *batchStatusError) Error() string {
+	return fmt.Sprintf("backend returned status %d: %s", e.status, e.body)
+}
+
+// batchAPIMissing reports whether a target answered a Batch API request as
+// a server without the Files or Batch API does.
+func batchAPIMissing(err error) bool {
+	var statusErr *batchStatusError
+	return errors.As(err, &statusErr) && (statusErr.status == http.StatusNotFound || statusErr.status == http.StatusMethodNotAllowed)
+}
+
+// --- Emulated batches ---
+
+// startRun records how to stop a running emulated batch.
+func (s *batchStore) startRun(id string, cancel context.CancelFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == nil {
+		s.running = make(map[string]context.CancelFunc)
+	}
+	s.running[id] = cancel
+}
+
+// cancelRun stops a running emulated batch.
+func (s *batchStore) cancelRun(id string) {
+	s.mu.Lock()
+	cancel, ok := s.running[id]
+	delete(s.running, id)
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+}
+
+// batchResult is one line of a batch's output or error file.
+type batchResult struct {
+	ID       string               `json:"id"`
+	CustomID string               `json:"custom_id"`
+	Response *batchResultResponse `json:"response"`
+	Error    *batchError          `json:"error"`
+}
+
+type batchResultResponse struct {
+	StatusCode int             `json:"status_code"`
+	RequestID  string          `json:"request_id"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// runBatch serves the requests of an emulated batch until all are done, the
+// batch is cancelled or its completion window ends, then writes the output
+// file with the successful answers and the error file with the rest.
+// Requests not sent by then are reported in the error file.
+func (b *Broker) runBatch(ctx context.Context, stored storedBatch, key *config.KeyConfig, lines []batchLine) {
+	id := stored.Batch.ID
+	defer b.batches.cancelRun(id)
+	handler, _ := b.batchHandler(stored.Batch.Endpoint)
+	serve := b.keyRequestHandler(key, handler)
+
+	b.mu.RLock()
+	parallelism := b.cfg.Batches.Parallelism
+	b.mu.RUnlock()
+	if parallelism == 0 {
+		parallelism = 4
+	}
+
+	results := make([]*batchResult, len(lines))
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallelism)
+	for i, line := range lines {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			result := runBatchLine(ctx, serve, line)
+			if result == nil {
+				return
+			}
+			results[i] = result
+			ok := result.Response.StatusCode < 400
+			if ok {
+				batchRequests.WithLabelValues("ok").Inc()
+			} else {
+				batchRequests.WithLabelValues("error").Inc()
+			}
+			b.batches.updateBatch(id, func(stored *storedBatch) {
+				if ok {
+					stored.Batch.RequestCounts.Completed++
+				} else {
+					stored.Batch.RequestCounts.Failed++
+				}
+			})
+		}()
+	}
+	wg.Wait()
+
+	// Write the result files.
+	status, code, message := "completed", "", ""
+	switch ctx.Err() {
+	case context.Canceled:
+		status, code, message = "cancelled", "batch_cancelled", "the batch was cancelled before this request was sent"
+	case context.DeadlineExceeded:
+		status, code, message = "expired", "batch_expired", "the batch's completion window ended before this request was sent"
+	}
+	finalizing := time.Now()
+	var output, errorsFile bytes.Buffer
+	unsent := 0
+	for i, result := range results {
+		if result == nil {
+			unsent++
+			result = &batchResult{ID: "batch_req_" + newRequestID()[:24], CustomID: lines[i].CustomID, Error: &batchError{Code: code, Message: message}}
+		}
+		encoded, _ := json.Marshal(result)
+		if result.Response != nil && result.Response.StatusCode < 400 {
+			output.Write(append(encoded, '\n'))
+		} else {
+			errorsFile.Write(append(encoded, '\n'))
+		}
+	}
+	var outputID, errorID *string
+	for _, file := range []struct {
+		content *bytes.Buffer
+		id      **string
+		name    string
+	}{{&output, &outputID, "output"}, {&errorsFile, &errorID, "errors"}} {
+		if file.content.Len() == 0 {
+			continue
+		}
+		stored, err := b.batches.putFile(stored.Key, id+"_"+file.name+".jsonl", "batch_output", file.content.Bytes())
+		if err != nil {
+			slog.Error("failed to store batch results", "batch", id, "error", err)
+			continue
+		}
+		*file.id = &stored.ID
+	}
+
+	done := time.Now()
+	stored = b.batches.updateBatch(id, func(stored *storedBatch) {
+		batch := &stored.Batch
+		batch.Status = status
+		batch.FinalizingAt = unixTime(finalizing)
+		batch.OutputFileID, batch.ErrorFileID = outputID, errorID
+		switch status {
+		case "completed":
+			batch.CompletedAt = unixTime(done)
+		case "cancelled":
+			batch.CancelledAt = unixTime(done)
+		case "expired":
+			batch.ExpiredAt = unixTime(done)
+		}
+	})
+	slog.Info("batch finished", "batch", id, "status", status, "completed", stored.Batch.RequestCounts.Completed, "failed", stored.Batch.RequestCounts.Failed, "unsent", unsent)
+}
+
+// keyRequestHandler wraps an endpoint's handler for requests the broker
+// makes on a key's behalf, such as a batch's requests or eval comparisons,
+// so they count against the key's quotas, budgets and usage like its own
+// requests.
+func (b *Broker) keyRequestHandler(key *config.KeyConfig, handler http.HandlerFunc) http.Handler {
+	limited := b.EnforceQuotas(b.ReportCost(handler))
+	return b.RecordUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key != nil {
+			noteClientKey(r, key)
+			r = r.WithContext(context.WithValue(r.Context(), clientKeyKey, key))
+		}
+		limited.ServeHTTP(w, r)
+	}))
+}
+
+// runBatchLine serves one request of a batch. A request turned away with
+// 429 or 503, by a quota or a busy target, is sent again after the wait
+// the answer asks for. It returns nil if the batch ended first.
+func runBatchLine(ctx context.Context, serve http.Handler, line batchLine) *batchResult {
+	requestID := newRequestID()
+	ctx = context.WithValue(context.WithValue(ctx, batchRequestKey, true), requestIDKey, requestID)
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, line.URL, bytes.NewReader(line.Body))
+		if err != nil {
+			return nil
+		}
+		req.Header.Set("Content-Type", "application/json")
+		capture := newCaptureWriter(nil)
+		serve.ServeHTTP(capture, req)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		status := capture.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) && attempt < batchLineAttempts {
+			wait, ok := workflows.ParseRetryAfter(capture.Header().Get("Retry-After"), time.Now())
+			if !ok {
+				wait = time.Second
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		body := capture.body.Bytes()
+		if !json.Valid(body) {
+			body, _ = json.Marshal(map[string]interface{}{"error": map[string]string{"message": string(body)}})
+		}
+		return &batchResult{
+			ID:       "batch_req_" + newRequestID()[:24],
+			CustomID: line.CustomID,
+			Response: &batchResultResponse{StatusCode: status, RequestID: requestID, Body: body},
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+// uploadBatchFile uploads a batch input file through /v1/files.
+func uploadBatchFile(t *testing.T, broker *Broker, content string) string {
+	t.Helper()
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("purpose", "batch")
+	part, _ := writer.CreateFormFile("file", "input.jsonl")
+	part.Write([]byte(content))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/v1/files", &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	broker.HandleFiles(rr, req)
+	var file fileObject
+	json.Unmarshal(rr.Body.Bytes(), &file)
+	if rr.Code != http.StatusOK || file.ID == "" || file.Bytes != len(content) {
+		t.Fatalf("Expected the file to be stored, got: %d %s", rr.Code, rr.Body.String())
+	}
+	return file.ID
+}
+
+// batchCall sends a Batch API request and decodes the answer.
+func batchCall(t *testing.T, handler http.HandlerFunc, method, path, body string, v interface{}) int {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	if v != nil {
+		json.Unmarshal(rr.Body.Bytes(), v)
+	}
+	return rr.Code
+}
+
+// waitForBatch polls a batch until it has finished.
+func waitForBatch(t *testing.T, broker *Broker, id string) batchObject {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var batch batchObject
+		batchCall(t, broker.HandleBatches, "GET", "/v1/batches/"+id, "", &batch)
+		if batch.finished() {
+			return batch
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Batch %s did not finish, last status: %s", id, batch.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// batchResults downloads a result file through /v1/files.
+func batchResults(t *testing.T, broker *Broker, id *string) map[string]batchResult {
+	t.Helper()
+	if id == nil {
+		t.Fatal("Expected a result file")
+	}
+	req := httptest.NewRequest("GET", "/v1/files/"+*id+"/content", nil)
+	rr := httptest.NewRecorder()
+	broker.HandleFiles(rr, req)
+	results := make(map[string]batchResult)
+	for _, line := range strings.Split(strings.TrimSpace(rr.Body.String()), "\n") {
+		var result batchResult
+		json.Unmarshal([]byte(line), &result)
+		results[result.CustomID] = result
+	}
+	return results
+}
+
+func TestBroker_EmulatedBatch(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(configPath, []byte(`
+[batches]
+  dir = "`+filepath.Join(dir, "batches")+`"
+  parallelism = 2
+
+[[models]]
+  alias = "fake"
+  type = "mock"
+  [models.target]
+    model = "mock-1"
+    mock = { response = "echo: {{input}}" }
+`), 0o644)
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	broker := New(cfg)
+
+	input := `{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "fake", "messages": [{"role": "user", "content": "one"}]}}
+{"custom_id": "b", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "fake", "messages": [{"role": "user", "content": "two"}]}}
+{"custom_id": "c", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "missing", "messages": [{"role": "user", "content": "three"}]}}
+`
+	fileID := uploadBatchFile(t, broker, input)
+	var batch batchObject
+	if code := batchCall(t, broker.HandleBatches, "POST", "/v1/batches", `{"input_file_id": "`+fileID+`", "endpoint": "/v1/chat/completions", "completion_window": "24h"}`, &batch); code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d", code)
+	}
+	if batch.Status != "in_progress" || batch.RequestCounts.Total != 3 {
+		t.Errorf("Expected an in-progress batch of 3, got: %+v", batch)
+	}
+
+	batch = waitForBatch(t, broker, batch.ID)
+	if batch.Status != "completed" || batch.RequestCounts.Completed != 2 || batch.RequestCounts.Failed != 1 {
+		t.Fatalf("Expected 2 completed and 1 failed, got: %s %+v", batch.Status, batch.RequestCounts)
+	}
+	output := batchResults(t, broker, batch.OutputFileID)
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	json.Unmarshal(output["b"].Response.Body, &completion)
+	if len(output) != 2 || output["a"].Response.StatusCode != 200 || len(completion.Choices) != 1 || completion.Choices[0].Message.Content != "echo: two" {
+		t.Errorf("Expected answers for a and b, got: %+v", output)
+	}
+	errors := batchResults(t, broker, batch.ErrorFileID)
+	if errors["c"].Response == nil || errors["c"].Response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a 404 for the unknown model, got: %+v", errors["c"])
+	}
+
+	// Files and batches belong to the key that made them
+	other := httptest.NewRequest("GET", "/v1/batches/"+batch.ID, nil)
+	other = other.WithContext(context.WithValue(other.Context(), clientKeyKey, &config.KeyConfig{Name: "other"}))
+	rr := httptest.NewRecorder()
+	broker.HandleBatches(rr, other)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected another key's batch to be hidden, got: %d", rr.Code)
+	}
+
+	// Batches and files survive a restart
+	restarted := New(cfg)
+	var reloaded batchObject
+	batchCall(t, restarted.HandleBatches, "GET", "/v1/batches/"+batch.ID, "", &reloaded)
+	if reloaded.Status != "completed" || len(batchResults(t, restarted, reloaded.OutputFileID)) != 2 {
+		t.Errorf("Expected the batch and its output after a restart, got: %+v", reloaded)
+	}
+
+	// Input files with unusable lines fail validation
+	fileID = uploadBatchFile(t, broker, `{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "fake"}}
+{"custom_id": "a", "method": "POST", "url": "/v1/embeddings", "body": {"model": "fake"}}
+`)
+	batchCall(t, broker.HandleBatches, "POST", "/v1/batches", `{"input_file_id": "`+fileID+`", "endpoint": "/v1/chat/completions"}`, &batch)
+	if batch.Status != "failed" || batch.Errors == nil || len(batch.Errors.Data) != 1 || *batch.Errors.Data[0].Line != 2 {
+		t.Errorf("Expected a failed batch with an error on line 2, got: %+v", batch)
+	}
+}
+
+func TestBroker_CancelEmulatedBatch(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(configPath, []byte(`
+[batches]
+  parallelism = 1
+
+[[models]]
+  alias = "slow"
+  type = "mock"
+  [models.target]
+    model = "mock-1"
+    mock = { latency = "100ms" }
+`), 0o644)
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	broker := New(cfg)
+
+	var input strings.Builder
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		input.WriteString(`{"custom_id": "` + id + `", "method": "POST", "url": "/v1/embeddings", "body": {"model": "slow", "input": "x"}}` + "\n")
+	}
+	fileID := uploadBatchFile(t, broker, input.String())
+	var batch batchObject
+	batchCall(t, broker.HandleBatches, "POST", "/v1/batches", `{"input_file_id": "`+fileID+`", "endpoint": "/v1/embeddings"}`, &batch)
+	time.Sleep(150 * time.Millisecond)
+	if code := batchCall(t, broker.HandleBatches, "POST", "/v1/batches/"+batch.ID+"/cancel", "", &batch); code != http.StatusOK || batch.Status != "cancelling" {
+		t.Fatalf("Expected the batch to be cancelling, got: %d %s", code, batch.Status)
+	}
+
+	batch = waitForBatch(t, broker, batch.ID)
+	if batch.Status != "cancelled" || batch.RequestCounts.Completed == 0 || batch.RequestCounts.Completed == 5 {
+		t.Fatalf("Expected a cancelled batch with some answers, got: %s %+v", batch.Status, batch.RequestCounts)
+	}
+	errors := batchResults(t, broker, batch.ErrorFileID)
+	if len(errors)+batch.RequestCounts.Completed != 5 || errors["5"].Error == nil || errors["5"].Error.Code != "batch_cancelled" {
+		t.Errorf("Expected the unsent requests in the error file, got: %+v", errors)
+	}
+}
+
+func TestBroker_NativeBatch(t *testing.T) {
+	var uploaded string
+	status := "in_progress"
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer sk-test" {
+			t.Errorf("Expected the target's API key, got: %s", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/v1/files":
+			file, _, err := r.FormFile("file")
+			if err != nil || r.FormValue("purpose") != "batch" {
+				t.Errorf("Expected a batch file upload, got: %v", err)
+				return
+			}
+			content, _ := io.ReadAll(file)
+			uploaded = string(content)
+			w.Write([]byte(`{"id": "file-remote", "object": "file"}`))
+		case r.Method == "POST" && r.URL.Path == "/v1/batches":
+			w.Write([]byte(`{"id": "batch_remote", "object": "batch", "endpoint": "/v1/chat/completions", "status": "validating", "input_file_id": "file-remote", "request_counts": {"total": 0, "completed": 0, "failed": 0}}`))
+		case r.Method == "GET" && r.URL.Path == "/v1/batches/batch_remote":
+			output := ""
+			if status == "completed" {
+				output = `, "output_file_id": "file-output"`
+			}
+			w.Write([]byte(`{"id": "batch_remote", "object": "batch", "endpoint": "/v1/chat/completions", "status": "` + status + `", "input_file_id": "file-remote"` + output + `, "request_counts": {"total": 1, "completed": 1, "failed": 0}}`))
+		case r.Method == "GET" && r.URL.Path == "/v1/files/file-output/content":
+			w.Write([]byte(`{"id": "batch_req_1", "custom_id": "a", "response": {"status_code": 200, "body": {}}, "error": null}` + "\n"))
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt": {
+				Alias:  "gpt",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/v1/", Model: "gpt-4o-mini", APIKey: "sk-test"},
+			},
+		},
+	})
+	fileID := uploadBatchFile(t, broker, `{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "gpt", "messages": [{"role": "user", "content": "hi"}]}}`+"\n")
+	var batch batchObject
+	if code := batchCall(t, broker.HandleBatches, "POST", "/v1/batches", `{"input_file_id": "`+fileID+`", "endpoint": "/v1/chat/completions"}`, &batch); code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d", code)
+	}
+	if !strings.Contains(uploaded, `"model":"gpt-4o-mini"`) {
+		t.Errorf("Expected the target model in the uploaded file, got: %s", uploaded)
+	}
+	if batch.ID == "batch_remote" || batch.InputFileID != fileID || batch.Status != "validating" {
+		t.Errorf("Expected the broker's IDs with the target's status, got: %+v", batch)
+	}
+
+	batchCall(t, broker.HandleBatches, "GET", "/v1/batches/"+batch.ID, "", &batch)
+	if batch.Status != "in_progress" || batch.OutputFileID != nil {
+		t.Errorf("Expected the target's progress, got: %+v", batch)
+	}
+	status = "completed"
+	batchCall(t, broker.HandleBatches, "GET", "/v1/batches/"+batch.ID, "", &batch)
+	if batch.Status != "completed" || batch.RequestCounts.Completed != 1 {
+		t.Fatalf("Expected the completed batch, got: %+v", batch)
+	}
+	if output := batchResults(t, broker, batch.OutputFileID); output["a"].Response == nil || output["a"].Response.StatusCode != 200 {
+		t.Errorf("Expected the target's output file copied to the broker, got: %+v", output)
+	}
+}
+
+func TestBroker_NativeBatchFallsBackToEmulation(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	newBroker := func(batch string) *Broker {
+		return New(&config.Config{
+			Models: map[string]config.Model{
+				"local": {
+					Alias:  "local",
+					Type:   "openai",
+					Target: config.TargetConfig{URL: mockBackend.URL + "/v1/", Model: "llama", Batch: batch},
+				},
+			},
+		})
+	}
+	input := `{"custom_id": "a", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "local", "messages": [{"role": "user", "content": "hi"}]}}` + "\n"
+
+	// A server without a Batch API gets its batches emulated
+	broker := newBroker("")
+	fileID := uploadBatchFile(t, broker, input)
+	var batch batchObject
+	if code := batchCall(t, broker.HandleBatches, "POST", "/v1/batches", `{"input_file_id": "`+fileID+`", "endpoint": "/v1/chat/completions"}`, &batch); code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d", code)
+	}
+	batch = waitForBatch(t, broker, batch.ID)
+	if batch.Status != "completed" || batch.RequestCounts.Completed != 1 {
+		t.Errorf("Expected the batch emulated to completion, got: %s %+v", batch.Status, batch.RequestCounts)
+	}
+
+	// Unless native batches were asked for
+	broker = newBroker("native")
+	fileID = uploadBatchFile(t, broker, input)
+	if code := batchCall(t, broker.HandleBatches, "POST", "/v1/batches", `{"input_file_id": "`+fileID+`", "endpoint": "/v1/chat/completions"}`, nil); code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a native batch the target does not take, got: %d", code)
+	}
+}
+
+func TestNativeBatchModel_LimitedKeys(t *testing.T) {
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt": {Alias: "gpt", Type: "openai", Target: config.TargetConfig{URL: "http://openai/v1/", Model: "gpt-4o-mini"}},
+		},
+	})
+	lines := []batchLine{{CustomID: "a", model: "gpt"}}
+	if _, ok := broker.nativeBatchModel(&config.KeyConfig{Name: "open"}, lines); !ok {
+		t.Errorf("Expected a native batch for a key without limits")
+	}
+	for _, key := range []config.KeyConfig{{Name: "tpm", TPM: 1000}, {Name: "daily", DailyBudget: 5}, {Name: "monthly", MonthlyBudget: 50}} {
+		if _, ok := broker.nativeBatchModel(&key, lines); ok {
+			t.Errorf("Expected key %s's batch to be emulated", key.Name)
+		}
+	}
+}
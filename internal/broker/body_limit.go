@@ -0,0 +1,47 @@
+package broker
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lmbroker/internal/broker/workflows"
+)
+
+// LimitRequestBodies is a middleware that enforces server.max_request_bytes
+// on API requests. Bodies are read up to the limit before anything else
+// sees them, so no later stage buffers more than that; larger requests are
+// answered 413 in the client's error format.
+func (b *Broker) LimitRequestBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.RLock()
+		limit := b.cfg.Server.MaxRequestBytes
+		b.mu.RUnlock()
+		if limit <= 0 || r.Body == nil || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > limit {
+			writeBodyTooLarge(w, r, limit)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		r.Body.Close()
+		if err != nil {
+			workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		if int64(len(body)) > limit {
+			writeBodyTooLarge(w, r, limit)
+			return
+		}
+		workflows.SetBody(r, body)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	workflows.WriteError(w, r, http.StatusRequestEntityTooLarge, "request body exceeds the limit of "+strconv.FormatInt(limit, 10)+" bytes")
+}
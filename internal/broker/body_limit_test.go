@@ -0,0 +1,43 @@
+package broker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_LimitRequestBodies(t *testing.T) {
+	broker := &Broker{cfg: &config.Config{Server: config.ServerConfig{MaxRequestBytes: 32}}}
+	var received string
+	handler := broker.LimitRequestBodies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	}))
+
+	// Bodies within the limit reach the handler whole
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o"}`))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || received != `{"model": "gpt-4o"}` {
+		t.Errorf("Expected the body to be passed on, got: %d %q", rr.Code, received)
+	}
+
+	// Larger ones are refused in the client's error format, also when the
+	// size is not announced up front
+	body := `{"model": "claude", "messages": [{"role": "user", "content": "Hello"}]}`
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	req.ContentLength = -1
+	rr = httptest.NewRecorder()
+	received = ""
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge || received != "" {
+		t.Errorf("Expected 413 without calling the handler, got: %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), `"type":"request_too_large"`) {
+		t.Errorf("Expected an Anthropic request_too_large error, got: %s", rr.Body.String())
+	}
+}
@@ -2,11 +2,17 @@ package broker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"lmbroker/internal/adapters"
 	"lmbroker/internal/config"
@@ -357,6 +363,15 @@ func TestBroker_ChatCompletions_ErrorHandling(t *testing.T) {
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("Expected status 404 for unsupported model, got: %d", rr.Code)
 	}
+	var openaiError struct {
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &openaiError); err != nil || openaiError.Error.Type != "invalid_request_error" || openaiError.Error.Message != "model not supported" {
+		t.Errorf("Expected an OpenAI error envelope, got: %s", rr.Body.String())
+	}
 
 	// Test no backend available for Claude model  
 	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude-3-haiku-20240307"}`))
@@ -368,6 +383,23 @@ func TestBroker_ChatCompletions_ErrorHandling(t *testing.T) {
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("Expected status 404 for unsupported model, got: %d", rr.Code)
 	}
+	var anthropicError struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &anthropicError); err != nil || anthropicError.Type != "error" || anthropicError.Error.Type != "not_found_error" {
+		t.Errorf("Expected an Anthropic error envelope, got: %s", rr.Body.String())
+	}
+
+	// Malformed bodies are reported in the caller's dialect too
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": `))
+	rr = httptest.NewRecorder()
+	emptyBroker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"invalid_request_error"`) || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Expected a 400 Anthropic error, got: %d %s", rr.Code, rr.Body.String())
+	}
 
 	// Test unsupported endpoint
 	req = httptest.NewRequest("POST", "/v1/unsupported", strings.NewReader(`{"model": "gpt-4"}`))
@@ -557,4 +589,852 @@ func TestBroker_ChatCompletions_Translation_OpenAIToAnthropic(t *testing.T) {
 	if message["content"] != "OpenAI to Anthropic translation!" {
 		t.Errorf("Expected translated content, got: %v", message["content"])
 	}
-}
\ No newline at end of file
+}
+
+func TestBroker_ChatCompletions_EvalMode(t *testing.T) {
+	mockBackend := func(content string, hits chan<- string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-LMBroker-Eval") != "" {
+				t.Error("Expected eval header to be stripped before reaching a backend")
+			}
+			hits <- content
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"id":     "chatcmpl-" + content,
+				"object": "chat.completion",
+				"choices": []map[string]interface{}{
+					{"index": 0, "message": map[string]interface{}{"role": "assistant", "content": content}, "finish_reason": "stop"},
+				},
+				"usage": map[string]int{"prompt_tokens": 3, "completion_tokens": 2, "total_tokens": 5},
+			})
+		}))
+	}
+
+	hits := make(chan string, 2)
+	primaryBackend := mockBackend("primary", hits)
+	defer primaryBackend.Close()
+	secondaryBackend := mockBackend("secondary", hits)
+	defer secondaryBackend.Close()
+
+	broker := createTestBroker()
+	broker.cfg.Eval.AllowHeader = true
+	gpt4Model := broker.cfg.Models["gpt-4"]
+	gpt4Model.Target.URL = primaryBackend.URL + "/v1/"
+	broker.cfg.Models["gpt-4"] = gpt4Model
+	broker.cfg.Models["gpt-4-candidate"] = config.Model{
+		Alias:  "gpt-4-candidate",
+		Type:   "openai",
+		Target: config.TargetConfig{URL: secondaryBackend.URL + "/v1/", Model: "gpt-4o"},
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-LMBroker-Eval", "gpt-4-candidate")
+
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", rr.Code)
+	}
+
+	if !strings.Contains(rr.Body.String(), `"content":"primary"`) {
+		t.Errorf("Expected primary response to be returned, got: %s", rr.Body.String())
+	}
+
+	// Both backends must have received the request
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		seen[<-hits] = true
+	}
+	if !seen["primary"] || !seen["secondary"] {
+		t.Errorf("Expected both backends to be called, got: %v", seen)
+	}
+}
+
+func TestBroker_EvalModeChargesKey(t *testing.T) {
+	hits := make(chan string, 2)
+	mockBackend := func(content string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits <- content
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "` + content + `"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 3, "completion_tokens": 2, "total_tokens": 5}}`))
+		}))
+	}
+	primaryBackend := mockBackend("primary")
+	defer primaryBackend.Close()
+	secondaryBackend := mockBackend("secondary")
+	defer secondaryBackend.Close()
+
+	broker := New(&config.Config{
+		Eval: config.EvalConfig{AllowHeader: true},
+		Models: map[string]config.Model{
+			"gpt-4":           {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: primaryBackend.URL + "/v1/", Model: "gpt-4"}},
+			"gpt-4-candidate": {Alias: "gpt-4-candidate", Type: "openai", Target: config.TargetConfig{URL: secondaryBackend.URL + "/v1/", Model: "gpt-4o"}},
+		},
+	})
+	newRequest := func(key *config.KeyConfig) *http.Request {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("X-LMBroker-Eval", "gpt-4-candidate")
+		return req.WithContext(context.WithValue(req.Context(), clientKeyKey, key))
+	}
+	team := &config.KeyConfig{Name: "team"}
+	handler := broker.RecordUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		noteClientKey(r, team)
+		broker.HandleChatCompletions(w, r)
+	}))
+
+	// Keys cannot mirror to models outside their allowlist
+	model := broker.cfg.Models["gpt-4"]
+	if _, ok := broker.evalTargetFor(newRequest(&config.KeyConfig{Name: "limited", Models: []string{"gpt-4"}}), &model); ok {
+		t.Errorf("Expected no comparison against a model the key may not use")
+	}
+
+	// The comparison is a request of the key's own
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest(team))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	<-hits
+	<-hits
+	deadline := time.Now().Add(5 * time.Second)
+	var totals []usageTotals
+	for time.Now().Before(deadline) {
+		totals = broker.usage.query(usageQuery{groupBy: map[string]bool{"key": true, "model": true}})
+		if len(totals) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(totals) != 2 || totals[1].Key != "team" || totals[1].Model != "gpt-4-candidate" || totals[1].OutputTokens != 2 {
+		t.Errorf("Expected usage for both models under the key, got: %+v", totals)
+	}
+}
+
+func TestEvalRecorder_Close(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "eval.jsonl")
+	recorder := &evalRecorder{path: path}
+	recorder.write(evalRecord{Dialect: "openai"})
+	if err := recorder.close(); err != nil {
+		t.Fatalf("Expected the log to close, got: %v", err)
+	}
+	if recorder.file != nil {
+		t.Errorf("Expected the file to be released")
+	}
+
+	// Records of comparisons that finish after shutdown are dropped
+	recorder.write(evalRecord{Dialect: "openai"})
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 1 {
+		t.Errorf("Expected 1 record, got: %d", lines)
+	}
+}
+
+func TestParseUsage(t *testing.T) {
+	in, out := parseUsage([]byte(`{"usage": {"prompt_tokens": 10, "completion_tokens": 4}}`))
+	if in != 10 || out != 4 {
+		t.Errorf("Expected 10/4 tokens from JSON body, got: %d/%d", in, out)
+	}
+
+	stream := "event: message_start\ndata: {\"type\":\"message_start\",\"message\":{\"usage\":{\"input_tokens\":7}}}\n\n" +
+		"event: message_delta\ndata: {\"type\":\"message_delta\",\"usage\":{\"output_tokens\":9}}\n\n"
+	in, out = parseUsage([]byte(stream))
+	if in != 7 || out != 9 {
+		t.Errorf("Expected 7/9 tokens from stream, got: %d/%d", in, out)
+	}
+}
+
+func TestBroker_ChatCompletions_AzureOpenAI(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/openai/deployments/gpt4o-prod/chat/completions" {
+			t.Errorf("Expected deployment path, got: %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("api-version") != "2024-06-01" {
+			t.Errorf("Expected api-version 2024-06-01, got: %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("api-key") != "azure-key" || r.Header.Get("Authorization") != "" {
+			t.Errorf("Expected api-key auth only, got api-key=%q authorization=%q", r.Header.Get("api-key"), r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-azure", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi from Azure"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias: "gpt-4o",
+				Type:  "azure_openai",
+				Target: config.TargetConfig{
+					URL:        mockBackend.URL + "/",
+					Model:      "gpt-4o",
+					APIKey:     "azure-key",
+					Deployment: "gpt4o-prod",
+					APIVersion: "2024-06-01",
+				},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer client-key")
+	rr := httptest.NewRecorder()
+
+	broker.HandleChatCompletions(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", rr.Code)
+	}
+	// Same wire format as OpenAI, so the response is passed through untouched
+	if !strings.Contains(rr.Body.String(), "chatcmpl-azure") {
+		t.Errorf("Expected passthrough response, got: %s", rr.Body.String())
+	}
+}
+
+func TestBroker_ChatCompletions_AuthStyle(t *testing.T) {
+	var got *http.Request
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/messages") {
+			w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 1}}`))
+			return
+		}
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"claude": {
+				Alias:  "claude",
+				Type:   "anthropic",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "claude-3-haiku-20240307", APIKey: "sk-ant"},
+			},
+			"keyed": {
+				Alias:  "keyed",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o", APIKey: "sk-query", AuthStyle: "query-param"},
+			},
+		},
+	})
+	send := func(model string) {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+model+`", "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer client-key")
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 for %s, got: %d %s", model, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Anthropic targets default to x-api-key with an API version
+	send("claude")
+	if got.Header.Get("x-api-key") != "sk-ant" || got.Header.Get("Authorization") != "" {
+		t.Errorf("Expected x-api-key auth only, got x-api-key=%q authorization=%q", got.Header.Get("x-api-key"), got.Header.Get("Authorization"))
+	}
+	if got.Header.Get("anthropic-version") != "2023-06-01" {
+		t.Errorf("Expected anthropic-version 2023-06-01, got: %q", got.Header.Get("anthropic-version"))
+	}
+
+	// query-param sends the key in the URL instead of a header
+	send("keyed")
+	if got.URL.Query().Get("key") != "sk-query" || got.Header.Get("Authorization") != "" {
+		t.Errorf("Expected the key as a query parameter only, got query=%q authorization=%q", got.URL.RawQuery, got.Header.Get("Authorization"))
+	}
+}
+
+func TestBroker_ChatCompletions_VertexAnthropic(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]interface{}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		if r.Header.Get("Authorization") != "Bearer static-token" {
+			t.Errorf("Expected bearer token, got: %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_vertex", "type": "message", "role": "assistant", "content": [{"type": "text", "text": "Hi"}], "model": "claude-sonnet-4", "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 1}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"claude": {
+				Alias: "claude",
+				Type:  "vertex_anthropic",
+				Target: config.TargetConfig{
+					URL:     mockBackend.URL + "/v1/",
+					Model:   "claude-sonnet-4@20250514",
+					APIKey:  "static-token",
+					Project: "my-project",
+					Region:  "us-east5",
+				},
+			},
+		},
+	})
+
+	for _, tt := range []struct {
+		stream bool
+		path   string
+	}{
+		{false, "/v1/projects/my-project/locations/us-east5/publishers/anthropic/models/claude-sonnet-4@20250514:rawPredict"},
+		{true, "/v1/projects/my-project/locations/us-east5/publishers/anthropic/models/claude-sonnet-4@20250514:streamRawPredict"},
+	} {
+		reqBody, _ := json.Marshal(map[string]interface{}{
+			"model":      "claude",
+			"max_tokens": 100,
+			"stream":     tt.stream,
+			"messages":   []map[string]string{{"role": "user", "content": "Hello"}},
+		})
+		req := httptest.NewRequest("POST", "/v1/messages", bytes.NewReader(reqBody))
+		req.Header.Set("anthropic-version", "2023-06-01")
+		rr := httptest.NewRecorder()
+
+		broker.HandleChatCompletions(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d", rr.Code)
+		}
+		if gotPath != tt.path {
+			t.Errorf("Expected path %s, got: %s", tt.path, gotPath)
+		}
+		if _, hasModel := gotBody["model"]; hasModel || gotBody["anthropic_version"] != "vertex-2023-10-16" {
+			t.Errorf("Expected Vertex body without model and with anthropic_version, got: %v", gotBody)
+		}
+	}
+}
+
+func TestBroker_CountTokens(t *testing.T) {
+	// Anthropic targets are proxied
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages/count_tokens" {
+			t.Errorf("Expected count_tokens path, got: %s", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"input_tokens": 42}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"claude": {Alias: "claude", Type: "anthropic", Target: config.TargetConfig{URL: mockBackend.URL + "/v1/", Model: "claude-sonnet-4"}},
+			"gpt-4":  {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: "http://unused/v1/", Model: "gpt-4"}},
+		},
+	})
+
+	req := httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(`{"model": "claude", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	broker.HandleCountTokens(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"input_tokens": 42`) {
+		t.Errorf("Expected proxied count, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Other targets get a local estimate
+	reqBody := `{
+		"model": "gpt-4",
+		"system": "` + strings.Repeat("a", 400) + `",
+		"messages": [{"role": "user", "content": [{"type": "text", "text": "` + strings.Repeat("b", 400) + `"}, {"type": "image", "source": {"type": "url", "url": "https://example.com/cat.png"}}]}]
+	}`
+	req = httptest.NewRequest("POST", "/v1/messages/count_tokens", strings.NewReader(reqBody))
+	rr = httptest.NewRecorder()
+	broker.HandleCountTokens(rr, req)
+
+	var body struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if expected := 200 + imageTokenEstimate + 3; body.InputTokens != expected {
+		t.Errorf("Expected estimate of %d tokens, got: %d", expected, body.InputTokens)
+	}
+}
+
+func TestBroker_Completions(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]interface{}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/completions" {
+			w.Write([]byte(`{"id": "cmpl-native", "object": "text_completion", "choices": [{"index": 0, "text": "native", "finish_reason": "stop"}]}`))
+			return
+		}
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "via chat"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 3, "completion_tokens": 2}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"instruct": {
+				Alias:  "instruct",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-3.5-turbo-instruct"},
+			},
+			"chat-only": {
+				Alias:              "chat-only",
+				Type:               "openai",
+				Target:             config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"},
+				CompletionsViaChat: true,
+			},
+		},
+	})
+
+	// Backends with a native completions endpoint receive the request as-is
+	req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "instruct", "prompt": "Hello"}`))
+	rr := httptest.NewRecorder()
+	broker.HandleCompletions(rr, req)
+	if gotPath != "/completions" || !strings.Contains(rr.Body.String(), "cmpl-native") {
+		t.Errorf("Expected passthrough to /completions, got path %s and body: %s", gotPath, rr.Body.String())
+	}
+
+	// Chat-only backends get the prompt as a user message
+	req = httptest.NewRequest("POST", "/v1/completions", strings.NewReader(`{"model": "chat-only", "prompt": "Hello", "max_tokens": 5}`))
+	rr = httptest.NewRecorder()
+	broker.HandleCompletions(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if gotPath != "/chat/completions" {
+		t.Errorf("Expected translation to /chat/completions, got: %s", gotPath)
+	}
+	messages, _ := gotBody["messages"].([]interface{})
+	if len(messages) != 1 || gotBody["model"] != "gpt-4o" || gotBody["max_tokens"] != float64(5) {
+		t.Errorf("Expected a single-message chat request for gpt-4o, got: %v", gotBody)
+	}
+
+	var resp struct {
+		Object  string `json:"object"`
+		Choices []struct {
+			Text string `json:"text"`
+		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode completion response: %v", err)
+	}
+	if resp.Object != "text_completion" || len(resp.Choices) != 1 || resp.Choices[0].Text != "via chat" || resp.Usage.TotalTokens != 5 {
+		t.Errorf("Expected the chat reply as a text completion, got: %s", rr.Body.String())
+	}
+}
+
+func TestBroker_ImageGenerations(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/images/generations" {
+			t.Errorf("Expected /images/generations, got: %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["model"] != "stabilityai/sdxl" {
+			t.Errorf("Expected model rewritten to stabilityai/sdxl, got: %v", body["model"])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"created": 1, "data": [{"url": "https://images.example/1.png"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"sdxl": {
+				Alias:  "sdxl",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "stabilityai/sdxl"},
+			},
+			"claude": {
+				Alias:  "claude",
+				Type:   "anthropic",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "claude-3-haiku-20240307"},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("POST", "/v1/images/generations", strings.NewReader(`{"model": "sdxl", "prompt": "a lighthouse"}`))
+	rr := httptest.NewRecorder()
+	broker.HandleImageGenerations(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "images.example") {
+		t.Errorf("Expected passthrough image response, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Providers without image generation are rejected up front
+	req = httptest.NewRequest("POST", "/v1/images/generations", strings.NewReader(`{"model": "claude", "prompt": "a lighthouse"}`))
+	rr = httptest.NewRecorder()
+	broker.HandleImageGenerations(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for a chat-only provider, got: %d", rr.Code)
+	}
+}
+
+func TestBroker_Audio(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/audio/transcriptions":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatalf("Expected a valid multipart body, got: %v", err)
+			}
+			if r.FormValue("model") != "whisper-1" || r.FormValue("language") != "en" {
+				t.Errorf("Expected model rewritten and other fields kept, got: %v", r.MultipartForm.Value)
+			}
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				t.Fatalf("Expected the uploaded file, got: %v", err)
+			}
+			audio, _ := io.ReadAll(file)
+			if string(audio) != "RIFF\x00\x01fake" {
+				t.Errorf("Expected file bytes forwarded unchanged, got: %q", audio)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"text": "hello world"}`))
+		case "/audio/speech":
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			if body["model"] != "tts-1" {
+				t.Errorf("Expected model rewritten to tts-1, got: %v", body["model"])
+			}
+			w.Header().Set("Content-Type", "audio/mpeg")
+			w.Write([]byte{0xff, 0xfb, 0x90, 0x00})
+		default:
+			t.Errorf("Unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"stt": {Alias: "stt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "whisper-1"}},
+			"tts": {Alias: "tts", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "tts-1"}},
+		},
+	})
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	writer.WriteField("model", "stt")
+	fileWriter, _ := writer.CreateFormFile("file", "clip.wav")
+	fileWriter.Write([]byte("RIFF\x00\x01fake"))
+	writer.WriteField("language", "en")
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/v1/audio/transcriptions", &form)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	broker.HandleAudio(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "hello world") {
+		t.Errorf("Expected transcription response, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/v1/audio/speech", strings.NewReader(`{"model": "tts", "input": "hi", "voice": "alloy"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	broker.HandleAudio(rr, req)
+	if rr.Header().Get("Content-Type") != "audio/mpeg" || !bytes.Equal(rr.Body.Bytes(), []byte{0xff, 0xfb, 0x90, 0x00}) {
+		t.Errorf("Expected binary audio passed through, got: %s %v", rr.Header().Get("Content-Type"), rr.Body.Bytes())
+	}
+}
+
+func TestBroker_Responses(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]interface{}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/responses" {
+			w.Write([]byte(`{"id": "resp_native", "object": "response", "output": []}`))
+			return
+		}
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-3-haiku-20240307", "content": [{"type": "text", "text": "Bonjour"}], "stop_reason": "end_turn", "usage": {"input_tokens": 4, "output_tokens": 2}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4.1": {
+				Alias:  "gpt-4.1",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4.1"},
+			},
+			"claude": {
+				Alias:  "claude",
+				Type:   "anthropic",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "claude-3-haiku-20240307"},
+			},
+		},
+	})
+
+	// OpenAI targets receive the Responses request untouched
+	req := httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model": "gpt-4.1", "input": "Hello"}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if gotPath != "/responses" || !strings.Contains(rr.Body.String(), "resp_native") {
+		t.Errorf("Expected passthrough to /responses, got path %s and body: %s", gotPath, rr.Body.String())
+	}
+
+	// Other backends are reached through chat translation
+	req = httptest.NewRequest("POST", "/v1/responses", strings.NewReader(`{"model": "claude", "input": "Say hello in French"}`))
+	rr = httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if messages, _ := gotBody["messages"].([]interface{}); len(messages) != 1 || gotBody["stream"] == true {
+		t.Errorf("Expected one non-streaming Anthropic message, got: %v", gotBody)
+	}
+
+	var resp struct {
+		Object string `json:"object"`
+		Output []struct {
+			Type    string `json:"type"`
+			Content []struct {
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"output"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode Responses response: %v", err)
+	}
+	if resp.Object != "response" || len(resp.Output) != 1 || resp.Output[0].Content[0].Text != "Bonjour" {
+		t.Errorf("Expected the reply as a Responses message item, got: %s", rr.Body.String())
+	}
+}
+
+func TestBroker_ChatCompletions_Failover(t *testing.T) {
+	primaryStatus := http.StatusServiceUnavailable
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Primary", "1")
+		w.WriteHeader(primaryStatus)
+		w.Write([]byte(`{"error": {"message": "overloaded"}}`))
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["model"] != "claude-3-haiku-20240307" {
+			t.Errorf("Expected fallback target model, got: %v", body["model"])
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "content": [{"type": "text", "text": "from fallback"}], "stop_reason": "end_turn"}`))
+	}))
+	defer fallback.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:     "gpt-4o",
+				Type:      "openai",
+				Target:    config.TargetConfig{URL: primary.URL + "/", Model: "gpt-4o"},
+				Fallbacks: []string{"claude"},
+			},
+			"claude": {
+				Alias:  "claude",
+				Type:   "anthropic",
+				Target: config.TargetConfig{URL: fallback.URL + "/", Model: "claude-3-haiku-20240307"},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "from fallback") {
+		t.Fatalf("Expected the fallback's translated response, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("X-LMBroker-Served-By") != "claude" {
+		t.Errorf("Expected X-LMBroker-Served-By: claude, got: %q", rr.Header().Get("X-LMBroker-Served-By"))
+	}
+	if rr.Header().Get("X-Primary") != "" {
+		t.Errorf("Expected the failed attempt's headers to be discarded")
+	}
+
+	// Client errors are the caller's problem and are not retried elsewhere
+	primaryStatus = http.StatusBadRequest
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr = httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusBadRequest || rr.Header().Get("X-LMBroker-Served-By") != "gpt-4o" {
+		t.Errorf("Expected the primary's 400 without failover, got: %d served by %q", rr.Code, rr.Header().Get("X-LMBroker-Served-By"))
+	}
+}
+
+func TestBroker_ChatCompletions_DefaultModel(t *testing.T) {
+	var gotBody map[string]interface{}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	cfg := &config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:  "gpt-4o",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"},
+			},
+		},
+	}
+	requestBody := `{"model": "gpt-3.5-turbo", "messages": [{"role": "user", "content": "Hello"}]}`
+
+	// Without a default model, unknown aliases are rejected
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr := httptest.NewRecorder()
+	New(cfg).HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got: %d", rr.Code)
+	}
+
+	// With one, they are served by it under its model name
+	cfg.DefaultModel = "gpt-4o"
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(requestBody))
+	rr = httptest.NewRecorder()
+	New(cfg).HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if gotBody["model"] != "gpt-4o" {
+		t.Errorf("Expected the model field to be rewritten to gpt-4o, got: %v", gotBody["model"])
+	}
+}
+
+func TestBroker_MockProvider(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(configPath, []byte(`
+[[models]]
+  alias = "fake"
+  type = "mock"
+  [models.target]
+    model = "mock-1"
+    mock = { response = "{{model}} heard: {{input}}", chunk_delay = "1ms" }
+`), 0o644)
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	broker := New(cfg)
+
+	// Anthropic clients are answered through translation
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "fake", "max_tokens": 100, "messages": [{"role": "user", "content": "hello there"}]}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	var message struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+		Usage struct {
+			InputTokens int `json:"input_tokens"`
+		} `json:"usage"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &message)
+	if rr.Code != http.StatusOK || len(message.Content) != 1 || message.Content[0].Text != "mock-1 heard: hello there" {
+		t.Fatalf("Expected the templated answer, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if message.Usage.InputTokens == 0 {
+		t.Errorf("Expected estimated usage, got: %s", rr.Body.String())
+	}
+
+	// OpenAI clients get a real stream, one word per chunk
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "fake", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`))
+	rr = httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	body := rr.Body.String()
+	if rr.Code != http.StatusOK || strings.Count(body, `"content":"`) != 4 || !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected a streamed answer, got: %d %s", rr.Code, body)
+	}
+
+	// Embeddings are deterministic
+	embed := func(input string) []float64 {
+		req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "fake", "input": "`+input+`"}`))
+		rr := httptest.NewRecorder()
+		broker.HandleEmbeddings(rr, req)
+		var resp struct {
+			Data []struct {
+				Embedding []float64 `json:"embedding"`
+			} `json:"data"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if len(resp.Data) != 1 || len(resp.Data[0].Embedding) != 16 {
+			t.Fatalf("Expected one embedding, got: %d %s", rr.Code, rr.Body.String())
+		}
+		return resp.Data[0].Embedding
+	}
+	if a, b := embed("cat"), embed("cat"); a[0] != b[0] || a[0] == embed("dog")[0] {
+		t.Errorf("Expected embeddings to depend only on the input")
+	}
+}
+
+func TestBroker_SelfHostedParameters(t *testing.T) {
+	var received map[string]interface{}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "yes"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"llama": {Alias: "llama", Type: "vllm", Target: config.TargetConfig{URL: mockBackend.URL + "/v1/", Model: "llama-3"}},
+			"tgi":   {Alias: "tgi", Type: "tgi", Target: config.TargetConfig{URL: mockBackend.URL + "/v1/", Model: "tgi"}},
+		},
+	})
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr
+	}
+
+	if rr := send(`{"model": "llama", "messages": [{"role": "user", "content": "Hi"}], "top_k": 40, "min_p": 0.05}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if received["top_k"] != float64(40) || received["min_p"] != 0.05 {
+		t.Errorf("Expected vLLM parameters to be passed through, got: %v", received)
+	}
+
+	rr := send(`{"model": "llama", "messages": [{"role": "user", "content": "Hi"}], "top_k": "many"}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "invalid parameter top_k") {
+		t.Errorf("Expected a 400 for a bad top_k, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	if rr := send(`{"model": "tgi", "messages": [{"role": "user", "content": "Hi"}], "guided_regex": "yes|no"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if format, _ := received["response_format"].(map[string]interface{}); format["type"] != "regex" || received["guided_regex"] != nil {
+		t.Errorf("Expected guided_regex to become a TGI grammar, got: %v", received)
+	}
+}
+
+func TestBroker_CodeExecutionSameFormat(t *testing.T) {
+	var received map[string]interface{}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "done"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {Alias: "gpt-4o", Type: "openai", CodeExecution: "disabled", Target: config.TargetConfig{URL: mockBackend.URL + "/v1/", Model: "gpt-4o"}},
+		},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hi"}], "tools": [{"type": "code_interpreter"}]}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+
+	// The rewrite applies even though client and backend share a format
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if tools, _ := received["tools"].([]interface{}); len(tools) != 0 {
+		t.Errorf("Expected the code execution tool to be stripped, got: %v", received["tools"])
+	}
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+// budgetHeader reports how much of its tightest budget a key has left, in USD.
+const budgetHeader = "X-LMBroker-Budget-Remaining"
+
+// keySpend is a key's estimated spend in the current UTC day and month.
+type keySpend struct {
+	day     string
+	month   string
+	daily   float64
+	monthly float64
+}
+
+// spendTracker accumulates the estimated spend of client keys. It is kept
+// in memory, so spend starts over when the broker restarts.
+type spendTracker struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*keySpend
+}
+
+func newSpendTracker() *spendTracker {
+	return &spendTracker{now: time.Now, keys: make(map[string]*keySpend)}
+}
+
+// current returns a key's spend, starting a new day or month when the
+// calendar has moved on. Callers hold s.mu.
+func (s *spendTracker) current(name string, now time.Time) *keySpend {
+	day, month := now.UTC().Format("2006-01-02"), now.UTC().Format("2006-01")
+	spend, ok := s.keys[name]
+	if !ok {
+		spend = &keySpend{day: day, month: month}
+		s.keys[name] = spend
+	}
+	if spend.day != day {
+		spend.day, spend.daily = day, 0
+	}
+	if spend.month != month {
+		spend.month, spend.monthly = month, 0
+	}
+	return spend
+}
+
+// budgetStatus is how a key stands against its budgets.
+type budgetStatus struct {
+	Key           string  `json:"key"`
+	DailySpend    float64 `json:"daily_spend"`
+	DailyBudget   float64 `json:"daily_budget,omitempty"`
+	MonthlySpend  float64 `json:"monthly_spend"`
+	MonthlyBudget float64 `json:"monthly_budget,omitempty"`
+	// Remaining is what is left of the tightest budget; nil without budgets.
+	Remaining *float64 `json:"remaining,omitempty"`
+	// Exceeded names the budget ("daily" or "monthly") that is used up.
+	Exceeded string `json:"exceeded,omitempty"`
+
+	resetIn time.Duration
+}
+
+func (s *spendTracker) status(key *config.KeyConfig) budgetStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now().UTC()
+	spend := s.current(key.Name, now)
+
+	status := budgetStatus{
+		Key:           key.Name,
+		DailySpend:    spend.daily,
+		DailyBudget:   key.DailyBudget,
+		MonthlySpend:  spend.monthly,
+		MonthlyBudget: key.MonthlyBudget,
+	}
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	for _, budget := range []struct {
+		name   string
+		limit  float64
+		spent  float64
+		resets time.Time
+	}{
+		{"monthly", key.MonthlyBudget, spend.monthly, nextMonth},
+		{"daily", key.DailyBudget, spend.daily, tomorrow},
+	} {
+		if budget.limit <= 0 {
+			continue
+		}
+		remaining := max(budget.limit-budget.spent, 0)
+		if status.Remaining == nil || remaining < *status.Remaining {
+			status.Remaining = &remaining
+		}
+		if remaining == 0 && status.Exceeded == "" {
+			status.Exceeded, status.resetIn = budget.name, budget.resets.Sub(now)
+		}
+	}
+	return status
+}
+
+func (s *spendTracker) charge(name string, cost float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spend := s.current(name, s.now())
+	spend.daily += cost
+	spend.monthly += cost
+}
+
+// HandleAdminBudgets serves /admin/budgets with the spend and remaining
+// budget of every client key.
+func (b *Broker) HandleAdminBudgets(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAdmin(w, r) {
+		return
+	}
+	b.mu.RLock()
+	keys := b.cfg.Keys
+	b.mu.RUnlock()
+
+	statuses := make([]budgetStatus, 0, len(keys))
+	for i := range keys {
+		statuses = append(statuses, b.spend.status(&keys[i]))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": statuses})
+}
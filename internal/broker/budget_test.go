@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Budgets(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 50, "completion_tokens": 20}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Server: config.ServerConfig{AdminKey: "admin-secret"},
+		Models: map[string]config.Model{
+			"gpt-4": {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{
+				URL:     mockBackend.URL + "/",
+				Model:   "gpt-4",
+				Pricing: config.PricingConfig{InputPerMillion: 10, OutputPerMillion: 30},
+			}},
+		},
+		Keys: []config.KeyConfig{{Name: "team-a", Key: "lmb-secret", DailyBudget: 0.001}},
+	})
+	now := time.Date(2025, 3, 14, 12, 0, 0, 0, time.UTC)
+	broker.spend.now = func() time.Time { return now }
+	handler := broker.Authenticate(broker.EnforceQuotas(http.HandlerFunc(broker.HandleChatCompletions)))
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Authorization", "Bearer lmb-secret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The first request costs 50*10/1M + 20*30/1M = $0.0011, using up the budget
+	rr := send()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get(budgetHeader) != "0.001000" {
+		t.Errorf("Expected the full budget to remain before the first request, got: %s", rr.Header().Get(budgetHeader))
+	}
+
+	rr = send()
+	if rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "insufficient_quota") || !strings.Contains(rr.Body.String(), "daily budget") {
+		t.Errorf("Expected a 429 naming the daily budget, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Retry-After") != "43200" {
+		t.Errorf("Expected Retry-After until midnight UTC, got: %s", rr.Header().Get("Retry-After"))
+	}
+
+	// The admin endpoint reports spend and needs the admin key
+	req := httptest.NewRequest("GET", "/admin/budgets", nil)
+	rr = httptest.NewRecorder()
+	broker.HandleAdminBudgets(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without the admin key, got: %d", rr.Code)
+	}
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	rr = httptest.NewRecorder()
+	broker.HandleAdminBudgets(rr, req)
+	var resp struct {
+		Keys []budgetStatus `json:"keys"`
+	}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if len(resp.Keys) != 1 || resp.Keys[0].Exceeded != "daily" || resp.Keys[0].DailySpend <= 0.001 {
+		t.Errorf("Expected team-a's daily budget to be exceeded, got: %+v", resp.Keys)
+	}
+
+	// A new day brings a fresh daily budget
+	now = now.Add(12 * time.Hour)
+	if rr = send(); rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 the next day, got: %d", rr.Code)
+	}
+}
+
+func TestBroker_BudgetsChargeStreams(t *testing.T) {
+	reportUsage := true
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			StreamOptions struct {
+				IncludeUsage bool `json:"include_usage"`
+			} `json:"stream_options"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.StreamOptions.IncludeUsage {
+			t.Errorf("Expected the stream to be asked for its usage")
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"id\": \"1\", \"object\": \"chat.completion.chunk\", \"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hello there, how are you today?\"}}]}\n\n"))
+		if reportUsage {
+			w.Write([]byte("data: {\"id\": \"1\", \"object\": \"chat.completion.chunk\", \"choices\": [], \"usage\": {\"prompt_tokens\": 50, \"completion_tokens\": 20}}\n\n"))
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+	defer mockBackend.Close()
+
+	key := config.KeyConfig{Name: "team-a", Key: "lmb-secret", DailyBudget: 1}
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4": {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{
+				URL:     mockBackend.URL + "/",
+				Model:   "gpt-4",
+				Pricing: config.PricingConfig{InputPerMillion: 10, OutputPerMillion: 30},
+			}},
+		},
+		Keys: []config.KeyConfig{key},
+	})
+	handler := broker.Authenticate(broker.EnforceQuotas(http.HandlerFunc(broker.HandleChatCompletions)))
+	send := func() float64 {
+		before := broker.spend.status(&key).DailySpend
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Authorization", "Bearer lmb-secret")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+		}
+		return broker.spend.status(&key).DailySpend - before
+	}
+
+	// The stream reports its usage when asked: 50*10/1M + 20*30/1M
+	if spent := send(); spent < 0.0010999 || spent > 0.0011001 {
+		t.Errorf("Expected the reported usage to be charged, got: %f", spent)
+	}
+
+	// A stream that still reports none is charged an estimate
+	reportUsage = false
+	if spent := send(); spent <= 0 {
+		t.Errorf("Expected a stream without usage to be charged, got: %f", spent)
+	}
+}
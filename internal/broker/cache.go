@@ -0,0 +1,310 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// cacheHeader tells the client whether a response came from the cache:
+// "hit" for an identical request, "semantic-hit" for a similar prompt, or
+// "miss".
+const cacheHeader = "X-LMBroker-Cache"
+
+var cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_cache_lookups_total",
+	Help: "Response cache lookups by alias and result (hit, semantic_hit or miss).",
+}, []string{"alias", "result"})
+
+// promptFields are the request fields that carry the prompt in any chat
+// dialect. Everything else must match exactly for a cached response to apply.
+var promptFields = []string{"messages", "system", "input", "instructions"}
+
+// cacheEntry is a stored response to one request or, in an embedding
+// cache, the vector of one input and the model that produced it.
+type cacheEntry struct {
+	exactKey    [32]byte
+	paramsKey   [32]byte
+	vector      []float64
+	contentType string
+	body        []byte
+	model       string
+	stored      time.Time
+}
+
+// responseCache holds the cached responses of one alias, oldest first.
+type responseCache struct {
+	mu      sync.Mutex
+	entries []*cacheEntry
+	exact   map[[32]byte]*cacheEntry
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{exact: make(map[[32]byte]*cacheEntry)}
+}
+
+// lookup returns the freshest matching entry: an identical request, or in
+// semantic mode the most similar prompt with the same parameters.
+func (c *responseCache) lookup(settings *config.CacheConfig, exactKey, paramsKey [32]byte, vector []float64, now time.Time) (*cacheEntry, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(settings.TTLDuration, now)
+	if entry, ok := c.exact[exactKey]; ok {
+		return entry, "hit"
+	}
+	if vector == nil {
+		return nil, "miss"
+	}
+	var best *cacheEntry
+	bestScore := settings.SimilarityThreshold
+	for _, entry := range c.entries {
+		if entry.paramsKey != paramsKey || entry.vector == nil {
+			continue
+		}
+		if score := cosineSimilarity(vector, entry.vector); score >= bestScore {
+			best, bestScore = entry, score
+		}
+	}
+	if best == nil {
+		return nil, "miss"
+	}
+	return best, "semantic_hit"
+}
+
+func (c *responseCache) store(settings *config.CacheConfig, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(settings.TTLDuration, entry.stored)
+	if previous, ok := c.exact[entry.exactKey]; ok {
+		c.remove(previous)
+	}
+	for len(c.entries) >= settings.MaxEntries {
+		c.remove(c.entries[0])
+	}
+	c.entries = append(c.entries, entry)
+	c.exact[entry.exactKey] = entry
+}
+
+// expire drops entries older than ttl. Callers hold c.mu.
+func (c *responseCache) expire(ttl time.Duration, now time.Time) {
+	for len(c.entries) > 0 && now.Sub(c.entries[0].stored) > ttl {
+		c.remove(c.entries[0])
+	}
+}
+
+// remove deletes an entry. Callers hold c.mu.
+func (c *responseCache) remove(entry *cacheEntry) {
+	for i, candidate := range c.entries {
+		if candidate == entry {
+			c.entries = append(c.entries[:i], c.entries[i+1:]...)
+			break
+		}
+	}
+	if c.exact[entry.exactKey] == entry {
+		delete(c.exact, entry.exactKey)
+	}
+}
+
+// cacheFor returns the response cache of an alias, creating it on first use.
+func (b *Broker) cacheFor(alias string) *responseCache {
+	b.cachesMu.Lock()
+	defer b.cachesMu.Unlock()
+	cache, ok := b.caches[alias]
+	if !ok {
+		cache = newResponseCache()
+		b.caches[alias] = cache
+	}
+	return cache
+}
+
+// withCache answers a chat request from the model's response cache when it
+// can, and otherwise serves it and stores a successful response. Streaming
+// requests and models without a cache are served as usual.
+func (b *Broker) withCache(w http.ResponseWriter, r *http.Request, clientAdapterType string, modelConfig *config.Model, serve func(w http.ResponseWriter)) {
+	settings := modelConfig.Cache
+	if settings == nil {
+		serve(w)
+		return
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	if envelope.Stream {
+		serve(w)
+		return
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		serve(w)
+		return
+	}
+
+	// 1. Key the request by its full content and by its non-prompt
+	// parameters, which must match exactly for a similar prompt to count.
+	// Unless the cache is shared, keys include the client key, so one key
+	// is never served another's responses.
+	delete(request, "model")
+	scope := clientAdapterType
+	if key, ok := clientKey(r); ok && key != nil && !settings.Shared {
+		scope += "\x00" + key.Name
+	}
+	exactKey := cacheKey(scope, request)
+	prompt := make(map[string]interface{})
+	for _, field := range promptFields {
+		if value, ok := request[field]; ok {
+			prompt[field] = value
+			delete(request, field)
+		}
+	}
+	paramsKey := cacheKey(scope, request)
+
+	// 2. In semantic mode, embed the prompt. If that fails the cache still
+	// matches identical requests.
+	var vector []float64
+	if settings.Mode == "semantic" {
+		if vector, err = b.embed(r.Context(), settings.EmbeddingAlias, promptText(prompt)); err != nil {
+			slog.Warn("failed to embed prompt for semantic cache", "alias", modelConfig.Alias, "error", err)
+		}
+	}
+
+	// 3. Serve a cached response if one matches.
+	cache := b.cacheFor(modelConfig.Alias)
+	entry, result := cache.lookup(settings, exactKey, paramsKey, vector, time.Now())
+	cacheLookups.WithLabelValues(modelConfig.Alias, result).Inc()
+	if entry != nil {
+		noteCacheHit(r)
+		w.Header().Set("Content-Type", entry.contentType)
+		w.Header().Set(cacheHeader, strings.ReplaceAll(result, "_", "-"))
+		w.WriteHeader(http.StatusOK)
+		w.Write(entry.body)
+		return
+	}
+
+	// 4. Otherwise serve the request and keep a successful response.
+	w.Header().Set(cacheHeader, "miss")
+	capture := newCaptureWriter(w)
+	serve(capture)
+	if capture.status != http.StatusOK || !strings.HasPrefix(capture.Header().Get("Content-Type"), "application/json") {
+		return
+	}
+	cache.store(settings, &cacheEntry{
+		exactKey:    exactKey,
+		paramsKey:   paramsKey,
+		vector:      vector,
+		contentType: capture.Header().Get("Content-Type"),
+		body:        bytes.Clone(capture.body.Bytes()),
+		stored:      time.Now(),
+	})
+}
+
+// cacheKey hashes a request within a scope, such as its dialect and client
+// key. Object keys are encoded in sorted order, so field order does not
+// matter.
+func cacheKey(scope string, request map[string]interface{}) [32]byte {
+	encoded, _ := json.Marshal(request)
+	return sha256.Sum256(append([]byte(scope+"\n"), encoded...))
+}
+
+// promptText flattens the prompt fields into the text that is embedded.
+func promptText(prompt map[string]interface{}) string {
+	var parts []string
+	var collect func(value interface{})
+	collect = func(value interface{}) {
+		switch v := value.(type) {
+		case string:
+			parts = append(parts, v)
+		case []interface{}:
+			for _, item := range v {
+				collect(item)
+			}
+		case map[string]interface{}:
+			if role, ok := v["role"].(string); ok {
+				parts = append(parts, role+":")
+			}
+			for _, key := range []string{"content", "text"} {
+				if content, ok := v[key]; ok {
+					collect(content)
+				}
+			}
+		}
+	}
+	for _, field := range promptFields {
+		if value, ok := prompt[field]; ok {
+			collect(value)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// embed runs text through an embedding alias, routed like any other
+// OpenAI-format request, and returns its vector.
+func (b *Broker) embed(ctx context.Context, alias, text string) ([]float64, error) {
+	modelConfig, ok := b.findModelConfig(alias)
+	if !ok {
+		return nil, fmt.Errorf("embedding alias %q not found", alias)
+	}
+	body, err := json.Marshal(map[string]interface{}{"model": alias, "input": text})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(withoutRequestInfo(ctx), "POST", "/v1/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	capture := newCaptureWriter(nil)
+	b.withFailover(capture, req, modelConfig, func(w http.ResponseWriter, modelConfig *config.Model) {
+		b.dispatchEmbedding(w, req, "openai", modelConfig)
+	})
+	if capture.status >= 400 {
+		return nil, fmt.Errorf("embedding alias returned status %d: %s", capture.status, capture.body.String())
+	}
+
+	var resp struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(capture.body.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("failed to decode embedding response: %w", err)
+	}
+	if len(resp.Data) == 0 || len(resp.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("embedding alias returned no vector")
+	}
+	return resp.Data[0].Embedding, nil
+}
+
+// cosineSimilarity compares two vectors; vectors of different lengths,
+// e.g. from a changed embedding model, never match.
+func cosineSimilarity(a, b []float64) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += a[i] * b[i]
+		normA += a[i] * a[i]
+		normB += b[i] * b[i]
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,216 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Cache(t *testing.T) {
+	var chatCalls, embeddingCalls atomic.Int32
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/embeddings") {
+			embeddingCalls.Add(1)
+			// Prompts about the weather embed close together.
+			vector := `[0.1, 0.9]`
+			if strings.Contains(string(body), "weather") {
+				vector = `[0.9, 0.1]`
+			}
+			w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": ` + vector + `}], "usage": {"prompt_tokens": 5, "total_tokens": 5}}`))
+			return
+		}
+		chatCalls.Add(1)
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Sunny"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 12, "completion_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	cache := &config.CacheConfig{Mode: "semantic", TTLDuration: time.Hour, MaxEntries: 10, EmbeddingAlias: "embedder", SimilarityThreshold: 0.95}
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"cached-gpt": {Alias: "cached-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}, Cache: cache},
+			"embedder":   {Alias: "embedder", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "text-embedding-3-small"}},
+		},
+	})
+	send := func(body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+		}
+		return rr
+	}
+
+	rr := send(`{"model": "cached-gpt", "messages": [{"role": "user", "content": "What is the weather in Paris?"}]}`)
+	if rr.Header().Get(cacheHeader) != "miss" || chatCalls.Load() != 1 {
+		t.Fatalf("Expected the first request to miss, got: %q after %d calls", rr.Header().Get(cacheHeader), chatCalls.Load())
+	}
+
+	// An identical request, even with fields reordered, is served from the cache.
+	rr = send(`{"messages": [{"content": "What is the weather in Paris?", "role": "user"}], "model": "cached-gpt"}`)
+	if rr.Header().Get(cacheHeader) != "hit" || chatCalls.Load() != 1 || !strings.Contains(rr.Body.String(), "Sunny") {
+		t.Errorf("Expected an exact hit, got: %q after %d calls (%s)", rr.Header().Get(cacheHeader), chatCalls.Load(), rr.Body.String())
+	}
+
+	// A similar prompt is a semantic hit; a different one is not.
+	rr = send(`{"model": "cached-gpt", "messages": [{"role": "user", "content": "Tell me the weather in Paris"}]}`)
+	if rr.Header().Get(cacheHeader) != "semantic-hit" || chatCalls.Load() != 1 {
+		t.Errorf("Expected a semantic hit, got: %q after %d calls", rr.Header().Get(cacheHeader), chatCalls.Load())
+	}
+	rr = send(`{"model": "cached-gpt", "messages": [{"role": "user", "content": "Write a haiku about autumn"}]}`)
+	if rr.Header().Get(cacheHeader) != "miss" || chatCalls.Load() != 2 {
+		t.Errorf("Expected a dissimilar prompt to miss, got: %q after %d calls", rr.Header().Get(cacheHeader), chatCalls.Load())
+	}
+
+	// Similar prompts only match with the same parameters.
+	rr = send(`{"model": "cached-gpt", "temperature": 1.5, "messages": [{"role": "user", "content": "Tell me the weather in Paris"}]}`)
+	if rr.Header().Get(cacheHeader) != "miss" || chatCalls.Load() != 3 {
+		t.Errorf("Expected different parameters to miss, got: %q after %d calls", rr.Header().Get(cacheHeader), chatCalls.Load())
+	}
+
+	// Streams are never cached.
+	calls := chatCalls.Load()
+	send(`{"model": "cached-gpt", "stream": true, "messages": [{"role": "user", "content": "What is the weather in Paris?"}]}`)
+	if chatCalls.Load() != calls+1 {
+		t.Errorf("Expected a streaming request to reach the backend")
+	}
+	if embeddingCalls.Load() != 5 {
+		t.Errorf("Expected one embedding per non-streaming request, got: %d", embeddingCalls.Load())
+	}
+}
+
+func TestBroker_CachePerKey(t *testing.T) {
+	var chatCalls atomic.Int32
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chatCalls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "Sunny"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 12, "completion_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	cache := &config.CacheConfig{Mode: "exact", TTLDuration: time.Hour, MaxEntries: 10}
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"cached-gpt": {Alias: "cached-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}, Cache: cache},
+		},
+	})
+	send := func(key string) string {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "cached-gpt", "messages": [{"role": "user", "content": "What is the weather in Paris?"}]}`))
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyKey, &config.KeyConfig{Name: key}))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr.Header().Get(cacheHeader)
+	}
+
+	// One key's response is not served to another
+	if send("a") != "miss" || send("a") != "hit" {
+		t.Fatalf("Expected a key's repeated request to hit")
+	}
+	if result := send("b"); result != "miss" || chatCalls.Load() != 2 {
+		t.Errorf("Expected another key to miss, got: %q after %d calls", result, chatCalls.Load())
+	}
+
+	// Unless the cache is shared
+	cache.Shared = true
+	send("a")
+	if result := send("b"); result != "hit" {
+		t.Errorf("Expected a shared cache to hit across keys, got: %q", result)
+	}
+}
+
+func TestResponseCache_Eviction(t *testing.T) {
+	settings := &config.CacheConfig{TTLDuration: time.Minute, MaxEntries: 2}
+	cache := newResponseCache()
+	start := time.Unix(1700000000, 0)
+	for i, key := range [][32]byte{{1}, {2}, {3}} {
+		cache.store(settings, &cacheEntry{exactKey: key, stored: start.Add(time.Duration(i) * 30 * time.Second)})
+	}
+	if entry, _ := cache.lookup(settings, [32]byte{1}, [32]byte{}, nil, start.Add(time.Minute)); entry != nil {
+		t.Errorf("Expected the oldest entry to be evicted")
+	}
+	if entry, _ := cache.lookup(settings, [32]byte{3}, [32]byte{}, nil, start.Add(time.Minute)); entry == nil {
+		t.Errorf("Expected the newest entry to be cached")
+	}
+	if entry, _ := cache.lookup(settings, [32]byte{2}, [32]byte{}, nil, start.Add(2*time.Minute)); entry != nil {
+		t.Errorf("Expected an entry older than the TTL to expire")
+	}
+}
+
+func TestBroker_EmbeddingCache(t *testing.T) {
+	var requested []string
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		requested = append(requested, strings.Join(req.Input, "|"))
+		data := make([]string, len(req.Input))
+		for i, input := range req.Input {
+			data[i] = fmt.Sprintf(`{"object": "embedding", "index": %d, "embedding": [%d]}`, i, len(input))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object": "list", "model": "text-embedding-3-small", "data": [` + strings.Join(data, ",") + `], "usage": {"prompt_tokens": 3, "total_tokens": 3}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"embedder": {Alias: "embedder", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "text-embedding-3-small"},
+				Cache: &config.CacheConfig{Mode: "exact", TTLDuration: time.Hour, MaxEntries: 10}},
+		},
+	})
+	send := func(body string) (*httptest.ResponseRecorder, []int) {
+		rr := httptest.NewRecorder()
+		broker.HandleEmbeddings(rr, httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			Data []struct {
+				Index     int   `json:"index"`
+				Embedding []int `json:"embedding"`
+			} `json:"data"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		var vectors []int
+		for i, item := range resp.Data {
+			if item.Index != i {
+				t.Errorf("Expected data in input order, got index %d at %d", item.Index, i)
+			}
+			vectors = append(vectors, item.Embedding[0])
+		}
+		return rr, vectors
+	}
+
+	rr, vectors := send(`{"model": "embedder", "input": ["a", "bb", "a"]}`)
+	if rr.Header().Get(cacheHeader) != "miss" || fmt.Sprint(vectors) != "[1 2 1]" || requested[0] != "a|bb" {
+		t.Errorf("Expected unique inputs to be embedded once, got: %q %v %v", rr.Header().Get(cacheHeader), vectors, requested)
+	}
+
+	// Only the new input reaches the backend; the response mixes both.
+	rr, vectors = send(`{"model": "embedder", "input": ["ccc", "bb"]}`)
+	if rr.Header().Get(cacheHeader) != "partial" || fmt.Sprint(vectors) != "[3 2]" || len(requested) != 2 || requested[1] != "ccc" {
+		t.Errorf("Expected a partial hit embedding only ccc, got: %q %v %v", rr.Header().Get(cacheHeader), vectors, requested)
+	}
+
+	rr, vectors = send(`{"model": "embedder", "input": "bb"}`)
+	if rr.Header().Get(cacheHeader) != "hit" || fmt.Sprint(vectors) != "[2]" || len(requested) != 2 {
+		t.Errorf("Expected a full hit, got: %q %v %v", rr.Header().Get(cacheHeader), vectors, requested)
+	}
+
+	// Other parameters change the vectors, so they are keyed separately.
+	send(`{"model": "embedder", "input": "bb", "dimensions": 256}`)
+	if len(requested) != 3 {
+		t.Errorf("Expected a request with other dimensions to miss, got: %v", requested)
+	}
+}
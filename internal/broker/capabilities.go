@@ -0,0 +1,334 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+	"lmbroker/internal/tokenizer"
+)
+
+// degradedHeader lists the features stripped from a degraded request.
+const degradedHeader = "X-LMBroker-Degraded"
+
+// truncatedHeader counts the messages dropped from a request that did not
+// fit in the model's context window.
+const truncatedHeader = "X-LMBroker-Truncated"
+
+// unsupported reports whether a capability is declared unsupported.
+func unsupported(feature *bool) bool {
+	return feature != nil && !*feature
+}
+
+// chatFeatures are the features a chat request uses, in any client dialect.
+type chatFeatures struct {
+	tools     bool
+	images    bool
+	jsonMode  bool
+	stream    bool
+	maxTokens int
+}
+
+// detectFeatures inspects a decoded chat request body.
+func detectFeatures(req map[string]interface{}) chatFeatures {
+	var features chatFeatures
+	for _, field := range []string{"tools", "functions"} {
+		if list, ok := req[field].([]interface{}); ok && len(list) > 0 {
+			features.tools = true
+		}
+	}
+	features.images = hasImage(req["messages"]) || hasImage(req["input"])
+	if format, ok := req["response_format"].(map[string]interface{}); ok && isJSONFormat(format) {
+		features.jsonMode = true
+	}
+	if text, ok := req["text"].(map[string]interface{}); ok {
+		if format, ok := text["format"].(map[string]interface{}); ok && isJSONFormat(format) {
+			features.jsonMode = true
+		}
+	}
+	features.stream, _ = req["stream"].(bool)
+	for _, field := range []string{"max_tokens", "max_completion_tokens", "max_output_tokens"} {
+		if n, ok := req[field].(float64); ok {
+			features.maxTokens = int(n)
+		}
+	}
+	return features
+}
+
+func isJSONFormat(format map[string]interface{}) bool {
+	return format["type"] == "json_object" || format["type"] == "json_schema"
+}
+
+// hasImage reports whether a decoded value holds an image content block.
+func hasImage(value interface{}) bool {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if hasImage(item) {
+				return true
+			}
+		}
+	case map[string]interface{}:
+		switch v["type"] {
+		case "image", "image_url", "input_image":
+			return true
+		}
+		return hasImage(v["content"])
+	}
+	return false
+}
+
+// checkCapabilities rejects chat requests that use a feature the model is
+// declared not to support. It returns false after writing a 400 naming the
+// problem. Models that degrade have unsupported tools, images and JSON mode
+// stripped from the request instead, listed in degradedHeader.
+func (b *Broker) checkCapabilities(w http.ResponseWriter, r *http.Request, modelConfig *config.Model) bool {
+	caps := modelConfig.Capabilities
+	if caps.Tools == nil && caps.Vision == nil && caps.JSONMode == nil && caps.Streaming == nil {
+		return true
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return false
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(envelope.Raw, &req); err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return false
+	}
+	features := detectFeatures(req)
+
+	var stripped []string
+	for _, check := range []struct {
+		used      bool
+		supported *bool
+		name      string
+		label     string
+		strip     func(map[string]interface{})
+	}{
+		{features.tools, caps.Tools, "tools", "tools", stripTools},
+		{features.images, caps.Vision, "image inputs", "images", stripImages},
+		{features.jsonMode, caps.JSONMode, "JSON mode", "json_mode", stripJSONMode},
+		{features.stream, caps.Streaming, "streaming", "streaming", nil},
+	} {
+		if !check.used || !unsupported(check.supported) {
+			continue
+		}
+		if caps.Degrade && check.strip != nil {
+			check.strip(req)
+			stripped = append(stripped, check.label)
+			continue
+		}
+		slog.Warn("rejected request for unsupported capability", "alias", modelConfig.Alias, "capability", check.name)
+		workflows.WriteErrorCode(w, r, http.StatusBadRequest, "unsupported_capability", "", fmt.Sprintf("model %s does not support %s", modelConfig.Alias, check.name))
+		return false
+	}
+	if len(stripped) > 0 {
+		body, err := json.Marshal(req)
+		if err != nil {
+			workflows.WriteError(w, r, http.StatusInternalServerError, "failed to encode request body")
+			return false
+		}
+		workflows.SetBody(r, body)
+		slog.Warn("stripped unsupported features from request", "alias", modelConfig.Alias, "removed", stripped)
+		w.Header().Set(degradedHeader, strings.Join(stripped, ", "))
+	}
+	return true
+}
+
+// fitContextWindow handles chat requests that do not fit in the model's
+// context window as its overflow setting says: they are rejected, their
+// oldest non-system messages are dropped until they fit, or they are handed
+// to the overflow alias. It returns the model to serve the request, or
+// false after writing a 400.
+func (b *Broker) fitContextWindow(w http.ResponseWriter, r *http.Request, modelConfig *config.Model) (*config.Model, bool) {
+	caps := modelConfig.Capabilities
+	if caps.MaxContext == 0 {
+		return modelConfig, true
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return nil, false
+	}
+	var req map[string]interface{}
+	if err := json.Unmarshal(envelope.Raw, &req); err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return nil, false
+	}
+	requested := detectFeatures(req).maxTokens
+	tok := b.tokenizerFor(modelConfig)
+	prompt := countPromptTokens(tok, envelope.Raw)
+	maxTokens := outputTokens(modelConfig, requested)
+	if prompt+maxTokens <= caps.MaxContext {
+		return modelConfig, true
+	}
+
+	switch caps.Overflow {
+	case "truncate":
+		if dropped, ok := truncateOldest(tok, req, prompt, caps.MaxContext-maxTokens); ok {
+			body, err := json.Marshal(req)
+			if err != nil {
+				workflows.WriteError(w, r, http.StatusInternalServerError, "failed to encode request body")
+				return nil, false
+			}
+			workflows.SetBody(r, body)
+			slog.Warn("truncated request exceeding the context window", "alias", modelConfig.Alias, "prompt_tokens", prompt, "max_context", caps.MaxContext, "dropped_messages", dropped)
+			w.Header().Set(truncatedHeader, strconv.Itoa(dropped))
+			return modelConfig, true
+		}
+	case "fallback":
+		// The overflow alias must fit the request itself; its own overflow
+		// setting is not followed, so aliases cannot hand requests around.
+		if overflow, ok := b.findModelConfig(caps.OverflowAlias); ok {
+			limit := overflow.Capabilities.MaxContext
+			if limit == 0 || countPromptTokens(b.tokenizerFor(overflow), envelope.Raw)+outputTokens(overflow, requested) <= limit {
+				body, err := withModelField(envelope.Raw, overflow.Alias)
+				if err != nil {
+					workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+					return nil, false
+				}
+				workflows.SetBody(r, body)
+				slog.Info("routing request exceeding the context window to its overflow alias", "alias", modelConfig.Alias, "overflow_alias", overflow.Alias, "prompt_tokens", prompt, "max_context", caps.MaxContext)
+				return overflow, true
+			}
+		}
+	}
+	slog.Warn("rejected request exceeding the context window", "alias", modelConfig.Alias, "prompt_tokens", prompt, "max_tokens", maxTokens, "max_context", caps.MaxContext)
+	workflows.WriteErrorCode(w, r, http.StatusBadRequest, "context_length_exceeded", "", fmt.Sprintf("model %s has a context window of %d tokens, but the prompt is about %d tokens and %d more were requested for the output", modelConfig.Alias, caps.MaxContext, prompt, maxTokens))
+	return nil, false
+}
+
+// outputTokens returns the output a request reserves in the context window:
+// its own token limit, or else the model's default.
+func outputTokens(modelConfig *config.Model, requested int) int {
+	if requested == 0 {
+		return modelConfig.MaxTokens
+	}
+	return requested
+}
+
+// truncateOldest drops the oldest non-system messages, or Responses input
+// items, of a decoded chat request until its prompt of about prompt tokens
+// fits in budget. The conversation then opens with a user turn, so no
+// orphaned tool results or assistant replies remain. The latest message is
+// always kept; it reports false, leaving req unchanged, if the request only
+// fits without it.
+func truncateOldest(tok tokenizer.Tokenizer, req map[string]interface{}, prompt, budget int) (int, bool) {
+	field, overhead := "messages", messageTokens
+	items, ok := req[field].([]interface{})
+	if !ok {
+		field, overhead = "input", 0
+		if items, ok = req[field].([]interface{}); !ok {
+			return 0, false
+		}
+	}
+
+	kept := append([]interface{}(nil), items...)
+	dropped := 0
+	for prompt > budget || (dropped > 0 && !opensConversation(kept)) {
+		oldest, remaining := -1, 0
+		for i, item := range kept {
+			if !isSystemItem(item) {
+				if oldest < 0 {
+					oldest = i
+				}
+				remaining++
+			}
+		}
+		if remaining <= 1 {
+			return 0, false
+		}
+		var texts []string
+		images := 0
+		collectText(kept[oldest], &texts, &images)
+		for _, text := range texts {
+			prompt -= tok.Count(text)
+		}
+		prompt -= images*imageTokenEstimate + overhead
+		kept = append(kept[:oldest], kept[oldest+1:]...)
+		dropped++
+	}
+	req[field] = kept
+	return dropped, true
+}
+
+// isSystemItem reports whether a message carries instructions, which
+// truncation keeps.
+func isSystemItem(item interface{}) bool {
+	message, _ := item.(map[string]interface{})
+	return message["role"] == "system" || message["role"] == "developer"
+}
+
+// opensConversation reports whether the first non-system message is a user
+// turn rather than a tool result.
+func opensConversation(items []interface{}) bool {
+	for _, item := range items {
+		if isSystemItem(item) {
+			continue
+		}
+		message, _ := item.(map[string]interface{})
+		if message["role"] != "user" || (message["type"] != nil && message["type"] != "message") {
+			return false
+		}
+		if blocks, ok := message["content"].([]interface{}); ok {
+			for _, block := range blocks {
+				if block, ok := block.(map[string]interface{}); ok && block["type"] == "tool_result" {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return true
+}
+
+// stripTools removes tool definitions and the settings that refer to them.
+func stripTools(req map[string]interface{}) {
+	for _, field := range []string{"tools", "tool_choice", "parallel_tool_calls", "functions", "function_call"} {
+		delete(req, field)
+	}
+}
+
+// stripImages replaces every image content block with a text note.
+func stripImages(req map[string]interface{}) {
+	for _, field := range []string{"messages", "input"} {
+		if value, ok := req[field]; ok {
+			req[field] = replaceImages(value)
+		}
+	}
+}
+
+func replaceImages(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		for i, item := range v {
+			v[i] = replaceImages(item)
+		}
+	case map[string]interface{}:
+		switch v["type"] {
+		case "image", "image_url":
+			return map[string]interface{}{"type": "text", "text": "[image removed]"}
+		case "input_image":
+			return map[string]interface{}{"type": "input_text", "text": "[image removed]"}
+		}
+		if content, ok := v["content"]; ok {
+			v["content"] = replaceImages(content)
+		}
+	}
+	return value
+}
+
+// stripJSONMode removes JSON output formats, leaving plain text.
+func stripJSONMode(req map[string]interface{}) {
+	delete(req, "response_format")
+	if text, ok := req["text"].(map[string]interface{}); ok {
+		delete(text, "format")
+	}
+}
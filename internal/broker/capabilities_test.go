@@ -0,0 +1,205 @@
+package broker
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+	"lmbroker/internal/tokenizer"
+)
+
+func TestBroker_Capabilities(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "ok"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	no := false
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"small": {
+				Alias:        "small",
+				Type:         "openai",
+				Target:       config.TargetConfig{URL: mockBackend.URL + "/", Model: "small-1"},
+				Capabilities: config.CapabilityConfig{MaxContext: 100, Tools: &no, Vision: &no, Streaming: &no},
+			},
+		},
+	})
+	send := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr
+	}
+
+	if rr := send("/v1/chat/completions", `{"model": "small", "messages": [{"role": "user", "content": "Hello"}]}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected a supported request to be served, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	for _, tc := range []struct {
+		name, path, body, expected string
+	}{
+		{"tools", "/v1/chat/completions", `{"model": "small", "messages": [{"role": "user", "content": "Hi"}], "tools": [{"type": "function", "function": {"name": "f"}}]}`, "model small does not support tools"},
+		{"vision", "/v1/messages", `{"model": "small", "max_tokens": 10, "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "url", "url": "https://example.com/a.png"}}]}]}`, "model small does not support image inputs"},
+		{"streaming", "/v1/chat/completions", `{"model": "small", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`, "model small does not support streaming"},
+		{"context", "/v1/chat/completions", `{"model": "small", "max_tokens": 90, "messages": [{"role": "user", "content": "` + strings.Repeat("a", 40) + `"}]}`, "context window of 100 tokens"},
+	} {
+		rr := send(tc.path, tc.body)
+		if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), tc.expected) {
+			t.Errorf("%s: Expected a 400 saying %q, got: %d %s", tc.name, tc.expected, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestBroker_CapabilitiesDegrade(t *testing.T) {
+	var received string
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "ok"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	no := false
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"text-only": {
+				Alias:        "text-only",
+				Type:         "openai",
+				Target:       config.TargetConfig{URL: mockBackend.URL + "/", Model: "text-1"},
+				Capabilities: config.CapabilityConfig{Tools: &no, Vision: &no, Streaming: &no, Degrade: true},
+			},
+		},
+	})
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{
+		"model": "text-only",
+		"messages": [{"role": "user", "content": [{"type": "text", "text": "What is this?"}, {"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}]}],
+		"tools": [{"type": "function", "function": {"name": "lookup"}}],
+		"tool_choice": "auto"
+	}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the degraded request to be served, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get(degradedHeader) != "tools, images" {
+		t.Errorf("Expected the removed features in %s, got: %q", degradedHeader, rr.Header().Get(degradedHeader))
+	}
+	if strings.Contains(received, "tools") || strings.Contains(received, "tool_choice") || strings.Contains(received, "image_url") || !strings.Contains(received, "[image removed]") {
+		t.Errorf("Expected tools and images to be stripped, got: %s", received)
+	}
+
+	// Streaming cannot be stripped and is still rejected
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "text-only", "stream": true, "messages": [{"role": "user", "content": "Hi"}]}`))
+	rr = httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected streaming to be rejected, got: %d", rr.Code)
+	}
+}
+
+func TestBroker_ContextOverflow(t *testing.T) {
+	var received struct {
+		Model    string `json:"model"`
+		Messages []struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		} `json:"messages"`
+	}
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "ok"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	model := func(alias string, caps config.CapabilityConfig) config.Model {
+		return config.Model{Alias: alias, Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: alias + "-1"}, Capabilities: caps}
+	}
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"truncating": model("truncating", config.CapabilityConfig{MaxContext: 100, Overflow: "truncate"}),
+			"routing":    model("routing", config.CapabilityConfig{MaxContext: 100, Overflow: "fallback", OverflowAlias: "long"}),
+			"long":       model("long", config.CapabilityConfig{MaxContext: 100000}),
+		},
+	})
+	send := func(alias string, messages ...string) *httptest.ResponseRecorder {
+		received.Model, received.Messages = "", nil
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+alias+`", "max_tokens": 20, "messages": [`+strings.Join(messages, ", ")+`]}`))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr
+	}
+	long := `{"role": "user", "content": "` + strings.Repeat("lorem ipsum dolor sit amet ", 30) + `"}`
+	conversation := []string{`{"role": "system", "content": "Be brief."}`, long, `{"role": "assistant", "content": "Noted."}`, `{"role": "user", "content": "And now?"}`}
+
+	// The oldest turns are dropped, keeping the system prompt and opening
+	// the conversation with a user turn
+	rr := send("truncating", conversation...)
+	if rr.Code != http.StatusOK || rr.Header().Get(truncatedHeader) != "2" {
+		t.Fatalf("Expected the request to be truncated, got: %d %q %s", rr.Code, rr.Header().Get(truncatedHeader), rr.Body.String())
+	}
+	if len(received.Messages) != 2 || received.Messages[0].Content != "Be brief." || received.Messages[1].Content != "And now?" {
+		t.Errorf("Expected the system prompt and the latest turn, got: %+v", received.Messages)
+	}
+
+	// The latest turn is never dropped
+	if rr := send("truncating", conversation[0], long); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "context_length_exceeded") {
+		t.Errorf("Expected a latest turn that does not fit to be rejected, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Requests that fit are left alone
+	if rr := send("truncating", conversation[3]); rr.Code != http.StatusOK || rr.Header().Get(truncatedHeader) != "" || len(received.Messages) != 1 {
+		t.Errorf("Expected a fitting request to be served unchanged, got: %d %+v", rr.Code, received.Messages)
+	}
+
+	// Overflowing requests for a fallback alias go to the long-context alias
+	if rr := send("routing", conversation...); rr.Code != http.StatusOK || received.Model != "long-1" || len(received.Messages) != 4 {
+		t.Errorf("Expected the long-context alias to serve the whole request, got: %d %s %+v", rr.Code, received.Model, received.Messages)
+	}
+	if rr := send("routing", conversation[3]); rr.Code != http.StatusOK || received.Model != "routing-1" {
+		t.Errorf("Expected a fitting request to stay on its alias, got: %d %s", rr.Code, received.Model)
+	}
+
+	// The overflow alias must be allowed for the client's key
+	keyed := New(&config.Config{
+		Models: map[string]config.Model{"routing": model("routing", config.CapabilityConfig{MaxContext: 100, Overflow: "fallback", OverflowAlias: "long"}), "long": model("long", config.CapabilityConfig{})},
+		Keys:   []config.KeyConfig{{Name: "limited", Key: "lmb-limited", Models: []string{"routing"}}},
+	})
+	received.Model = ""
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "routing", "max_tokens": 20, "messages": [`+strings.Join(conversation, ", ")+`]}`))
+	req.Header.Set("Authorization", "Bearer lmb-limited")
+	rr = httptest.NewRecorder()
+	keyed.Authenticate(http.HandlerFunc(keyed.HandleChatCompletions)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden || received.Model != "" {
+		t.Errorf("Expected 403 for an overflow alias outside the key's allowlist, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestTruncateOldest(t *testing.T) {
+	tok := tokenizer.Approximate
+	var req map[string]interface{}
+	json.Unmarshal([]byte(`{"messages": [
+		{"role": "user", "content": "`+strings.Repeat("word ", 50)+`"},
+		{"role": "assistant", "content": [{"type": "tool_use", "id": "t1", "name": "f", "input": {}}]},
+		{"role": "user", "content": [{"type": "tool_result", "tool_use_id": "t1", "content": "42"}]},
+		{"role": "assistant", "content": "It is 42."},
+		{"role": "user", "content": "Thanks"}
+	]}`), &req)
+	body, _ := json.Marshal(req)
+	prompt := countPromptTokens(tok, body)
+
+	// Tool results are not left without their call
+	dropped, ok := truncateOldest(tok, req, prompt, prompt-10)
+	messages := req["messages"].([]interface{})
+	if !ok || dropped != 4 || len(messages) != 1 || messages[0].(map[string]interface{})["content"] != "Thanks" {
+		t.Errorf("Expected the conversation to open with the latest user turn, got: %d %v", dropped, messages)
+	}
+}
@@ -3,20 +3,53 @@ package broker
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"strings"
+	"sync"
 
 	"lmbroker/internal/adapters"
 	"lmbroker/internal/broker/workflows"
 	"lmbroker/internal/config"
+	"lmbroker/internal/tokenizer"
+	"lmbroker/internal/toolgateway"
 )
 
 // Broker holds the state for the broker, including the configuration
 // and a map of initialized adapters.
 type Broker struct {
-	cfg      *config.Config
-	adapters map[string]adapters.Adapter
+	// mu guards the parts of the configuration that a reload replaces:
+	// cfg.Models, cfg.DefaultModel, cfg.Keys, cfg.Routes and rollouts.
+	mu          sync.RWMutex
+	cfg         *config.Config
+	adapters    map[string]adapters.Adapter
+	eval        *evalRecorder
+	tools       *toolgateway.Gateway
+	rollouts    map[string]*rollout
+	health      *healthChecker
+	latency     *latencyTracker
+	cooldown    *cooldownTracker
+	load        *loadTracker
+	concurrency *concurrencyLimiter
+	limiter     *rateLimiter
+	spend       *spendTracker
+	usage       *usageStore
+	content     *contentLog
+	requests    *requestStore
+	batches     *batchStore
+	jobs        *jobStore
+	webhooks    *webhookNotifier
+	tokenizers  *tokenizer.Registry
+
+	cachesMu sync.Mutex
+	caches   map[string]*responseCache
+
+	// adminMu serializes model changes made through the admin API.
+	adminMu sync.Mutex
 }
 
 // New creates a new Broker instance.
@@ -24,57 +57,157 @@ func New(cfg *config.Config) *Broker {
 	// Initialize all the adapters we support.
 	initializedAdapters := make(map[string]adapters.Adapter)
 	initializedAdapters["openai"] = &adapters.OpenAIAdapter{}
+	initializedAdapters["azure_openai"] = &adapters.OpenAIAdapter{}
 	initializedAdapters["anthropic"] = &adapters.AnthropicAdapter{}
+	initializedAdapters["vertex_anthropic"] = &adapters.AnthropicAdapter{}
+	initializedAdapters["vertex_gemini"] = &adapters.OpenAIAdapter{}
+	initializedAdapters["gemini"] = &adapters.GeminiAdapter{}
+	initializedAdapters["ollama"] = &adapters.OllamaAdapter{}
+	initializedAdapters["voyage"] = &adapters.VoyageAdapter{}
+	initializedAdapters["cohere"] = &adapters.CohereAdapter{}
+	initializedAdapters["openai_responses"] = &adapters.ResponsesAdapter{}
+	initializedAdapters["mock"] = &adapters.OpenAIAdapter{}
+	initializedAdapters["vllm"] = &adapters.VLLMAdapter{}
+	initializedAdapters["tgi"] = &adapters.VLLMAdapter{TGI: true}
+	initializedAdapters["groq"] = &adapters.GroqAdapter{}
+	initializedAdapters["together"] = &adapters.TogetherAdapter{}
 
-	return &Broker{
-		cfg:      cfg,
-		adapters: initializedAdapters,
+	b := &Broker{
+		cfg:         cfg,
+		adapters:    initializedAdapters,
+		eval:        &evalRecorder{path: cfg.Eval.LogFile},
+		tools:       toolgateway.New(cfg.Gateway),
+		rollouts:    newRollouts(cfg.Models, nil, nil),
+		health:      newHealthChecker(cfg),
+		latency:     newLatencyTracker(),
+		cooldown:    newCooldownTracker(),
+		load:        newLoadTracker(),
+		concurrency: newConcurrencyLimiter(cfg.Concurrency),
+		limiter:     newRateLimiter(),
+		spend:       newSpendTracker(),
+		usage:       newUsageStore(cfg.Usage.LogFile),
+		content:     newContentLog(cfg.ContentLog),
+		requests:    newRequestStore(cfg.RequestLog),
+		batches:     newBatchStore(cfg.Batches),
+		jobs:        newJobStore(cfg.Async),
+		webhooks:    newWebhookNotifier(cfg.Webhooks),
+		tokenizers:  newTokenizers(cfg),
+		caches:      make(map[string]*responseCache),
 	}
+	b.health.onDown = b.notifyUnhealthy
+	return b
+}
+
+// Close releases the files the broker keeps open, once it has stopped
+// serving requests.
+func (b *Broker) Close() error {
+	return b.eval.close()
 }
 
 // extractModelFromRequest extracts the model name from the request body
 func (b *Broker) extractModelFromRequest(r *http.Request) (string, error) {
-	// Read the body
-	body, err := io.ReadAll(r.Body)
+	// Read the body once; later stages share it through the envelope.
+	envelope, err := workflows.ReadEnvelope(r)
 	if err != nil {
 		return "", err
 	}
-	
-	// Restore the body for later use
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
-	
-	// Parse JSON to extract model
-	var reqData struct {
-		Model string `json:"model"`
+
+	// Uploads (e.g. audio transcriptions) carry the model as a form field.
+	if mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == "multipart/form-data" {
+		return modelFromMultipart(envelope.Raw, params["boundary"])
 	}
 	
-	if err := json.Unmarshal(body, &reqData); err != nil {
-		return "", err
+	return envelope.Model, envelope.Err
+}
+
+// modelFromMultipart returns the value of the model field of a multipart
+// form body.
+func modelFromMultipart(body []byte, boundary string) (string, error) {
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", fmt.Errorf("multipart form has no model field")
+		}
+		if err != nil {
+			return "", err
+		}
+		if part.FormName() == "model" {
+			value, err := io.ReadAll(part)
+			return strings.TrimSpace(string(value)), err
+		}
 	}
-	
-	return reqData.Model, nil
 }
 
 // findModelConfig finds the model configuration for the specified alias
 func (b *Broker) findModelConfig(modelAlias string) (*config.Model, bool) {
+	b.mu.RLock()
 	model, ok := b.cfg.Models[modelAlias]
+	b.mu.RUnlock()
 	if !ok {
 		return nil, false
 	}
 	return &model, true
 }
 
+// resolveModel finds the model configuration for the alias a client asked
+// for. A routing rule, then the client key's routes, may send the request
+// to another alias, and unknown aliases are served by the configured
+// default model. Either way the request's model field is rewritten to the
+// serving alias so the rest of the pipeline sees an ordinary request for it.
+func (b *Broker) resolveModel(r *http.Request, modelAlias string) (*config.Model, bool) {
+	alias := b.applyRoutes(r, modelAlias)
+	if key, ok := clientKey(r); ok && key.Routes[alias] != "" {
+		alias = key.Routes[alias]
+	}
+	modelConfig, ok := b.findModelConfig(alias)
+	if !ok {
+		b.mu.RLock()
+		defaultModel := b.cfg.DefaultModel
+		b.mu.RUnlock()
+		if defaultModel == "" {
+			return nil, false
+		}
+		if modelConfig, ok = b.findModelConfig(defaultModel); !ok {
+			return nil, false
+		}
+		slog.Info("routing unknown model to default", "requested", modelAlias, "alias", modelConfig.Alias)
+	}
+	if modelConfig.Alias == modelAlias {
+		return modelConfig, true
+	}
+
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		return nil, false
+	}
+	var body []byte
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mediaType == "multipart/form-data" {
+		body, err = workflows.RewriteMultipartModel(envelope.Raw, r.Header.Get("Content-Type"), modelConfig.Alias)
+	} else {
+		body, err = withModelField(envelope.Raw, modelConfig.Alias)
+	}
+	if err != nil {
+		return nil, false
+	}
+	workflows.SetBody(r, body)
+	return modelConfig, true
+}
+
 // HandleChatCompletions is the main handler for all chat completion requests.
 func (b *Broker) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	slog.Info("received chat completion request")
+	r = b.watchRateLimits(r)
+	slog.Info("received chat completion request", "request_id", requestID(r), "client_ip", b.clientIP(r))
 	// 1. Identify the client adapter from the request path.
 	var clientAdapterType string
 	if r.URL.Path == "/v1/chat/completions" {
 		clientAdapterType = "openai"
 	} else if r.URL.Path == "/v1/messages" {
 		clientAdapterType = "anthropic"
+	} else if r.URL.Path == "/v1/responses" {
+		clientAdapterType = "openai_responses"
 	} else {
-		http.Error(w, "unsupported endpoint", http.StatusNotFound)
+		workflows.WriteError(w, r, http.StatusNotFound, "unsupported endpoint")
 		return
 	}
 
@@ -82,29 +215,147 @@ func (b *Broker) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	modelName, err := b.extractModelFromRequest(r)
 	if err != nil {
 		slog.Error("failed to extract model from request", "error", err)
-		http.Error(w, "failed to parse request body", http.StatusBadRequest)
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+
+	// 2.5. In strict mode, reject malformed requests before routing.
+	if !b.validateRequest(w, r, clientAdapterType) {
 		return
 	}
 	
-	// 3. Find model configuration for this alias
-	modelConfig, ok := b.findModelConfig(modelName)
+	// 3. Find model configuration for this alias, or the default model
+	modelConfig, ok := b.resolveModel(r, modelName)
 	if !ok {
 		slog.Error("no model configuration found", "alias", modelName)
-		http.Error(w, "model not supported", http.StatusNotFound)
+		workflows.WriteError(w, r, http.StatusNotFound, "model not supported")
+		return
+	}
+
+	// 3.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 3.6. Reject requests the model is declared unable to serve, and deal
+	// with prompts that overflow its context window.
+	if !b.checkCapabilities(w, r, modelConfig) {
 		return
 	}
-	slog.Info("routing to provider", "alias", modelName, "target_model", modelConfig.Target.Model, "provider_type", modelConfig.Type, "target_url", modelConfig.Target.URL)
+	alias := modelConfig.Alias
+	if modelConfig, ok = b.fitContextWindow(w, r, modelConfig); !ok {
+		return
+	}
+	// An overflow alias is checked like the alias the client asked for.
+	if modelConfig.Alias != alias && (!b.authorizeModel(w, r, modelConfig) || !b.checkCapabilities(w, r, modelConfig)) {
+		return
+	}
+
+	// 3.7. Put the request on its arm of the alias's experiment, keeping
+	// each user on the same arm.
+	w, modelConfig, finishExperiment := b.assignExperimentArm(w, r, modelConfig)
+	defer finishExperiment()
+	slog.Info("routing to provider", "request_id", requestID(r), "alias", modelName, "target_model", modelConfig.Target.Model, "provider_type", modelConfig.Type, "target_url", modelConfig.Target.URL)
 
-	// 4. Compare client and provider types.
-	if clientAdapterType == modelConfig.Type {
+	// 3.8. Mirror a share of the alias's traffic to its shadow target,
+	// comparing the two once the primary has answered.
+	w, finishShadow := b.startShadow(w, r, clientAdapterType, modelConfig)
+	defer finishShadow()
+
+	// 4. If an eval comparison applies, mirror the request to the secondary
+	// alias; the client only ever sees the primary's response.
+	if evalConfig, ok := b.evalTargetFor(r, modelConfig); ok {
+		noteServedTarget(r, modelConfig)
+		b.dispatchChatWithEval(w, r, clientAdapterType, modelConfig, evalConfig)
+		return
+	}
+
+	// 5. Serve the request from the model's cache, or else falling back
+	// along the model's chain if the target fails.
+	b.withCache(w, r, clientAdapterType, modelConfig, func(w http.ResponseWriter) {
+		b.withFailover(w, r, modelConfig, func(w http.ResponseWriter, modelConfig *config.Model) {
+			noteServedTarget(r, modelConfig)
+			b.dispatchChat(w, r, clientAdapterType, modelConfig)
+		})
+	})
+}
+
+// dispatchChat sends a chat request to the model's target using the
+// passthrough or translation workflow as appropriate.
+func (b *Broker) dispatchChat(w http.ResponseWriter, r *http.Request, clientAdapterType string, modelConfig *config.Model) {
+	// Broker-side stages (gateway tools, guardrails, system prompts, prompt
+	// compression, code execution rewrites) work on the unified request, so
+	// they always translate, even between identical formats.
+	rewritesCodeExecution := modelConfig.CodeExecution != "" && modelConfig.CodeExecution != "native"
+	if len(modelConfig.GatewayTools) > 0 || modelConfig.Guardrails != nil || modelConfig.SystemPrompt.Enabled() || modelConfig.Compression.MaxPromptTokens > 0 || rewritesCodeExecution {
+		slog.Info("performing extended translation")
+		clientAdapter := b.adapters[clientAdapterType]
+		providerAdapter := b.adapters[modelConfig.Type]
+		noteWorkflow(r, "translation")
+		workflows.HandleExtendedTranslation(w, r, clientAdapter, providerAdapter, providerEndpoint(modelConfig, "chat/completions"), modelConfig, workflows.Extensions{Tools: b.tools, Summarizer: b, Moderator: b, Notifier: b})
+		return
+	}
+
+	// OpenAI serves Responses clients natively unless the model is marked
+	// chat-only; every other backend is reached through translation.
+	if clientAdapterType == "openai_responses" && modelConfig.Type == "openai" && !modelConfig.ResponsesViaChat {
+		slog.Info("performing passthrough")
+		noteWorkflow(r, "passthrough")
+		workflows.HandlePassthrough(w, r, providerEndpoint(modelConfig, "responses"), modelConfig)
+		return
+	}
+
+	// Compare client and provider formats.
+	if clientAdapterType == dialectOf(modelConfig.Type) {
+		if !b.prepareRequestBody(w, r, modelConfig) {
+			return
+		}
 		slog.Info("performing passthrough")
 		// If they match, use the efficient passthrough workflow.
-		workflows.HandlePassthrough(w, r, modelConfig.Target.URL+"chat/completions", modelConfig)
+		noteWorkflow(r, "passthrough")
+		workflows.HandlePassthrough(w, r, providerEndpoint(modelConfig, "chat/completions"), modelConfig)
 	} else {
 		slog.Info("performing translation")
 		// If they don't match, use the translation workflow.
 		clientAdapter := b.adapters[clientAdapterType]
 		providerAdapter := b.adapters[modelConfig.Type]
-		workflows.HandleTranslation(w, r, clientAdapter, providerAdapter, modelConfig.Target.URL+"chat/completions", modelConfig)
+		noteWorkflow(r, "translation")
+		workflows.HandleTranslation(w, r, clientAdapter, providerAdapter, providerEndpoint(modelConfig, "chat/completions"), modelConfig)
+	}
+}
+
+// prepareRequestBody lets the adapter of a self-hosted server check, and
+// rewrite, the extra parameters of a request passed through to it. It
+// returns false after answering 400 for a parameter the server would
+// reject.
+func (b *Broker) prepareRequestBody(w http.ResponseWriter, r *http.Request, modelConfig *config.Model) bool {
+	native, ok := b.adapters[modelConfig.Type].(*adapters.VLLMAdapter)
+	if !ok {
+		return true
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return false
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(envelope.Raw, &body); err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return false
+	}
+	if err := native.PrepareBody(body); err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, err.Error())
+		return false
+	}
+	// Only TGI bodies are rewritten.
+	if !native.TGI {
+		return true
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusInternalServerError, "failed to encode request body")
+		return false
 	}
+	workflows.SetBody(r, raw)
+	return true
 }
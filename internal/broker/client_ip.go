@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// contextKey is the type for values the broker stores on request contexts.
+type contextKey int
+
+const (
+	clientIPKey contextKey = iota
+	clientKeyKey
+	requestInfoKey
+	requestIDKey
+	batchRequestKey
+)
+
+// ResolveClientIP is a middleware that determines the real client address
+// and stores it on the request context for logging and access control.
+// Forwarding headers are only honored when the direct peer is a trusted proxy.
+func (b *Broker) ResolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := b.resolveClientIP(r)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey, ip)))
+	})
+}
+
+// clientIP returns the address resolved by ResolveClientIP, falling back to
+// resolving it on the spot when the middleware was not installed.
+func (b *Broker) clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+	return b.resolveClientIP(r)
+}
+
+// resolveClientIP walks X-Forwarded-For from right to left, skipping trusted
+// hops, and returns the first untrusted address. X-Real-IP is used when no
+// X-Forwarded-For header is present.
+func (b *Broker) resolveClientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	if !b.isTrustedProxy(remote) {
+		return remote
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		var hops []string
+		for _, value := range forwarded {
+			for _, hop := range strings.Split(value, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					hops = append(hops, hop)
+				}
+			}
+		}
+		for i := len(hops) - 1; i >= 0; i-- {
+			if !b.isTrustedProxy(hops[i]) {
+				return hops[i]
+			}
+		}
+		// Every hop is trusted; the left-most entry is the best we have.
+		if len(hops) > 0 {
+			return hops[0]
+		}
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	return remote
+}
+
+// isTrustedProxy reports whether the address falls in a configured
+// trusted_proxies range.
+func (b *Broker) isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range b.cfg.Server.TrustedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
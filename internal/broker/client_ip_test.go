@@ -0,0 +1,53 @@
+package broker
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_ResolveClientIP(t *testing.T) {
+	broker := &Broker{
+		cfg: &config.Config{
+			Server: config.ServerConfig{
+				TrustedPrefixes: []netip.Prefix{
+					netip.MustParsePrefix("10.0.0.0/8"),
+					netip.MustParsePrefix("127.0.0.1/32"),
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		expected   string
+	}{
+		{"untrusted peer ignores headers", "203.0.113.7:1234", "198.51.100.1", "198.51.100.2", "203.0.113.7"},
+		{"trusted peer uses forwarded", "10.1.2.3:1234", "198.51.100.1", "", "198.51.100.1"},
+		{"skips trusted hops", "127.0.0.1:1234", "198.51.100.1, 203.0.113.9, 10.0.0.5", "", "203.0.113.9"},
+		{"falls back to real ip", "10.1.2.3:1234", "", "198.51.100.2", "198.51.100.2"},
+		{"trusted peer without headers", "10.1.2.3:1234", "", "", "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if got := broker.resolveClientIP(req); got != tt.expected {
+				t.Errorf("Expected client IP %s, got: %s", tt.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// HandleCompletions is the handler for legacy text completion requests
+// (/v1/completions).
+func (b *Broker) HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	r = b.watchRateLimits(r)
+	// 1. Text completions are only spoken in the OpenAI format.
+	clientAdapterType := "openai"
+
+	// 2. Extract model name from request body
+	modelName, err := b.extractModelFromRequest(r)
+	if err != nil {
+		slog.Error("failed to extract model from request", "error", err)
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+
+	// 3. Find model configuration for this alias, or the default model
+	modelConfig, ok := b.resolveModel(r, modelName)
+	if !ok {
+		slog.Error("no model configuration found", "alias", modelName)
+		workflows.WriteError(w, r, http.StatusNotFound, "model not supported")
+		return
+	}
+
+	// 3.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 4. Serve from the target picked by weight or blue/green rollout,
+	// falling back along the model's chain if the target fails.
+	b.withFailover(w, r, modelConfig, func(w http.ResponseWriter, modelConfig *config.Model) {
+		noteServedTarget(r, modelConfig)
+		b.dispatchCompletion(w, r, clientAdapterType, modelConfig)
+	})
+}
+
+// dispatchCompletion forwards a completion request unchanged to backends that
+// implement /v1/completions, and otherwise translates it into a chat request.
+// Models with guardrails always translate, as the checks work on the unified
+// request.
+func (b *Broker) dispatchCompletion(w http.ResponseWriter, r *http.Request, clientAdapterType string, modelConfig *config.Model) {
+	if clientAdapterType == dialectOf(modelConfig.Type) && !modelConfig.CompletionsViaChat && modelConfig.Guardrails == nil {
+		slog.Info("performing completion passthrough")
+		noteWorkflow(r, "passthrough")
+		workflows.HandlePassthrough(w, r, providerEndpoint(modelConfig, "completions"), modelConfig)
+		return
+	}
+
+	slog.Info("performing completion translation via chat")
+	clientAdapter := b.adapters[clientAdapterType].(adapters.CompletionAdapter)
+	providerAdapter := b.adapters[modelConfig.Type]
+	noteWorkflow(r, "translation")
+	workflows.HandleCompletionTranslation(w, r, clientAdapter, providerAdapter, providerEndpoint(modelConfig, "chat/completions"), modelConfig, workflows.Extensions{Moderator: b, Notifier: b})
+}
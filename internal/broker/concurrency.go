@@ -0,0 +1,247 @@
+package broker
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/config"
+)
+
+var (
+	inFlightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lmbroker_in_flight_requests",
+		Help: "Backend requests in flight, by alias and target.",
+	}, []string{"alias", "target"})
+
+	queuedRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lmbroker_queued_requests",
+		Help: "Requests waiting for a concurrency slot, by priority class.",
+	}, []string{"priority"})
+
+	concurrencyRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_concurrency_rejections_total",
+		Help: "Requests turned away because a concurrency limit was reached, by alias and target.",
+	}, []string{"alias", "target"})
+)
+
+// priorityRanks orders the priority classes of client keys; lower ranks are
+// admitted first.
+var priorityRanks = map[string]int{"high": 0, "normal": 1, "low": 2}
+
+// semaphore is a counting semaphore whose waiters are admitted by priority
+// rank, then in arrival order.
+type semaphore struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	waiters []*semaphoreWaiter
+}
+
+type semaphoreWaiter struct {
+	rank  int
+	ready chan struct{}
+}
+
+func newSemaphore(size int) *semaphore {
+	return &semaphore{size: size}
+}
+
+// tryAcquire takes a slot if one is free and nobody is waiting for it.
+func (s *semaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.used < s.size && len(s.waiters) == 0 {
+		s.used++
+		return true
+	}
+	return false
+}
+
+// acquire waits for a slot behind every waiter of the same or a higher
+// priority, until the deadline passes or ctx is done.
+func (s *semaphore) acquire(ctx context.Context, rank int, deadline <-chan time.Time) bool {
+	if s.tryAcquire() {
+		return true
+	}
+	s.mu.Lock()
+	waiter := &semaphoreWaiter{rank: rank, ready: make(chan struct{})}
+	position := slices.IndexFunc(s.waiters, func(other *semaphoreWaiter) bool { return other.rank > rank })
+	if position < 0 {
+		position = len(s.waiters)
+	}
+	s.waiters = slices.Insert(s.waiters, position, waiter)
+	s.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return true
+	case <-deadline:
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if index := slices.Index(s.waiters, waiter); index >= 0 {
+		s.waiters = slices.Delete(s.waiters, index, index+1)
+		return false
+	}
+	// The slot was handed over just as we gave up; pass it on.
+	s.releaseLocked()
+	return false
+}
+
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseLocked()
+}
+
+// releaseLocked hands a slot to the first waiter, or frees it. Callers hold
+// s.mu.
+func (s *semaphore) releaseLocked() {
+	if len(s.waiters) > 0 && s.used <= s.size {
+		waiter := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		close(waiter.ready)
+		return
+	}
+	s.used--
+}
+
+// resize changes the number of slots, admitting waiters if it grew. Slots
+// held beyond a smaller size are freed as their requests finish.
+func (s *semaphore) resize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size = size
+	for s.used < s.size && len(s.waiters) > 0 {
+		s.used++
+		waiter := s.waiters[0]
+		s.waiters = s.waiters[1:]
+		close(waiter.ready)
+	}
+}
+
+// concurrencyLimiter bounds backend requests in flight with semaphores: one
+// for the whole broker and one per target that sets max_in_flight.
+type concurrencyLimiter struct {
+	settings config.ConcurrencyConfig
+	global   *semaphore
+
+	mu      sync.Mutex
+	targets map[string]*semaphore
+}
+
+func newConcurrencyLimiter(settings config.ConcurrencyConfig) *concurrencyLimiter {
+	limiter := &concurrencyLimiter{settings: settings, targets: make(map[string]*semaphore)}
+	if settings.MaxInFlight > 0 {
+		limiter.global = newSemaphore(settings.MaxInFlight)
+	}
+	return limiter
+}
+
+// targetSemaphore returns the semaphore of a target, or nil if it has no
+// limit. A reload that changes the limit resizes it.
+func (c *concurrencyLimiter) targetSemaphore(modelConfig *config.Model) *semaphore {
+	limit := modelConfig.Target.MaxInFlight
+	if limit <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := cooldownKey(modelConfig)
+	target, ok := c.targets[key]
+	if !ok {
+		target = newSemaphore(limit)
+		c.targets[key] = target
+	} else {
+		target.resize(limit)
+	}
+	return target
+}
+
+// acquire takes a slot of each semaphore, queueing by priority class or
+// giving up as configured. It returns a function that releases them, or false
+// if no slot was free in time.
+func (c *concurrencyLimiter) acquire(ctx context.Context, priority string, semaphores ...*semaphore) (func(), bool) {
+	var held []*semaphore
+	release := func() {
+		for _, semaphore := range held {
+			semaphore.release()
+		}
+	}
+
+	var deadline <-chan time.Time
+	for _, semaphore := range semaphores {
+		if semaphore == nil {
+			continue
+		}
+		if semaphore.tryAcquire() {
+			held = append(held, semaphore)
+			continue
+		}
+		if c.settings.OnLimit == "reject" {
+			release()
+			return nil, false
+		}
+
+		if deadline == nil && c.settings.QueueTimeoutDuration > 0 {
+			timer := time.NewTimer(c.settings.QueueTimeoutDuration)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		queued := queuedRequests.WithLabelValues(priority)
+		queued.Inc()
+		ok := semaphore.acquire(ctx, priorityRanks[priority], deadline)
+		queued.Dec()
+		if !ok {
+			release()
+			return nil, false
+		}
+		held = append(held, semaphore)
+	}
+	return release, true
+}
+
+// withConcurrencyLimit wraps a serve function so each backend request holds
+// a slot of its target's limit and of the global limit while it runs. The
+// target slot is taken first, so a request queued on a busy target does not
+// hold a global slot meanwhile. Queued requests are admitted by the
+// priority of their client key. Requests that get no slot are answered 503,
+// which lets a fallback chain take over.
+func (b *Broker) withConcurrencyLimit(r *http.Request, serve func(http.ResponseWriter, *config.Model)) func(http.ResponseWriter, *config.Model) {
+	priority := "normal"
+	if key, ok := clientKey(r); ok && key.Priority != "" {
+		priority = key.Priority
+	}
+	// Batch requests wait behind interactive ones.
+	if isBatchRequest(r) {
+		priority = "low"
+	}
+	return func(w http.ResponseWriter, modelConfig *config.Model) {
+		release, ok := b.concurrency.acquire(r.Context(), priority, b.concurrency.targetSemaphore(modelConfig), b.concurrency.global)
+		if !ok {
+			if r.Context().Err() != nil {
+				return
+			}
+			concurrencyRejections.WithLabelValues(modelConfig.Alias, modelConfig.Target.Model).Inc()
+			slog.Warn("concurrency limit reached", "request_id", requestID(r), "alias", modelConfig.Alias, "target", modelConfig.Target.Model, "priority", priority)
+			w.Header().Set("Retry-After", "1")
+			writeKeyError(w, r, http.StatusServiceUnavailable, "server_overloaded", "too many concurrent requests, try again shortly")
+			return
+		}
+		defer release()
+
+		gauge := inFlightRequests.WithLabelValues(modelConfig.Alias, modelConfig.Target.Model)
+		gauge.Inc()
+		defer gauge.Dec()
+		defer b.load.begin(modelConfig)()
+		serve(w, modelConfig)
+	}
+}
@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_ConcurrencyLimit(t *testing.T) {
+	entered := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer backend.Close()
+
+	newBroker := func(settings config.ConcurrencyConfig) *Broker {
+		return New(&config.Config{
+			Concurrency: settings,
+			Models: map[string]config.Model{
+				"gpt-4o": {
+					Alias:  "gpt-4o",
+					Type:   "openai",
+					Target: config.TargetConfig{URL: backend.URL + "/", Model: "gpt-4o", MaxInFlight: 1},
+				},
+			},
+		})
+	}
+	send := func(broker *Broker) <-chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`))
+			rr := httptest.NewRecorder()
+			broker.HandleChatCompletions(rr, req)
+			done <- rr
+		}()
+		return done
+	}
+
+	// Rejecting: a second request while the target is busy gets 503 at once
+	broker := newBroker(config.ConcurrencyConfig{OnLimit: "reject"})
+	first := send(broker)
+	<-entered
+	rr := <-send(broker)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" || !strings.Contains(rr.Body.String(), "server_overloaded") {
+		t.Errorf("Expected 503 with Retry-After and an OpenAI-style error, got: %d %v %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+	unblock <- struct{}{}
+	if rr := <-first; rr.Code != http.StatusOK {
+		t.Errorf("Expected the first request to succeed, got: %d", rr.Code)
+	}
+
+	// Queueing: the second request waits for the first to finish
+	broker = newBroker(config.ConcurrencyConfig{OnLimit: "queue", QueueTimeoutDuration: 5 * time.Second})
+	first = send(broker)
+	<-entered
+	second := send(broker)
+	select {
+	case <-entered:
+		t.Fatal("Expected the second request to wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unblock <- struct{}{}
+	<-entered
+	unblock <- struct{}{}
+	if rr1, rr2 := <-first, <-second; rr1.Code != http.StatusOK || rr2.Code != http.StatusOK {
+		t.Errorf("Expected both queued requests to succeed, got: %d %d", rr1.Code, rr2.Code)
+	}
+
+	// A queued request gives up after the queue timeout
+	broker = newBroker(config.ConcurrencyConfig{OnLimit: "queue", QueueTimeoutDuration: 20 * time.Millisecond})
+	first = send(broker)
+	<-entered
+	if rr := <-send(broker); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 after the queue timeout, got: %d", rr.Code)
+	}
+	unblock <- struct{}{}
+	<-first
+}
+
+func TestSemaphore_Priority(t *testing.T) {
+	sem := newSemaphore(1)
+	if !sem.tryAcquire() {
+		t.Fatal("Expected a free slot")
+	}
+
+	// Queue low, then normal, then high; each waits behind the slot holder
+	admitted := make(chan string, 3)
+	for _, priority := range []string{"low", "normal", "high"} {
+		queued := len(sem.waiters)
+		go func() {
+			if sem.acquire(context.Background(), priorityRanks[priority], nil) {
+				admitted <- priority
+			}
+		}()
+		for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+			sem.mu.Lock()
+			waiting := len(sem.waiters)
+			sem.mu.Unlock()
+			if waiting > queued || time.Now().After(deadline) {
+				break
+			}
+		}
+	}
+
+	var order []string
+	for range 3 {
+		sem.release()
+		order = append(order, <-admitted)
+	}
+	if strings.Join(order, ",") != "high,normal,low" {
+		t.Errorf("Expected higher priorities admitted first, got: %v", order)
+	}
+
+	// A waiter that gives up leaves the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sem.acquire(ctx, priorityRanks["high"], nil) || len(sem.waiters) != 0 {
+		t.Errorf("Expected a cancelled waiter to give up and leave the queue")
+	}
+}
@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// contentRecord is one request in the content log. Request and Response
+// hold the bodies as JSON where they are JSON, and as text otherwise, such
+// as the events of a stream.
+type contentRecord struct {
+	Timestamp time.Time   `json:"timestamp"`
+	RequestID string      `json:"request_id,omitempty"`
+	Key       string      `json:"key,omitempty"`
+	Alias     string      `json:"alias"`
+	Target    string      `json:"target"`
+	Path      string      `json:"path"`
+	Status    int         `json:"status"`
+	Request   interface{} `json:"request,omitempty"`
+	Response  interface{} `json:"response,omitempty"`
+}
+
+// contentLog appends content records to a file, redacting them as
+// configured.
+type contentLog struct {
+	cfg    config.ContentLogConfig
+	fields map[string]bool
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newContentLog(cfg config.ContentLogConfig) *contentLog {
+	if len(cfg.RedactFields) == 0 {
+		cfg.RedactFields = config.DefaultRedactFields
+	}
+	fields := make(map[string]bool, len(cfg.RedactFields))
+	for _, field := range cfg.RedactFields {
+		fields[field] = true
+	}
+	return &contentLog{cfg: cfg, fields: fields}
+}
+
+// enabled reports whether a request to the model by the key is logged.
+func (c *contentLog) enabled(model *config.Model, key *config.KeyConfig) bool {
+	if c.cfg.File == "" {
+		return false
+	}
+	enabled := c.cfg.Enabled
+	if model.LogContent != nil {
+		enabled = *model.LogContent
+	}
+	if key != nil && key.LogContent != nil {
+		enabled = *key.LogContent
+	}
+	return enabled
+}
+
+func (c *contentLog) record(record contentRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("failed to encode content record", "error", err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		file, err := os.OpenFile(c.cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			slog.Error("failed to open content log", "path", c.cfg.File, "error", err)
+			return
+		}
+		c.file = file
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write content record", "path", c.cfg.File, "error", err)
+	}
+}
+
+// body returns a request or response body for the log: decoded and
+// redacted JSON, a stream with each event's data redacted, or nothing for
+// other bodies, such as audio uploads.
+func (c *contentLog) body(raw []byte) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err == nil {
+		return c.redact(value)
+	}
+	if !bytes.Contains(raw, []byte("data:")) {
+		return nil
+	}
+	lines := strings.Split(string(raw), "\n")
+	for i, line := range lines {
+		data, ok := strings.CutPrefix(line, "data: ")
+		var event interface{}
+		if !ok || json.Unmarshal([]byte(data), &event) != nil {
+			continue
+		}
+		redacted, _ := json.Marshal(c.redact(event))
+		lines[i] = "data: " + string(redacted)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// redact replaces the contents of the configured fields in a decoded JSON
+// value. Fields holding objects or lists of objects, like content blocks,
+// are redacted inside instead.
+func (c *contentLog) redact(value interface{}) interface{} {
+	if c.cfg.Redact != "hash" && c.cfg.Redact != "drop" {
+		return value
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if !c.fields[key] || hasObjects(item) {
+				v[key] = c.redact(item)
+				continue
+			}
+			if c.cfg.Redact == "drop" {
+				delete(v, key)
+				continue
+			}
+			v[key] = hashContent(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = c.redact(item)
+		}
+	}
+	return value
+}
+
+// hasObjects reports whether a value is an object or a list holding one.
+func hasObjects(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return true
+	case []interface{}:
+		for _, item := range v {
+			if hasObjects(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashContent returns the SHA-256 of a string, or of the JSON encoding of
+// any other value, so equal contents can still be matched up.
+func hashContent(value interface{}) string {
+	data, ok := value.(string)
+	if !ok {
+		encoded, _ := json.Marshal(value)
+		data = string(encoded)
+	}
+	sum := sha256.Sum256([]byte(data))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// LogContent is a middleware that writes the prompt and response of API
+// requests to the content log, for the models and keys it is enabled for.
+// It must be installed outside Authenticate.
+func (b *Broker) LogContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.content.cfg.File == "" || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, w, r := withRequestInfo(w, r)
+		envelope, _ := workflows.ReadEnvelope(r)
+		next.ServeHTTP(w, r)
+
+		model, _ := info.target()
+		key := info.clientKey()
+		if model == nil || !b.content.enabled(model, key) {
+			return
+		}
+		record := contentRecord{
+			Timestamp: info.start.UTC(),
+			RequestID: requestID(r),
+			Alias:     model.Alias,
+			Target:    model.Target.Model,
+			Path:      r.URL.Path,
+			Status:    info.capture.status,
+			Response:  b.content.body(info.capture.body.Bytes()),
+		}
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if key != nil {
+			record.Key = key.Name
+		}
+		if envelope != nil {
+			record.Request = b.content.body(envelope.Raw)
+		}
+		b.content.record(record)
+	})
+}
@@ -0,0 +1,80 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_LogContent(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "The answer is 42."}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 5, "completion_tokens": 4}}`))
+	}))
+	defer mockBackend.Close()
+
+	path := filepath.Join(t.TempDir(), "content.jsonl")
+	on, off := true, false
+	broker := New(&config.Config{
+		ContentLog: config.ContentLogConfig{File: path, Redact: "hash"},
+		Keys: []config.KeyConfig{
+			{Name: "team-a", Key: "sk-team-a"},
+			{Name: "private", Key: "sk-private", LogContent: &off},
+		},
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:      "gpt-4o",
+				Type:       "openai",
+				Target:     config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"},
+				LogContent: &on,
+			},
+		},
+	})
+	handler := broker.RecordUsage(broker.LogContent(broker.Authenticate(http.HandlerFunc(broker.HandleChatCompletions))))
+	for _, key := range []string{"sk-team-a", "sk-private"} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "What is the answer?"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	// Only the model's opted-in request is logged; the private key opted out
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one logged request, got: %s", data)
+	}
+	var record struct {
+		Key      string                 `json:"key"`
+		Alias    string                 `json:"alias"`
+		Status   int                    `json:"status"`
+		Request  map[string]interface{} `json:"request"`
+		Response map[string]interface{} `json:"response"`
+	}
+	json.Unmarshal([]byte(lines[0]), &record)
+	if record.Key != "team-a" || record.Alias != "gpt-4o" || record.Status != http.StatusOK {
+		t.Errorf("Expected the request metadata, got: %+v", record)
+	}
+
+	// Contents are hashed, metadata such as roles and usage is kept
+	if strings.Contains(lines[0], "What is the answer") || strings.Contains(lines[0], "answer is 42") {
+		t.Errorf("Expected contents to be redacted, got: %s", lines[0])
+	}
+	message := record.Request["messages"].([]interface{})[0].(map[string]interface{})
+	if message["role"] != "user" || !strings.HasPrefix(message["content"].(string), "sha256:") {
+		t.Errorf("Expected the role kept and the content hashed, got: %v", message)
+	}
+	if record.Response["usage"] == nil || record.Request["model"] != "gpt-4o" {
+		t.Errorf("Expected usage and model to be kept, got: %v", record.Response)
+	}
+}
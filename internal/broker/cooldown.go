@@ -0,0 +1,175 @@
+package broker
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// maxCooldown caps how long a backend's Retry-After can keep a target out
+// of rotation.
+const maxCooldown = 5 * time.Minute
+
+var (
+	targetCooldowns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_target_cooldowns_total",
+		Help: "Times a target was taken out of rotation after answering 429 or reporting its rate limit used up.",
+	}, []string{"alias", "target"})
+
+	targetCooldownUntil = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lmbroker_target_cooldown_until_seconds",
+		Help: "Unix time until which a rate-limited target is avoided.",
+	}, []string{"alias", "target"})
+)
+
+// targetCooldown is a target that is being avoided after a 429, or after
+// its backend reported its rate limit used up.
+type targetCooldown struct {
+	Alias  string    `json:"alias"`
+	Target string    `json:"target"`
+	URL    string    `json:"url"`
+	Until  time.Time `json:"until"`
+}
+
+// cooldownTracker remembers which targets recently answered 429. Targets are
+// identified by alias, URL and model, so weighted, green and fallback
+// targets are tracked separately.
+type cooldownTracker struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]targetCooldown
+}
+
+func newCooldownTracker() *cooldownTracker {
+	return &cooldownTracker{now: time.Now, targets: make(map[string]targetCooldown)}
+}
+
+func cooldownKey(modelConfig *config.Model) string {
+	return modelConfig.Alias + "\x00" + modelConfig.Target.URL + "\x00" + modelConfig.Target.Model
+}
+
+// start takes a target out of rotation for the backend's Retry-After, or
+// the target's configured cooldown without one.
+func (c *cooldownTracker) start(modelConfig *config.Model, retryAfter string) {
+	duration := modelConfig.Target.CooldownDuration
+	if wait, ok := workflows.ParseRetryAfter(retryAfter, c.now()); ok {
+		duration = min(wait, maxCooldown)
+	}
+	c.hold(modelConfig, duration)
+}
+
+// throttle takes a target out of rotation when its backend reports that no
+// requests, or no tokens beyond the target's rate_limit_reserve, remain in
+// its window, until the window resets.
+func (c *cooldownTracker) throttle(modelConfig *config.Model, limits adapters.RateLimits) {
+	var duration time.Duration
+	if limits.RemainingRequests == 0 {
+		duration = limits.ResetRequests
+	}
+	if limits.RemainingTokens >= 0 && limits.RemainingTokens <= modelConfig.Target.RateLimitReserve {
+		duration = max(duration, limits.ResetTokens)
+	}
+	c.hold(modelConfig, min(duration, maxCooldown))
+}
+
+// hold keeps a target out of rotation for duration, unless the target has
+// cooldowns turned off.
+func (c *cooldownTracker) hold(modelConfig *config.Model, duration time.Duration) {
+	if modelConfig.Target.CooldownDuration <= 0 || duration <= 0 {
+		return
+	}
+	until := c.now().Add(duration)
+
+	c.mu.Lock()
+	c.targets[cooldownKey(modelConfig)] = targetCooldown{
+		Alias:  modelConfig.Alias,
+		Target: modelConfig.Target.Model,
+		URL:    modelConfig.Target.URL,
+		Until:  until,
+	}
+	c.mu.Unlock()
+	targetCooldowns.WithLabelValues(modelConfig.Alias, modelConfig.Target.Model).Inc()
+	targetCooldownUntil.WithLabelValues(modelConfig.Alias, modelConfig.Target.Model).Set(float64(until.Unix()))
+}
+
+// active reports whether a target is cooling down.
+func (c *cooldownTracker) active(modelConfig *config.Model) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cooldown, ok := c.targets[cooldownKey(modelConfig)]
+	if ok && !c.now().Before(cooldown.Until) {
+		delete(c.targets, cooldownKey(modelConfig))
+		return false
+	}
+	return ok
+}
+
+// snapshot lists the targets cooling down, by alias and target.
+func (c *cooldownTracker) snapshot() []targetCooldown {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	cooldowns := []targetCooldown{}
+	for key, cooldown := range c.targets {
+		if !now.Before(cooldown.Until) {
+			delete(c.targets, key)
+			continue
+		}
+		cooldowns = append(cooldowns, cooldown)
+	}
+	sort.Slice(cooldowns, func(i, j int) bool {
+		if cooldowns[i].Alias != cooldowns[j].Alias {
+			return cooldowns[i].Alias < cooldowns[j].Alias
+		}
+		return cooldowns[i].Target < cooldowns[j].Target
+	})
+	return cooldowns
+}
+
+// coolingDown reports whether every target of a model is cooling down, so
+// a fallback should serve instead.
+func (b *Broker) coolingDown(modelConfig *config.Model) bool {
+	if len(modelConfig.Targets) == 0 {
+		return b.cooldown.active(modelConfig)
+	}
+	for _, target := range modelConfig.Targets {
+		if !b.cooldown.active(withWeightedTarget(modelConfig, target)) {
+			return false
+		}
+	}
+	return true
+}
+
+// withCooldown wraps a serve function so a target that answers 429 starts
+// cooling down.
+func (b *Broker) withCooldown(serve func(http.ResponseWriter, *config.Model)) func(http.ResponseWriter, *config.Model) {
+	return func(w http.ResponseWriter, modelConfig *config.Model) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		serve(recorder, modelConfig)
+		if recorder.status == http.StatusTooManyRequests {
+			b.cooldown.start(modelConfig, w.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// watchRateLimits has the target responses to a request checked, so targets
+// whose backends report their rate limits cool down once a response says
+// they are used up.
+func (b *Broker) watchRateLimits(r *http.Request) *http.Request {
+	return r.WithContext(workflows.WithResponseObserver(r.Context(), func(modelConfig *config.Model, resp *http.Response) {
+		if reporter, ok := b.adapters[modelConfig.Type].(adapters.RateLimitReporter); ok {
+			if limits, ok := reporter.ParseRateLimits(resp.Header); ok {
+				b.cooldown.throttle(modelConfig, limits)
+			}
+		}
+	}))
+}
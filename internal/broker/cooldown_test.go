@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_TargetCooldown(t *testing.T) {
+	primaryHits := 0
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"message": "rate limited"}}`))
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "from fallback"}, "finish_reason": "stop"}]}`))
+	}))
+	defer fallback.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:     "gpt-4o",
+				Type:      "openai",
+				Target:    config.TargetConfig{URL: primary.URL + "/", Model: "gpt-4o", CooldownDuration: 30 * time.Second},
+				Fallbacks: []string{"backup"},
+			},
+			"backup": {
+				Alias:  "backup",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: fallback.URL + "/", Model: "gpt-4o-mini", CooldownDuration: 30 * time.Second},
+			},
+		},
+	})
+	now := time.Unix(1700000000, 0)
+	broker.cooldown.now = func() time.Time { return now }
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr
+	}
+
+	// The 429 fails over and starts the primary's cooldown
+	rr := send()
+	if rr.Code != http.StatusOK || rr.Header().Get("X-LMBroker-Served-By") != "backup" {
+		t.Fatalf("Expected the fallback to answer, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// While cooling down, the primary is not tried at all
+	rr = send()
+	if rr.Code != http.StatusOK || primaryHits != 1 {
+		t.Errorf("Expected the cooling target to be skipped, got: %d after %d primary requests", rr.Code, primaryHits)
+	}
+
+	rr = httptest.NewRecorder()
+	broker.HandleBackendHealth(rr, httptest.NewRequest("GET", "/health/backends", nil))
+	var report struct {
+		Cooldowns []targetCooldown `json:"cooldowns"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode health report: %v", err)
+	}
+	if len(report.Cooldowns) != 1 || report.Cooldowns[0].Alias != "gpt-4o" || !report.Cooldowns[0].Until.Equal(now.Add(60*time.Second)) {
+		t.Errorf("Expected the primary cooling down for Retry-After, got: %+v", report.Cooldowns)
+	}
+
+	// Once Retry-After has passed, the primary is tried again
+	now = now.Add(61 * time.Second)
+	send()
+	if primaryHits != 2 {
+		t.Errorf("Expected the primary to be retried after its cooldown, got: %d requests", primaryHits)
+	}
+}
+
+func TestBroker_RateLimitHeadersCooldown(t *testing.T) {
+	primaryHits := 0
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("x-ratelimit-remaining-requests", "100")
+		w.Header().Set("x-ratelimit-remaining-tokens", "500")
+		w.Header().Set("x-ratelimit-reset-tokens", "12.5s")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "from groq"}, "finish_reason": "stop"}]}`))
+	}))
+	defer primary.Close()
+
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-2", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "from fallback"}, "finish_reason": "stop"}]}`))
+	}))
+	defer fallback.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"llama": {
+				Alias:     "llama",
+				Type:      "groq",
+				Target:    config.TargetConfig{URL: primary.URL + "/", Model: "llama-3.3-70b-versatile", CooldownDuration: 30 * time.Second, RateLimitReserve: 1000},
+				Fallbacks: []string{"backup"},
+			},
+			"backup": {
+				Alias:  "backup",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: fallback.URL + "/", Model: "gpt-4o-mini", CooldownDuration: 30 * time.Second},
+			},
+		},
+	})
+	now := time.Unix(1700000000, 0)
+	broker.cooldown.now = func() time.Time { return now }
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "llama", "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr
+	}
+
+	// The response is served, but its tokens are within the reserve
+	if rr := send(); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "from groq") {
+		t.Fatalf("Expected the primary to answer, got: %d %s", rr.Code, rr.Body.String())
+	}
+	cooldowns := broker.cooldown.snapshot()
+	if len(cooldowns) != 1 || !cooldowns[0].Until.Equal(now.Add(12500*time.Millisecond)) {
+		t.Fatalf("Expected the primary cooling down until its tokens reset, got: %+v", cooldowns)
+	}
+
+	// Until then, requests spill over without a 429
+	if rr := send(); !strings.Contains(rr.Body.String(), "from fallback") || primaryHits != 1 {
+		t.Errorf("Expected the fallback to answer, got: %s after %d primary requests", rr.Body.String(), primaryHits)
+	}
+
+	now = now.Add(13 * time.Second)
+	send()
+	if primaryHits != 2 {
+		t.Errorf("Expected the primary to be used once its window reset, got: %d requests", primaryHits)
+	}
+}
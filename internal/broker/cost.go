@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// costHeader reports the estimated cost of a request in USD, priced from
+// the token usage its response reports and the serving target's pricing.
+const costHeader = "X-LMBroker-Cost"
+
+// ReportCost is a middleware that returns the cost of each API request in
+// X-LMBroker-Cost when the target that served it has pricing. Usage is only
+// known once the response is complete, so JSON responses are held back
+// until then; streams are sent as they arrive and carry the cost as an HTTP
+// trailer instead. Other responses, such as audio or file downloads, and
+// responses of targets without pricing pass straight through. It should be
+// installed next to the routes, inside the other broker middlewares.
+func (b *Broker) ReportCost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, w, r := withRequestInfo(w, r)
+		cw := &costWriter{inner: w, info: info}
+		next.ServeHTTP(cw, r)
+		cw.finish(info)
+	})
+}
+
+// costWriter holds back a priced JSON response until its cost is known.
+type costWriter struct {
+	inner     http.ResponseWriter
+	info      *requestInfo
+	status    int
+	streaming bool
+	passing   bool
+	body      bytes.Buffer
+}
+
+func (c *costWriter) Header() http.Header {
+	return c.inner.Header()
+}
+
+func (c *costWriter) WriteHeader(status int) {
+	if c.status != 0 {
+		return
+	}
+	c.status = status
+	contentType := c.inner.Header().Get("Content-Type")
+	switch {
+	case !c.info.pricing().Priced():
+		c.passing = true
+		c.inner.WriteHeader(status)
+	case strings.HasPrefix(contentType, "text/event-stream"):
+		c.streaming = true
+		c.inner.Header().Add("Trailer", costHeader)
+		c.inner.WriteHeader(status)
+	case !strings.HasPrefix(contentType, "application/json"):
+		c.passing = true
+		c.inner.WriteHeader(status)
+	}
+}
+
+func (c *costWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.passing {
+		return c.inner.Write(p)
+	}
+	c.body.Write(p)
+	if c.streaming {
+		return c.inner.Write(p)
+	}
+	return len(p), nil
+}
+
+// Flush passes stream chunks on; priced JSON responses are held until
+// finish.
+func (c *costWriter) Flush() {
+	if !c.streaming && !c.passing {
+		return
+	}
+	if flusher, ok := c.inner.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish sets the cost and releases a held-back response.
+func (c *costWriter) finish(info *requestInfo) {
+	if c.status == 0 || c.passing {
+		return
+	}
+	if pricing := info.pricing(); pricing.Priced() {
+		cost := strconv.FormatFloat(pricing.Cost(parseUsage(c.body.Bytes())), 'f', 6, 64)
+		c.inner.Header().Set(costHeader, cost)
+	}
+	if c.streaming {
+		return
+	}
+	c.inner.WriteHeader(c.status)
+	c.inner.Write(c.body.Bytes())
+}
@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_ReportCost(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"stream":true`) || strings.Contains(string(body), `"stream": true`) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hello\"}}]}\n\n"))
+			w.Write([]byte("data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 1000, \"completion_tokens\": 100}}\n\ndata: [DONE]\n\n"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 1000, "completion_tokens": 100}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"priced-gpt": {Alias: "priced-gpt", Type: "openai", Target: config.TargetConfig{
+				URL:     mockBackend.URL + "/",
+				Model:   "gpt-4",
+				Pricing: config.PricingConfig{InputPerMillion: 2.5, OutputPerMillion: 10},
+			}},
+			"free-gpt": {Alias: "free-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+		},
+	})
+	handler := broker.Observe(broker.ReportCost(http.HandlerFunc(broker.HandleChatCompletions)))
+	send := func(body string) *http.Response {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+		}
+		return rr.Result()
+	}
+
+	// 1000 * 2.5 / 1M + 100 * 10 / 1M = $0.0035
+	resp := send(`{"model": "priced-gpt", "messages": [{"role": "user", "content": "Hello"}]}`)
+	if got := resp.Header.Get(costHeader); got != "0.003500" {
+		t.Errorf("Expected %s: 0.003500, got: %q", costHeader, got)
+	}
+
+	resp = send(`{"model": "priced-gpt", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`)
+	if got := resp.Trailer.Get(costHeader); got != "0.003500" {
+		t.Errorf("Expected a %s trailer on the stream, got: %q", costHeader, got)
+	}
+
+	resp = send(`{"model": "free-gpt", "messages": [{"role": "user", "content": "Hello"}]}`)
+	if got := resp.Header.Get(costHeader); got != "" {
+		t.Errorf("Expected no cost without pricing, got: %q", got)
+	}
+
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `lmbroker_cost_usd_total{alias="priced-gpt",key="",provider="openai"} 0.007`; !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s", want)
+	}
+}
+
+func TestBroker_ReportCostPassesThrough(t *testing.T) {
+	broker := New(&config.Config{})
+	priced := &config.Model{Alias: "tts", Type: "openai", Target: config.TargetConfig{Model: "tts-1", Pricing: config.PricingConfig{InputPerMillion: 15}}}
+	for _, tc := range []struct {
+		name        string
+		model       *config.Model
+		contentType string
+	}{
+		{"unpriced JSON", nil, "application/json"},
+		{"priced audio", priced, "audio/mpeg"},
+	} {
+		rr := httptest.NewRecorder()
+		handler := broker.ReportCost(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.model != nil {
+				noteServedTarget(r, tc.model)
+			}
+			w.Header().Set("Content-Type", tc.contentType)
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			// The chunk reaches the client before the handler returns
+			if rr.Body.String() != "chunk" || !rr.Flushed {
+				t.Errorf("%s: expected the chunk to be passed through, got: %q", tc.name, rr.Body.String())
+			}
+		}))
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/audio/speech", strings.NewReader(`{}`)))
+		if rr.Body.String() != "chunk" || rr.Header().Get(costHeader) != "" {
+			t.Errorf("%s: expected the response once and without a cost, got: %q %q", tc.name, rr.Body.String(), rr.Header().Get(costHeader))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package broker
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/broker/workflows"
+)
+
+// imageTokenEstimate approximates an image's cost when its dimensions are
+// unknown (Anthropic bills roughly width*height/750, capped near 1600).
+const imageTokenEstimate = 1600
+
+// HandleCountTokens serves Anthropic's /v1/messages/count_tokens. Anthropic
+// targets answer it themselves; for any other provider the tokens are
+// counted locally with the model's tokenizer and returned in the same shape.
+func (b *Broker) HandleCountTokens(w http.ResponseWriter, r *http.Request) {
+	// 1. Extract model name from request body
+	modelName, err := b.extractModelFromRequest(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+
+	// 2. Find model configuration for this alias, or the default model
+	modelConfig, ok := b.resolveModel(r, modelName)
+	if !ok {
+		workflows.WriteError(w, r, http.StatusNotFound, "model not supported")
+		return
+	}
+
+	// 2.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 3. Proxy to Anthropic when it is the target.
+	if modelConfig.Type == "anthropic" {
+		noteServedTarget(r, modelConfig)
+		noteWorkflow(r, "passthrough")
+		workflows.HandlePassthrough(w, r, providerEndpoint(modelConfig, "messages/count_tokens"), modelConfig)
+		return
+	}
+
+	// 4. Otherwise count the request contents locally.
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	tok := b.tokenizerFor(modelConfig)
+	inputTokens := countPromptTokens(tok, envelope.Raw)
+	slog.Debug("counted tokens locally", "alias", modelName, "provider_type", modelConfig.Type, "tokenizer", tok.Name(), "input_tokens", inputTokens)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"input_tokens": inputTokens})
+}
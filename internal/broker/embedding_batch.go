@@ -0,0 +1,191 @@
+package broker
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+var embeddingBatches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_embedding_batches_total",
+	Help: "Batches large embedding requests were split into, by result.",
+}, []string{"alias", "result"})
+
+// defaultEmbeddingBatchSizes are the most inputs each provider accepts in
+// one embedding request.
+var defaultEmbeddingBatchSizes = map[string]int{
+	"openai":       2048,
+	"azure_openai": 2048,
+	"voyage":       1000,
+	"gemini":       100,
+	"cohere":       96,
+}
+
+// embeddingBatch is the slice of a large request's inputs sent together,
+// and what the target answered for it.
+type embeddingBatch struct {
+	offset  int
+	inputs  []json.RawMessage
+	capture *captureWriter
+}
+
+// withEmbeddingBatches serves an embedding request with more inputs than
+// the target accepts as several requests of at most its batch size, with
+// bounded parallelism, and merges their vectors back in input order. A
+// batch that fails is retried on its own; if it keeps failing, its error
+// is the answer.
+func (b *Broker) withEmbeddingBatches(w http.ResponseWriter, r *http.Request, modelConfig *config.Model, serve func(w http.ResponseWriter, r *http.Request)) {
+	settings := modelConfig.Target.EmbeddingBatch
+	size := settings.MaxInputs
+	if size == 0 {
+		size = defaultEmbeddingBatchSizes[modelConfig.Type]
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil || size <= 0 {
+		serve(w, r)
+		return
+	}
+	var request map[string]json.RawMessage
+	var inputs []json.RawMessage
+	if json.Unmarshal(envelope.Raw, &request) != nil || json.Unmarshal(request["input"], &inputs) != nil || len(inputs) <= size || isTokenArray(inputs) {
+		serve(w, r)
+		return
+	}
+
+	// 1. Cut the inputs into batches.
+	var batches []*embeddingBatch
+	for offset := 0; offset < len(inputs); offset += size {
+		batches = append(batches, &embeddingBatch{offset: offset, inputs: inputs[offset:min(offset+size, len(inputs))]})
+	}
+	slog.Info("splitting embedding request", "request_id", requestID(r), "alias", modelConfig.Alias, "inputs", len(inputs), "batches", len(batches))
+
+	// 2. Send them, retrying the ones that fail, until all succeed or one
+	// has run out of retries.
+	parallelism := settings.Parallelism
+	if parallelism == 0 {
+		parallelism = 4
+	}
+	retries := 1
+	if settings.Retries != nil {
+		retries = *settings.Retries
+	}
+	pending := batches
+	for attempt := 0; len(pending) > 0; attempt++ {
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, parallelism)
+		for _, batch := range pending {
+			request["input"], _ = json.Marshal(batch.inputs)
+			body, _ := json.Marshal(request)
+			sub := r.Clone(r.Context())
+			workflows.SetBody(sub, body)
+			batch.capture = newCaptureWriter(nil)
+
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				serve(batch.capture, sub)
+			}()
+		}
+		wg.Wait()
+
+		var failed []*embeddingBatch
+		var fatal *embeddingBatch
+		for _, batch := range pending {
+			status := batch.capture.status
+			if status == 0 || status == http.StatusOK {
+				embeddingBatches.WithLabelValues(modelConfig.Alias, "ok").Inc()
+				continue
+			}
+			embeddingBatches.WithLabelValues(modelConfig.Alias, "error").Inc()
+			failed = append(failed, batch)
+			if fatal == nil && (attempt >= retries || !retryableBatchStatus(status)) {
+				fatal = batch
+			}
+		}
+		if fatal != nil {
+			slog.Warn("embedding batch failed", "request_id", requestID(r), "alias", modelConfig.Alias, "status", fatal.capture.status, "offset", fatal.offset)
+			copyCapture(w, fatal.capture)
+			return
+		}
+		pending = failed
+	}
+
+	// 3. Merge the vectors in input order and add up the usage.
+	data := make([]map[string]interface{}, len(inputs))
+	model := ""
+	promptTokens, totalTokens := 0, 0
+	for _, batch := range batches {
+		var resp struct {
+			Data []struct {
+				Index     int             `json:"index"`
+				Embedding json.RawMessage `json:"embedding"`
+			} `json:"data"`
+			Model string `json:"model"`
+			Usage struct {
+				PromptTokens int `json:"prompt_tokens"`
+				TotalTokens  int `json:"total_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(batch.capture.body.Bytes(), &resp); err != nil || len(resp.Data) != len(batch.inputs) {
+			workflows.WriteError(w, r, http.StatusBadGateway, "failed to decode embedding response")
+			return
+		}
+		for _, item := range resp.Data {
+			if item.Index < 0 || item.Index >= len(batch.inputs) {
+				workflows.WriteError(w, r, http.StatusBadGateway, "failed to decode embedding response")
+				return
+			}
+			index := batch.offset + item.Index
+			data[index] = map[string]interface{}{"object": "embedding", "index": index, "embedding": item.Embedding}
+		}
+		if model == "" {
+			model = resp.Model
+		}
+		promptTokens += resp.Usage.PromptTokens
+		totalTokens += resp.Usage.TotalTokens
+	}
+	for _, item := range data {
+		if item == nil {
+			workflows.WriteError(w, r, http.StatusBadGateway, "failed to decode embedding response")
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  model,
+		"usage":  map[string]int{"prompt_tokens": promptTokens, "total_tokens": totalTokens},
+	})
+}
+
+// isTokenArray reports whether an input list is a single token array,
+// which is one input rather than many.
+func isTokenArray(inputs []json.RawMessage) bool {
+	var number float64
+	return len(inputs) > 0 && json.Unmarshal(inputs[0], &number) == nil
+}
+
+// retryableBatchStatus reports whether a failed batch may succeed if sent
+// again: rate limits and server errors may, client errors will not.
+func retryableBatchStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// copyCapture writes a captured response to w.
+func copyCapture(w http.ResponseWriter, capture *captureWriter) {
+	for key, values := range capture.Header() {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(capture.status)
+	w.Write(capture.body.Bytes())
+}
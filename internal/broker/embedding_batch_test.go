@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_EmbeddingBatches(t *testing.T) {
+	var mu sync.Mutex
+	var batches [][]string
+	failed := false
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		batches = append(batches, req.Input)
+		// The batch with "c" fails the first time
+		fail := req.Input[0] == "c" && !failed
+		failed = failed || fail
+		mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"error": {"message": "overloaded"}}`))
+			return
+		}
+		if req.Input[0] == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"message": "input too long"}}`))
+			return
+		}
+		data := make([]map[string]interface{}, len(req.Input))
+		for i, input := range req.Input {
+			// Answer in reverse order; the index places each vector
+			j := len(req.Input) - 1 - i
+			data[j] = map[string]interface{}{"object": "embedding", "index": i, "embedding": []float64{float64(input[0])}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"object": "list",
+			"data":   data,
+			"model":  "embed-1",
+			"usage":  map[string]int{"prompt_tokens": len(req.Input), "total_tokens": len(req.Input)},
+		})
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"embed": {
+				Alias: "embed",
+				Type:  "openai",
+				Target: config.TargetConfig{
+					URL:            mockBackend.URL + "/",
+					Model:          "embed-1",
+					EmbeddingBatch: config.EmbeddingBatchConfig{MaxInputs: 2, Parallelism: 2},
+				},
+			},
+		},
+	})
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/embeddings", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		broker.HandleEmbeddings(rr, req)
+		return rr
+	}
+
+	rr := send(`{"model": "embed", "input": ["a", "b", "c", "d", "e"]}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	var resp struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(resp.Data) != 5 || resp.Usage.TotalTokens != 5 {
+		t.Fatalf("Expected 5 vectors and 5 tokens, got: %s", rr.Body.String())
+	}
+	for i, item := range resp.Data {
+		if item.Index != i || item.Embedding[0] != float64('a'+i) {
+			t.Errorf("Expected vector %d for input %c, got: %+v", i, 'a'+i, item)
+		}
+	}
+	// Three batches, and only the failed one was sent again
+	if len(batches) != 4 {
+		t.Errorf("Expected 4 backend requests, got: %v", batches)
+	}
+
+	// Client errors are not retried and reach the client
+	batches = nil
+	rr = send(`{"model": "embed", "input": ["a", "b", "bad", "d"]}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "input too long") || len(batches) != 2 {
+		t.Errorf("Expected the failing batch's 400 after 2 requests, got: %d %s after %v", rr.Code, rr.Body.String(), batches)
+	}
+
+	// Requests within the batch size are sent as they are
+	batches = nil
+	if rr := send(`{"model": "embed", "input": ["a", "b"]}`); rr.Code != http.StatusOK || len(batches) != 1 {
+		t.Errorf("Expected a single request, got: %d after %v", rr.Code, batches)
+	}
+}
@@ -0,0 +1,173 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// withEmbeddingCache serves an embedding request with a cache keyed on the
+// SHA-256 of each input string, so repeated chunks are not embedded again.
+// Only the inputs that miss are sent to the target, and cached and fresh
+// vectors are returned together in input order. Requests with token or
+// image inputs, and models without a cache, are served as usual.
+func (b *Broker) withEmbeddingCache(w http.ResponseWriter, r *http.Request, modelConfig *config.Model, serve func(w http.ResponseWriter)) {
+	settings := modelConfig.Cache
+	if settings == nil {
+		serve(w)
+		return
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	var request map[string]interface{}
+	if err := json.Unmarshal(envelope.Raw, &request); err != nil {
+		serve(w)
+		return
+	}
+	inputs, ok := stringInputs(request["input"])
+	if !ok {
+		serve(w)
+		return
+	}
+
+	// 1. Vectors depend on every parameter besides the input, so those are
+	// part of each input's key.
+	delete(request, "input")
+	delete(request, "model")
+	paramsKey := cacheKey("embeddings", request)
+	keys := make([][32]byte, len(inputs))
+	for i, input := range inputs {
+		keys[i] = sha256.Sum256(append(paramsKey[:], input...))
+	}
+
+	// 2. Look up every input; identical inputs are embedded once.
+	cache := b.cacheFor(modelConfig.Alias)
+	now := time.Now()
+	vectors := make([]json.RawMessage, len(inputs))
+	var missing []string
+	missingIndex := make(map[[32]byte]int)
+	model := modelConfig.Target.Model
+	hits := 0
+	for i, key := range keys {
+		if entry, _ := cache.lookup(settings, key, [32]byte{}, nil, now); entry != nil {
+			vectors[i], model = entry.body, entry.model
+			hits++
+			continue
+		}
+		if _, ok := missingIndex[key]; !ok {
+			missingIndex[key] = len(missing)
+			missing = append(missing, inputs[i])
+		}
+	}
+	cacheLookups.WithLabelValues(modelConfig.Alias, "hit").Add(float64(hits))
+	cacheLookups.WithLabelValues(modelConfig.Alias, "miss").Add(float64(len(inputs) - hits))
+
+	// 3. Embed the inputs that missed and keep their vectors.
+	usage := json.RawMessage(`{"prompt_tokens": 0, "total_tokens": 0}`)
+	result := "hit"
+	if len(missing) > 0 {
+		result = "partial"
+		if hits == 0 {
+			result = "miss"
+		}
+		request["input"] = missing
+		request["model"] = modelConfig.Alias
+		missBody, _ := json.Marshal(request)
+		workflows.SetBody(r, missBody)
+
+		capture := newCaptureWriter(nil)
+		serve(capture)
+		if capture.status != 0 && capture.status != http.StatusOK {
+			for key, values := range capture.Header() {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(capture.status)
+			w.Write(capture.body.Bytes())
+			return
+		}
+		var fresh struct {
+			Data []struct {
+				Index     int             `json:"index"`
+				Embedding json.RawMessage `json:"embedding"`
+			} `json:"data"`
+			Model string          `json:"model"`
+			Usage json.RawMessage `json:"usage"`
+		}
+		if err := json.Unmarshal(capture.body.Bytes(), &fresh); err != nil || len(fresh.Data) != len(missing) {
+			workflows.WriteError(w, r, http.StatusBadGateway, "failed to decode embedding response")
+			return
+		}
+		if fresh.Model != "" {
+			model = fresh.Model
+		}
+		if fresh.Usage != nil {
+			usage = fresh.Usage
+		}
+		freshVectors := make([]json.RawMessage, len(missing))
+		for _, item := range fresh.Data {
+			if item.Index < 0 || item.Index >= len(missing) {
+				workflows.WriteError(w, r, http.StatusBadGateway, "failed to decode embedding response")
+				return
+			}
+			freshVectors[item.Index] = item.Embedding
+		}
+		for _, vector := range freshVectors {
+			if vector == nil {
+				workflows.WriteError(w, r, http.StatusBadGateway, "failed to decode embedding response")
+				return
+			}
+		}
+		for key, index := range missingIndex {
+			cache.store(settings, &cacheEntry{exactKey: key, body: freshVectors[index], model: model, stored: now})
+		}
+		for i, key := range keys {
+			if vectors[i] == nil {
+				vectors[i] = freshVectors[missingIndex[key]]
+			}
+		}
+	} else {
+		noteCacheHit(r)
+	}
+
+	// 4. Answer with all vectors in input order.
+	data := make([]map[string]interface{}, len(vectors))
+	for i, vector := range vectors {
+		data[i] = map[string]interface{}{"object": "embedding", "index": i, "embedding": vector}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(cacheHeader, result)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   data,
+		"model":  model,
+		"usage":  usage,
+	})
+}
+
+// stringInputs returns the inputs of an embedding request given as a
+// string or a list of strings.
+func stringInputs(input interface{}) ([]string, bool) {
+	switch v := input.(type) {
+	case string:
+		return []string{v}, true
+	case []interface{}:
+		inputs := make([]string, len(v))
+		for i, item := range v {
+			text, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			inputs[i] = text
+		}
+		return inputs, len(inputs) > 0
+	default:
+		return nil, false
+	}
+}
@@ -2,38 +2,137 @@ package broker
 
 import (
 	"net/http"
+	"sort"
 
 	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
 )
 
+// embeddingDialects are the paths embeddings are served on, and the API
+// format clients use on each.
+var embeddingDialects = map[string]string{
+	"/v1/embeddings": "openai",
+	"/v2/embed":      "cohere", // Cohere v2 embed API
+	"/api/embed":     "ollama", // Ollama native API
+}
+
+// dialectHeader names the client's API format where its path does not.
+const dialectHeader = "X-LMBroker-Dialect"
+
+// EmbeddingPaths returns the paths to serve embeddings on: the built-in
+// ones and those in server.embedding_paths.
+func (b *Broker) EmbeddingPaths() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var paths []string
+	for path := range embeddingDialects {
+		paths = append(paths, path)
+	}
+	for path := range b.cfg.Server.EmbeddingPaths {
+		if _, ok := embeddingDialects[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// embeddingDialect returns the API format of an embedding request: the one
+// its X-LMBroker-Dialect header names, or else the one of its path, which
+// is OpenAI's unless configured otherwise.
+func (b *Broker) embeddingDialect(r *http.Request) (string, bool) {
+	if dialect := r.Header.Get(dialectHeader); dialect != "" {
+		switch dialect {
+		case "openai", "cohere", "ollama":
+			return dialect, true
+		}
+		return "", false
+	}
+	b.mu.RLock()
+	dialect, ok := b.cfg.Server.EmbeddingPaths[r.URL.Path]
+	b.mu.RUnlock()
+	if ok {
+		return dialect, true
+	}
+	if dialect, ok := embeddingDialects[r.URL.Path]; ok {
+		return dialect, true
+	}
+	return "openai", true
+}
+
 // HandleEmbeddings is the main handler for all embedding requests.
 func (b *Broker) HandleEmbeddings(w http.ResponseWriter, r *http.Request) {
-	// 1. Identify the client adapter from the request path.
-	// Embeddings are currently only supported in OpenAI format
-	clientAdapterType := "openai"
+	r = b.watchRateLimits(r)
+	// 1. Identify the client adapter from the request path or header.
+	clientAdapterType, ok := b.embeddingDialect(r)
+	if !ok {
+		workflows.WriteError(w, r, http.StatusBadRequest, "unknown "+dialectHeader+" "+r.Header.Get(dialectHeader)+"; use openai, cohere or ollama")
+		return
+	}
 
 	// 2. Extract model name from request body
 	modelName, err := b.extractModelFromRequest(r)
 	if err != nil {
-		http.Error(w, "failed to parse request body", http.StatusBadRequest)
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+
+	// 2.5. In strict mode, reject malformed OpenAI requests before routing.
+	if clientAdapterType == "openai" && !b.validateRequest(w, r, "embeddings") {
 		return
 	}
 	
-	// 3. Find model configuration for this alias
-	modelConfig, ok := b.findModelConfig(modelName)
+	// 3. Find model configuration for this alias, or the default model
+	modelConfig, ok := b.resolveModel(r, modelName)
 	if !ok {
-		http.Error(w, "embedding model not supported", http.StatusNotFound)
+		workflows.WriteError(w, r, http.StatusNotFound, "embedding model not supported")
 		return
 	}
 
-	// 4. Compare client and provider types.
-	if clientAdapterType == modelConfig.Type {
+	// 3.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 4. Serve cached inputs from the model's cache and the rest from the
+	// target picked by weight or blue/green rollout, falling back along the
+	// model's chain if the target fails. Inputs beyond the target's batch
+	// size are sent in several requests. Caching and batching work on
+	// OpenAI requests, so other clients skip them.
+	serve := func(w http.ResponseWriter) {
+		b.withFailover(w, r, modelConfig, func(w http.ResponseWriter, modelConfig *config.Model) {
+			noteServedTarget(r, modelConfig)
+			dispatch := func(w http.ResponseWriter, r *http.Request) {
+				b.dispatchEmbedding(w, r, clientAdapterType, modelConfig)
+			}
+			if clientAdapterType != "openai" {
+				dispatch(w, r)
+				return
+			}
+			b.withEmbeddingBatches(w, r, modelConfig, dispatch)
+		})
+	}
+	if clientAdapterType != "openai" {
+		serve(w)
+		return
+	}
+	b.withEmbeddingCache(w, r, modelConfig, serve)
+}
+
+// dispatchEmbedding sends an embedding request to the model's target using
+// the passthrough or translation workflow as appropriate.
+func (b *Broker) dispatchEmbedding(w http.ResponseWriter, r *http.Request, clientAdapterType string, modelConfig *config.Model) {
+	// Compare client and provider types. Local dimension truncation
+	// needs to reshape the response, so it always goes through translation.
+	if clientAdapterType == dialectOf(modelConfig.Type) && !modelConfig.TruncateDimensions {
 		// If they match, use the efficient passthrough workflow.
-		workflows.HandlePassthrough(w, r, modelConfig.Target.URL+"embeddings", modelConfig)
+		noteWorkflow(r, "passthrough")
+		workflows.HandlePassthrough(w, r, providerEndpoint(modelConfig, "embeddings"), modelConfig)
 	} else {
 		// If they don't match, use the translation workflow.
 		clientAdapter := b.adapters[clientAdapterType]
 		providerAdapter := b.adapters[modelConfig.Type]
-		workflows.HandleEmbeddingTranslation(w, r, clientAdapter, providerAdapter, modelConfig.Target.URL+"embeddings", modelConfig)
+		noteWorkflow(r, "translation")
+		workflows.HandleEmbeddingTranslation(w, r, clientAdapter, providerAdapter, providerEndpoint(modelConfig, "embeddings"), modelConfig)
 	}
 }
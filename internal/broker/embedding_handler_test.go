@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_EmbeddingDialects(t *testing.T) {
+	var openaiInput interface{}
+	openaiBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input interface{} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		openaiInput = req.Input
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object": "list", "data": [{"object": "embedding", "index": 0, "embedding": [0.1, 0.2]}, {"object": "embedding", "index": 1, "embedding": [0.3, 0.4]}], "model": "embed-1", "usage": {"prompt_tokens": 7, "total_tokens": 7}}`))
+	}))
+	defer openaiBackend.Close()
+
+	var ollamaPath string
+	var ollamaBody map[string]interface{}
+	ollamaBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ollamaPath = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&ollamaBody)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"model": "nomic-embed-text", "embeddings": [[0.5, 0.6]], "prompt_eval_count": 3}`))
+	}))
+	defer ollamaBackend.Close()
+
+	broker := New(&config.Config{
+		Server: config.ServerConfig{
+			EmbeddingPaths: map[string]string{"/cohere/v2/embed": "cohere"},
+		},
+		Models: map[string]config.Model{
+			"embed": {
+				Alias:  "embed",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: openaiBackend.URL + "/", Model: "embed-1"},
+			},
+			"nomic": {
+				Alias:  "nomic",
+				Type:   "ollama",
+				Target: config.TargetConfig{URL: ollamaBackend.URL + "/", Model: "nomic-embed-text"},
+			},
+		},
+	})
+	send := func(path, dialect, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if dialect != "" {
+			req.Header.Set(dialectHeader, dialect)
+		}
+		rr := httptest.NewRecorder()
+		broker.HandleEmbeddings(rr, req)
+		return rr
+	}
+
+	// A Cohere client is answered in Cohere's format from an OpenAI backend
+	for _, path := range []string{"/v2/embed", "/cohere/v2/embed"} {
+		rr := send(path, "", `{"model": "embed", "texts": ["a", "b"], "input_type": "search_query", "embedding_types": ["float"]}`)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 on %s, got: %d %s", path, rr.Code, rr.Body.String())
+		}
+		var cohereResp struct {
+			ID         string `json:"id"`
+			Embeddings struct {
+				Float [][]float64 `json:"float"`
+			} `json:"embeddings"`
+			Meta struct {
+				BilledUnits struct {
+					InputTokens int `json:"input_tokens"`
+				} `json:"billed_units"`
+			} `json:"meta"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &cohereResp)
+		if cohereResp.ID == "" || len(cohereResp.Embeddings.Float) != 2 || cohereResp.Embeddings.Float[1][0] != 0.3 {
+			t.Errorf("Expected a Cohere response with 2 vectors on %s, got: %s", path, rr.Body.String())
+		}
+		if cohereResp.Meta.BilledUnits.InputTokens != 7 {
+			t.Errorf("Expected 7 billed input tokens, got: %d", cohereResp.Meta.BilledUnits.InputTokens)
+		}
+		if inputs, ok := openaiInput.([]interface{}); !ok || len(inputs) != 2 || inputs[0] != "a" {
+			t.Errorf("Expected the OpenAI backend to get [a b], got: %v", openaiInput)
+		}
+	}
+
+	// Cohere's integer encodings cannot be produced from other backends
+	rr := send("/v2/embed", "", `{"model": "embed", "texts": ["a"], "embedding_types": ["int8"]}`)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "embedding_types") {
+		t.Errorf("Expected 400 for int8 embedding_types, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// An Ollama client of an OpenAI backend
+	rr = send("/api/embed", "", `{"model": "embed", "input": "a"}`)
+	var ollamaResp struct {
+		Model           string      `json:"model"`
+		Embeddings      [][]float64 `json:"embeddings"`
+		PromptEvalCount int         `json:"prompt_eval_count"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &ollamaResp)
+	if rr.Code != http.StatusOK || len(ollamaResp.Embeddings) != 2 || ollamaResp.PromptEvalCount != 7 {
+		t.Errorf("Expected an Ollama response, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if inputs, ok := openaiInput.([]interface{}); !ok || len(inputs) != 1 || inputs[0] != "a" {
+		t.Errorf("Expected the OpenAI backend to get [a], got: %v", openaiInput)
+	}
+
+	// An Ollama client of an Ollama backend is passed through
+	rr = send("/api/embed", "", `{"model": "nomic", "input": ["x"], "keep_alive": "5m"}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"prompt_eval_count": 3`) {
+		t.Errorf("Expected the Ollama response unchanged, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if ollamaPath != "/api/embed" || ollamaBody["keep_alive"] != "5m" {
+		t.Errorf("Expected passthrough to /api/embed, got: %s %v", ollamaPath, ollamaBody)
+	}
+
+	// The header names the format on any path
+	rr = send("/v1/embeddings", "ollama", `{"model": "embed", "input": ["a"]}`)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "prompt_eval_count") {
+		t.Errorf("Expected an Ollama response for the header, got: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = send("/v1/embeddings", "gemini", `{"model": "embed", "input": ["a"]}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown dialect, got: %d", rr.Code)
+	}
+
+	paths := broker.EmbeddingPaths()
+	if len(paths) != 4 || paths[0] != "/api/embed" || paths[1] != "/cohere/v2/embed" {
+		t.Errorf("Expected the built-in and configured paths, got: %v", paths)
+	}
+}
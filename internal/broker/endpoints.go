@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"net/url"
+	"strings"
+
+	"lmbroker/internal/config"
+)
+
+// defaultAzureAPIVersion is used for Azure OpenAI targets without api_version.
+const defaultAzureAPIVersion = "2024-10-21"
+
+// dialectOf returns the wire format a provider type speaks. Providers that
+// host another vendor's API reuse its adapter and passthrough path.
+func dialectOf(providerType string) string {
+	switch providerType {
+	case "azure_openai", "vertex_gemini", "mock", "vllm", "tgi", "groq", "together":
+		return "openai"
+	case "vertex_anthropic":
+		return "anthropic"
+	}
+	return providerType
+}
+
+// providerEndpoint builds the backend URL for an operation such as
+// "chat/completions" or "embeddings". Most providers follow the OpenAI
+// layout of appending the operation to the base URL; the exceptions are
+// handled here.
+func providerEndpoint(modelConfig *config.Model, operation string) string {
+	base := modelConfig.Target.URL
+	switch modelConfig.Type {
+	case "gemini":
+		if operation == "embeddings" {
+			model := strings.TrimPrefix(modelConfig.Target.Model, "models/")
+			return base + "models/" + model + ":batchEmbedContents"
+		}
+	case "ollama":
+		if operation == "embeddings" {
+			return base + "api/embed"
+		}
+	case "voyage":
+		// Only voyage-multimodal-* models are served by the multimodal API.
+		if operation == "embeddings" && strings.Contains(modelConfig.Target.Model, "multimodal") {
+			return base + "multimodalembeddings"
+		}
+	case "cohere":
+		if operation == "embeddings" {
+			return base + "embed"
+		}
+	case "azure_openai":
+		deployment := modelConfig.Target.Deployment
+		if deployment == "" {
+			deployment = modelConfig.Target.Model
+		}
+		apiVersion := modelConfig.Target.APIVersion
+		if apiVersion == "" {
+			apiVersion = defaultAzureAPIVersion
+		}
+		return base + "openai/deployments/" + url.PathEscape(deployment) + "/" + operation + "?api-version=" + url.QueryEscape(apiVersion)
+	case "vertex_anthropic":
+		// Streaming requests are switched to :streamRawPredict once the
+		// body has been inspected.
+		return vertexBase(modelConfig) + "publishers/anthropic/models/" + url.PathEscape(modelConfig.Target.Model) + ":rawPredict"
+	case "vertex_gemini":
+		// Vertex's OpenAI-compatible endpoint; models are named "google/<model>".
+		return vertexBase(modelConfig) + "endpoints/openapi/" + operation
+	}
+	return base + operation
+}
+
+// vertexBase returns the project/location prefix for Vertex AI URLs. The
+// target url overrides the regional API host when set.
+func vertexBase(modelConfig *config.Model) string {
+	region := modelConfig.Target.Region
+	if region == "" {
+		region = "us-central1"
+	}
+	host := modelConfig.Target.URL
+	if host == "" {
+		host = "https://" + region + "-aiplatform.googleapis.com/v1/"
+		if region == "global" {
+			host = "https://aiplatform.googleapis.com/v1/"
+		}
+	}
+	return host + "projects/" + url.PathEscape(modelConfig.Target.Project) + "/locations/" + url.PathEscape(region) + "/"
+}
@@ -0,0 +1,285 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// evalHeader lets clients request a comparison against another alias.
+const evalHeader = "X-LMBroker-Eval"
+
+// evalRecorder appends comparison records to the configured log file.
+type evalRecorder struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	closed bool
+}
+
+// evalSide captures one target's outcome in a comparison.
+type evalSide struct {
+	Alias        string `json:"alias"`
+	TargetModel  string `json:"target_model"`
+	Status       int    `json:"status"`
+	LatencyMs    int64  `json:"latency_ms"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	Output       string `json:"output"`
+}
+
+// evalRecord is a single line in the eval log.
+type evalRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Dialect   string    `json:"dialect"`
+	Request   string    `json:"request"`
+	Primary   evalSide  `json:"primary"`
+	Secondary evalSide  `json:"secondary"`
+}
+
+// evalTargetFor returns the secondary model for a dual-send comparison, if
+// one is configured on the alias or requested via header and the client key
+// may use it.
+func (b *Broker) evalTargetFor(r *http.Request, modelConfig *config.Model) (*config.Model, bool) {
+	alias := modelConfig.EvalAlias
+	if header := r.Header.Get(evalHeader); header != "" && b.cfg.Eval.AllowHeader {
+		alias = header
+	}
+	if alias == "" || alias == modelConfig.Alias {
+		return nil, false
+	}
+	evalConfig, ok := b.findModelConfig(alias)
+	if !ok {
+		slog.Warn("eval alias not found, skipping comparison", "alias", modelConfig.Alias, "eval_alias", alias)
+		return nil, false
+	}
+	if key, ok := clientKey(r); ok && key != nil && !key.Allows(evalConfig.Alias) {
+		slog.Warn("eval alias outside the key's allowlist, skipping comparison", "key", key.Name, "alias", modelConfig.Alias, "eval_alias", alias)
+		return nil, false
+	}
+	return evalConfig, true
+}
+
+// dispatchChatWithEval serves the primary model to the client while the
+// same request runs against the secondary in the background. Once both have
+// finished, a comparison record is logged.
+func (b *Broker) dispatchChatWithEval(w http.ResponseWriter, r *http.Request, clientAdapterType string, primary, secondary *config.Model) {
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	body := envelope.Raw
+
+	// The secondary must outlive the client connection, and is not part of
+	// the client's request in metrics. It is a request of the client key's
+	// own, counting against its quotas, budgets and usage. Neither backend
+	// should see the broker's control header.
+	secondaryReq := r.Clone(withoutRequestInfo(context.WithoutCancel(r.Context())))
+	secondaryBody := body
+	if rewritten, err := withModelField(body, secondary.Alias); err == nil {
+		secondaryBody = rewritten
+	}
+	workflows.SetBody(secondaryReq, secondaryBody)
+	secondaryReq.Header.Del(evalHeader)
+	r.Header.Del(evalHeader)
+	key, _ := clientKey(r)
+	serveSecondary := b.keyRequestHandler(key, func(w http.ResponseWriter, r *http.Request) {
+		noteServedTarget(r, secondary)
+		b.dispatchChat(w, r, clientAdapterType, secondary)
+	})
+
+	secondaryDone := make(chan evalSide, 1)
+	go func() {
+		capture := newCaptureWriter(nil)
+		start := time.Now()
+		serveSecondary.ServeHTTP(capture, secondaryReq)
+		secondaryDone <- capture.side(secondary, time.Since(start))
+	}()
+
+	capture := newCaptureWriter(w)
+	start := time.Now()
+	b.dispatchChat(capture, r, clientAdapterType, primary)
+	primarySide := capture.side(primary, time.Since(start))
+
+	go func() {
+		record := evalRecord{
+			Timestamp: time.Now().UTC(),
+			Dialect:   clientAdapterType,
+			Request:   string(body),
+			Primary:   primarySide,
+			Secondary: <-secondaryDone,
+		}
+		slog.Info("eval comparison",
+			"alias", primary.Alias,
+			"eval_alias", secondary.Alias,
+			"primary_status", record.Primary.Status,
+			"primary_latency_ms", record.Primary.LatencyMs,
+			"primary_output_tokens", record.Primary.OutputTokens,
+			"secondary_status", record.Secondary.Status,
+			"secondary_latency_ms", record.Secondary.LatencyMs,
+			"secondary_output_tokens", record.Secondary.OutputTokens,
+		)
+		b.eval.write(record)
+	}()
+}
+
+// write appends a record to the eval log file, opening it on first use.
+func (e *evalRecorder) write(record evalRecord) {
+	if e == nil || e.path == "" {
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("failed to encode eval record", "error", err)
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		slog.Warn("dropping eval record after shutdown", "path", e.path)
+		return
+	}
+	if e.file == nil {
+		file, err := os.OpenFile(e.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			slog.Error("failed to open eval log", "path", e.path, "error", err)
+			return
+		}
+		e.file = file
+	}
+	if _, err := e.file.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write eval record", "path", e.path, "error", err)
+	}
+}
+
+// close closes the eval log file. Records written afterwards are dropped.
+func (e *evalRecorder) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	if e.file == nil {
+		return nil
+	}
+	err := e.file.Close()
+	e.file = nil
+	return err
+}
+
+// captureWriter records the status and body of a response. When wrapping a
+// real ResponseWriter it tees everything through; otherwise it only buffers.
+type captureWriter struct {
+	inner  http.ResponseWriter
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// firstToken is when the first write carrying generated content went out.
+	firstToken time.Time
+}
+
+// tokenContent matches a JSON field carrying generated text in a stream event
+// of any dialect, which marks the arrival of the first token.
+var tokenContent = regexp.MustCompile(`"(content|text|delta|arguments|partial_json|thinking|reasoning_content)":\s*"[^"]`)
+
+func newCaptureWriter(inner http.ResponseWriter) *captureWriter {
+	return &captureWriter{inner: inner, header: make(http.Header)}
+}
+
+func (c *captureWriter) Header() http.Header {
+	if c.inner != nil {
+		return c.inner.Header()
+	}
+	return c.header
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	if c.inner != nil {
+		c.inner.WriteHeader(status)
+	}
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if c.firstToken.IsZero() && tokenContent.Match(p) {
+		c.firstToken = time.Now()
+	}
+	c.body.Write(p)
+	if c.inner != nil {
+		return c.inner.Write(p)
+	}
+	return len(p), nil
+}
+
+// Flush lets streaming workflows push chunks through the capture.
+func (c *captureWriter) Flush() {
+	if flusher, ok := c.inner.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (c *captureWriter) side(modelConfig *config.Model, latency time.Duration) evalSide {
+	inputTokens, outputTokens := parseUsage(c.body.Bytes())
+	return evalSide{
+		Alias:        modelConfig.Alias,
+		TargetModel:  modelConfig.Target.Model,
+		Status:       c.status,
+		LatencyMs:    latency.Milliseconds(),
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		Output:       c.body.String(),
+	}
+}
+
+// parseUsage extracts token counts from a client-facing response body in
+// either dialect. Streaming bodies are scanned event by event.
+func parseUsage(body []byte) (int, int) {
+	var inputTokens, outputTokens int
+	collect := func(payload []byte) {
+		type usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			InputTokens      int `json:"input_tokens"`
+			OutputTokens     int `json:"output_tokens"`
+		}
+		var event struct {
+			Usage   usage `json:"usage"`
+			Message struct {
+				Usage usage `json:"usage"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return
+		}
+		for _, u := range []usage{event.Usage, event.Message.Usage} {
+			inputTokens = max(inputTokens, u.PromptTokens, u.InputTokens)
+			outputTokens = max(outputTokens, u.CompletionTokens, u.OutputTokens)
+		}
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		collect(trimmed)
+		return inputTokens, outputTokens
+	}
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		if payload, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:")); ok {
+			collect(bytes.TrimSpace(payload))
+		}
+	}
+	return inputTokens, outputTokens
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/config"
+)
+
+var (
+	experimentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_experiment_requests_total",
+		Help: "Requests served by each arm of an alias's experiment, by status.",
+	}, []string{"alias", "experiment", "arm", "status"})
+
+	experimentLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lmbroker_experiment_latency_seconds",
+		Help:    "Latency of requests served by each arm of an alias's experiment.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"alias", "experiment", "arm"})
+
+	experimentTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_experiment_tokens_total",
+		Help: "Tokens of requests served by each arm of an alias's experiment, by kind.",
+	}, []string{"alias", "experiment", "arm", "kind"})
+)
+
+// assignExperimentArm puts a request for an alias with an experiment on one
+// of its arms. It returns the writer to answer through, the model as the
+// arm configures it, and a function to call once the request is served,
+// which records the arm's outcome. Aliases without an experiment are
+// returned unchanged.
+func (b *Broker) assignExperimentArm(w http.ResponseWriter, r *http.Request, modelConfig *config.Model) (http.ResponseWriter, *config.Model, func()) {
+	experiment := modelConfig.Experiment
+	if experiment == nil || len(experiment.Arms) == 0 {
+		return w, modelConfig, func() {}
+	}
+	name := experiment.Name
+	if name == "" {
+		name = modelConfig.Alias
+	}
+	arm := pickExperimentArm(experiment.Arms, experimentBucket(name, b.experimentIdentity(r, experiment.HashOn)))
+	noteExperimentArm(r, name, arm.Name)
+
+	// Responses are not cached across arms, which would hand one arm's
+	// answers to another's users.
+	selected := *modelConfig
+	selected.Cache = nil
+	if arm.Target != nil {
+		selected.Target = *arm.Target
+		selected.Type = arm.Type
+		if selected.Type == "" {
+			selected.Type = modelConfig.Type
+		}
+		selected.Targets, selected.Green = nil, nil
+	}
+	if arm.SystemPrompt != nil {
+		selected.SystemPrompt = *arm.SystemPrompt
+	}
+
+	capture := newCaptureWriter(w)
+	start := time.Now()
+	return capture, &selected, func() {
+		outcome := capture.side(&selected, time.Since(start))
+		experimentRequests.WithLabelValues(modelConfig.Alias, name, arm.Name, strconv.Itoa(outcome.Status)).Inc()
+		experimentLatency.WithLabelValues(modelConfig.Alias, name, arm.Name).Observe(time.Since(start).Seconds())
+		experimentTokens.WithLabelValues(modelConfig.Alias, name, arm.Name, "input").Add(float64(outcome.InputTokens))
+		experimentTokens.WithLabelValues(modelConfig.Alias, name, arm.Name, "output").Add(float64(outcome.OutputTokens))
+	}
+}
+
+// experimentIdentity returns what keeps a client on the same arm: the
+// request's user or the client key, as hashOn says, and else the client IP.
+func (b *Broker) experimentIdentity(r *http.Request, hashOn string) string {
+	if hashOn != "key" {
+		if user := requestUser(r); user != "" {
+			return "user:" + user
+		}
+	}
+	if key, ok := clientKey(r); ok && key != nil {
+		return "key:" + key.Name
+	}
+	return "ip:" + b.clientIP(r)
+}
+
+// experimentBucket maps an identity to a stable point in [0, 100) for the
+// experiment. Hashing the experiment's name with it keeps assignments in
+// different experiments independent.
+func experimentBucket(experiment, identity string) float64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(experiment))
+	hash.Write([]byte{0})
+	hash.Write([]byte(identity))
+	return float64(hash.Sum64()%10000) / 100
+}
+
+// pickExperimentArm returns the arm whose share of [0, 100) contains point.
+func pickExperimentArm(arms []config.ExperimentArm, point float64) config.ExperimentArm {
+	for _, arm := range arms {
+		if point < arm.Percent {
+			return arm
+		}
+		point -= arm.Percent
+	}
+	return arms[len(arms)-1]
+}
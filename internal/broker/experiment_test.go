@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Experiment(t *testing.T) {
+	type received struct {
+		model  string
+		system string
+	}
+	var got received
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Role    string `json:"role"`
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		got = received{model: req.Model}
+		for _, message := range req.Messages {
+			if message.Role == "system" {
+				got.system = message.Content
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"assistant": {
+				Alias:  "assistant",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"},
+				Experiment: &config.ExperimentConfig{
+					Name: "concise",
+					Arms: []config.ExperimentArm{
+						{Name: "control", Percent: 50},
+						{Name: "treatment", Percent: 50, Target: &config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o-mini"}, SystemPrompt: &config.SystemPromptConfig{Prefix: "Be concise."}},
+					},
+				},
+			},
+		},
+	})
+	send := func(user string) received {
+		got = received{}
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "assistant", "user": "`+user+`", "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+		}
+		return got
+	}
+
+	arms := map[string]int{}
+	for i := 0; i < 40; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		first := send(user)
+		switch first {
+		case received{model: "gpt-4o"}:
+			arms["control"]++
+		case received{model: "gpt-4o-mini", system: "Be concise."}:
+			arms["treatment"]++
+		default:
+			t.Fatalf("Expected the request to be served by one arm, got: %+v", first)
+		}
+		// The same user always lands on the same arm
+		if again := send(user); again != first {
+			t.Errorf("Expected %s to stay on its arm, got: %+v then %+v", user, first, again)
+		}
+	}
+	if arms["control"] == 0 || arms["treatment"] == 0 {
+		t.Errorf("Expected users on both arms, got: %v", arms)
+	}
+
+	// Requests are counted by arm
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	for arm, users := range arms {
+		want := fmt.Sprintf(`lmbroker_experiment_requests_total{alias="assistant",arm="%s",experiment="concise",status="200"} %d`, arm, 2*users)
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("Expected %s in metrics", want)
+		}
+	}
+}
+
+func TestPickExperimentArm(t *testing.T) {
+	arms := []config.ExperimentArm{{Name: "a", Percent: 10}, {Name: "b", Percent: 0}, {Name: "c", Percent: 90}}
+	cases := map[float64]string{0: "a", 9.99: "a", 10: "c", 99.99: "c"}
+	for point, want := range cases {
+		if got := pickExperimentArm(arms, point); got.Name != want {
+			t.Errorf("Point %v: expected arm %s, got: %s", point, want, got.Name)
+		}
+	}
+	if experimentBucket("exp", "user:1") != experimentBucket("exp", "user:1") {
+		t.Errorf("Expected the same identity to get the same bucket")
+	}
+}
@@ -0,0 +1,141 @@
+package broker
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// servedByHeader names the alias that produced the response when a model
+// has a fallback chain.
+const servedByHeader = "X-LMBroker-Served-By"
+
+// failoverStatus reports whether a backend status should move the request
+// on to the next target in the chain.
+func failoverStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// failoverWriter holds back an attempt's response until its status is known.
+// A failed attempt that still has a fallback is discarded; anything else is
+// committed to the client and passed through unbuffered, so streams keep
+// streaming.
+type failoverWriter struct {
+	w        http.ResponseWriter
+	alias    string
+	canRetry bool
+
+	header      http.Header
+	wroteHeader bool
+	failed      bool
+	status      int
+}
+
+func (f *failoverWriter) Header() http.Header {
+	return f.header
+}
+
+func (f *failoverWriter) WriteHeader(status int) {
+	if f.wroteHeader {
+		return
+	}
+	f.wroteHeader = true
+	f.status = status
+	if f.canRetry && failoverStatus(status) {
+		f.failed = true
+		return
+	}
+	for key, values := range f.header {
+		f.w.Header()[key] = values
+	}
+	f.w.Header().Set(servedByHeader, f.alias)
+	f.w.WriteHeader(status)
+}
+
+func (f *failoverWriter) Write(p []byte) (int, error) {
+	if !f.wroteHeader {
+		f.WriteHeader(http.StatusOK)
+	}
+	if f.failed {
+		return len(p), nil
+	}
+	return f.w.Write(p)
+}
+
+// Flush lets streaming workflows push chunks through the writer.
+func (f *failoverWriter) Flush() {
+	if f.failed {
+		return
+	}
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// withFailover serves a request from the model and, when it answers with a
+// 429 or 5xx (including unreachable backends), replays it against each
+// alias in the model's fallback chain in turn. Responses carry the alias
+// that served them in X-LMBroker-Served-By.
+func (b *Broker) withFailover(w http.ResponseWriter, r *http.Request, modelConfig *config.Model, serve func(http.ResponseWriter, *config.Model)) {
+	if len(modelConfig.Fallbacks) == 0 {
+		b.serveModel(w, r, modelConfig, serve)
+		return
+	}
+
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	body := envelope.Raw
+
+	chain := []*config.Model{modelConfig}
+	for _, alias := range modelConfig.Fallbacks {
+		if fallback, ok := b.findModelConfig(alias); ok {
+			chain = append(chain, fallback)
+		}
+	}
+
+	for i, target := range chain {
+		// Skip models whose targets are all rate limited while a later
+		// model in the chain can still answer.
+		if i < len(chain)-1 && b.coolingDown(target) {
+			slog.Info("target cooling down, trying fallback", "alias", target.Alias, "fallback", chain[i+1].Alias)
+			continue
+		}
+
+		// Fallbacks see the request as if the client had asked for their alias.
+		if i > 0 {
+			attemptBody, err := withModelField(body, target.Alias)
+			if err != nil {
+				workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request JSON")
+				return
+			}
+			workflows.SetBody(r, attemptBody)
+		}
+
+		writer := &failoverWriter{w: w, alias: target.Alias, canRetry: i < len(chain)-1, header: make(http.Header)}
+		b.serveModel(writer, r, target, serve)
+		if !writer.failed {
+			return
+		}
+		// Stop if the client has gone away; there is nobody to answer.
+		if r.Context().Err() != nil {
+			return
+		}
+		slog.Warn("target failed, trying fallback", "alias", target.Alias, "status", writer.status, "fallback", chain[i+1].Alias)
+	}
+}
+
+// withModelField returns a JSON request body with its model field replaced.
+func withModelField(body []byte, model string) ([]byte, error) {
+	var reqData map[string]interface{}
+	if err := json.Unmarshal(body, &reqData); err != nil {
+		return nil, err
+	}
+	reqData["model"] = model
+	return json.Marshal(reqData)
+}
@@ -0,0 +1,323 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// fileObject is an uploaded or generated file as the OpenAI Files API
+// describes it.
+type fileObject struct {
+	ID        string `json:"id"`
+	Object    string `json:"object"`
+	Bytes     int    `json:"bytes"`
+	CreatedAt int64  `json:"created_at"`
+	Filename  string `json:"filename"`
+	Purpose   string `json:"purpose"`
+}
+
+// storedFile is a file and the client key it belongs to. Without a batch
+// directory its content is kept here.
+type storedFile struct {
+	Key     string     `json:"key,omitempty"`
+	File    fileObject `json:"file"`
+	Deleted bool       `json:"deleted,omitempty"`
+	content []byte
+}
+
+// batchStore keeps the files and batches of the Batch API. With a
+// directory, file contents are written there and every change to a file or
+// batch is appended to its index.jsonl, which is replayed on startup.
+type batchStore struct {
+	dir string
+
+	mu      sync.Mutex
+	index   *os.File
+	files   map[string]*storedFile
+	batches map[string]*storedBatch
+	// running stops the emulated batches in progress.
+	running map[string]context.CancelFunc
+}
+
+// batchIndexEntry is one line of the index: the new state of a file or a
+// batch.
+type batchIndexEntry struct {
+	File  *storedFile  `json:"file,omitempty"`
+	Batch *storedBatch `json:"batch,omitempty"`
+}
+
+func newBatchStore(cfg config.BatchConfig) *batchStore {
+	store := &batchStore{dir: cfg.Dir, files: make(map[string]*storedFile), batches: make(map[string]*storedBatch)}
+	if cfg.Dir != "" {
+		store.load()
+	}
+	return store
+}
+
+// load replays the index. Lines that fail to decode, such as one cut short
+// by a crash, are skipped. Emulated batches that were still running cannot
+// be resumed and are marked failed.
+func (s *batchStore) load() {
+	file, err := os.Open(filepath.Join(s.dir, "index.jsonl"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to open batch index", "dir", s.dir, "error", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry batchIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if entry.File != nil {
+			s.files[entry.File.File.ID] = entry.File
+		}
+		if entry.Batch != nil {
+			s.batches[entry.Batch.Batch.ID] = entry.Batch
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("failed to read batch index", "dir", s.dir, "error", err)
+	}
+	for _, stored := range s.batches {
+		if stored.RemoteID == "" && !stored.Batch.finished() {
+			stored.Batch.fail("broker_restarted", "the broker restarted before the batch finished", time.Now())
+			s.appendLocked(batchIndexEntry{Batch: stored})
+		}
+	}
+	slog.Info("batch index loaded", "dir", s.dir, "files", len(s.files), "batches", len(s.batches))
+}
+
+// appendLocked writes an entry to the index.
+func (s *batchStore) appendLocked(entry batchIndexEntry) {
+	if s.dir == "" {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("failed to encode batch index entry", "error", err)
+		return
+	}
+	if s.index == nil {
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			slog.Error("failed to create batch directory", "dir", s.dir, "error", err)
+			return
+		}
+		index, err := os.OpenFile(filepath.Join(s.dir, "index.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			slog.Error("failed to open batch index", "dir", s.dir, "error", err)
+			return
+		}
+		s.index = index
+	}
+	if _, err := s.index.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write batch index", "dir", s.dir, "error", err)
+	}
+}
+
+// putFile stores a new file for a client key.
+func (s *batchStore) putFile(key, filename, purpose string, content []byte) (fileObject, error) {
+	stored := &storedFile{Key: key, File: fileObject{
+		ID:        "file-" + newRequestID()[:24],
+		Object:    "file",
+		Bytes:     len(content),
+		CreatedAt: time.Now().Unix(),
+		Filename:  filename,
+		Purpose:   purpose,
+	}}
+	if s.dir == "" {
+		stored.content = content
+	} else {
+		if err := os.MkdirAll(s.dir, 0o755); err != nil {
+			return fileObject{}, err
+		}
+		if err := os.WriteFile(filepath.Join(s.dir, stored.File.ID), content, 0o644); err != nil {
+			return fileObject{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[stored.File.ID] = stored
+	s.appendLocked(batchIndexEntry{File: stored})
+	return stored.File, nil
+}
+
+// file returns a client key's file.
+func (s *batchStore) file(key, id string) (fileObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.files[id]
+	if !ok || stored.Deleted || stored.Key != key {
+		return fileObject{}, false
+	}
+	return stored.File, true
+}
+
+// content returns the content of a client key's file.
+func (s *batchStore) content(key, id string) ([]byte, bool) {
+	s.mu.Lock()
+	stored, ok := s.files[id]
+	s.mu.Unlock()
+	if !ok || stored.Deleted || stored.Key != key {
+		return nil, false
+	}
+	if s.dir == "" {
+		return stored.content, true
+	}
+	content, err := os.ReadFile(filepath.Join(s.dir, id))
+	if err != nil {
+		slog.Error("failed to read batch file", "id", id, "error", err)
+		return nil, false
+	}
+	return content, true
+}
+
+// deleteFile removes a client key's file.
+func (s *batchStore) deleteFile(key, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.files[id]
+	if !ok || stored.Deleted || stored.Key != key {
+		return false
+	}
+	stored.Deleted = true
+	stored.content = nil
+	s.appendLocked(batchIndexEntry{File: stored})
+	if s.dir != "" {
+		os.Remove(filepath.Join(s.dir, id))
+	}
+	return true
+}
+
+// listFiles returns a client key's files with the given purpose, or all of
+// them, newest first.
+func (s *batchStore) listFiles(key, purpose string) []fileObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files := []fileObject{}
+	for _, stored := range s.files {
+		if !stored.Deleted && stored.Key == key && (purpose == "" || stored.File.Purpose == purpose) {
+			files = append(files, stored.File)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID > files[j].ID
+	})
+	return files
+}
+
+// batchOwner is the name of the client key a Batch API request is made
+// with, or "" when the broker has no keys.
+func batchOwner(r *http.Request) string {
+	if key, ok := clientKey(r); ok {
+		return key.Name
+	}
+	return ""
+}
+
+// HandleFiles serves the OpenAI Files API on /v1/files: uploads (a
+// multipart form with file and purpose), listing, retrieval, content
+// download and deletion. Files belong to the client key that uploaded
+// them. They are kept by the broker to be used as batch input, whether
+// the batch then runs natively or emulated.
+func (b *Broker) HandleFiles(w http.ResponseWriter, r *http.Request) {
+	owner := batchOwner(r)
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/files"), "/")
+	id, suffix, _ := strings.Cut(rest, "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse multipart form: "+err.Error())
+			return
+		}
+		purpose := r.FormValue("purpose")
+		if purpose == "" {
+			workflows.WriteError(w, r, http.StatusBadRequest, "purpose is required")
+			return
+		}
+		upload, header, err := r.FormFile("file")
+		if err != nil {
+			workflows.WriteError(w, r, http.StatusBadRequest, "file is required")
+			return
+		}
+		defer upload.Close()
+		content, err := io.ReadAll(upload)
+		if err != nil {
+			workflows.WriteError(w, r, http.StatusBadRequest, "failed to read file")
+			return
+		}
+		file, err := b.batches.putFile(owner, header.Filename, purpose, content)
+		if err != nil {
+			slog.Error("failed to store file", "error", err)
+			workflows.WriteError(w, r, http.StatusInternalServerError, "failed to store file")
+			return
+		}
+		writeJSON(w, http.StatusOK, file)
+
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"object":   "list",
+			"data":     b.batches.listFiles(owner, r.URL.Query().Get("purpose")),
+			"has_more": false,
+		})
+
+	case id != "" && suffix == "" && r.Method == http.MethodGet:
+		file, ok := b.batches.file(owner, id)
+		if !ok {
+			workflows.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("no such file: %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, file)
+
+	case id != "" && suffix == "content" && r.Method == http.MethodGet:
+		content, ok := b.batches.content(owner, id)
+		if !ok {
+			workflows.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("no such file: %s", id))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write(content)
+
+	case id != "" && suffix == "" && r.Method == http.MethodDelete:
+		if !b.batches.deleteFile(owner, id) {
+			workflows.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("no such file: %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "object": "file", "deleted": true})
+
+	default:
+		workflows.WriteError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// writeJSON answers with a JSON document.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
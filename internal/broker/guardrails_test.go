@@ -0,0 +1,149 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Guardrails(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model    string `json:"model"`
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		last := body.Messages[len(body.Messages)-1].Content
+		answer := "Here you go."
+		switch {
+		case body.Model == "moderator" && strings.Contains(last, "attack"):
+			answer = "UNSAFE: violence"
+		case body.Model == "moderator":
+			answer = "SAFE"
+		case strings.Contains(last, "secret"):
+			answer = "The password is hunter2."
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "chatcmpl-1",
+			"object":  "chat.completion",
+			"choices": []map[string]interface{}{{"index": 0, "message": map[string]string{"role": "assistant", "content": answer}, "finish_reason": "stop"}},
+		})
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:  "gpt-4o",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"},
+				Guardrails: &config.GuardrailConfig{
+					DenyPatterns:       []*regexp.Regexp{regexp.MustCompile(`(?i)ssn:\s*\d`)},
+					DenyOutputPatterns: []*regexp.Regexp{regexp.MustCompile(`password is`)},
+					MaxPromptTokens:    100,
+					ModerationAlias:    "moderator",
+					OutputAction:       "annotate",
+				},
+			},
+			"moderator": {
+				Alias:  "moderator",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "moderator"},
+			},
+		},
+	})
+	send := func(path, content string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{
+			"model":      "gpt-4o",
+			"max_tokens": 100,
+			"messages":   []map[string]string{{"role": "user", "content": content}},
+		})
+		req := httptest.NewRequest("POST", path, strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		return rr
+	}
+
+	// Clean prompts pass every check
+	if rr := send("/v1/chat/completions", "Hello"); rr.Code != http.StatusOK || rr.Header().Get(workflows.GuardrailHeader) != "" {
+		t.Errorf("Expected a clean response, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Deny-list, length and moderation failures are policy errors in the
+	// client's dialect
+	rr := send("/v1/messages", "My SSN: 123-45-6789")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"type":"invalid_request_error"`) || !strings.Contains(rr.Body.String(), "guardrail deny") {
+		t.Errorf("Expected an Anthropic policy error for the deny-list, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := send("/v1/chat/completions", strings.Repeat("word ", 200)); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "max_prompt_tokens") {
+		t.Errorf("Expected the long prompt to be rejected, got: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = send("/v1/chat/completions", "Plan an attack")
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"code":"content_policy_violation"`) || !strings.Contains(rr.Body.String(), "violence") {
+		t.Errorf("Expected the moderator to block the prompt, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// Failing output is annotated rather than blocked
+	rr = send("/v1/chat/completions", "Tell me the secret")
+	if rr.Code != http.StatusOK || rr.Header().Get(workflows.GuardrailHeader) != "deny" {
+		t.Errorf("Expected an annotated response, got: %d %q", rr.Code, rr.Header().Get(workflows.GuardrailHeader))
+	}
+}
+
+func TestBroker_GuardrailsCompletions(t *testing.T) {
+	var hits int
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      "chatcmpl-1",
+			"object":  "chat.completion",
+			"choices": []map[string]interface{}{{"index": 0, "message": map[string]string{"role": "assistant", "content": "The password is hunter2."}, "finish_reason": "stop"}},
+		})
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"instruct": {
+				Alias:  "instruct",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "instruct"},
+				Guardrails: &config.GuardrailConfig{
+					DenyPatterns:       []*regexp.Regexp{regexp.MustCompile(`(?i)ssn:\s*\d`)},
+					DenyOutputPatterns: []*regexp.Regexp{regexp.MustCompile(`password is`)},
+				},
+			},
+		},
+	})
+	send := func(prompt string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"model": "instruct", "prompt": prompt, "max_tokens": 10})
+		req := httptest.NewRequest("POST", "/v1/completions", strings.NewReader(string(body)))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		broker.HandleCompletions(rr, req)
+		return rr
+	}
+
+	// Text completions get the same checks as chat, even for backends that
+	// would accept them natively
+	if rr := send("My SSN: 123-45-6789"); rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "content_policy_violation") {
+		t.Errorf("Expected the prompt to be rejected, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if hits != 0 {
+		t.Errorf("Expected the backend not to be called, got: %d calls", hits)
+	}
+	if rr := send("Tell me the secret"); rr.Code != http.StatusBadRequest || strings.Contains(rr.Body.String(), "hunter2") {
+		t.Errorf("Expected the answer to be blocked, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,290 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+// Health states of a probed target. Targets start out unknown and are only
+// avoided once a probe has actually failed.
+const (
+	healthUnknown = "unknown"
+	healthUp      = "up"
+	healthDown    = "down"
+)
+
+// targetHealth is the last probe result for one target of a model.
+type targetHealth struct {
+	Alias       string    `json:"alias"`
+	Target      string    `json:"target"` // "primary", "green", or a weighted target's name
+	URL         string    `json:"url"`
+	Status      string    `json:"status"`
+	LastChecked time.Time `json:"last_checked,omitzero"`
+	LatencyMS   int64     `json:"latency_ms"`
+	Error       string    `json:"error,omitempty"`
+
+	probeURL string
+}
+
+// healthChecker periodically probes every model target with a GET to its
+// health path. A target is up when it answers with a status below 500:
+// authentication or routing errors still show the backend is serving.
+type healthChecker struct {
+	interval time.Duration
+	client   *http.Client
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	targets []*targetHealth
+
+	// onDown, if set, is called when a probe finds a target down that was
+	// not known to be.
+	onDown func(target targetHealth)
+}
+
+func newHealthChecker(cfg *config.Config) *healthChecker {
+	checker := &healthChecker{
+		interval: cfg.HealthCheck.IntervalDuration,
+		client:   &http.Client{Timeout: cfg.HealthCheck.TimeoutDuration},
+		now:      time.Now,
+	}
+	checker.setModels(cfg.Models)
+	return checker
+}
+
+// setModels replaces the probed targets with those of models. Targets that
+// are still configured with the same URL keep their last result.
+func (h *healthChecker) setModels(models map[string]config.Model) {
+	var targets []*targetHealth
+	for alias, model := range models {
+		if len(model.Targets) > 0 {
+			for _, target := range model.Targets {
+				targets = appendTarget(targets, alias, target.Name, target.Type, target.Target)
+			}
+		} else {
+			targets = appendTarget(targets, alias, "primary", model.Type, model.Target)
+		}
+		if model.Green != nil {
+			targets = appendTarget(targets, alias, "green", model.Green.Type, model.Green.Target)
+		}
+	}
+	// Keep /health/backends output stable between calls.
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Alias != targets[j].Alias {
+			return targets[i].Alias < targets[j].Alias
+		}
+		return targets[i].Target < targets[j].Target
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, target := range targets {
+		for _, previous := range h.targets {
+			if previous.Alias == target.Alias && previous.Target == target.Target && previous.probeURL == target.probeURL {
+				targets[i] = previous
+				break
+			}
+		}
+	}
+	h.targets = targets
+}
+
+// appendTarget adds a target to probe. Targets without a base URL (Vertex
+// AI on its default host) and mock targets are not probed.
+func appendTarget(targets []*targetHealth, alias, name, providerType string, target config.TargetConfig) []*targetHealth {
+	if target.URL == "" || providerType == "mock" {
+		return targets
+	}
+	path := target.HealthPath
+	if path == "" {
+		path = "models"
+		if providerType == "ollama" {
+			path = "api/tags"
+		}
+	}
+	return append(targets, &targetHealth{
+		Alias:    alias,
+		Target:   name,
+		URL:      target.URL,
+		Status:   healthUnknown,
+		probeURL: target.URL + path,
+	})
+}
+
+// run probes all targets immediately and then on every interval until ctx
+// is cancelled.
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll probes every target concurrently and records the results.
+func (h *healthChecker) checkAll(ctx context.Context) {
+	h.mu.RLock()
+	targets := h.targets
+	h.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.probe(ctx, target)
+		}()
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) probe(ctx context.Context, target *targetHealth) {
+	start := h.now()
+	status, probeErr := healthUp, ""
+	req, err := http.NewRequestWithContext(ctx, "GET", target.probeURL, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = h.client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 500 {
+				err = fmt.Errorf("status %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		status, probeErr = healthDown, err.Error()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if status != target.Status && target.Status != healthUnknown {
+		slog.Warn("backend health changed", "alias", target.Alias, "target", target.Target, "status", status, "error", probeErr)
+	}
+	wentDown := status == healthDown && target.Status != healthDown
+	target.Status = status
+	target.Error = probeErr
+	target.LastChecked = h.now()
+	target.LatencyMS = h.now().Sub(start).Milliseconds()
+	if wentDown && h.onDown != nil {
+		h.onDown(*target)
+	}
+}
+
+// snapshot returns a copy of the current results.
+func (h *healthChecker) snapshot() []targetHealth {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	results := make([]targetHealth, len(h.targets))
+	for i, target := range h.targets {
+		results[i] = *target
+	}
+	return results
+}
+
+// notifyUnhealthy reports a target that went down to the webhooks.
+func (b *Broker) notifyUnhealthy(target targetHealth) {
+	b.Notify("backend.unhealthy", map[string]interface{}{
+		"alias":  target.Alias,
+		"target": target.Target,
+		"url":    target.URL,
+		"error":  target.Error,
+	})
+}
+
+// healthy reports whether a target has not been seen failing. Targets that
+// are not probed are always healthy.
+func (h *healthChecker) healthy(alias, name string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, target := range h.targets {
+		if target.Alias == alias && target.Target == name {
+			return target.Status != healthDown
+		}
+	}
+	return true
+}
+
+// modelDown reports whether every probed target of an alias is down.
+func (h *healthChecker) modelDown(alias string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	probed := false
+	for _, target := range h.targets {
+		if target.Alias != alias {
+			continue
+		}
+		if target.Status != healthDown {
+			return false
+		}
+		probed = true
+	}
+	return probed
+}
+
+// StartHealthChecks begins probing model targets in the background when
+// health checks are enabled. It returns immediately; probing stops when ctx
+// is cancelled.
+func (b *Broker) StartHealthChecks(ctx context.Context) {
+	if !b.cfg.HealthCheck.Enabled {
+		return
+	}
+	go b.health.run(ctx)
+}
+
+// unavailableModels lists the required models whose targets are all down.
+func (b *Broker) unavailableModels() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	down := []string{}
+	for alias, model := range b.cfg.Models {
+		if model.Required && b.health.modelDown(alias) {
+			down = append(down, alias)
+		}
+	}
+	sort.Strings(down)
+	return down
+}
+
+// HandleHealth serves /health. It reports 503 while any required model has
+// no healthy target.
+func (b *Broker) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	if down := b.unavailableModels(); len(down) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "UNAVAILABLE: %v\n", down)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "OK")
+}
+
+// HandleBackendHealth serves /health/backends with the last probe result of
+// every target and the targets cooling down after a 429.
+func (b *Broker) HandleBackendHealth(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	down := b.unavailableModels()
+	if len(down) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":            b.cfg.HealthCheck.Enabled,
+		"unavailable_models": down,
+		"backends":           b.health.snapshot(),
+		"cooldowns":          b.cooldown.snapshot(),
+	})
+}
@@ -0,0 +1,89 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestHealthChecker(t *testing.T) {
+	healthy := true
+	var mu sync.Mutex
+	var probedPaths []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		probedPaths = append(probedPaths, r.URL.Path)
+		if r.URL.Path == "/api/tags" || healthy {
+			w.WriteHeader(http.StatusUnauthorized) // Reachable even without credentials
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	broker := New(&config.Config{
+		HealthCheck: config.HealthCheckConfig{Enabled: true},
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:    "gpt-4o",
+				Type:     "openai",
+				Target:   config.TargetConfig{URL: backend.URL + "/", Model: "gpt-4o"},
+				Required: true,
+			},
+			"llama": {
+				Alias:  "llama",
+				Type:   "ollama",
+				Target: config.TargetConfig{URL: backend.URL + "/", Model: "llama3"},
+			},
+		},
+	})
+
+	// Before any probe, nothing is reported down
+	rr := httptest.NewRecorder()
+	broker.HandleHealth(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 before the first probe, got: %d", rr.Code)
+	}
+
+	broker.health.checkAll(context.Background())
+	if len(probedPaths) != 2 {
+		t.Fatalf("Expected both targets probed, got: %v", probedPaths)
+	}
+	rr = httptest.NewRecorder()
+	broker.HandleHealth(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 while the required model is up, got: %d", rr.Code)
+	}
+
+	mu.Lock()
+	healthy = false
+	mu.Unlock()
+	broker.health.checkAll(context.Background())
+	rr = httptest.NewRecorder()
+	broker.HandleHealth(rr, httptest.NewRequest("GET", "/health", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 once the required model is down, got: %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	broker.HandleBackendHealth(rr, httptest.NewRequest("GET", "/health/backends", nil))
+	var report struct {
+		UnavailableModels []string       `json:"unavailable_models"`
+		Backends          []targetHealth `json:"backends"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode backend health: %v", err)
+	}
+	if len(report.UnavailableModels) != 1 || report.UnavailableModels[0] != "gpt-4o" {
+		t.Errorf("Expected gpt-4o unavailable, got: %v", report.UnavailableModels)
+	}
+	if len(report.Backends) != 2 || report.Backends[0].Status != "down" || report.Backends[0].Error == "" || report.Backends[1].Status != "up" {
+		t.Errorf("Expected gpt-4o down and llama up, got: %+v", report.Backends)
+	}
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// HandleImageGenerations is the handler for image generation requests
+// (/v1/images/generations).
+func (b *Broker) HandleImageGenerations(w http.ResponseWriter, r *http.Request) {
+	r = b.watchRateLimits(r)
+	// 1. Image generation is only spoken in the OpenAI format.
+	clientAdapterType := "openai"
+
+	// 2. Extract model name from request body
+	modelName, err := b.extractModelFromRequest(r)
+	if err != nil {
+		slog.Error("failed to extract model from request", "error", err)
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+
+	// 3. Find model configuration for this alias, or the default model
+	modelConfig, ok := b.resolveModel(r, modelName)
+	if !ok {
+		slog.Error("no model configuration found", "alias", modelName)
+		workflows.WriteError(w, r, http.StatusNotFound, "image model not supported")
+		return
+	}
+
+	// 3.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 4. Serve from the target picked by weight or blue/green rollout.
+	b.serveModel(w, r, modelConfig, func(w http.ResponseWriter, modelConfig *config.Model) {
+		noteServedTarget(r, modelConfig)
+		b.dispatchImage(w, r, clientAdapterType, modelConfig)
+	})
+}
+
+// dispatchImage sends an image request to the model's target using the
+// passthrough or translation workflow as appropriate.
+func (b *Broker) dispatchImage(w http.ResponseWriter, r *http.Request, clientAdapterType string, modelConfig *config.Model) {
+	providerURL := providerEndpoint(modelConfig, "images/generations")
+	if clientAdapterType == dialectOf(modelConfig.Type) {
+		noteWorkflow(r, "passthrough")
+		workflows.HandlePassthrough(w, r, providerURL, modelConfig)
+		return
+	}
+
+	providerAdapter, ok := b.adapters[modelConfig.Type].(adapters.ImageAdapter)
+	if !ok {
+		workflows.WriteError(w, r, http.StatusBadRequest, "image generation is not supported for provider type "+modelConfig.Type)
+		return
+	}
+	clientAdapter := b.adapters[clientAdapterType].(adapters.ImageAdapter)
+	noteWorkflow(r, "translation")
+	workflows.HandleImageTranslation(w, r, clientAdapter, providerAdapter, providerURL, modelConfig)
+}
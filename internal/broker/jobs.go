@@ -0,0 +1,271 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// asyncHeader asks for a chat request to be answered with a job to poll
+// instead of waiting for the model.
+const asyncHeader = "X-LMBroker-Async"
+
+var asyncJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_async_jobs_total",
+	Help: "Asynchronous requests, by the status their job ended with.",
+}, []string{"status"})
+
+// asyncPaths are the endpoints that accept asynchronous requests.
+var asyncPaths = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/messages":         true,
+	"/v1/responses":        true,
+}
+
+// jobResponse is the answer an asynchronous request got.
+type jobResponse struct {
+	StatusCode int             `json:"status_code"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// jobObject is an asynchronous request as /v1/jobs describes it.
+type jobObject struct {
+	ID          string       `json:"id"`
+	Object      string       `json:"object"`
+	Status      string       `json:"status"`
+	RequestID   string       `json:"request_id,omitempty"`
+	CreatedAt   int64        `json:"created_at"`
+	CompletedAt *int64       `json:"completed_at,omitempty"`
+	Response    *jobResponse `json:"response,omitempty"`
+}
+
+// storedJob is a job, the client key it belongs to and how to stop it.
+type storedJob struct {
+	key      string
+	job      jobObject
+	finished time.Time
+	cancel   context.CancelFunc
+}
+
+// jobStore keeps asynchronous requests in memory until their results have
+// been kept for the configured time.
+type jobStore struct {
+	ttl     time.Duration
+	maxJobs int
+
+	mu   sync.Mutex
+	jobs map[string]*storedJob
+}
+
+func newJobStore(cfg config.AsyncConfig) *jobStore {
+	store := &jobStore{ttl: cfg.TTLDuration, maxJobs: cfg.MaxJobs, jobs: make(map[string]*storedJob)}
+	if store.ttl == 0 {
+		store.ttl = time.Hour
+	}
+	if store.maxJobs == 0 {
+		store.maxJobs = 1000
+	}
+	return store
+}
+
+// sweepLocked forgets the jobs whose results have expired.
+func (s *jobStore) sweepLocked(now time.Time) {
+	for id, stored := range s.jobs {
+		if !stored.finished.IsZero() && now.Sub(stored.finished) > s.ttl {
+			delete(s.jobs, id)
+		}
+	}
+}
+
+// start records a new job for a client key, unless the store is full.
+func (s *jobStore) start(key, requestID string, cancel context.CancelFunc) (jobObject, bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(now)
+	if len(s.jobs) >= s.maxJobs {
+		return jobObject{}, false
+	}
+	stored := &storedJob{key: key, cancel: cancel, job: jobObject{
+		ID:        "job_" + newRequestID()[:24],
+		Object:    "job",
+		Status:    "in_progress",
+		RequestID: requestID,
+		CreatedAt: now.Unix(),
+	}}
+	s.jobs[stored.job.ID] = stored
+	return stored.job, true
+}
+
+// finish records the answer of a job; a 2xx answer completes it and any
+// other fails it. A job deleted while it ran is not brought back.
+func (s *jobStore) finish(id string, capture *captureWriter) string {
+	status := capture.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := capture.body.Bytes()
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	now := time.Now()
+	completedAt := now.Unix()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.jobs[id]
+	if !ok {
+		return "cancelled"
+	}
+	stored.job.Status = "completed"
+	if status < 200 || status >= 300 {
+		stored.job.Status = "failed"
+	}
+	stored.job.CompletedAt = &completedAt
+	stored.job.Response = &jobResponse{StatusCode: status, Body: body}
+	stored.finished = now
+	stored.cancel()
+	return stored.job.Status
+}
+
+// get returns a client key's job.
+func (s *jobStore) get(key, id string) (jobObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweepLocked(time.Now())
+	stored, ok := s.jobs[id]
+	if !ok || stored.key != key {
+		return jobObject{}, false
+	}
+	return stored.job, true
+}
+
+// remove forgets a client key's job, stopping it if it still runs.
+func (s *jobStore) remove(key, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.jobs[id]
+	if !ok || stored.key != key {
+		return false
+	}
+	delete(s.jobs, id)
+	stored.cancel()
+	return true
+}
+
+// RunAsync serves chat requests made with X-LMBroker-Async: true in the
+// background. The client is answered at once with 202 and a job, and polls
+// /v1/jobs/{id} for the model's answer, so long generations survive client
+// timeouts. It sits after Authenticate: the job belongs to the client key,
+// and its quotas, budgets and usage are applied when the job runs.
+func (b *Broker) RunAsync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(asyncHeader)
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		async, err := strconv.ParseBool(value)
+		if err != nil {
+			workflows.WriteError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid %s header %q", asyncHeader, value))
+			return
+		}
+		if !async {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 1. Only whole chat answers can be kept for polling.
+		if r.Method != http.MethodPost || !asyncPaths[r.URL.Path] {
+			workflows.WriteError(w, r, http.StatusBadRequest, asyncHeader+" is only supported on chat requests")
+			return
+		}
+		envelope, err := workflows.ReadEnvelope(r)
+		if err != nil {
+			workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		if envelope.Stream {
+			workflows.WriteError(w, r, http.StatusBadRequest, "asynchronous requests cannot stream")
+			return
+		}
+
+		// 2. Record the job. It outlives the client's connection, and is
+		// detached from the client request's info, which only sees the 202.
+		ctx, cancel := context.WithCancel(withoutRequestInfo(context.WithoutCancel(r.Context())))
+		key, hasKey := clientKey(r)
+		job, ok := b.jobs.start(batchOwner(r), requestID(r), cancel)
+		if !ok {
+			cancel()
+			workflows.WriteError(w, r, http.StatusTooManyRequests, "too many asynchronous jobs; poll or delete finished ones first")
+			return
+		}
+
+		// 3. Serve the request in the background, accounting for it as a
+		// request of its own.
+		sub := r.Clone(ctx)
+		sub.Header.Del(asyncHeader)
+		workflows.SetBody(sub, envelope.Raw)
+		serve := b.RecordUsage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if hasKey {
+				noteClientKey(r, key)
+			}
+			next.ServeHTTP(w, r)
+		}))
+		go func() {
+			capture := newCaptureWriter(nil)
+			serve.ServeHTTP(capture, sub)
+			status := b.jobs.finish(job.ID, capture)
+			asyncJobs.WithLabelValues(status).Inc()
+			slog.Info("async job finished", "request_id", job.RequestID, "job", job.ID, "status", status, "response_status", capture.status)
+		}()
+
+		w.Header().Set("Location", "/v1/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	})
+}
+
+// HandleJobs serves /v1/jobs/{id}: GET polls an asynchronous request, which
+// carries its answer as response once it has finished; DELETE stops it if
+// it still runs and forgets it. Jobs belong to the client key that made
+// them.
+func (b *Broker) HandleJobs(w http.ResponseWriter, r *http.Request) {
+	owner := batchOwner(r)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/jobs"), "/")
+	if id == "" || strings.Contains(id, "/") {
+		workflows.WriteError(w, r, http.StatusNotFound, "no such job")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		job, ok := b.jobs.get(owner, id)
+		if !ok {
+			workflows.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("no such job: %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+
+	case http.MethodDelete:
+		if !b.jobs.remove(owner, id) {
+			workflows.WriteError(w, r, http.StatusNotFound, fmt.Sprintf("no such job: %s", id))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "object": "job", "deleted": true})
+
+	default:
+		workflows.WriteError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
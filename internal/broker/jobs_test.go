@@ -0,0 +1,109 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_AsyncJobs(t *testing.T) {
+	release := make(chan struct{})
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "model": "gpt-4o", "choices": [{"index": 0, "message": {"role": "assistant", "content": "done"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 5, "completion_tokens": 2, "total_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o": {Alias: "gpt-4o", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"}},
+		},
+		Keys: []config.KeyConfig{{Name: "team-a", Key: "lmb-a"}, {Name: "team-b", Key: "lmb-b"}},
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", broker.HandleChatCompletions)
+	mux.HandleFunc("/v1/embeddings", broker.HandleEmbeddings)
+	mux.HandleFunc("/v1/jobs/", broker.HandleJobs)
+	handler := broker.RecordUsage(broker.Authenticate(broker.RunAsync(broker.EnforceQuotas(broker.ReportCost(mux)))))
+	send := func(method, path, key, async, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		if async != "" {
+			req.Header.Set(asyncHeader, async)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+	chat := `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]}`
+
+	// The client gets a job at once while the model is still generating
+	rr := send("POST", "/v1/chat/completions", "lmb-a", "true", chat)
+	var job jobObject
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	if rr.Code != http.StatusAccepted || job.Status != "in_progress" || rr.Header().Get("Location") != "/v1/jobs/"+job.ID {
+		t.Fatalf("Expected 202 with an in-progress job, got: %d %s", rr.Code, rr.Body.String())
+	}
+	rr = send("GET", "/v1/jobs/"+job.ID, "lmb-a", "", "")
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	if rr.Code != http.StatusOK || job.Status != "in_progress" || job.Response != nil {
+		t.Errorf("Expected the job to be in progress, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := send("GET", "/v1/jobs/"+job.ID, "lmb-b", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected another key's job to be hidden, got: %d", rr.Code)
+	}
+
+	// Once the model answers, the poll carries its response
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status == "in_progress" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rr = send("GET", "/v1/jobs/"+job.ID, "lmb-a", "", "")
+		json.Unmarshal(rr.Body.Bytes(), &job)
+	}
+	if job.Status != "completed" || job.CompletedAt == nil || job.Response == nil || job.Response.StatusCode != http.StatusOK {
+		t.Fatalf("Expected a completed job, got: %s", rr.Body.String())
+	}
+	if !strings.Contains(string(job.Response.Body), `"content":"done"`) {
+		t.Errorf("Expected the chat completion in the job, got: %s", job.Response.Body)
+	}
+	totals := broker.usage.query(usageQuery{groupBy: map[string]bool{"key": true}})
+	if len(totals) != 1 || totals[0].Key != "team-a" || totals[0].Requests != 1 || totals[0].InputTokens != 5 || totals[0].OutputTokens != 2 {
+		t.Errorf("Expected the job's usage recorded for team-a, got: %+v", totals)
+	}
+
+	// Unknown models fail the job with the broker's error
+	rr = send("POST", "/v1/chat/completions", "lmb-a", "1", `{"model": "missing", "messages": []}`)
+	json.Unmarshal(rr.Body.Bytes(), &job)
+	deadline = time.Now().Add(5 * time.Second)
+	for job.Status == "in_progress" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		json.Unmarshal(send("GET", "/v1/jobs/"+job.ID, "lmb-a", "", "").Body.Bytes(), &job)
+	}
+	if job.Status != "failed" || job.Response == nil || job.Response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a failed job with a 404, got: %+v", job)
+	}
+	if rr := send("DELETE", "/v1/jobs/"+job.ID, "lmb-a", "", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected the job to be deleted, got: %d", rr.Code)
+	}
+	if rr := send("GET", "/v1/jobs/"+job.ID, "lmb-a", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected a deleted job to be gone, got: %d", rr.Code)
+	}
+
+	// Streams, other endpoints and bad header values are refused
+	for _, tc := range []struct{ path, async, body string }{
+		{"/v1/chat/completions", "true", `{"model": "gpt-4o", "stream": true, "messages": []}`},
+		{"/v1/embeddings", "true", `{"model": "gpt-4o", "input": "a"}`},
+		{"/v1/chat/completions", "soon", chat},
+	} {
+		if rr := send("POST", tc.path, "lmb-a", tc.async, tc.body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s with %s, got: %d %s", tc.path, tc.async, rr.Code, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/config"
+)
+
+const (
+	// latencyWindowSize is how many recent requests the rolling latency
+	// percentiles cover.
+	latencyWindowSize = 100
+	// latencyMinSamples is how many requests a target must serve before it
+	// is ranked; until then it is preferred, so every target gets measured.
+	latencyMinSamples = 5
+	// latencyExploreRate is the share of requests sent to a random target
+	// so slower targets keep being measured and can win back traffic.
+	latencyExploreRate = 0.05
+)
+
+var targetLatency = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "lmbroker_target_latency_seconds",
+	Help: "Rolling time to first response byte per target of least_latency aliases.",
+}, []string{"alias", "target", "quantile"})
+
+// latencyWindow is a ring buffer of recent latencies.
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+// latencyTracker keeps rolling latency windows per alias target.
+type latencyTracker struct {
+	mu      sync.Mutex
+	windows map[string]*latencyWindow
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{windows: make(map[string]*latencyWindow)}
+}
+
+func (t *latencyTracker) record(alias, target string, latency time.Duration) {
+	t.mu.Lock()
+	key := alias + "/" + target
+	window, ok := t.windows[key]
+	if !ok {
+		window = &latencyWindow{}
+		t.windows[key] = window
+	}
+	if len(window.samples) < latencyWindowSize {
+		window.samples = append(window.samples, latency)
+	} else {
+		window.samples[window.next] = latency
+		window.next = (window.next + 1) % latencyWindowSize
+	}
+	t.mu.Unlock()
+
+	p50, p95, _ := t.quantiles(alias, target)
+	targetLatency.WithLabelValues(alias, target, "0.5").Set(p50.Seconds())
+	targetLatency.WithLabelValues(alias, target, "0.95").Set(p95.Seconds())
+}
+
+// quantiles returns the rolling p50 and p95 of a target and the number of
+// samples they are based on.
+func (t *latencyTracker) quantiles(alias, target string) (p50, p95 time.Duration, samples int) {
+	t.mu.Lock()
+	window, ok := t.windows[alias+"/"+target]
+	if !ok {
+		t.mu.Unlock()
+		return 0, 0, 0
+	}
+	sorted := slices.Clone(window.samples)
+	t.mu.Unlock()
+
+	slices.Sort(sorted)
+	percentile := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))]
+	}
+	return percentile(0.5), percentile(0.95), len(sorted)
+}
+
+// pickFastestTarget chooses the healthy target with the lowest rolling
+// median latency, with r uniform in [0, 1). Unmeasured targets go first,
+// and a small share of requests explores a random target.
+func (b *Broker) pickFastestTarget(modelConfig *config.Model, r float64) (*config.Model, string) {
+	candidates := b.healthyTargets(modelConfig)
+	if r < latencyExploreRate {
+		chosen := candidates[int(r/latencyExploreRate*float64(len(candidates)))]
+		return withWeightedTarget(modelConfig, chosen), chosen.Name
+	}
+
+	chosen := candidates[0]
+	var best time.Duration
+	for i, target := range candidates {
+		p50, _, samples := b.latency.quantiles(modelConfig.Alias, target.Name)
+		if samples < latencyMinSamples {
+			chosen = target
+			break
+		}
+		if i == 0 || p50 < best {
+			chosen, best = target, p50
+		}
+	}
+	return withWeightedTarget(modelConfig, chosen), chosen.Name
+}
+
+// latencyRecorder notes when the first response byte is written.
+type latencyRecorder struct {
+	http.ResponseWriter
+	start       time.Time
+	firstByte   time.Duration
+	status      int
+	wroteHeader bool
+}
+
+func (l *latencyRecorder) WriteHeader(status int) {
+	if !l.wroteHeader {
+		l.wroteHeader = true
+		l.status = status
+		l.firstByte = time.Since(l.start)
+	}
+	l.ResponseWriter.WriteHeader(status)
+}
+
+func (l *latencyRecorder) Write(p []byte) (int, error) {
+	if !l.wroteHeader {
+		l.WriteHeader(http.StatusOK)
+	}
+	return l.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming workflows push chunks through the recorder.
+func (l *latencyRecorder) Flush() {
+	if flusher, ok := l.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
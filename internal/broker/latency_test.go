@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestLatencyTracker_Quantiles(t *testing.T) {
+	tracker := newLatencyTracker()
+	for i := 1; i <= latencyWindowSize+20; i++ {
+		tracker.record("gpt-4", "openai", time.Duration(i)*time.Millisecond)
+	}
+
+	// Only the most recent window counts: samples 21ms..120ms
+	p50, p95, samples := tracker.quantiles("gpt-4", "openai")
+	if samples != latencyWindowSize {
+		t.Errorf("Expected %d samples, got: %d", latencyWindowSize, samples)
+	}
+	if p50 != 70*time.Millisecond {
+		t.Errorf("Expected p50 of 70ms, got: %v", p50)
+	}
+	if p95 != 115*time.Millisecond {
+		t.Errorf("Expected p95 of 115ms, got: %v", p95)
+	}
+}
+
+func TestPickFastestTarget(t *testing.T) {
+	model := config.Model{
+		Alias:    "gpt-4",
+		Strategy: "least_latency",
+		Targets: []config.WeightedTarget{
+			{Name: "slow", Type: "openai", Target: config.TargetConfig{URL: "http://slow/", Model: "gpt-4"}},
+			{Name: "fast", Type: "anthropic", Target: config.TargetConfig{URL: "http://fast/", Model: "claude-3-haiku"}},
+		},
+	}
+	broker := New(&config.Config{Models: map[string]config.Model{"gpt-4": model}})
+
+	// Unmeasured targets are tried first
+	if _, name := broker.pickFastestTarget(&model, 0.5); name != "slow" {
+		t.Errorf("Expected the first unmeasured target, got: %s", name)
+	}
+	for i := 0; i < latencyMinSamples; i++ {
+		broker.latency.record("gpt-4", "slow", 900*time.Millisecond)
+	}
+	if _, name := broker.pickFastestTarget(&model, 0.5); name != "fast" {
+		t.Errorf("Expected the remaining unmeasured target, got: %s", name)
+	}
+	for i := 0; i < latencyMinSamples; i++ {
+		broker.latency.record("gpt-4", "fast", 100*time.Millisecond)
+	}
+
+	selected, name := broker.pickFastestTarget(&model, 0.5)
+	if name != "fast" {
+		t.Errorf("Expected the fastest target, got: %s", name)
+	}
+	if selected.Type != "anthropic" || selected.Target.Model != "claude-3-haiku" {
+		t.Errorf("Expected the fast target's type and model, got: %s %s", selected.Type, selected.Target.Model)
+	}
+
+	// A small share of requests explores the other targets
+	if _, name := broker.pickFastestTarget(&model, 0.01); name != "slow" {
+		t.Errorf("Expected exploration to pick the slow target, got: %s", name)
+	}
+
+	// A target seen failing is skipped even when it is fastest
+	for _, target := range broker.health.targets {
+		if target.Target == "fast" {
+			target.Status = healthDown
+		}
+	}
+	if _, name := broker.pickFastestTarget(&model, 0.5); name != "slow" {
+		t.Errorf("Expected the unhealthy target to be skipped, got: %s", name)
+	}
+}
+
+func TestBroker_LeastLatencyIgnoresErrors(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"message": "rate limited"}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4": {
+				Alias:    "gpt-4",
+				Strategy: "least_latency",
+				Targets: []config.WeightedTarget{
+					{Name: "limited", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+				},
+			},
+		},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A fast rejection must not make the target look fast
+	if _, _, samples := broker.latency.quantiles("gpt-4", "limited"); samples != 0 {
+		t.Errorf("Expected no latency samples for an error response, got: %d", samples)
+	}
+}
@@ -0,0 +1,152 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/config"
+)
+
+var targetSpills = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_target_spills_total",
+	Help: "Requests of spillover aliases passed on from a target at its spill threshold, by alias and target.",
+}, []string{"alias", "target"})
+
+// tokenSample is the tokens a response used and when it finished.
+type tokenSample struct {
+	at     time.Time
+	tokens int
+}
+
+// targetLoad is what a target is currently serving: its requests in
+// flight, and the requests and tokens of the last minute.
+type targetLoad struct {
+	inFlight int
+	requests []time.Time
+	tokens   []tokenSample
+}
+
+// pruneLocked drops what happened more than a minute before now.
+func (l *targetLoad) pruneLocked(now time.Time) {
+	cutoff := now.Add(-time.Minute)
+	drop := 0
+	for drop < len(l.requests) && !l.requests[drop].After(cutoff) {
+		drop++
+	}
+	l.requests = l.requests[drop:]
+	drop = 0
+	for drop < len(l.tokens) && !l.tokens[drop].at.After(cutoff) {
+		drop++
+	}
+	l.tokens = l.tokens[drop:]
+}
+
+// loadTracker keeps the live load of every target, keyed like cooldowns.
+type loadTracker struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]*targetLoad
+}
+
+func newLoadTracker() *loadTracker {
+	return &loadTracker{now: time.Now, targets: make(map[string]*targetLoad)}
+}
+
+// loadLocked returns a target's load, pruned to the last minute. Callers
+// hold t.mu.
+func (t *loadTracker) loadLocked(modelConfig *config.Model) *targetLoad {
+	key := cooldownKey(modelConfig)
+	load, ok := t.targets[key]
+	if !ok {
+		load = &targetLoad{}
+		t.targets[key] = load
+	}
+	load.pruneLocked(t.now())
+	return load
+}
+
+// begin counts a request sent to a target; the returned function marks it
+// finished.
+func (t *loadTracker) begin(modelConfig *config.Model) func() {
+	t.mu.Lock()
+	load := t.loadLocked(modelConfig)
+	load.inFlight++
+	load.requests = append(load.requests, t.now())
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		load.inFlight--
+		t.mu.Unlock()
+	}
+}
+
+// addTokens counts the tokens a target's response used.
+func (t *loadTracker) addTokens(modelConfig *config.Model, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	load := t.loadLocked(modelConfig)
+	load.tokens = append(load.tokens, tokenSample{at: t.now(), tokens: tokens})
+}
+
+// current returns a target's requests in flight and its requests and
+// tokens of the last minute.
+func (t *loadTracker) current(modelConfig *config.Model) (inFlight, rpm, tpm int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	load := t.loadLocked(modelConfig)
+	for _, sample := range load.tokens {
+		tpm += sample.tokens
+	}
+	return load.inFlight, len(load.requests), tpm
+}
+
+// pickSpilloverTarget chooses the first of the model's healthy targets, in
+// order, that is below its spill thresholds. When every one is at them, the
+// first takes the request, and its own concurrency limit decides whether it
+// waits. A target without thresholds takes everything that reaches it. It
+// also reports whether the chosen target spills on tokens, so its response
+// must be read for its usage.
+func (b *Broker) pickSpilloverTarget(modelConfig *config.Model) (*config.Model, string, bool) {
+	candidates := b.healthyTargets(modelConfig)
+	for _, target := range candidates {
+		selected := withWeightedTarget(modelConfig, target)
+		inFlightLimit := target.SpillInFlight
+		if inFlightLimit == 0 {
+			inFlightLimit = target.Target.MaxInFlight
+		}
+		inFlight, rpm, tpm := b.load.current(selected)
+		if (inFlightLimit > 0 && inFlight >= inFlightLimit) ||
+			(target.SpillRPM > 0 && rpm >= target.SpillRPM) ||
+			(target.SpillTPM > 0 && tpm >= target.SpillTPM) {
+			targetSpills.WithLabelValues(modelConfig.Alias, target.Name).Inc()
+			continue
+		}
+		return selected, target.Name, target.SpillTPM > 0
+	}
+	return withWeightedTarget(modelConfig, candidates[0]), candidates[0].Name, candidates[0].SpillTPM > 0
+}
+
+// pickLeastBusyTarget chooses the healthy target with the fewest requests
+// in flight, with r uniform in [0, 1) breaking ties.
+func (b *Broker) pickLeastBusyTarget(modelConfig *config.Model, r float64) (*config.Model, string) {
+	var idlest []config.WeightedTarget
+	fewest := 0
+	for _, target := range b.healthyTargets(modelConfig) {
+		inFlight, _, _ := b.load.current(withWeightedTarget(modelConfig, target))
+		if len(idlest) == 0 || inFlight < fewest {
+			idlest, fewest = idlest[:0], inFlight
+		}
+		if inFlight == fewest {
+			idlest = append(idlest, target)
+		}
+	}
+	chosen := idlest[int(r*float64(len(idlest)))]
+	return withWeightedTarget(modelConfig, chosen), chosen.Name
+}
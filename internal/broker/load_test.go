@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestPickSpilloverTarget(t *testing.T) {
+	model := config.Model{
+		Alias:    "llama",
+		Strategy: "spillover",
+		Targets: []config.WeightedTarget{
+			{Name: "reserved", Type: "openai", SpillRPM: 2, SpillTPM: 100, SpillInFlight: 1, Target: config.TargetConfig{URL: "http://reserved/", Model: "llama"}},
+			{Name: "shared", Type: "openai", Target: config.TargetConfig{URL: "http://shared/", Model: "llama", MaxInFlight: 1}},
+			{Name: "overflow", Type: "openai", Target: config.TargetConfig{URL: "http://overflow/", Model: "llama"}},
+		},
+	}
+	broker := New(&config.Config{Models: map[string]config.Model{"llama": model}})
+	now := time.Now()
+	broker.load.now = func() time.Time { return now }
+	pick := func() string {
+		_, name, _ := broker.pickSpilloverTarget(&model)
+		return name
+	}
+	reserved := withWeightedTarget(&model, model.Targets[0])
+	shared := withWeightedTarget(&model, model.Targets[1])
+
+	// The primary takes traffic while below all its thresholds
+	if name := pick(); name != "reserved" {
+		t.Errorf("Expected the primary target, got: %s", name)
+	}
+	done := broker.load.begin(reserved)
+	if name := pick(); name != "shared" {
+		t.Errorf("Expected a spill at the in-flight threshold, got: %s", name)
+	}
+	done()
+	if name := pick(); name != "reserved" {
+		t.Errorf("Expected the primary back once the request finished, got: %s", name)
+	}
+
+	// The second target spills at its max_in_flight
+	broker.load.addTokens(reserved, 150)
+	if name := pick(); name != "shared" {
+		t.Errorf("Expected a spill at the token threshold, got: %s", name)
+	}
+	defer broker.load.begin(shared)()
+	if name := pick(); name != "overflow" {
+		t.Errorf("Expected a spill past the busy second target, got: %s", name)
+	}
+
+	// Load older than a minute no longer counts
+	now = now.Add(61 * time.Second)
+	broker.load.begin(reserved)()
+	if name := pick(); name != "reserved" {
+		t.Errorf("Expected the primary once its tokens expired, got: %s", name)
+	}
+	broker.load.begin(reserved)()
+	if name := pick(); name != "overflow" {
+		t.Errorf("Expected a spill at the request threshold, got: %s", name)
+	}
+}
+
+func TestBroker_SpilloverRouting(t *testing.T) {
+	var hits []string
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 30, "completion_tokens": 10, "total_tokens": 40}}`))
+		}))
+	}
+	primary, secondary := backend("primary"), backend("secondary")
+	defer primary.Close()
+	defer secondary.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"llama": {
+				Alias:    "llama",
+				Type:     "openai",
+				Strategy: "spillover",
+				Targets: []config.WeightedTarget{
+					{Name: "primary", Type: "openai", SpillTPM: 100, Target: config.TargetConfig{URL: primary.URL + "/", Model: "llama"}},
+					{Name: "secondary", Type: "openai", Target: config.TargetConfig{URL: secondary.URL + "/", Model: "llama"}},
+				},
+			},
+		},
+	})
+	for i := 0; i < 4; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "llama", "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	// The primary's tokens reach 120 on its third request
+	if strings.Join(hits, ",") != "primary,primary,primary,secondary" {
+		t.Errorf("Expected the fourth request to spill over, got: %v", hits)
+	}
+}
+
+func TestPickLeastBusyTarget(t *testing.T) {
+	model := config.Model{
+		Alias:    "llama",
+		Strategy: "least_busy",
+		Targets: []config.WeightedTarget{
+			{Name: "a100", Type: "vllm", Target: config.TargetConfig{URL: "http://a100/", Model: "llama"}},
+			{Name: "l4", Type: "vllm", Target: config.TargetConfig{URL: "http://l4/", Model: "llama"}},
+			{Name: "t4", Type: "vllm", Target: config.TargetConfig{URL: "http://t4/", Model: "llama"}},
+		},
+	}
+	broker := New(&config.Config{Models: map[string]config.Model{"llama": model}})
+	target := func(i int) *config.Model { return withWeightedTarget(&model, model.Targets[i]) }
+
+	// Idle targets tie and are chosen between at random
+	if _, name := broker.pickLeastBusyTarget(&model, 0); name != "a100" {
+		t.Errorf("Expected the first idle target, got: %s", name)
+	}
+	if _, name := broker.pickLeastBusyTarget(&model, 0.99); name != "t4" {
+		t.Errorf("Expected the last idle target, got: %s", name)
+	}
+
+	// The target with the fewest requests in flight wins
+	defer broker.load.begin(target(0))()
+	defer broker.load.begin(target(0))()
+	doneL4 := broker.load.begin(target(1))
+	defer broker.load.begin(target(2))()
+	defer broker.load.begin(target(2))()
+	if _, name := broker.pickLeastBusyTarget(&model, 0.99); name != "l4" {
+		t.Errorf("Expected the least busy target, got: %s", name)
+	}
+	doneL4()
+	selected, name := broker.pickLeastBusyTarget(&model, 0)
+	if name != "l4" || selected.Target.URL != "http://l4/" || selected.Type != "vllm" {
+		t.Errorf("Expected the l4 target once idle, got: %s %+v", name, selected.Target)
+	}
+
+	// Unhealthy targets are skipped however idle they are
+	for _, health := range broker.health.targets {
+		if health.Target == "l4" {
+			health.Status = healthDown
+		}
+	}
+	if _, name := broker.pickLeastBusyTarget(&model, 0); name != "a100" {
+		t.Errorf("Expected the unhealthy target to be skipped, got: %s", name)
+	}
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_requests_total",
+		Help: "Requests served, by model alias, provider type, workflow and status code.",
+	}, []string{"alias", "provider", "workflow", "status"})
+
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_request_errors_total",
+		Help: "Requests answered with a 4xx or 5xx status.",
+	}, []string{"alias", "provider", "workflow", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lmbroker_request_duration_seconds",
+		Help:    "Time from receiving a request to the end of its response.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"alias", "provider", "workflow"})
+
+	tokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_tokens_total",
+		Help: "Tokens reported by responses, by direction (input or output).",
+	}, []string{"alias", "provider", "direction"})
+
+	costTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_cost_usd_total",
+		Help: "Estimated spend in USD from reported token usage and target pricing, by client key.",
+	}, []string{"alias", "provider", "key"})
+
+	clientCancellations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_client_cancellations_total",
+		Help: "Requests whose client disconnected before the response was complete, cancelling the backend request.",
+	}, []string{"alias", "provider", "workflow"})
+
+	timeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lmbroker_time_to_first_token_seconds",
+		Help:    "Time from receiving a streaming request to sending its first generated token.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 0.75, 1, 1.5, 2, 3, 5, 10, 30},
+	}, []string{"alias"})
+
+	streamThroughput = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lmbroker_stream_output_tokens_per_second",
+		Help:    "Output tokens per second of streaming responses after the first token.",
+		Buckets: []float64{5, 10, 20, 30, 50, 75, 100, 150, 200, 300, 500},
+	}, []string{"alias"})
+)
+
+// Observe is a middleware that records Prometheus metrics for every API
+// request that reached a model target. It should wrap the other broker
+// middlewares so rejected and failed-over requests are seen as the client
+// saw them.
+func (b *Broker) Observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, w, r := withRequestInfo(w, r)
+		next.ServeHTTP(w, r)
+		observeRequest(info, r.Context().Err() != nil)
+	})
+}
+
+// observeRequest records a finished request. cancelled reports that the
+// client went away before it was complete.
+func observeRequest(info *requestInfo, cancelled bool) {
+	model, workflow := info.target()
+	if model == nil {
+		return
+	}
+	if cancelled {
+		clientCancellations.WithLabelValues(model.Alias, model.Type, workflow).Inc()
+	}
+	status := info.capture.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	requestsTotal.WithLabelValues(model.Alias, model.Type, workflow, strconv.Itoa(status)).Inc()
+	if status >= 400 {
+		requestErrors.WithLabelValues(model.Alias, model.Type, workflow, strconv.Itoa(status)).Inc()
+	}
+	end := time.Now()
+	requestDuration.WithLabelValues(model.Alias, model.Type, workflow).Observe(end.Sub(info.start).Seconds())
+	inputTokens, outputTokens := info.usage()
+	tokensTotal.WithLabelValues(model.Alias, model.Type, "input").Add(float64(inputTokens))
+	tokensTotal.WithLabelValues(model.Alias, model.Type, "output").Add(float64(outputTokens))
+	if cost := info.pricing().Cost(inputTokens, outputTokens); cost > 0 {
+		keyName := ""
+		if key := info.clientKey(); key != nil {
+			keyName = key.Name
+		}
+		costTotal.WithLabelValues(model.Alias, model.Type, keyName).Add(cost)
+	}
+
+	// Streams also report how soon the first token arrived and how fast the
+	// rest followed. Throughput needs the stream to report its usage.
+	firstToken := info.capture.firstToken
+	if firstToken.IsZero() || !strings.HasPrefix(info.capture.Header().Get("Content-Type"), "text/event-stream") {
+		return
+	}
+	timeToFirstToken.WithLabelValues(model.Alias).Observe(firstToken.Sub(info.start).Seconds())
+	if generating := end.Sub(firstToken).Seconds(); outputTokens > 1 && generating > 0 {
+		streamThroughput.WithLabelValues(model.Alias).Observe(float64(outputTokens-1) / generating)
+	}
+}
@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Observe(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 12, "completion_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"observed-gpt": {Alias: "observed-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+		},
+	})
+	handler := broker.Observe(http.HandlerFunc(broker.HandleChatCompletions))
+
+	for _, path := range []string{"/v1/chat/completions", "/v1/messages"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"model": "observed-gpt", "max_tokens": 10, "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 from %s, got: %d (%s)", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := rr.Body.String()
+	for _, want := range []string{
+		`lmbroker_requests_total{alias="observed-gpt",provider="openai",status="200",workflow="passthrough"} 1`,
+		`lmbroker_requests_total{alias="observed-gpt",provider="openai",status="200",workflow="translation"} 1`,
+		`lmbroker_request_duration_seconds_count{alias="observed-gpt",provider="openai",workflow="passthrough"} 1`,
+		`lmbroker_tokens_total{alias="observed-gpt",direction="input",provider="openai"} 24`,
+		`lmbroker_tokens_total{alias="observed-gpt",direction="output",provider="openai"} 14`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+}
+
+func TestBroker_Observe_Streaming(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		w.Write([]byte("data: {\"choices\": [{\"index\": 0, \"delta\": {\"role\": \"assistant\", \"content\": \"\"}}]}\n\n"))
+		flusher.Flush()
+		time.Sleep(60 * time.Millisecond)
+		w.Write([]byte("data: {\"choices\": [{\"index\": 0, \"delta\": {\"content\": \"Hello\"}}]}\n\n"))
+		flusher.Flush()
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("data: {\"choices\": [], \"usage\": {\"prompt_tokens\": 5, \"completion_tokens\": 3}}\n\ndata: [DONE]\n\n"))
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"streamed-gpt": {Alias: "streamed-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+		},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "streamed-gpt", "stream": true, "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	broker.Observe(http.HandlerFunc(broker.HandleChatCompletions)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	metrics := rr.Body.String()
+	for _, want := range []string{
+		`lmbroker_time_to_first_token_seconds_count{alias="streamed-gpt"} 1`,
+		`lmbroker_stream_output_tokens_per_second_count{alias="streamed-gpt"} 1`,
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Expected metrics to contain %s", want)
+		}
+	}
+	// The role-only first chunk does not count as the first token
+	if strings.Contains(metrics, `lmbroker_time_to_first_token_seconds_bucket{alias="streamed-gpt",le="0.05"} 1`) {
+		t.Errorf("Expected the first token to arrive with the second chunk")
+	}
+}
+
+func TestBroker_Observe_ClientCancellation(t *testing.T) {
+	backendCancelled := make(chan struct{})
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+		close(backendCancelled)
+	}))
+	defer mockBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"cancelled-claude": {Alias: "cancelled-claude", Type: "anthropic", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "claude-sonnet-4"}},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "cancelled-claude", "messages": [{"role": "user", "content": "Hello"}]}`)).WithContext(ctx)
+	time.AfterFunc(50*time.Millisecond, cancel)
+	rr := httptest.NewRecorder()
+	broker.Observe(http.HandlerFunc(broker.HandleChatCompletions)).ServeHTTP(rr, req)
+
+	// The backend request is cancelled along with the client's
+	select {
+	case <-backendCancelled:
+	case <-time.After(time.Second):
+		t.Fatal("Expected the backend request to be cancelled")
+	}
+	if rr.Code != 499 {
+		t.Errorf("Expected status 499, got: %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `lmbroker_client_cancellations_total{alias="cancelled-claude",provider="anthropic",workflow="translation"} 1`; !strings.Contains(rr.Body.String(), want) {
+		t.Errorf("Expected metrics to contain %s", want)
+	}
+}
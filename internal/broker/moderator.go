@@ -0,0 +1,25 @@
+package broker
+
+import (
+	"context"
+	"strings"
+)
+
+// moderationPrompt instructs the moderation model used by guardrails.
+const moderationPrompt = "You are a content moderation classifier. Decide whether the following text " +
+	"is harmful, abusive, illegal, or violates a typical enterprise acceptable use policy. " +
+	"Reply with exactly SAFE, or UNSAFE followed by a short reason."
+
+// Moderate asks a moderation alias to classify text. Anything but an
+// answer starting with UNSAFE counts as safe.
+func (b *Broker) Moderate(ctx context.Context, alias, text string) (bool, string, error) {
+	answer, err := b.ask(ctx, "moderator", alias, moderationPrompt, text)
+	if err != nil {
+		return false, "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if verdict, reason, _ := strings.Cut(answer, " "); strings.EqualFold(strings.Trim(verdict, ".:"), "UNSAFE") {
+		return true, strings.TrimSpace(strings.TrimLeft(reason, ":-")), nil
+	}
+	return false, "", nil
+}
@@ -0,0 +1,124 @@
+package broker
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// EnforceQuotas is a middleware that enforces the rate limits and budgets
+// of the client key that authenticated a request. It must be installed
+// inside Authenticate. Token usage is reserved up front by counting the
+// prompt with the model's tokenizer, and corrected, and priced, from the
+// usage the response reports. OpenAI-format streams are asked to report
+// their usage; one that still reports none is charged the prompt estimate
+// and a count of the streamed output.
+func (b *Broker) EnforceQuotas(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := clientKey(r)
+		budgeted := ok && (key.DailyBudget > 0 || key.MonthlyBudget > 0)
+		if !ok || (key.RPM <= 0 && key.TPM <= 0 && !budgeted) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		estimatedTokens := 0
+		var modelConfig *config.Model
+		if key.TPM > 0 || budgeted {
+			var err error
+			estimatedTokens, modelConfig, err = b.estimatePromptTokens(r, key)
+			if err != nil {
+				workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+				return
+			}
+		}
+
+		// 1. Refuse keys that have used up a budget, or whose prompt alone
+		// would cost more than is left of it.
+		if budgeted {
+			status := b.spend.status(key)
+			w.Header().Set(budgetHeader, strconv.FormatFloat(*status.Remaining, 'f', 6, 64))
+			if status.Exceeded != "" {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(status.resetIn.Seconds()))))
+				writeKeyError(w, r, http.StatusTooManyRequests, "insufficient_quota", "API key "+key.Name+" has exceeded its "+status.Exceeded+" budget")
+				return
+			}
+			if modelConfig != nil && modelConfig.Target.Pricing.Cost(estimatedTokens, 0) > *status.Remaining {
+				writeKeyError(w, r, http.StatusTooManyRequests, "insufficient_quota", "the prompt's estimated cost exceeds the remaining budget of API key "+key.Name)
+				return
+			}
+		}
+
+		// 2. Apply the per-minute request and token limits.
+		if wait, limit := b.limiter.admit(w, key, estimatedTokens); wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeKeyError(w, r, http.StatusTooManyRequests, "rate_limit_exceeded", "rate limit reached for "+limit+" per minute on API key "+key.Name)
+			return
+		}
+		if key.TPM <= 0 && !budgeted {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// 3. Serve the request and account for the usage it reports.
+		streamed := requestStreamUsage(r)
+		info, w, r := withRequestInfo(w, r)
+		next.ServeHTTP(w, r)
+		inputTokens, outputTokens := info.usage()
+		if streamed && inputTokens+outputTokens == 0 && !info.cacheHit() && info.capture.status == http.StatusOK {
+			if model, _ := info.target(); model != nil {
+				inputTokens, outputTokens = estimatedTokens, countStreamedTokens(b.tokenizerFor(model), info.capture.body.Bytes())
+				info.estimateUsage(inputTokens, outputTokens)
+			}
+		}
+		if key.TPM > 0 && (inputTokens+outputTokens > 0 || info.cacheHit()) {
+			b.limiter.settle(key, estimatedTokens, inputTokens+outputTokens)
+		}
+		if budgeted {
+			b.spend.charge(key.Name, info.pricing().Cost(inputTokens, outputTokens))
+			// The budget was not used up when the request started (step
+			// 1), so this request is the one that used it up.
+			if status := b.spend.status(key); status.Exceeded != "" {
+				b.Notify("budget.exceeded", map[string]interface{}{
+					"key":       key.Name,
+					"budget":    status.Exceeded,
+					"resets_in": int(math.Ceil(status.resetIn.Seconds())),
+				})
+			}
+		}
+	})
+}
+
+// requestStreamUsage asks an OpenAI-format stream to end with its usage,
+// which such streams only report when the client asks for it. It reports
+// whether the request streams.
+func requestStreamUsage(r *http.Request) bool {
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil || !envelope.Stream {
+		return false
+	}
+	if r.URL.Path != "/v1/chat/completions" && r.URL.Path != "/v1/completions" {
+		return true
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(envelope.Raw, &body); err != nil {
+		return true
+	}
+	options, _ := body["stream_options"].(map[string]interface{})
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	if options["include_usage"] == true {
+		return true
+	}
+	options["include_usage"] = true
+	body["stream_options"] = options
+	if encoded, err := json.Marshal(body); err == nil {
+		workflows.SetBody(r, encoded)
+	}
+	return true
+}
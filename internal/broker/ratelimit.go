@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+// tokenBucket holds up to capacity tokens and refills continuously at
+// capacity per minute. Its level may go negative when a request turns out
+// to cost more than was reserved; the debt is repaid by refilling.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: float64(perMinute), tokens: float64(perMinute), last: now}
+}
+
+func (t *tokenBucket) refill(now time.Time) {
+	t.tokens = math.Min(t.capacity, t.tokens+now.Sub(t.last).Minutes()*t.capacity)
+	t.last = now
+}
+
+// wait is how long until the bucket holds n tokens.
+func (t *tokenBucket) wait(n float64) time.Duration {
+	if t.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - t.tokens) / t.capacity * float64(time.Minute))
+}
+
+// reset is how long until the bucket is full again.
+func (t *tokenBucket) reset() time.Duration {
+	return t.wait(t.capacity).Round(time.Millisecond)
+}
+
+func (t *tokenBucket) remaining() int {
+	return max(int(t.tokens), 0)
+}
+
+// keyLimits are the buckets of one client key.
+type keyLimits struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+}
+
+// rateLimiter enforces the per-minute request and token limits of client
+// keys.
+type rateLimiter struct {
+	now func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]*keyLimits
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{now: time.Now, keys: make(map[string]*keyLimits)}
+}
+
+// limitsFor returns the buckets of a key, starting over when its limits
+// changed in a reload. Callers hold l.mu.
+func (l *rateLimiter) limitsFor(key *config.KeyConfig, now time.Time) *keyLimits {
+	limits, ok := l.keys[key.Name]
+	if !ok || !sameCapacity(limits.requests, key.RPM) || !sameCapacity(limits.tokens, key.TPM) {
+		limits = &keyLimits{}
+		if key.RPM > 0 {
+			limits.requests = newTokenBucket(key.RPM, now)
+		}
+		if key.TPM > 0 {
+			limits.tokens = newTokenBucket(key.TPM, now)
+		}
+		l.keys[key.Name] = limits
+	}
+	if limits.requests != nil {
+		limits.requests.refill(now)
+	}
+	if limits.tokens != nil {
+		limits.tokens.refill(now)
+	}
+	return limits
+}
+
+func sameCapacity(bucket *tokenBucket, perMinute int) bool {
+	if bucket == nil {
+		return perMinute <= 0
+	}
+	return bucket.capacity == float64(perMinute)
+}
+
+// admit takes one request and reserves estimatedTokens for a key. When the
+// key is over a limit nothing is taken and the time to wait is returned
+// along with which limit ("requests" or "tokens") was hit.
+func (l *rateLimiter) admit(w http.ResponseWriter, key *config.KeyConfig, estimatedTokens int) (time.Duration, string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limits := l.limitsFor(key, l.now())
+
+	// A key in token debt waits until it is repaid.
+	if limits.tokens != nil && limits.tokens.tokens <= 0 {
+		setRateLimitHeaders(w, limits)
+		return max(limits.tokens.wait(1), time.Second), "tokens"
+	}
+	if limits.requests != nil {
+		if limits.requests.tokens < 1 {
+			setRateLimitHeaders(w, limits)
+			return max(limits.requests.wait(1), time.Second), "requests"
+		}
+		limits.requests.tokens--
+	}
+	if limits.tokens != nil {
+		limits.tokens.tokens -= float64(estimatedTokens)
+	}
+	setRateLimitHeaders(w, limits)
+	return 0, ""
+}
+
+// settle replaces a request's reserved token estimate with its actual usage.
+func (l *rateLimiter) settle(key *config.KeyConfig, estimatedTokens, actualTokens int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limits, ok := l.keys[key.Name]; ok && limits.tokens != nil {
+		limits.tokens.tokens += float64(estimatedTokens - actualTokens)
+	}
+}
+
+// setRateLimitHeaders reports a key's limits in the x-ratelimit-* headers
+// that OpenAI SDKs read.
+func setRateLimitHeaders(w http.ResponseWriter, limits *keyLimits) {
+	for name, bucket := range map[string]*tokenBucket{"requests": limits.requests, "tokens": limits.tokens} {
+		if bucket == nil {
+			continue
+		}
+		w.Header().Set("x-ratelimit-limit-"+name, strconv.Itoa(int(bucket.capacity)))
+		w.Header().Set("x-ratelimit-remaining-"+name, strconv.Itoa(bucket.remaining()))
+		w.Header().Set("x-ratelimit-reset-"+name, bucket.reset().String())
+	}
+}
@@ -0,0 +1,70 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_RateLimit(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	broker := New(&config.Config{})
+	broker.limiter.now = func() time.Time { return now }
+	key := &config.KeyConfig{Name: "team-a", Key: "lmb-secret", RPM: 2, TPM: 100}
+
+	usage := `{"usage": {"prompt_tokens": 10, "completion_tokens": 20}}`
+	handler := broker.EnforceQuotas(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(usage))
+	}))
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello there"}]}`))
+		req = req.WithContext(context.WithValue(req.Context(), clientKeyKey, key))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", rr.Code)
+	}
+	if rr.Header().Get("x-ratelimit-limit-requests") != "2" || rr.Header().Get("x-ratelimit-remaining-requests") != "1" {
+		t.Errorf("Expected request limit headers, got: %v", rr.Header())
+	}
+	send()
+
+	// The third request in the same minute is rejected
+	rr = send()
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got: %d", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "30" || !strings.Contains(rr.Body.String(), "rate_limit_exceeded") {
+		t.Errorf("Expected Retry-After 30 and an OpenAI-style error, got: %v %s", rr.Header(), rr.Body.String())
+	}
+
+	// Reported usage is charged: two requests of 30 tokens leave 40, half a
+	// minute refills 50, and the next request reserves 6 for its prompt
+	// (3 tokens of text and 3 of message framing)
+	now = now.Add(30 * time.Second)
+	if rr = send(); rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 after refilling, got: %d", rr.Code)
+	}
+	if remaining := rr.Header().Get("x-ratelimit-remaining-tokens"); remaining != "84" {
+		t.Errorf("Expected 84 remaining tokens before settling, got: %s", remaining)
+	}
+
+	// A key in token debt is rejected until it is repaid
+	usage = `{"usage": {"prompt_tokens": 500, "completion_tokens": 0}}`
+	now = now.Add(30 * time.Second)
+	send()
+	now = now.Add(time.Second)
+	rr = send()
+	if rr.Code != http.StatusTooManyRequests || !strings.Contains(rr.Body.String(), "tokens per minute") {
+		t.Errorf("Expected the token limit to reject, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
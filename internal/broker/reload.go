@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"log/slog"
+	"reflect"
+
+	"lmbroker/internal/config"
+)
+
+// Reload switches the broker to the models, default model, client keys and
+// routing rules of a newly loaded configuration. Requests already in flight
+// finish against the model they started with. Rollouts and health results
+// of targets that did not change are kept, and a changed target of an alias
+// with canary settings starts a canary. Response caches are kept for aliases
+// whose definition did not change, so reloads that only resolve secrets
+// again keep them. Other settings (server, gateway, eval, health check timing) only take
+// effect on restart.
+func (b *Broker) Reload(cfg *config.Config) {
+	b.mu.Lock()
+	previous := b.cfg.Definitions
+	b.rollouts = newRollouts(cfg.Models, b.cfg.Models, b.rollouts)
+	b.cfg.Models = cfg.Models
+	b.cfg.Definitions = cfg.Definitions
+	b.cfg.DefaultModel = cfg.DefaultModel
+	b.cfg.Keys = cfg.Keys
+	b.cfg.Routes = cfg.Routes
+	b.mu.Unlock()
+
+	// Cached responses of a changed alias may come from targets that are no
+	// longer configured, and semantic caches also depend on the embedding
+	// alias that indexed them.
+	changed := func(alias string) bool {
+		old, hadOld := previous[alias]
+		current, ok := cfg.Definitions[alias]
+		return !hadOld || !ok || !sameDefinition(old, current)
+	}
+	b.cachesMu.Lock()
+	for alias := range b.caches {
+		model := cfg.Models[alias]
+		if changed(alias) || (model.Cache != nil && model.Cache.Mode == "semantic" && changed(model.Cache.EmbeddingAlias)) {
+			delete(b.caches, alias)
+		}
+	}
+	b.cachesMu.Unlock()
+
+	b.health.setModels(cfg.Models)
+	slog.Info("configuration reloaded", "models", len(cfg.Models))
+}
+
+// sameDefinition reports whether two models are written the same way.
+func sameDefinition(a, b config.Model) bool {
+	tableA, errA := config.ModelTable(a)
+	tableB, errB := config.ModelTable(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(tableA, tableB)
+}
@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Reload(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	green := &config.RolloutConfig{Type: "openai", StepPercent: 10, Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"}}
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4": {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}, Green: green},
+		},
+	})
+	rolloutBefore := broker.rollouts["gpt-4"]
+	for _, target := range broker.health.targets {
+		if target.Target == "primary" {
+			target.Status = healthDown
+		}
+	}
+
+	broker.Reload(&config.Config{
+		Models: map[string]config.Model{
+			"gpt-4": {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}, Green: green},
+			"new":   {Alias: "new", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o-mini"}},
+		},
+	})
+
+	// New aliases are served immediately
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "new", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200 for a reloaded alias, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+
+	// Unchanged rollouts and health results carry over
+	if broker.rollouts["gpt-4"] != rolloutBefore {
+		t.Errorf("Expected the unchanged rollout to be kept")
+	}
+	if broker.health.healthy("gpt-4", "primary") {
+		t.Errorf("Expected the unchanged target to keep its health result")
+	}
+	if !broker.health.healthy("new", "primary") || len(broker.health.snapshot()) != 3 {
+		t.Errorf("Expected the new target to be probed, got: %v", broker.health.snapshot())
+	}
+
+	// Removed aliases are no longer served
+	broker.Reload(&config.Config{Models: map[string]config.Model{}})
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr = httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a removed alias, got: %d", rr.Code)
+	}
+}
+
+func TestBroker_ReloadStartsCanary(t *testing.T) {
+	served := map[string]int{}
+	var mu sync.Mutex
+	backend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			served[name]++
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+		}))
+	}
+	oldBackend, newBackend := backend("old"), backend("new")
+	defer oldBackend.Close()
+	defer newBackend.Close()
+
+	model := func(url string) config.Model {
+		model := config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: url + "/", Model: "gpt-4"}, Canary: &config.CanaryConfig{Percent: 50, MinRequests: 1000}}
+		if err := config.PrepareModel(&model); err != nil {
+			t.Fatalf("Failed to prepare model: %v", err)
+		}
+		return model
+	}
+	broker := New(&config.Config{Models: map[string]config.Model{"gpt-4": model(oldBackend.URL)}})
+	broker.Reload(&config.Config{Models: map[string]config.Model{"gpt-4": model(newBackend.URL)}})
+
+	// The changed target only gets the canary's share of traffic
+	for i := 0; i < 40; i++ {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+		}
+	}
+	if served["old"] == 0 || served["new"] == 0 || served["old"]+served["new"] != 40 {
+		t.Errorf("Expected traffic split between the previous and new targets, got: %v", served)
+	}
+}
+
+func TestBroker_ReloadKeepsCaches(t *testing.T) {
+	calls := 0
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	configPath := filepath.Join(t.TempDir(), "config.toml")
+	load := func(model string) *config.Config {
+		os.WriteFile(configPath, []byte(`
+[[models]]
+  alias = "gpt-4"
+  type = "openai"
+  target = { url = "`+mockBackend.URL+`/", model = "`+model+`", api_key = "env:LMBROKER_TEST_KEY" }
+  cache = {}
+`), 0o644)
+		cfg, err := config.Load(configPath)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+		return cfg
+	}
+	t.Setenv("LMBROKER_TEST_KEY", "sk-old")
+	broker := New(load("gpt-4"))
+	send := func() {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+		broker.HandleChatCompletions(httptest.NewRecorder(), req)
+	}
+	send()
+
+	// A rotated secret keeps the cached responses
+	t.Setenv("LMBROKER_TEST_KEY", "sk-new")
+	broker.Reload(load("gpt-4"))
+	send()
+	if calls != 1 {
+		t.Errorf("Expected the cache to survive a secret refresh, got: %d backend calls", calls)
+	}
+
+	// A changed target does not
+	broker.Reload(load("gpt-4o"))
+	send()
+	if calls != 2 {
+		t.Errorf("Expected the cache to be dropped for a changed target, got: %d backend calls", calls)
+	}
+}
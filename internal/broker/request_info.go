@@ -0,0 +1,154 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+// requestInfo collects what the broker learns about a client request while
+// serving it, for metrics and accounting once the response is done. The
+// response is captured so its reported token usage can be read.
+type requestInfo struct {
+	start   time.Time
+	capture *captureWriter
+
+	mu       sync.Mutex
+	key      *config.KeyConfig
+	model    *config.Model
+	workflow string
+	cached   bool
+
+	experiment string
+	arm        string
+
+	usageOnce    sync.Once
+	inputTokens  int
+	outputTokens int
+}
+
+// withRequestInfo returns the request's info, attaching a new one and a
+// capturing writer on first use so nested middlewares share one capture.
+func withRequestInfo(w http.ResponseWriter, r *http.Request) (*requestInfo, http.ResponseWriter, *http.Request) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok && info != nil {
+		return info, w, r
+	}
+	info := &requestInfo{start: time.Now(), capture: newCaptureWriter(w)}
+	return info, info.capture, r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+}
+
+// withoutRequestInfo detaches requests derived from ctx, such as eval
+// mirrors, from the client request's info.
+func withoutRequestInfo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestInfoKey, (*requestInfo)(nil))
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// noteServedTarget records the target about to serve a request. With a
+// fallback chain the last target tried is the one that answered.
+func noteServedTarget(r *http.Request, modelConfig *config.Model) {
+	if info := requestInfoFrom(r); info != nil {
+		info.mu.Lock()
+		info.model = modelConfig
+		info.mu.Unlock()
+	}
+}
+
+// noteClientKey records the client key that authenticated a request, for
+// middlewares that run outside Authenticate.
+func noteClientKey(r *http.Request, key *config.KeyConfig) {
+	if info := requestInfoFrom(r); info != nil {
+		info.mu.Lock()
+		info.key = key
+		info.mu.Unlock()
+	}
+}
+
+// noteCacheHit records that a request was answered from the response cache.
+func noteCacheHit(r *http.Request) {
+	if info := requestInfoFrom(r); info != nil {
+		info.mu.Lock()
+		info.cached = true
+		info.mu.Unlock()
+	}
+}
+
+// noteWorkflow records whether a request was passed through or translated.
+func noteWorkflow(r *http.Request, workflow string) {
+	if info := requestInfoFrom(r); info != nil {
+		info.mu.Lock()
+		info.workflow = workflow
+		info.mu.Unlock()
+	}
+}
+
+// noteExperimentArm records the experiment arm a request was assigned to.
+func noteExperimentArm(r *http.Request, experiment, arm string) {
+	if info := requestInfoFrom(r); info != nil {
+		info.mu.Lock()
+		info.experiment, info.arm = experiment, arm
+		info.mu.Unlock()
+	}
+}
+
+// experimentArm returns the experiment and arm of the request, or "" for
+// requests outside any experiment.
+func (i *requestInfo) experimentArm() (string, string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.experiment, i.arm
+}
+
+// target returns the target that served the request and its workflow; the
+// model is nil for requests that did not reach one.
+func (i *requestInfo) target() (*config.Model, string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.model, i.workflow
+}
+
+// cacheHit reports whether the response came from the response cache.
+func (i *requestInfo) cacheHit() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.cached
+}
+
+// clientKey returns the key that authenticated the request, or nil.
+func (i *requestInfo) clientKey() *config.KeyConfig {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.key
+}
+
+func (i *requestInfo) pricing() config.PricingConfig {
+	if model, _ := i.target(); model != nil {
+		return model.Target.Pricing
+	}
+	return config.PricingConfig{}
+}
+
+// estimateUsage replaces the usage of a response that reported none with
+// an estimate. It must only be called once the response is complete.
+func (i *requestInfo) estimateUsage(inputTokens, outputTokens int) {
+	i.usage()
+	i.inputTokens, i.outputTokens = inputTokens, outputTokens
+}
+
+// usage returns the token counts the response reported. It must only be
+// called once the response is complete. Cache hits used no tokens.
+func (i *requestInfo) usage() (int, int) {
+	i.usageOnce.Do(func() {
+		if !i.cacheHit() {
+			i.inputTokens, i.outputTokens = parseUsage(i.capture.body.Bytes())
+		}
+	})
+	return i.inputTokens, i.outputTokens
+}
@@ -0,0 +1,319 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// requestRecord is one API request in the request log.
+type requestRecord struct {
+	Timestamp    time.Time   `json:"timestamp"`
+	RequestID    string      `json:"request_id"`
+	Method       string      `json:"method"`
+	Path         string      `json:"path"`
+	Key          string      `json:"key,omitempty"`
+	Alias        string      `json:"alias,omitempty"`
+	Provider     string      `json:"provider,omitempty"`
+	Target       string      `json:"target,omitempty"`
+	Workflow     string      `json:"workflow,omitempty"`
+	Status       int         `json:"status"`
+	LatencyMS    int64       `json:"latency_ms"`
+	InputTokens  int         `json:"input_tokens"`
+	OutputTokens int         `json:"output_tokens"`
+	Cost         float64     `json:"cost"`
+	Cached       bool        `json:"cached,omitempty"`
+	Experiment   string      `json:"experiment,omitempty"`
+	Arm          string      `json:"arm,omitempty"`
+	Request      interface{} `json:"request,omitempty"`
+	Response     interface{} `json:"response,omitempty"`
+}
+
+// requestStore keeps the latest requests in memory to answer queries, and
+// appends every request to the configured file, which is replayed on
+// startup. Queries that need more than the memory holds read the older
+// records back from the file.
+type requestStore struct {
+	cfg config.RequestLogConfig
+
+	mu      sync.Mutex
+	file    *os.File
+	records []requestRecord
+	total   int // records added since startup, so the file's first total-MaxRecords are no longer in memory
+}
+
+func newRequestStore(cfg config.RequestLogConfig) *requestStore {
+	if cfg.MaxRecords <= 0 {
+		cfg.MaxRecords = 10000
+	}
+	store := &requestStore{cfg: cfg}
+	if cfg.Enabled && cfg.File != "" {
+		store.load()
+	}
+	return store
+}
+
+// load replays the request log, keeping its latest records. Lines that fail
+// to decode, such as one cut short by a crash, are skipped.
+func (s *requestStore) load() {
+	file, err := os.Open(s.cfg.File)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to open request log", "path", s.cfg.File, "error", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record requestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err == nil {
+			s.addLocked(record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("failed to read request log", "path", s.cfg.File, "error", err)
+	}
+	slog.Info("request log loaded", "path", s.cfg.File, "records", s.total)
+}
+
+// scanOlder returns up to limit records matching q, newest first, among the
+// first count records of the file: those that have left memory.
+func (s *requestStore) scanOlder(q requestQuery, count, limit int) []requestRecord {
+	file, err := os.Open(s.cfg.File)
+	if err != nil {
+		slog.Error("failed to open request log", "path", s.cfg.File, "error", err)
+		return nil
+	}
+	defer file.Close()
+
+	var matches []requestRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for seen := 0; seen < count && scanner.Scan(); {
+		var record requestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		seen++
+		if q.matches(record) {
+			matches = append(matches, record)
+			if len(matches) > 2*limit {
+				matches = append([]requestRecord(nil), matches[len(matches)-limit:]...)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("failed to read request log", "path", s.cfg.File, "error", err)
+	}
+
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	slices.Reverse(matches)
+	return matches
+}
+
+// addLocked keeps a record, dropping the oldest beyond MaxRecords. The
+// backing array is compacted once it holds twice as many.
+func (s *requestStore) addLocked(record requestRecord) {
+	s.total++
+	s.records = append(s.records, record)
+	if len(s.records) > 2*s.cfg.MaxRecords {
+		s.records = append([]requestRecord(nil), s.records[len(s.records)-s.cfg.MaxRecords:]...)
+	}
+}
+
+// latestLocked returns the records still kept for queries.
+func (s *requestStore) latestLocked() []requestRecord {
+	if len(s.records) > s.cfg.MaxRecords {
+		return s.records[len(s.records)-s.cfg.MaxRecords:]
+	}
+	return s.records
+}
+
+func (s *requestStore) record(record requestRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addLocked(record)
+	if s.cfg.File == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("failed to encode request record", "error", err)
+		return
+	}
+	if s.file == nil {
+		file, err := os.OpenFile(s.cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			slog.Error("failed to open request log", "path", s.cfg.File, "error", err)
+			return
+		}
+		s.file = file
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write request record", "path", s.cfg.File, "error", err)
+	}
+}
+
+// requestQuery selects requests. Status is a code such as "429" or a class
+// such as "5xx"; empty fields match everything.
+type requestQuery struct {
+	key    string
+	alias  string
+	status string
+	from   time.Time
+	to     time.Time
+	limit  int
+}
+
+func (q requestQuery) matches(record requestRecord) bool {
+	if (q.key != "" && record.Key != q.key) || (q.alias != "" && record.Alias != q.alias) {
+		return false
+	}
+	if q.status != "" {
+		code := strconv.Itoa(record.Status)
+		if class, ok := strings.CutSuffix(q.status, "xx"); ok {
+			if !strings.HasPrefix(code, class) {
+				return false
+			}
+		} else if code != q.status {
+			return false
+		}
+	}
+	if (!q.from.IsZero() && record.Timestamp.Before(q.from)) || (!q.to.IsZero() && !record.Timestamp.Before(q.to)) {
+		return false
+	}
+	return true
+}
+
+// query returns the matching requests, newest first. When the records in
+// memory do not fill the limit, the search continues through the older
+// records in the file.
+func (s *requestStore) query(q requestQuery) []requestRecord {
+	s.mu.Lock()
+	records := s.latestLocked()
+	results := []requestRecord{}
+	for i := len(records) - 1; i >= 0 && len(results) < q.limit; i-- {
+		if q.matches(records[i]) {
+			results = append(results, records[i])
+		}
+	}
+	older := s.total - len(records)
+	s.mu.Unlock()
+
+	if len(results) < q.limit && older > 0 && s.cfg.File != "" {
+		results = append(results, s.scanOlder(q, older, q.limit-len(results))...)
+	}
+	return results
+}
+
+// LogRequests is a middleware that stores the metadata of every API
+// request, and optionally its bodies, in the request log. It must be
+// installed outside Authenticate.
+func (b *Broker) LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.requests.cfg.Enabled || !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, w, r := withRequestInfo(w, r)
+		var envelope *workflows.Envelope
+		if b.requests.cfg.IncludeBodies {
+			envelope, _ = workflows.ReadEnvelope(r)
+		}
+		next.ServeHTTP(w, r)
+
+		record := requestRecord{
+			Timestamp: info.start.UTC(),
+			RequestID: requestID(r),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    info.capture.status,
+			LatencyMS: time.Since(info.start).Milliseconds(),
+			Cached:    info.cacheHit(),
+		}
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		if key := info.clientKey(); key != nil {
+			record.Key = key.Name
+		}
+		if model, workflow := info.target(); model != nil {
+			record.Alias, record.Provider, record.Target, record.Workflow = model.Alias, model.Type, model.Target.Model, workflow
+			record.InputTokens, record.OutputTokens = info.usage()
+			record.Cost = info.pricing().Cost(record.InputTokens, record.OutputTokens)
+		}
+		record.Experiment, record.Arm = info.experimentArm()
+		if envelope != nil {
+			record.Request = b.content.body(envelope.Raw)
+			record.Response = b.content.body(info.capture.body.Bytes())
+		}
+		b.requests.record(record)
+	})
+}
+
+// HandleAdminRequests serves /admin/requests with the latest matching
+// requests, newest first. Query parameters: key, alias, status (a code such
+// as 429 or a class such as 5xx), from and to (RFC 3339 times or YYYY-MM-DD
+// days; to is exclusive), and limit (default 100).
+func (b *Broker) HandleAdminRequests(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAdmin(w, r) {
+		return
+	}
+	if !b.requests.cfg.Enabled {
+		http.Error(w, "request log is not enabled", http.StatusNotFound)
+		return
+	}
+	params := r.URL.Query()
+	q := requestQuery{key: params.Get("key"), alias: params.Get("alias"), status: params.Get("status"), limit: 100}
+	if q.status != "" {
+		if _, err := strconv.Atoi(strings.TrimSuffix(q.status, "xx")); err != nil {
+			http.Error(w, "status must be a code such as 429 or a class such as 5xx", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, bound := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &q.from}, {"to", &q.to}} {
+		value := params.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			parsed, err = time.Parse("2006-01-02", value)
+		}
+		if err != nil {
+			http.Error(w, bound.name+" must be an RFC 3339 time or a YYYY-MM-DD date", http.StatusBadRequest)
+			return
+		}
+		*bound.value = parsed
+	}
+	if limit := params.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		q.limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"requests": b.requests.query(q)})
+}
@@ -0,0 +1,95 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_RequestLog(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 10, "completion_tokens": 2}}`))
+	}))
+	defer mockBackend.Close()
+
+	cfg := &config.Config{
+		Server:     config.ServerConfig{AdminKey: "admin-secret"},
+		RequestLog: config.RequestLogConfig{Enabled: true, File: filepath.Join(t.TempDir(), "requests.jsonl"), IncludeBodies: true},
+		Models: map[string]config.Model{
+			"gpt-4o": {Alias: "gpt-4o", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o"}},
+		},
+		Keys: []config.KeyConfig{{Name: "team-a", Key: "sk-team-a"}, {Name: "team-b", Key: "sk-team-b"}},
+	}
+	broker := New(cfg)
+	handler := broker.LogRequests(broker.Authenticate(http.HandlerFunc(broker.HandleChatCompletions)))
+	for _, call := range []struct{ key, model string }{
+		{"sk-team-a", "gpt-4o"},
+		{"sk-team-a", "unknown"},
+		{"sk-team-b", "gpt-4o"},
+		{"sk-wrong", "gpt-4o"},
+	} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+call.model+`", "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Authorization", "Bearer "+call.key)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	query := func(broker *Broker, params string) []requestRecord {
+		req := httptest.NewRequest("GET", "/admin/requests?"+params, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		rr := httptest.NewRecorder()
+		broker.HandleAdminRequests(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 from /admin/requests?%s, got: %d (%s)", params, rr.Code, rr.Body.String())
+		}
+		var response struct {
+			Requests []requestRecord `json:"requests"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response.Requests
+	}
+
+	// Every request is kept, newest first, including those that failed
+	all := query(broker, "")
+	if len(all) != 4 || all[0].Status != http.StatusUnauthorized || all[1].Key != "team-b" {
+		t.Fatalf("Expected four requests, newest first, got: %+v", all)
+	}
+
+	// Filters combine
+	served := query(broker, "key=team-a&status=2xx")
+	if len(served) != 1 || served[0].Alias != "gpt-4o" || served[0].InputTokens != 10 || served[0].Workflow != "passthrough" {
+		t.Errorf("Expected team-a's served request, got: %+v", served)
+	}
+	if failed := query(broker, "status=404"); len(failed) != 1 || failed[0].Key != "team-a" {
+		t.Errorf("Expected the unknown model request, got: %+v", failed)
+	}
+	if recent := query(broker, "from=2999-01-01"); len(recent) != 0 {
+		t.Errorf("Expected no requests in the future, got: %+v", recent)
+	}
+	if limited := query(broker, "limit=2"); len(limited) != 2 {
+		t.Errorf("Expected two requests, got: %d", len(limited))
+	}
+	if served[0].Request == nil || served[0].Response == nil {
+		t.Errorf("Expected the bodies to be stored, got: %+v", served[0])
+	}
+
+	// The log survives a restart
+	if replayed := query(New(cfg), "alias=gpt-4o"); len(replayed) != 2 {
+		t.Errorf("Expected the requests to be replayed, got: %+v", replayed)
+	}
+
+	// Queries reach past max_records into the file
+	cfg.RequestLog.MaxRecords = 1
+	small := New(cfg)
+	if older := query(small, "key=team-a"); len(older) != 2 || older[0].Status != http.StatusNotFound || older[1].Status != http.StatusOK {
+		t.Errorf("Expected team-a's requests from the file, newest first, got: %+v", older)
+	}
+	if limited := query(small, "limit=3"); len(limited) != 3 || limited[0].Status != http.StatusUnauthorized || limited[2].Key != "team-a" {
+		t.Errorf("Expected the newest three requests, got: %+v", limited)
+	}
+}
@@ -0,0 +1,334 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+// Rollout states.
+const (
+	rolloutActive     = "rolling"
+	rolloutPromoted   = "promoted"
+	rolloutRolledBack = "rolled_back"
+)
+
+// rolloutStats accumulates outcomes for one side during a step.
+type rolloutStats struct {
+	requests int
+	errors   int
+	latency  time.Duration
+}
+
+func (s rolloutStats) errorRate() float64 {
+	if s.requests == 0 {
+		return 0
+	}
+	return float64(s.errors) / float64(s.requests)
+}
+
+func (s rolloutStats) meanLatency() time.Duration {
+	if s.requests == 0 {
+		return 0
+	}
+	return s.latency / time.Duration(s.requests)
+}
+
+// rollout shifts an alias's traffic from its blue target to a green one in
+// steps, comparing the two sides at each step and rolling back on regression.
+// A canary is a rollout of a changed target in a single step: its green side
+// is the alias's new target and its base the target it replaces.
+type rollout struct {
+	alias    string
+	cfg      *config.RolloutConfig
+	base     *config.TargetConfig
+	baseType string
+	now      func() time.Time
+	alert    func(payload map[string]interface{})
+
+	mu      sync.Mutex
+	state   string
+	percent int
+	stepAt  time.Time
+	blue    rolloutStats
+	green   rolloutStats
+}
+
+func newRollout(alias string, cfg *config.RolloutConfig) *rollout {
+	r := &rollout{
+		alias:   alias,
+		cfg:     cfg,
+		now:     time.Now,
+		state:   rolloutActive,
+		percent: min(cfg.StepPercent, 100),
+	}
+	r.stepAt = r.now()
+	r.alert = r.postAlert
+	return r
+}
+
+// newCanary starts a canary of an alias's new target against the target
+// it served before.
+func newCanary(alias string, model config.Model, base config.TargetConfig, baseType string) *rollout {
+	canary := model.Canary
+	r := newRollout(alias, &config.RolloutConfig{
+		Target:               model.Target,
+		Type:                 model.Type,
+		StepPercent:          canary.Percent,
+		StepDuration:         canary.PeriodDuration,
+		MinRequests:          canary.MinRequests,
+		MaxErrorRateIncrease: canary.MaxErrorRateIncrease,
+		MaxLatencyRatio:      canary.MaxLatencyRatio,
+		AlertWebhook:         canary.AlertWebhook,
+	})
+	r.base, r.baseType = &base, baseType
+	return r
+}
+
+// newRollouts tracks a rollout for every alias that defines a green
+// target. Rollouts in previous whose green target is unchanged carry over
+// with their progress. An alias with canary settings whose target URL or
+// model differs from its previous model starts a canary; a canary whose
+// new target is still the alias's target carries over.
+func newRollouts(models, previousModels map[string]config.Model, previous map[string]*rollout) map[string]*rollout {
+	rollouts := make(map[string]*rollout)
+	for alias, model := range models {
+		existing, hasExisting := previous[alias]
+		if model.Green != nil {
+			if hasExisting && existing.base == nil && reflect.DeepEqual(existing.cfg, model.Green) {
+				rollouts[alias] = existing
+				continue
+			}
+			rollouts[alias] = newRollout(alias, model.Green)
+			continue
+		}
+		if model.Canary == nil {
+			continue
+		}
+		if hasExisting && existing.base != nil && sameTarget(existing.cfg.Target, model.Target) {
+			rollouts[alias] = existing
+			continue
+		}
+		old, ok := previousModels[alias]
+		if !ok || sameTarget(old.Target, model.Target) {
+			continue
+		}
+		// A canary replaced before it was promoted never took the
+		// traffic, so the new one is measured against its base.
+		base, baseType := old.Target, old.Type
+		if hasExisting && existing.base != nil && existing.currentState() != rolloutPromoted {
+			base, baseType = *existing.base, existing.baseType
+		}
+		slog.Info("canary started", "alias", alias, "canary_target", model.Target.Model, "previous_target", base.Model, "canary_traffic_pct", model.Canary.Percent)
+		rollouts[alias] = newCanary(alias, model, base, baseType)
+	}
+	return rollouts
+}
+
+// sameTarget reports whether two targets reach the same model at the same
+// URL.
+func sameTarget(a, b config.TargetConfig) bool {
+	return a.URL == b.URL && a.Model == b.Model
+}
+
+func (r *rollout) currentState() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state
+}
+
+// pick chooses the side for one request and returns the model config to use.
+func (r *rollout) pick(modelConfig *config.Model) (*config.Model, bool) {
+	r.mu.Lock()
+	percent := r.percent
+	r.mu.Unlock()
+
+	if percent <= 0 || (percent < 100 && rand.IntN(100) >= percent) {
+		return r.blueModel(modelConfig), false
+	}
+	green := *modelConfig
+	green.Target = r.cfg.Target
+	green.Type = r.cfg.Type
+	return &green, true
+}
+
+// blueModel returns the model config of the blue side: the alias's own target,
+// or for a canary the target it replaces.
+func (r *rollout) blueModel(modelConfig *config.Model) *config.Model {
+	if r.base == nil {
+		return modelConfig
+	}
+	blue := *modelConfig
+	blue.Target = *r.base
+	blue.Type = r.baseType
+	return &blue
+}
+
+// record adds a finished request to the current step and advances the
+// rollout once the step has enough evidence.
+func (r *rollout) record(green bool, status int, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state != rolloutActive {
+		return
+	}
+
+	stats := &r.blue
+	if green {
+		stats = &r.green
+	}
+	stats.requests++
+	stats.latency += latency
+	if status >= 500 {
+		stats.errors++
+	}
+
+	if r.green.requests < r.cfg.MinRequests || r.now().Sub(r.stepAt) < r.cfg.StepDuration {
+		return
+	}
+	r.evaluate()
+}
+
+// evaluate judges the current step. It must be called with mu held.
+func (r *rollout) evaluate() {
+	blue, green := r.blue, r.green
+	r.blue, r.green = rolloutStats{}, rolloutStats{}
+	r.stepAt = r.now()
+
+	errorIncrease := green.errorRate() - blue.errorRate()
+	latencyRatio := 0.0
+	if blue.requests > 0 && blue.meanLatency() > 0 {
+		latencyRatio = float64(green.meanLatency()) / float64(blue.meanLatency())
+	}
+
+	if r.base != nil {
+		r.evaluateCanary(blue, green, errorIncrease, latencyRatio)
+		return
+	}
+	if errorIncrease > r.cfg.MaxErrorRateIncrease || latencyRatio > r.cfg.MaxLatencyRatio {
+		payload := map[string]interface{}{
+			"alias":             r.alias,
+			"event":             "green_rolled_back",
+			"green_target":      r.cfg.Target.Model,
+			"green_error_rate":  green.errorRate(),
+			"blue_error_rate":   blue.errorRate(),
+			"green_latency_ms":  green.meanLatency().Milliseconds(),
+			"blue_latency_ms":   blue.meanLatency().Milliseconds(),
+			"green_traffic_pct": r.percent,
+		}
+		r.state = rolloutRolledBack
+		r.percent = 0
+		slog.Error("green target degraded, rolled back", "alias", r.alias, "green_target", r.cfg.Target.Model,
+			"green_error_rate", green.errorRate(), "blue_error_rate", blue.errorRate(),
+			"green_latency_ms", green.meanLatency().Milliseconds(), "blue_latency_ms", blue.meanLatency().Milliseconds())
+		go r.alert(payload)
+		return
+	}
+
+	r.percent = min(r.percent+r.cfg.StepPercent, 100)
+	if r.percent == 100 {
+		r.state = rolloutPromoted
+		slog.Info("green target promoted", "alias", r.alias, "green_target", r.cfg.Target.Model)
+		return
+	}
+	slog.Info("green rollout step", "alias", r.alias, "green_traffic_pct", r.percent,
+		"green_error_rate", green.errorRate(), "blue_error_rate", blue.errorRate())
+}
+
+// evaluateCanary judges a canary, which is promoted outright if it did not
+// regress. It must be called with mu held.
+func (r *rollout) evaluateCanary(previous, canary rolloutStats, errorIncrease, latencyRatio float64) {
+	if errorIncrease > r.cfg.MaxErrorRateIncrease || latencyRatio > r.cfg.MaxLatencyRatio {
+		payload := map[string]interface{}{
+			"alias":               r.alias,
+			"event":               "canary_rolled_back",
+			"canary_target":       r.cfg.Target.Model,
+			"previous_target":     r.base.Model,
+			"canary_error_rate":   canary.errorRate(),
+			"previous_error_rate": previous.errorRate(),
+			"canary_latency_ms":   canary.meanLatency().Milliseconds(),
+			"previous_latency_ms": previous.meanLatency().Milliseconds(),
+		}
+		r.state = rolloutRolledBack
+		r.percent = 0
+		slog.Error("canary target degraded, rolled back", "alias", r.alias, "canary_target", r.cfg.Target.Model, "previous_target", r.base.Model,
+			"canary_error_rate", canary.errorRate(), "previous_error_rate", previous.errorRate(),
+			"canary_latency_ms", canary.meanLatency().Milliseconds(), "previous_latency_ms", previous.meanLatency().Milliseconds())
+		go r.alert(payload)
+		return
+	}
+	r.state = rolloutPromoted
+	r.percent = 100
+	slog.Info("canary target promoted", "alias", r.alias, "canary_target", r.cfg.Target.Model)
+}
+
+// postAlert sends a rollback notice to the configured alert webhook.
+func (r *rollout) postAlert(payload map[string]interface{}) {
+	if r.cfg.AlertWebhook == "" {
+		return
+	}
+	body, _ := json.Marshal(payload)
+	resp, err := http.Post(r.cfg.AlertWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		slog.Error("failed to send rollout alert", "alias", r.alias, "error", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// statusRecorder captures the status code written through a ResponseWriter
+// without buffering the body.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+// Flush lets streaming workflows push chunks through the recorder.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// withRollout routes a request through the alias's blue/green rollout, if
+// any, recording the outcome against the side that served it.
+func (b *Broker) withRollout(w http.ResponseWriter, modelConfig *config.Model, serve func(http.ResponseWriter, *config.Model)) {
+	b.mu.RLock()
+	rollout, ok := b.rollouts[modelConfig.Alias]
+	b.mu.RUnlock()
+	if !ok {
+		serve(w, modelConfig)
+		return
+	}
+
+	target, green := rollout.pick(modelConfig)
+	// A rate-limited green target hands its share back to blue for now.
+	if green && b.cooldown.active(target) {
+		target, green = rollout.blueModel(modelConfig), false
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	start := time.Now()
+	serve(recorder, target)
+	rollout.record(green, recorder.status, time.Since(start))
+}
@@ -0,0 +1,179 @@
+package broker
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func newTestRollout(clock *time.Time, alerts chan map[string]interface{}) *rollout {
+	r := newRollout("gpt-4", &config.RolloutConfig{
+		Target:               config.TargetConfig{URL: "http://green", Model: "gpt-4.1"},
+		Type:                 "openai",
+		StepPercent:          50,
+		StepDuration:         time.Minute,
+		MinRequests:          2,
+		MaxErrorRateIncrease: 0.05,
+		MaxLatencyRatio:      1.5,
+	})
+	r.now = func() time.Time { return *clock }
+	r.stepAt = *clock
+	r.alert = func(payload map[string]interface{}) { alerts <- payload }
+	return r
+}
+
+func TestRollout_PromotesHealthyGreen(t *testing.T) {
+	clock := time.Now()
+	r := newTestRollout(&clock, make(chan map[string]interface{}, 1))
+
+	model := &config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{Model: "gpt-4"}}
+	for step := 0; step < 2; step++ {
+		r.record(false, http.StatusOK, 100*time.Millisecond)
+		r.record(true, http.StatusOK, 110*time.Millisecond)
+		clock = clock.Add(2 * time.Minute)
+		r.record(true, http.StatusOK, 100*time.Millisecond)
+	}
+
+	if r.state != rolloutPromoted || r.percent != 100 {
+		t.Fatalf("Expected green promoted at 100%%, got: %s at %d%%", r.state, r.percent)
+	}
+	target, green := r.pick(model)
+	if !green || target.Target.Model != "gpt-4.1" || model.Target.Model != "gpt-4" {
+		t.Errorf("Expected promoted rollout to route to green without mutating blue, got: %s", target.Target.Model)
+	}
+}
+
+func TestRollout_RollsBackOnErrors(t *testing.T) {
+	clock := time.Now()
+	alerts := make(chan map[string]interface{}, 1)
+	r := newTestRollout(&clock, alerts)
+
+	r.record(false, http.StatusOK, 100*time.Millisecond)
+	r.record(true, http.StatusBadGateway, 100*time.Millisecond)
+	// Not enough time has passed, so the step is not judged yet.
+	r.record(true, http.StatusOK, 100*time.Millisecond)
+	if r.state != rolloutActive {
+		t.Fatalf("Expected rollout to wait for the step interval, got: %s", r.state)
+	}
+
+	clock = clock.Add(2 * time.Minute)
+	r.record(true, http.StatusInternalServerError, 100*time.Millisecond)
+
+	if r.state != rolloutRolledBack || r.percent != 0 {
+		t.Fatalf("Expected rollback to 0%%, got: %s at %d%%", r.state, r.percent)
+	}
+	select {
+	case payload := <-alerts:
+		if payload["event"] != "green_rolled_back" || payload["green_traffic_pct"] != 50 {
+			t.Errorf("Expected rollback alert at 50%%, got: %v", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a rollback alert")
+	}
+
+	if _, green := r.pick(&config.Model{Alias: "gpt-4"}); green {
+		t.Error("Expected rolled-back rollout to serve blue")
+	}
+}
+
+func TestRollout_RollsBackOnLatency(t *testing.T) {
+	clock := time.Now()
+	r := newTestRollout(&clock, make(chan map[string]interface{}, 1))
+
+	r.record(false, http.StatusOK, 100*time.Millisecond)
+	r.record(true, http.StatusOK, 400*time.Millisecond)
+	clock = clock.Add(2 * time.Minute)
+	r.record(true, http.StatusOK, 400*time.Millisecond)
+
+	if r.state != rolloutRolledBack {
+		t.Errorf("Expected rollback on 4x latency, got: %s", r.state)
+	}
+}
+
+func TestNewRollouts_Canary(t *testing.T) {
+	canary := &config.CanaryConfig{Percent: 10, PeriodDuration: time.Minute, MinRequests: 2, MaxErrorRateIncrease: 0.05, MaxLatencyRatio: 1.5}
+	model := func(url, target string) config.Model {
+		return config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: url, Model: target}, Canary: canary}
+	}
+	v1 := map[string]config.Model{"gpt-4": model("http://old", "gpt-4")}
+
+	// Nothing to canary on startup or while the target is unchanged
+	if rollouts := newRollouts(v1, nil, nil); len(rollouts) != 0 {
+		t.Errorf("Expected no canary on startup, got: %v", rollouts)
+	}
+	if rollouts := newRollouts(v1, v1, nil); len(rollouts) != 0 {
+		t.Errorf("Expected no canary for an unchanged target, got: %v", rollouts)
+	}
+
+	// A new model starts a canary against the previous one
+	v2 := map[string]config.Model{"gpt-4": model("http://new", "gpt-4.1")}
+	rollouts := newRollouts(v2, v1, nil)
+	r := rollouts["gpt-4"]
+	if r == nil || r.percent != 10 || r.base.URL != "http://old" || r.cfg.Target.Model != "gpt-4.1" {
+		t.Fatalf("Expected a canary of the new target, got: %+v", r)
+	}
+	served := v2["gpt-4"]
+	if blue := r.blueModel(&served); blue.Target.URL != "http://old" || served.Target.URL != "http://new" {
+		t.Errorf("Expected the rest of the traffic on the previous target, got: %s", blue.Target.URL)
+	}
+
+	// The canary carries over reloads that keep the new target
+	if newRollouts(v2, v2, rollouts)["gpt-4"] != r {
+		t.Errorf("Expected the canary to carry over")
+	}
+
+	// Replacing an unpromoted canary measures the next one against the
+	// target that kept the traffic
+	v3 := map[string]config.Model{"gpt-4": model("http://newer", "gpt-4.2")}
+	if next := newRollouts(v3, v2, rollouts)["gpt-4"]; next == r || next.base.URL != "http://old" {
+		t.Errorf("Expected a new canary against the original target, got: %+v", next)
+	}
+}
+
+func TestCanary_PromotesOrRollsBack(t *testing.T) {
+	clock := time.Now()
+	start := func() (*rollout, chan map[string]interface{}) {
+		alerts := make(chan map[string]interface{}, 1)
+		model := config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: "http://new", Model: "gpt-4.1"},
+			Canary: &config.CanaryConfig{Percent: 5, PeriodDuration: time.Minute, MinRequests: 2, MaxErrorRateIncrease: 0.05, MaxLatencyRatio: 1.5}}
+		r := newCanary("gpt-4", model, config.TargetConfig{URL: "http://old", Model: "gpt-4"}, "openai")
+		r.now = func() time.Time { return clock }
+		r.stepAt = clock
+		r.alert = func(payload map[string]interface{}) { alerts <- payload }
+		return r, alerts
+	}
+
+	// A healthy canary is promoted in one step
+	r, _ := start()
+	r.record(false, http.StatusOK, 100*time.Millisecond)
+	r.record(true, http.StatusOK, 100*time.Millisecond)
+	clock = clock.Add(2 * time.Minute)
+	r.record(true, http.StatusOK, 100*time.Millisecond)
+	if r.state != rolloutPromoted || r.percent != 100 {
+		t.Errorf("Expected the canary promoted at 100%%, got: %s at %d%%", r.state, r.percent)
+	}
+
+	// A failing canary hands all traffic back to the previous target
+	r, alerts := start()
+	r.record(false, http.StatusOK, 100*time.Millisecond)
+	r.record(true, http.StatusBadGateway, 100*time.Millisecond)
+	clock = clock.Add(2 * time.Minute)
+	r.record(true, http.StatusOK, 100*time.Millisecond)
+	if r.state != rolloutRolledBack || r.percent != 0 {
+		t.Fatalf("Expected the canary rolled back, got: %s at %d%%", r.state, r.percent)
+	}
+	select {
+	case payload := <-alerts:
+		if payload["event"] != "canary_rolled_back" || payload["previous_target"] != "gpt-4" {
+			t.Errorf("Expected a canary rollback alert, got: %v", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a rollback alert")
+	}
+	target, green := r.pick(&config.Model{Alias: "gpt-4", Target: config.TargetConfig{URL: "http://new", Model: "gpt-4.1"}})
+	if green || target.Target.URL != "http://old" {
+		t.Errorf("Expected the rolled-back canary to serve the previous target, got: %s", target.Target.URL)
+	}
+}
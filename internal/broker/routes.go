@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"lmbroker/internal/config"
+)
+
+// Route is one path of the broker's HTTP API and the handler serving it.
+type Route struct {
+	Path    string
+	Handler http.Handler
+}
+
+// Routes returns every path the broker serves: config.BrokerRoutes, which
+// embedding_paths are checked against, followed by the embedding paths.
+func (b *Broker) Routes() []Route {
+	var routes []Route
+	for _, path := range config.BrokerRoutes {
+		handler := b.routeHandler(path)
+		if handler == nil {
+			panic(fmt.Sprintf("broker route %s has no handler", path))
+		}
+		routes = append(routes, Route{Path: path, Handler: handler})
+	}
+	for _, path := range b.EmbeddingPaths() { // OpenAI, Cohere and Ollama formats
+		routes = append(routes, Route{Path: path, Handler: http.HandlerFunc(b.HandleEmbeddings)})
+	}
+	return routes
+}
+
+// routeHandler returns the handler of one of config.BrokerRoutes.
+func (b *Broker) routeHandler(path string) http.Handler {
+	switch path {
+	case "/health":
+		return http.HandlerFunc(b.HandleHealth)
+	case "/health/backends":
+		return http.HandlerFunc(b.HandleBackendHealth)
+	case "/metrics":
+		return promhttp.Handler()
+	// The admin endpoints need server.admin_key.
+	case "/admin/budgets":
+		return http.HandlerFunc(b.HandleAdminBudgets)
+	case "/admin/usage":
+		return http.HandlerFunc(b.HandleAdminUsage)
+	case "/admin/requests":
+		return http.HandlerFunc(b.HandleAdminRequests)
+	case "/admin/models", "/admin/models/":
+		return http.HandlerFunc(b.HandleAdminModels)
+	// Chat in the OpenAI, Anthropic and OpenAI Responses formats.
+	case "/v1/chat/completions", "/v1/messages", "/v1/responses":
+		return http.HandlerFunc(b.HandleChatCompletions)
+	case "/v1/messages/count_tokens":
+		return http.HandlerFunc(b.HandleCountTokens)
+	case "/v1/tokenize", "/v1/tokenize/count":
+		return http.HandlerFunc(b.HandleTokenize)
+	case "/v1/completions": // Legacy text completions
+		return http.HandlerFunc(b.HandleCompletions)
+	case "/v1/images/generations":
+		return http.HandlerFunc(b.HandleImageGenerations)
+	case "/v1/files", "/v1/files/":
+		return http.HandlerFunc(b.HandleFiles)
+	case "/v1/batches", "/v1/batches/":
+		return http.HandlerFunc(b.HandleBatches)
+	case "/v1/jobs/":
+		return http.HandlerFunc(b.HandleJobs)
+	case "/v1/audio/transcriptions", "/v1/audio/speech":
+		return http.HandlerFunc(b.HandleAudio)
+	}
+	return nil
+}
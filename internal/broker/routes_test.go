@@ -0,0 +1,27 @@
+package broker
+
+import (
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Routes(t *testing.T) {
+	broker := New(&config.Config{
+		Server: config.ServerConfig{EmbeddingPaths: map[string]string{"/custom/embed": "cohere"}},
+	})
+	paths := make(map[string]bool)
+	for _, route := range broker.Routes() {
+		if paths[route.Path] {
+			t.Errorf("Expected %s to be registered once", route.Path)
+		}
+		paths[route.Path] = true
+	}
+
+	// Every reserved path is served, along with the embedding paths
+	for _, path := range append(config.BrokerRoutes, "/v1/embeddings", "/custom/embed") {
+		if !paths[path] {
+			t.Errorf("Expected %s to be served", path)
+		}
+	}
+}
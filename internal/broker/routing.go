@@ -0,0 +1,210 @@
+package broker
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+	"lmbroker/internal/expr"
+)
+
+var routeMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_route_matches_total",
+	Help: "Requests sent to another alias by a routing rule, by rule.",
+}, []string{"rule"})
+
+// routePrograms caches the compiled when expressions of routing rules by
+// source, so reloaded rules are compiled once.
+var routePrograms sync.Map
+
+// applyRoutes returns the alias a request for an alias is served by under
+// the configured routing rules: the To of the first rule that matches, or
+// the alias itself. Rules are read on every request, so a reload takes
+// effect at once.
+func (b *Broker) applyRoutes(r *http.Request, alias string) string {
+	b.mu.RLock()
+	rules := b.cfg.Routes
+	b.mu.RUnlock()
+	if len(rules) == 0 {
+		return alias
+	}
+
+	user, userRead := "", false
+	var variables map[string]interface{}
+	for _, rule := range rules {
+		if !matchesAny(rule.Models, alias) || !matchesHeaders(r, rule.Headers) {
+			continue
+		}
+		if rule.User != "" {
+			if !userRead {
+				user, userRead = requestUser(r), true
+			}
+			if matched, _ := path.Match(rule.User, user); !matched || user == "" {
+				continue
+			}
+		}
+		if rule.When != "" {
+			if variables == nil {
+				variables = b.routeVariables(r, alias)
+			}
+			if !b.routeWhen(r, rule, variables) {
+				continue
+			}
+		}
+		routeMatches.WithLabelValues(rule.Name).Inc()
+		slog.Info("routing rule matched", "request_id", requestID(r), "rule", rule.Name, "requested", alias, "alias", rule.To)
+		return rule.To
+	}
+	return alias
+}
+
+// routeWhen evaluates a rule's when expression. An expression that fails,
+// such as one comparing a string to a number, does not match.
+func (b *Broker) routeWhen(r *http.Request, rule config.RouteRule, variables map[string]interface{}) bool {
+	program, err := routeProgram(rule.When)
+	if err == nil {
+		if _, counted := variables["tokens"]; program.Uses("tokens") && !counted {
+			variables["tokens"] = b.routeTokens(r)
+		}
+		var matched bool
+		if matched, err = program.EvalBool(variables); err == nil {
+			return matched
+		}
+	}
+	slog.Warn("routing rule failed", "request_id", requestID(r), "rule", rule.Name, "error", err)
+	return false
+}
+
+// routeProgram compiles a when expression, or returns it compiled.
+func routeProgram(source string) (*expr.Program, error) {
+	if program, ok := routePrograms.Load(source); ok {
+		return program.(*expr.Program), nil
+	}
+	program, err := expr.Compile(source, config.RouteVariables)
+	if err != nil {
+		return nil, err
+	}
+	routePrograms.Store(source, program)
+	return program, nil
+}
+
+// routeVariables returns the attributes of a request that when expressions
+// can use, except for tokens, which are only counted when an expression
+// needs them.
+func (b *Broker) routeVariables(r *http.Request, alias string) map[string]interface{} {
+	now := time.Now()
+	variables := map[string]interface{}{
+		"model":   alias,
+		"path":    r.URL.Path,
+		"user":    requestUser(r),
+		"key":     batchOwner(r),
+		"hour":    now.Hour(),
+		"weekday": int(now.Weekday()),
+	}
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	variables["headers"] = headers
+
+	messages := 0
+	if envelope, err := workflows.ReadEnvelope(r); err == nil {
+		variables["stream"] = envelope.Stream
+		var fields struct {
+			Messages []json.RawMessage `json:"messages"`
+			Input    json.RawMessage   `json:"input"`
+		}
+		if json.Unmarshal(envelope.Raw, &fields) == nil {
+			var input []json.RawMessage
+			if len(fields.Messages) > 0 {
+				messages = len(fields.Messages)
+			} else if json.Unmarshal(fields.Input, &input) == nil {
+				messages = len(input)
+			} else if len(fields.Input) > 0 {
+				messages = 1
+			}
+		}
+	} else {
+		variables["stream"] = false
+	}
+	variables["messages"] = messages
+	return variables
+}
+
+// routeTokens estimates a request's prompt tokens with the tokenizer of the
+// model it asks for.
+func (b *Broker) routeTokens(r *http.Request) int {
+	key, _ := clientKey(r)
+	tokens, _, err := b.estimatePromptTokens(r, key)
+	if err != nil {
+		return 0
+	}
+	return tokens
+}
+
+// matchesAny reports whether a value matches one of the glob patterns, or
+// there are none.
+func matchesAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHeaders reports whether the request carries every header with a
+// value matching its glob pattern.
+func matchesHeaders(r *http.Request, headers map[string]string) bool {
+	for name, pattern := range headers {
+		values := r.Header.Values(name)
+		if len(values) == 0 {
+			return false
+		}
+		matched := false
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// requestUser returns the end user a request names: the OpenAI user field,
+// or the Anthropic metadata.user_id.
+func requestUser(r *http.Request) string {
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		return ""
+	}
+	var fields struct {
+		User     string `json:"user"`
+		Metadata struct {
+			UserID string `json:"user_id"`
+		} `json:"metadata"`
+	}
+	if json.Unmarshal(envelope.Raw, &fields) != nil {
+		return ""
+	}
+	if fields.User != "" {
+		return fields.User
+	}
+	return fields.Metadata.UserID
+}
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_RoutingRules(t *testing.T) {
+	var gotModel string
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		gotModel = req.Model
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "1", "object": "chat.completion", "model": "` + req.Model + `", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	model := func(alias, target string) config.Model {
+		return config.Model{Alias: alias, Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: target}}
+	}
+	cfg := &config.Config{
+		Models: map[string]config.Model{
+			"gpt-4o":      model("gpt-4o", "gpt-4o"),
+			"o1":          model("o1", "o1"),
+			"gpt-4o-mini": model("gpt-4o-mini", "gpt-4o-mini"),
+		},
+		Routes: []config.RouteRule{
+			{Name: "research", Models: []string{"gpt-4*"}, Headers: map[string]string{"X-Team": "research"}, To: "o1"},
+			{Name: "free-tier", User: "free-*", To: "gpt-4o-mini"},
+		},
+	}
+	broker := New(cfg)
+	send := func(path string, header map[string]string, body string) string {
+		gotModel = ""
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+		}
+		return gotModel
+	}
+	openai := func(extra string) string {
+		return `{"model": "gpt-4o", "messages": [{"role": "user", "content": "Hello"}]` + extra + `}`
+	}
+
+	cases := []struct {
+		name   string
+		path   string
+		header map[string]string
+		body   string
+		want   string
+	}{
+		{"no rule matches", "/v1/chat/completions", nil, openai(""), "gpt-4o"},
+		{"header rule", "/v1/chat/completions", map[string]string{"X-Team": "research"}, openai(""), "o1"},
+		{"other header value", "/v1/chat/completions", map[string]string{"X-Team": "sales"}, openai(""), "gpt-4o"},
+		{"rule limited to its models", "/v1/chat/completions", map[string]string{"X-Team": "research"}, `{"model": "o1", "messages": [{"role": "user", "content": "Hello"}]}`, "o1"},
+		{"OpenAI user", "/v1/chat/completions", nil, openai(`, "user": "free-42"`), "gpt-4o-mini"},
+		{"paying user", "/v1/chat/completions", nil, openai(`, "user": "paid-42"`), "gpt-4o"},
+		{"Anthropic metadata.user_id", "/v1/messages", nil, `{"model": "gpt-4o", "max_tokens": 10, "metadata": {"user_id": "free-7"}, "messages": [{"role": "user", "content": "Hello"}]}`, "gpt-4o-mini"},
+		{"first matching rule wins", "/v1/chat/completions", map[string]string{"X-Team": "research"}, openai(`, "user": "free-42"`), "o1"},
+	}
+	for _, tc := range cases {
+		if got := send(tc.path, tc.header, tc.body); got != tc.want {
+			t.Errorf("%s: expected target %s, got: %s", tc.name, tc.want, got)
+		}
+	}
+
+	// Reloaded rules apply to the next request
+	reloaded := *cfg
+	reloaded.Routes = []config.RouteRule{{Name: "everyone", Models: []string{"gpt-4o"}, To: "o1"}}
+	broker.Reload(&reloaded)
+	if got := send("/v1/chat/completions", nil, openai("")); got != "o1" {
+		t.Errorf("Expected the reloaded rule to apply, got: %s", got)
+	}
+}
+
+func TestBroker_RoutingExpressions(t *testing.T) {
+	var gotModel string
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		gotModel = req.Model
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	model := func(alias string) config.Model {
+		return config.Model{Alias: alias, Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: alias}}
+	}
+	broker := New(&config.Config{
+		Models: map[string]config.Model{"gpt-4o": model("gpt-4o"), "long-context": model("long-context"), "fast": model("fast")},
+		Routes: []config.RouteRule{
+			{Name: "long", When: `model.startsWith("gpt") && tokens > 1000`, To: "long-context"},
+			{Name: "chatty", When: `messages >= 3 || headers["x-priority"] == "low"`, To: "fast"},
+			{Name: "broken", When: `headers["x-retries"] > 2`, To: "fast"},
+		},
+	})
+	send := func(header map[string]string, body string) string {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		broker.HandleChatCompletions(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got: %d %s", rr.Code, rr.Body.String())
+		}
+		return gotModel
+	}
+	message := `{"role": "user", "content": "Hello"}`
+	chat := func(messages ...string) string {
+		return `{"model": "gpt-4o", "messages": [` + strings.Join(messages, ", ") + `]}`
+	}
+
+	if got := send(nil, chat(message)); got != "gpt-4o" {
+		t.Errorf("Expected no rule to match a short request, got: %s", got)
+	}
+	long := `{"role": "user", "content": "` + strings.Repeat("lorem ipsum dolor sit amet ", 300) + `"}`
+	if got := send(nil, chat(long)); got != "long-context" {
+		t.Errorf("Expected a long prompt to be routed by its tokens, got: %s", got)
+	}
+	if got := send(nil, chat(message, message, message)); got != "fast" {
+		t.Errorf("Expected routing by message count, got: %s", got)
+	}
+	if got := send(map[string]string{"X-Priority": "low"}, chat(message)); got != "fast" {
+		t.Errorf("Expected routing by a lowercase header name, got: %s", got)
+	}
+	// Comparing a header string to a number fails, which does not match
+	if got := send(map[string]string{"X-Retries": "5"}, chat(message)); got != "gpt-4o" {
+		t.Errorf("Expected a failing expression not to match, got: %s", got)
+	}
+}
@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"context"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+var (
+	shadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_shadow_requests_total",
+		Help: "Requests mirrored to shadow targets, by alias and the shadow's status.",
+	}, []string{"alias", "status"})
+
+	shadowLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lmbroker_shadow_latency_seconds",
+		Help:    "Latency of mirrored requests on the primary and the shadow target, by alias and side.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"alias", "side"})
+
+	shadowLatencyDiff = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lmbroker_shadow_latency_diff_seconds",
+		Help:    "Shadow minus primary latency of mirrored requests, by alias.",
+		Buckets: []float64{-10, -5, -2, -1, -0.5, -0.1, 0, 0.1, 0.5, 1, 2, 5, 10},
+	}, []string{"alias"})
+
+	shadowTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lmbroker_shadow_tokens_total",
+		Help: "Tokens of mirrored requests on the primary and the shadow target, by alias, side and kind.",
+	}, []string{"alias", "side", "kind"})
+)
+
+// startShadow mirrors a sampled chat request to the model's shadow target
+// in the background. It returns the writer the primary should answer
+// through and a function to call once it has: the two sides are then
+// compared in metrics and a log line, and the shadow's response is
+// discarded. Requests that are not sampled are served unchanged.
+func (b *Broker) startShadow(w http.ResponseWriter, r *http.Request, clientAdapterType string, modelConfig *config.Model) (http.ResponseWriter, func()) {
+	shadow := modelConfig.Shadow
+	if shadow == nil {
+		return w, func() {}
+	}
+	percent := 100.0
+	if shadow.Percent != nil {
+		percent = *shadow.Percent
+	}
+	if percent < 100 && rand.Float64()*100 >= percent {
+		return w, func() {}
+	}
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		return w, func() {}
+	}
+
+	// The shadow is a plain copy of the alias on the shadow target: it
+	// neither falls back nor splits traffic, and like an eval secondary it
+	// outlives the client and is left out of the client's accounting.
+	target := *modelConfig
+	target.Target = shadow.Target
+	target.Type = shadow.Type
+	if target.Type == "" {
+		target.Type = modelConfig.Type
+	}
+	target.Fallbacks, target.Targets, target.Green, target.Shadow = nil, nil, nil, nil
+	shadowReq := r.Clone(withoutRequestInfo(context.WithoutCancel(r.Context())))
+	workflows.SetBody(shadowReq, envelope.Raw)
+	shadowReq.Header.Del(evalHeader)
+
+	shadowDone := make(chan evalSide, 1)
+	go func() {
+		capture := newCaptureWriter(nil)
+		start := time.Now()
+		b.dispatchChat(capture, shadowReq, clientAdapterType, &target)
+		shadowDone <- capture.side(&target, time.Since(start))
+	}()
+
+	capture := newCaptureWriter(w)
+	start := time.Now()
+	return capture, func() {
+		primary := capture.side(modelConfig, time.Since(start))
+		go func() { b.compareShadow(r, primary, <-shadowDone) }()
+	}
+}
+
+// compareShadow records how the shadow target did against the primary.
+func (b *Broker) compareShadow(r *http.Request, primary, shadow evalSide) {
+	alias := primary.Alias
+	shadowRequests.WithLabelValues(alias, strconv.Itoa(shadow.Status)).Inc()
+	for side, outcome := range map[string]evalSide{"primary": primary, "shadow": shadow} {
+		shadowLatency.WithLabelValues(alias, side).Observe(float64(outcome.LatencyMs) / 1000)
+		shadowTokens.WithLabelValues(alias, side, "input").Add(float64(outcome.InputTokens))
+		shadowTokens.WithLabelValues(alias, side, "output").Add(float64(outcome.OutputTokens))
+	}
+	shadowLatencyDiff.WithLabelValues(alias).Observe(float64(shadow.LatencyMs-primary.LatencyMs) / 1000)
+	slog.Info("shadow comparison",
+		"request_id", requestID(r),
+		"alias", alias,
+		"shadow_target", shadow.TargetModel,
+		"primary_status", primary.Status,
+		"shadow_status", shadow.Status,
+		"latency_diff_ms", shadow.LatencyMs-primary.LatencyMs,
+		"input_tokens_diff", shadow.InputTokens-primary.InputTokens,
+		"output_tokens_diff", shadow.OutputTokens-primary.OutputTokens,
+	)
+}
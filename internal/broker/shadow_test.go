@@ -0,0 +1,114 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_ShadowTraffic(t *testing.T) {
+	completion := func(content string, outputTokens string) string {
+		return `{"id": "1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "` + content + `"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 8, "completion_tokens": ` + outputTokens + `, "total_tokens": 20}}`
+	}
+	primaryBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(completion("from primary", "12")))
+	}))
+	defer primaryBackend.Close()
+
+	shadowModels := make(chan string, 1)
+	shadowBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(completion("from shadow", "30")))
+		shadowModels <- req.Model
+	}))
+	defer shadowBackend.Close()
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"shadowed": {
+				Alias:  "shadowed",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: primaryBackend.URL + "/", Model: "gpt-4o"},
+				Shadow: &config.ShadowConfig{Type: "vllm", Target: config.TargetConfig{URL: shadowBackend.URL + "/", Model: "llama-3-70b"}},
+			},
+		},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "shadowed", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	start := time.Now()
+	broker.HandleChatCompletions(rr, req)
+
+	// The client only sees the primary, without waiting for the shadow
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "from primary") {
+		t.Errorf("Expected the primary's response, got: %d %s", rr.Code, rr.Body.String())
+	}
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Errorf("Expected the client not to wait for the shadow, took: %v", elapsed)
+	}
+	select {
+	case model := <-shadowModels:
+		if model != "llama-3-70b" {
+			t.Errorf("Expected the shadow target's model, got: %s", model)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the request to be mirrored to the shadow")
+	}
+
+	// Both sides are compared in metrics
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rr = httptest.NewRecorder()
+		promhttp.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		metrics := rr.Body.String()
+		if strings.Contains(metrics, `lmbroker_shadow_tokens_total{alias="shadowed",kind="output",side="shadow"} 30`) {
+			for _, want := range []string{
+				`lmbroker_shadow_requests_total{alias="shadowed",status="200"} 1`,
+				`lmbroker_shadow_tokens_total{alias="shadowed",kind="output",side="primary"} 12`,
+				`lmbroker_shadow_latency_diff_seconds_count{alias="shadowed"} 1`,
+				`lmbroker_shadow_latency_seconds_count{alias="shadowed",side="shadow"} 1`,
+			} {
+				if !strings.Contains(metrics, want) {
+					t.Errorf("Expected %s in metrics", want)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the shadow comparison in metrics")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An explicit 0 percent pauses mirroring
+	paused := 0.0
+	broker = New(&config.Config{
+		Models: map[string]config.Model{
+			"shadowed": {
+				Alias:  "shadowed",
+				Type:   "openai",
+				Target: config.TargetConfig{URL: primaryBackend.URL + "/", Model: "gpt-4o"},
+				Shadow: &config.ShadowConfig{Percent: &paused, Target: config.TargetConfig{URL: shadowBackend.URL + "/", Model: "llama-3-70b"}},
+			},
+		},
+	})
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "shadowed", "messages": [{"role": "user", "content": "Hello"}]}`))
+	broker.HandleChatCompletions(httptest.NewRecorder(), req)
+	select {
+	case model := <-shadowModels:
+		t.Errorf("Expected a paused shadow not to be mirrored to, got a request for: %s", model)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
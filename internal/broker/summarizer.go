@@ -0,0 +1,66 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// summaryPrompt instructs the summarizer model used by prompt compression.
+const summaryPrompt = "Summarize the following conversation so it can replace the original turns. " +
+	"Keep facts, decisions, open questions, and tool results the assistant may still need. Be concise."
+
+// Summarize runs a transcript through another alias, routed like any other
+// OpenAI-format request, and returns the summary text.
+func (b *Broker) Summarize(ctx context.Context, alias, transcript string) (string, error) {
+	return b.ask(ctx, "summarizer", alias, summaryPrompt, transcript)
+}
+
+// ask sends a system prompt and one user message to an alias, routed like
+// any other OpenAI-format request, and returns the answer text. role names
+// the alias's job in errors.
+func (b *Broker) ask(ctx context.Context, role, alias, system, user string) (string, error) {
+	modelConfig, ok := b.findModelConfig(alias)
+	if !ok {
+		return "", fmt.Errorf("%s alias %q not found", role, alias)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"model": alias,
+		"messages": []map[string]string{
+			{"role": "system", "content": system},
+			{"role": "user", "content": user},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	capture := newCaptureWriter(nil)
+	b.dispatchChat(capture, req, "openai", modelConfig)
+	if capture.status >= 400 {
+		return "", fmt.Errorf("%s returned status %d: %s", role, capture.status, capture.body.String())
+	}
+
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(capture.body.Bytes(), &resp); err != nil {
+		return "", fmt.Errorf("failed to decode %s response: %w", role, err)
+	}
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return "", fmt.Errorf("%s returned no content", role)
+	}
+	return resp.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,215 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+	"lmbroker/internal/tokenizer"
+)
+
+// messageTokens is the framing every chat message adds to a prompt.
+const messageTokens = 3
+
+// newTokenizers builds the registry of the configured tiktoken encodings
+// and the built-in approximations.
+func newTokenizers(cfg *config.Config) *tokenizer.Registry {
+	var loaded []tokenizer.Tokenizer
+	for _, t := range cfg.Tokenizers {
+		if t.Encoding != nil {
+			loaded = append(loaded, t.Encoding)
+		}
+	}
+	return tokenizer.NewRegistry(loaded...)
+}
+
+// tokenizerFor returns the tokenizer that counts a model's tokens.
+func (b *Broker) tokenizerFor(modelConfig *config.Model) tokenizer.Tokenizer {
+	return b.tokenizers.ForModel(modelConfig.Tokenizer, modelConfig.Type, modelConfig.Target.Model)
+}
+
+// lookupModel finds the model a key's request for an alias is served by,
+// following the key's routes and the default model like resolveModel, but
+// without rewriting the request.
+func (b *Broker) lookupModel(key *config.KeyConfig, alias string) (*config.Model, bool) {
+	if key != nil && key.Routes[alias] != "" {
+		alias = key.Routes[alias]
+	}
+	if modelConfig, ok := b.findModelConfig(alias); ok {
+		return modelConfig, true
+	}
+	b.mu.RLock()
+	defaultModel := b.cfg.DefaultModel
+	b.mu.RUnlock()
+	return b.findModelConfig(defaultModel)
+}
+
+// estimatePromptTokens counts the prompt of an API request with the
+// tokenizer of the model it is for, before the request is served. It
+// returns the model too, if the request names a known one.
+func (b *Broker) estimatePromptTokens(r *http.Request, key *config.KeyConfig) (int, *config.Model, error) {
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	modelConfig, ok := b.lookupModel(key, envelope.Model)
+	tok := b.tokenizers.ForModel("", "", envelope.Model)
+	if ok {
+		tok = b.tokenizerFor(modelConfig)
+	} else {
+		modelConfig = nil
+	}
+	return countPromptTokens(tok, envelope.Raw), modelConfig, nil
+}
+
+// countStreamedTokens counts the text an OpenAI-format stream generated,
+// for streams that do not report their usage.
+func countStreamedTokens(tok tokenizer.Tokenizer, body []byte) int {
+	tokens := 0
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		payload, ok := bytes.CutPrefix(bytes.TrimSpace(line), []byte("data:"))
+		if !ok {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta interface{} `json:"delta"`
+				Text  string      `json:"text"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(bytes.TrimSpace(payload), &chunk); err != nil {
+			continue
+		}
+		for _, choice := range chunk.Choices {
+			texts := []string{choice.Text}
+			images := 0
+			collectText(choice.Delta, &texts, &images)
+			for _, text := range texts {
+				tokens += tok.Count(text)
+			}
+		}
+	}
+	return tokens
+}
+
+// countPromptTokens counts the text a request body sends to the model: its
+// messages, system prompt and instructions, completion prompt or embedding
+// input, and tool definitions, plus the framing of each message and a flat
+// estimate per image. Bodies that are not JSON, such as audio uploads,
+// count as nothing.
+func countPromptTokens(tok tokenizer.Tokenizer, body []byte) int {
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return 0
+	}
+	tokens := 0
+	for _, field := range []string{"system", "instructions", "prompt", "input", "messages"} {
+		var texts []string
+		images := 0
+		collectText(req[field], &texts, &images)
+		for _, text := range texts {
+			tokens += tok.Count(text)
+		}
+		tokens += images * imageTokenEstimate
+	}
+	if messages, ok := req["messages"].([]interface{}); ok {
+		tokens += messageTokens * len(messages)
+	}
+	if tools, ok := req["tools"]; ok {
+		encoded, _ := json.Marshal(tools)
+		tokens += tok.Count(string(encoded))
+	}
+	return tokens
+}
+
+// collectText gathers the strings of a decoded JSON value that hold text,
+// skipping roles, types, identifiers and image data, and counts images.
+func collectText(value interface{}, texts *[]string, images *int) {
+	switch v := value.(type) {
+	case string:
+		*texts = append(*texts, v)
+	case []interface{}:
+		for _, item := range v {
+			collectText(item, texts, images)
+		}
+	case map[string]interface{}:
+		switch v["type"] {
+		case "image", "image_url", "input_image":
+			*images++
+			return
+		}
+		for key, item := range v {
+			switch key {
+			case "role", "type", "id", "tool_call_id", "tool_use_id", "call_id", "name", "cache_control", "source", "image_url":
+				continue
+			}
+			collectText(item, texts, images)
+		}
+	}
+}
+
+// HandleTokenize serves /v1/tokenize and /v1/tokenize/count, which count
+// tokens with the tokenizer of a model alias. The body names the model and
+// either an input (a string or a list of strings) or a chat request's
+// messages, system prompt and tools. /v1/tokenize also returns the token
+// IDs of an input when the tokenizer is exact.
+func (b *Broker) HandleTokenize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		workflows.WriteError(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// 1. Find the model named in the body.
+	modelName, err := b.extractModelFromRequest(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to parse request body")
+		return
+	}
+	modelConfig, ok := b.resolveModel(r, modelName)
+	if !ok {
+		workflows.WriteError(w, r, http.StatusNotFound, "model not supported")
+		return
+	}
+
+	// 1.5. Make sure the client's key may use this model.
+	if !b.authorizeModel(w, r, modelConfig) {
+		return
+	}
+
+	// 2. Count, and with an exact tokenizer encode, the input.
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return
+	}
+	tok := b.tokenizerFor(modelConfig)
+	resp := map[string]interface{}{
+		"model":     modelConfig.Alias,
+		"tokenizer": tok.Name(),
+		"exact":     tok.Exact(),
+		"count":     countPromptTokens(tok, envelope.Raw),
+	}
+	if tok.Exact() && !strings.HasSuffix(r.URL.Path, "/count") {
+		var req struct {
+			Input interface{} `json:"input"`
+		}
+		json.Unmarshal(envelope.Raw, &req)
+		switch input := req.Input.(type) {
+		case string:
+			resp["tokens"] = tok.Encode(input)
+		case []interface{}:
+			tokens := make([][]int, 0, len(input))
+			for _, item := range input {
+				text, _ := item.(string)
+				tokens = append(tokens, tok.Encode(text))
+			}
+			resp["tokens"] = tokens
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
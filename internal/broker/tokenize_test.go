@@ -0,0 +1,86 @@
+package broker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Tokenize(t *testing.T) {
+	dir := t.TempDir()
+	var lines []string
+	for b := 0; b < 256; b++ {
+		lines = append(lines, fmt.Sprintf("%s %d", base64.StdEncoding.EncodeToString([]byte{byte(b)}), b))
+	}
+	lines = append(lines, base64.StdEncoding.EncodeToString([]byte("hi"))+" 256")
+	os.WriteFile(filepath.Join(dir, "o200k_base.tiktoken"), []byte(strings.Join(lines, "\n")), 0o644)
+	configPath := filepath.Join(dir, "config.toml")
+	os.WriteFile(configPath, []byte(`
+[[tokenizers]]
+  name = "o200k_base"
+  file = "`+filepath.Join(dir, "o200k_base.tiktoken")+`"
+
+[[models]]
+  alias = "gpt-4o"
+  type = "openai"
+  target = { url = "http://unused/v1/", model = "gpt-4o", pricing = { input_per_million = 1000000 } }
+
+[[models]]
+  alias = "claude"
+  type = "anthropic"
+  target = { url = "http://unused/v1/", model = "claude-sonnet-4" }
+`), 0o644)
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	broker := New(cfg)
+
+	send := func(path, body string) map[string]interface{} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		broker.HandleTokenize(rr, req)
+		var resp map[string]interface{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("Expected a count, got: %d %s", rr.Code, rr.Body.String())
+		}
+		return resp
+	}
+
+	// OpenAI models use the loaded encoding and return token IDs
+	resp := send("/v1/tokenize", `{"model": "gpt-4o", "input": "hi!"}`)
+	if resp["tokenizer"] != "o200k_base" || resp["exact"] != true || resp["count"] != float64(2) || fmt.Sprint(resp["tokens"]) != "[256 33]" {
+		t.Errorf("Expected an exact encoding, got: %v", resp)
+	}
+	if resp = send("/v1/tokenize/count", `{"model": "gpt-4o", "input": ["hi", "hi"]}`); resp["count"] != float64(2) || resp["tokens"] != nil {
+		t.Errorf("Expected only a count, got: %v", resp)
+	}
+
+	// Claude is approximated; chat messages add their framing
+	resp = send("/v1/tokenize", `{"model": "claude", "messages": [{"role": "user", "content": [{"type": "text", "text": "abcdefg"}]}]}`)
+	if resp["tokenizer"] != "claude" || resp["exact"] != false || resp["count"] != float64(2+3) {
+		t.Errorf("Expected an approximate count, got: %v", resp)
+	}
+
+	// A prompt that alone costs more than a key's remaining budget is
+	// refused before it is sent
+	key := &config.KeyConfig{Name: "team-a", Key: "sk-team-a", DailyBudget: 0.5}
+	served := false
+	handler := broker.EnforceQuotas(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }))
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`))
+	req = req.WithContext(context.WithValue(req.Context(), clientKeyKey, key))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests || served || !strings.Contains(rr.Body.String(), "insufficient_quota") {
+		t.Errorf("Expected the request to be refused, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
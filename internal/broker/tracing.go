@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"lmbroker/internal/tracing"
+)
+
+// finishReason matches the stop reason fields of OpenAI, Anthropic and
+// Responses bodies, including stream events.
+var finishReason = regexp.MustCompile(`"(?:finish_reason|stop_reason)":\s*"([^"]+)"`)
+
+// Trace is a middleware that continues the caller's W3C trace and, when a
+// tracer is configured, records a server span for every API request with
+// attributes from the OpenTelemetry GenAI conventions. Backend calls made
+// while serving the request become its child spans.
+func (b *Broker) Trace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := tracing.Extract(r.Context(), r.Header)
+		operation := tracing.Operation(r.URL.Path)
+		ctx, span := tracing.Start(ctx, r.Method+" "+r.URL.Path, tracing.KindServer)
+		if span == nil {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+		defer span.End()
+
+		info, w, r := withRequestInfo(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
+
+		status := info.capture.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("url.path", r.URL.Path)
+		span.SetAttribute("http.response.status_code", status)
+		span.SetAttribute("gen_ai.operation.name", operation)
+		if status >= 500 {
+			span.SetError(http.StatusText(status))
+		}
+		model, workflow := info.target()
+		if model == nil {
+			return
+		}
+		span.SetAttribute("gen_ai.request.model", model.Alias)
+		span.SetAttribute("gen_ai.system", model.Type)
+		span.SetAttribute("lmbroker.workflow", workflow)
+		inputTokens, outputTokens := info.usage()
+		span.SetAttribute("gen_ai.usage.input_tokens", inputTokens)
+		span.SetAttribute("gen_ai.usage.output_tokens", outputTokens)
+		if reasons := finishReasons(info.capture.body.Bytes()); len(reasons) > 0 {
+			span.SetAttribute("gen_ai.response.finish_reasons", reasons)
+		}
+	})
+}
+
+// finishReasons lists the distinct finish reasons reported in a response
+// body, in order of appearance.
+func finishReasons(body []byte) []string {
+	var reasons []string
+	for _, match := range finishReason.FindAllSubmatch(body, -1) {
+		reason := string(match[1])
+		if !slices.Contains(reasons, reason) {
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,104 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"lmbroker/internal/config"
+	"lmbroker/internal/tracing"
+)
+
+func TestBroker_Trace(t *testing.T) {
+	var mu sync.Mutex
+	var exported []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []map[string]interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("Expected OTLP JSON, got: %s", body)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, resource := range payload.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				exported = append(exported, scope.Spans...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	var backendTraceparent string
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendTraceparent = r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 12, "completion_tokens": 7}}`))
+	}))
+	defer mockBackend.Close()
+
+	tracer := tracing.New(tracing.Options{Endpoint: collector.URL + "/v1/traces"})
+	tracing.SetDefault(tracer)
+	defer tracing.SetDefault(nil)
+
+	broker := New(&config.Config{
+		Models: map[string]config.Model{
+			"traced-gpt": {Alias: "traced-gpt", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4"}},
+		},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "traced-gpt", "messages": [{"role": "user", "content": "Hello"}]}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	broker.Trace(http.HandlerFunc(broker.HandleChatCompletions)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+	}
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected spans to flush, got: %v", err)
+	}
+
+	if !strings.HasPrefix(backendTraceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || strings.Contains(backendTraceparent, "00f067aa0ba902b7") {
+		t.Errorf("Expected the backend to continue the caller's trace from a broker span, got: %q", backendTraceparent)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(exported) != 2 {
+		t.Fatalf("Expected a server and a client span, got: %d", len(exported))
+	}
+	client, server := exported[0], exported[1]
+	if server["parentSpanId"] != "00f067aa0ba902b7" || client["parentSpanId"] != server["spanId"] {
+		t.Errorf("Expected client span under server span under the caller, got: %v and %v", client, server)
+	}
+	if !strings.HasSuffix(backendTraceparent, "-"+client["spanId"].(string)+"-01") {
+		t.Errorf("Expected the backend traceparent to name the client span, got: %q", backendTraceparent)
+	}
+
+	attributes := map[string]string{}
+	for _, attribute := range server["attributes"].([]interface{}) {
+		encoded, _ := json.Marshal(attribute.(map[string]interface{})["value"])
+		attributes[attribute.(map[string]interface{})["key"].(string)] = string(encoded)
+	}
+	for key, want := range map[string]string{
+		"gen_ai.operation.name":          `{"stringValue":"chat"}`,
+		"gen_ai.request.model":           `{"stringValue":"traced-gpt"}`,
+		"gen_ai.usage.input_tokens":      `{"intValue":"12"}`,
+		"gen_ai.usage.output_tokens":     `{"intValue":"7"}`,
+		"gen_ai.response.finish_reasons": `{"arrayValue":{"values":[{"stringValue":"stop"}]}}`,
+		"http.response.status_code":      `{"intValue":"200"}`,
+	} {
+		if attributes[key] != want {
+			t.Errorf("Expected %s to be %s, got: %s", key, want, attributes[key])
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageRecord is one served request in the usage log.
+type usageRecord struct {
+	Timestamp    time.Time `json:"timestamp"`
+	Key          string    `json:"key"`
+	Alias        string    `json:"alias"`
+	Target       string    `json:"target"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	Cost         float64   `json:"cost"`
+}
+
+// usageBucket identifies the usage of one key on one model in one UTC day,
+// the finest grouping /admin/usage reports.
+type usageBucket struct {
+	key   string
+	model string
+	day   string
+}
+
+// usageTotals is the usage reported for a group of requests.
+type usageTotals struct {
+	Key          string  `json:"key,omitempty"`
+	Model        string  `json:"model,omitempty"`
+	Day          string  `json:"day,omitempty"`
+	Requests     int     `json:"requests"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+}
+
+func (t *usageTotals) add(other usageTotals) {
+	t.Requests += other.Requests
+	t.InputTokens += other.InputTokens
+	t.OutputTokens += other.OutputTokens
+	t.Cost += other.Cost
+}
+
+// usageStore keeps per-request usage. Records are appended to the
+// configured file, one JSON line each, and replayed on startup; daily totals
+// are kept in memory to answer queries. Without a file, usage starts over
+// when the broker restarts.
+type usageStore struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	buckets map[usageBucket]*usageTotals
+}
+
+func newUsageStore(path string) *usageStore {
+	store := &usageStore{path: path, buckets: make(map[usageBucket]*usageTotals)}
+	if path != "" {
+		store.load()
+	}
+	return store
+}
+
+// load replays the usage file. Lines that fail to decode, such as one cut
+// short by a crash, are skipped.
+func (s *usageStore) load() {
+	file, err := os.Open(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to open usage log", "path", s.path, "error", err)
+		}
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	loaded, skipped := 0, 0
+	for scanner.Scan() {
+		var record usageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			skipped++
+			continue
+		}
+		s.addLocked(record)
+		loaded++
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("failed to read usage log", "path", s.path, "error", err)
+	}
+	slog.Info("usage log loaded", "path", s.path, "records", loaded, "skipped", skipped)
+}
+
+func (s *usageStore) addLocked(record usageRecord) {
+	bucket := usageBucket{key: record.Key, model: record.Alias, day: record.Timestamp.UTC().Format("2006-01-02")}
+	totals, ok := s.buckets[bucket]
+	if !ok {
+		totals = &usageTotals{}
+		s.buckets[bucket] = totals
+	}
+	totals.add(usageTotals{Requests: 1, InputTokens: record.InputTokens, OutputTokens: record.OutputTokens, Cost: record.Cost})
+}
+
+// record adds a request's usage to the totals and appends it to the file.
+func (s *usageStore) record(record usageRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addLocked(record)
+	if s.path == "" {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("failed to encode usage record", "error", err)
+		return
+	}
+	if s.file == nil {
+		file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			slog.Error("failed to open usage log", "path", s.path, "error", err)
+			return
+		}
+		s.file = file
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		slog.Error("failed to write usage record", "path", s.path, "error", err)
+	}
+}
+
+// usageQuery selects and groups usage. Days are inclusive YYYY-MM-DD bounds;
+// empty fields match everything.
+type usageQuery struct {
+	groupBy map[string]bool
+	key     string
+	model   string
+	from    string
+	to      string
+}
+
+// query returns the totals of matching usage, grouped by the requested
+// dimensions and sorted by them.
+func (s *usageStore) query(q usageQuery) []usageTotals {
+	s.mu.Lock()
+	groups := make(map[usageBucket]*usageTotals)
+	for bucket, totals := range s.buckets {
+		if (q.key != "" && bucket.key != q.key) || (q.model != "" && bucket.model != q.model) ||
+			(q.from != "" && bucket.day < q.from) || (q.to != "" && bucket.day > q.to) {
+			continue
+		}
+		var group usageBucket
+		if q.groupBy["key"] {
+			group.key = bucket.key
+		}
+		if q.groupBy["model"] {
+			group.model = bucket.model
+		}
+		if q.groupBy["day"] {
+			group.day = bucket.day
+		}
+		grouped, ok := groups[group]
+		if !ok {
+			grouped = &usageTotals{Key: group.key, Model: group.model, Day: group.day}
+			groups[group] = grouped
+		}
+		grouped.add(*totals)
+	}
+	s.mu.Unlock()
+
+	results := make([]usageTotals, 0, len(groups))
+	for _, totals := range groups {
+		results = append(results, *totals)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		return a.Model < b.Model
+	})
+	return results
+}
+
+// RecordUsage is a middleware that stores the token usage and cost of every
+// API request that reached a model target, under the client key that made
+// it. It must be installed outside Authenticate.
+func (b *Broker) RecordUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v1/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		info, w, r := withRequestInfo(w, r)
+		next.ServeHTTP(w, r)
+
+		model, _ := info.target()
+		if model == nil {
+			return
+		}
+		record := usageRecord{Timestamp: info.start.UTC(), Alias: model.Alias, Target: model.Target.Model}
+		if key := info.clientKey(); key != nil {
+			record.Key = key.Name
+		}
+		record.InputTokens, record.OutputTokens = info.usage()
+		record.Cost = info.pricing().Cost(record.InputTokens, record.OutputTokens)
+		b.usage.record(record)
+	})
+}
+
+// HandleAdminUsage serves /admin/usage with aggregated token usage and cost.
+// Query parameters: group_by (a comma-separated subset of key, model and
+// day; default all three), key, model, and from/to days (YYYY-MM-DD).
+func (b *Broker) HandleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if !b.requireAdmin(w, r) {
+		return
+	}
+	params := r.URL.Query()
+	q := usageQuery{
+		groupBy: map[string]bool{"key": true, "model": true, "day": true},
+		key:     params.Get("key"),
+		model:   params.Get("model"),
+		from:    params.Get("from"),
+		to:      params.Get("to"),
+	}
+	if groupBy := params.Get("group_by"); groupBy != "" {
+		q.groupBy = map[string]bool{}
+		for _, dimension := range strings.Split(groupBy, ",") {
+			dimension = strings.TrimSpace(dimension)
+			if dimension != "key" && dimension != "model" && dimension != "day" {
+				http.Error(w, "group_by must list key, model or day", http.StatusBadRequest)
+				return
+			}
+			q.groupBy[dimension] = true
+		}
+	}
+	for _, day := range []string{q.from, q.to} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", day); err != nil {
+			http.Error(w, "from and to must be dates in YYYY-MM-DD format", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"usage": b.usage.query(q)})
+}
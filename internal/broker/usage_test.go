@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Usage(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 100, "completion_tokens": 20}}`))
+	}))
+	defer mockBackend.Close()
+
+	usageFile := filepath.Join(t.TempDir(), "usage.jsonl")
+	cfg := &config.Config{
+		Server: config.ServerConfig{AdminKey: "admin-secret"},
+		Usage:  config.UsageConfig{LogFile: usageFile},
+		Models: map[string]config.Model{
+			"gpt-4": {Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{
+				URL:     mockBackend.URL + "/",
+				Model:   "gpt-4",
+				Pricing: config.PricingConfig{InputPerMillion: 10, OutputPerMillion: 30},
+			}},
+			"gpt-4-mini": {Alias: "gpt-4-mini", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4-mini"}},
+		},
+		Keys: []config.KeyConfig{{Name: "team-a", Key: "sk-team-a"}, {Name: "team-b", Key: "sk-team-b"}},
+	}
+	broker := New(cfg)
+	handler := broker.RecordUsage(broker.Authenticate(http.HandlerFunc(broker.HandleChatCompletions)))
+	for _, call := range []struct{ key, model string }{
+		{"sk-team-a", "gpt-4"},
+		{"sk-team-a", "gpt-4"},
+		{"sk-team-a", "gpt-4-mini"},
+		{"sk-team-b", "gpt-4"},
+	} {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "`+call.model+`", "messages": [{"role": "user", "content": "Hello"}]}`))
+		req.Header.Set("Authorization", "Bearer "+call.key)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got: %d (%s)", rr.Code, rr.Body.String())
+		}
+	}
+
+	query := func(broker *Broker, params string) []usageTotals {
+		req := httptest.NewRequest("GET", "/admin/usage?"+params, nil)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		rr := httptest.NewRecorder()
+		broker.HandleAdminUsage(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 from /admin/usage?%s, got: %d (%s)", params, rr.Code, rr.Body.String())
+		}
+		var response struct {
+			Usage []usageTotals `json:"usage"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return response.Usage
+	}
+
+	byKey := query(broker, "group_by=key")
+	if len(byKey) != 2 || byKey[0].Key != "team-a" || byKey[0].Requests != 3 || byKey[0].InputTokens != 300 || byKey[0].OutputTokens != 60 {
+		t.Fatalf("Expected team-a to have 3 requests with 300/60 tokens, got: %+v", byKey)
+	}
+	// Two priced requests: 2 * (100*10 + 20*30) / 1M.
+	if byKey[0].Cost < 0.00319 || byKey[0].Cost > 0.00321 {
+		t.Errorf("Expected team-a to have cost $0.0032, got: %v", byKey[0].Cost)
+	}
+
+	filtered := query(broker, "group_by=model,day&model=gpt-4")
+	if len(filtered) != 1 || filtered[0].Model != "gpt-4" || filtered[0].Day == "" || filtered[0].Key != "" || filtered[0].Requests != 3 {
+		t.Errorf("Expected one gpt-4 row per day across keys, got: %+v", filtered)
+	}
+	if rows := query(broker, "from=2000-01-01&to=2000-01-31"); len(rows) != 0 {
+		t.Errorf("Expected no usage outside the date range, got: %+v", rows)
+	}
+
+	// Usage survives a restart.
+	restarted := New(cfg)
+	if rows := query(restarted, "group_by=key"); len(rows) != 2 || rows[0].Requests != 3 || rows[1].Requests != 1 {
+		t.Errorf("Expected usage to be replayed from the log, got: %+v", rows)
+	}
+
+	// Invalid queries and missing credentials are rejected.
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/usage?group_by=target", nil)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	broker.HandleAdminUsage(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an unknown group_by, got: %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	broker.HandleAdminUsage(rr, httptest.NewRequest("GET", "/admin/usage", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401 without the admin key, got: %d", rr.Code)
+	}
+}
@@ -0,0 +1,506 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"lmbroker/internal/broker/workflows"
+)
+
+// fieldError is a single schema violation at a JSON path such as
+// "messages[2].content[0].image_url.url".
+type fieldError struct {
+	Field   string
+	Message string
+}
+
+// validator collects field errors while walking a decoded request body.
+type validator struct {
+	errors []fieldError
+}
+
+func (v *validator) fail(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, fieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// validateRequest checks a request body against the endpoint's schema when
+// strict validation is enabled. It returns false after writing a 400 in the
+// client's dialect, listing every violation found.
+func (b *Broker) validateRequest(w http.ResponseWriter, r *http.Request, endpoint string) bool {
+	if !b.cfg.Server.StrictValidation {
+		return true
+	}
+
+	envelope, err := workflows.ReadEnvelope(r)
+	if err != nil {
+		workflows.WriteError(w, r, http.StatusBadRequest, "failed to read request body")
+		return false
+	}
+	body := envelope.Raw
+
+	var errors []fieldError
+	switch endpoint {
+	case "openai":
+		errors = validateOpenAIChat(body)
+	case "anthropic":
+		errors = validateAnthropicChat(body)
+	case "embeddings":
+		errors = validateOpenAIEmbedding(body)
+	}
+	if len(errors) == 0 {
+		return true
+	}
+
+	writeValidationError(w, r, errors)
+	return false
+}
+
+// writeValidationError reports schema violations in the client's error
+// envelope, naming the first offending field as the OpenAI param.
+func writeValidationError(w http.ResponseWriter, r *http.Request, errors []fieldError) {
+	messages := make([]string, len(errors))
+	for i, e := range errors {
+		messages[i] = e.Field + ": " + e.Message
+	}
+	message := "invalid request: " + strings.Join(messages, "; ")
+	workflows.WriteErrorCode(w, r, http.StatusBadRequest, "", errors[0].Field, message)
+}
+
+func decodeObject(v *validator, body []byte) map[string]interface{} {
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		v.fail("body", "must be valid JSON: %v", err)
+		return nil
+	}
+	object, ok := decoded.(map[string]interface{})
+	if !ok {
+		v.fail("body", "must be a JSON object")
+		return nil
+	}
+	return object
+}
+
+// --- OpenAI Chat Completions ---
+
+func validateOpenAIChat(body []byte) []fieldError {
+	v := &validator{}
+	req := decodeObject(v, body)
+	if req == nil {
+		return v.errors
+	}
+
+	v.requireString(req, "model", "model")
+	v.optionalBool(req, "stream", "stream")
+	v.optionalNumber(req, "temperature", "temperature", 0, 2)
+	v.optionalNumber(req, "top_p", "top_p", 0, 1)
+	v.optionalInteger(req, "n", "n", 1)
+	v.optionalInteger(req, "max_tokens", "max_tokens", 1)
+	v.optionalInteger(req, "max_completion_tokens", "max_completion_tokens", 1)
+
+	messages, ok := v.requireArray(req, "messages", "messages")
+	if ok && len(messages) == 0 {
+		v.fail("messages", "must contain at least one message")
+	}
+	for i, raw := range messages {
+		v.openaiMessage(fmt.Sprintf("messages[%d]", i), raw)
+	}
+
+	if tools, ok := v.optionalArray(req, "tools", "tools"); ok {
+		for i, raw := range tools {
+			v.openaiTool(fmt.Sprintf("tools[%d]", i), raw)
+		}
+	}
+	return v.errors
+}
+
+func (v *validator) openaiMessage(path string, raw interface{}) {
+	msg, ok := raw.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+
+	role, _ := msg["role"].(string)
+	switch role {
+	case "system", "developer", "user", "assistant", "tool", "function":
+	default:
+		v.fail(path+".role", "must be one of system, developer, user, assistant, tool, function")
+		return
+	}
+
+	switch typed := msg["content"].(type) {
+	case string:
+	case nil:
+		// Assistant turns may carry only tool calls.
+		if role != "assistant" {
+			v.fail(path+".content", "is required for %s messages", role)
+		} else if msg["tool_calls"] == nil && msg["function_call"] == nil {
+			v.fail(path+".content", "is required unless tool_calls is set")
+		}
+	case []interface{}:
+		for j, part := range typed {
+			v.openaiContentPart(fmt.Sprintf("%s.content[%d]", path, j), part)
+		}
+	default:
+		v.fail(path+".content", "must be a string or an array of content parts")
+	}
+
+	if role == "tool" {
+		v.requireString(msg, "tool_call_id", path+".tool_call_id")
+	}
+	if calls, ok := v.optionalArray(msg, "tool_calls", path+".tool_calls"); ok {
+		if role != "assistant" {
+			v.fail(path+".tool_calls", "is only allowed on assistant messages")
+		}
+		for j, raw := range calls {
+			callPath := fmt.Sprintf("%s.tool_calls[%d]", path, j)
+			call, ok := raw.(map[string]interface{})
+			if !ok {
+				v.fail(callPath, "must be an object")
+				continue
+			}
+			v.requireString(call, "id", callPath+".id")
+			if function, ok := v.requireObject(call, "function", callPath+".function"); ok {
+				v.requireString(function, "name", callPath+".function.name")
+				v.requireString(function, "arguments", callPath+".function.arguments")
+			}
+		}
+	}
+}
+
+func (v *validator) openaiContentPart(path string, raw interface{}) {
+	part, ok := raw.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+	switch part["type"] {
+	case "text", "refusal":
+		field := "text"
+		if part["type"] == "refusal" {
+			field = "refusal"
+		}
+		v.requireString(part, field, path+"."+field)
+	case "image_url":
+		if image, ok := v.requireObject(part, "image_url", path+".image_url"); ok {
+			v.requireString(image, "url", path+".image_url.url")
+		}
+	case "input_audio":
+		if audio, ok := v.requireObject(part, "input_audio", path+".input_audio"); ok {
+			v.requireString(audio, "data", path+".input_audio.data")
+			v.requireString(audio, "format", path+".input_audio.format")
+		}
+	case "file":
+		v.requireObject(part, "file", path+".file")
+	default:
+		v.fail(path+".type", "must be one of text, image_url, input_audio, file, refusal")
+	}
+}
+
+func (v *validator) openaiTool(path string, raw interface{}) {
+	tool, ok := raw.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+	switch tool["type"] {
+	case "function":
+		function, ok := v.requireObject(tool, "function", path+".function")
+		if !ok {
+			return
+		}
+		if name, ok := v.requireString(function, "name", path+".function.name"); ok && !toolNamePattern.MatchString(name) {
+			v.fail(path+".function.name", "must match %s", toolNamePattern.String())
+		}
+		v.optionalObject(function, "parameters", path+".function.parameters")
+	case "web_search", "web_search_preview", "code_interpreter", "computer_use_preview":
+		// Hosted tools the broker knows how to translate.
+	default:
+		v.fail(path+".type", "must be function or a supported hosted tool type")
+	}
+}
+
+// --- Anthropic Messages ---
+
+func validateAnthropicChat(body []byte) []fieldError {
+	v := &validator{}
+	req := decodeObject(v, body)
+	if req == nil {
+		return v.errors
+	}
+
+	v.requireString(req, "model", "model")
+	if _, present := req["max_tokens"]; !present {
+		v.fail("max_tokens", "is required")
+	} else {
+		v.optionalInteger(req, "max_tokens", "max_tokens", 1)
+	}
+	v.optionalBool(req, "stream", "stream")
+	v.optionalNumber(req, "temperature", "temperature", 0, 1)
+	v.optionalNumber(req, "top_p", "top_p", 0, 1)
+	v.optionalInteger(req, "top_k", "top_k", 0)
+	if stops, ok := v.optionalArray(req, "stop_sequences", "stop_sequences"); ok {
+		for i, stop := range stops {
+			if _, isString := stop.(string); !isString {
+				v.fail(fmt.Sprintf("stop_sequences[%d]", i), "must be a string")
+			}
+		}
+	}
+
+	switch system := req["system"].(type) {
+	case nil, string:
+	case []interface{}:
+		for i, raw := range system {
+			path := fmt.Sprintf("system[%d]", i)
+			block, ok := raw.(map[string]interface{})
+			if !ok || block["type"] != "text" {
+				v.fail(path, "must be a text block")
+				continue
+			}
+			v.requireString(block, "text", path+".text")
+		}
+	default:
+		v.fail("system", "must be a string or an array of text blocks")
+	}
+
+	messages, ok := v.requireArray(req, "messages", "messages")
+	if ok && len(messages) == 0 {
+		v.fail("messages", "must contain at least one message")
+	}
+	for i, raw := range messages {
+		v.anthropicMessage(fmt.Sprintf("messages[%d]", i), raw)
+	}
+
+	if tools, ok := v.optionalArray(req, "tools", "tools"); ok {
+		for i, raw := range tools {
+			v.anthropicTool(fmt.Sprintf("tools[%d]", i), raw)
+		}
+	}
+	return v.errors
+}
+
+func (v *validator) anthropicMessage(path string, raw interface{}) {
+	msg, ok := raw.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+
+	role, _ := msg["role"].(string)
+	if role != "user" && role != "assistant" {
+		v.fail(path+".role", "must be user or assistant")
+	}
+
+	switch content := msg["content"].(type) {
+	case string:
+	case []interface{}:
+		for j, block := range content {
+			v.anthropicBlock(fmt.Sprintf("%s.content[%d]", path, j), block)
+		}
+	default:
+		v.fail(path+".content", "must be a string or an array of content blocks")
+	}
+}
+
+func (v *validator) anthropicBlock(path string, raw interface{}) {
+	block, ok := raw.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+	switch block["type"] {
+	case "text":
+		v.requireString(block, "text", path+".text")
+	case "image", "document":
+		if source, ok := v.requireObject(block, "source", path+".source"); ok {
+			switch source["type"] {
+			case "base64":
+				v.requireString(source, "media_type", path+".source.media_type")
+				v.requireString(source, "data", path+".source.data")
+			case "url":
+				v.requireString(source, "url", path+".source.url")
+			case "text", "content", "file":
+			default:
+				v.fail(path+".source.type", "must be base64 or url")
+			}
+		}
+	case "tool_use", "server_tool_use":
+		v.requireString(block, "id", path+".id")
+		v.requireString(block, "name", path+".name")
+		v.requireObject(block, "input", path+".input")
+	case "tool_result":
+		v.requireString(block, "tool_use_id", path+".tool_use_id")
+		switch content := block["content"].(type) {
+		case nil, string:
+		case []interface{}:
+			for k, nested := range content {
+				v.anthropicBlock(fmt.Sprintf("%s.content[%d]", path, k), nested)
+			}
+		default:
+			v.fail(path+".content", "must be a string or an array of content blocks")
+		}
+	case "thinking", "redacted_thinking", "web_search_tool_result", "code_execution_tool_result":
+		// Echoed back from previous assistant turns; passed through as-is.
+	default:
+		v.fail(path+".type", "must be one of text, image, document, tool_use, tool_result, thinking")
+	}
+}
+
+func (v *validator) anthropicTool(path string, raw interface{}) {
+	tool, ok := raw.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return
+	}
+	if toolType, ok := tool["type"].(string); ok && toolType != "custom" {
+		for _, prefix := range []string{"web_search_", "computer_", "code_execution_", "bash_", "text_editor_"} {
+			if strings.HasPrefix(toolType, prefix) {
+				return
+			}
+		}
+		v.fail(path+".type", "is not a supported server tool type")
+		return
+	}
+	if name, ok := v.requireString(tool, "name", path+".name"); ok && !toolNamePattern.MatchString(name) {
+		v.fail(path+".name", "must match %s", toolNamePattern.String())
+	}
+	v.requireObject(tool, "input_schema", path+".input_schema")
+}
+
+// --- OpenAI Embeddings ---
+
+func validateOpenAIEmbedding(body []byte) []fieldError {
+	v := &validator{}
+	req := decodeObject(v, body)
+	if req == nil {
+		return v.errors
+	}
+
+	v.requireString(req, "model", "model")
+	v.optionalInteger(req, "dimensions", "dimensions", 1)
+	if format, present := req["encoding_format"]; present && format != "float" && format != "base64" {
+		v.fail("encoding_format", "must be float or base64")
+	}
+
+	switch input := req["input"].(type) {
+	case string:
+	case []interface{}:
+		if len(input) == 0 {
+			v.fail("input", "must not be empty")
+		}
+		for i, item := range input {
+			switch item.(type) {
+			case string, float64, []interface{}, map[string]interface{}:
+			default:
+				v.fail(fmt.Sprintf("input[%d]", i), "must be a string, token array, or content parts")
+			}
+		}
+	case nil:
+		v.fail("input", "is required")
+	default:
+		v.fail("input", "must be a string or an array")
+	}
+	return v.errors
+}
+
+// --- Field helpers ---
+
+func (v *validator) requireString(object map[string]interface{}, key, path string) (string, bool) {
+	value, present := object[key]
+	if !present || value == nil {
+		v.fail(path, "is required")
+		return "", false
+	}
+	s, ok := value.(string)
+	if !ok {
+		v.fail(path, "must be a string")
+		return "", false
+	}
+	return s, true
+}
+
+func (v *validator) requireObject(object map[string]interface{}, key, path string) (map[string]interface{}, bool) {
+	if _, present := object[key]; !present {
+		v.fail(path, "is required")
+		return nil, false
+	}
+	return v.optionalObject(object, key, path)
+}
+
+func (v *validator) optionalObject(object map[string]interface{}, key, path string) (map[string]interface{}, bool) {
+	value, present := object[key]
+	if !present {
+		return nil, false
+	}
+	nested, ok := value.(map[string]interface{})
+	if !ok {
+		v.fail(path, "must be an object")
+		return nil, false
+	}
+	return nested, true
+}
+
+func (v *validator) requireArray(object map[string]interface{}, key, path string) ([]interface{}, bool) {
+	if _, present := object[key]; !present {
+		v.fail(path, "is required")
+		return nil, false
+	}
+	return v.optionalArray(object, key, path)
+}
+
+func (v *validator) optionalArray(object map[string]interface{}, key, path string) ([]interface{}, bool) {
+	value, present := object[key]
+	if !present || value == nil {
+		return nil, false
+	}
+	array, ok := value.([]interface{})
+	if !ok {
+		v.fail(path, "must be an array")
+		return nil, false
+	}
+	return array, true
+}
+
+func (v *validator) optionalBool(object map[string]interface{}, key, path string) {
+	if value, present := object[key]; present && value != nil {
+		if _, ok := value.(bool); !ok {
+			v.fail(path, "must be a boolean")
+		}
+	}
+}
+
+func (v *validator) optionalNumber(object map[string]interface{}, key, path string, min, max float64) {
+	value, present := object[key]
+	if !present || value == nil {
+		return
+	}
+	number, ok := value.(float64)
+	if !ok {
+		v.fail(path, "must be a number")
+		return
+	}
+	if number < min || number > max {
+		v.fail(path, "must be between %g and %g", min, max)
+	}
+}
+
+func (v *validator) optionalInteger(object map[string]interface{}, key, path string, min int) {
+	value, present := object[key]
+	if !present || value == nil {
+		return
+	}
+	number, ok := value.(float64)
+	if !ok || number != math.Trunc(number) {
+		v.fail(path, "must be an integer")
+		return
+	}
+	if number < float64(min) {
+		v.fail(path, "must be at least %d", min)
+	}
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestValidateRequest_Schemas(t *testing.T) {
+	tests := []struct {
+		name     string
+		validate func([]byte) []fieldError
+		body     string
+		fields   []string
+	}{
+		{"valid openai", validateOpenAIChat,
+			`{"model": "gpt-4", "messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}, {"role": "assistant", "content": null, "tool_calls": [{"id": "c1", "type": "function", "function": {"name": "f", "arguments": "{}"}}]}, {"role": "tool", "tool_call_id": "c1", "content": "ok"}]}`,
+			nil},
+		{"openai field errors", validateOpenAIChat,
+			`{"model": "gpt-4", "temperature": 3, "messages": [{"role": "robot", "content": "hi"}, {"role": "user", "content": [{"type": "image_url", "image_url": {}}]}, {"role": "tool", "content": "x"}], "tools": [{"type": "function", "function": {"name": "bad name"}}]}`,
+			[]string{"temperature", "messages[0].role", "messages[1].content[0].image_url.url", "messages[2].tool_call_id", "tools[0].function.name"}},
+		{"openai missing messages", validateOpenAIChat, `{"model": "gpt-4"}`, []string{"messages"}},
+		{"valid anthropic", validateAnthropicChat,
+			`{"model": "claude", "max_tokens": 100, "system": "be brief", "messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "AA=="}}, {"type": "text", "text": "what?"}]}], "tools": [{"type": "web_search_20250305", "name": "web_search"}, {"name": "f", "input_schema": {"type": "object"}}]}`,
+			nil},
+		{"anthropic field errors", validateAnthropicChat,
+			`{"model": "claude", "messages": [{"role": "system", "content": "hi"}, {"role": "user", "content": [{"type": "tool_result"}, {"type": "video"}]}], "tools": [{"name": "f"}]}`,
+			[]string{"max_tokens", "messages[0].role", "messages[1].content[0].tool_use_id", "messages[1].content[1].type", "tools[0].input_schema"}},
+		{"valid embeddings", validateOpenAIEmbedding, `{"model": "text-embedding-3-small", "input": ["a", "b"], "encoding_format": "base64"}`, nil},
+		{"embedding field errors", validateOpenAIEmbedding, `{"model": "e", "input": [], "dimensions": 1.5}`, []string{"dimensions", "input"}},
+		{"invalid json", validateOpenAIChat, `{"model":`, []string{"body"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errors := tt.validate([]byte(tt.body))
+			var fields []string
+			for _, e := range errors {
+				fields = append(fields, e.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("Expected errors on %v, got: %v", tt.fields, errors)
+			}
+		})
+	}
+}
+
+func TestBroker_StrictValidation(t *testing.T) {
+	broker := &Broker{
+		cfg: &config.Config{
+			Server: config.ServerConfig{StrictValidation: true},
+			Models: map[string]config.Model{},
+		},
+	}
+
+	reqBody := `{"model": "gpt-4", "messages": [{"role": "user"}]}`
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(reqBody))
+	rr := httptest.NewRecorder()
+
+	broker.HandleChatCompletions(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got: %d", rr.Code)
+	}
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Param   string `json:"param"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode error: %v", err)
+	}
+	if body.Error.Type != "invalid_request_error" || body.Error.Param != "messages[0].content" {
+		t.Errorf("Expected invalid_request_error on messages[0].content, got: %+v", body.Error)
+	}
+
+	// Anthropic clients get Anthropic's error envelope
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude", "messages": []}`))
+	rr = httptest.NewRecorder()
+	broker.HandleChatCompletions(rr, req)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), `"type":"error"`) {
+		t.Errorf("Expected Anthropic-style 400, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
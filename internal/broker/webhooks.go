@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"lmbroker/internal/broker/workflows"
+	"lmbroker/internal/config"
+)
+
+// webhookQueueSize bounds the events waiting for delivery; events beyond it
+// are dropped rather than slowing down requests.
+const webhookQueueSize = 1024
+
+// webhookEvent is the JSON payload POSTed to webhooks.
+type webhookEvent struct {
+	Event     string                 `json:"event"`
+	Timestamp time.Time              `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// webhookNotifier delivers events to the configured webhooks from a
+// background goroutine, one attempt per event and endpoint.
+type webhookNotifier struct {
+	hooks  []config.WebhookConfig
+	client *http.Client
+	queue  chan webhookEvent
+}
+
+func newWebhookNotifier(hooks []config.WebhookConfig) *webhookNotifier {
+	n := &webhookNotifier{hooks: hooks, client: &http.Client{Timeout: 10 * time.Second}}
+	if len(hooks) > 0 {
+		n.queue = make(chan webhookEvent, webhookQueueSize)
+		go n.run()
+	}
+	return n
+}
+
+// wants reports whether any webhook subscribes to an event, so callers can
+// skip building its data.
+func (n *webhookNotifier) wants(event string) bool {
+	if n == nil {
+		return false
+	}
+	for i := range n.hooks {
+		if n.hooks[i].Wants(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues an event for the webhooks that subscribe to it.
+func (b *Broker) Notify(event string, data map[string]interface{}) {
+	if !b.webhooks.wants(event) {
+		return
+	}
+	select {
+	case b.webhooks.queue <- webhookEvent{Event: event, Timestamp: time.Now().UTC(), Data: data}:
+	default:
+		slog.Warn("webhook queue full, dropping event", "event", event)
+	}
+}
+
+func (n *webhookNotifier) run() {
+	for event := range n.queue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("failed to encode webhook event", "event", event.Event, "error", err)
+			continue
+		}
+		for i := range n.hooks {
+			if n.hooks[i].Wants(event.Event) {
+				n.deliver(&n.hooks[i], event.Event, body)
+			}
+		}
+	}
+}
+
+func (n *webhookNotifier) deliver(hook *config.WebhookConfig, event string, body []byte) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("invalid webhook URL", "url", hook.URL, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-LMBroker-Event", event)
+	if hook.Signing != nil {
+		if err := workflows.SignRequest(req, hook.Signing, time.Now()); err != nil {
+			slog.Error("failed to sign webhook", "url", hook.URL, "error", err)
+			return
+		}
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		slog.Warn("webhook delivery failed", "url", hook.URL, "event", event, "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("webhook delivery rejected", "url", hook.URL, "event", event, "status", resp.StatusCode)
+	}
+}
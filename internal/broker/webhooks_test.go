@@ -0,0 +1,97 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"lmbroker/internal/config"
+)
+
+func TestBroker_Webhooks(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "chatcmpl-1", "object": "chat.completion", "choices": [{"index": 0, "message": {"role": "assistant", "content": "hi"}, "finish_reason": "stop"}], "usage": {"prompt_tokens": 1000, "completion_tokens": 10}}`))
+	}))
+	defer mockBackend.Close()
+
+	events := make(chan webhookEvent, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write([]byte(r.Header.Get("X-LMBroker-Timestamp") + "."))
+		mac.Write(body)
+		if r.Header.Get("X-LMBroker-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			t.Errorf("Expected a valid signature, got: %q", r.Header.Get("X-LMBroker-Signature"))
+		}
+		var event webhookEvent
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer receiver.Close()
+
+	broker := New(&config.Config{
+		Webhooks: []config.WebhookConfig{{
+			URL:     receiver.URL,
+			Events:  []string{"request.completed", "budget.exceeded", "guardrail.triggered"},
+			Signing: &config.SigningConfig{Secret: "hook-secret", Header: "X-LMBroker-Signature", TimestampHeader: "X-LMBroker-Timestamp"},
+		}},
+		Keys: []config.KeyConfig{{Name: "team-a", Key: "sk-team-a", DailyBudget: 0.001}},
+		Models: map[string]config.Model{
+			"gpt-4o": {
+				Alias:      "gpt-4o",
+				Type:       "openai",
+				Target:     config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4o", Pricing: config.PricingConfig{InputPerMillion: 10}},
+				Guardrails: &config.GuardrailConfig{DenyPatterns: []*regexp.Regexp{regexp.MustCompile(`forbidden`)}, OutputAction: "block"},
+			},
+		},
+	})
+	handler := broker.AccessLog(broker.Authenticate(broker.EnforceQuotas(http.HandlerFunc(broker.HandleChatCompletions))))
+	send := func(content string) {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "messages": [{"role": "user", "content": "`+content+`"}]}`))
+		req.Header.Set("Authorization", "Bearer sk-team-a")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	receive := func() webhookEvent {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a webhook event")
+			return webhookEvent{}
+		}
+	}
+
+	// The first request uses up the budget and completes
+	send("Hello")
+	got := map[string]webhookEvent{}
+	for range 2 {
+		event := receive()
+		got[event.Event] = event
+	}
+	if got["budget.exceeded"].Data["key"] != "team-a" || got["budget.exceeded"].Data["budget"] != "daily" {
+		t.Errorf("Expected a budget.exceeded event, got: %+v", got)
+	}
+	if completed := got["request.completed"].Data; completed["alias"] != "gpt-4o" || completed["status"] != float64(200) {
+		t.Errorf("Expected a request.completed event, got: %+v", got)
+	}
+
+	// A guardrail failure is reported on its own and the budget is not
+	// reported again
+	broker.spend = newSpendTracker()
+	send("forbidden")
+	if event := receive(); event.Event != "guardrail.triggered" || event.Data["check"] != "deny" || event.Data["stage"] != "input" {
+		t.Errorf("Expected a guardrail.triggered event, got: %+v", event)
+	}
+	if event := receive(); event.Event != "request.completed" || event.Data["status"] != float64(400) {
+		t.Errorf("Expected the blocked request to complete with 400, got: %+v", event)
+	}
+}
@@ -0,0 +1,172 @@
+package broker
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/config"
+)
+
+var targetSelections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_target_selections_total",
+	Help: "Requests routed to each weighted target of an alias.",
+}, []string{"alias", "target"})
+
+// serveModel resolves the concrete target of an alias that serves a
+// request, first by session affinity or the model's target selection
+// strategy and then through any blue/green rollout, and serves it within
+// the concurrency limits.
+func (b *Broker) serveModel(w http.ResponseWriter, r *http.Request, modelConfig *config.Model, serve func(http.ResponseWriter, *config.Model)) {
+	serve = b.withConcurrencyLimit(r, b.withCooldown(serve))
+	if len(modelConfig.Targets) == 0 {
+		b.withRollout(w, modelConfig, serve)
+		return
+	}
+
+	var name string
+	if session := sessionKey(r, modelConfig); session != "" {
+		modelConfig, name = b.pickAffinityTarget(modelConfig, session)
+	} else if modelConfig.Strategy == "least_latency" {
+		modelConfig, name = b.pickFastestTarget(modelConfig, rand.Float64())
+		// Rank targets by time to first byte of successful responses, which
+		// unlike total time does not depend on how long the answer is.
+		recorder := &latencyRecorder{ResponseWriter: w, start: time.Now()}
+		w = recorder
+		defer func() {
+			if recorder.wroteHeader && recorder.status >= 200 && recorder.status < 300 {
+				b.latency.record(modelConfig.Alias, name, recorder.firstByte)
+			}
+		}()
+	} else if modelConfig.Strategy == "least_busy" {
+		modelConfig, name = b.pickLeastBusyTarget(modelConfig, rand.Float64())
+	} else if modelConfig.Strategy == "spillover" {
+		var countTokens bool
+		modelConfig, name, countTokens = b.pickSpilloverTarget(modelConfig)
+		// Targets that spill on tokens count the usage of their responses.
+		if countTokens {
+			capture := newCaptureWriter(w)
+			w = capture
+			defer func() {
+				inputTokens, outputTokens := parseUsage(capture.body.Bytes())
+				b.load.addTokens(modelConfig, inputTokens+outputTokens)
+			}()
+		}
+	} else {
+		modelConfig, name = b.pickWeightedTarget(modelConfig, rand.Float64())
+	}
+	targetSelections.WithLabelValues(modelConfig.Alias, name).Inc()
+	b.withRollout(w, modelConfig, serve)
+}
+
+// pickWeightedTarget chooses one of the model's weighted targets, with r
+// uniform in [0, 1). Weights are read from the model configuration on every
+// request.
+func (b *Broker) pickWeightedTarget(modelConfig *config.Model, r float64) (*config.Model, string) {
+	candidates := b.healthyTargets(modelConfig)
+
+	total := 0
+	for _, target := range candidates {
+		total += target.Weight
+	}
+	chosen := candidates[len(candidates)-1]
+	if total == 0 {
+		chosen = candidates[int(r*float64(len(candidates)))]
+	} else {
+		point := int(r * float64(total))
+		for _, target := range candidates {
+			if point < target.Weight {
+				chosen = target
+				break
+			}
+			point -= target.Weight
+		}
+	}
+	return withWeightedTarget(modelConfig, chosen), chosen.Name
+}
+
+// sessionKey returns the session a request belongs to under the model's
+// affinity, or "" if it has none.
+func sessionKey(r *http.Request, modelConfig *config.Model) string {
+	switch modelConfig.Affinity {
+	case "header":
+		header := modelConfig.AffinityHeader
+		if header == "" {
+			header = "X-Session-ID"
+		}
+		if session := r.Header.Get(header); session != "" {
+			return "session:" + session
+		}
+		fallthrough
+	case "user":
+		if user := requestUser(r); user != "" {
+			return "user:" + user
+		}
+	}
+	return ""
+}
+
+// pickAffinityTarget chooses the target that serves a session by weighted
+// rendezvous hashing: each target scores the session by a hash of the two,
+// scaled by its weight, and the highest score wins. A session only moves
+// when its target becomes unhealthy or its weights change, and then only
+// the sessions of that target move.
+func (b *Broker) pickAffinityTarget(modelConfig *config.Model, session string) (*config.Model, string) {
+	candidates := b.healthyTargets(modelConfig)
+	weighted := false
+	for _, target := range candidates {
+		weighted = weighted || target.Weight > 0
+	}
+
+	chosen := candidates[0]
+	best := math.Inf(-1)
+	for _, target := range candidates {
+		weight := 1.0
+		if weighted {
+			weight = float64(target.Weight)
+		}
+		if weight <= 0 {
+			continue
+		}
+		hash := fnv.New64a()
+		hash.Write([]byte(session))
+		hash.Write([]byte{0})
+		hash.Write([]byte(target.Name))
+		// A uniform point in (0, 1) from the hash, turned into a score
+		// whose ranking across targets follows their weights.
+		point := (float64(hash.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := -weight / math.Log(point); score > best {
+			chosen, best = target, score
+		}
+	}
+	return withWeightedTarget(modelConfig, chosen), chosen.Name
+}
+
+// healthyTargets returns the model's targets that the health checker has
+// not seen failing and that are not cooling down after a 429, or all of
+// them if none qualify.
+func (b *Broker) healthyTargets(modelConfig *config.Model) []config.WeightedTarget {
+	candidates := make([]config.WeightedTarget, 0, len(modelConfig.Targets))
+	for _, target := range modelConfig.Targets {
+		if b.health.healthy(modelConfig.Alias, target.Name) && !b.cooldown.active(withWeightedTarget(modelConfig, target)) {
+			candidates = append(candidates, target)
+		}
+	}
+	if len(candidates) == 0 {
+		return modelConfig.Targets
+	}
+	return candidates
+}
+
+// withWeightedTarget returns a copy of the model pointed at one of its targets.
+func withWeightedTarget(modelConfig *config.Model, target config.WeightedTarget) *config.Model {
+	selected := *modelConfig
+	selected.Target = target.Target
+	selected.Type = target.Type
+	return &selected
+}
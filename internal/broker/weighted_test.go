@@ -0,0 +1,129 @@
+package broker
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestPickWeightedTarget(t *testing.T) {
+	model := config.Model{
+		Alias: "gpt-4",
+		Targets: []config.WeightedTarget{
+			{Name: "openai", Type: "openai", Weight: 90, Target: config.TargetConfig{URL: "http://openai/", Model: "gpt-4"}},
+			{Name: "cheap", Type: "anthropic", Weight: 10, Target: config.TargetConfig{URL: "http://cheap/", Model: "claude-3-haiku"}},
+		},
+	}
+	broker := New(&config.Config{Models: map[string]config.Model{"gpt-4": model}})
+
+	cases := []struct {
+		r    float64
+		want string
+	}{
+		{0, "openai"},
+		{0.89, "openai"},
+		{0.9, "cheap"},
+		{0.999, "cheap"},
+	}
+	for _, tc := range cases {
+		selected, name := broker.pickWeightedTarget(&model, tc.r)
+		if name != tc.want {
+			t.Errorf("r=%v: expected %s, got: %s", tc.r, tc.want, name)
+		}
+		if name == "cheap" && (selected.Type != "anthropic" || selected.Target.Model != "claude-3-haiku") {
+			t.Errorf("Expected the cheap target's type and model, got: %s %s", selected.Type, selected.Target.Model)
+		}
+	}
+
+	// A target seen failing is skipped while another remains
+	for _, target := range broker.health.targets {
+		if target.Target == "openai" {
+			target.Status = healthDown
+		}
+	}
+	if _, name := broker.pickWeightedTarget(&model, 0); name != "cheap" {
+		t.Errorf("Expected the unhealthy target to be skipped, got: %s", name)
+	}
+
+	// Without weights, traffic is split evenly
+	for _, target := range broker.health.targets {
+		target.Status = healthUp
+	}
+	model.Targets[0].Weight, model.Targets[1].Weight = 0, 0
+	if _, name := broker.pickWeightedTarget(&model, 0.4); name != "openai" {
+		t.Errorf("Expected an even split, got: %s", name)
+	}
+	if _, name := broker.pickWeightedTarget(&model, 0.6); name != "cheap" {
+		t.Errorf("Expected an even split, got: %s", name)
+	}
+}
+
+func TestPickAffinityTarget(t *testing.T) {
+	model := config.Model{Alias: "llama", Affinity: "header", AffinityHeader: "X-Session-ID"}
+	for _, name := range []string{"replica-1", "replica-2", "replica-3"} {
+		model.Targets = append(model.Targets, config.WeightedTarget{Name: name, Type: "vllm", Target: config.TargetConfig{URL: "http://" + name + "/", Model: "llama-3-70b"}})
+	}
+	broker := New(&config.Config{Models: map[string]config.Model{"llama": model}})
+	request := func(header, body string) *http.Request {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+		if header != "" {
+			req.Header.Set("X-Session-ID", header)
+		}
+		return req
+	}
+
+	// Sessions come from the header, then the user; others have none
+	if got := sessionKey(request("conv-1", `{"user": "alice"}`), &model); got != "session:conv-1" {
+		t.Errorf("Expected the session header, got: %s", got)
+	}
+	if got := sessionKey(request("", `{"metadata": {"user_id": "alice"}}`), &model); got != "user:alice" {
+		t.Errorf("Expected the Anthropic user ID, got: %s", got)
+	}
+	if got := sessionKey(request("", `{}`), &model); got != "" {
+		t.Errorf("Expected no session, got: %s", got)
+	}
+
+	// A session keeps its replica, and sessions spread across replicas
+	assigned := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		session := fmt.Sprintf("session:%d", i)
+		_, name := broker.pickAffinityTarget(&model, session)
+		if _, again := broker.pickAffinityTarget(&model, session); again != name {
+			t.Errorf("Expected %s to keep its replica, got: %s then %s", session, name, again)
+		}
+		assigned[session] = name
+		used[name] = true
+	}
+	if len(used) != 3 {
+		t.Errorf("Expected sessions on every replica, got: %v", used)
+	}
+
+	// Only the sessions of a failing replica move
+	for _, target := range broker.health.targets {
+		if target.Target == "replica-2" {
+			target.Status = healthDown
+		}
+	}
+	for session, before := range assigned {
+		_, after := broker.pickAffinityTarget(&model, session)
+		if after == "replica-2" || (before != "replica-2" && after != before) {
+			t.Errorf("Expected %s to move only off the failing replica, got: %s then %s", session, before, after)
+		}
+	}
+
+	// Weights bias the assignment; a drained replica gets no sessions
+	for _, target := range broker.health.targets {
+		target.Status = healthUp
+	}
+	model.Targets[0].Weight, model.Targets[1].Weight, model.Targets[2].Weight = 1, 1, 0
+	for session := range assigned {
+		if _, name := broker.pickAffinityTarget(&model, session); name == "replica-3" {
+			t.Errorf("Expected no sessions on the drained replica, got: %s", session)
+		}
+	}
+}
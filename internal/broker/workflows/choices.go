@@ -0,0 +1,115 @@
+package workflows
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// maxEmulatedChoices bounds the parallel requests one emulated n request
+// can fan out to.
+const maxEmulatedChoices = 8
+
+// supportsChoices reports whether a backend adapter can generate several
+// choices for one request.
+func supportsChoices(providerAdapter adapters.Adapter) bool {
+	choices, ok := providerAdapter.(adapters.ChoicesAdapter)
+	return ok && choices.SupportsChoices()
+}
+
+// emulateChoices serves a request for several choices with one request per
+// choice, sent in parallel, for models that enable emulate_n. Requests with
+// gateway tools take this path too, as each choice needs its own
+// conversation, and are refused with a 400 without emulate_n. Usage is
+// summed over the requests. If any of them fails, its error is returned to
+// the client.
+func emulateChoices(w http.ResponseWriter, r *http.Request, providerAdapter adapters.Adapter, unifiedReq *adapters.UnifiedChatRequest, providerURL string, modelConfig *config.Model, executor ToolExecutor) (*adapters.UnifiedChatResponse, bool) {
+	n := unifiedReq.N
+	if !modelConfig.EmulateN {
+		WriteError(w, r, http.StatusBadRequest, "n > 1 is not supported for this model")
+		return nil, false
+	}
+	if n > maxEmulatedChoices {
+		WriteError(w, r, http.StatusBadRequest, "n must be at most "+strconv.Itoa(maxEmulatedChoices)+" for this model")
+		return nil, false
+	}
+
+	responses := make([]*adapters.UnifiedChatResponse, n)
+	failures := make([]*bufferedResponse, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		choiceReq := *unifiedReq
+		choiceReq.N = 0
+		choiceReq.Messages = slices.Clone(unifiedReq.Messages)
+		failures[i] = newBufferedResponse()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], _ = complete(failures[i], r, providerAdapter, &choiceReq, providerURL, modelConfig, executor)
+		}()
+	}
+	wg.Wait()
+
+	for i, resp := range responses {
+		if resp == nil {
+			slog.Warn("emulated choice failed", "alias", modelConfig.Alias, "choice", i, "status", failures[i].status)
+			failures[i].replay(w)
+			return nil, false
+		}
+	}
+
+	merged := responses[0]
+	for _, resp := range responses[1:] {
+		merged.Usage.InputTokens += resp.Usage.InputTokens
+		merged.Usage.OutputTokens += resp.Usage.OutputTokens
+		merged.AdditionalChoices = append(merged.AdditionalChoices, adapters.UnifiedChatResponse{
+			Role:               resp.Role,
+			Content:            resp.Content,
+			Reasoning:          resp.Reasoning,
+			ReasoningSignature: resp.ReasoningSignature,
+			ToolCalls:          resp.ToolCalls,
+			StopReason:         resp.StopReason,
+			Citations:          resp.Citations,
+		})
+	}
+	return merged, true
+}
+
+// bufferedResponse holds the error response of one emulated choice until
+// it is known which response the client gets.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// replay copies the buffered response to w.
+func (b *bufferedResponse) replay(w http.ResponseWriter) {
+	for key, values := range b.header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(b.status)
+	w.Write(b.body.Bytes())
+}
@@ -0,0 +1,54 @@
+package workflows
+
+import (
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// HandleCompletionTranslation serves a legacy text completion request from a
+// chat backend: the prompt is sent as a single user message and the reply
+// is returned as the completion text.
+func HandleCompletionTranslation(w http.ResponseWriter, r *http.Request, clientAdapter adapters.CompletionAdapter, providerAdapter adapters.Adapter, providerURL string, modelConfig *config.Model, ext Extensions) {
+	// 1. Decode the client's request into our internal format.
+	completionReq, err := clientAdapter.ClientCompletionToUnified(r)
+	if err != nil {
+		slog.Error("failed to translate client completion request to unified format", "error", err)
+		WriteError(w, r, http.StatusBadRequest, "failed to translate client completion request to unified format: "+err.Error())
+		return
+	}
+
+	// 1.5. Rewrite the model and recast the prompt as a chat conversation.
+	completionReq.Model = modelConfig.Target.Model
+	unifiedReq := adapters.CompletionToChat(completionReq)
+	applyMaxTokens(unifiedReq, modelConfig)
+
+	// 1.6. Reject prompts that fail the model's guardrails.
+	if modelConfig.Guardrails != nil && !enforceInputGuardrails(w, r, unifiedReq, modelConfig, ext) {
+		return
+	}
+
+	// 2-3. Send to the provider and decode its response.
+	unifiedResp, ok := sendChat(w, r, providerAdapter, unifiedReq, providerURL, modelConfig)
+	if !ok {
+		return
+	}
+
+	// 3.5. Block or annotate answers that fail the model's guardrails.
+	if modelConfig.Guardrails != nil && !enforceOutputGuardrails(w, r, unifiedResp, modelConfig, ext) {
+		return
+	}
+
+	// 4. Encode the reply as a completion for the original client.
+	completionResp := adapters.ChatToCompletion(unifiedResp)
+	completionResp.Stream = completionReq.Stream
+	if completionResp.Model == "" {
+		completionResp.Model = completionReq.Model
+	}
+	if err := clientAdapter.UnifiedCompletionToClient(completionResp, w); err != nil {
+		slog.Error("failed to translate unified completion response to client format", "error", err)
+		return
+	}
+}
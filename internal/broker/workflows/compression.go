@@ -0,0 +1,212 @@
+package workflows
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// Summarizer condenses a conversation transcript using another model alias.
+type Summarizer interface {
+	Summarize(ctx context.Context, alias, transcript string) (string, error)
+}
+
+var compressionTokensSaved = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_prompt_compression_tokens_saved_total",
+	Help: "Estimated prompt tokens removed by prompt compression.",
+}, []string{"alias", "strategy"})
+
+// omittedToolOutput replaces tool results dropped by the "tool_outputs" strategy.
+const omittedToolOutput = "[tool output omitted to fit the context budget]"
+
+// summaryKeepMessages is how many trailing messages "summarize" leaves intact.
+const summaryKeepMessages = 4
+
+var (
+	blankLines     = regexp.MustCompile(`\n{3,}`)
+	spaceRuns      = regexp.MustCompile(`(\S)[ \t]{2,}`)
+	headingMarkers = regexp.MustCompile(`(?m)^#{1,6}[ \t]+`)
+	boldSpans      = regexp.MustCompile(`\*\*([^*\s](?:[^*\n]*[^*\s])?)\*\*`)
+)
+
+// compressPrompt applies the model's compression strategies in order until
+// the estimated prompt size fits within its budget.
+func compressPrompt(ctx context.Context, unifiedReq *adapters.UnifiedChatRequest, modelConfig *config.Model, summarizer Summarizer) {
+	budget := modelConfig.Compression.MaxPromptTokens
+	before := estimatePromptTokens(unifiedReq)
+	if before <= budget {
+		return
+	}
+
+	strategies := modelConfig.Compression.Strategies
+	if len(strategies) == 0 {
+		strategies = []string{"whitespace", "tool_outputs"}
+	}
+
+	size := before
+	for _, strategy := range strategies {
+		if size <= budget {
+			break
+		}
+		switch strategy {
+		case "whitespace":
+			stripWhitespace(unifiedReq)
+		case "tool_outputs":
+			dropToolOutputs(unifiedReq, budget)
+		case "summarize":
+			if summarizer == nil || modelConfig.Compression.SummarizerAlias == "" {
+				slog.Warn("summarize compression needs summarizer_alias", "alias", modelConfig.Alias)
+				continue
+			}
+			if err := summarizeHistory(ctx, unifiedReq, modelConfig.Compression.SummarizerAlias, summarizer); err != nil {
+				slog.Warn("prompt summarization failed", "alias", modelConfig.Alias, "error", err)
+				continue
+			}
+		default:
+			slog.Warn("unknown compression strategy", "alias", modelConfig.Alias, "strategy", strategy)
+			continue
+		}
+
+		after := estimatePromptTokens(unifiedReq)
+		if saved := size - after; saved > 0 {
+			compressionTokensSaved.WithLabelValues(modelConfig.Alias, strategy).Add(float64(saved))
+		}
+		size = after
+	}
+
+	slog.Info("compressed prompt", "alias", modelConfig.Alias, "budget", budget, "tokens_before", before, "tokens_after", size)
+}
+
+// estimatePromptTokens approximates prompt size at four characters per
+// token, which is close enough to decide whether to compress.
+func estimatePromptTokens(unifiedReq *adapters.UnifiedChatRequest) int {
+	chars := 0
+	for _, msg := range unifiedReq.Messages {
+		chars += len(msg.Content)
+		for _, call := range msg.ToolCalls {
+			chars += len(call.Function.Name) + len(call.Function.Arguments)
+		}
+	}
+	return chars / 4
+}
+
+// stripWhitespace collapses redundant whitespace and markdown emphasis in
+// prose. Tool results, code blocks and inline code are left as they are,
+// since their layout and punctuation may be significant.
+func stripWhitespace(unifiedReq *adapters.UnifiedChatRequest) {
+	for i, msg := range unifiedReq.Messages {
+		if msg.ToolCallID != "" || msg.Role == "tool" {
+			continue
+		}
+		segments := strings.Split(msg.Content, "```")
+		for j := 0; j < len(segments); j += 2 {
+			spans := strings.Split(segments[j], "`")
+			for k := 0; k < len(spans); k += 2 {
+				text := spans[k]
+				text = headingMarkers.ReplaceAllString(text, "")
+				text = stripBold(text)
+				text = spaceRuns.ReplaceAllString(text, "$1 ")
+				text = blankLines.ReplaceAllString(text, "\n\n")
+				spans[k] = text
+			}
+			segments[j] = strings.Join(spans, "`")
+		}
+		unifiedReq.Messages[i].Content = strings.TrimSpace(strings.Join(segments, "```"))
+	}
+}
+
+// stripBold removes the markers of **bold** spans that stand on their own,
+// keeping ones inside words or expressions such as 2**3. Underscore
+// emphasis is left alone, as it cannot be told apart from identifiers such
+// as __init__.
+func stripBold(text string) string {
+	var out strings.Builder
+	last := 0
+	for _, match := range boldSpans.FindAllStringSubmatchIndex(text, -1) {
+		start, end := match[0], match[1]
+		if (start > 0 && isWordByte(text[start-1])) || (end < len(text) && isWordByte(text[end])) {
+			continue
+		}
+		out.WriteString(text[last:start])
+		out.WriteString(text[match[2]:match[3]])
+		last = end
+	}
+	out.WriteString(text[last:])
+	return out.String()
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// dropToolOutputs replaces tool results with a placeholder, oldest first,
+// until the prompt fits. The most recent tool result is always kept.
+func dropToolOutputs(unifiedReq *adapters.UnifiedChatRequest, budget int) {
+	last := -1
+	for i, msg := range unifiedReq.Messages {
+		if msg.ToolCallID != "" {
+			last = i
+		}
+	}
+	for i, msg := range unifiedReq.Messages {
+		if i >= last || estimatePromptTokens(unifiedReq) <= budget {
+			return
+		}
+		if msg.ToolCallID != "" && msg.Content != omittedToolOutput {
+			unifiedReq.Messages[i].Content = omittedToolOutput
+			unifiedReq.Messages[i].Images = nil
+		}
+	}
+}
+
+// summarizeHistory replaces older turns with a single summary message. The
+// kept tail starts at an assistant turn so tool calls stay paired with their
+// results and roles keep alternating after the summary.
+func summarizeHistory(ctx context.Context, unifiedReq *adapters.UnifiedChatRequest, alias string, summarizer Summarizer) error {
+	start := 0
+	for start < len(unifiedReq.Messages) && unifiedReq.Messages[start].Role == "system" {
+		start++
+	}
+	end := -1
+	for i := max(start+1, len(unifiedReq.Messages)-summaryKeepMessages); i < len(unifiedReq.Messages); i++ {
+		if unifiedReq.Messages[i].Role == "assistant" {
+			end = i
+			break
+		}
+	}
+	if end <= start {
+		return nil
+	}
+
+	var transcript strings.Builder
+	for _, msg := range unifiedReq.Messages[start:end] {
+		role := msg.Role
+		if msg.ToolCallID != "" {
+			role = "tool result"
+		}
+		transcript.WriteString(role + ": " + msg.Content + "\n")
+		for _, call := range msg.ToolCalls {
+			transcript.WriteString("tool call " + call.Function.Name + ": " + call.Function.Arguments + "\n")
+		}
+	}
+
+	summary, err := summarizer.Summarize(ctx, alias, transcript.String())
+	if err != nil {
+		return err
+	}
+
+	messages := append([]adapters.UnifiedMessage{}, unifiedReq.Messages[:start]...)
+	messages = append(messages, adapters.UnifiedMessage{
+		Role:    "user",
+		Content: "Summary of the earlier conversation:\n" + summary,
+	})
+	unifiedReq.Messages = append(messages, unifiedReq.Messages[end:]...)
+	return nil
+}
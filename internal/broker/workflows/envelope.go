@@ -0,0 +1,69 @@
+package workflows
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// Envelope is a request body read once and shared by every stage that needs
+// it: routing, validation, quotas, caching, failover and the workflows. It
+// travels as the request's Body, so adapters that decode the body themselves
+// read the same bytes instead of another copy.
+type Envelope struct {
+	// Raw is the body as received. It is shared and must not be modified.
+	Raw []byte
+	// Model and Stream are the model and stream fields of a JSON body.
+	Model  string
+	Stream bool
+	// Err is set when the body is not a JSON object with a string model,
+	// as for multipart uploads.
+	Err error
+}
+
+// envelopeBody is a request body that carries its Envelope.
+type envelopeBody struct {
+	*bytes.Reader
+	envelope *Envelope
+}
+
+func (b *envelopeBody) Close() error { return nil }
+
+// ReadEnvelope returns the request's envelope, reading the body the first
+// time. The body is rewound on every call, so the next reader sees it whole.
+func ReadEnvelope(r *http.Request) (*Envelope, error) {
+	if body, ok := r.Body.(*envelopeBody); ok {
+		body.Seek(0, io.SeekStart)
+		return body.envelope, nil
+	}
+	var raw []byte
+	if r.Body != nil {
+		var err error
+		raw, err = io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return SetBody(r, raw), nil
+}
+
+// SetBody replaces the request's body, for instance with its model field
+// rewritten, and returns the new envelope.
+func SetBody(r *http.Request, raw []byte) *Envelope {
+	envelope := &Envelope{Raw: raw}
+	var fields struct {
+		Model  string          `json:"model"`
+		Stream json.RawMessage `json:"stream"`
+	}
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		envelope.Err = err
+	} else {
+		envelope.Model = fields.Model
+		envelope.Stream = string(fields.Stream) == "true"
+	}
+	r.Body = &envelopeBody{Reader: bytes.NewReader(raw), envelope: envelope}
+	r.ContentLength = int64(len(raw))
+	return envelope
+}
@@ -0,0 +1,84 @@
+package workflows
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// WriteError answers with an error the broker raised itself, in the error
+// envelope of the client's SDK: Anthropic's for /v1/messages endpoints and
+// OpenAI's for the rest.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	WriteErrorCode(w, r, status, "", "", message)
+}
+
+// WriteErrorCode is WriteError with an OpenAI error code, like
+// "invalid_api_key", and the request parameter at fault. Anthropic errors have
+// neither, so both are left out there.
+func WriteErrorCode(w http.ResponseWriter, r *http.Request, status int, code, param, message string) {
+	anthropicType, openAIType := errorTypes(status)
+
+	var payload interface{}
+	if isAnthropicPath(r.URL.Path) {
+		payload = map[string]interface{}{
+			"type": "error",
+			"error": map[string]string{
+				"type":    anthropicType,
+				"message": message,
+			},
+		}
+	} else {
+		var openAICode interface{}
+		if code != "" {
+			openAICode = code
+		}
+		var openAIParam interface{}
+		if param != "" {
+			openAIParam = param
+		}
+		payload = map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": message,
+				"type":    openAIType,
+				"param":   openAIParam,
+				"code":    openAICode,
+			},
+		}
+	}
+
+	body, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// isAnthropicPath reports whether a request path belongs to the Anthropic
+// Messages API, including count_tokens.
+func isAnthropicPath(path string) bool {
+	return strings.HasPrefix(path, "/v1/messages")
+}
+
+// errorTypes returns the Anthropic and OpenAI error types for a status.
+func errorTypes(status int) (anthropicType, openAIType string) {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error", "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error", "invalid_request_error"
+	case http.StatusForbidden:
+		return "permission_error", "invalid_request_error"
+	case http.StatusNotFound:
+		return "not_found_error", "invalid_request_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large", "invalid_request_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error", "rate_limit_error"
+	case http.StatusServiceUnavailable, 529:
+		return "overloaded_error", "server_error"
+	}
+	if status >= 500 {
+		return "api_error", "server_error"
+	}
+	return "invalid_request_error", "invalid_request_error"
+}
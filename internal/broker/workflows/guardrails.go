@@ -0,0 +1,154 @@
+package workflows
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// Moderator classifies text as safe or unsafe using another model alias.
+type Moderator interface {
+	Moderate(ctx context.Context, alias, text string) (flagged bool, reason string, err error)
+}
+
+// Notifier receives broker events, such as failed guardrail checks, for
+// webhooks.
+type Notifier interface {
+	Notify(event string, data map[string]interface{})
+}
+
+// GuardrailHeader names the output check an annotated response failed.
+const GuardrailHeader = "X-LMBroker-Guardrail"
+
+var guardrailsTriggered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "lmbroker_guardrails_triggered_total",
+	Help: "Prompts and responses that failed a guardrail check.",
+}, []string{"alias", "stage", "check"})
+
+// guardrailViolation describes a failed check: "deny", "max_prompt_tokens"
+// or "moderation".
+type guardrailViolation struct {
+	Check  string
+	Reason string
+}
+
+// enforceInputGuardrails checks a prompt against the model's guardrails
+// and, if it fails one, answers with a policy error. It reports whether
+// the request may go on.
+func enforceInputGuardrails(w http.ResponseWriter, r *http.Request, unifiedReq *adapters.UnifiedChatRequest, modelConfig *config.Model, ext Extensions) bool {
+	guardrails := modelConfig.Guardrails
+	var violation *guardrailViolation
+	if guardrails.MaxPromptTokens > 0 && estimatePromptTokens(unifiedReq) > guardrails.MaxPromptTokens {
+		violation = &guardrailViolation{Check: "max_prompt_tokens", Reason: fmt.Sprintf("prompt exceeds %d tokens", guardrails.MaxPromptTokens)}
+	} else {
+		var err error
+		violation, err = checkText(r.Context(), promptText(unifiedReq), guardrails.DenyPatterns, guardrails.ModerationAlias, ext.Moderator)
+		if err != nil {
+			slog.Error("guardrail moderation failed", "alias", modelConfig.Alias, "error", err)
+			WriteError(w, r, http.StatusBadGateway, "guardrail moderation failed")
+			return false
+		}
+	}
+	if violation == nil {
+		return true
+	}
+	noteGuardrail(ext, modelConfig, "input", violation, "block")
+	slog.Warn("prompt blocked by guardrail", "alias", modelConfig.Alias, "check", violation.Check, "reason", violation.Reason)
+	WriteErrorCode(w, r, http.StatusBadRequest, "content_policy_violation", "", "request blocked by guardrail "+violation.Check+": "+violation.Reason)
+	return false
+}
+
+// enforceOutputGuardrails checks a response against the model's guardrails.
+// A failing response is replaced by a policy error, or annotated with
+// GuardrailHeader when the output action is "annotate". It reports whether
+// the response may be returned.
+func enforceOutputGuardrails(w http.ResponseWriter, r *http.Request, unifiedResp *adapters.UnifiedChatResponse, modelConfig *config.Model, ext Extensions) bool {
+	guardrails := modelConfig.Guardrails
+	alias := guardrails.ModerationAlias
+	if !guardrails.ModerateOutput {
+		alias = ""
+	}
+	violation, err := checkText(r.Context(), responseText(unifiedResp), guardrails.DenyOutputPatterns, alias, ext.Moderator)
+	if err != nil {
+		slog.Error("guardrail moderation failed", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "guardrail moderation failed")
+		return false
+	}
+	if violation == nil {
+		return true
+	}
+	noteGuardrail(ext, modelConfig, "output", violation, guardrails.OutputAction)
+	slog.Warn("response failed guardrail", "alias", modelConfig.Alias, "check", violation.Check, "reason", violation.Reason, "action", guardrails.OutputAction)
+	if guardrails.OutputAction == "annotate" {
+		w.Header().Set(GuardrailHeader, violation.Check)
+		return true
+	}
+	WriteErrorCode(w, r, http.StatusBadRequest, "content_policy_violation", "", "response blocked by guardrail "+violation.Check+": "+violation.Reason)
+	return false
+}
+
+// noteGuardrail counts a failed check and reports it to the notifier.
+func noteGuardrail(ext Extensions, modelConfig *config.Model, stage string, violation *guardrailViolation, action string) {
+	guardrailsTriggered.WithLabelValues(modelConfig.Alias, stage, violation.Check).Inc()
+	if ext.Notifier != nil {
+		ext.Notifier.Notify("guardrail.triggered", map[string]interface{}{
+			"alias":  modelConfig.Alias,
+			"stage":  stage,
+			"check":  violation.Check,
+			"reason": violation.Reason,
+			"action": action,
+		})
+	}
+}
+
+// checkText runs the deny-list, then the moderation alias if one is given
+// and a moderator is available.
+func checkText(ctx context.Context, text string, deny []*regexp.Regexp, moderationAlias string, moderator Moderator) (*guardrailViolation, error) {
+	for _, pattern := range deny {
+		if pattern.MatchString(text) {
+			return &guardrailViolation{Check: "deny", Reason: "matches " + pattern.String()}, nil
+		}
+	}
+	if moderationAlias == "" || moderator == nil || text == "" {
+		return nil, nil
+	}
+	flagged, reason, err := moderator.Moderate(ctx, moderationAlias, text)
+	if err != nil || !flagged {
+		return nil, err
+	}
+	if reason == "" {
+		reason = "flagged by " + moderationAlias
+	}
+	return &guardrailViolation{Check: "moderation", Reason: reason}, nil
+}
+
+// promptText joins the text the client sent: the system prompt and every
+// message.
+func promptText(unifiedReq *adapters.UnifiedChatRequest) string {
+	parts := []string{unifiedReq.System}
+	for _, msg := range unifiedReq.Messages {
+		parts = append(parts, msg.Content)
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
+
+// responseText joins the text of every choice, tool call arguments included.
+func responseText(unifiedResp *adapters.UnifiedChatResponse) string {
+	var parts []string
+	for _, choice := range append([]adapters.UnifiedChatResponse{*unifiedResp}, unifiedResp.AdditionalChoices...) {
+		parts = append(parts, choice.Content)
+		for _, call := range choice.ToolCalls {
+			parts = append(parts, call.Function.Arguments)
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
@@ -0,0 +1,66 @@
+package workflows
+
+import (
+	"net/http"
+	"strings"
+
+	"lmbroker/internal/config"
+)
+
+// unforwardedHeaders describe the client's connection to the broker or its
+// browser session, not the request, so no policy forwards them.
+var unforwardedHeaders = []string{
+	"Connection",
+	"Cookie",
+	"Host",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// reencodedHeaders describe a body the broker re-encodes when translating,
+// so the backend request keeps the adapter's own.
+var reencodedHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding"}
+
+// forwardHeaders adds the client headers the target's policy lets through
+// to a backend request. passthrough tells whether the body is forwarded as
+// received; translated requests only get the headers Forward names.
+func forwardHeaders(dst, src http.Header, policy config.HeaderPolicy, passthrough bool) {
+	if !passthrough && len(policy.Forward) == 0 {
+		return
+	}
+	for name, values := range src {
+		if matchesHeader(unforwardedHeaders, name) || matchesHeader(policy.Drop, name) {
+			continue
+		}
+		if len(policy.Forward) > 0 && !matchesHeader(policy.Forward, name) {
+			continue
+		}
+		if !passthrough && matchesHeader(reencodedHeaders, name) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// matchesHeader reports whether a header name is in a list of names and
+// "prefix*" patterns.
+func matchesHeader(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
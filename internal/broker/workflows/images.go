@@ -0,0 +1,79 @@
+package workflows
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// HandleImageTranslation is the workflow for image generation requests whose
+// client and provider formats differ, with model rewriting.
+func HandleImageTranslation(w http.ResponseWriter, r *http.Request, clientAdapter, providerAdapter adapters.ImageAdapter, providerURL string, modelConfig *config.Model) {
+	// 1. Decode the client's request into our internal format.
+	unifiedReq, err := clientAdapter.ClientImageToUnified(r)
+	if err != nil {
+		slog.Error("failed to translate client image request to unified format", "error", err)
+		WriteError(w, r, http.StatusBadRequest, "failed to translate client image request to unified format: "+err.Error())
+		return
+	}
+
+	// 1.5. Rewrite the model field in the unified request
+	unifiedReq.Model = modelConfig.Target.Model
+
+	// 2. Encode our internal request into the format for the target provider.
+	providerReq, err := providerAdapter.UnifiedImageToBackend(unifiedReq, providerURL)
+	if err != nil {
+		slog.Error("failed to translate unified image request to provider format", "error", err)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate unified image request to provider format")
+		return
+	}
+	providerReq = providerReq.WithContext(r.Context())
+	forwardHeaders(providerReq.Header, r.Header, modelConfig.Target.Headers, false)
+
+	// 2.5. Add API key if configured
+	if err := applyAuth(providerReq, modelConfig); err != nil {
+		slog.Error("failed to authenticate image request to provider", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to authenticate image request to provider")
+		return
+	}
+
+	// Make the request to the provider.
+	providerResp, err := doRequest(providerReq, modelConfig)
+	if err != nil {
+		slog.Error("failed to make image request to provider", "error", err)
+		WriteError(w, r, backendErrorStatus(err), "failed to make image request to provider")
+		return
+	}
+	defer providerResp.Body.Close()
+	if err := bufferResponse(providerResp, modelConfig); err != nil {
+		slog.Error("failed to read provider image response", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to read provider image response: "+err.Error())
+		return
+	}
+
+	// 2.6. Surface backend errors instead of decoding them as images.
+	if providerResp.StatusCode >= 400 {
+		slog.Error("backend returned image generation error", "status", providerResp.StatusCode)
+		w.Header().Set("Content-Type", providerResp.Header.Get("Content-Type"))
+		w.WriteHeader(providerResp.StatusCode)
+		io.Copy(w, providerResp.Body)
+		return
+	}
+
+	// 3. Decode the provider's response into our internal format.
+	unifiedResp, err := providerAdapter.BackendImageToUnified(providerResp)
+	if err != nil {
+		slog.Error("failed to translate provider image response to unified format", "error", err)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate provider image response to unified format")
+		return
+	}
+
+	// 4. Encode our internal response into the format for the original client.
+	if err := clientAdapter.UnifiedImageToClient(unifiedResp, w); err != nil {
+		slog.Error("failed to translate unified image response to client format", "error", err)
+		return
+	}
+}
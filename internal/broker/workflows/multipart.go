@@ -0,0 +1,77 @@
+package workflows
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"lmbroker/internal/config"
+)
+
+// HandleMultipartPassthrough is the passthrough workflow for multipart form
+// uploads such as audio transcriptions. The model form field is rewritten;
+// every other part, including the uploaded file, is forwarded byte for byte.
+func HandleMultipartPassthrough(w http.ResponseWriter, r *http.Request, providerURL string, modelConfig *config.Model) {
+	envelope, err := ReadEnvelope(r)
+	if err != nil {
+		WriteError(w, r, http.StatusInternalServerError, "failed to read request body")
+		return
+	}
+	body := envelope.Raw
+
+	if modelConfig.Target.Model != modelConfig.Alias {
+		if body, err = RewriteMultipartModel(body, r.Header.Get("Content-Type"), modelConfig.Target.Model); err != nil {
+			WriteError(w, r, http.StatusBadRequest, "failed to parse multipart form: "+err.Error())
+			return
+		}
+	}
+
+	forwardRequest(w, r, providerURL, body, modelConfig)
+}
+
+// RewriteMultipartModel re-encodes a multipart body with the model field
+// replaced, keeping the original boundary so the Content-Type header stays
+// valid.
+func RewriteMultipartModel(body []byte, contentType, model string) ([]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, fmt.Errorf("expected multipart/form-data with a boundary")
+	}
+
+	reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+	if err := writer.SetBoundary(params["boundary"]); err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		dst, err := writer.CreatePart(part.Header)
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "model" {
+			_, err = io.WriteString(dst, model)
+		} else {
+			_, err = io.Copy(dst, part)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"log/slog"
 	"net/http"
+	"strings"
 
 	"lmbroker/internal/config"
 )
@@ -16,17 +18,18 @@ import (
 // request and response directly without translation, which is efficient.
 func HandlePassthrough(w http.ResponseWriter, r *http.Request, providerURL string, modelConfig *config.Model) {
 	// Read and potentially modify the request body to rewrite the model field
-	body, err := io.ReadAll(r.Body)
+	envelope, err := ReadEnvelope(r)
 	if err != nil {
-		http.Error(w, "failed to read request body", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "failed to read request body")
 		return
 	}
+	body := envelope.Raw
 
 	// Rewrite the model field if the target model is different from the alias
 	if modelConfig.Target.Model != modelConfig.Alias {
 		var reqData map[string]interface{}
 		if err := json.Unmarshal(body, &reqData); err != nil {
-			http.Error(w, "failed to parse request JSON", http.StatusBadRequest)
+			WriteError(w, r, http.StatusBadRequest, "failed to parse request JSON")
 			return
 		}
 		
@@ -35,32 +38,47 @@ func HandlePassthrough(w http.ResponseWriter, r *http.Request, providerURL strin
 		
 		// Marshal back to JSON
 		if body, err = json.Marshal(reqData); err != nil {
-			http.Error(w, "failed to encode request JSON", http.StatusInternalServerError)
+			WriteError(w, r, http.StatusInternalServerError, "failed to encode request JSON")
 			return
 		}
 	}
 
-	// Create a new request to the provider.
-	backendReq, err := http.NewRequest(r.Method, providerURL, bytes.NewReader(body))
+	forwardRequest(w, r, providerURL, body, modelConfig)
+}
+
+// forwardRequest sends an already rewritten request body to the provider
+// with the client's headers and copies the response back, streaming event
+// and audio responses as they arrive.
+func forwardRequest(w http.ResponseWriter, r *http.Request, providerURL string, body []byte, modelConfig *config.Model) {
+	// Create a new request to the provider. It is tied to the client's
+	// context so a disconnect cancels the backend call too.
+	backendReq, err := http.NewRequestWithContext(r.Context(), r.Method, providerURL, bytes.NewReader(body))
 	if err != nil {
-		http.Error(w, "failed to create provider request", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "failed to create provider request")
 		return
 	}
 
-	// Copy headers from the original request to the provider request.
-	// Important headers like Content-Type, Authorization, etc., are preserved.
-	backendReq.Header = r.Header.Clone()
+	// Copy the client's headers to the provider request, as the target's
+	// header policy allows. Content-Type, Authorization, etc. pass by default.
+	forwardHeaders(backendReq.Header, r.Header, modelConfig.Target.Headers, true)
+
+	// Apply provider-specific body changes before the request is signed.
+	if err := adaptProviderRequest(backendReq, modelConfig); err != nil {
+		WriteError(w, r, http.StatusBadRequest, "failed to parse request JSON")
+		return
+	}
 	
 	// Add API key if configured
-	if modelConfig.Target.APIKey != "" {
-		backendReq.Header.Set("Authorization", "Bearer "+modelConfig.Target.APIKey)
+	if err := applyAuth(backendReq, modelConfig); err != nil {
+		slog.Error("failed to authenticate backend request", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to authenticate request to backend")
+		return
 	}
 
 	// Make the request to the backend.
-	client := &http.Client{}
-	backendResp, err := client.Do(backendReq)
+	backendResp, err := doRequest(backendReq, modelConfig)
 	if err != nil {
-		http.Error(w, "failed to make request to backend", http.StatusBadGateway)
+		WriteError(w, r, backendErrorStatus(err), "failed to make request to backend")
 		return
 	}
 	defer backendResp.Body.Close()
@@ -72,9 +90,48 @@ func HandlePassthrough(w http.ResponseWriter, r *http.Request, providerURL strin
 		}
 	}
 
+	// Server-Sent Events and synthesized audio must reach the client as they
+	// arrive, so they are flushed chunk by chunk rather than buffered until
+	// the end.
+	contentType := backendResp.Header.Get("Content-Type")
+	streaming := strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "audio/")
+	if streaming {
+		w.Header().Del("Content-Length")
+	}
+
 	// Set the status code of our response to match the backend's response.
 	w.WriteHeader(backendResp.StatusCode)
 
 	// Stream the backend response directly to the client.
-	_, _ = io.Copy(w, backendResp.Body)
+	if !streaming {
+		_, _ = io.Copy(w, backendResp.Body)
+		return
+	}
+	if err := streamEvents(w, backendResp.Body); err != nil && r.Context().Err() != nil {
+		slog.Info("client disconnected during stream, backend request cancelled", "alias", modelConfig.Alias)
+	}
+}
+
+// streamEvents copies an event stream to the client, flushing after every
+// read so each event is delivered without waiting for the next.
+func streamEvents(w http.ResponseWriter, body io.Reader) error {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
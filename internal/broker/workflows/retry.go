@@ -0,0 +1,300 @@
+package workflows
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lmbroker/internal/config"
+	"lmbroker/internal/tracing"
+)
+
+// sleep waits for d or until ctx is done; tests replace it to avoid real waits.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ResponseObserver sees every response a target returns before it is read.
+type ResponseObserver func(modelConfig *config.Model, resp *http.Response)
+
+type contextKey int
+
+const responseObserverKey contextKey = iota
+
+// WithResponseObserver has observe see the target responses to backend
+// requests made with ctx.
+func WithResponseObserver(ctx context.Context, observe ResponseObserver) context.Context {
+	return context.WithValue(ctx, responseObserverKey, observe)
+}
+
+// Send sends a request the broker makes on its own, such as a batch file
+// upload, to a model's target with the target's credentials, timeouts and
+// retry policy.
+func Send(req *http.Request, modelConfig *config.Model) (*http.Response, error) {
+	if err := applyAuth(req, modelConfig); err != nil {
+		return nil, err
+	}
+	return doRequest(req, modelConfig)
+}
+
+// doRequest sends a backend request, retrying under the target's retry
+// policy. Retries only happen before anything has been written to the
+// client: on a retryable status, whose body is discarded, or when the
+// connection could not be established, so the backend never saw the request.
+// Each call is traced as one client span covering all attempts.
+func doRequest(req *http.Request, modelConfig *config.Model) (*http.Response, error) {
+	operation := tracing.Operation(req.URL.Path)
+	ctx, span := tracing.Start(req.Context(), operation+" "+modelConfig.Target.Model, tracing.KindClient)
+	defer span.End()
+	span.SetAttribute("gen_ai.operation.name", operation)
+	span.SetAttribute("gen_ai.system", modelConfig.Type)
+	span.SetAttribute("gen_ai.request.model", modelConfig.Target.Model)
+	span.SetAttribute("server.address", req.URL.Hostname())
+	tracing.Inject(ctx, req.Header)
+
+	// The total timeout runs until a regular response's body is closed.
+	// Streams are instead cut off when they stall.
+	timeouts := modelConfig.Target.Timeouts
+	ctx, cancel := context.WithCancelCause(ctx)
+	expire := func() { cancel(errBackendTimeout) }
+	var timer *time.Timer
+	if timeouts.TotalDuration > 0 {
+		timer = time.AfterFunc(timeouts.TotalDuration, expire)
+	}
+	req = req.WithContext(ctx)
+
+	resp, attempts, err := sendWithRetries(req, modelConfig)
+	span.SetAttribute("lmbroker.attempts", attempts)
+	if observe, ok := ctx.Value(responseObserverKey).(ResponseObserver); ok && err == nil {
+		observe(modelConfig, resp)
+	}
+	if err != nil {
+		if timer != nil {
+			timer.Stop()
+		}
+		if context.Cause(ctx) == errBackendTimeout || isTimeout(err) {
+			err = fmt.Errorf("%w: %w", errBackendTimeout, err)
+		}
+		cancel(nil)
+		span.SetError(err.Error())
+		return nil, err
+	}
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(http.StatusText(resp.StatusCode))
+	}
+	body := &timeoutBody{ReadCloser: resp.Body, timer: timer, cancel: func() { cancel(nil) }}
+	if isStream(resp) {
+		if timer != nil {
+			timer.Stop()
+		}
+		body.timer = nil
+		if timeouts.StreamIdleDuration > 0 {
+			body.idle = timeouts.StreamIdleDuration
+			body.timer = time.AfterFunc(body.idle, expire)
+		}
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// errBackendTimeout is returned, wrapped, when a backend request runs out
+// of time under the target's timeouts.
+var errBackendTimeout = errors.New("backend timed out")
+
+// errResponseTooLarge is returned when a backend response the broker reads
+// whole is larger than the target's max_response_bytes.
+var errResponseTooLarge = errors.New("backend response exceeds max_response_bytes")
+
+// bufferResponse reads a backend response body into memory before it is
+// decoded, refusing bodies over the target's max_response_bytes. Without a
+// limit the body is left to be read as is.
+func bufferResponse(resp *http.Response, modelConfig *config.Model) error {
+	limit := modelConfig.Target.MaxResponseBytes
+	if limit <= 0 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return errResponseTooLarge
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return nil
+}
+
+// StatusClientClosedRequest is recorded for requests whose client
+// disconnected before the backend answered, after nginx's convention. The
+// client never sees it.
+const StatusClientClosedRequest = 499
+
+// backendErrorStatus is the status to answer a failed backend request with:
+// 504 if it timed out, 499 if the client went away and cancelled it, or 502.
+func backendErrorStatus(err error) int {
+	if errors.Is(err, errBackendTimeout) {
+		return http.StatusGatewayTimeout
+	}
+	if errors.Is(err, context.Canceled) {
+		return StatusClientClosedRequest
+	}
+	return http.StatusBadGateway
+}
+
+// isStream reports whether a response is delivered incrementally, so the
+// total timeout does not apply to it.
+func isStream(resp *http.Response) bool {
+	contentType := resp.Header.Get("Content-Type")
+	return strings.HasPrefix(contentType, "text/event-stream") || strings.HasPrefix(contentType, "application/x-ndjson") || strings.HasPrefix(contentType, "audio/")
+}
+
+// isTimeout reports whether err is a connect or response header timeout.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// timeoutBody ends a backend response's timeouts when it is closed. On
+// streams, every read pushes the idle deadline back.
+type timeoutBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	idle   time.Duration
+	cancel func()
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.idle > 0 && n > 0 {
+		b.timer.Reset(b.idle)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// fallbackClients serve targets whose configuration was not loaded from a
+// file, and so has no client of its own, sharing one per set of settings.
+var fallbackClients sync.Map
+
+// clientFor returns the HTTP client of a target.
+func clientFor(target *config.TargetConfig) *http.Client {
+	if target.Client != nil {
+		return target.Client
+	}
+	key := struct {
+		timeouts config.TimeoutConfig
+		pool     config.PoolConfig
+		mock     *config.MockConfig
+	}{target.Timeouts, target.Pool, target.Mock}
+	if client, ok := fallbackClients.Load(key); ok {
+		return client.(*http.Client)
+	}
+	client, _ := fallbackClients.LoadOrStore(key, config.NewClient(target))
+	return client.(*http.Client)
+}
+
+// sendWithRetries sends req until it succeeds or the retry policy gives up,
+// returning the number of attempts made.
+func sendWithRetries(req *http.Request, modelConfig *config.Model) (*http.Response, int, error) {
+	client := clientFor(&modelConfig.Target)
+	policy := modelConfig.Target.Retry
+	if policy == nil || policy.MaxAttempts <= 1 || req.GetBody == nil {
+		resp, err := client.Do(req)
+		return resp, 1, err
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		last := attempt >= policy.MaxAttempts
+		if err == nil && (last || !slices.Contains(policy.RetryOn, resp.StatusCode)) {
+			return resp, attempt, nil
+		}
+		if err != nil && (last || !isDialError(err)) {
+			return nil, attempt, err
+		}
+
+		wait := backoff(policy, attempt)
+		if err == nil {
+			// Honor the backend's own hint, but give up rather than stall
+			// longer than the policy allows.
+			if retryAfter, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > policy.MaxBackoffDuration {
+					return resp, attempt, nil
+				}
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			slog.Warn("retrying backend request", "alias", modelConfig.Alias, "status", resp.StatusCode, "attempt", attempt, "wait", wait)
+		} else {
+			slog.Warn("retrying backend request", "alias", modelConfig.Alias, "error", err, "attempt", attempt, "wait", wait)
+		}
+
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, attempt, err
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, attempt, err
+		}
+		req.Body = body
+	}
+}
+
+// backoff returns the exponential delay before the retry following attempt,
+// with up to 20% jitter so clients rejected together do not retry together.
+func backoff(policy *config.RetryConfig, attempt int) time.Duration {
+	wait := policy.InitialBackoffDuration << (attempt - 1)
+	if policy.MaxBackoffDuration > 0 && (wait > policy.MaxBackoffDuration || wait <= 0) {
+		wait = policy.MaxBackoffDuration
+	}
+	return wait + time.Duration(rand.Float64()*0.2*float64(wait))
+}
+
+// ParseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// isDialError reports whether err happened while connecting, before any
+// part of the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
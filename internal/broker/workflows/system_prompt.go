@@ -0,0 +1,48 @@
+package workflows
+
+import (
+	"strings"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// systemPlaceholder stands for the client's system prompt in a template.
+const systemPlaceholder = "{{system}}"
+
+// applySystemPrompt wraps or replaces the client's system prompt as the
+// model configures. Leading system and developer messages are folded into
+// System first, so the result reaches every backend as a single system
+// prompt.
+func applySystemPrompt(unifiedReq *adapters.UnifiedChatRequest, modelConfig *config.Model) {
+	prompt := modelConfig.SystemPrompt
+	if !prompt.Enabled() {
+		return
+	}
+
+	parts := []string{}
+	if unifiedReq.System != "" {
+		parts = append(parts, unifiedReq.System)
+	}
+	start := 0
+	for start < len(unifiedReq.Messages) && (unifiedReq.Messages[start].Role == "system" || unifiedReq.Messages[start].Role == "developer") {
+		if content := unifiedReq.Messages[start].Content; content != "" {
+			parts = append(parts, content)
+		}
+		start++
+	}
+	unifiedReq.Messages = unifiedReq.Messages[start:]
+	system := strings.Join(parts, "\n\n")
+
+	if prompt.Template != "" {
+		unifiedReq.System = strings.ReplaceAll(prompt.Template, systemPlaceholder, system)
+		return
+	}
+	parts = parts[:0]
+	for _, part := range []string{prompt.Prefix, system, prompt.Suffix} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	unifiedReq.System = strings.Join(parts, "\n\n")
+}
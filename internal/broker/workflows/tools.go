@@ -0,0 +1,111 @@
+package workflows
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+// applyCodeExecutionMode rewrites hosted code execution tools according to
+// the model's code_execution setting before the request reaches the backend.
+func applyCodeExecutionMode(unifiedReq *adapters.UnifiedChatRequest, modelConfig *config.Model) {
+	if modelConfig.CodeExecution == "" || modelConfig.CodeExecution == "native" {
+		return
+	}
+
+	tools := unifiedReq.Tools[:0]
+	for _, tool := range unifiedReq.Tools {
+		if tool.Type != "code_execution" {
+			tools = append(tools, tool)
+			continue
+		}
+		if modelConfig.CodeExecution == "function" {
+			tools = append(tools, adapters.CodeExecutionFunctionTool())
+		}
+	}
+	unifiedReq.Tools = tools
+}
+
+// defaultMaxToolRounds bounds the gateway tool loop when a model sets no limit.
+const defaultMaxToolRounds = 8
+
+// ToolExecutor runs tools on the broker side on behalf of the model.
+type ToolExecutor interface {
+	// Definitions resolves configured gateway tool names to tool definitions.
+	Definitions(ctx context.Context, names []string) ([]adapters.UnifiedTool, error)
+	// Handles reports whether a tool call should be executed by the broker,
+	// given the calling model's gateway tool names.
+	Handles(names []string, tool string) bool
+	// Call executes one of the model's gateway tools with JSON-encoded
+	// arguments.
+	Call(ctx context.Context, names []string, tool, arguments string) (string, error)
+}
+
+// runToolLoop executes gateway tool calls and re-sends the conversation until
+// the model answers without them. Responses that also call client-side tools
+// are returned as-is, since the broker cannot fulfil those calls itself.
+func runToolLoop(w http.ResponseWriter, r *http.Request, providerAdapter adapters.Adapter, unifiedReq *adapters.UnifiedChatRequest, unifiedResp *adapters.UnifiedChatResponse, providerURL string, modelConfig *config.Model, executor ToolExecutor) (*adapters.UnifiedChatResponse, bool) {
+	maxRounds := modelConfig.MaxToolRounds
+	if maxRounds <= 0 {
+		maxRounds = defaultMaxToolRounds
+	}
+
+	usage := unifiedResp.Usage
+	for round := 0; round < maxRounds && gatewayOnly(unifiedResp.ToolCalls, executor, modelConfig.GatewayTools); round++ {
+		unifiedReq.Messages = append(unifiedReq.Messages, adapters.UnifiedMessage{
+			Role:      "assistant",
+			Content:   unifiedResp.Content,
+			ToolCalls: unifiedResp.ToolCalls,
+		})
+		for _, call := range unifiedResp.ToolCalls {
+			result, err := executor.Call(r.Context(), modelConfig.GatewayTools, call.Function.Name, call.Function.Arguments)
+			if err != nil {
+				// The model sees the failure and can recover or explain it.
+				slog.Warn("gateway tool call failed", "tool", call.Function.Name, "error", err)
+				result = "Error: " + err.Error()
+			}
+			unifiedReq.Messages = append(unifiedReq.Messages, adapters.UnifiedMessage{
+				Role:       "tool",
+				ToolCallID: call.ID,
+				Name:       call.Function.Name,
+				Content:    result,
+			})
+		}
+
+		slog.Info("gateway tool round complete", "alias", modelConfig.Alias, "round", round+1, "calls", len(unifiedResp.ToolCalls))
+		// A forced tool choice is satisfied by now; the model must be free
+		// to answer with the results.
+		unifiedReq.ToolChoice = nil
+		var ok bool
+		if unifiedResp, ok = sendChat(w, r, providerAdapter, unifiedReq, providerURL, modelConfig); !ok {
+			return nil, false
+		}
+		usage.InputTokens += unifiedResp.Usage.InputTokens
+		usage.OutputTokens += unifiedResp.Usage.OutputTokens
+	}
+
+	if gatewayOnly(unifiedResp.ToolCalls, executor, modelConfig.GatewayTools) {
+		slog.Warn("gateway tool loop reached max_tool_rounds", "alias", modelConfig.Alias, "max_tool_rounds", maxRounds)
+	}
+
+	// Report what the whole loop cost, not just the final round.
+	unifiedResp.Usage = usage
+	return unifiedResp, true
+}
+
+// gatewayOnly reports whether there are tool calls and the broker can run
+// every one of them with the given gateway tool names.
+func gatewayOnly(calls []adapters.UnifiedToolCall, executor ToolExecutor, names []string) bool {
+	if len(calls) == 0 {
+		return false
+	}
+	for _, call := range calls {
+		if !executor.Handles(names, call.Function.Name) {
+			return false
+		}
+	}
+	return true
+}
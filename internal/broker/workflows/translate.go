@@ -3,51 +3,177 @@ package workflows
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
 
 	"lmbroker/internal/adapters"
 	"lmbroker/internal/config"
+	"lmbroker/internal/tokenizer"
 )
 
 // HandleTranslation is the workflow for when the client and provider
 // speak different API languages. It uses the adapter interfaces to
 // perform a four-step translation with model rewriting.
 func HandleTranslation(w http.ResponseWriter, r *http.Request, clientAdapter, providerAdapter adapters.Adapter, providerURL string, modelConfig *config.Model) {
+	HandleExtendedTranslation(w, r, clientAdapter, providerAdapter, providerURL, modelConfig, Extensions{})
+}
+
+// Extensions are optional broker services the translation workflow can use
+// for models that enable them.
+type Extensions struct {
+	// Tools executes the model's gateway tools, looping until the model
+	// produces an answer.
+	Tools ToolExecutor
+	// Summarizer backs the "summarize" prompt compression strategy.
+	Summarizer Summarizer
+	// Moderator backs guardrails that name a moderation alias.
+	Moderator Moderator
+	// Notifier is told about failed guardrail checks.
+	Notifier Notifier
+}
+
+// HandleExtendedTranslation is HandleTranslation with the broker-side
+// stages (guardrails, system prompt injection, prompt compression, gateway
+// tools) enabled by the model configuration.
+func HandleExtendedTranslation(w http.ResponseWriter, r *http.Request, clientAdapter, providerAdapter adapters.Adapter, providerURL string, modelConfig *config.Model, ext Extensions) {
 	// 1. Decode the client's request into our internal format.
 	unifiedReq, err := clientAdapter.ClientChatToUnified(r)
 	if err != nil {
 		slog.Error("failed to translate client request to unified format", "error", err)
-		http.Error(w, "failed to translate client request to unified format", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate client request to unified format")
+		return
+	}
+
+	// 1.1. Reject prompts that fail the model's guardrails.
+	if modelConfig.Guardrails != nil && !enforceInputGuardrails(w, r, unifiedReq, modelConfig, ext) {
 		return
 	}
 
 	// 1.5. Rewrite the model field in the unified request
 	unifiedReq.Model = modelConfig.Target.Model
+	applyMaxTokens(unifiedReq, modelConfig)
+	applyCodeExecutionMode(unifiedReq, modelConfig)
+	applySystemPrompt(unifiedReq, modelConfig)
+
+	// 1.6. Offer the broker-executed tools alongside the client's own.
+	executor := ext.Tools
+	if len(modelConfig.GatewayTools) == 0 {
+		executor = nil
+	}
+	if executor != nil {
+		gatewayTools, err := executor.Definitions(r.Context(), modelConfig.GatewayTools)
+		if err != nil {
+			slog.Error("failed to resolve gateway tools", "alias", modelConfig.Alias, "error", err)
+			WriteError(w, r, http.StatusBadGateway, "failed to resolve gateway tools")
+			return
+		}
+		unifiedReq.Tools = append(unifiedReq.Tools, gatewayTools...)
+	}
+
+	// 1.7. Shrink over-budget prompts before they reach the provider.
+	if modelConfig.Compression.MaxPromptTokens > 0 {
+		compressPrompt(r.Context(), unifiedReq, modelConfig, ext.Summarizer)
+	}
+
+	// 2-3. Send to the provider and decode its response, running gateway
+	// tool calls in between until the model stops asking for them.
+	// Several choices come from the provider in one response if it can
+	// generate them, or from parallel requests.
+	var unifiedResp *adapters.UnifiedChatResponse
+	var ok bool
+	if unifiedReq.N > 1 && (executor != nil || !supportsChoices(providerAdapter)) {
+		unifiedResp, ok = emulateChoices(w, r, providerAdapter, unifiedReq, providerURL, modelConfig, executor)
+	} else {
+		unifiedResp, ok = complete(w, r, providerAdapter, unifiedReq, providerURL, modelConfig, executor)
+	}
+	if !ok {
+		return
+	}
+
+	// 3.5. Block or annotate answers that fail the model's guardrails.
+	if modelConfig.Guardrails != nil && !enforceOutputGuardrails(w, r, unifiedResp, modelConfig, ext) {
+		return
+	}
 
+	// 4. Encode our internal response into the format for the original client.
+	unifiedResp.Stream = unifiedReq.ReplayStream
+	unifiedResp.IncludeUsage = unifiedReq.IncludeUsage
+	unifiedResp.LegacyFunctions = unifiedReq.LegacyFunctions
+	if err := clientAdapter.UnifiedChatToClient(unifiedResp, w); err != nil {
+		slog.Error("failed to translate unified response to client format", "error", err)
+		// The error is already written to the response writer in the adapter.
+		return
+	}
+}
+
+// complete sends a unified request and, with an executor, runs the gateway
+// tool loop on the response. On failure the error has already been written
+// to w and ok is false.
+func complete(w http.ResponseWriter, r *http.Request, providerAdapter adapters.Adapter, unifiedReq *adapters.UnifiedChatRequest, providerURL string, modelConfig *config.Model, executor ToolExecutor) (*adapters.UnifiedChatResponse, bool) {
+	unifiedResp, ok := sendChat(w, r, providerAdapter, unifiedReq, providerURL, modelConfig)
+	if !ok || executor == nil {
+		return unifiedResp, ok
+	}
+	return runToolLoop(w, r, providerAdapter, unifiedReq, unifiedResp, providerURL, modelConfig, executor)
+}
+
+// applyMaxTokens fills in the model's default output limit when the client
+// set none and keeps the limit within the model's cap.
+func applyMaxTokens(unifiedReq *adapters.UnifiedChatRequest, modelConfig *config.Model) {
+	if unifiedReq.MaxTokens <= 0 {
+		unifiedReq.MaxTokens = modelConfig.MaxTokens
+	}
+	if modelConfig.MaxTokensCap > 0 && (unifiedReq.MaxTokens <= 0 || unifiedReq.MaxTokens > modelConfig.MaxTokensCap) {
+		unifiedReq.MaxTokens = modelConfig.MaxTokensCap
+	}
+}
+
+// sendChat performs one provider round trip for a unified request. On
+// failure the error has already been written to w and ok is false.
+func sendChat(w http.ResponseWriter, r *http.Request, providerAdapter adapters.Adapter, unifiedReq *adapters.UnifiedChatRequest, providerURL string, modelConfig *config.Model) (*adapters.UnifiedChatResponse, bool) {
 	// 2. Encode our internal request into the format for the target provider.
 	providerReq, err := providerAdapter.UnifiedChatToBackend(unifiedReq, providerURL)
+	if paramErr := (*adapters.ParameterError)(nil); errors.As(err, &paramErr) {
+		WriteError(w, r, http.StatusBadRequest, paramErr.Error())
+		return nil, false
+	}
 	if err != nil {
 		slog.Error("failed to translate unified request to provider format", "error", err)
-		http.Error(w, "failed to translate unified request to provider format", http.StatusInternalServerError)
-		return
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate unified request to provider format")
+		return nil, false
 	}
+	if err := adaptProviderRequest(providerReq, modelConfig); err != nil {
+		slog.Error("failed to adapt request for provider", "error", err)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate unified request to provider format")
+		return nil, false
+	}
+	providerReq = providerReq.WithContext(r.Context())
+	forwardHeaders(providerReq.Header, r.Header, modelConfig.Target.Headers, false)
 
 	// 2.5. Add API key if configured
-	if modelConfig.Target.APIKey != "" {
-		providerReq.Header.Set("Authorization", "Bearer "+modelConfig.Target.APIKey)
+	if err := applyAuth(providerReq, modelConfig); err != nil {
+		slog.Error("failed to authenticate request to provider", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to authenticate request to provider")
+		return nil, false
 	}
 
 	// Make the request to the provider.
-	client := &http.Client{}
-	providerResp, err := client.Do(providerReq)
+	providerResp, err := doRequest(providerReq, modelConfig)
 	if err != nil {
 		slog.Error("failed to make request to provider", "error", err)
-		http.Error(w, "failed to make request to provider", http.StatusBadGateway)
-		return
+		WriteError(w, r, backendErrorStatus(err), "failed to make request to provider")
+		return nil, false
 	}
 	defer providerResp.Body.Close()
+	if err := bufferResponse(providerResp, modelConfig); err != nil {
+		slog.Error("failed to read provider response", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to read provider response: "+err.Error())
+		return nil, false
+	}
 
 	// 3. Check if backend returned an error and handle appropriately
 	if providerResp.StatusCode >= 400 {
@@ -55,48 +181,61 @@ func HandleTranslation(w http.ResponseWriter, r *http.Request, clientAdapter, pr
 		bodyBytes, err := io.ReadAll(providerResp.Body)
 		if err != nil {
 			slog.Error("failed to read error response body", "error", err)
-			http.Error(w, "failed to read error response", http.StatusInternalServerError)
-			return
+			WriteError(w, r, http.StatusInternalServerError, "failed to read error response")
+			return nil, false
 		}
 		// Restore the body for the adapter
 		providerResp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
 		
 		slog.Error("backend returned error", "status", providerResp.StatusCode)
 		
+		if retryAfter := providerResp.Header.Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+
 		// Translate error directly since we already have the bytes
 		var errorResp map[string]interface{}
 		if err := json.Unmarshal(bodyBytes, &errorResp); err != nil {
 			slog.Error("failed to parse backend error JSON", "error", err)
-			errorResp = map[string]interface{}{
-				"error": map[string]string{
-					"message": "An error occurred at the backend.",
-					"type":    "broker_error",
-				},
-			}
+			WriteError(w, r, providerResp.StatusCode, "An error occurred at the backend.")
+			return nil, false
 		}
-		
+
+		// Errors from a backend of the other dialect are rewritten for the
+		// client's SDK: Anthropic errors by the adapter, OpenAI-style ones
+		// from their message and status.
+		_, anthropicBackend := providerAdapter.(*adapters.AnthropicAdapter)
+		status := providerResp.StatusCode
 		errorBody, _ := json.Marshal(errorResp)
+		switch {
+		case anthropicBackend && !isAnthropicPath(r.URL.Path):
+			status = adapters.OpenAIErrorStatus(status)
+			errorBody = providerAdapter.TranslateError(providerResp)
+		case !anthropicBackend && isAnthropicPath(r.URL.Path):
+			message := "An error occurred at the backend."
+			if errorObject, ok := errorResp["error"].(map[string]interface{}); ok {
+				if text, ok := errorObject["message"].(string); ok && text != "" {
+					message = text
+				}
+			}
+			WriteError(w, r, status, message)
+			return nil, false
+		}
 		
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(providerResp.StatusCode)
+		w.WriteHeader(status)
 		w.Write(errorBody)
-		return
+		return nil, false
 	}
 
 	// 3. Decode the provider's response into our internal format.
 	unifiedResp, err := providerAdapter.BackendChatToUnified(providerResp)
 	if err != nil {
 		slog.Error("failed to translate provider response to unified format", "error", err)
-		http.Error(w, "failed to translate provider response to unified format", http.StatusInternalServerError)
-		return
-	}
-
-	// 4. Encode our internal response into the format for the original client.
-	if err := clientAdapter.UnifiedChatToClient(unifiedResp, w); err != nil {
-		slog.Error("failed to translate unified response to client format", "error", err)
-		// The error is already written to the response writer in the adapter.
-		return
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate provider response to unified format")
+		return nil, false
 	}
+	return unifiedResp, true
 }
 
 // HandleEmbeddingTranslation is the workflow for embedding translation
@@ -104,45 +243,137 @@ func HandleTranslation(w http.ResponseWriter, r *http.Request, clientAdapter, pr
 func HandleEmbeddingTranslation(w http.ResponseWriter, r *http.Request, clientAdapter, providerAdapter adapters.Adapter, providerURL string, modelConfig *config.Model) {
 	// 1. Decode the client's request into our internal format.
 	unifiedReq, err := clientAdapter.ClientEmbeddingToUnified(r)
+	if paramErr := (*adapters.ParameterError)(nil); errors.As(err, &paramErr) {
+		WriteError(w, r, http.StatusBadRequest, paramErr.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, "failed to translate client embedding request to unified format", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate client embedding request to unified format")
 		return
 	}
 
 	// 1.5. Rewrite the model field in the unified request
 	unifiedReq.Model = modelConfig.Target.Model
 
+	// 1.6. If the broker truncates locally, the backend must return full vectors.
+	dimensions := unifiedReq.Dimensions
+	if modelConfig.TruncateDimensions {
+		unifiedReq.Dimensions = 0
+	}
+
 	// 2. Encode our internal request into the format for the target provider.
 	providerReq, err := providerAdapter.UnifiedEmbeddingToBackend(unifiedReq, providerURL)
+	if paramErr := (*adapters.ParameterError)(nil); errors.As(err, &paramErr) {
+		WriteError(w, r, http.StatusBadRequest, paramErr.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, "failed to translate unified embedding request to provider format", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate unified embedding request to provider format")
 		return
 	}
+	providerReq = providerReq.WithContext(r.Context())
+	forwardHeaders(providerReq.Header, r.Header, modelConfig.Target.Headers, false)
 
 	// 2.5. Add API key if configured
-	if modelConfig.Target.APIKey != "" {
-		providerReq.Header.Set("Authorization", "Bearer "+modelConfig.Target.APIKey)
+	if err := applyAuth(providerReq, modelConfig); err != nil {
+		slog.Error("failed to authenticate embedding request to provider", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to authenticate embedding request to provider")
+		return
 	}
 
 	// Make the request to the provider.
-	client := &http.Client{}
-	providerResp, err := client.Do(providerReq)
+	providerResp, err := doRequest(providerReq, modelConfig)
 	if err != nil {
-		http.Error(w, "failed to make embedding request to provider", http.StatusBadGateway)
+		WriteError(w, r, backendErrorStatus(err), "failed to make embedding request to provider")
 		return
 	}
 	defer providerResp.Body.Close()
+	if err := bufferResponse(providerResp, modelConfig); err != nil {
+		slog.Error("failed to read provider embedding response", "alias", modelConfig.Alias, "error", err)
+		WriteError(w, r, http.StatusBadGateway, "failed to read provider embedding response: "+err.Error())
+		return
+	}
+
+	// 2.6. Surface backend errors instead of decoding them as embeddings.
+	if providerResp.StatusCode >= 400 {
+		slog.Error("backend returned embedding error", "status", providerResp.StatusCode)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(providerResp.StatusCode)
+		w.Write(providerAdapter.TranslateError(providerResp))
+		return
+	}
 
 	// 3. Decode the provider's response into our internal format.
 	unifiedResp, err := providerAdapter.BackendEmbeddingToUnified(providerResp)
 	if err != nil {
-		http.Error(w, "failed to translate provider embedding response to unified format", http.StatusInternalServerError)
+		WriteError(w, r, http.StatusInternalServerError, "failed to translate provider embedding response to unified format")
 		return
 	}
 
+	// 3.5. Render vectors in the encoding the client asked for, regardless
+	// of what the backend returned.
+	unifiedResp.EncodingFormat = unifiedReq.EncodingFormat
+	if unifiedResp.Model == "" {
+		unifiedResp.Model = unifiedReq.Model
+	}
+	// 3.6. Backends that report no usage, such as Gemini, get an estimate.
+	if unifiedResp.Usage.InputTokens == 0 {
+		unifiedResp.Usage.InputTokens = estimateEmbeddingTokens(unifiedReq)
+	}
+	if modelConfig.TruncateDimensions && dimensions > 0 {
+		for i, embedding := range unifiedResp.Embeddings {
+			// Vectors can only be shortened.
+			if len(embedding) < dimensions {
+				WriteError(w, r, http.StatusBadRequest, fmt.Sprintf("dimensions %d exceeds the %d dimensions of %s", dimensions, len(embedding), modelConfig.Alias))
+				return
+			}
+			unifiedResp.Embeddings[i] = truncateEmbedding(embedding, dimensions)
+		}
+	}
+
 	// 4. Encode our internal response into the format for the original client.
 	if err := clientAdapter.UnifiedEmbeddingToClient(unifiedResp, w); err != nil {
 		// The error is already written to the response writer in the adapter.
 		return
 	}
 }
+
+
+// estimateEmbeddingTokens counts the tokens of an embedding request's
+// inputs: exactly for token arrays, and approximately for text.
+func estimateEmbeddingTokens(unifiedReq *adapters.UnifiedEmbeddingRequest) int {
+	tokens := 0
+	for _, input := range unifiedReq.Tokens {
+		tokens += len(input)
+	}
+	for _, input := range unifiedReq.Input {
+		tokens += tokenizer.Approximate.Count(input)
+	}
+	for _, parts := range unifiedReq.Contents {
+		for _, part := range parts {
+			tokens += tokenizer.Approximate.Count(part.Text)
+		}
+	}
+	return tokens
+}
+
+// truncateEmbedding keeps the first dims components of a Matryoshka-style
+// embedding and re-normalizes it to unit length.
+func truncateEmbedding(embedding []float32, dims int) []float32 {
+	if dims >= len(embedding) {
+		return embedding
+	}
+	truncated := embedding[:dims]
+	var norm float64
+	for _, v := range truncated {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return truncated
+	}
+	scale := float32(1 / math.Sqrt(norm))
+	for i := range truncated {
+		truncated[i] *= scale
+	}
+	return truncated
+}
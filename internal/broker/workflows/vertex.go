@@ -0,0 +1,54 @@
+package workflows
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"lmbroker/internal/config"
+)
+
+// vertexAnthropicVersion replaces the anthropic-version header on Vertex AI,
+// where it is sent in the body instead.
+const vertexAnthropicVersion = "vertex-2023-10-16"
+
+func isVertex(providerType string) bool {
+	return strings.HasPrefix(providerType, "vertex_")
+}
+
+// adaptProviderRequest applies provider-specific changes to an outgoing
+// request body. For Anthropic on Vertex AI the model lives in the URL, the
+// API version moves into the body, and streaming uses :streamRawPredict.
+func adaptProviderRequest(req *http.Request, modelConfig *config.Model) error {
+	if modelConfig.Type != "vertex_anthropic" || req.Body == nil {
+		return nil
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	var reqData map[string]interface{}
+	if err := json.Unmarshal(body, &reqData); err != nil {
+		return err
+	}
+
+	delete(reqData, "model")
+	if _, ok := reqData["anthropic_version"]; !ok {
+		reqData["anthropic_version"] = vertexAnthropicVersion
+	}
+	if stream, _ := reqData["stream"].(bool); stream {
+		req.URL.Path = strings.Replace(req.URL.Path, ":rawPredict", ":streamRawPredict", 1)
+	}
+	req.Header.Del("anthropic-version")
+
+	if body, err = json.Marshal(reqData); err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+	return nil
+}
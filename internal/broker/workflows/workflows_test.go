@@ -1,10 +1,21 @@
 package workflows
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"lmbroker/internal/adapters"
 	"lmbroker/internal/config"
@@ -139,4 +150,856 @@ func TestHandlePassthrough(t *testing.T) {
 	if !strings.Contains(body, "POST") {
 		t.Errorf("Expected response to contain POST method, got: %s", body)
 	}
-}
\ No newline at end of file
+}
+func TestHandleEmbeddingTranslation_TruncateDimensions(t *testing.T) {
+	// Backend without Matryoshka support always returns full vectors
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "dimensions") {
+			t.Errorf("Expected dimensions to be handled locally, got request: %s", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"object": "list", "data": [{"index": 0, "embedding": [3, 4, 12]}], "model": "local-embed"}`))
+	}))
+	defer backendServer.Close()
+
+	reqBody := `{"model": "embed", "input": ["Hello"], "dimensions": 2}`
+	req, err := http.NewRequest("POST", "/v1/embeddings", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	adapter := &adapters.OpenAIAdapter{}
+	mockModel := &config.Model{
+		Alias:              "embed",
+		Type:               "openai",
+		Target:             config.TargetConfig{URL: backendServer.URL, Model: "local-embed"},
+		TruncateDimensions: true,
+	}
+
+	HandleEmbeddingTranslation(rr, req, adapter, adapter, backendServer.URL+"/embeddings", mockModel)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", rr.Code)
+	}
+
+	// [3, 4] re-normalized to unit length
+	if !strings.Contains(rr.Body.String(), `"embedding":[0.6,0.8]`) {
+		t.Errorf("Expected truncated, normalized embedding, got: %s", rr.Body.String())
+	}
+
+	// Vectors cannot be made longer than the model's
+	req, _ = http.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "embed", "input": ["Hello"], "dimensions": 8}`))
+	rr = httptest.NewRecorder()
+	HandleEmbeddingTranslation(rr, req, adapter, adapter, backendServer.URL+"/embeddings", mockModel)
+	if rr.Code != http.StatusBadRequest || !strings.Contains(rr.Body.String(), "dimensions 8 exceeds the 3 dimensions of embed") {
+		t.Errorf("Expected a 400 for too many dimensions, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandleEmbeddingTranslation_EstimatedUsage(t *testing.T) {
+	// Gemini's batch embedding API reports no token usage
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"embeddings": [{"values": [0.1]}, {"values": [0.2]}]}`))
+	}))
+	defer backendServer.Close()
+
+	req, _ := http.NewRequest("POST", "/v1/embeddings", strings.NewReader(`{"model": "embed", "input": ["Hello world!", "abcd"]}`))
+	rr := httptest.NewRecorder()
+	mockModel := &config.Model{Alias: "embed", Type: "gemini", Target: config.TargetConfig{URL: backendServer.URL + "/", Model: "text-embedding-004"}}
+	HandleEmbeddingTranslation(rr, req, &adapters.OpenAIAdapter{}, &adapters.GeminiAdapter{}, backendServer.URL+"/embed", mockModel)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	// 12 and 4 characters at four per token
+	if !strings.Contains(rr.Body.String(), `"usage":{"prompt_tokens":4,"total_tokens":4}`) {
+		t.Errorf("Expected estimated usage, got: %s", rr.Body.String())
+	}
+}
+
+func TestApplyCodeExecutionMode(t *testing.T) {
+	newRequest := func() *adapters.UnifiedChatRequest {
+		return &adapters.UnifiedChatRequest{
+			Tools: []adapters.UnifiedTool{
+				{Type: "code_execution"},
+				{Type: "function", Function: adapters.UnifiedFunction{Name: "get_weather"}},
+			},
+		}
+	}
+
+	native := newRequest()
+	applyCodeExecutionMode(native, &config.Model{})
+	if native.Tools[0].Type != "code_execution" {
+		t.Errorf("Expected native tool to be kept, got: %+v", native.Tools)
+	}
+
+	emulated := newRequest()
+	applyCodeExecutionMode(emulated, &config.Model{CodeExecution: "function"})
+	if len(emulated.Tools) != 2 || emulated.Tools[0].Type != "function" || emulated.Tools[0].Function.Name != "code_execution" {
+		t.Errorf("Expected code_execution function tool, got: %+v", emulated.Tools)
+	}
+
+	disabled := newRequest()
+	applyCodeExecutionMode(disabled, &config.Model{CodeExecution: "disabled"})
+	if len(disabled.Tools) != 1 || disabled.Tools[0].Function.Name != "get_weather" {
+		t.Errorf("Expected only get_weather to remain, got: %+v", disabled.Tools)
+	}
+}
+
+func TestApplyMaxTokens(t *testing.T) {
+	cases := []struct {
+		client, defaults, limit, expected int
+	}{
+		{client: 0, expected: 0},
+		{client: 500, expected: 500},
+		{client: 0, defaults: 1024, expected: 1024},
+		{client: 500, defaults: 1024, expected: 500},
+		{client: 9000, limit: 8192, expected: 8192},
+		{client: 0, defaults: 1024, limit: 8192, expected: 1024},
+		{client: 0, limit: 8192, expected: 8192},
+	}
+	for _, c := range cases {
+		req := &adapters.UnifiedChatRequest{MaxTokens: c.client}
+		applyMaxTokens(req, &config.Model{MaxTokens: c.defaults, MaxTokensCap: c.limit})
+		if req.MaxTokens != c.expected {
+			t.Errorf("Expected max_tokens %d for %+v, got: %d", c.expected, c, req.MaxTokens)
+		}
+	}
+}
+
+// fakeExecutor serves a single "get_time" tool for gateway tests.
+type fakeExecutor struct {
+	calls []string
+}
+
+func (f *fakeExecutor) Definitions(ctx context.Context, names []string) ([]adapters.UnifiedTool, error) {
+	return []adapters.UnifiedTool{{Type: "function", Function: adapters.UnifiedFunction{Name: "get_time"}}}, nil
+}
+
+func (f *fakeExecutor) Handles(names []string, name string) bool {
+	return name == "get_time"
+}
+
+func (f *fakeExecutor) Call(ctx context.Context, names []string, name, arguments string) (string, error) {
+	f.calls = append(f.calls, name)
+	return "12:00", nil
+}
+
+func TestHandleExtendedTranslation_GatewayTools(t *testing.T) {
+	rounds := 0
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rounds++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if rounds == 1 {
+			if !strings.Contains(string(body), `"get_time"`) {
+				t.Errorf("Expected gateway tool in first request, got: %s", body)
+			}
+			w.Write([]byte(`{"id": "chatcmpl-1", "model": "gpt-4", "choices": [{"index": 0, "message": {"role": "assistant", "content": null,
+				"tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_time", "arguments": "{}"}}]}, "finish_reason": "tool_calls"}],
+				"usage": {"prompt_tokens": 10, "completion_tokens": 5}}`))
+			return
+		}
+		if !strings.Contains(string(body), `"tool_call_id":"call_1"`) || !strings.Contains(string(body), "12:00") {
+			t.Errorf("Expected tool result in follow-up request, got: %s", body)
+		}
+		w.Write([]byte(`{"id": "chatcmpl-2", "model": "gpt-4", "choices": [{"index": 0, "message": {"role": "assistant", "content": "It is noon."}, "finish_reason": "stop"}],
+			"usage": {"prompt_tokens": 20, "completion_tokens": 4}}`))
+	}))
+	defer backendServer.Close()
+
+	reqBody := `{"model": "gpt-4", "messages": [{"role": "user", "content": "What time is it?"}]}`
+	req, err := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(reqBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	mockModel := &config.Model{
+		Alias:        "gpt-4",
+		Type:         "openai",
+		Target:       config.TargetConfig{URL: backendServer.URL, Model: "gpt-4"},
+		GatewayTools: []string{"get_time"},
+	}
+	executor := &fakeExecutor{}
+
+	HandleExtendedTranslation(rr, req, &adapters.OpenAIAdapter{}, &adapters.OpenAIAdapter{}, backendServer.URL+"/v1/chat/completions", mockModel, Extensions{Tools: executor})
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got: %d", rr.Code)
+	}
+	if rounds != 2 || len(executor.calls) != 1 {
+		t.Errorf("Expected 2 backend rounds and 1 tool call, got: %d rounds, %v", rounds, executor.calls)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "It is noon.") || strings.Contains(body, "get_time") {
+		t.Errorf("Expected only the final answer, got: %s", body)
+	}
+	if !strings.Contains(body, `"prompt_tokens":30`) {
+		t.Errorf("Expected usage summed across rounds, got: %s", body)
+	}
+}
+
+type fakeSummarizer struct {
+	transcript string
+}
+
+func (f *fakeSummarizer) Summarize(ctx context.Context, alias, transcript string) (string, error) {
+	f.transcript = transcript
+	return "user asked about logs", nil
+}
+
+func TestApplySystemPrompt(t *testing.T) {
+	wrap := &config.Model{SystemPrompt: config.SystemPromptConfig{Prefix: "Follow ACME policy.", Suffix: "Answer in English."}}
+
+	// Leading system messages are folded into the wrapped prompt
+	req := &adapters.UnifiedChatRequest{Messages: []adapters.UnifiedMessage{
+		{Role: "system", Content: "You are helpful."},
+		{Role: "user", Content: "Hi"},
+	}}
+	applySystemPrompt(req, wrap)
+	if req.System != "Follow ACME policy.\n\nYou are helpful.\n\nAnswer in English." || len(req.Messages) != 1 || req.Messages[0].Role != "user" {
+		t.Errorf("Expected the system message to be wrapped, got: %q %v", req.System, req.Messages)
+	}
+
+	// Without a client system prompt, only the configured parts remain
+	req = &adapters.UnifiedChatRequest{Messages: []adapters.UnifiedMessage{{Role: "user", Content: "Hi"}}}
+	applySystemPrompt(req, wrap)
+	if req.System != "Follow ACME policy.\n\nAnswer in English." {
+		t.Errorf("Expected prefix and suffix only, got: %q", req.System)
+	}
+
+	// A template places the client's prompt where it says
+	req = &adapters.UnifiedChatRequest{System: "Be brief."}
+	applySystemPrompt(req, &config.Model{SystemPrompt: config.SystemPromptConfig{Template: "<policy>ACME</policy>\n<user_instructions>{{system}}</user_instructions>"}})
+	if req.System != "<policy>ACME</policy>\n<user_instructions>Be brief.</user_instructions>" {
+		t.Errorf("Expected the template to be filled in, got: %q", req.System)
+	}
+}
+
+func TestCompressPrompt(t *testing.T) {
+	longOutput := strings.Repeat("log line\n", 200)
+	newRequest := func() *adapters.UnifiedChatRequest {
+		return &adapters.UnifiedChatRequest{
+			Messages: []adapters.UnifiedMessage{
+				{Role: "system", Content: "You are helpful."},
+				{Role: "user", Content: "## Logs\n\n\n\nPlease   **check**:\n```\n  indented   code\n```"},
+				{Role: "assistant", ToolCalls: []adapters.UnifiedToolCall{{ID: "c1", Function: adapters.UnifiedFunctionCall{Name: "read_logs", Arguments: "{}"}}}},
+				{Role: "tool", ToolCallID: "c1", Content: longOutput},
+				{Role: "assistant", ToolCalls: []adapters.UnifiedToolCall{{ID: "c2", Function: adapters.UnifiedFunctionCall{Name: "read_logs", Arguments: "{}"}}}},
+				{Role: "tool", ToolCallID: "c2", Content: longOutput},
+				{Role: "assistant", Content: "Both logs look fine."},
+				{Role: "user", Content: "Thanks"},
+			},
+		}
+	}
+
+	// Under budget: untouched
+	unchanged := newRequest()
+	compressPrompt(context.Background(), unchanged, &config.Model{Compression: config.CompressionConfig{MaxPromptTokens: 100000}}, nil)
+	if unchanged.Messages[3].Content != longOutput {
+		t.Error("Expected prompt under budget to be left alone")
+	}
+
+	defaults := newRequest()
+	compressPrompt(context.Background(), defaults, &config.Model{Compression: config.CompressionConfig{MaxPromptTokens: 500}}, nil)
+	if got := defaults.Messages[1].Content; got != "Logs\n\nPlease check:\n```\n  indented   code\n```" {
+		t.Errorf("Expected whitespace and markdown stripped outside code, got: %q", got)
+	}
+	if defaults.Messages[3].Content != omittedToolOutput {
+		t.Errorf("Expected oldest tool output dropped, got: %.40q", defaults.Messages[3].Content)
+	}
+	if defaults.Messages[5].Content == omittedToolOutput {
+		t.Error("Expected most recent tool output to be kept")
+	}
+
+	// Identifiers, expressions, inline code and tool results keep their text
+	code := &adapters.UnifiedChatRequest{Messages: []adapters.UnifiedMessage{
+		{Role: "user", Content: "Why   does __init__ return 2**3 in `a  **b**  c`?"},
+		{Role: "tool", ToolCallID: "c1", Content: "  **raw**   output"},
+	}}
+	stripWhitespace(code)
+	if got := code.Messages[0].Content; got != "Why does __init__ return 2**3 in `a  **b**  c`?" {
+		t.Errorf("Expected code to survive whitespace stripping, got: %q", got)
+	}
+	if got := code.Messages[1].Content; got != "  **raw**   output" {
+		t.Errorf("Expected tool output to be left alone, got: %q", got)
+	}
+
+	summarizer := &fakeSummarizer{}
+	summarized := newRequest()
+	compressPrompt(context.Background(), summarized, &config.Model{Compression: config.CompressionConfig{
+		MaxPromptTokens: 100,
+		Strategies:      []string{"summarize"},
+		SummarizerAlias: "cheap",
+	}}, summarizer)
+	// The kept tail starts at the last tool call so it stays paired with its result
+	if len(summarized.Messages) != 6 {
+		t.Fatalf("Expected system, summary, and last four turns, got: %d messages", len(summarized.Messages))
+	}
+	if summarized.Messages[0].Role != "system" || !strings.Contains(summarized.Messages[1].Content, "user asked about logs") || summarized.Messages[2].ToolCalls[0].ID != "c2" {
+		t.Errorf("Expected summary to replace older turns, got: %+v", summarized.Messages)
+	}
+	if !strings.Contains(summarizer.transcript, "tool call read_logs") {
+		t.Errorf("Expected transcript to include tool calls, got: %.80q", summarizer.transcript)
+	}
+}
+
+func TestApplyAuth_SigningFailure(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{}`))
+	req.GetBody = func() (io.ReadCloser, error) { return nil, errors.New("body is gone") }
+	model := &config.Model{Target: config.TargetConfig{Signing: &config.SigningConfig{Secret: "s3cret", Header: "X-LMBroker-Signature", TimestampHeader: "X-LMBroker-Timestamp"}}}
+
+	if err := applyAuth(req, model); err == nil || req.Header.Get("X-LMBroker-Signature") != "" {
+		t.Errorf("Expected signing to fail the request, got: %v", err)
+	}
+}
+
+func TestHandlePassthrough_MissingVertexToken(t *testing.T) {
+	called := false
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer backendServer.Close()
+
+	req := httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "claude", "messages": []}`))
+	rr := httptest.NewRecorder()
+	mockModel := &config.Model{
+		Alias:  "claude",
+		Type:   "vertex_anthropic",
+		Target: config.TargetConfig{URL: backendServer.URL, Model: "claude-sonnet-4", Project: "p", CredentialsFile: filepath.Join(t.TempDir(), "missing.json")},
+	}
+	HandlePassthrough(rr, req, backendServer.URL+"/v1/messages", mockModel)
+
+	if rr.Code != http.StatusBadGateway || called {
+		t.Errorf("Expected 502 without reaching the backend, got: %d (backend called: %v)", rr.Code, called)
+	}
+}
+
+func TestHandlePassthrough_SignsRequests(t *testing.T) {
+	signing := &config.SigningConfig{Secret: "s3cret", Header: "X-LMBroker-Signature", TimestampHeader: "X-LMBroker-Timestamp"}
+
+	var verified bool
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-LMBroker-Timestamp")
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(timestamp + "." + string(body)))
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		verified = timestamp != "" && hmac.Equal([]byte(r.Header.Get("X-LMBroker-Signature")), []byte(expected))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backendServer.Close()
+
+	req, err := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "local", "messages": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client-supplied signature must never reach the backend
+	req.Header.Set("X-LMBroker-Signature", "sha256=forged")
+	rr := httptest.NewRecorder()
+
+	mockModel := &config.Model{
+		Alias:  "local",
+		Type:   "openai",
+		Target: config.TargetConfig{URL: backendServer.URL, Model: "llama-3", Signing: signing},
+	}
+	HandlePassthrough(rr, req, backendServer.URL+"/v1/chat/completions", mockModel)
+
+	if !verified {
+		t.Error("Expected backend to verify the HMAC signature over the rewritten body")
+	}
+}
+
+// flushRecorder reports what had been written at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes chan string
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes <- f.Body.String()
+	f.ResponseRecorder.Flush()
+}
+
+func TestHandlePassthrough_StreamsEvents(t *testing.T) {
+	release := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "data: {\"delta\": \"Hel\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: {\"delta\": \"lo\"}\n\ndata: [DONE]\n\n")
+	}))
+	defer backendServer.Close()
+
+	req, err := http.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "stream": true, "messages": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan string, 8)}
+	mockModel := &config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: backendServer.URL, Model: "gpt-4"}}
+
+	done := make(chan struct{})
+	go func() {
+		HandlePassthrough(rr, req, backendServer.URL+"/v1/chat/completions", mockModel)
+		close(done)
+	}()
+
+	// The first event must be flushed while the backend is still streaming
+	select {
+	case first := <-rr.flushes:
+		if !strings.Contains(first, "Hel") || strings.Contains(first, "[DONE]") {
+			t.Errorf("Expected only the first event in the first flush, got: %q", first)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected first event to be flushed before the stream finished")
+	}
+
+	close(release)
+	<-done
+	if !strings.HasSuffix(rr.Body.String(), "data: [DONE]\n\n") {
+		t.Errorf("Expected full stream, got: %q", rr.Body.String())
+	}
+}
+
+func TestHandlePassthrough_ClientDisconnectCancelsBackend(t *testing.T) {
+	backendCancelled := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "data: {}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(backendCancelled)
+	}))
+	defer backendServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "stream": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mockModel := &config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: backendServer.URL, Model: "gpt-4"}}
+
+	done := make(chan struct{})
+	go func() {
+		HandlePassthrough(httptest.NewRecorder(), req, backendServer.URL+"/v1/chat/completions", mockModel)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-backendCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected backend request to be cancelled after client disconnect")
+	}
+	<-done
+}
+
+func TestHandleImageTranslation(t *testing.T) {
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), `"model":"dall-e-3"`) {
+			t.Errorf("Expected model rewritten to dall-e-3, got: %s", body)
+		}
+		if r.Header.Get("Authorization") != "Bearer image-key" {
+			t.Errorf("Expected API key on backend request, got: %q", r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"created": 2, "data": [{"url": "https://images.example/2.png"}]}`))
+	}))
+	defer mockBackend.Close()
+
+	modelConfig := &config.Model{
+		Alias:  "images",
+		Type:   "openai",
+		Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "dall-e-3", APIKey: "image-key"},
+	}
+	adapter := &adapters.OpenAIAdapter{}
+
+	req := httptest.NewRequest("POST", "/v1/images/generations", strings.NewReader(`{"model": "images", "prompt": "a lighthouse"}`))
+	rr := httptest.NewRecorder()
+	HandleImageTranslation(rr, req, adapter, adapter, mockBackend.URL+"/images/generations", modelConfig)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "images.example/2.png") {
+		t.Errorf("Expected translated image response, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandlePassthrough_RetriesTransientErrors(t *testing.T) {
+	var waits []time.Duration
+	originalSleep := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	defer func() { sleep = originalSleep }()
+
+	attempts := 0
+	mockBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := io.ReadAll(r.Body)
+		if !strings.Contains(string(body), "Hello") {
+			t.Errorf("Expected the full body on attempt %d, got: %s", attempts, body)
+		}
+		switch attempts {
+		case 1:
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"id": "ok"}`))
+		}
+	}))
+	defer mockBackend.Close()
+
+	modelConfig := &config.Model{
+		Alias: "gpt-4",
+		Type:  "openai",
+		Target: config.TargetConfig{
+			URL:   mockBackend.URL + "/",
+			Model: "gpt-4",
+			Retry: &config.RetryConfig{
+				MaxAttempts:            3,
+				RetryOn:                []int{429, 503},
+				InitialBackoffDuration: 100 * time.Millisecond,
+				MaxBackoffDuration:     5 * time.Second,
+			},
+		},
+	}
+
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr := httptest.NewRecorder()
+	HandlePassthrough(rr, req, mockBackend.URL+"/chat/completions", modelConfig)
+
+	if attempts != 3 || rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"ok"`) {
+		t.Fatalf("Expected success on the third attempt, got %d attempts, status %d: %s", attempts, rr.Code, rr.Body.String())
+	}
+	if len(waits) != 2 || waits[0] != 2*time.Second {
+		t.Errorf("Expected Retry-After to set the first wait, got: %v", waits)
+	}
+	if waits[1] < 200*time.Millisecond || waits[1] > 240*time.Millisecond {
+		t.Errorf("Expected the second wait to be the doubled backoff plus jitter, got: %v", waits[1])
+	}
+
+	// A Retry-After beyond the policy's max backoff is returned to the client
+	attempts = 0
+	mockBackend.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	req = httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+	rr = httptest.NewRecorder()
+	HandlePassthrough(rr, req, mockBackend.URL+"/chat/completions", modelConfig)
+	if attempts != 1 || rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected no retry past max_backoff, got %d attempts and status %d", attempts, rr.Code)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	if d, ok := ParseRetryAfter("7", now); !ok || d != 7*time.Second {
+		t.Errorf("Expected 7s, got: %v %v", d, ok)
+	}
+	if d, ok := ParseRetryAfter("Wed, 01 Jan 2025 12:00:30 GMT", now); !ok || d != 30*time.Second {
+		t.Errorf("Expected 30s from an HTTP date, got: %v %v", d, ok)
+	}
+	if _, ok := ParseRetryAfter("soon", now); ok {
+		t.Error("Expected an invalid value to be ignored")
+	}
+}
+
+func TestHandlePassthrough_Timeouts(t *testing.T) {
+	send := func(timeouts config.TimeoutConfig, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		mockBackend := httptest.NewServer(handler)
+		defer mockBackend.Close()
+		modelConfig := &config.Model{Alias: "gpt-4", Type: "openai", Target: config.TargetConfig{URL: mockBackend.URL + "/", Model: "gpt-4", Timeouts: timeouts}}
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4", "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		HandlePassthrough(rr, req, mockBackend.URL+"/chat/completions", modelConfig)
+		return rr
+	}
+	hang := func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) // Lets the server notice the broker hanging up
+		<-r.Context().Done()
+	}
+
+	// A backend that never answers is cut off with 504
+	if rr := send(config.TimeoutConfig{ResponseHeaderDuration: 50 * time.Millisecond}, hang); rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 after the response header timeout, got: %d", rr.Code)
+	}
+	if rr := send(config.TimeoutConfig{TotalDuration: 50 * time.Millisecond}, hang); rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected 504 after the total timeout, got: %d", rr.Code)
+	}
+
+	// A stream is not bound by the total timeout while it keeps sending
+	rr := send(config.TimeoutConfig{TotalDuration: 50 * time.Millisecond, StreamIdleDuration: time.Second}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("data: {}\n\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+	if !strings.Contains(rr.Body.String(), "[DONE]") {
+		t.Errorf("Expected the whole stream despite the total timeout, got: %q", rr.Body.String())
+	}
+
+	// But it is cut off once it stalls
+	rr = send(config.TimeoutConfig{StreamIdleDuration: 50 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {}\n\n"))
+		w.(http.Flusher).Flush()
+		hang(w, r)
+	})
+	if rr.Body.String() != "data: {}\n\n" {
+		t.Errorf("Expected the events sent before the stall, got: %q", rr.Body.String())
+	}
+}
+
+func TestHandleTranslation_EmulatedChoices(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), `"n"`) {
+			t.Errorf("Expected no n in Anthropic requests, got: %s", body)
+		}
+		mu.Lock()
+		calls++
+		text := strconv.Itoa(calls)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4", "content": [{"type": "text", "text": "` + text + `"}], "stop_reason": "end_turn", "usage": {"input_tokens": 10, "output_tokens": 2}}`))
+	}))
+	defer backend.Close()
+
+	send := func(modelConfig *config.Model) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude", "n": 3, "messages": [{"role": "user", "content": "Pick a number"}]}`))
+		rr := httptest.NewRecorder()
+		HandleTranslation(rr, req, &adapters.OpenAIAdapter{}, &adapters.AnthropicAdapter{}, backend.URL+"/v1/messages", modelConfig)
+		return rr
+	}
+	modelConfig := &config.Model{Alias: "claude", Type: "anthropic", Target: config.TargetConfig{URL: backend.URL, Model: "claude-sonnet-4"}}
+
+	// Without emulate_n the request is refused
+	if rr := send(modelConfig); rr.Code != http.StatusBadRequest || calls != 0 {
+		t.Errorf("Expected 400 without calling the backend, got: %d after %d calls", rr.Code, calls)
+	}
+
+	// With it, each choice comes from its own backend request
+	modelConfig.EmulateN = true
+	rr := send(modelConfig)
+	var resp struct {
+		Choices []struct {
+			Index   int `json:"index"`
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusOK || calls != 3 || len(resp.Choices) != 3 {
+		t.Fatalf("Expected 3 choices from 3 calls, got: %d after %d calls: %s", rr.Code, calls, rr.Body.String())
+	}
+	seen := map[string]bool{}
+	for i, choice := range resp.Choices {
+		if choice.Index != i {
+			t.Errorf("Expected choice %d to have index %d, got: %d", i, i, choice.Index)
+		}
+		seen[choice.Message.Content] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("Expected distinct choices, got: %+v", resp.Choices)
+	}
+	if resp.Usage.PromptTokens != 30 || resp.Usage.CompletionTokens != 6 {
+		t.Errorf("Expected usage summed over the calls, got: %+v", resp.Usage)
+	}
+}
+
+func TestHandleTranslation_StreamIncludeUsage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn", "usage": {"input_tokens": 12, "output_tokens": 3}}`))
+	}))
+	defer backend.Close()
+	modelConfig := &config.Model{Alias: "claude", Type: "anthropic", Target: config.TargetConfig{URL: backend.URL, Model: "claude-sonnet-4"}}
+
+	stream := func(options string) []string {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude", "stream": true`+options+`, "messages": [{"role": "user", "content": "Hello"}]}`))
+		rr := httptest.NewRecorder()
+		HandleTranslation(rr, req, &adapters.OpenAIAdapter{}, &adapters.AnthropicAdapter{}, backend.URL+"/v1/messages", modelConfig)
+		if rr.Header().Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("Expected an event stream, got: %d %s", rr.Code, rr.Body.String())
+		}
+		var events []string
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				events = append(events, data)
+			}
+		}
+		return events
+	}
+
+	// The usage chunk follows the finish reason, just before [DONE]
+	events := stream(`, "stream_options": {"include_usage": true}`)
+	if len(events) < 3 || events[len(events)-1] != "[DONE]" {
+		t.Fatalf("Expected chunks ending in [DONE], got: %v", events)
+	}
+	var last struct {
+		Choices []interface{} `json:"choices"`
+		Usage   struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+			TotalTokens      int `json:"total_tokens"`
+		} `json:"usage"`
+	}
+	json.Unmarshal([]byte(events[len(events)-2]), &last)
+	if len(last.Choices) != 0 || last.Usage.PromptTokens != 12 || last.Usage.CompletionTokens != 3 || last.Usage.TotalTokens != 15 {
+		t.Errorf("Expected a usage chunk from the Anthropic usage, got: %s", events[len(events)-2])
+	}
+	if !strings.Contains(events[0], `"usage":null`) {
+		t.Errorf("Expected null usage on content chunks, got: %s", events[0])
+	}
+
+	// Without the option, no chunk carries usage
+	for _, event := range stream("") {
+		if strings.Contains(event, "usage") {
+			t.Errorf("Expected no usage without include_usage, got: %s", event)
+		}
+	}
+}
+
+func TestHandleTranslation_BackendErrors(t *testing.T) {
+	anthropicBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(529)
+		w.Write([]byte(`{"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}`))
+	}))
+	defer anthropicBackend.Close()
+	openaiBackend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"message": "Rate limit reached", "type": "requests", "code": "rate_limit_exceeded"}}`))
+	}))
+	defer openaiBackend.Close()
+
+	// Anthropic errors reach OpenAI clients as OpenAI errors, 529 as 503
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude", "messages": [{"role": "user", "content": "Hi"}]}`))
+	rr := httptest.NewRecorder()
+	HandleTranslation(rr, req, &adapters.OpenAIAdapter{}, &adapters.AnthropicAdapter{}, anthropicBackend.URL+"/v1/messages", &config.Model{Alias: "claude", Type: "anthropic", Target: config.TargetConfig{URL: anthropicBackend.URL}})
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503, got: %d", rr.Code)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, `"type":"server_error"`) || !strings.Contains(body, `"message":"Overloaded"`) {
+		t.Errorf("Expected an OpenAI server_error, got: %s", body)
+	}
+
+	// OpenAI errors reach Anthropic clients as Anthropic errors
+	req = httptest.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model": "gpt-4o", "max_tokens": 10, "messages": [{"role": "user", "content": "Hi"}]}`))
+	rr = httptest.NewRecorder()
+	HandleTranslation(rr, req, &adapters.AnthropicAdapter{}, &adapters.OpenAIAdapter{}, openaiBackend.URL+"/v1/chat/completions", &config.Model{Alias: "gpt-4o", Type: "openai", Target: config.TargetConfig{URL: openaiBackend.URL}})
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got: %d", rr.Code)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, `"type":"rate_limit_error"`) || !strings.Contains(body, `"message":"Rate limit reached"`) {
+		t.Errorf("Expected an Anthropic rate_limit_error, got: %s", body)
+	}
+}
+
+func TestHandleTranslation_MaxResponseBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4", "content": [{"type": "text", "text": "` + strings.Repeat("a", 512) + `"}], "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 128}}`))
+	}))
+	defer backend.Close()
+
+	send := func(limit int64) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "claude", "messages": [{"role": "user", "content": "Hi"}]}`))
+		rr := httptest.NewRecorder()
+		HandleTranslation(rr, req, &adapters.OpenAIAdapter{}, &adapters.AnthropicAdapter{}, backend.URL+"/v1/messages", &config.Model{Alias: "claude", Type: "anthropic", Target: config.TargetConfig{URL: backend.URL, MaxResponseBytes: limit}})
+		return rr
+	}
+	if rr := send(256); rr.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 for a response over the limit, got: %d", rr.Code)
+	}
+	if rr := send(4096); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), strings.Repeat("a", 512)) {
+		t.Errorf("Expected the response within the limit, got: %d %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestReadEnvelope(t *testing.T) {
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(`{"model": "gpt-4o", "stream": true, "messages": []}`))
+	envelope, err := ReadEnvelope(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if envelope.Model != "gpt-4o" || !envelope.Stream || envelope.Err != nil {
+		t.Errorf("Expected the model and stream flag, got: %+v", envelope)
+	}
+
+	// Later stages get the same envelope and can still read the body whole
+	io.ReadAll(req.Body)
+	again, _ := ReadEnvelope(req)
+	if again != envelope {
+		t.Errorf("Expected the body to be read only once")
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != string(envelope.Raw) {
+		t.Errorf("Expected the body to be rewound, got: %q", body)
+	}
+
+	// Replacing the body starts a new envelope
+	SetBody(req, []byte(`{"model": "claude"}`))
+	if envelope, _ = ReadEnvelope(req); envelope.Model != "claude" || envelope.Stream || req.ContentLength != int64(len(envelope.Raw)) {
+		t.Errorf("Expected the replaced body, got: %+v", envelope)
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-sonnet-4", "content": [{"type": "text", "text": "Hi"}], "stop_reason": "end_turn", "usage": {"input_tokens": 1, "output_tokens": 1}}`))
+	}))
+	defer backend.Close()
+	newRequest := func(path string) *http.Request {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"model": "claude", "max_tokens": 10, "messages": [{"role": "user", "content": "Hi"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("Anthropic-Beta", "prompt-caching-2024-07-31")
+		req.Header.Set("X-Client-Trace", "abc")
+		return req
+	}
+
+	// Passthrough forwards every header but cookies and those dropped
+	modelConfig := &config.Model{Alias: "claude", Type: "anthropic", Target: config.TargetConfig{URL: backend.URL, Model: "claude", Headers: config.HeaderPolicy{Drop: []string{"x-client-*"}}}}
+	HandlePassthrough(httptest.NewRecorder(), newRequest("/v1/messages"), backend.URL+"/v1/messages", modelConfig)
+	if got.Get("Anthropic-Beta") == "" || got.Get("Cookie") != "" || got.Get("X-Client-Trace") != "" {
+		t.Errorf("Expected anthropic-beta without the cookie or dropped header, got: %v", got)
+	}
+
+	// Translation forwards only the allowlisted headers
+	HandleTranslation(httptest.NewRecorder(), newRequest("/v1/chat/completions"), &adapters.OpenAIAdapter{}, &adapters.AnthropicAdapter{}, backend.URL+"/v1/messages", modelConfig)
+	if got.Get("Anthropic-Beta") != "" || got.Get("X-Client-Trace") != "" {
+		t.Errorf("Expected no client headers without a forward list, got: %v", got)
+	}
+	modelConfig.Target.Headers.Forward = []string{"anthropic-*", "content-type"}
+	HandleTranslation(httptest.NewRecorder(), newRequest("/v1/chat/completions"), &adapters.OpenAIAdapter{}, &adapters.AnthropicAdapter{}, backend.URL+"/v1/messages", modelConfig)
+	if got.Get("Anthropic-Beta") != "prompt-caching-2024-07-31" || got.Get("Cookie") != "" || len(got.Values("Content-Type")) != 1 {
+		t.Errorf("Expected the forwarded anthropic-beta header only, got: %v", got)
+	}
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"lmbroker/internal/adapters/mock"
+)
+
+// NewClient builds the HTTP client for a target from its pool and timeout
+// settings. Each target gets its own connection pool, so keep-alive
+// connections are reused across requests to it. Mock targets are answered
+// in process.
+func NewClient(target *TargetConfig) *http.Client {
+	if target.Mock != nil {
+		return &http.Client{Transport: &mock.Transport{
+			Response:   target.Mock.Response,
+			Latency:    target.Mock.LatencyDuration,
+			ChunkDelay: target.Mock.ChunkDelayDuration,
+		}}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: target.Timeouts.ConnectDuration, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	if socket := target.Socket; socket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	transport.TLSHandshakeTimeout = target.Timeouts.ConnectDuration
+	transport.ResponseHeaderTimeout = target.Timeouts.ResponseHeaderDuration
+	transport.MaxIdleConns = target.Pool.MaxIdleConns
+	transport.MaxIdleConnsPerHost = target.Pool.MaxIdleConns
+	transport.IdleConnTimeout = target.Pool.IdleConnTimeoutDuration
+	if target.Pool.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return &http.Client{Transport: transport}
+}
@@ -2,10 +2,22 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+
+	"lmbroker/internal/expr"
+	"lmbroker/internal/tokenizer"
 )
 
 // Config holds the entire application configuration.
@@ -16,14 +28,78 @@ import (
 type Config struct {
 	LogLevel   string             `toml:"log_level"`
 	Server     ServerConfig       `toml:"server"`
+	Eval       EvalConfig         `toml:"eval"`
+	Gateway    GatewayConfig      `toml:"gateway"`
+	HealthCheck HealthCheckConfig `toml:"health_check"`
+	Tracing    TracingConfig      `toml:"tracing"`
+	Usage      UsageConfig        `toml:"usage"`
+	ContentLog ContentLogConfig   `toml:"content_log"`
+	RequestLog RequestLogConfig   `toml:"request_log"`
+	Batches    BatchConfig        `toml:"batches"`
+	Async      AsyncConfig        `toml:"async"`
+	// Webhooks receive JSON notifications of request lifecycle events.
+	Webhooks   []WebhookConfig    `toml:"webhooks"`
+	// Tokenizers load tiktoken BPE files for exact local token counts.
+	Tokenizers []TokenizerConfig  `toml:"tokenizers"`
+	Concurrency ConcurrencyConfig `toml:"concurrency"`
+	// DefaultModel names the model alias that serves requests for aliases
+	// the broker does not know, instead of rejecting them with 404.
+	DefaultModel string           `toml:"default_model"`
+	// Include is a glob, relative to this file, of further files whose
+	// [[models]] are merged in, e.g. "models.d/*.toml".
+	Include    string             `toml:"include"`
+	// Keys are the client API keys the broker accepts. When any are set,
+	// every API request must present one.
+	Keys       []KeyConfig        `toml:"keys"`
+	// Routes send requests matching their conditions to another model
+	// alias. The first matching rule applies.
+	Routes     []RouteRule        `toml:"routes"`
 	Models     map[string]Model   `toml:"-"` // Populated after parsing
 	RawModels  []Model            `toml:"models"` // Used for initial parsing
+	// Definitions are the models as written, before defaults are applied
+	// and secrets resolved, so the admin API can keep secret references.
+	Definitions map[string]Model `toml:"-"`
 }
 
 // ServerConfig holds server-specific configuration settings.
 type ServerConfig struct {
 	Host string `toml:"host"`
 	Port int    `toml:"port"`
+	// Socket is a Unix domain socket path to listen on instead of host and
+	// port.
+	Socket string `toml:"socket"`
+	// TrustedProxies lists IPs or CIDR ranges whose X-Forwarded-For and
+	// X-Real-IP headers are honored when resolving the client address.
+	TrustedProxies  []string       `toml:"trusted_proxies"`
+	TrustedPrefixes []netip.Prefix `toml:"-"` // Populated after parsing
+	// StrictValidation rejects malformed requests with field-level errors
+	// before they are forwarded to a provider.
+	StrictValidation bool `toml:"strict_validation"`
+	// WatchConfig reloads models whenever the config file changes, in
+	// addition to on SIGHUP.
+	WatchConfig bool `toml:"watch_config"`
+	// SecretRefresh reloads the configuration at this interval so that
+	// rotated file:, vault: and awssm: secrets are picked up (default off).
+	SecretRefresh         string        `toml:"secret_refresh"`
+	SecretRefreshDuration time.Duration `toml:"-"` // Populated after parsing
+	// AdminKey is the bearer token for the /admin endpoints, which are
+	// disabled without one; "env:NAME" reads it from the environment.
+	AdminKey string `toml:"admin_key"`
+	// ModelsFile, relative to this file, stores the models added, changed
+	// or removed through /admin/models, which then survive restarts. Its
+	// models take the place of those configured here.
+	ModelsFile string `toml:"models_file"`
+	// ShutdownTimeout is how long in-flight requests, including streams,
+	// may take to finish after SIGTERM or SIGINT (default 30s).
+	ShutdownTimeout         string        `toml:"shutdown_timeout"`
+	ShutdownTimeoutDuration time.Duration `toml:"-"` // Populated after parsing
+	// MaxRequestBytes caps the size of API request bodies; larger requests
+	// are answered 413. Zero means unlimited.
+	MaxRequestBytes int64 `toml:"max_request_bytes"`
+	// EmbeddingPaths serves embeddings on more paths, each mapped to the
+	// API format its clients use ("openai", "cohere" or "ollama"). They are
+	// registered at startup.
+	EmbeddingPaths map[string]string `toml:"embedding_paths"`
 }
 
 // Model represents a model alias mapping to a target provider.
@@ -31,13 +107,732 @@ type Model struct {
 	Alias  string       `toml:"alias"`
 	Target TargetConfig `toml:"target"`
 	Type   string       `toml:"type"`
+	// TruncateDimensions makes the broker honor the embeddings `dimensions`
+	// field itself (truncate and re-normalize) for backends without
+	// Matryoshka support, instead of forwarding it.
+	TruncateDimensions bool `toml:"truncate_dimensions"`
+	// CompletionsViaChat serves /v1/completions for this model through its
+	// chat endpoint, for OpenAI-compatible backends that dropped the legacy
+	// completions API. Other backend types always go through chat.
+	CompletionsViaChat bool `toml:"completions_via_chat"`
+	// ResponsesViaChat does the same for /v1/responses on OpenAI targets
+	// whose backend only implements Chat Completions.
+	ResponsesViaChat bool `toml:"responses_via_chat"`
+	// EvalAlias names another model alias that receives a copy of every
+	// request for offline comparison; its response is never returned.
+	EvalAlias string `toml:"eval_alias"`
+	// CodeExecution controls provider-hosted code execution tools in
+	// translated requests: "native" (default) maps them to the backend's own
+	// sandbox, "function" exposes them as a regular function tool for the
+	// client to run, and "disabled" strips them.
+	CodeExecution string `toml:"code_execution"`
+	// GatewayTools lists broker-executed tools (tool names or MCP server
+	// names) offered to the model. When set, the broker runs the tool loop
+	// itself and only returns the final answer to the client.
+	GatewayTools []string `toml:"gateway_tools"`
+	// MaxToolRounds caps the broker-side tool loop; defaults to 8.
+	MaxToolRounds int `toml:"max_tool_rounds"`
+	// EmulateN serves requests for several choices (OpenAI n) on backends
+	// that cannot generate them, by sending one request per choice in
+	// parallel. Without it such requests are refused.
+	EmulateN bool `toml:"emulate_n"`
+	// MaxTokens is the output token limit of translated requests whose
+	// client sets none. Without it Anthropic targets get 4096, as their API
+	// requires a limit, and other targets their own default.
+	MaxTokens int `toml:"max_tokens"`
+	// MaxTokensCap bounds the output limit of translated requests: larger
+	// client limits are lowered to it, and it is sent when no limit is set
+	// otherwise. Zero leaves limits as sent.
+	MaxTokensCap int `toml:"max_tokens_cap"`
+	// Compression shrinks prompts that exceed a token budget before they
+	// are forwarded.
+	Compression CompressionConfig `toml:"compression"`
+	// SystemPrompt injects instructions into the system prompt of every
+	// chat request routed through the alias.
+	SystemPrompt SystemPromptConfig `toml:"system_prompt"`
+	// LogContent turns content logging on or off for the alias, overriding
+	// content_log.enabled.
+	LogContent *bool `toml:"log_content"`
+	// Tokenizer names the tokenizer that counts the alias's tokens before
+	// a request is sent: a [[tokenizers]] entry or a built-in
+	// approximation ("approximate", "claude", "llama"). Defaults to a guess
+	// from the provider type and target model.
+	Tokenizer string `toml:"tokenizer"`
+	// Capabilities declare what the alias supports, so chat requests it
+	// cannot serve are rejected by the broker with a clear error.
+	Capabilities CapabilityConfig `toml:"capabilities"`
+	// Guardrails check prompts before they are forwarded and responses
+	// before they are returned.
+	Guardrails *GuardrailConfig `toml:"guardrails"`
+	// Cache serves repeated chat completion requests from stored responses
+	// and, on embedding models, repeated inputs from stored vectors.
+	Cache *CacheConfig `toml:"cache"`
+	// Required makes /health report 503 while every target of this model
+	// is failing its health checks.
+	Required bool `toml:"required"`
+	// Fallbacks lists model aliases to retry, in order, when this model's
+	// target returns 429 or 5xx or cannot be reached.
+	Fallbacks []string `toml:"fallbacks"`
+	// Targets splits the alias's traffic across several backends in
+	// proportion to their weights. When set, it replaces Target and Type.
+	Targets []WeightedTarget `toml:"targets"`
+	// Strategy chooses among Targets: "weighted" (default) splits traffic
+	// by weight; "least_latency" prefers the target with the lowest rolling
+	// median latency; "least_busy" picks the target with the fewest
+	// requests in flight; "spillover" sends traffic to the first target
+	// until its spill thresholds are reached, then to the next.
+	Strategy string `toml:"strategy"`
+	// Affinity keeps the requests of one session on the same one of
+	// Targets, so self-hosted replicas can reuse their prompt caches:
+	// "user" keys sessions by the request's user (OpenAI user, Anthropic
+	// metadata.user_id); "header" keys them by AffinityHeader, falling back
+	// to the user. Requests without a session are routed by Strategy.
+	Affinity string `toml:"affinity"`
+	// AffinityHeader is the request header carrying the session ID for
+	// "header" affinity (default "X-Session-ID").
+	AffinityHeader string `toml:"affinity_header"`
+	// Green is a replacement target that gradually takes traffic from
+	// Target, rolling back automatically if it performs worse.
+	Green *RolloutConfig `toml:"green"`
+	// Canary makes a change of Target's URL or model, through a reload or
+	// the admin API, start as a canary: the new target gets a small share
+	// of traffic until it is promoted, or rolled back if it regresses.
+	Canary *CanaryConfig `toml:"canary"`
+	// Shadow receives a copy of a share of the alias's chat requests, whose
+	// responses are measured against the primary's and then discarded.
+	Shadow *ShadowConfig `toml:"shadow"`
+	// Experiment splits the alias's chat requests between arms that differ
+	// in target or system prompt, keeping each user on the same arm.
+	Experiment *ExperimentConfig `toml:"experiment"`
+}
+
+// WeightedTarget is one backend of an alias that splits traffic by weight.
+type WeightedTarget struct {
+	Target TargetConfig `toml:"target"`
+	// Type is the target's provider type; defaults to the model's type.
+	Type string `toml:"type"`
+	// Weight is the target's relative share of traffic; a target with
+	// weight 0 is drained. If every weight is 0, traffic is split evenly.
+	Weight int `toml:"weight"`
+	// Name labels the target in metrics and health reports; defaults to
+	// the target model.
+	Name string `toml:"name"`
+	// SpillRPM, SpillTPM and SpillInFlight are the load at which a
+	// "spillover" alias sends further requests to its next target: requests
+	// or tokens in the last minute, or requests in flight. SpillInFlight
+	// defaults to the target's max_in_flight; zero means no threshold.
+	SpillRPM      int `toml:"spill_rpm"`
+	SpillTPM      int `toml:"spill_tpm"`
+	SpillInFlight int `toml:"spill_in_flight"`
+}
+
+// RolloutConfig describes a blue/green rollout of a new target for an alias.
+type RolloutConfig struct {
+	Target TargetConfig `toml:"target"`
+	// Type is the green target's provider type; defaults to the model's type.
+	Type string `toml:"type"`
+	// StepPercent is how much traffic shifts to green at each healthy step
+	// (default 10); green starts at this share.
+	StepPercent int `toml:"step_percent"`
+	// StepInterval is the minimum time between steps, e.g. "5m" (the default).
+	StepInterval string        `toml:"step_interval"`
+	StepDuration time.Duration `toml:"-"` // Populated after parsing
+	// MinRequests is how many green requests a step needs before it is
+	// judged (default 20).
+	MinRequests int `toml:"min_requests"`
+	// MaxErrorRateIncrease is the largest tolerated rise in 5xx rate over
+	// blue, as a fraction (default 0.05).
+	MaxErrorRateIncrease float64 `toml:"max_error_rate_increase"`
+	// MaxLatencyRatio is the largest tolerated green/blue mean latency
+	// ratio (default 1.5).
+	MaxLatencyRatio float64 `toml:"max_latency_ratio"`
+	// AlertWebhook receives a JSON POST when the rollout is rolled back.
+	AlertWebhook string `toml:"alert_webhook"`
+}
+
+// CanaryConfig describes how a changed target of an alias is canaried
+// against the target it replaces.
+type CanaryConfig struct {
+	// Percent is the share of traffic the new target gets during the
+	// canary, from 1 to 99 (default 5).
+	Percent int `toml:"percent"`
+	// Period is how long the canary runs before it is judged, e.g. "10m"
+	// (the default).
+	Period         string        `toml:"period"`
+	PeriodDuration time.Duration `toml:"-"` // Populated after parsing
+	// MinRequests is how many requests the new target must serve before
+	// the canary is judged (default 20).
+	MinRequests int `toml:"min_requests"`
+	// MaxErrorRateIncrease is the largest tolerated rise in 5xx rate over
+	// the previous target, as a fraction (default 0.05).
+	MaxErrorRateIncrease float64 `toml:"max_error_rate_increase"`
+	// MaxLatencyRatio is the largest tolerated new/previous mean latency
+	// ratio (default 1.5).
+	MaxLatencyRatio float64 `toml:"max_latency_ratio"`
+	// AlertWebhook receives a JSON POST when the canary is rolled back.
+	AlertWebhook string `toml:"alert_webhook"`
+}
+
+// ShadowConfig mirrors part of an alias's traffic to a target under
+// evaluation, without the client seeing its responses.
+type ShadowConfig struct {
+	Target TargetConfig `toml:"target"`
+	// Type is the shadow target's provider type; defaults to the model's type.
+	Type string `toml:"type"`
+	// Percent is the share of requests mirrored, from 0 to 100. Unset
+	// mirrors every request; 0 pauses mirroring.
+	Percent *float64 `toml:"percent"`
+}
+
+// ExperimentConfig is an A/B experiment on an alias.
+type ExperimentConfig struct {
+	// Name labels the experiment in logs and metrics; defaults to the alias.
+	Name string `toml:"name"`
+	// HashOn is what keeps requests on an arm: "user" (default) hashes the
+	// request's user, falling back to the client key; "key" hashes the
+	// client key. Requests with neither hash the client IP.
+	HashOn string `toml:"hash_on"`
+	// Arms share the traffic; their percentages must add up to 100.
+	Arms []ExperimentArm `toml:"arms"`
+}
+
+// ExperimentArm is one variant of an experiment. An arm that sets neither a
+// target nor a system prompt serves the alias unchanged, as a control.
+type ExperimentArm struct {
+	Name string `toml:"name"`
+	// Percent is the arm's share of users, from 0 to 100.
+	Percent float64 `toml:"percent"`
+	// Target replaces the alias's target, and its weighted targets and
+	// rollout, for the arm's requests.
+	Target *TargetConfig `toml:"target"`
+	// Type is the arm target's provider type; defaults to the model's type.
+	Type string `toml:"type"`
+	// SystemPrompt replaces the alias's system prompt settings.
+	SystemPrompt *SystemPromptConfig `toml:"system_prompt"`
+}
+
+// CompressionConfig controls prompt compression for a model. It is disabled
+// unless MaxPromptTokens is set.
+type CompressionConfig struct {
+	// MaxPromptTokens is the estimated prompt size above which compression runs.
+	MaxPromptTokens int `toml:"max_prompt_tokens"`
+	// Strategies are applied in order until the prompt fits: "whitespace",
+	// "tool_outputs", and "summarize". Defaults to the first two.
+	Strategies []string `toml:"strategies"`
+	// SummarizerAlias is the model alias used by the "summarize" strategy.
+	SummarizerAlias string `toml:"summarizer_alias"`
+}
+
+// SystemPromptConfig wraps or replaces the client's system prompt. It is
+// disabled when every field is empty.
+type SystemPromptConfig struct {
+	// Prefix and Suffix are placed before and after the client's system
+	// prompt, separated from it by a blank line.
+	Prefix string `toml:"prefix"`
+	Suffix string `toml:"suffix"`
+	// Template replaces the system prompt; "{{system}}" in it stands for
+	// the client's own. It cannot be combined with Prefix or Suffix.
+	Template string `toml:"template"`
+}
+
+// Enabled reports whether the model rewrites system prompts.
+func (p SystemPromptConfig) Enabled() bool {
+	return p.Prefix != "" || p.Suffix != "" || p.Template != ""
+}
+
+// GuardrailConfig lists the moderation checks of a model. Prompts failing an
+// input check are rejected with a policy error; responses failing an output
+// check are blocked or annotated, as OutputAction says.
+type GuardrailConfig struct {
+	// Deny lists regular expressions that prompts must not match.
+	Deny         []string         `toml:"deny"`
+	DenyPatterns []*regexp.Regexp `toml:"-"` // Populated after parsing
+	// DenyOutput lists regular expressions that responses must not match.
+	DenyOutput         []string         `toml:"deny_output"`
+	DenyOutputPatterns []*regexp.Regexp `toml:"-"` // Populated after parsing
+	// MaxPromptTokens rejects prompts whose estimated size exceeds it.
+	MaxPromptTokens int `toml:"max_prompt_tokens"`
+	// ModerationAlias is a model alias asked to classify prompts, and
+	// responses if ModerateOutput is set, as safe or unsafe.
+	ModerationAlias string `toml:"moderation_alias"`
+	ModerateOutput  bool   `toml:"moderate_output"`
+	// OutputAction is "block" (default), which replaces a failing response
+	// with a policy error, or "annotate", which returns it with an
+	// X-LMBroker-Guardrail header naming the check.
+	OutputAction string `toml:"output_action"`
+}
+
+// CacheConfig controls the response cache of a model. Only non-streaming
+// chat completions are cached; embedding caches always match exactly, per
+// input string.
+type CacheConfig struct {
+	// Mode is "exact" (default), which only matches identical requests, or
+	// "semantic", which also matches prompts whose embeddings are similar.
+	Mode string `toml:"mode"`
+	// TTL is how long a response is served from the cache (default 1h).
+	TTL         string        `toml:"ttl"`
+	TTLDuration time.Duration `toml:"-"` // Populated after parsing
+	// MaxEntries bounds the cache; the oldest entries are evicted first
+	// (default 1000).
+	MaxEntries int `toml:"max_entries"`
+	// EmbeddingAlias is the model alias that embeds prompts in semantic mode.
+	EmbeddingAlias string `toml:"embedding_alias"`
+	// SimilarityThreshold is the cosine similarity at or above which a cached
+	// prompt matches in semantic mode (default 0.95).
+	SimilarityThreshold float64 `toml:"similarity_threshold"`
+	// Shared serves cached responses to every client key. By default a key
+	// is only served responses to its own requests.
+	Shared bool `toml:"shared"`
+}
+
+// EvalConfig controls dual-send evaluation mode.
+type EvalConfig struct {
+	// LogFile receives one JSON line per comparison. Comparisons are always
+	// logged via slog; the file is optional.
+	LogFile string `toml:"log_file"`
+	// AllowHeader lets clients opt in per request with X-LMBroker-Eval: <alias>.
+	AllowHeader bool `toml:"allow_header"`
+}
+
+// UsageConfig controls where per-request token usage is stored.
+type UsageConfig struct {
+	// LogFile receives one JSON line per request and is replayed on startup.
+	// Without it, usage is only kept in memory.
+	LogFile string `toml:"log_file"`
+}
+
+// CapabilityConfig declares the features a model supports. Unset features
+// are assumed to be supported.
+type CapabilityConfig struct {
+	// MaxContext is the model's context window in tokens, which the prompt
+	// and the requested output must fit in. Zero means unknown.
+	MaxContext int   `toml:"max_context"`
+	Tools      *bool `toml:"tools"`
+	Vision     *bool `toml:"vision"`
+	// JSONMode covers OpenAI response_format and Responses text.format
+	// JSON output.
+	JSONMode  *bool `toml:"json_mode"`
+	Streaming *bool `toml:"streaming"`
+	// Degrade strips unsupported tools, images and JSON mode from requests
+	// instead of rejecting them. Streaming and context limits are still
+	// enforced.
+	Degrade bool `toml:"degrade"`
+	// Overflow is what happens to a request that does not fit in
+	// MaxContext: "reject" (default) answers 400, "truncate" drops the
+	// oldest non-system messages until it fits, and "fallback" sends it to
+	// OverflowAlias.
+	Overflow      string `toml:"overflow"`
+	OverflowAlias string `toml:"overflow_alias"`
+}
+
+// TokenizerConfig loads a tiktoken BPE file, such as cl100k_base.tiktoken,
+// under a name models can refer to. Models of OpenAI's families use
+// "cl100k_base" and "o200k_base" without naming them.
+type TokenizerConfig struct {
+	Name string `toml:"name"`
+	File string `toml:"file"`
+	// Pattern is the pre-tokenizer the file was trained with, "cl100k" or
+	// "o200k"; defaults to "o200k" for names starting with o200k and
+	// "cl100k" otherwise.
+	Pattern  string         `toml:"pattern"`
+	Encoding *tokenizer.BPE `toml:"-"` // Loaded after parsing
+}
+
+// WebhookEvents are the events webhooks can subscribe to.
+var WebhookEvents = []string{"request.completed", "budget.exceeded", "backend.unhealthy", "guardrail.triggered"}
+
+// WebhookConfig is an endpoint that receives events as JSON POSTs.
+type WebhookConfig struct {
+	URL string `toml:"url"`
+	// Events lists the events sent to the endpoint; empty sends every one
+	// except request.completed.
+	Events []string `toml:"events"`
+	// Signing signs each payload like an outbound request, so the endpoint
+	// can verify it came from the broker.
+	Signing *SigningConfig `toml:"signing"`
+}
+
+// Wants reports whether the webhook subscribes to an event.
+func (w *WebhookConfig) Wants(event string) bool {
+	if len(w.Events) == 0 {
+		return event != "request.completed"
+	}
+	return slices.Contains(w.Events, event)
+}
+
+// RequestLogConfig keeps the metadata of API requests for /admin/requests.
+type RequestLogConfig struct {
+	Enabled bool `toml:"enabled"`
+	// File receives one JSON line per request and is replayed on startup.
+	// Without it, requests are only kept in memory.
+	File string `toml:"file"`
+	// MaxRecords is how many of the latest requests are kept in memory
+	// (default 10000). Queries that need older ones scan the file.
+	MaxRecords int `toml:"max_records"`
+	// IncludeBodies also stores request and response bodies, redacted as
+	// content_log says.
+	IncludeBodies bool `toml:"include_bodies"`
+}
+
+// BatchConfig controls the OpenAI Batch API served on /v1/files and
+// /v1/batches.
+type BatchConfig struct {
+	// Dir keeps uploaded files, batch results and the batches themselves
+	// across restarts. Without it, they are only kept in memory.
+	Dir string `toml:"dir"`
+	// Parallelism is how many requests of an emulated batch run at once
+	// (default 4).
+	Parallelism int `toml:"parallelism"`
+}
+
+// AsyncConfig controls the jobs of asynchronous requests, made with
+// X-LMBroker-Async: true and polled on /v1/jobs.
+type AsyncConfig struct {
+	// TTL is how long a finished job's result is kept (default "1h").
+	TTL         string        `toml:"ttl"`
+	TTLDuration time.Duration `toml:"-"` // Populated after parsing
+	// MaxJobs is how many jobs are kept at once (default 1000). Further
+	// asynchronous requests are refused with 429.
+	MaxJobs int `toml:"max_jobs"`
+}
+
+// ContentLogConfig controls logging of full prompts and responses for
+// debugging and audit. Nothing is logged without a file.
+type ContentLogConfig struct {
+	// File receives one JSON line per logged request.
+	File string `toml:"file"`
+	// Enabled logs every request. Models and client keys may turn logging
+	// on or off for themselves with log_content; a key's setting wins.
+	Enabled bool `toml:"enabled"`
+	// Redact is how the contents named by RedactFields are logged: "none"
+	// (default) keeps them, "hash" replaces them with their SHA-256, and
+	// "drop" leaves them out. Metadata such as models, roles and usage is
+	// always kept.
+	Redact string `toml:"redact"`
+	// RedactFields are the JSON field names holding contents, in requests
+	// and responses of every dialect. Defaults to DefaultRedactFields.
+	RedactFields []string `toml:"redact_fields"`
+}
+
+// DefaultRedactFields are the JSON fields that carry prompt and response
+// contents.
+var DefaultRedactFields = []string{
+	"content", "text", "input", "prompt", "system", "instructions", "arguments",
+	"thinking", "partial_json", "reasoning_content", "url", "data", "b64_json",
+}
+
+// ConcurrencyConfig limits how many requests the broker sends to backends
+// at once. Targets can set their own, lower max_in_flight.
+type ConcurrencyConfig struct {
+	// MaxInFlight caps the backend requests in flight across all targets.
+	// Zero means unlimited.
+	MaxInFlight int `toml:"max_in_flight"`
+	// OnLimit is what happens to a request beyond a limit: "queue" (default)
+	// waits up to QueueTimeout for a slot, "reject" answers 503 at once.
+	OnLimit string `toml:"on_limit"`
+	// QueueTimeout is how long a queued request waits (default 30s).
+	QueueTimeout         string        `toml:"queue_timeout"`
+	QueueTimeoutDuration time.Duration `toml:"-"` // Populated after parsing
+}
+
+// HealthCheckConfig controls the background probing of model targets.
+type HealthCheckConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Interval between probes of each target (default 30s) and the time a
+	// probe may take (default 5s).
+	Interval string `toml:"interval"`
+	Timeout  string `toml:"timeout"`
+
+	IntervalDuration time.Duration `toml:"-"` // Populated after parsing
+	TimeoutDuration  time.Duration `toml:"-"` // Populated after parsing
+}
+
+// TracingConfig controls OTLP trace export.
+type TracingConfig struct {
+	Enabled bool `toml:"enabled"`
+	// Endpoint is the collector's OTLP/HTTP traces URL. It defaults to
+	// OTEL_EXPORTER_OTLP_ENDPOINT, or http://localhost:4318, plus /v1/traces.
+	Endpoint string `toml:"endpoint"`
+	// ServiceName is reported as service.name (default "lmbroker").
+	ServiceName string `toml:"service_name"`
+	// Headers are sent with every export, e.g. a collector API key; values
+	// may use "env:NAME".
+	Headers map[string]string `toml:"headers"`
+}
+
+// KeyConfig is a client API key issued by the broker, independent of any
+// backend credentials.
+type KeyConfig struct {
+	// Name identifies the key in logs and metrics.
+	Name string `toml:"name"`
+	// Key is the secret clients send; "env:NAME" reads it from the environment.
+	Key string `toml:"key"`
+	// Models restricts the key to these model aliases, which may be glob
+	// patterns such as "cheap-*". Empty allows every model.
+	Models []string `toml:"models"`
+	// Routes sends requests for one alias to another for this key only,
+	// e.g. { "gpt-4" = "gpt-4o-mini" }. The allowlist applies to the alias
+	// routed to.
+	Routes map[string]string `toml:"routes"`
+	// RPM and TPM cap the requests and tokens (prompt plus completion) the
+	// key may use per minute. Zero means unlimited.
+	RPM int `toml:"rpm"`
+	TPM int `toml:"tpm"`
+	// DailyBudget and MonthlyBudget cap the key's estimated spend in USD
+	// per UTC day and calendar month. Zero means unlimited.
+	DailyBudget   float64 `toml:"daily_budget"`
+	MonthlyBudget float64 `toml:"monthly_budget"`
+	// Priority is the key's class when requests queue for a concurrency
+	// slot: "high", "normal" (default) or "low". Higher classes are admitted
+	// first; within a class, in arrival order.
+	Priority string `toml:"priority"`
+	// LogContent turns content logging on or off for the key's requests,
+	// overriding the model and content_log.enabled.
+	LogContent *bool `toml:"log_content"`
+}
+
+// Allows reports whether the key may use the model alias.
+func (k *KeyConfig) Allows(alias string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, pattern := range k.Models {
+		if matched, _ := path.Match(pattern, alias); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteRule sends requests that match all of its conditions to another
+// model alias, before the alias is looked up. At least one condition is
+// required.
+type RouteRule struct {
+	// Name labels the rule in logs and metrics; defaults to To.
+	Name string `toml:"name"`
+	// Models limits the rule to requests for these aliases, which may be
+	// glob patterns. Empty matches every alias.
+	Models []string `toml:"models"`
+	// Headers must all be present with a value matching the glob pattern,
+	// e.g. { "X-Team" = "research" }.
+	Headers map[string]string `toml:"headers"`
+	// User is a glob pattern for the OpenAI user field or the Anthropic
+	// metadata.user_id.
+	User string `toml:"user"`
+	// When is an expression over the request's RouteVariables that must
+	// be true, e.g. `tokens > 8000 && hour >= 9 && hour < 17`.
+	When string `toml:"when"`
+	// To is the model alias matching requests are served by.
+	To string `toml:"to"`
+}
+
+// RouteVariables are the request attributes a routing rule's when
+// expression can use: the alias asked for, the endpoint path, the number of
+// messages, the estimated prompt tokens, the end user, the client key's
+// name, whether the response streams, the broker's local hour (0-23) and
+// weekday (0 is Sunday), and the headers by lowercase name.
+var RouteVariables = []string{"model", "path", "messages", "tokens", "user", "key", "stream", "hour", "weekday", "headers"}
+
+// GatewayConfig declares the tools the broker can execute on behalf of models.
+type GatewayConfig struct {
+	Tools      []GatewayTool `toml:"tools"`
+	MCPServers []MCPServer   `toml:"mcp_servers"`
+}
+
+// GatewayTool is a single tool served by a webhook. The webhook receives
+// {"name": ..., "arguments": {...}} and its response body is the tool result.
+type GatewayTool struct {
+	Name        string                 `toml:"name"`
+	Description string                 `toml:"description"`
+	Parameters  map[string]interface{} `toml:"parameters"`
+	Webhook     string                 `toml:"webhook"`
+}
+
+// MCPServer is a Model Context Protocol server reached over streamable HTTP.
+// All of its tools are exposed under their MCP names.
+type MCPServer struct {
+	Name    string            `toml:"name"`
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
 }
 
 // TargetConfig holds the target provider details.
 type TargetConfig struct {
+	// URL is the base URL of the provider's API. A local server listening
+	// on a Unix domain socket is written unix://<socket>:<base path>, e.g.
+	// "unix:///run/vllm.sock:/v1/".
 	URL    string `toml:"url"`
+	Socket string `toml:"-"` // Populated after parsing, from a unix:// URL
 	Model  string `toml:"model"`
 	APIKey string `toml:"api_key"`
+	// AuthStyle is how the API key is sent: "bearer" (Authorization:
+	// Bearer), "x-api-key", "api-key", or "query-param" (a key query
+	// parameter). Defaults to the provider's convention: x-api-key for
+	// Anthropic, api-key for Azure OpenAI, x-goog-api-key for Gemini, and
+	// bearer otherwise.
+	AuthStyle string `toml:"auth_style"`
+	// Deployment and APIVersion address Azure OpenAI targets; the
+	// deployment defaults to Model.
+	Deployment string `toml:"deployment"`
+	APIVersion string `toml:"api_version"`
+	// Project, Region, and CredentialsFile address Vertex AI targets. Without
+	// an api_key, OAuth tokens come from CredentialsFile or, if that is
+	// empty, application default credentials.
+	Project         string `toml:"project"`
+	Region          string `toml:"region"`
+	CredentialsFile string `toml:"credentials_file"`
+	// Signing adds an HMAC signature to outbound requests so the backend
+	// can verify they came from the broker.
+	Signing *SigningConfig `toml:"signing"`
+	// Retry re-sends requests that the backend rejected with a transient
+	// error, before any of the response reaches the client.
+	Retry *RetryConfig `toml:"retry"`
+	// HealthPath is the path, relative to URL, that health checks probe
+	// with a GET; defaults to "models" ("api/tags" for Ollama).
+	HealthPath string `toml:"health_path"`
+	// Pricing is what the target charges, used to estimate request costs.
+	Pricing PricingConfig `toml:"pricing"`
+	// Cooldown is how long the target is avoided after it answers 429, when
+	// the response has no Retry-After (default 30s; "0s" disables it).
+	Cooldown         string        `toml:"cooldown"`
+	CooldownDuration time.Duration `toml:"-"` // Populated after parsing
+	// RateLimitReserve is how many tokens of the rate limit a groq or
+	// together target reports are held back: when no more remain, the
+	// target cools down until its token window resets, rather than waiting
+	// for a 429.
+	RateLimitReserve int `toml:"rate_limit_reserve"`
+	// MaxInFlight caps the requests in flight to this target; beyond it,
+	// requests queue or are rejected as [concurrency] on_limit says. Zero
+	// means unlimited.
+	MaxInFlight int `toml:"max_in_flight"`
+	// Timeouts bound how long a backend may take to answer.
+	Timeouts TimeoutConfig `toml:"timeouts"`
+	// MaxResponseBytes caps the size of responses the broker reads whole
+	// to translate them; larger ones are answered 502. Passthrough and
+	// streamed responses are forwarded as they arrive and not capped. Zero
+	// means unlimited.
+	MaxResponseBytes int64 `toml:"max_response_bytes"`
+	// Pool tunes the target's connection pool.
+	Pool PoolConfig `toml:"pool"`
+	// Headers controls which client headers are forwarded to the target.
+	Headers HeaderPolicy `toml:"headers"`
+	// Mock sets the answers of a "mock" target.
+	Mock *MockConfig `toml:"mock"`
+	// EmbeddingBatch splits embedding requests with more inputs than the
+	// backend takes at once into batches sent in parallel.
+	EmbeddingBatch EmbeddingBatchConfig `toml:"embedding_batch"`
+	// Batch is how batches for the target are run: "native" sends them to
+	// its own Batch API, "emulate" runs their requests through the broker.
+	// Defaults to native for openai targets, falling back to emulate when
+	// the target has no Batch API, and to emulate for the rest. Batches of
+	// keys with tpm or budgets are always emulated.
+	Batch string `toml:"batch"`
+	// Client is the target's HTTP client, shared by all its requests.
+	Client *http.Client `toml:"-"` // Built after parsing
+}
+
+// PoolConfig tunes the keep-alive connections kept open to a target.
+type PoolConfig struct {
+	// MaxIdleConns is how many idle connections are kept for reuse
+	// (default 64).
+	MaxIdleConns int `toml:"max_idle_conns"`
+	// IdleConnTimeout is how long an idle connection is kept (default 90s).
+	IdleConnTimeout         string        `toml:"idle_conn_timeout"`
+	IdleConnTimeoutDuration time.Duration `toml:"-"` // Populated after parsing
+	// DisableHTTP2 keeps the target on HTTP/1.1, which is otherwise only
+	// used if the backend does not offer HTTP/2.
+	DisableHTTP2 bool `toml:"disable_http2"`
+}
+
+// HeaderPolicy controls which client request headers cross the broker to
+// a target. Names are matched case-insensitively, and a trailing "*"
+// matches by prefix, as in "anthropic-*". Hop-by-hop headers and cookies
+// are never forwarded.
+type HeaderPolicy struct {
+	// Forward lists the headers to forward. When empty, passthrough
+	// requests forward every header, and translated requests, whose body
+	// the broker re-encodes, none.
+	Forward []string `toml:"forward"`
+	// Drop lists headers never forwarded, even when Forward matches them.
+	Drop []string `toml:"drop"`
+}
+
+// TimeoutConfig holds a target's HTTP timeouts. A duration of "0s" disables
+// that timeout.
+type TimeoutConfig struct {
+	// Connect bounds establishing the connection, TLS included (default 10s).
+	Connect string `toml:"connect"`
+	// ResponseHeader bounds the wait for the response headers once the
+	// request is sent (default 5m). Backends only send them once a
+	// non-streaming answer is complete.
+	ResponseHeader string `toml:"response_header"`
+	// Total bounds a non-streaming exchange, retries included, until its
+	// body has been read (default 10m).
+	Total string `toml:"total"`
+	// StreamIdle bounds the gap between chunks of a streaming response,
+	// which has no total limit (default 2m).
+	StreamIdle string `toml:"stream_idle"`
+
+	ConnectDuration        time.Duration `toml:"-"` // Populated after parsing
+	ResponseHeaderDuration time.Duration `toml:"-"` // Populated after parsing
+	TotalDuration          time.Duration `toml:"-"` // Populated after parsing
+	StreamIdleDuration     time.Duration `toml:"-"` // Populated after parsing
+}
+
+// PricingConfig is a target's price in USD per million tokens.
+type PricingConfig struct {
+	InputPerMillion  float64 `toml:"input_per_million"`
+	OutputPerMillion float64 `toml:"output_per_million"`
+}
+
+// Priced reports whether the target has a price set.
+func (p PricingConfig) Priced() bool {
+	return p.InputPerMillion > 0 || p.OutputPerMillion > 0
+}
+
+// Cost returns the price of a request with the given token counts.
+func (p PricingConfig) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.InputPerMillion + float64(outputTokens)*p.OutputPerMillion) / 1e6
+}
+
+// RetryConfig is a target's retry policy for transient failures.
+type RetryConfig struct {
+	// MaxAttempts counts the first try; defaults to 3.
+	MaxAttempts int `toml:"max_attempts"`
+	// InitialBackoff is the wait before the first retry, doubling after
+	// each further attempt up to MaxBackoff (defaults 500ms and 10s).
+	InitialBackoff string `toml:"initial_backoff"`
+	MaxBackoff     string `toml:"max_backoff"`
+	// RetryOn lists retryable status codes; defaults to 429, 502, 503, 504.
+	RetryOn []int `toml:"retry_on"`
+
+	InitialBackoffDuration time.Duration `toml:"-"` // Populated after parsing
+	MaxBackoffDuration     time.Duration `toml:"-"` // Populated after parsing
+}
+
+// EmbeddingBatchConfig sets how a target's embedding requests are split.
+type EmbeddingBatchConfig struct {
+	// MaxInputs is the most inputs sent in one request. Zero means the
+	// provider's documented limit: 2048 for OpenAI, 1000 for Voyage, 100
+	// for Gemini and 96 for Cohere; other providers are not split.
+	MaxInputs int `toml:"max_inputs"`
+	// Parallelism is how many batches are in flight at once (default 4).
+	Parallelism int `toml:"parallelism"`
+	// Retries is how many more times a failed batch is sent before the
+	// request fails (default 1). Batches that succeeded are not resent.
+	Retries *int `toml:"retries"`
+}
+
+// SigningConfig controls outbound request signing. The signature is
+// hex(HMAC-SHA256(secret, timestamp + "." + body)), sent as "sha256=<hex>".
+type SigningConfig struct {
+	// Secret is the shared HMAC key; "env:NAME" reads it from the environment.
+	Secret string `toml:"secret"`
+	// Header carries the signature (default X-LMBroker-Signature).
+	Header string `toml:"header"`
+	// TimestampHeader carries the Unix timestamp that was signed
+	// (default X-LMBroker-Timestamp).
+	TimestampHeader string `toml:"timestamp_header"`
 }
 
 // Load reads the configuration from the specified file path,
@@ -50,25 +845,72 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	text, err := interpolateEnv(string(data))
+	if err != nil {
+		return nil, err
+	}
+
 	var cfg Config
-	if _, err := toml.Decode(string(data), &cfg); err != nil {
+	if _, err := toml.Decode(text, &cfg); err != nil {
 		return nil, err
 	}
 
+	// Merge in models from included files, refusing aliases defined twice.
+	sources := make(map[string]string)
+	for _, model := range cfg.RawModels {
+		if previous, ok := sources[model.Alias]; ok {
+			return nil, fmt.Errorf("model %q is defined twice in %s", model.Alias, previous)
+		}
+		sources[model.Alias] = path
+	}
+	if cfg.Include != "" {
+		included, err := loadIncludes(path, cfg.Include, sources)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RawModels = append(cfg.RawModels, included...)
+	}
+
+	// Models changed through the admin API take the place of those above.
+	if cfg.Server.ModelsFile != "" {
+		if !filepath.IsAbs(cfg.Server.ModelsFile) {
+			cfg.Server.ModelsFile = filepath.Join(filepath.Dir(path), cfg.Server.ModelsFile)
+		}
+		overlay, err := LoadOverlay(cfg.Server.ModelsFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RawModels = overlay.apply(cfg.RawModels)
+	}
+
 	// Convert the slice of models into a map for efficient access by alias.
 	cfg.Models = make(map[string]Model)
+	cfg.Definitions = make(map[string]Model)
 	for _, model := range cfg.RawModels {
-		// Resolve environment variables in API keys
-		if envVar, found := strings.CutPrefix(model.Target.APIKey, "env:"); found {
-			if envValue := os.Getenv(envVar); envValue != "" {
-				model.Target.APIKey = envValue
-			}
+		definition, err := copyModel(model)
+		if err != nil {
+			return nil, fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+		cfg.Definitions[model.Alias] = definition
+		if err := PrepareModel(&model); err != nil {
+			return nil, err
 		}
 		cfg.Models[model.Alias] = model
 	}
 	// We don't need the raw slice anymore.
 	cfg.RawModels = nil
 
+	if err := loadTokenizers(cfg.Tokenizers); err != nil {
+		return nil, err
+	}
+	if err := CheckReferences(&cfg); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnvOverrides(&cfg); err != nil {
+		return nil, err
+	}
+
 	// Set default server configuration if not provided
 	if cfg.Server.Host == "" {
 		cfg.Server.Host = "localhost"
@@ -76,11 +918,1101 @@ func Load(path string) (*Config, error) {
 	if cfg.Server.Port == 0 {
 		cfg.Server.Port = 8080
 	}
+	if cfg.Server.SecretRefresh != "" {
+		duration, err := time.ParseDuration(cfg.Server.SecretRefresh)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid secret_refresh %q", cfg.Server.SecretRefresh)
+		}
+		cfg.Server.SecretRefreshDuration = duration
+	}
+	cfg.Server.ShutdownTimeoutDuration = 30 * time.Second
+	if cfg.Server.ShutdownTimeout != "" {
+		duration, err := time.ParseDuration(cfg.Server.ShutdownTimeout)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid shutdown_timeout %q", cfg.Server.ShutdownTimeout)
+		}
+		cfg.Server.ShutdownTimeoutDuration = duration
+	}
+	if cfg.Server.MaxRequestBytes < 0 {
+		return nil, fmt.Errorf("invalid max_request_bytes %d", cfg.Server.MaxRequestBytes)
+	}
+	for path, dialect := range cfg.Server.EmbeddingPaths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("embedding_paths: path %q must start with /", path)
+		}
+		if route, ok := brokerRoute(path); ok {
+			return nil, fmt.Errorf("embedding_paths: path %s is already served as %s", path, route)
+		}
+		switch dialect {
+		case "openai", "cohere", "ollama":
+		default:
+			return nil, fmt.Errorf("embedding_paths: unknown format %q for %s; use openai, cohere or ollama", dialect, path)
+		}
+	}
+
+	if err := applyHealthCheckDefaults(&cfg.HealthCheck); err != nil {
+		return nil, err
+	}
+
+	if err := applyTracingDefaults(&cfg.Tracing); err != nil {
+		return nil, err
+	}
+
+	if err := applyConcurrencyDefaults(&cfg.Concurrency); err != nil {
+		return nil, err
+	}
+
+	if err := applyKeyDefaults(cfg.Keys); err != nil {
+		return nil, err
+	}
+	if err := applyRouteDefaults(cfg.Routes); err != nil {
+		return nil, err
+	}
+	if err := applyContentLogDefaults(&cfg.ContentLog); err != nil {
+		return nil, err
+	}
+	for i := range cfg.Webhooks {
+		webhook := &cfg.Webhooks[i]
+		if webhook.URL == "" {
+			return nil, fmt.Errorf("webhooks[%d]: url is required", i)
+		}
+		for _, event := range webhook.Events {
+			if !slices.Contains(WebhookEvents, event) {
+				return nil, fmt.Errorf("webhooks[%d]: unknown event %q", i, event)
+			}
+		}
+		if err := applySigningDefaults(webhook.Signing); err != nil {
+			return nil, fmt.Errorf("webhooks[%d]: %w", i, err)
+		}
+	}
+	if cfg.RequestLog.MaxRecords < 0 {
+		return nil, fmt.Errorf("invalid request_log max_records %d", cfg.RequestLog.MaxRecords)
+	}
+	if cfg.RequestLog.MaxRecords == 0 {
+		cfg.RequestLog.MaxRecords = 10000
+	}
+	if cfg.Batches.Parallelism < 0 {
+		return nil, fmt.Errorf("invalid batches parallelism %d", cfg.Batches.Parallelism)
+	}
+	if cfg.Async.TTL != "" {
+		duration, err := time.ParseDuration(cfg.Async.TTL)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid async ttl %q", cfg.Async.TTL)
+		}
+		cfg.Async.TTLDuration = duration
+	}
+	if cfg.Async.MaxJobs < 0 {
+		return nil, fmt.Errorf("invalid async max_jobs %d", cfg.Async.MaxJobs)
+	}
+	adminKey, err := resolveSecret(cfg.Server.AdminKey)
+	if err != nil {
+		return nil, fmt.Errorf("admin_key: %w", err)
+	}
+	cfg.Server.AdminKey = adminKey
+	if strings.HasPrefix(cfg.Server.AdminKey, "env:") {
+		return nil, fmt.Errorf("admin_key: environment variable %s is unset", strings.TrimPrefix(cfg.Server.AdminKey, "env:"))
+	}
+
+	// Parse trusted proxy entries so a typo fails at startup rather than
+	// silently trusting (or ignoring) forwarded headers.
+	for _, entry := range cfg.Server.TrustedProxies {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted_proxies entry %q: %w", entry, err)
+		}
+		cfg.Server.TrustedPrefixes = append(cfg.Server.TrustedPrefixes, prefix)
+	}
 
 	return &cfg, nil
 }
 
+// PrepareModel fills in the defaults of a model definition and validates
+// it on its own. CheckReferences validates it against the other models.
+func PrepareModel(model *Model) error {
+	if err := applyTargetDefaults(&model.Target, model.Type); err != nil {
+		return fmt.Errorf("model %q: %w", model.Alias, err)
+	}
+	if len(model.Targets) > 0 {
+		if err := applyWeightedTargetDefaults(model); err != nil {
+			return fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+	}
+	if model.MaxTokens < 0 || model.MaxTokensCap < 0 {
+		return fmt.Errorf("model %q: max_tokens and max_tokens_cap cannot be negative", model.Alias)
+	}
+	if model.MaxTokensCap > 0 && model.MaxTokens > model.MaxTokensCap {
+		return fmt.Errorf("model %q: max_tokens %d exceeds max_tokens_cap %d", model.Alias, model.MaxTokens, model.MaxTokensCap)
+	}
+	if model.Capabilities.MaxContext < 0 {
+		return fmt.Errorf("model %q: capabilities max_context cannot be negative", model.Alias)
+	}
+	switch caps := model.Capabilities; {
+	case caps.Overflow != "" && caps.Overflow != "reject" && caps.Overflow != "truncate" && caps.Overflow != "fallback":
+		return fmt.Errorf("model %q: unknown capabilities overflow %q", model.Alias, caps.Overflow)
+	case caps.Overflow == "fallback" && caps.OverflowAlias == "":
+		return fmt.Errorf("model %q: capabilities overflow \"fallback\" requires overflow_alias", model.Alias)
+	}
+	if prompt := model.SystemPrompt; prompt.Template != "" && (prompt.Prefix != "" || prompt.Suffix != "") {
+		return fmt.Errorf("model %q: system_prompt template cannot be combined with prefix or suffix", model.Alias)
+	}
+	if model.Strategy != "" && model.Strategy != "weighted" && model.Strategy != "least_latency" && model.Strategy != "least_busy" && model.Strategy != "spillover" {
+		return fmt.Errorf("model %q: unknown strategy %q", model.Alias, model.Strategy)
+	}
+	for _, strategy := range model.Compression.Strategies {
+		if strategy != "whitespace" && strategy != "tool_outputs" && strategy != "summarize" {
+			return fmt.Errorf("model %q: unknown compression strategy %q", model.Alias, strategy)
+		}
+		if strategy == "summarize" && model.Compression.SummarizerAlias == "" {
+			return fmt.Errorf("model %q: compression strategy \"summarize\" requires summarizer_alias", model.Alias)
+		}
+	}
+	if model.CodeExecution != "" && model.CodeExecution != "native" && model.CodeExecution != "function" && model.CodeExecution != "disabled" {
+		return fmt.Errorf("model %q: unknown code_execution %q", model.Alias, model.CodeExecution)
+	}
+	if model.Affinity != "" && model.Affinity != "user" && model.Affinity != "header" {
+		return fmt.Errorf("model %q: unknown affinity %q", model.Alias, model.Affinity)
+	}
+	if model.Affinity != "" && len(model.Targets) == 0 {
+		return fmt.Errorf("model %q: affinity requires targets", model.Alias)
+	}
+	if model.Affinity == "header" && model.AffinityHeader == "" {
+		model.AffinityHeader = "X-Session-ID"
+	}
+	if model.Green != nil {
+		if err := applyRolloutDefaults(model); err != nil {
+			return fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+	}
+	if model.Canary != nil {
+		if err := applyCanaryDefaults(model); err != nil {
+			return fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+	}
+	if shadow := model.Shadow; shadow != nil {
+		if shadow.Type == "" {
+			shadow.Type = model.Type
+		}
+		if err := applyTargetDefaults(&shadow.Target, shadow.Type); err != nil {
+			return fmt.Errorf("model %q: shadow target: %w", model.Alias, err)
+		}
+		if shadow.Percent != nil && (*shadow.Percent < 0 || *shadow.Percent > 100) {
+			return fmt.Errorf("model %q: shadow percent must be between 0 and 100", model.Alias)
+		}
+	}
+	if model.Experiment != nil {
+		if err := applyExperimentDefaults(model); err != nil {
+			return fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+	}
+	if model.Guardrails != nil {
+		if err := applyGuardrailDefaults(model.Guardrails); err != nil {
+			return fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+	}
+	if model.Cache != nil {
+		if err := applyCacheDefaults(model.Cache); err != nil {
+			return fmt.Errorf("model %q: %w", model.Alias, err)
+		}
+	}
+	return nil
+}
+
+// CheckReferences makes sure every model alias the configuration refers to,
+// from fallbacks, semantic caches, the default model and key routes, exists.
+func CheckReferences(cfg *Config) error {
+	for alias, model := range cfg.Models {
+		for _, fallback := range model.Fallbacks {
+			if _, ok := cfg.Models[fallback]; !ok || fallback == alias {
+				return fmt.Errorf("model %q: invalid fallback %q", alias, fallback)
+			}
+		}
+		if model.Guardrails != nil && model.Guardrails.ModerationAlias != "" {
+			if _, ok := cfg.Models[model.Guardrails.ModerationAlias]; !ok || model.Guardrails.ModerationAlias == alias {
+				return fmt.Errorf("model %q: invalid guardrails moderation_alias %q", alias, model.Guardrails.ModerationAlias)
+			}
+			// Moderation calls go through the moderating alias's own
+			// guardrails, so the chain of moderators must end.
+			seen := map[string]bool{alias: true}
+			for next := model.Guardrails.ModerationAlias; next != ""; {
+				if seen[next] {
+					return fmt.Errorf("model %q: guardrails moderation_alias %q leads back to %q", alias, model.Guardrails.ModerationAlias, next)
+				}
+				seen[next] = true
+				moderator := cfg.Models[next]
+				if moderator.Guardrails == nil {
+					break
+				}
+				next = moderator.Guardrails.ModerationAlias
+			}
+		}
+		if model.EvalAlias != "" {
+			if _, ok := cfg.Models[model.EvalAlias]; !ok || model.EvalAlias == alias {
+				return fmt.Errorf("model %q: invalid eval_alias %q", alias, model.EvalAlias)
+			}
+		}
+		if summarizer := model.Compression.SummarizerAlias; summarizer != "" {
+			if _, ok := cfg.Models[summarizer]; !ok || summarizer == alias {
+				return fmt.Errorf("model %q: invalid compression summarizer_alias %q", alias, summarizer)
+			}
+			// Summaries are requested through the summarizing alias, which
+			// may compress its own prompt, so the chain of summarizers must
+			// end.
+			seen := map[string]bool{alias: true}
+			for next := summarizer; next != ""; next = cfg.Models[next].Compression.SummarizerAlias {
+				if seen[next] {
+					return fmt.Errorf("model %q: compression summarizer_alias %q leads back to %q", alias, summarizer, next)
+				}
+				seen[next] = true
+			}
+		}
+		for _, name := range model.GatewayTools {
+			if !slices.ContainsFunc(cfg.Gateway.Tools, func(t GatewayTool) bool { return t.Name == name }) &&
+				!slices.ContainsFunc(cfg.Gateway.MCPServers, func(s MCPServer) bool { return s.Name == name }) {
+				return fmt.Errorf("model %q: gateway_tools entry %q is not a gateway tool or MCP server", alias, name)
+			}
+		}
+		if overflow := model.Capabilities.OverflowAlias; overflow != "" {
+			if _, ok := cfg.Models[overflow]; !ok || overflow == alias {
+				return fmt.Errorf("model %q: invalid capabilities overflow_alias %q", alias, overflow)
+			}
+		}
+		if model.Tokenizer != "" && !slices.Contains(tokenizer.Builtin, model.Tokenizer) &&
+			!slices.ContainsFunc(cfg.Tokenizers, func(t TokenizerConfig) bool { return t.Name == model.Tokenizer }) {
+			return fmt.Errorf("model %q: unknown tokenizer %q", alias, model.Tokenizer)
+		}
+		if model.Cache != nil && model.Cache.Mode == "semantic" {
+			if _, ok := cfg.Models[model.Cache.EmbeddingAlias]; !ok {
+				return fmt.Errorf("model %q: semantic cache needs a configured embedding_alias, got %q", alias, model.Cache.EmbeddingAlias)
+			}
+		}
+	}
+
+	if cfg.DefaultModel != "" {
+		if _, ok := cfg.Models[cfg.DefaultModel]; !ok {
+			return fmt.Errorf("default_model %q is not a configured model alias", cfg.DefaultModel)
+		}
+	}
+
+	for _, key := range cfg.Keys {
+		for from, to := range key.Routes {
+			if _, ok := cfg.Models[to]; !ok {
+				return fmt.Errorf("key %q: route for %q targets unknown model %q", key.Name, from, to)
+			}
+		}
+	}
+
+	for _, rule := range cfg.Routes {
+		if _, ok := cfg.Models[rule.To]; !ok {
+			return fmt.Errorf("route %q targets unknown model %q", rule.Name, rule.To)
+		}
+	}
+	return nil
+}
+
+// applyEnvOverrides lets LMBROKER_HOST, LMBROKER_PORT and LMBROKER_LOG_LEVEL
+// replace the file's settings, so one config file serves every deployment.
+func applyEnvOverrides(cfg *Config) error {
+	if host := os.Getenv("LMBROKER_HOST"); host != "" {
+		cfg.Server.Host = host
+	}
+	if port := os.Getenv("LMBROKER_PORT"); port != "" {
+		value, err := strconv.Atoi(port)
+		if err != nil || value <= 0 || value > 65535 {
+			return fmt.Errorf("invalid LMBROKER_PORT %q", port)
+		}
+		cfg.Server.Port = value
+	}
+	if logLevel := os.Getenv("LMBROKER_LOG_LEVEL"); logLevel != "" {
+		cfg.LogLevel = logLevel
+	}
+	return nil
+}
+
+// loadIncludes reads the model definitions of every file matching pattern,
+// relative to the directory of the main config file, in lexical order.
+// Included files may only define [[models]]. sources maps each alias seen so
+// far to the file defining it and is updated as files are read.
+func loadIncludes(configPath, pattern string, sources map[string]string) ([]Model, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(configPath), pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern %q: %w", pattern, err)
+	}
+
+	var models []Model
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text, err := interpolateEnv(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		var included struct {
+			Models []Model `toml:"models"`
+		}
+		meta, err := toml.Decode(text, &included)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, key := range meta.Keys() {
+			if len(key) == 1 && key[0] != "models" {
+				return nil, fmt.Errorf("%s: included files may only define [[models]], found %q", file, key[0])
+			}
+		}
+		for _, model := range included.Models {
+			if previous, ok := sources[model.Alias]; ok {
+				return nil, fmt.Errorf("model %q in %s is already defined in %s", model.Alias, file, previous)
+			}
+			sources[model.Alias] = file
+		}
+		models = append(models, included.Models...)
+	}
+	return models, nil
+}
+
+// envReference matches ${NAME} and ${NAME:-default} references, and the
+// $${ escape for a literal "${".
+var envReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// bareEnvValue matches the values a reference outside a string may expand to:
+// numbers, booleans and dates.
+var bareEnvValue = regexp.MustCompile(`^[A-Za-z0-9_.:+-]+$`)
+
+// interpolateEnv replaces environment variable references in the config
+// text, so they work in any string, number or boolean value. Values are
+// escaped for the string they appear in, and outside strings they must be
+// plain scalars, so a variable can never add keys or tables. References in
+// comments are left alone. A reference to an unset variable without a
+// default is an error.
+func interpolateEnv(text string) (string, error) {
+	var out strings.Builder
+	var missing []string
+	quote := "" // the delimiter of the string being read, if any
+	for i := 0; i < len(text); {
+		rest := text[i:]
+		if quote == "" {
+			if rest[0] == '#' {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				out.WriteString(rest[:end])
+				i += end
+				continue
+			}
+			if opening := stringDelimiter(rest); opening != "" {
+				quote = opening
+				out.WriteString(opening)
+				i += len(opening)
+				continue
+			}
+		} else {
+			if rest[0] == '\\' && (quote == `"` || quote == `"""`) && len(rest) > 1 {
+				out.WriteString(rest[:2])
+				i += 2
+				continue
+			}
+			if strings.HasPrefix(rest, quote) || (rest[0] == '\n' && len(quote) == 1) {
+				out.WriteString(rest[:len(quote)])
+				i += len(quote)
+				quote = ""
+				continue
+			}
+		}
+
+		loc := envReference.FindStringSubmatchIndex(rest)
+		if loc == nil || loc[0] != 0 {
+			out.WriteByte(rest[0])
+			i++
+			continue
+		}
+		i += loc[1]
+		if rest[:loc[1]] == "$${" {
+			out.WriteString("${")
+			continue
+		}
+		name := rest[loc[2]:loc[3]]
+		value, ok := os.LookupEnv(name)
+		if !ok && loc[4] >= 0 {
+			value, ok = rest[loc[4]:loc[5]], true
+		}
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		escaped, err := escapeEnvValue(value, quote)
+		if err != nil {
+			return "", fmt.Errorf("environment variable %s: %w", name, err)
+		}
+		out.WriteString(escaped)
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("config references unset environment variables: %s", strings.Join(missing, ", "))
+	}
+	return out.String(), nil
+}
+
+// stringDelimiter returns the TOML string delimiter text starts with, if any.
+func stringDelimiter(text string) string {
+	for _, delimiter := range []string{`"""`, `'''`, `"`, `'`} {
+		if strings.HasPrefix(text, delimiter) {
+			return delimiter
+		}
+	}
+	return ""
+}
+
+// escapeEnvValue prepares a value for the TOML context it is expanded in:
+// escaped in basic strings, checked in literal strings, which have no
+// escapes, and restricted to scalars outside strings.
+func escapeEnvValue(value, quote string) (string, error) {
+	switch quote {
+	case "":
+		if !bareEnvValue.MatchString(value) {
+			return "", fmt.Errorf("value outside a string must be a number, boolean or date; quote the reference")
+		}
+		return value, nil
+	case `"`, `"""`:
+		var out strings.Builder
+		for _, r := range value {
+			switch {
+			case r == '\\' || r == '"':
+				out.WriteByte('\\')
+				out.WriteRune(r)
+			case r == '\n':
+				out.WriteString(`\n`)
+			case r == '\t':
+				out.WriteString(`\t`)
+			case r < 0x20 || r == 0x7f:
+				fmt.Fprintf(&out, `\u%04X`, r)
+			default:
+				out.WriteRune(r)
+			}
+		}
+		return out.String(), nil
+	}
+	if strings.Contains(value, "'") || strings.ContainsFunc(value, func(r rune) bool { return r < 0x20 && r != '\t' || r == 0x7f }) {
+		return "", fmt.Errorf("value cannot be used in a literal string; use a double-quoted one")
+	}
+	return value, nil
+}
+
+// applyRouteDefaults names routing rules and rejects rules without a
+// target or a condition, or with invalid patterns or expressions.
+func applyRouteDefaults(rules []RouteRule) error {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.To == "" {
+			return fmt.Errorf("routes[%d]: to is required", i)
+		}
+		if rule.Name == "" {
+			rule.Name = rule.To
+		}
+		if len(rule.Models) == 0 && len(rule.Headers) == 0 && rule.User == "" && rule.When == "" {
+			return fmt.Errorf("route %q: set at least one of models, headers, user or when", rule.Name)
+		}
+		if rule.When != "" {
+			if _, err := expr.Compile(rule.When, RouteVariables); err != nil {
+				return fmt.Errorf("route %q: invalid when expression: %w", rule.Name, err)
+			}
+		}
+		patterns := append([]string{rule.User}, rule.Models...)
+		for _, pattern := range rule.Headers {
+			patterns = append(patterns, pattern)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("route %q: invalid pattern %q", rule.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// applyKeyDefaults resolves client key secrets and rejects keys that are
+// empty, that share a name or secret with another key, or whose allowlist
+// or routes are invalid.
+func applyKeyDefaults(keys []KeyConfig) error {
+	names := make(map[string]bool)
+	secrets := make(map[string]bool)
+	for i := range keys {
+		key := &keys[i]
+		if key.Name == "" {
+			return fmt.Errorf("keys[%d]: name is required", i)
+		}
+		secret, err := resolveSecret(key.Key)
+		if err != nil {
+			return fmt.Errorf("key %q: %w", key.Name, err)
+		}
+		key.Key = secret
+		if key.Key == "" || strings.HasPrefix(key.Key, "env:") {
+			return fmt.Errorf("key %q: key is empty or its environment variable is unset", key.Name)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("key %q is defined twice", key.Name)
+		}
+		if secrets[key.Key] {
+			return fmt.Errorf("key %q reuses the secret of another key", key.Name)
+		}
+		if key.RPM < 0 || key.TPM < 0 {
+			return fmt.Errorf("key %q: rpm and tpm must not be negative", key.Name)
+		}
+		if key.DailyBudget < 0 || key.MonthlyBudget < 0 {
+			return fmt.Errorf("key %q: budgets must not be negative", key.Name)
+		}
+		if key.Priority == "" {
+			key.Priority = "normal"
+		}
+		if key.Priority != "high" && key.Priority != "normal" && key.Priority != "low" {
+			return fmt.Errorf("key %q: unknown priority %q", key.Name, key.Priority)
+		}
+		for _, pattern := range key.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("key %q: invalid model pattern %q", key.Name, pattern)
+			}
+		}
+		names[key.Name] = true
+		secrets[key.Key] = true
+	}
+	return nil
+}
+
+// applyWeightedTargetDefaults fills in each weighted target's type and name
+// and makes the first one the model's nominal Target.
+func applyWeightedTargetDefaults(model *Model) error {
+	names := make(map[string]bool)
+	for i := range model.Targets {
+		target := &model.Targets[i]
+		if target.Type == "" {
+			target.Type = model.Type
+		}
+		if err := applyTargetDefaults(&target.Target, target.Type); err != nil {
+			return fmt.Errorf("target %d: %w", i, err)
+		}
+		if target.Name == "" {
+			target.Name = target.Target.Model
+		}
+		if target.Weight < 0 {
+			return fmt.Errorf("target %q: weight must not be negative", target.Name)
+		}
+		if target.SpillRPM < 0 || target.SpillTPM < 0 || target.SpillInFlight < 0 {
+			return fmt.Errorf("target %q: spill thresholds must not be negative", target.Name)
+		}
+		if names[target.Name] {
+			return fmt.Errorf("duplicate target name %q; set a distinct name", target.Name)
+		}
+		names[target.Name] = true
+	}
+	model.Target = model.Targets[0].Target
+	model.Type = model.Targets[0].Type
+	return nil
+}
+
+// applyRolloutDefaults fills in the green target's defaults and parses its
+// step interval.
+func applyRolloutDefaults(model *Model) error {
+	green := model.Green
+	if green.Type == "" {
+		green.Type = model.Type
+	}
+	if err := applyTargetDefaults(&green.Target, green.Type); err != nil {
+		return fmt.Errorf("green target: %w", err)
+	}
+	if green.StepPercent <= 0 {
+		green.StepPercent = 10
+	}
+	if green.MinRequests <= 0 {
+		green.MinRequests = 20
+	}
+	if green.MaxErrorRateIncrease <= 0 {
+		green.MaxErrorRateIncrease = 0.05
+	}
+	if green.MaxLatencyRatio <= 0 {
+		green.MaxLatencyRatio = 1.5
+	}
+	green.StepDuration = 5 * time.Minute
+	if green.StepInterval != "" {
+		duration, err := time.ParseDuration(green.StepInterval)
+		if err != nil {
+			return fmt.Errorf("invalid green step_interval %q: %w", green.StepInterval, err)
+		}
+		green.StepDuration = duration
+	}
+	return nil
+}
+
+// applyCanaryDefaults validates a model's canary settings and fills in
+// defaults.
+func applyCanaryDefaults(model *Model) error {
+	canary := model.Canary
+	if model.Green != nil || len(model.Targets) > 0 {
+		return fmt.Errorf("canary cannot be combined with green or targets")
+	}
+	if canary.Percent == 0 {
+		canary.Percent = 5
+	}
+	if canary.Percent < 1 || canary.Percent > 99 {
+		return fmt.Errorf("canary percent must be between 1 and 99")
+	}
+	if canary.MinRequests <= 0 {
+		canary.MinRequests = 20
+	}
+	if canary.MaxErrorRateIncrease <= 0 {
+		canary.MaxErrorRateIncrease = 0.05
+	}
+	if canary.MaxLatencyRatio <= 0 {
+		canary.MaxLatencyRatio = 1.5
+	}
+	canary.PeriodDuration = 10 * time.Minute
+	if canary.Period != "" {
+		duration, err := time.ParseDuration(canary.Period)
+		if err != nil {
+			return fmt.Errorf("invalid canary period %q: %w", canary.Period, err)
+		}
+		canary.PeriodDuration = duration
+	}
+	return nil
+}
+
+// applyExperimentDefaults validates a model's experiment and its arms.
+func applyExperimentDefaults(model *Model) error {
+	experiment := model.Experiment
+	if experiment.Name == "" {
+		experiment.Name = model.Alias
+	}
+	if experiment.HashOn == "" {
+		experiment.HashOn = "user"
+	}
+	if experiment.HashOn != "user" && experiment.HashOn != "key" {
+		return fmt.Errorf("unknown experiment hash_on %q", experiment.HashOn)
+	}
+	if len(experiment.Arms) == 0 {
+		return fmt.Errorf("experiment %q has no arms", experiment.Name)
+	}
+	names := make(map[string]bool, len(experiment.Arms))
+	total := 0.0
+	for i := range experiment.Arms {
+		arm := &experiment.Arms[i]
+		if arm.Name == "" {
+			return fmt.Errorf("experiment %q: arm %d has no name", experiment.Name, i+1)
+		}
+		if names[arm.Name] {
+			return fmt.Errorf("experiment %q: duplicate arm %q", experiment.Name, arm.Name)
+		}
+		names[arm.Name] = true
+		if arm.Percent < 0 {
+			return fmt.Errorf("experiment %q: arm %q percent cannot be negative", experiment.Name, arm.Name)
+		}
+		total += arm.Percent
+		if arm.Target != nil {
+			if arm.Type == "" {
+				arm.Type = model.Type
+			}
+			if err := applyTargetDefaults(arm.Target, arm.Type); err != nil {
+				return fmt.Errorf("experiment %q: arm %q target: %w", experiment.Name, arm.Name, err)
+			}
+		}
+		if prompt := arm.SystemPrompt; prompt != nil && prompt.Template != "" && (prompt.Prefix != "" || prompt.Suffix != "") {
+			return fmt.Errorf("experiment %q: arm %q system_prompt template cannot be combined with prefix or suffix", experiment.Name, arm.Name)
+		}
+	}
+	if math.Abs(total-100) > 1e-9 {
+		return fmt.Errorf("experiment %q: arm percentages add up to %g, not 100", experiment.Name, total)
+	}
+	return nil
+}
+
+// applyCacheDefaults validates a model's cache settings and fills in defaults.
+func applyCacheDefaults(cache *CacheConfig) error {
+	if cache.Mode == "" {
+		cache.Mode = "exact"
+	}
+	if cache.Mode != "exact" && cache.Mode != "semantic" {
+		return fmt.Errorf("unknown cache mode %q", cache.Mode)
+	}
+	cache.TTLDuration = time.Hour
+	if cache.TTL != "" {
+		duration, err := time.ParseDuration(cache.TTL)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid cache ttl %q", cache.TTL)
+		}
+		cache.TTLDuration = duration
+	}
+	if cache.MaxEntries <= 0 {
+		cache.MaxEntries = 1000
+	}
+	if cache.SimilarityThreshold == 0 {
+		cache.SimilarityThreshold = 0.95
+	}
+	if cache.SimilarityThreshold < 0 || cache.SimilarityThreshold > 1 {
+		return fmt.Errorf("cache similarity_threshold must be between 0 and 1, got %v", cache.SimilarityThreshold)
+	}
+	return nil
+}
+
+// applyContentLogDefaults validates the redaction mode and fills in the
+// redacted fields.
+func applyContentLogDefaults(contentLog *ContentLogConfig) error {
+	if contentLog.Redact == "" {
+		contentLog.Redact = "none"
+	}
+	if contentLog.Redact != "none" && contentLog.Redact != "hash" && contentLog.Redact != "drop" {
+		return fmt.Errorf("unknown content_log redact mode %q", contentLog.Redact)
+	}
+	if len(contentLog.RedactFields) == 0 {
+		contentLog.RedactFields = DefaultRedactFields
+	}
+	return nil
+}
+
+// applyGuardrailDefaults compiles the deny-lists and validates the limits
+// and output action.
+func applyGuardrailDefaults(guardrails *GuardrailConfig) error {
+	compile := func(patterns []string) ([]*regexp.Regexp, error) {
+		compiled := make([]*regexp.Regexp, 0, len(patterns))
+		for _, pattern := range patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid guardrails pattern %q: %w", pattern, err)
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled, nil
+	}
+	var err error
+	if guardrails.DenyPatterns, err = compile(guardrails.Deny); err != nil {
+		return err
+	}
+	if guardrails.DenyOutputPatterns, err = compile(guardrails.DenyOutput); err != nil {
+		return err
+	}
+	if guardrails.MaxPromptTokens < 0 {
+		return fmt.Errorf("guardrails max_prompt_tokens cannot be negative")
+	}
+	if guardrails.ModerateOutput && guardrails.ModerationAlias == "" {
+		return fmt.Errorf("guardrails moderate_output needs a moderation_alias")
+	}
+	if guardrails.OutputAction == "" {
+		guardrails.OutputAction = "block"
+	}
+	if guardrails.OutputAction != "block" && guardrails.OutputAction != "annotate" {
+		return fmt.Errorf("unknown guardrails output_action %q", guardrails.OutputAction)
+	}
+	return nil
+}
+
+// loadTokenizers reads the tiktoken files of the configured tokenizers.
+func loadTokenizers(tokenizers []TokenizerConfig) error {
+	names := make(map[string]bool)
+	for i := range tokenizers {
+		t := &tokenizers[i]
+		if t.Name == "" || t.File == "" {
+			return fmt.Errorf("tokenizers[%d]: name and file are required", i)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tokenizer %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.Pattern == "" {
+			t.Pattern = "cl100k"
+			if strings.HasPrefix(t.Name, "o200k") {
+				t.Pattern = "o200k"
+			}
+		}
+		encoding, err := tokenizer.LoadTiktoken(t.Name, t.File, t.Pattern)
+		if err != nil {
+			return fmt.Errorf("tokenizer %q: %w", t.Name, err)
+		}
+		t.Encoding = encoding
+	}
+	return nil
+}
+
+// applyTargetDefaults resolves a target's API key, fills in the defaults
+// of its settings and builds its HTTP client.
+func applyTargetDefaults(target *TargetConfig, providerType string) error {
+	if providerType == "mock" {
+		if err := applyMockDefaults(target); err != nil {
+			return err
+		}
+	}
+	if (providerType == "vertex_anthropic" || providerType == "vertex_gemini") && target.Project == "" {
+		return fmt.Errorf("%s targets need a project", providerType)
+	}
+	// Resolve secret references in API keys
+	apiKey, err := resolveSecret(target.APIKey)
+	if err != nil {
+		return fmt.Errorf("api_key: %w", err)
+	}
+	target.APIKey = apiKey
+	if err := applySigningDefaults(target.Signing); err != nil {
+		return err
+	}
+	target.CooldownDuration = 30 * time.Second
+	if target.Cooldown != "" {
+		duration, err := time.ParseDuration(target.Cooldown)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid cooldown %q", target.Cooldown)
+		}
+		target.CooldownDuration = duration
+	}
+	if batch := target.EmbeddingBatch; batch.MaxInputs < 0 || batch.Parallelism < 0 || (batch.Retries != nil && *batch.Retries < 0) {
+		return fmt.Errorf("invalid embedding_batch settings")
+	}
+	switch target.Batch {
+	case "", "emulate":
+	case "native":
+		if providerType != "openai" {
+			return fmt.Errorf("batch = \"native\" needs an openai target")
+		}
+	default:
+		return fmt.Errorf("unknown batch mode %q; use native or emulate", target.Batch)
+	}
+	if target.RateLimitReserve < 0 {
+		return fmt.Errorf("invalid rate_limit_reserve %d", target.RateLimitReserve)
+	}
+	if target.MaxInFlight < 0 {
+		return fmt.Errorf("invalid max_in_flight %d", target.MaxInFlight)
+	}
+	for _, name := range append(append([]string(nil), target.Headers.Forward...), target.Headers.Drop...) {
+		if strings.TrimSuffix(name, "*") == "" && name != "*" {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	switch target.AuthStyle {
+	case "", "bearer", "x-api-key", "api-key", "query-param":
+	default:
+		return fmt.Errorf("invalid auth_style %q", target.AuthStyle)
+	}
+	if target.MaxResponseBytes < 0 {
+		return fmt.Errorf("invalid max_response_bytes %d", target.MaxResponseBytes)
+	}
+	if err := applyTimeoutDefaults(&target.Timeouts); err != nil {
+		return err
+	}
+	if target.Pool.MaxIdleConns < 0 {
+		return fmt.Errorf("invalid pool max_idle_conns %d", target.Pool.MaxIdleConns)
+	}
+	if target.Pool.MaxIdleConns == 0 {
+		target.Pool.MaxIdleConns = 64
+	}
+	target.Pool.IdleConnTimeoutDuration = 90 * time.Second
+	if target.Pool.IdleConnTimeout != "" {
+		duration, err := time.ParseDuration(target.Pool.IdleConnTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid pool idle_conn_timeout %q", target.Pool.IdleConnTimeout)
+		}
+		target.Pool.IdleConnTimeoutDuration = duration
+	}
+	if err := applyRetryDefaults(target.Retry); err != nil {
+		return err
+	}
+	// Requests to a socket target are plain HTTP whose connections are
+	// dialed to the socket.
+	if rest, ok := strings.CutPrefix(target.URL, "unix://"); ok {
+		socket, basePath, _ := strings.Cut(rest, ":")
+		if socket == "" {
+			return fmt.Errorf("invalid url %q: no socket path", target.URL)
+		}
+		if !strings.HasPrefix(basePath, "/") {
+			basePath = "/" + basePath
+		}
+		target.Socket = socket
+		target.URL = "http://localhost" + basePath
+	}
+	target.Client = NewClient(target)
+	return nil
+}
+
+// applyTimeoutDefaults parses a target's timeouts, filling in defaults.
+func applyTimeoutDefaults(timeouts *TimeoutConfig) error {
+	for _, timeout := range []struct {
+		name     string
+		value    string
+		fallback time.Duration
+		duration *time.Duration
+	}{
+		{"connect", timeouts.Connect, 10 * time.Second, &timeouts.ConnectDuration},
+		{"response_header", timeouts.ResponseHeader, 5 * time.Minute, &timeouts.ResponseHeaderDuration},
+		{"total", timeouts.Total, 10 * time.Minute, &timeouts.TotalDuration},
+		{"stream_idle", timeouts.StreamIdle, 2 * time.Minute, &timeouts.StreamIdleDuration},
+	} {
+		*timeout.duration = timeout.fallback
+		if timeout.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(timeout.value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid %s timeout %q", timeout.name, timeout.value)
+		}
+		*timeout.duration = duration
+	}
+	return nil
+}
+
+// applyRetryDefaults fills in the retry policy's defaults and parses its
+// backoff durations.
+func applyRetryDefaults(retry *RetryConfig) error {
+	if retry == nil {
+		return nil
+	}
+	if retry.MaxAttempts <= 0 {
+		retry.MaxAttempts = 3
+	}
+	if len(retry.RetryOn) == 0 {
+		retry.RetryOn = []int{429, 502, 503, 504}
+	}
+	retry.InitialBackoffDuration = 500 * time.Millisecond
+	if retry.InitialBackoff != "" {
+		duration, err := time.ParseDuration(retry.InitialBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid retry initial_backoff %q: %w", retry.InitialBackoff, err)
+		}
+		retry.InitialBackoffDuration = duration
+	}
+	retry.MaxBackoffDuration = 10 * time.Second
+	if retry.MaxBackoff != "" {
+		duration, err := time.ParseDuration(retry.MaxBackoff)
+		if err != nil {
+			return fmt.Errorf("invalid retry max_backoff %q: %w", retry.MaxBackoff, err)
+		}
+		retry.MaxBackoffDuration = duration
+	}
+	return nil
+}
+
+// applyHealthCheckDefaults parses the health check interval and timeout.
+func applyHealthCheckDefaults(health *HealthCheckConfig) error {
+	health.IntervalDuration = 30 * time.Second
+	if health.Interval != "" {
+		duration, err := time.ParseDuration(health.Interval)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid health_check interval %q", health.Interval)
+		}
+		health.IntervalDuration = duration
+	}
+	health.TimeoutDuration = 5 * time.Second
+	if health.Timeout != "" {
+		duration, err := time.ParseDuration(health.Timeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid health_check timeout %q", health.Timeout)
+		}
+		health.TimeoutDuration = duration
+	}
+	return nil
+}
+
+// applyConcurrencyDefaults validates the global in-flight limit and parses
+// the queue timeout.
+func applyConcurrencyDefaults(concurrency *ConcurrencyConfig) error {
+	if concurrency.MaxInFlight < 0 {
+		return fmt.Errorf("invalid concurrency max_in_flight %d", concurrency.MaxInFlight)
+	}
+	if concurrency.OnLimit == "" {
+		concurrency.OnLimit = "queue"
+	}
+	if concurrency.OnLimit != "queue" && concurrency.OnLimit != "reject" {
+		return fmt.Errorf("invalid concurrency on_limit %q", concurrency.OnLimit)
+	}
+	concurrency.QueueTimeoutDuration = 30 * time.Second
+	if concurrency.QueueTimeout != "" {
+		duration, err := time.ParseDuration(concurrency.QueueTimeout)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("invalid concurrency queue_timeout %q", concurrency.QueueTimeout)
+		}
+		concurrency.QueueTimeoutDuration = duration
+	}
+	return nil
+}
+
+// applyTracingDefaults fills in the collector endpoint and service name, and
+// resolves secrets in the export headers.
+func applyTracingDefaults(tracing *TracingConfig) error {
+	if tracing.Endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			base = "http://localhost:4318"
+		}
+		tracing.Endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if tracing.ServiceName == "" {
+		tracing.ServiceName = "lmbroker"
+	}
+	for name, value := range tracing.Headers {
+		secret, err := resolveSecret(value)
+		if err != nil {
+			return fmt.Errorf("tracing header %s: %w", name, err)
+		}
+		tracing.Headers[name] = secret
+	}
+	return nil
+}
+
+// applySigningDefaults resolves the signing secret and default header names.
+func applySigningDefaults(signing *SigningConfig) error {
+	if signing == nil {
+		return nil
+	}
+	secret, err := resolveSecret(signing.Secret)
+	if err != nil {
+		return fmt.Errorf("signing secret: %w", err)
+	}
+	signing.Secret = secret
+	if signing.Secret == "" || strings.HasPrefix(signing.Secret, "env:") {
+		return fmt.Errorf("signing secret is empty or its environment variable is unset")
+	}
+	if signing.Header == "" {
+		signing.Header = "X-LMBroker-Signature"
+	}
+	if signing.TimestampHeader == "" {
+		signing.TimestampHeader = "X-LMBroker-Timestamp"
+	}
+	return nil
+}
+
+// parsePrefix accepts either a bare IP address or a CIDR range.
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
+
 // Address returns the server address in the format "host:port".
 func (s *ServerConfig) Address() string {
 	return fmt.Sprintf("%s:%d", s.Host, s.Port)
 }
+
+// BrokerRoutes are the paths the broker serves besides its embedding
+// paths; the server registers exactly these. Those ending in a slash serve
+// everything below them.
+var BrokerRoutes = []string{
+	"/health", "/health/backends", "/metrics",
+	"/admin/budgets", "/admin/usage", "/admin/requests", "/admin/models", "/admin/models/",
+	"/v1/chat/completions", "/v1/messages", "/v1/responses", "/v1/messages/count_tokens",
+	"/v1/tokenize", "/v1/tokenize/count", "/v1/completions", "/v1/images/generations",
+	"/v1/files", "/v1/files/", "/v1/batches", "/v1/batches/", "/v1/jobs/",
+	"/v1/audio/transcriptions", "/v1/audio/speech",
+}
+
+// brokerRoute returns the broker route that already serves path, if any.
+func brokerRoute(path string) (string, bool) {
+	for _, route := range BrokerRoutes {
+		if path == route || (strings.HasSuffix(route, "/") && strings.HasPrefix(path, route)) {
+			return route, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,382 @@
+package config
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("LMBROKER_TEST_HOST", "0.0.0.0")
+	t.Setenv("LMBROKER_TEST_EMPTY", "")
+
+	got, err := interpolateEnv(`host = "${LMBROKER_TEST_HOST}" port = ${LMBROKER_TEST_PORT:-9000} empty = "${LMBROKER_TEST_EMPTY:-x}" literal = "$${HOME}"`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	want := `host = "0.0.0.0" port = 9000 empty = "" literal = "${HOME}"`
+	if got != want {
+		t.Errorf("Expected %s, got: %s", want, got)
+	}
+
+	_, err = interpolateEnv(`url = "${LMBROKER_TEST_UNSET_A}/${LMBROKER_TEST_UNSET_B}"`)
+	if err == nil || !strings.Contains(err.Error(), "LMBROKER_TEST_UNSET_A, LMBROKER_TEST_UNSET_B") {
+		t.Errorf("Expected an error naming the unset variables, got: %v", err)
+	}
+
+	// Comments are left alone
+	if got, err := interpolateEnv("# set ${LMBROKER_TEST_UNSET_A} first\nport = 1 # or ${LMBROKER_TEST_UNSET_B}"); err != nil || got != "# set ${LMBROKER_TEST_UNSET_A} first\nport = 1 # or ${LMBROKER_TEST_UNSET_B}" {
+		t.Errorf("Expected comments to be kept as written, got: %q, %v", got, err)
+	}
+
+	// Values cannot break out of their string or add keys
+	t.Setenv("LMBROKER_TEST_HOSTILE", "x\"\nadmin_key = \"owned")
+	got, err = interpolateEnv(`api_key = "${LMBROKER_TEST_HOSTILE}" # "${LMBROKER_TEST_HOSTILE}"`)
+	if want := `api_key = "x\"\nadmin_key = \"owned" # "${LMBROKER_TEST_HOSTILE}"`; err != nil || got != want {
+		t.Errorf("Expected %s, got: %s (%v)", want, got, err)
+	}
+	var decoded map[string]string
+	if _, err := toml.Decode(got, &decoded); err != nil || len(decoded) != 1 || decoded["api_key"] != "x\"\nadmin_key = \"owned" {
+		t.Errorf("Expected a single api_key holding the value, got: %v (%v)", decoded, err)
+	}
+	for _, source := range []string{`port = ${LMBROKER_TEST_HOSTILE}`, `api_key = '${LMBROKER_TEST_HOSTILE}'`} {
+		if _, err := interpolateEnv(source); err == nil || !strings.Contains(err.Error(), "LMBROKER_TEST_HOSTILE") {
+			t.Errorf("%s: expected the value to be refused, got: %v", source, err)
+		}
+	}
+}
+
+func TestLoad_InterpolatesEnv(t *testing.T) {
+	t.Setenv("LMBROKER_TEST_BACKEND", "http://backend:8000/v1/")
+	t.Setenv("LMBROKER_TEST_PORT", "9090")
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`
+[server]
+  port = ${LMBROKER_TEST_PORT}
+
+[[models]]
+  alias = "local"
+  type = "openai"
+  target = { url = "${LMBROKER_TEST_BACKEND}", model = "llama3.1" }
+`), 0o644)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if cfg.Server.Port != 9090 {
+		t.Errorf("Expected port 9090, got: %d", cfg.Server.Port)
+	}
+	if cfg.Models["local"].Target.URL != "http://backend:8000/v1/" {
+		t.Errorf("Expected the interpolated URL, got: %s", cfg.Models["local"].Target.URL)
+	}
+}
+
+func TestLoad_Includes(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "models.d"), 0o755)
+	os.WriteFile(filepath.Join(dir, "config.toml"), []byte(`
+include = "models.d/*.toml"
+
+[[models]]
+  alias = "gpt-4"
+  type = "openai"
+  target = { url = "https://api.openai.com/v1/", model = "gpt-4" }
+`), 0o644)
+	os.WriteFile(filepath.Join(dir, "models.d", "search.toml"), []byte(`
+[[models]]
+  alias = "embed"
+  type = "openai"
+  target = { url = "http://localhost:11434/v1/", model = "nomic-embed-text" }
+`), 0o644)
+
+	cfg, err := Load(filepath.Join(dir, "config.toml"))
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if _, ok := cfg.Models["gpt-4"]; !ok {
+		t.Errorf("Expected the main file's model, got: %v", cfg.Models)
+	}
+	if _, ok := cfg.Models["embed"]; !ok {
+		t.Errorf("Expected the included model, got: %v", cfg.Models)
+	}
+
+	// An alias defined in two files is rejected
+	os.WriteFile(filepath.Join(dir, "models.d", "team.toml"), []byte(`
+[[models]]
+  alias = "gpt-4"
+  type = "openai"
+  target = { url = "https://other/v1/", model = "gpt-4" }
+`), 0o644)
+	_, err = Load(filepath.Join(dir, "config.toml"))
+	if err == nil || !strings.Contains(err.Error(), "team.toml") || !strings.Contains(err.Error(), "config.toml") {
+		t.Errorf("Expected a duplicate alias error naming both files, got: %v", err)
+	}
+
+	// Included files may not change other settings
+	os.WriteFile(filepath.Join(dir, "models.d", "team.toml"), []byte(`log_level = "debug"`), 0o644)
+	if _, err = Load(filepath.Join(dir, "config.toml")); err == nil {
+		t.Errorf("Expected an error for a non-model setting in an included file")
+	}
+}
+
+func TestLoad_TargetClients(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`
+[[models]]
+  alias = "local"
+  type = "openai"
+  target = { url = "http://backend:8000/v1/", model = "llama3.1", pool = { max_idle_conns = 8, disable_http2 = true } }
+
+[[models]]
+  alias = "remote"
+  type = "openai"
+  target = { url = "https://api.openai.com/v1/", model = "gpt-4o", timeouts = { response_header = "30s" } }
+`), 0o644)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	local, remote := cfg.Models["local"].Target.Client, cfg.Models["remote"].Target.Client
+	if local == nil || remote == nil || local == remote {
+		t.Fatalf("Expected a client per target, got: %v %v", local, remote)
+	}
+	transport := local.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 8 || transport.ForceAttemptHTTP2 || transport.IdleConnTimeout != 90*time.Second {
+		t.Errorf("Expected the local pool settings, got: %d %v %v", transport.MaxIdleConnsPerHost, transport.ForceAttemptHTTP2, transport.IdleConnTimeout)
+	}
+	transport = remote.Transport.(*http.Transport)
+	if transport.MaxIdleConnsPerHost != 64 || !transport.ForceAttemptHTTP2 || transport.ResponseHeaderTimeout != 30*time.Second {
+		t.Errorf("Expected default pool settings and the header timeout, got: %d %v %v", transport.MaxIdleConnsPerHost, transport.ForceAttemptHTTP2, transport.ResponseHeaderTimeout)
+	}
+}
+
+func TestLoad_UnixSocketTarget(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, so avoid the long test
+	// directory.
+	dir, err := os.MkdirTemp("", "lmb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "backend.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	backend.Listener = listener
+	backend.Start()
+	defer backend.Close()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`
+[[models]]
+  alias = "local"
+  type = "openai"
+  target = { url = "unix://`+socket+`:/v1/", model = "llama3.1" }
+`), 0o644)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	target := cfg.Models["local"].Target
+	if target.URL != "http://localhost/v1/" || target.Socket != socket {
+		t.Fatalf("Expected the socket and base path to be split, got: %s %s", target.URL, target.Socket)
+	}
+	resp, err := target.Client.Get(target.URL + "models")
+	if err != nil {
+		t.Fatalf("Expected the request to reach the socket, got: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/v1/models" {
+		t.Errorf("Expected /v1/models, got: %s", body)
+	}
+}
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("LMBROKER_TEST_KEY", "sk-env")
+	keyFile := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(keyFile, []byte("sk-file\n"), 0o600)
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/lmbroker":
+			w.Write([]byte(`{"data": {"data": {"openai": "sk-vault"}, "metadata": {"version": 3}}}`))
+		case "/v1/kv/lmbroker":
+			w.Write([]byte(`{"data": {"value": "sk-vault-v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "vault-token")
+
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": map[string]string{
+			"prod/openai": "sk-aws",
+			"prod/keys":   `{"anthropic": "sk-aws-json"}`,
+		}[body["SecretId"]]})
+	}))
+	defer aws.Close()
+	t.Setenv("AWS_ENDPOINT_URL_SECRETS_MANAGER", aws.URL)
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+
+	for value, want := range map[string]string{
+		"sk-literal":                        "sk-literal",
+		"env:LMBROKER_TEST_KEY":             "sk-env",
+		"env:LMBROKER_TEST_UNSET":           "env:LMBROKER_TEST_UNSET",
+		"file:" + keyFile:                   "sk-file",
+		"vault:secret/data/lmbroker#openai": "sk-vault",
+		"vault:kv/lmbroker":                 "sk-vault-v1",
+		"awssm:prod/openai":                 "sk-aws",
+		"awssm:prod/keys#anthropic":         "sk-aws-json",
+	} {
+		got, err := resolveSecret(value)
+		if err != nil || got != want {
+			t.Errorf("Expected %s to resolve to %s, got: %q %v", value, want, got, err)
+		}
+	}
+
+	// References that cannot be resolved fail the load
+	for _, value := range []string{"file:/nonexistent/key", "vault:secret/data/missing", "vault:secret/data/lmbroker#other"} {
+		if _, err := resolveSecret(value); err == nil {
+			t.Errorf("Expected an error for %s", value)
+		}
+	}
+}
+
+func TestCheckReferences_ModerationCycle(t *testing.T) {
+	moderatedBy := func(alias, moderator string) Model {
+		return Model{Alias: alias, Guardrails: &GuardrailConfig{ModerationAlias: moderator}}
+	}
+	cfg := &Config{Models: map[string]Model{"a": moderatedBy("a", "b"), "b": moderatedBy("b", "c"), "c": {Alias: "c"}}}
+	if err := CheckReferences(cfg); err != nil {
+		t.Errorf("Expected a chain of moderators to be valid, got: %v", err)
+	}
+	cfg.Models["c"] = moderatedBy("c", "a")
+	if err := CheckReferences(cfg); err == nil || !strings.Contains(err.Error(), "leads back") {
+		t.Errorf("Expected a moderation cycle to be rejected, got: %v", err)
+	}
+}
+
+func TestCheckReferences_EvalAlias(t *testing.T) {
+	cfg := &Config{Models: map[string]Model{"a": {Alias: "a", EvalAlias: "missing"}}}
+	if err := CheckReferences(cfg); err == nil || !strings.Contains(err.Error(), "eval_alias") {
+		t.Errorf("Expected an unknown eval_alias to be rejected, got: %v", err)
+	}
+}
+
+func TestPrepareModel_VertexProject(t *testing.T) {
+	for _, providerType := range []string{"vertex_anthropic", "vertex_gemini"} {
+		model := Model{Alias: "a", Type: providerType, Target: TargetConfig{Model: "m", Region: "us-east5"}}
+		if err := PrepareModel(&model); err == nil || !strings.Contains(err.Error(), "project") {
+			t.Errorf("%s: expected a missing project to be rejected, got: %v", providerType, err)
+		}
+		model.Target.Project = "my-project"
+		if err := PrepareModel(&model); err != nil {
+			t.Errorf("%s: expected no error, got: %v", providerType, err)
+		}
+	}
+}
+
+func TestPrepareModel_CodeExecution(t *testing.T) {
+	for mode, wantErr := range map[string]bool{"": false, "native": false, "function": false, "disabled": false, "sandbox": true} {
+		model := Model{Alias: "a", Type: "openai", CodeExecution: mode}
+		if err := PrepareModel(&model); (err != nil) != wantErr {
+			t.Errorf("code_execution %q: expected error %v, got: %v", mode, wantErr, err)
+		}
+	}
+}
+
+func TestCompressionValidation(t *testing.T) {
+	model := Model{Alias: "a", Type: "openai", Compression: CompressionConfig{MaxPromptTokens: 100, Strategies: []string{"shorten"}}}
+	if err := PrepareModel(&model); err == nil || !strings.Contains(err.Error(), "unknown compression strategy") {
+		t.Errorf("Expected an unknown strategy to be rejected, got: %v", err)
+	}
+	model.Compression.Strategies = []string{"summarize"}
+	if err := PrepareModel(&model); err == nil || !strings.Contains(err.Error(), "requires summarizer_alias") {
+		t.Errorf("Expected summarize without an alias to be rejected, got: %v", err)
+	}
+
+	summarize := func(alias string) CompressionConfig {
+		return CompressionConfig{MaxPromptTokens: 100, Strategies: []string{"summarize"}, SummarizerAlias: alias}
+	}
+	for name, models := range map[string]map[string]Model{
+		"missing": {"a": {Alias: "a", Compression: summarize("missing")}},
+		"self":    {"a": {Alias: "a", Compression: summarize("a")}},
+		"cycle":   {"a": {Alias: "a", Compression: summarize("b")}, "b": {Alias: "b", Compression: summarize("a")}},
+	} {
+		if err := CheckReferences(&Config{Models: models}); err == nil || !strings.Contains(err.Error(), "summarizer_alias") {
+			t.Errorf("%s: expected the summarizer_alias to be rejected, got: %v", name, err)
+		}
+	}
+	chain := map[string]Model{"a": {Alias: "a", Compression: summarize("b")}, "b": {Alias: "b"}}
+	if err := CheckReferences(&Config{Models: chain}); err != nil {
+		t.Errorf("Expected a summarizer without its own summarizer to be accepted, got: %v", err)
+	}
+}
+
+func TestCheckReferences_GatewayTools(t *testing.T) {
+	cfg := &Config{
+		Models:  map[string]Model{"a": {Alias: "a", GatewayTools: []string{"get_time", "docs"}}},
+		Gateway: GatewayConfig{Tools: []GatewayTool{{Name: "get_time"}}, MCPServers: []MCPServer{{Name: "docs"}}},
+	}
+	if err := CheckReferences(cfg); err != nil {
+		t.Errorf("Expected configured gateway tools to be accepted, got: %v", err)
+	}
+	cfg.Models["a"] = Model{Alias: "a", GatewayTools: []string{"missing"}}
+	if err := CheckReferences(cfg); err == nil || !strings.Contains(err.Error(), "gateway_tools") {
+		t.Errorf("Expected an unknown gateway tool to be rejected, got: %v", err)
+	}
+}
+
+func TestLoad_EmbeddingPathCollisions(t *testing.T) {
+	for path, wantErr := range map[string]bool{
+		"/v1/tokenize":         true,
+		"/v1/chat/completions": true,
+		"/v1/files/embed":      true,
+		"/v2/embed":            false,
+		"/custom/embed":        false,
+	} {
+		configPath := filepath.Join(t.TempDir(), "config.toml")
+		os.WriteFile(configPath, []byte(`
+[server]
+  embedding_paths = { "`+path+`" = "openai" }
+`), 0o644)
+		_, err := Load(configPath)
+		if wantErr && (err == nil || !strings.Contains(err.Error(), "already served")) {
+			t.Errorf("Path %s: expected a collision error, got: %v", path, err)
+		}
+		if !wantErr && err != nil {
+			t.Errorf("Path %s: expected no error, got: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// MockConfig sets how a "mock" target answers. Mock targets are served by
+// the broker itself, speaking the OpenAI API, so clients and CI can use the
+// broker without calling any backend.
+type MockConfig struct {
+	// Response is the content of every answer. It may use {{input}}, the
+	// last user message or prompt, and {{model}}, the requested model.
+	// Defaults to "{{input}}", echoing the input back.
+	Response string `toml:"response"`
+	// Latency is how long the target waits before answering.
+	Latency         string        `toml:"latency"`
+	LatencyDuration time.Duration `toml:"-"` // Populated after parsing
+	// ChunkDelay is the pause between the chunks of a streamed answer,
+	// which is sent one word per chunk.
+	ChunkDelay         string        `toml:"chunk_delay"`
+	ChunkDelayDuration time.Duration `toml:"-"` // Populated after parsing
+}
+
+// applyMockDefaults gives a mock target its settings and a placeholder URL.
+func applyMockDefaults(target *TargetConfig) error {
+	if target.Mock == nil {
+		target.Mock = &MockConfig{}
+	}
+	if target.URL == "" {
+		target.URL = "http://mock/"
+	}
+	mock := target.Mock
+	if mock.Response == "" {
+		mock.Response = "{{input}}"
+	}
+	for _, delay := range []struct {
+		name     string
+		value    string
+		duration *time.Duration
+	}{
+		{"latency", mock.Latency, &mock.LatencyDuration},
+		{"chunk_delay", mock.ChunkDelay, &mock.ChunkDelayDuration},
+	} {
+		if delay.value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(delay.value)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid mock %s %q", delay.name, delay.value)
+		}
+		*delay.duration = duration
+	}
+	return nil
+}
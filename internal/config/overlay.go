@@ -0,0 +1,203 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ModelOverlay is the models file written by the admin API: models that
+// replace or add to the configured ones, and aliases that were removed.
+// Models are kept as they were submitted, before defaults are applied, so
+// "env:NAME" secrets stay references.
+type ModelOverlay struct {
+	Removed []string `toml:"removed"`
+	Models  []Model  `toml:"models"`
+}
+
+// LoadOverlay reads a models file. A missing file is an empty overlay.
+func LoadOverlay(path string) (*ModelOverlay, error) {
+	overlay := &ModelOverlay{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return overlay, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := toml.Decode(string(data), overlay); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return overlay, nil
+}
+
+// Set records a model, replacing any earlier version of it.
+func (o *ModelOverlay) Set(model Model) {
+	o.Removed = slices.DeleteFunc(o.Removed, func(alias string) bool { return alias == model.Alias })
+	for i := range o.Models {
+		if o.Models[i].Alias == model.Alias {
+			o.Models[i] = model
+			return
+		}
+	}
+	o.Models = append(o.Models, model)
+}
+
+// Remove records that a model was removed.
+func (o *ModelOverlay) Remove(alias string) {
+	o.Models = slices.DeleteFunc(o.Models, func(model Model) bool { return model.Alias == alias })
+	if !slices.Contains(o.Removed, alias) {
+		o.Removed = append(o.Removed, alias)
+	}
+}
+
+// Save writes the overlay to path, replacing the file in one step so a
+// crash never leaves it half written.
+func (o *ModelOverlay) Save(path string) error {
+	models := make([]map[string]interface{}, 0, len(o.Models))
+	for _, model := range o.Models {
+		table, err := ModelTable(model)
+		if err != nil {
+			return err
+		}
+		models = append(models, table)
+	}
+	sort.Strings(o.Removed)
+
+	var buf bytes.Buffer
+	buf.WriteString("# Models managed through the lmbroker admin API (/admin/models).\n")
+	if err := toml.NewEncoder(&buf).Encode(map[string]interface{}{"removed": o.Removed, "models": models}); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), ".models-*.toml")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(buf.Bytes()); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// apply returns the configured models with the overlay's changes.
+func (o *ModelOverlay) apply(models []Model) []Model {
+	result := make([]Model, 0, len(models)+len(o.Models))
+	for _, model := range models {
+		replaced := slices.ContainsFunc(o.Models, func(other Model) bool { return other.Alias == model.Alias })
+		if !replaced && !slices.Contains(o.Removed, model.Alias) {
+			result = append(result, model)
+		}
+	}
+	return append(result, o.Models...)
+}
+
+// ModelTable returns a model as it would be written in config.toml, with
+// unset fields left out.
+func ModelTable(model Model) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(model); err != nil {
+		return nil, err
+	}
+	var table map[string]interface{}
+	if _, err := toml.Decode(buf.String(), &table); err != nil {
+		return nil, err
+	}
+	compact(table, reflect.TypeOf(model))
+	return table, nil
+}
+
+// copyModel returns a deep copy of a model as written, which preparing the
+// original leaves untouched.
+func copyModel(model Model) (Model, error) {
+	table, err := ModelTable(model)
+	if err != nil {
+		return Model{}, err
+	}
+	return ModelFromTable(table)
+}
+
+// ModelFromTable decodes a model given as a table of config.toml fields,
+// rejecting fields that do not exist.
+func ModelFromTable(table map[string]interface{}) (Model, error) {
+	var model Model
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(table); err != nil {
+		return model, err
+	}
+	meta, err := toml.Decode(buf.String(), &model)
+	if err != nil {
+		return model, err
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		return model, fmt.Errorf("unknown field %q", undecoded[0].String())
+	}
+	return model, nil
+}
+
+// compact removes unset fields from a table decoded from the Go type t:
+// zero values, empty lists, and empty tables of non-pointer structs. An
+// empty table of a pointer field, like `cache = {}`, turns a feature on,
+// so it is kept, as are zero values of pointer fields.
+func compact(table map[string]interface{}, t reflect.Type) {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name, _, _ := strings.Cut(field.Tag.Get("toml"), ","); name != "" && name != "-" {
+			fields[name] = field.Type
+		}
+	}
+	for key, value := range table {
+		fieldType, ok := fields[key]
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			switch fieldType.Kind() {
+			case reflect.Struct:
+				compact(v, fieldType)
+				if len(v) == 0 {
+					delete(table, key)
+				}
+			case reflect.Pointer:
+				compact(v, fieldType.Elem())
+			default:
+				if len(v) == 0 {
+					delete(table, key)
+				}
+			}
+		case []map[string]interface{}:
+			for _, item := range v {
+				compact(item, fieldType.Elem())
+			}
+			if len(v) == 0 {
+				delete(table, key)
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				delete(table, key)
+			}
+		default:
+			// A set pointer, like `log_content = false`, is kept even
+			// when its value is zero.
+			if fieldType.Kind() == reflect.Pointer {
+				continue
+			}
+			if value == nil || reflect.ValueOf(value).IsZero() {
+				delete(table, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package config
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secrets such as API keys may be given literally or as a reference that is
+// resolved every time the configuration is loaded:
+//
+//	env:NAME                  the environment variable NAME
+//	file:/path/to/key         the file's contents, surrounding whitespace trimmed
+//	vault:secret/data/app#key field key of a Vault secret (KV v1 or v2)
+//	awssm:name                an AWS Secrets Manager secret string
+//	awssm:name#key            field key of a JSON secret string
+//
+// Vault is reached at VAULT_ADDR with VAULT_TOKEN (and VAULT_NAMESPACE if
+// set); the field defaults to "value". AWS credentials and region come from
+// the standard AWS_* environment variables.
+
+// secretClient fetches secrets from Vault and AWS Secrets Manager.
+var secretClient = &http.Client{Timeout: 10 * time.Second}
+
+// resolveSecret returns the value a secret reference points to, or the
+// value itself if it is not a reference. An unset environment variable
+// keeps the literal "env:NAME", which callers that require the secret
+// reject; other references that cannot be resolved are errors.
+func resolveSecret(value string) (string, error) {
+	scheme, ref, found := strings.Cut(value, ":")
+	if !found {
+		return value, nil
+	}
+	switch scheme {
+	case "env":
+		if envValue := os.Getenv(ref); envValue != "" {
+			return envValue, nil
+		}
+		return value, nil
+	case "file":
+		data, err := os.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", value, err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	case "vault":
+		secret, err := vaultSecret(ref)
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", value, err)
+		}
+		return secret, nil
+	case "awssm":
+		secret, err := awsSecret(ref, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %w", value, err)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// vaultSecret reads a field of a Vault secret, given as "path#field".
+func vaultSecret(ref string) (string, error) {
+	secretPath, field, _ := strings.Cut(ref, "#")
+	if field == "" {
+		field = "value"
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is unset")
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(secretPath, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := fetchSecret(req, &body); err != nil {
+		return "", err
+	}
+	// KV version 2 nests the secret's fields one level deeper.
+	fields := body.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		if _, versioned := fields["metadata"]; versioned {
+			fields = nested
+		}
+	}
+	secret, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %q not found", field)
+	}
+	return secret, nil
+}
+
+// awsSecret reads an AWS Secrets Manager secret, given as "name" or
+// "name#field" for a field of a JSON secret.
+func awsSecret(ref string, now time.Time) (string, error) {
+	secretID, field, _ := strings.Cut(ref, "#")
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	payload, _ := json.Marshal(map[string]string{"SecretId": secretID})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, payload, region, "secretsmanager", accessKey, secretKey, now)
+
+	var body struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := fetchSecret(req, &body); err != nil {
+		return "", err
+	}
+	if field == "" {
+		return body.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(body.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("secret string is not a JSON object")
+	}
+	secret, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %q not found", field)
+	}
+	return secret, nil
+}
+
+// fetchSecret sends a request to a secrets backend and decodes its JSON
+// answer.
+func fetchSecret(req *http.Request, v interface{}) error {
+	resp, err := secretClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s answered %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// signAWSRequest signs a request with AWS Signature Version 4.
+func signAWSRequest(req *http.Request, payload []byte, region, service, accessKey, secretKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// 1. Build the canonical request from the signed headers.
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	// 2. Sign it with a key derived for the day, region and service.
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// canonicalQuery encodes query parameters sorted by name, as signing
+// requires.
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,745 @@
+// Package expr evaluates the small expression language routing rules are
+// written in. Its syntax is a subset of CEL: numbers, strings, booleans,
+// lists, the usual arithmetic, comparison and logical operators, the
+// conditional operator, `in` on lists and maps, indexing, and the
+// functions size, startsWith, endsWith, contains, matches and lower.
+// Expressions are parsed once and evaluated against a set of variables.
+package expr
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Program is a parsed expression.
+type Program struct {
+	source string
+	root   node
+	vars   map[string]bool
+}
+
+// Compile parses an expression that may refer to the given variables.
+func Compile(source string, variables []string) (*Program, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, variables: variables, used: make(map[string]bool)}
+	root, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+	}
+	return &Program{source: source, root: root, vars: p.used}, nil
+}
+
+// String returns the expression's source.
+func (p *Program) String() string { return p.source }
+
+// Uses reports whether the expression refers to a variable, so costly
+// variables need only be computed when they are.
+func (p *Program) Uses(variable string) bool { return p.vars[variable] }
+
+// Eval evaluates the expression. Numbers are float64, maps are
+// map[string]interface{} and lists []interface{}; ints and map[string]string
+// variables are converted.
+func (p *Program) Eval(variables map[string]interface{}) (interface{}, error) {
+	env := make(map[string]interface{}, len(variables))
+	for name, value := range variables {
+		env[name] = normalize(value)
+	}
+	return p.root.eval(env)
+}
+
+// EvalBool evaluates an expression that must be true or false.
+func (p *Program) EvalBool(variables map[string]interface{}) (bool, error) {
+	value, err := p.Eval(variables)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is %s, not a bool", typeName(value))
+	}
+	return result, nil
+}
+
+// normalize converts variable values to the types expressions work with.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			m[key] = item
+		}
+		return m
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = item
+		}
+		return list
+	}
+	return value
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Lexing
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+	// value is the decoded number or string.
+	value interface{}
+}
+
+// operators are tried longest first.
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", ".", "?", ":"}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			number, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", source[start:i], start)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[start:i], pos: start, value: number})
+
+		case c == '"' || c == '\'':
+			start := i
+			var text strings.Builder
+			for i++; ; i++ {
+				if i >= len(source) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				if source[i] == c {
+					i++
+					break
+				}
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+					switch source[i] {
+					case 'n':
+						text.WriteByte('\n')
+					case 't':
+						text.WriteByte('\t')
+					default:
+						text.WriteByte(source[i])
+					}
+					continue
+				}
+				text.WriteByte(source[i])
+			}
+			tokens = append(tokens, token{kind: tokenString, text: source[start:i], pos: start, value: text.String()})
+
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] >= 'a' && source[i] <= 'z' || source[i] >= 'A' && source[i] <= 'Z' || source[i] >= '0' && source[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[start:i], pos: start})
+
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "end of expression", pos: len(source)}), nil
+}
+
+// Parsing
+
+type parser struct {
+	tokens    []token
+	next      int
+	variables []string
+	used      map[string]bool
+}
+
+func (p *parser) peek() token { return p.tokens[p.next] }
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tokenEOF {
+		p.next++
+	}
+	return tok
+}
+
+// accept consumes the operator or keyword if it comes next.
+func (p *parser) accept(text string) bool {
+	if tok := p.peek(); (tok.kind == tokenOp || tok.kind == tokenIdent) && tok.text == text {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at %d, got %q", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+// expression parses a conditional: or ? expression : expression.
+func (p *parser) expression() (node, error) {
+	condition, err := p.or()
+	if err != nil || !p.accept("?") {
+		return condition, err
+	}
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return conditionalNode{condition, then, otherwise}, nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right node
+		right, err = p.and()
+		left = logicalNode{"||", left, right}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.relation()
+	for err == nil && p.accept("&&") {
+		var right node
+		right, err = p.relation()
+		left = logicalNode{"&&", left, right}
+	}
+	return left, err
+}
+
+func (p *parser) relation() (node, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+		if p.accept(op) {
+			right, err := p.additive()
+			if err != nil {
+				return nil, err
+			}
+			return binaryNode{op, left, right}, nil
+		}
+	}
+	return left, nil
+}
+
+func (p *parser) additive() (node, error) {
+	left, err := p.multiplicative()
+	for err == nil {
+		op := p.peek().text
+		if p.peek().kind != tokenOp || (op != "+" && op != "-") {
+			break
+		}
+		p.advance()
+		var right node
+		right, err = p.multiplicative()
+		left = binaryNode{op, left, right}
+	}
+	return left, err
+}
+
+func (p *parser) multiplicative() (node, error) {
+	left, err := p.unary()
+	for err == nil {
+		op := p.peek().text
+		if p.peek().kind != tokenOp || (op != "*" && op != "/" && op != "%") {
+			break
+		}
+		p.advance()
+		var right node
+		right, err = p.unary()
+		left = binaryNode{op, left, right}
+	}
+	return left, err
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("!") {
+		operand, err := p.unary()
+		return unaryNode{"!", operand}, err
+	}
+	if p.accept("-") {
+		operand, err := p.unary()
+		return unaryNode{"-", operand}, err
+	}
+	return p.postfix()
+}
+
+func (p *parser) postfix() (node, error) {
+	target, err := p.primary()
+	for err == nil {
+		switch {
+		case p.accept("."):
+			name := p.advance()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expected a name after . at %d", name.pos)
+			}
+			if p.accept("(") {
+				var args []node
+				if args, err = p.arguments(")"); err == nil {
+					target, err = newCall(name, append([]node{target}, args...), true)
+				}
+			} else {
+				target = indexNode{target, literalNode{name.text}}
+			}
+		case p.accept("["):
+			var index node
+			if index, err = p.expression(); err == nil {
+				err = p.expect("]")
+			}
+			target = indexNode{target, index}
+		default:
+			return target, nil
+		}
+	}
+	return nil, err
+}
+
+func (p *parser) arguments(closing string) ([]node, error) {
+	var args []node
+	if p.accept(closing) {
+		return args, nil
+	}
+	for {
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.accept(closing) {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) primary() (node, error) {
+	tok := p.advance()
+	switch tok.kind {
+	case tokenNumber, tokenString:
+		return literalNode{tok.value}, nil
+	case tokenIdent:
+		switch tok.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.arguments(")")
+			if err != nil {
+				return nil, err
+			}
+			return newCall(tok, args, false)
+		}
+		if !slices.Contains(p.variables, tok.text) {
+			return nil, fmt.Errorf("unknown variable %q at %d", tok.text, tok.pos)
+		}
+		p.used[tok.text] = true
+		return variableNode{tok.text}, nil
+	case tokenOp:
+		if tok.text == "(" {
+			inner, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+		if tok.text == "[" {
+			items, err := p.arguments("]")
+			return listNode{items}, err
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.text, tok.pos)
+}
+
+// functionArity is how many arguments each function takes, counting the
+// receiver of a method call.
+var functionArity = map[string]int{
+	"size": 1, "startsWith": 2, "endsWith": 2, "contains": 2, "matches": 2, "lower": 1,
+}
+
+func newCall(name token, args []node, method bool) (node, error) {
+	arity, ok := functionArity[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.text, name.pos)
+	}
+	if len(args) != arity {
+		if method {
+			return nil, fmt.Errorf("%s takes %d arguments at %d", name.text, arity-1, name.pos)
+		}
+		return nil, fmt.Errorf("%s takes %d arguments at %d", name.text, arity, name.pos)
+	}
+	call := callNode{name: name.text, args: args}
+	// A literal pattern is compiled, and checked, once.
+	if pattern, ok := args[len(args)-1].(literalNode); ok && name.text == "matches" {
+		text, ok := pattern.value.(string)
+		if !ok {
+			return nil, fmt.Errorf("matches takes a string pattern at %d", name.pos)
+		}
+		re, err := regexp.Compile(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q at %d: %v", text, name.pos, err)
+		}
+		call.pattern = re
+	}
+	return call, nil
+}
+
+// Evaluation
+
+type node interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type literalNode struct{ value interface{} }
+
+func (n literalNode) eval(map[string]interface{}) (interface{}, error) { return n.value, nil }
+
+type variableNode struct{ name string }
+
+func (n variableNode) eval(env map[string]interface{}) (interface{}, error) {
+	return env[n.name], nil
+}
+
+type listNode struct{ items []node }
+
+func (n listNode) eval(env map[string]interface{}) (interface{}, error) {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+type conditionalNode struct{ condition, then, otherwise node }
+
+func (n conditionalNode) eval(env map[string]interface{}) (interface{}, error) {
+	condition, err := evalBool(n.condition, env, "?:")
+	if err != nil {
+		return nil, err
+	}
+	if condition {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type logicalNode struct {
+	op          string
+	left, right node
+}
+
+func (n logicalNode) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := evalBool(n.left, env, n.op)
+	if err != nil {
+		return nil, err
+	}
+	if (n.op == "&&" && !left) || (n.op == "||" && left) {
+		return left, nil
+	}
+	return evalBool(n.right, env, n.op)
+}
+
+func evalBool(n node, env map[string]interface{}, op string) (bool, error) {
+	value, err := n.eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s needs bools, got %s", op, typeName(value))
+	}
+	return result, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n unaryNode) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case bool:
+		if n.op == "!" {
+			return !v, nil
+		}
+	case float64:
+		if n.op == "-" {
+			return -v, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %s to %s", n.op, typeName(value))
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n binaryNode) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []interface{}:
+			return slices.ContainsFunc(container, func(item interface{}) bool { return equal(left, item) }), nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			if !ok {
+				return false, nil
+			}
+			_, found := container[key]
+			return found, nil
+		}
+		return nil, fmt.Errorf("in needs a list or map, got %s", typeName(right))
+	}
+
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			switch n.op {
+			case "+":
+				return l + r, nil
+			case "<":
+				return l < r, nil
+			case "<=":
+				return l <= r, nil
+			case ">":
+				return l > r, nil
+			case ">=":
+				return l >= r, nil
+			}
+		}
+	}
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("cannot apply %s to %s and %s", n.op, typeName(left), typeName(right))
+	}
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "%":
+		// Modulo works on the integer parts, so 0.5 is a zero divisor too.
+		if int64(r) == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return float64(int64(l) % int64(r)), nil
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+// equal compares scalars by value; lists and maps are never equal.
+func equal(left, right interface{}) bool {
+	switch left.(type) {
+	case []interface{}, map[string]interface{}:
+		return false
+	}
+	switch right.(type) {
+	case []interface{}, map[string]interface{}:
+		return false
+	}
+	return left == right
+}
+
+type indexNode struct{ target, index node }
+
+// eval looks up a map key, which is null when missing, or a list element.
+func (n indexNode) eval(env map[string]interface{}) (interface{}, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch container := target.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys are strings, got %s", typeName(index))
+		}
+		return container[key], nil
+	case []interface{}:
+		i, ok := index.(float64)
+		if !ok || i != float64(int(i)) || i < 0 || int(i) >= len(container) {
+			return nil, fmt.Errorf("invalid list index %v", index)
+		}
+		return container[int(i)], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(target))
+}
+
+type callNode struct {
+	name    string
+	args    []node
+	pattern *regexp.Regexp
+}
+
+func (n callNode) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	if n.name == "size" {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		}
+		return nil, fmt.Errorf("size needs a string, list or map, got %s", typeName(args[0]))
+	}
+
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s needs strings, got %s", n.name, typeName(arg))
+		}
+		strs[i] = s
+	}
+	switch n.name {
+	case "startsWith":
+		return strings.HasPrefix(strs[0], strs[1]), nil
+	case "endsWith":
+		return strings.HasSuffix(strs[0], strs[1]), nil
+	case "contains":
+		return strings.Contains(strs[0], strs[1]), nil
+	case "lower":
+		return strings.ToLower(strs[0]), nil
+	case "matches":
+		re := n.pattern
+		if re == nil {
+			var err error
+			if re, err = regexp.Compile(strs[1]); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", strs[1], err)
+			}
+		}
+		return re.MatchString(strs[0]), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", n.name)
+}
@@ -0,0 +1,107 @@
+package expr
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProgram_Eval(t *testing.T) {
+	variables := map[string]interface{}{
+		"model":    "gpt-4o",
+		"messages": 12,
+		"tokens":   int64(9000),
+		"stream":   true,
+		"headers":  map[string]string{"x-team": "research"},
+		"tags":     []string{"beta", "eu"},
+	}
+	names := []string{"model", "messages", "tokens", "stream", "headers", "tags", "user"}
+
+	cases := []struct {
+		source string
+		want   interface{}
+	}{
+		{`model == "gpt-4o"`, true},
+		{`model.startsWith('gpt-') && tokens > 8000`, true},
+		{`messages > 10 || tokens < 100`, true},
+		{`!stream`, false},
+		{`headers["x-team"] == "research"`, true},
+		{`headers.missing == null`, true},
+		{`"x-team" in headers && !("x-org" in headers)`, true},
+		{`"eu" in tags && size(tags) == 2`, true},
+		{`model in ["gpt-4o", "o1"]`, true},
+		{`model.matches("^gpt-4(o|-turbo)$")`, true},
+		{`lower("ABC") + "d"`, "abcd"},
+		{`tokens / 1000 + messages * 2 - 1`, float64(32)},
+		{`tokens % 7`, float64(5)},
+		{`-messages < 0 ? "long" : "short"`, "long"},
+		{`user == null || user.startsWith("free")`, true},
+		{`tags[1]`, "eu"},
+	}
+	for _, tc := range cases {
+		program, err := Compile(tc.source, names)
+		if err != nil {
+			t.Errorf("%s: failed to compile: %v", tc.source, err)
+			continue
+		}
+		got, err := program.Eval(variables)
+		if err != nil || got != tc.want {
+			t.Errorf("%s: expected %v, got: %v (%v)", tc.source, tc.want, got, err)
+		}
+	}
+
+	// Only the variables the expression refers to are used
+	program, _ := Compile(`model == "x" || messages > 1`, names)
+	if !program.Uses("messages") || program.Uses("tokens") {
+		t.Errorf("Expected messages and not tokens to be used")
+	}
+}
+
+func TestCompile_Errors(t *testing.T) {
+	cases := map[string]string{
+		`model ==`:              "unexpected",
+		`modle == "x"`:          "unknown variable",
+		`model.startsWith()`:    "takes 1 arguments",
+		`model.shout()`:         "unknown function",
+		`model.matches("(")`:    "invalid pattern",
+		`"unterminated`:         "unterminated string",
+		`model == "x" model`:    "unexpected",
+		`(model == "x"`:         "expected \")\"",
+		`messages < 1 < 2`:      "unexpected",
+		`model # "x"`:           "unexpected character",
+		`stream ? "a"`:          "expected \":\"",
+		`[model, messages`:      "expected \",\"",
+		`headers[`:              "unexpected",
+		`model.startsWith("a",`: "unexpected",
+	}
+	for source, want := range cases {
+		_, err := Compile(source, []string{"model", "messages", "stream", "headers"})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got: %v", source, want, err)
+		}
+	}
+}
+
+func TestProgram_EvalErrors(t *testing.T) {
+	variables := map[string]interface{}{"model": "gpt-4o", "messages": 3}
+	for _, source := range []string{
+		`model > 3`,
+		`messages && true`,
+		`messages / 0 > 1`,
+		`messages % 0.5 > 1`,
+		`size(messages) > 0`,
+		`model[0] == "g"`,
+	} {
+		program, err := Compile(source, []string{"model", "messages"})
+		if err != nil {
+			t.Errorf("%s: failed to compile: %v", source, err)
+			continue
+		}
+		if _, err := program.EvalBool(variables); err == nil {
+			t.Errorf("%s: expected an evaluation error", source)
+		}
+	}
+	program, _ := Compile(`model`, []string{"model"})
+	if _, err := program.EvalBool(variables); err == nil || !strings.Contains(err.Error(), "not a bool") {
+		t.Errorf("Expected a non-bool result to be an error, got: %v", err)
+	}
+}
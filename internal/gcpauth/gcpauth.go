@@ -0,0 +1,237 @@
+// Package gcpauth obtains Google OAuth access tokens from application default
+// credentials: a service account or authorized user JSON file, or the GCE
+// metadata server. Tokens are cached and refreshed shortly before expiry.
+package gcpauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CloudPlatformScope is the OAuth scope covering Vertex AI.
+const CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+const (
+	defaultTokenURL = "https://oauth2.googleapis.com/token"
+	metadataURL     = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	// refreshMargin renews tokens this long before they expire.
+	refreshMargin = time.Minute
+)
+
+// TokenSource returns a valid access token, fetching a new one when the
+// cached token is missing or about to expire.
+type TokenSource struct {
+	fetch func(ctx context.Context) (string, time.Duration, error)
+	now   func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// Token returns a cached token or fetches a fresh one.
+func (s *TokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && s.now().Before(s.expiry.Add(-refreshMargin)) {
+		return s.token, nil
+	}
+	token, lifetime, err := s.fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expiry = token, s.now().Add(lifetime)
+	return token, nil
+}
+
+var (
+	defaultsMu sync.Mutex
+	defaults   = make(map[string]*TokenSource)
+)
+
+// Default returns the shared token source for a credentials file, or for
+// application default credentials when path is empty. The credentials are
+// resolved lazily, on the first Token call.
+func Default(path string) *TokenSource {
+	defaultsMu.Lock()
+	defer defaultsMu.Unlock()
+	if source, ok := defaults[path]; ok {
+		return source
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	source := &TokenSource{now: time.Now}
+	source.fetch = func(ctx context.Context) (string, time.Duration, error) {
+		credentialsPath := path
+		if credentialsPath == "" {
+			credentialsPath = findCredentialsFile()
+		}
+		if credentialsPath == "" {
+			return fetchMetadataToken(ctx, client)
+		}
+		creds, err := loadCredentials(credentialsPath)
+		if err != nil {
+			return "", 0, err
+		}
+		return creds.fetchToken(ctx, client, time.Now())
+	}
+	defaults[path] = source
+	return source
+}
+
+// findCredentialsFile follows the ADC lookup order: the
+// GOOGLE_APPLICATION_CREDENTIALS variable, then gcloud's well-known file.
+func findCredentialsFile() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return path
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(configDir, "gcloud", "application_default_credentials.json")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// credentials is the union of the service_account and authorized_user
+// JSON credential formats.
+type credentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func loadCredentials(path string) (*credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Google credentials: %w", err)
+	}
+	var creds credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse Google credentials %s: %w", path, err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = defaultTokenURL
+	}
+	return &creds, nil
+}
+
+func (c *credentials) fetchToken(ctx context.Context, client *http.Client, now time.Time) (string, time.Duration, error) {
+	form := url.Values{}
+	switch c.Type {
+	case "service_account":
+		assertion, err := c.signedJWT(now)
+		if err != nil {
+			return "", 0, err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", c.ClientID)
+		form.Set("client_secret", c.ClientSecret)
+		form.Set("refresh_token", c.RefreshToken)
+	default:
+		return "", 0, fmt.Errorf("unsupported Google credentials type %q", c.Type)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(client, req)
+}
+
+// signedJWT builds the RS256 assertion for the service account JWT bearer grant.
+func (c *credentials) signedJWT(now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("service account private key is not PEM encoded")
+	}
+	var key *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return "", fmt.Errorf("service account private key is not an RSA key")
+		}
+		key = rsaKey
+	} else if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("failed to parse service account private key: %w", err)
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": c.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   c.ClientEmail,
+		"scope": CloudPlatformScope,
+		"aud":   c.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	encoding := base64.RawURLEncoding
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+func fetchMetadataToken(ctx context.Context, client *http.Client) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", metadataURL, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	token, lifetime, err := doTokenRequest(client, req)
+	if err != nil {
+		return "", 0, fmt.Errorf("no Google credentials file found and metadata server unavailable: %w", err)
+	}
+	return token, lifetime, nil
+}
+
+func doTokenRequest(client *http.Client, req *http.Request) (string, time.Duration, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	var tokenResp struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", 0, fmt.Errorf("failed to decode token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode >= 400 || tokenResp.AccessToken == "" {
+		return "", 0, fmt.Errorf("token request failed (status %d): %s %s", resp.StatusCode, tokenResp.Error, tokenResp.ErrorDescription)
+	}
+	return tokenResp.AccessToken, time.Duration(tokenResp.ExpiresIn) * time.Second, nil
+}
@@ -0,0 +1,115 @@
+package gcpauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	privateKey := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	requests := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			t.Errorf("Expected JWT bearer grant, got: %s", r.Form.Get("grant_type"))
+		}
+
+		// Verify the assertion was signed by the service account key
+		parts := strings.Split(r.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("Expected a three-part JWT, got: %q", r.Form.Get("assertion"))
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("Expected valid RS256 signature, got: %v", err)
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		if !strings.Contains(string(claims), `"iss":"broker@project.iam.gserviceaccount.com"`) || !strings.Contains(string(claims), CloudPlatformScope) {
+			t.Errorf("Expected issuer and scope claims, got: %s", claims)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "ya29.token", "expires_in": 3600, "token_type": "Bearer"}`))
+	}))
+	defer tokenServer.Close()
+
+	path := filepath.Join(t.TempDir(), "sa.json")
+	creds, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "broker@project.iam.gserviceaccount.com",
+		"private_key":  privateKey,
+		"token_uri":    tokenServer.URL,
+	})
+	if err := os.WriteFile(path, creds, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	source := Default(path)
+	for i := 0; i < 2; i++ {
+		token, err := source.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+		if token != "ya29.token" {
+			t.Errorf("Expected access token, got: %q", token)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected cached token to be reused, got %d token requests", requests)
+	}
+
+	// Near expiry the token is refreshed
+	source.now = func() time.Time { return time.Now().Add(59*time.Minute + 30*time.Second) }
+	if _, err := source.Token(context.Background()); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected refresh near expiry, got %d token requests", requests)
+	}
+}
+
+func TestAuthorizedUserToken(t *testing.T) {
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "1//refresh" {
+			t.Errorf("Expected refresh token grant, got: %v", r.Form)
+		}
+		w.Write([]byte(`{"access_token": "ya29.user", "expires_in": 3599}`))
+	}))
+	defer tokenServer.Close()
+
+	creds := &credentials{Type: "authorized_user", ClientID: "id", ClientSecret: "secret", RefreshToken: "1//refresh", TokenURI: tokenServer.URL}
+	token, lifetime, err := creds.fetchToken(context.Background(), http.DefaultClient, time.Now())
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if token != "ya29.user" || lifetime != 3599*time.Second {
+		t.Errorf("Expected user token with lifetime, got: %q %v", token, lifetime)
+	}
+
+	if _, _, err := (&credentials{Type: "external_account"}).fetchToken(context.Background(), http.DefaultClient, time.Now()); err == nil {
+		t.Error("Expected error for unsupported credentials type")
+	}
+}
@@ -0,0 +1,169 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pre-tokenizer patterns of the tiktoken encodings, split into pieces before
+// byte-pair merging. tiktoken ends both with \s+(?!\S), which RE2 cannot
+// express; split gives back the last whitespace character instead. Go's \s
+// is ASCII only, so whitespace is spelled out.
+const (
+	ws = `\t\n\v\f\r \x{85}\p{Z}`
+
+	cl100kPattern = `(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^` + ws + `\p{L}\p{N}]+[\r\n]*|[` + ws + `]*[\r\n]|[` + ws + `]+`
+
+	o200kPattern = `[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?` +
+		`|\p{N}{1,3}| ?[^` + ws + `\p{L}\p{N}]+[\r\n/]*|[` + ws + `]*[\r\n]+|[` + ws + `]+`
+)
+
+// Patterns maps the pre-tokenizer names a tiktoken file can be used with to
+// their patterns.
+var Patterns = map[string]string{
+	"cl100k": cl100kPattern,
+	"o200k":  o200kPattern,
+}
+
+// BPE is a tiktoken byte-pair encoding.
+type BPE struct {
+	name    string
+	ranks   map[string]int
+	pattern *regexp.Regexp
+}
+
+// LoadTiktoken reads a .tiktoken file, one base64 token and its rank per
+// line, to be used with the named pre-tokenizer ("cl100k" or "o200k").
+func LoadTiktoken(name, path, pattern string) (*BPE, error) {
+	expr, ok := Patterns[pattern]
+	if !ok {
+		return nil, fmt.Errorf("unknown pattern %q", pattern)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a token and its rank", path, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("%s: no tokens", path)
+	}
+	return &BPE{name: name, ranks: ranks, pattern: regexp.MustCompile(`\A(?:` + expr + `)`)}, nil
+}
+
+func (b *BPE) Name() string { return b.name }
+
+func (b *BPE) Exact() bool { return true }
+
+func (b *BPE) Count(text string) int {
+	return len(b.Encode(text))
+}
+
+func (b *BPE) Encode(text string) []int {
+	tokens := []int{}
+	for _, piece := range b.split(text) {
+		if rank, ok := b.ranks[piece]; ok {
+			tokens = append(tokens, rank)
+			continue
+		}
+		tokens = append(tokens, b.merge(piece)...)
+	}
+	return tokens
+}
+
+// split cuts text into pre-tokenizer pieces.
+func (b *BPE) split(text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := b.pattern.FindStringIndex(text)
+		end := 1
+		if loc != nil && loc[1] > 0 {
+			end = loc[1]
+		}
+		// \s+(?!\S): a run of spaces before a word leaves its last
+		// character to start the word's piece.
+		if piece := text[:end]; end < len(text) && isSpaces(piece) {
+			if _, size := utf8.DecodeLastRuneInString(piece); size < len(piece) {
+				end -= size
+			}
+		}
+		pieces = append(pieces, text[:end])
+		text = text[end:]
+	}
+	return pieces
+}
+
+// isSpaces reports whether s is whitespace without line breaks.
+func isSpaces(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) || r == '\r' || r == '\n' {
+			return false
+		}
+	}
+	return true
+}
+
+// merge applies byte-pair merges to a piece, joining the adjacent pair with
+// the lowest rank until no pair is a token.
+func (b *BPE) merge(piece string) []int {
+	// bounds[i] is where part i starts; the last entry is the end.
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := b.ranks[piece[bounds[i]:bounds[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	tokens := make([]int, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		rank, ok := b.ranks[piece[bounds[i]:bounds[i+1]]]
+		if !ok {
+			// Complete encodings have every byte; count a missing one
+			// as a token anyway.
+			rank = -1
+		}
+		tokens = append(tokens, rank)
+	}
+	return tokens
+}
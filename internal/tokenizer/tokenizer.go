@@ -0,0 +1,112 @@
+// Package tokenizer counts tokens locally, before a request reaches its
+// backend. OpenAI models are counted exactly with tiktoken BPE files the
+// operator provides; other models, and OpenAI ones without a file, get a
+// per-character approximation tuned for their tokenizer family.
+package tokenizer
+
+import (
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+// Tokenizer counts the tokens of text for one tokenizer.
+type Tokenizer interface {
+	Name() string
+	// Exact reports whether counts are exact rather than estimated.
+	Exact() bool
+	Count(text string) int
+	// Encode returns the token IDs of text, or nil if the tokenizer only
+	// estimates.
+	Encode(text string) []int
+}
+
+// Approximations built into every registry. Each estimates English text at
+// its tokenizer's average characters per token, and every other character
+// (such as CJK) as a token of its own.
+var (
+	Approximate = &approximation{name: "approximate", charsPerToken: 4}
+	Claude      = &approximation{name: "claude", charsPerToken: 3.5}
+	Llama       = &approximation{name: "llama", charsPerToken: 3.8}
+)
+
+// Builtin lists the names of the built-in tokenizers.
+var Builtin = []string{Approximate.name, Claude.name, Llama.name}
+
+type approximation struct {
+	name          string
+	charsPerToken float64
+}
+
+func (a *approximation) Name() string { return a.name }
+
+func (a *approximation) Exact() bool { return false }
+
+func (a *approximation) Encode(string) []int { return nil }
+
+func (a *approximation) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	ascii := 0
+	other := 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return int(math.Ceil(float64(ascii)/a.charsPerToken)) + other
+}
+
+// Registry holds the tokenizers available to models by name.
+type Registry struct {
+	tokenizers map[string]Tokenizer
+}
+
+// NewRegistry returns a registry of the built-in approximations and the
+// given tokenizers, which replace built-ins of the same name.
+func NewRegistry(tokenizers ...Tokenizer) *Registry {
+	r := &Registry{tokenizers: make(map[string]Tokenizer)}
+	for _, t := range []Tokenizer{Approximate, Claude, Llama} {
+		r.tokenizers[t.Name()] = t
+	}
+	for _, t := range tokenizers {
+		r.tokenizers[t.Name()] = t
+	}
+	return r
+}
+
+// Get returns the tokenizer with the given name.
+func (r *Registry) Get(name string) (Tokenizer, bool) {
+	t, ok := r.tokenizers[name]
+	return t, ok
+}
+
+// ForModel returns the tokenizer to count a model's tokens with: the named
+// one if set and known, or else one guessed from the provider type and
+// target model. OpenAI models use o200k_base or cl100k_base when those are
+// loaded.
+func (r *Registry) ForModel(name, providerType, targetModel string) Tokenizer {
+	if t, ok := r.tokenizers[name]; ok {
+		return t
+	}
+	model := strings.ToLower(targetModel)
+	guess := Approximate.name
+	switch {
+	case strings.Contains(model, "claude") || providerType == "anthropic" || providerType == "vertex_anthropic":
+		guess = Claude.name
+	case strings.Contains(model, "llama"):
+		guess = Llama.name
+	case strings.Contains(model, "gpt-4o") || strings.Contains(model, "gpt-4.1") || strings.Contains(model, "gpt-5") ||
+		strings.HasPrefix(model, "o1") || strings.HasPrefix(model, "o3") || strings.HasPrefix(model, "o4"):
+		guess = "o200k_base"
+	case strings.Contains(model, "gpt-4") || strings.Contains(model, "gpt-3.5") || strings.Contains(model, "text-embedding"):
+		guess = "cl100k_base"
+	}
+	if t, ok := r.tokenizers[guess]; ok {
+		return t
+	}
+	return Approximate
+}
@@ -0,0 +1,89 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeTiktoken writes a small encoding: every byte, then merges that build
+// "hello".
+func writeTiktoken(t *testing.T) string {
+	var lines []string
+	for b := 0; b < 256; b++ {
+		lines = append(lines, fmt.Sprintf("%s %d", base64.StdEncoding.EncodeToString([]byte{byte(b)}), b))
+	}
+	for i, token := range []string{"he", "ll", "hell"} {
+		lines = append(lines, fmt.Sprintf("%s %d", base64.StdEncoding.EncodeToString([]byte(token)), 256+i))
+	}
+	path := filepath.Join(t.TempDir(), "test.tiktoken")
+	os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644)
+	return path
+}
+
+func TestBPE(t *testing.T) {
+	bpe, err := LoadTiktoken("test", writeTiktoken(t), "cl100k")
+	if err != nil {
+		t.Fatalf("Expected the file to load, got: %v", err)
+	}
+
+	pieces := bpe.split("Hello world  don't\n\nbar 123456")
+	expected := []string{"Hello", " world", " ", " don", "'t", "\n\n", "bar", " ", "123", "456"}
+	if !reflect.DeepEqual(pieces, expected) {
+		t.Errorf("Expected pieces %q, got: %q", expected, pieces)
+	}
+
+	// "hello" merges to "he", "ll", then "hell", leaving "o"
+	if tokens := bpe.Encode("hello"); !reflect.DeepEqual(tokens, []int{258, 'o'}) {
+		t.Errorf("Expected [258 111], got: %v", tokens)
+	}
+	// " hello" has no merge for its space
+	if count := bpe.Count("hello hello"); count != 5 {
+		t.Errorf("Expected 5 tokens, got: %d", count)
+	}
+
+	if _, err := LoadTiktoken("test", writeTiktoken(t), "p50k"); err == nil {
+		t.Errorf("Expected an unknown pattern to fail")
+	}
+}
+
+func TestApproximation(t *testing.T) {
+	if count := Approximate.Count(strings.Repeat("a", 9)); count != 3 {
+		t.Errorf("Expected 3 tokens, got: %d", count)
+	}
+	if count := Claude.Count("abcdefg"); count != 2 {
+		t.Errorf("Expected 2 tokens, got: %d", count)
+	}
+	if count := Approximate.Count("日本語"); count != 3 {
+		t.Errorf("Expected a token per CJK character, got: %d", count)
+	}
+	if Claude.Exact() || Claude.Encode("abc") != nil {
+		t.Errorf("Expected approximations not to encode")
+	}
+}
+
+func TestRegistry_ForModel(t *testing.T) {
+	bpe, err := LoadTiktoken("o200k_base", writeTiktoken(t), "o200k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := NewRegistry(bpe)
+	for _, tc := range []struct {
+		name, providerType, model, expected string
+	}{
+		{"", "openai", "gpt-4o-mini", "o200k_base"},
+		{"", "openai", "gpt-4", "approximate"}, // cl100k_base is not loaded
+		{"", "anthropic", "claude-sonnet-4", "claude"},
+		{"", "ollama", "llama3.1:8b", "llama"},
+		{"claude", "openai", "gpt-4o", "claude"},
+		{"", "cohere", "command-r", "approximate"},
+	} {
+		if got := registry.ForModel(tc.name, tc.providerType, tc.model).Name(); got != tc.expected {
+			t.Errorf("Expected %s for %s, got: %s", tc.expected, tc.model, got)
+		}
+	}
+}
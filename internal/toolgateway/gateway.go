@@ -0,0 +1,153 @@
+// Package toolgateway executes tools on behalf of models, either by calling
+// configured webhooks or by proxying to Model Context Protocol servers.
+package toolgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+const (
+	// callTimeout bounds a single webhook or MCP exchange.
+	callTimeout = 60 * time.Second
+	// maxResultBytes caps how much of a tool's response is read.
+	maxResultBytes = 1 << 20
+)
+
+// Gateway resolves tool definitions and dispatches tool calls. Calls are
+// looked up among the gateway tool names configured for the calling model,
+// so a model can only run the tools it was given.
+type Gateway struct {
+	client   *http.Client
+	webhooks map[string]config.GatewayTool
+	servers  map[string]*mcpClient
+}
+
+// New creates a Gateway from the [gateway] configuration section.
+func New(cfg config.GatewayConfig) *Gateway {
+	g := &Gateway{
+		client:   &http.Client{Timeout: callTimeout},
+		webhooks: make(map[string]config.GatewayTool),
+		servers:  make(map[string]*mcpClient),
+	}
+	for _, tool := range cfg.Tools {
+		g.webhooks[tool.Name] = tool
+	}
+	for _, server := range cfg.MCPServers {
+		g.servers[server.Name] = &mcpClient{server: server, client: g.client}
+	}
+	return g
+}
+
+// Definitions returns the tools to offer the model for the given names. A
+// name is either a webhook tool or an MCP server, which contributes all of
+// its tools.
+func (g *Gateway) Definitions(ctx context.Context, names []string) ([]adapters.UnifiedTool, error) {
+	var tools []adapters.UnifiedTool
+	for _, name := range names {
+		if tool, ok := g.webhooks[name]; ok {
+			tools = append(tools, adapters.UnifiedTool{
+				Type: "function",
+				Function: adapters.UnifiedFunction{
+					Name:        tool.Name,
+					Description: tool.Description,
+					Parameters:  tool.Parameters,
+				},
+			})
+			continue
+		}
+
+		server, ok := g.servers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown gateway tool or MCP server %q", name)
+		}
+		serverTools, err := server.listTools(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tools from MCP server %q: %w", name, err)
+		}
+		tools = append(tools, serverTools...)
+	}
+	return tools, nil
+}
+
+// Handles reports whether the named tool is executed by the broker for a
+// model configured with the given gateway tool names.
+func (g *Gateway) Handles(names []string, tool string) bool {
+	webhook, server := g.owner(names, tool)
+	return webhook != nil || server != nil
+}
+
+// Call executes a tool with JSON-encoded arguments and returns its textual
+// result for the model. Names are the model's gateway tool names.
+func (g *Gateway) Call(ctx context.Context, names []string, tool, arguments string) (string, error) {
+	args := json.RawMessage(arguments)
+	if !json.Valid(args) {
+		args = json.RawMessage("{}")
+	}
+
+	webhook, server := g.owner(names, tool)
+	switch {
+	case webhook != nil:
+		return g.callWebhook(ctx, *webhook, args)
+	case server != nil:
+		return server.callTool(ctx, tool, args)
+	}
+	return "", fmt.Errorf("tool %q is not served by the gateway", tool)
+}
+
+// owner finds the webhook or MCP server behind a tool among the given
+// gateway tool names. When several offer the same tool, the first listed
+// wins. MCP servers only own tools they have listed already.
+func (g *Gateway) owner(names []string, tool string) (*config.GatewayTool, *mcpClient) {
+	for _, name := range names {
+		if webhook, ok := g.webhooks[name]; ok && name == tool {
+			return &webhook, nil
+		}
+		if server, ok := g.servers[name]; ok && server.hasTool(tool) {
+			return nil, server
+		}
+	}
+	return nil, nil
+}
+
+func (g *Gateway) callWebhook(ctx context.Context, tool config.GatewayTool, args json.RawMessage) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"name":      tool.Name,
+		"arguments": args,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", tool.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	result, err := io.ReadAll(io.LimitReader(resp.Body, maxResultBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(result) > maxResultBytes {
+		return "", fmt.Errorf("webhook response exceeds %d bytes", maxResultBytes)
+	}
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, result)
+	}
+	return string(result), nil
+}
@@ -0,0 +1,137 @@
+package toolgateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"lmbroker/internal/config"
+)
+
+func TestGateway_Webhook(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Name      string            `json:"name"`
+			Arguments map[string]string `json:"arguments"`
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		io.WriteString(w, "sunny in "+payload.Arguments["city"])
+	}))
+	defer webhook.Close()
+
+	gateway := New(config.GatewayConfig{
+		Tools: []config.GatewayTool{{
+			Name:       "get_weather",
+			Parameters: map[string]interface{}{"type": "object"},
+			Webhook:    webhook.URL,
+		}},
+	})
+
+	tools, err := gateway.Definitions(context.Background(), []string{"get_weather"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(tools) != 1 || tools[0].Function.Name != "get_weather" {
+		t.Fatalf("Expected get_weather definition, got: %+v", tools)
+	}
+	names := []string{"get_weather"}
+	if !gateway.Handles(names, "get_weather") || gateway.Handles(names, "other") {
+		t.Error("Expected gateway to handle only get_weather")
+	}
+	if gateway.Handles(nil, "get_weather") {
+		t.Error("Expected get_weather to be unavailable to models without it")
+	}
+
+	result, err := gateway.Call(context.Background(), names, "get_weather", `{"city": "Paris"}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result != "sunny in Paris" {
+		t.Errorf("Expected webhook result, got: %q", result)
+	}
+
+	if _, err := gateway.Definitions(context.Background(), []string{"missing"}); err == nil {
+		t.Error("Expected error for unknown tool name")
+	}
+}
+
+func TestGateway_MCP(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg struct {
+			ID     *int            `json:"id"`
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&msg)
+		methods = append(methods, msg.Method)
+
+		if msg.Method != "initialize" && r.Header.Get("Mcp-Session-Id") != "session-1" {
+			t.Errorf("Expected session header on %s, got: %q", msg.Method, r.Header.Get("Mcp-Session-Id"))
+		}
+		if msg.ID == nil {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+
+		var result string
+		switch msg.Method {
+		case "initialize":
+			w.Header().Set("Mcp-Session-Id", "session-1")
+			result = `{"protocolVersion": "2025-03-26", "capabilities": {"tools": {}}, "serverInfo": {"name": "docs"}}`
+		case "tools/list":
+			result = `{"tools": [{"name": "search_docs", "description": "Search the docs", "inputSchema": {"type": "object"}}]}`
+		case "tools/call":
+			result = `{"content": [{"type": "text", "text": "found 3 pages"}], "isError": false}`
+		}
+		// Answer tool calls over SSE to exercise both response modes.
+		response, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": *msg.ID, "result": json.RawMessage(result)})
+		if msg.Method == "tools/call" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "event: message\ndata: "+string(response)+"\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	gateway := New(config.GatewayConfig{
+		MCPServers: []config.MCPServer{{Name: "docs", URL: server.URL}},
+	})
+
+	tools, err := gateway.Definitions(context.Background(), []string{"docs"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(tools) != 1 || tools[0].Function.Name != "search_docs" || tools[0].Function.Parameters["type"] != "object" {
+		t.Fatalf("Expected search_docs definition, got: %+v", tools)
+	}
+	names := []string{"docs"}
+	if !gateway.Handles(names, "search_docs") {
+		t.Error("Expected gateway to handle discovered MCP tool")
+	}
+	if gateway.Handles([]string{"other"}, "search_docs") {
+		t.Error("Expected search_docs to be unavailable to models without the docs server")
+	}
+	if _, err := gateway.Call(context.Background(), []string{"other"}, "search_docs", `{}`); err == nil {
+		t.Error("Expected a call outside the model's tools to fail")
+	}
+
+	result, err := gateway.Call(context.Background(), names, "search_docs", `{"query": "retries"}`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if result != "found 3 pages" {
+		t.Errorf("Expected MCP tool result, got: %q", result)
+	}
+
+	expected := "initialize,notifications/initialized,tools/list,tools/call"
+	if got := strings.Join(methods, ","); got != expected {
+		t.Errorf("Expected methods %s, got: %s", expected, got)
+	}
+}
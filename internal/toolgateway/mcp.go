@@ -0,0 +1,252 @@
+package toolgateway
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"lmbroker/internal/adapters"
+	"lmbroker/internal/config"
+)
+
+const mcpProtocolVersion = "2025-03-26"
+
+// maxMessageBytes caps how much of one MCP response is read.
+const maxMessageBytes = 16 << 20
+
+// mcpClient speaks JSON-RPC to one MCP server over the streamable HTTP
+// transport. The session is initialized lazily and tool listings are cached.
+type mcpClient struct {
+	server config.MCPServer
+	client *http.Client
+
+	mu        sync.Mutex
+	ready     bool
+	sessionID string
+	nextID    int
+	tools     []adapters.UnifiedTool
+}
+
+type rpcResponse struct {
+	ID     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (m *mcpClient) listTools(ctx context.Context) ([]adapters.UnifiedTool, error) {
+	m.mu.Lock()
+	cached := m.tools
+	m.mu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	result, err := m.call(ctx, "tools/list", map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	var listing struct {
+		Tools []struct {
+			Name        string                 `json:"name"`
+			Description string                 `json:"description"`
+			InputSchema map[string]interface{} `json:"inputSchema"`
+		} `json:"tools"`
+	}
+	if err := json.Unmarshal(result, &listing); err != nil {
+		return nil, err
+	}
+
+	tools := make([]adapters.UnifiedTool, 0, len(listing.Tools))
+	for _, tool := range listing.Tools {
+		tools = append(tools, adapters.UnifiedTool{
+			Type: "function",
+			Function: adapters.UnifiedFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	m.mu.Lock()
+	m.tools = tools
+	m.mu.Unlock()
+	return tools, nil
+}
+
+// hasTool reports whether the server's cached listing includes the tool.
+func (m *mcpClient) hasTool(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tool := range m.tools {
+		if tool.Function.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *mcpClient) callTool(ctx context.Context, name string, args json.RawMessage) (string, error) {
+	result, err := m.call(ctx, "tools/call", map[string]interface{}{
+		"name":      name,
+		"arguments": args,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var callResult struct {
+		Content []json.RawMessage `json:"content"`
+		IsError bool              `json:"isError"`
+	}
+	if err := json.Unmarshal(result, &callResult); err != nil {
+		return "", err
+	}
+
+	// Text parts are concatenated; anything else (images, resources) is
+	// passed to the model as its JSON form.
+	var parts []string
+	for _, raw := range callResult.Content {
+		var part struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(raw, &part); err == nil && part.Type == "text" {
+			parts = append(parts, part.Text)
+		} else {
+			parts = append(parts, string(raw))
+		}
+	}
+	output := strings.Join(parts, "\n")
+	if callResult.IsError {
+		return "", fmt.Errorf("%s", output)
+	}
+	return output, nil
+}
+
+// call sends a JSON-RPC request, initializing the session first if needed.
+func (m *mcpClient) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.ready {
+		if _, err := m.send(ctx, "initialize", map[string]interface{}{
+			"protocolVersion": mcpProtocolVersion,
+			"capabilities":    map[string]interface{}{},
+			"clientInfo":      map[string]string{"name": "lmbroker", "version": "1.0"},
+		}); err != nil {
+			return nil, fmt.Errorf("initialize: %w", err)
+		}
+		if err := m.notify(ctx, "notifications/initialized"); err != nil {
+			return nil, fmt.Errorf("initialize: %w", err)
+		}
+		m.ready = true
+	}
+
+	result, err := m.send(ctx, method, params)
+	if err != nil {
+		// A stale session is dropped so the next call re-initializes.
+		m.ready = false
+		m.sessionID = ""
+		return nil, err
+	}
+	return result, nil
+}
+
+func (m *mcpClient) send(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	m.nextID++
+	id := m.nextID
+	resp, err := m.post(ctx, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if sessionID := resp.Header.Get("Mcp-Session-Id"); sessionID != "" {
+		m.sessionID = sessionID
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("MCP server returned status %d", resp.StatusCode)
+	}
+
+	// Servers may answer with a single JSON body or an SSE stream that
+	// eventually carries the response with our id.
+	body := io.LimitReader(resp.Body, maxMessageBytes)
+	var rpc rpcResponse
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		found := false
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxMessageBytes)
+		for scanner.Scan() {
+			payload, ok := strings.CutPrefix(scanner.Text(), "data:")
+			if !ok {
+				continue
+			}
+			var event rpcResponse
+			if err := json.Unmarshal([]byte(strings.TrimSpace(payload)), &event); err != nil || event.ID == nil || *event.ID != id {
+				continue
+			}
+			rpc, found = event, true
+			break
+		}
+		if !found {
+			return nil, fmt.Errorf("MCP stream ended without a response to %s", method)
+		}
+	} else if err := json.NewDecoder(body).Decode(&rpc); err != nil {
+		return nil, err
+	}
+
+	if rpc.Error != nil {
+		return nil, fmt.Errorf("MCP error %d: %s", rpc.Error.Code, rpc.Error.Message)
+	}
+	return rpc.Result, nil
+}
+
+func (m *mcpClient) notify(ctx context.Context, method string) error {
+	resp, err := m.post(ctx, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  method,
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("MCP server returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (m *mcpClient) post(ctx context.Context, message map[string]interface{}) (*http.Response, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", m.server.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	if m.sessionID != "" {
+		req.Header.Set("Mcp-Session-Id", m.sessionID)
+	}
+	for key, value := range m.server.Headers {
+		req.Header.Set(key, value)
+	}
+	return m.client.Do(req)
+}
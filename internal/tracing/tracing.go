@@ -0,0 +1,393 @@
+// Package tracing records request spans and exports them to an
+// OpenTelemetry collector with OTLP over HTTP (JSON encoding). It supports
+// W3C traceparent propagation so broker spans join the caller's trace and
+// backends can continue it.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind is the OTLP span kind.
+type Kind int
+
+const (
+	KindServer Kind = 2
+	KindClient Kind = 3
+)
+
+const (
+	// batchSize is the most spans sent in one export request.
+	batchSize = 512
+	// flushInterval is how often buffered spans are exported.
+	flushInterval = 5 * time.Second
+	// queueSize bounds the spans waiting for export; more are dropped.
+	queueSize = 4096
+)
+
+// Options configure a Tracer.
+type Options struct {
+	// Endpoint is the OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces.
+	Endpoint string
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	// Headers are added to every export request, e.g. for authentication.
+	Headers map[string]string
+}
+
+// Tracer batches ended spans and exports them in the background.
+type Tracer struct {
+	opts   Options
+	client *http.Client
+	queue  chan *Span
+	stop   chan struct{}
+	done   chan struct{}
+	closed sync.Once
+}
+
+// New starts a tracer exporting to opts.Endpoint.
+func New(opts Options) *Tracer {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "lmbroker"
+	}
+	t := &Tracer{
+		opts:   opts,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+var defaultTracer atomic.Pointer[Tracer]
+
+// SetDefault makes t the tracer used by Start. Without one, Start returns
+// nil spans and tracing costs nothing.
+func SetDefault(t *Tracer) {
+	defaultTracer.Store(t)
+}
+
+// Shutdown exports the spans still queued and stops the tracer. Spans that
+// end afterwards, such as those of background work outliving the server,
+// are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.closed.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				t.export(batch)
+				batch = nil
+			}
+		case <-t.stop:
+			// The queue is never closed, so late spans cannot panic; the
+			// ones already queued are exported with the last batch.
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= batchSize {
+						t.export(batch)
+						batch = nil
+					}
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		}
+	}
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+	select {
+	case t.queue <- span:
+	default:
+		slog.Warn("trace export queue full, dropping span", "name", span.name)
+	}
+}
+
+// export sends a batch of spans as an OTLP ExportTraceServiceRequest.
+func (t *Tracer) export(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]map[string]interface{}, len(batch))
+	for i, span := range batch {
+		spans[i] = span.otlp()
+	}
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttribute("service.name", t.opts.ServiceName)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "lmbroker"},
+				"spans": spans,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("failed to encode spans", "error", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", t.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("failed to create trace export request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.opts.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		slog.Warn("failed to export spans", "endpoint", t.opts.Endpoint, "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("trace collector rejected spans", "endpoint", t.opts.Endpoint, "status", resp.StatusCode)
+	}
+}
+
+// spanContext identifies a span across process boundaries.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteParentKey
+)
+
+// Span is one timed operation. All methods are safe on a nil span, which
+// is what Start returns when tracing is disabled.
+type Span struct {
+	tracer   *Tracer
+	ctx      spanContext
+	parentID [8]byte
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []map[string]interface{}
+	errMessage string
+	failed     bool
+}
+
+// Start begins a span as a child of the span in ctx, or of a remote parent
+// extracted from incoming headers, or as the root of a new trace.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	tracer := defaultTracer.Load()
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{tracer: tracer, name: name, kind: kind, start: time.Now()}
+	if parent, ok := ctx.Value(spanKey).(*Span); ok && parent != nil {
+		span.ctx.traceID, span.ctx.sampled, span.parentID = parent.ctx.traceID, parent.ctx.sampled, parent.ctx.spanID
+	} else if remote, ok := ctx.Value(remoteParentKey).(spanContext); ok {
+		span.ctx.traceID, span.ctx.sampled, span.parentID = remote.traceID, remote.sampled, remote.spanID
+	} else {
+		rand.Read(span.ctx.traceID[:])
+		span.ctx.sampled = true
+	}
+	rand.Read(span.ctx.spanID[:])
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// FromContext returns the current span of ctx, or nil.
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// SetAttribute records a string, integer, float, boolean or string slice
+// attribute on the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, otlpAttribute(key, value))
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed, s.errMessage = true, message
+}
+
+// End finishes the span and queues it for export if its trace is sampled.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if ended || !s.ctx.sampled {
+		return
+	}
+	s.tracer.enqueue(s)
+}
+
+// otlp encodes the span in the OTLP JSON format.
+func (s *Span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.ctx.traceID[:]),
+		"spanId":            hex.EncodeToString(s.ctx.spanID[:]),
+		"name":              s.name,
+		"kind":              int(s.kind),
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        s.attributes,
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failed {
+		span["status"] = map[string]interface{}{"code": 2, "message": s.errMessage}
+	}
+	return span
+}
+
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": otlpValue(value)}
+}
+
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case []string:
+		values := make([]map[string]interface{}, len(v))
+		for i, item := range v {
+			values[i] = otlpValue(item)
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// Extract reads a W3C traceparent header so spans started from the
+// returned context join the caller's trace.
+func Extract(ctx context.Context, header http.Header) context.Context {
+	parts := strings.Split(strings.TrimSpace(header.Get("traceparent")), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	var remote spanContext
+	traceID, err1 := hex.DecodeString(parts[1])
+	spanID, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return ctx
+	}
+	copy(remote.traceID[:], traceID)
+	copy(remote.spanID[:], spanID)
+	if remote.traceID == [16]byte{} || remote.spanID == [8]byte{} {
+		return ctx
+	}
+	remote.sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, remoteParentKey, remote)
+}
+
+// Inject sets the traceparent header for an outgoing request so the
+// receiver continues the trace of the current span in ctx. Without a local
+// span, the caller's traceparent is passed on unchanged.
+func Inject(ctx context.Context, header http.Header) {
+	var current spanContext
+	if span := FromContext(ctx); span != nil {
+		current = span.ctx
+	} else if remote, ok := ctx.Value(remoteParentKey).(spanContext); ok {
+		current = remote
+	} else {
+		return
+	}
+	flags := "00"
+	if current.sampled {
+		flags = "01"
+	}
+	header.Set("traceparent", "00-"+hex.EncodeToString(current.traceID[:])+"-"+hex.EncodeToString(current.spanID[:])+"-"+flags)
+}
+
+// Operation returns the GenAI operation name for an API path.
+func Operation(path string) string {
+	switch {
+	case strings.Contains(path, "embed"):
+		return "embeddings"
+	case strings.HasSuffix(path, "/completions") && !strings.HasSuffix(path, "/chat/completions"):
+		return "text_completion"
+	case strings.Contains(path, "/images/"):
+		return "image_generation"
+	case strings.Contains(path, "/audio/"):
+		return "audio"
+	default:
+		return "chat"
+	}
+}
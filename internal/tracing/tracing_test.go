@@ -0,0 +1,94 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExtractInject(t *testing.T) {
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := Extract(context.Background(), incoming)
+
+	// Without a tracer the caller's context is passed on unchanged.
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if got := outgoing.Get("traceparent"); got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Expected the incoming traceparent, got: %q", got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		incoming.Set("traceparent", invalid)
+		outgoing := http.Header{}
+		Inject(Extract(context.Background(), incoming), outgoing)
+		if got := outgoing.Get("traceparent"); got != "" {
+			t.Errorf("Expected %q to be ignored, got: %q", invalid, got)
+		}
+	}
+}
+
+func TestStartWithoutTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "chat", KindServer)
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatalf("Expected no span without a tracer, got: %v", span)
+	}
+	// Span methods are safe on the nil span.
+	span.SetAttribute("gen_ai.request.model", "gpt-4")
+	span.SetError("failed")
+	span.End()
+}
+
+func TestOperation(t *testing.T) {
+	for path, want := range map[string]string{
+		"/v1/chat/completions": "chat",
+		"/v1/messages":         "chat",
+		"/v1/completions":      "text_completion",
+		"/v1/embeddings":       "embeddings",
+		"/api/embed":           "embeddings",
+	} {
+		if got := Operation(path); got != want {
+			t.Errorf("Expected %s for %s, got: %s", want, path, got)
+		}
+	}
+}
+
+func TestTracer_EndAfterShutdown(t *testing.T) {
+	exported := make(chan string, 2)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		exported <- string(body)
+	}))
+	defer collector.Close()
+
+	tracer := New(Options{Endpoint: collector.URL})
+	SetDefault(tracer)
+	defer SetDefault(nil)
+
+	_, before := Start(context.Background(), "before", KindServer)
+	_, after := Start(context.Background(), "after", KindServer)
+	before.End()
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	// Spans ending after shutdown are dropped rather than panicking.
+	after.End()
+
+	select {
+	case body := <-exported:
+		if !strings.Contains(body, `"before"`) || strings.Contains(body, `"after"`) {
+			t.Errorf("Expected only the span ended before shutdown, got: %s", body)
+		}
+	default:
+		t.Fatal("Expected the queued span to be exported on shutdown")
+	}
+}